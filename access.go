@@ -0,0 +1,97 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	authorizationv1 "github.com/ericchiang/k8s/apis/authorization/v1"
+	"github.com/pkg/errors"
+)
+
+// CanI asks the apiserver, with a SelfSubjectAccessReview, whether the
+// client is allowed to perform the verb on the resource in the
+// namespace.  Use k8s.AllNamespaces to ask about all namespaces, or a
+// cluster-scoped resource.
+func CanI(ctx context.Context, client *k8s.Client, verb string, resource APIResource, namespace string) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: &authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: k8s.String(namespace),
+				Verb:      k8s.String(verb),
+				Group:     k8s.String(resource.Group),
+				Version:   k8s.String(resource.Version),
+				Resource:  k8s.String(resource.Name),
+			},
+		},
+	}
+	var ret authorizationv1.SelfSubjectAccessReview
+	err := doJSON(ctx, client, request{
+		verb: http.MethodPost,
+		path: "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews",
+	}, review, &ret)
+	if err != nil {
+		return false, errors.Wrapf(err, "review %s %s", verb, resource.Name)
+	}
+	return ret.GetStatus().GetAllowed(), nil
+}
+
+// A PreflightError lists the permissions that the WatchingStore's
+// watches need, but don't have.
+type PreflightError struct {
+	Missing []*PermissionError
+}
+
+func (e *PreflightError) Error() string {
+	missing := make([]string, len(e.Missing))
+	for i, p := range e.Missing {
+		missing[i] = p.Error()
+	}
+	return "missing permissions (grant them with a Role or ClusterRole): " + strings.Join(missing, "; ")
+}
+
+// Unwrap returns the first of the missing permissions, so that
+// errors.As finds a *PermissionError.
+func (e *PreflightError) Unwrap() error {
+	if len(e.Missing) == 0 {
+		return nil
+	}
+	return e.Missing[0]
+}
+
+// preflight checks that every watch is allowed to list and watch its
+// resources, returning a *PreflightError if any aren't.  Watches of
+// types that aren't registered with the k8s package aren't checked.
+func (w *WatchingStore) preflight(ctx context.Context) error {
+	var missing []*PermissionError
+	for _, wa := range w.watches {
+		resource, err := apiResourceForList(wa.list)
+		if err != nil {
+			continue
+		}
+		namespace := wa.namespace
+		if !resource.Namespaced {
+			namespace = k8s.AllNamespaces
+		}
+		for _, verb := range []string{"list", "watch"} {
+			allowed, err := CanI(ctx, w.client, verb, resource, namespace)
+			if err != nil {
+				return errors.Wrap(err, "preflight")
+			}
+			if !allowed {
+				missing = append(missing, &PermissionError{
+					Verb:      verb,
+					GVR:       resource.GroupVersionResource(),
+					Namespace: namespace,
+				})
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return &PreflightError{Missing: missing}
+	}
+	return nil
+}
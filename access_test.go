@@ -0,0 +1,71 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestCanI(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.deny("watch", "configmaps")
+	configMaps := k8sutil.APIResource{Version: "v1", Name: "configmaps", Kind: "ConfigMap", Namespaced: true}
+	for verb, want := range map[string]bool{"list": true, "watch": false} {
+		allowed, err := k8sutil.CanI(context.Background(), server.client(), verb, configMaps, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != want {
+			t.Errorf("%s: got %v, want %v", verb, allowed, want)
+		}
+	}
+}
+
+// TestPreflight checks that Run returns a *PreflightError listing every
+// missing permission, without starting any watches.
+func TestPreflight(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.deny("watch", "configmaps")
+	server.deny("list", "namespaces")
+	w := &k8sutil.WatchingStore{
+		Client:    server.client(),
+		Logger:    testLogger{t},
+		Callback:  func(k8sutil.Store) { t.Error("called the Callback") },
+		Preflight: true,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{})
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := w.Run(ctx)
+	preflightErr, ok := err.(*k8sutil.PreflightError)
+	if !ok {
+		t.Fatalf("got %v, want a *PreflightError", err)
+	}
+	var permErr *k8sutil.PermissionError
+	if !errors.As(err, &permErr) {
+		t.Errorf("%v is not a *PermissionError", err)
+	}
+	var got []string
+	for _, p := range preflightErr.Missing {
+		got = append(got, p.Error())
+	}
+	want := []string{`not permitted to watch configmaps.v1 in namespace "default"`, "not permitted to list namespaces.v1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got missing %q, want %q", got, want)
+	}
+	for _, line := range server.drain() {
+		if strings.HasPrefix(line, "GET /api/v1/") {
+			t.Errorf("got request %s", line)
+		}
+	}
+}
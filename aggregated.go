@@ -0,0 +1,305 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// A View is a type of resource that an APIService computes from the
+// contents of the store, such as the "effective routes" that a set of
+// Ingresses and Services amount to.
+type View struct {
+	Name       string // the plural resource name, e.g. "effectiveroutes"
+	Kind       string // e.g. "EffectiveRoute"
+	Namespaced bool
+
+	// Compute returns the resources of the view, given the store.
+	// It is called for each request, so it should be cheap, or
+	// cache its results by the Store's Sequence.  The resources
+	// are usually *Unstructured; their apiVersion and kind are set
+	// to the APIService's group and version and the View's Kind.
+	Compute func(Store) []k8s.Resource
+}
+
+// An APIService is the scaffolding of an aggregated API server,
+// publishing Views of the cluster state as first-class API objects in
+// its own API group and version, which kubectl and other clients reach
+// through the apiserver once an APIService object (apiregistration.k8s.io)
+// points at it.  It serves the get and list verbs on the Views, with
+// label and field selectors as a CacheServer does; the discovery
+// documents; an empty OpenAPI document; and /healthz, /livez, and
+// /readyz, which is ready once the store has synced.
+//
+// Serve it with TLS, e.g.
+//
+//	auth, err := k8sutil.LoadAuthDelegation(ctx, client)
+//	certPEM, keyPEM, err := k8sutil.SelfSignedCert("my-api.my-namespace.svc")
+//	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+//	api := &k8sutil.APIService{Store: store, Group: "routes.example.com", Version: "v1alpha1", Views: views, Auth: auth}
+//	server := &http.Server{Addr: ":8443", Handler: api, TLSConfig: api.TLSConfig(cert)}
+//	err = server.ListenAndServeTLS("", "")
+//
+// and give the APIService object the certificate as its caBundle.
+type APIService struct {
+	Store   *WatchingStore // must not be nil
+	Group   string         // must not be empty, e.g. "routes.example.com"
+	Version string         // must not be empty, e.g. "v1alpha1"
+	Views   []View
+
+	// Auth, if set, authenticates and authorizes every request
+	// other than the health checks.  If nil, every request is
+	// allowed, which is only suitable for testing.
+	Auth *AuthDelegation
+
+	// Logger, if set, is told about requests that fail to be
+	// authenticated or authorized because of an error.
+	Logger Logger
+}
+
+// apiServiceVerbs are the verbs that an APIService supports.
+var apiServiceVerbs = []string{"get", "list"}
+
+// TLSConfig returns the TLS configuration to serve the APIService with
+// the certificate: one that asks for the client certificates that
+// proxied requests are made with, if there is an Auth.
+func (a *APIService) TLSConfig(cert tls.Certificate) *tls.Config {
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if a.Auth != nil && a.Auth.ClientCAs != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = a.Auth.ClientCAs
+	}
+	return config
+}
+
+// ServeHTTP serves a request.
+func (a *APIService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz", "/livez":
+		_, _ = w.Write([]byte("ok"))
+		return
+	case "/readyz":
+		if _, err := a.Store.Snapshot(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "the "+a.Group+" API is read-only")
+		return
+	}
+
+	attrs := RequestAttributes{Verb: "get", Path: r.URL.Path}
+	var req cacheRequest
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	isResource := len(parts) > 3 && parts[0] == "apis" && parts[1] == a.Group && parts[2] == a.Version
+	if isResource {
+		var code int
+		var err error
+		req, code, err = parseCacheRequest(r, parts[3:], a.resource)
+		if err == nil && req.watch {
+			code, err = http.StatusMethodNotAllowed, errors.New("watch is not supported")
+		}
+		if err != nil {
+			writeStatus(w, code, strings.Replace(http.StatusText(code), " ", "", -1), err.Error())
+			return
+		}
+		attrs = RequestAttributes{
+			Verb:      "get",
+			Resource:  req.resource.APIResource,
+			Namespace: req.namespace,
+			Name:      req.name,
+			Path:      r.URL.Path,
+		}
+		if req.name == "" {
+			attrs.Verb = "list"
+		}
+	}
+	if !a.authorize(w, r, attrs) {
+		return
+	}
+
+	switch {
+	case isResource:
+		a.serveList(w, req)
+	case r.URL.Path == "/apis":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"kind":       "APIGroupList",
+			"apiVersion": "v1",
+			"groups":     []interface{}{a.apiGroup()},
+		})
+	case r.URL.Path == "/apis/"+a.Group:
+		writeJSON(w, http.StatusOK, a.apiGroup())
+	case r.URL.Path == "/apis/"+a.Group+"/"+a.Version:
+		writeJSON(w, http.StatusOK, apiResourceListObject(a.groupVersion(), a.resources()))
+	case r.URL.Path == "/openapi/v2":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"swagger":     "2.0",
+			"info":        map[string]interface{}{"title": a.Group, "version": a.Version},
+			"paths":       map[string]interface{}{},
+			"definitions": map[string]interface{}{},
+		})
+	case r.URL.Path == "/openapi/v3":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"paths": map[string]interface{}{}})
+	default:
+		writeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+	}
+}
+
+// authorize authenticates and authorizes the request, responding with
+// the failure if it isn't allowed.
+func (a *APIService) authorize(w http.ResponseWriter, r *http.Request, attrs RequestAttributes) bool {
+	if a.Auth == nil {
+		return true
+	}
+	user, err := a.Auth.Authenticate(r)
+	if err != nil {
+		writeStatus(w, http.StatusUnauthorized, "Unauthorized", err.Error())
+		return false
+	}
+	allowed, err := a.Auth.Authorize(r.Context(), user, attrs)
+	if err != nil {
+		if a.Logger != nil {
+			a.Logger.Errorf("%s: authorize %s: %v", a.Group, user.Name, err)
+		}
+		writeStatus(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return false
+	}
+	if !allowed {
+		what := attrs.Path
+		if attrs.Resource.Name != "" {
+			what = attrs.Resource.Name + "." + attrs.Resource.Group
+		}
+		writeStatus(w, http.StatusForbidden, "Forbidden",
+			fmt.Sprintf("user %q cannot %s %s", user.Name, attrs.Verb, what))
+		return false
+	}
+	return true
+}
+
+// serveList serves a get or list request for a View.
+func (a *APIService) serveList(w http.ResponseWriter, req cacheRequest) {
+	store, err := a.Store.Snapshot()
+	if err != nil {
+		writeStatus(w, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+		return
+	}
+	var resources []k8s.Resource
+	for _, view := range a.Views {
+		if view.Name == req.resource.Name {
+			resources = view.Compute(store)
+		}
+	}
+	sortResources(resources)
+	writeResources(w, req, store.Sequence(), resources)
+}
+
+func (a *APIService) groupVersion() string {
+	return GroupVersionKind{Group: a.Group, Version: a.Version}.APIVersion()
+}
+
+// apiGroup returns the discovery document of the API group.
+func (a *APIService) apiGroup() map[string]interface{} {
+	version := map[string]interface{}{"groupVersion": a.groupVersion(), "version": a.Version}
+	return map[string]interface{}{
+		"kind":             "APIGroup",
+		"apiVersion":       "v1",
+		"name":             a.Group,
+		"versions":         []interface{}{version},
+		"preferredVersion": version,
+	}
+}
+
+// resources returns the served types of the Views.
+func (a *APIService) resources() []servedResource {
+	ret := make([]servedResource, len(a.Views))
+	for i, view := range a.Views {
+		ret[i] = servedResource{APIResource: APIResource{
+			Group:      a.Group,
+			Version:    a.Version,
+			Name:       view.Name,
+			Kind:       view.Kind,
+			Namespaced: view.Namespaced,
+			Verbs:      apiServiceVerbs,
+			Preferred:  true,
+		}}
+	}
+	return ret
+}
+
+// resource returns the served type of the View with the name.
+func (a *APIService) resource(name string) (servedResource, bool) {
+	for _, resource := range a.resources() {
+		if resource.Name == name {
+			return resource, true
+		}
+	}
+	return servedResource{}, false
+}
+
+// SelfSignedCert returns a self-signed serving certificate and its key,
+// PEM-encoded, for the hosts (DNS names or IP addresses), valid for a
+// year.  It is for an APIService that doesn't have a certificate issued
+// to it: give the APIService object the certificate as its caBundle.
+func SelfSignedCert(hosts ...string) (certPEM, keyPEM []byte, err error) {
+	if len(hosts) == 0 {
+		return nil, nil, errors.New("SelfSignedCert: no hosts")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "generate key")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "generate serial number")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create certificate")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "encode key")
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
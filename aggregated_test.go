@@ -0,0 +1,159 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// countView is a View of one "ConfigMapCount" per namespace, with the
+// number of ConfigMaps in it.
+var countView = k8sutil.View{
+	Name:       "configmapcounts",
+	Kind:       "ConfigMapCount",
+	Namespaced: true,
+	Compute: func(store k8sutil.Store) []k8s.Resource {
+		counts := map[string]int{}
+		for _, resource := range store.List(&corev1.ConfigMap{}) {
+			counts[resource.GetMetadata().GetNamespace()]++
+		}
+		var ret []k8s.Resource
+		for namespace, n := range counts {
+			data, _ := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{"namespace": namespace, "name": "count"},
+				"count":    n,
+			})
+			u := &k8sutil.Unstructured{}
+			if err := json.Unmarshal(data, u); err != nil {
+				panic(err)
+			}
+			ret = append(ret, u)
+		}
+		return ret
+	},
+}
+
+func TestAPIService(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	server.set(newConfigMap("default", "b"))
+	server.set(newConfigMap("other", "c"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{})
+	api := &k8sutil.APIService{Store: w, Group: "counts.example.com", Version: "v1", Views: []k8sutil.View{countView}}
+	apiServer := httptest.NewServer(api)
+	defer apiServer.Close()
+	url := apiServer.URL
+	resp, err := http.Get(url + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("ready before the store synced: %d", resp.StatusCode)
+	}
+	runStore(t, w)
+	<-stores
+
+	var list struct {
+		Kind  string `json:"kind"`
+		Items []struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Count int `json:"count"`
+		} `json:"items"`
+	}
+	if code := getJSON(t, url+"/apis/counts.example.com/v1/configmapcounts", &list); code != http.StatusOK {
+		t.Fatalf("list: %d", code)
+	}
+	var got []string
+	for _, item := range list.Items {
+		got = append(got, item.APIVersion+" "+item.Kind+" "+item.Metadata.Namespace+"="+strconv.Itoa(item.Count))
+	}
+	if want := "counts.example.com/v1 ConfigMapCount default=2, counts.example.com/v1 ConfigMapCount other=1"; strings.Join(got, ", ") != want || list.Kind != "ConfigMapCountList" {
+		t.Errorf("listed %s %q, want %q", list.Kind, got, want)
+	}
+	var item map[string]interface{}
+	if code := getJSON(t, url+"/apis/counts.example.com/v1/namespaces/other/configmapcounts/count", &item); code != http.StatusOK || item["count"] != 1.0 {
+		t.Errorf("get: %d %v", code, item)
+	}
+
+	var discovery struct {
+		GroupVersion string `json:"groupVersion"`
+		Resources    []struct {
+			Name  string   `json:"name"`
+			Verbs []string `json:"verbs"`
+		} `json:"resources"`
+	}
+	getJSON(t, url+"/apis/counts.example.com/v1", &discovery)
+	if discovery.GroupVersion != "counts.example.com/v1" || len(discovery.Resources) != 1 ||
+		discovery.Resources[0].Name != "configmapcounts" || strings.Join(discovery.Resources[0].Verbs, ",") != "get,list" {
+		t.Errorf("discovered %+v", discovery)
+	}
+
+	var status map[string]interface{}
+	for path, want := range map[string]int{
+		"/apis/counts.example.com/v1/configmapcounts?watch=true": http.StatusMethodNotAllowed,
+		"/apis/counts.example.com/v1/widgets":                    http.StatusNotFound,
+		"/apis/other.example.com/v1":                             http.StatusNotFound,
+	} {
+		if code := getJSON(t, url+path, &status); code != want {
+			t.Errorf("GET %s: got %d, want %d", path, code, want)
+		}
+	}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestSelfSignedCert(t *testing.T) {
+	certPEM, keyPEM, err := k8sutil.SelfSignedCert("my-api.my-namespace.svc", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("my-api.my-namespace.svc"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := k8sutil.SelfSignedCert(); err == nil {
+		t.Errorf("made a certificate for no hosts")
+	}
+}
@@ -0,0 +1,912 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	authorizationv1 "github.com/ericchiang/k8s/apis/authorization/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/runtime"
+	"github.com/golang/protobuf/proto"
+
+	"github.com/datawire/k8sutil"
+)
+
+// timeout is how long a test waits for something that should happen.
+const timeout = 10 * time.Second
+
+// A fakeType is a type of resource that a fakeAPIServer serves.
+type fakeType struct {
+	prefix     string // "/api/v1" or "/apis/GROUP/VERSION"
+	resource   string
+	namespaced bool
+	sample     k8s.Resource
+	list       k8s.ResourceList
+}
+
+var fakeTypes = []fakeType{
+	{"/api/v1", "configmaps", true, &corev1.ConfigMap{}, &corev1.ConfigMapList{}},
+	{"/api/v1", "namespaces", false, &corev1.Namespace{}, &corev1.NamespaceList{}},
+}
+
+// apiVersion returns the apiVersion of objects of the type, e.g. "v1".
+func (ft fakeType) apiVersion() string {
+	return strings.TrimPrefix(strings.TrimPrefix(ft.prefix, "/api/"), "/apis/")
+}
+
+// kind returns the kind of objects of the type, e.g. "ConfigMap".
+func (ft fakeType) kind() string {
+	return reflect.TypeOf(ft.sample).Elem().Name()
+}
+
+func fakeTypeOf(resource k8s.Resource) fakeType {
+	for _, ft := range fakeTypes {
+		if reflect.TypeOf(ft.sample) == reflect.TypeOf(resource) {
+			return ft
+		}
+	}
+	panic(fmt.Sprintf("no fakeType for %T", resource))
+}
+
+// A fakePath is a parsed request path.
+type fakePath struct {
+	prefix    string
+	namespace string
+	resource  string
+	name      string
+}
+
+func parseFakePath(path string) (fakePath, bool) {
+	var p fakePath
+	var rest []string
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		p.prefix, rest = "/"+strings.Join(parts[:2], "/"), parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		p.prefix, rest = "/"+strings.Join(parts[:3], "/"), parts[3:]
+	default:
+		return p, false
+	}
+	if len(rest) >= 3 && rest[0] == "namespaces" {
+		p.namespace, rest = rest[1], rest[2:]
+	}
+	switch len(rest) {
+	case 1:
+		p.resource = rest[0]
+	case 2:
+		p.resource, p.name = rest[0], rest[1]
+	default:
+		return p, false
+	}
+	return p, p.served()
+}
+
+// served returns whether p is of one of the fakeTypes; the others are
+// Not Found, as they are of a real apiserver without them installed.
+func (p fakePath) served() bool {
+	for _, ft := range fakeTypes {
+		if ft.prefix == p.prefix && ft.resource == p.resource {
+			return true
+		}
+	}
+	return false
+}
+
+// collection returns the path of the collection of the objects that p
+// is of, across all namespaces.
+func (p fakePath) collection() string {
+	return p.prefix + "/" + p.resource
+}
+
+func (p fakePath) String() string {
+	ret := p.prefix
+	if p.namespace != "" {
+		ret += "/namespaces/" + p.namespace
+	}
+	return ret + "/" + p.resource + "/" + p.name
+}
+
+// A failure is how a fakeAPIServer fails requests: with the status
+// code, the headers, and the details of the Status in the body.
+type failure struct {
+	code    int
+	header  http.Header
+	details *metav1.StatusDetails
+}
+
+// A fakeRequest is a request that a fakeAPIServer has served.
+type fakeRequest struct {
+	verb   string // version, discovery, list, watch, get, create, update, patch, or delete
+	line   string // describing the request and its response
+	header http.Header
+}
+
+type fakeEvent struct {
+	eventType string
+	path      fakePath
+	object    map[string]interface{}
+	version   int
+}
+
+// A fakeAPIServer is an in-memory apiserver, for the requests that its
+// tests make: its version, discovery of the fakeTypes, and lists and
+// watches of them, in protobuf if the
+// request accepts it (as the k8s.Client's typed requests do) and in
+// JSON otherwise; and, in JSON, GET, PUT, and merge-patch PATCH of
+// objects, POST to collections, and DELETE with a UID precondition.
+// PUT and PATCH are conditional on the resourceVersion, if they have
+// one.  Tests change the objects with set and remove, each change (as
+// each write) being an event for watches.  Each request is logged.
+type fakeAPIServer struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	objects   map[string]map[string]interface{} // by fakePath.String()
+	paths     map[string]fakePath
+	events    []fakeEvent
+	version   int
+	release   k8s.Version        // served as /version
+	missing   map[string]bool    // group versions that fail discovery
+	watchList bool               // whether watches may send initial events
+	denied    map[string]bool    // "verb resource" that reviews deny
+	fail      map[string]failure // by verb
+	requests  []fakeRequest
+	changed   chan struct{} // closed, and replaced, on each change or request
+	closed    chan struct{}
+}
+
+func newFakeAPIServer(t *testing.T) *fakeAPIServer {
+	s := &fakeAPIServer{
+		t:       t,
+		objects: map[string]map[string]interface{}{},
+		paths:   map[string]fakePath{},
+		release: k8s.Version{Major: "1", Minor: "16", GitVersion: "v1.16.0"},
+		missing: map[string]bool{},
+		fail:    map[string]failure{},
+		denied:  map[string]bool{},
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(func() {
+		close(s.closed)
+		s.server.Close()
+	})
+	return s
+}
+
+// client returns a client of the server.
+func (s *fakeAPIServer) client() *k8s.Client {
+	return &k8s.Client{Endpoint: s.server.URL, Client: s.server.Client()}
+}
+
+// setRelease sets the Kubernetes version that the server claims to be.
+func (s *fakeAPIServer) setRelease(major, minor string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release = k8s.Version{Major: major, Minor: minor, GitVersion: "v" + major + "." + minor + ".0"}
+}
+
+// setWatchList sets whether the server allows streaming lists
+// (watches with sendInitialEvents=true), as it does if the WatchList
+// feature gate is enabled; otherwise it rejects them.
+func (s *fakeAPIServer) setWatchList(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchList = enabled
+}
+
+// deny makes the server's SelfSubjectAccessReviews deny the verb on
+// the resource (such as "configmaps"), in every namespace.
+func (s *fakeAPIServer) deny(verb, resource string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denied[verb+" "+resource] = true
+}
+
+// setUnavailable makes the server advertise the API group version (such
+// as "metrics.k8s.io/v1beta1"), but fail to discover its resources, as
+// it does when an aggregated API server is down.
+func (s *fakeAPIServer) setUnavailable(groupVersion string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.missing[groupVersion] = true
+}
+
+// setFailure makes requests of the verb fail as f says, until it is
+// called with a zero failure.
+func (s *fakeAPIServer) setFailure(verb string, f failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail[verb] = f
+}
+
+// set stores the resource, as an ADDED or MODIFIED event, giving it a
+// UID if it has none, and the next resourceVersion.  It returns that
+// resourceVersion.
+func (s *fakeAPIServer) set(resource k8s.Resource) string {
+	ft := fakeTypeOf(resource)
+	p := fakePathOf(resource)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object := jsonMap(s.t, resource)
+	object["apiVersion"], object["kind"] = ft.apiVersion(), ft.kind()
+	metadata := object["metadata"].(map[string]interface{})
+	setUID(p, metadata)
+	s.store(p, object)
+	return metadata["resourceVersion"].(string)
+}
+
+// remove deletes the resource, as a DELETED event.
+func (s *fakeAPIServer) remove(resource k8s.Resource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delete(fakePathOf(resource))
+}
+
+// object returns the stored object of the resource, or nil.
+func (s *fakeAPIServer) object(resource k8s.Resource) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[fakePathOf(resource).String()]
+}
+
+// fakePathOf returns the path of the resource.
+func fakePathOf(resource k8s.Resource) fakePath {
+	ft := fakeTypeOf(resource)
+	p := fakePath{prefix: ft.prefix, resource: ft.resource, name: resource.GetMetadata().GetName()}
+	if ft.namespaced {
+		p.namespace = resource.GetMetadata().GetNamespace()
+	}
+	return p
+}
+
+// setUID gives the object at p a UID, if it has none.
+func setUID(p fakePath, metadata map[string]interface{}) {
+	if _, ok := metadata["uid"]; ok {
+		return
+	}
+	metadata["uid"] = "uid-" + p.name
+	if p.namespace != "" {
+		metadata["uid"] = "uid-" + p.namespace + "-" + p.name
+	}
+}
+
+// store stores the object at p, with the next resourceVersion.
+func (s *fakeAPIServer) store(p fakePath, object map[string]interface{}) {
+	s.version++
+	object["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(s.version)
+	eventType := k8s.EventModified
+	if _, ok := s.objects[p.String()]; !ok {
+		eventType = k8s.EventAdded
+	}
+	s.objects[p.String()] = object
+	s.paths[p.String()] = p
+	s.events = append(s.events, fakeEvent{eventType, p, object, s.version})
+	s.notify()
+}
+
+func (s *fakeAPIServer) delete(p fakePath) {
+	object := s.objects[p.String()]
+	delete(s.objects, p.String())
+	s.version++
+	s.events = append(s.events, fakeEvent{k8s.EventDeleted, p, object, s.version})
+	s.notify()
+}
+
+// notify wakes up everything waiting for a change.  s.mu must be held.
+func (s *fakeAPIServer) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// nextRequest returns the next request that the server has served.
+func (s *fakeAPIServer) nextRequest() fakeRequest {
+	s.t.Helper()
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		if len(s.requests) > 0 {
+			r := s.requests[0]
+			s.requests = s.requests[1:]
+			s.mu.Unlock()
+			return r
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			s.t.Fatalf("timed out waiting for a request")
+		}
+	}
+}
+
+// await returns the next request of the verb, skipping others.
+func (s *fakeAPIServer) await(verb string) fakeRequest {
+	s.t.Helper()
+	for {
+		if r := s.nextRequest(); r.verb == verb {
+			return r
+		}
+	}
+}
+
+// next returns the next line of the log.
+func (s *fakeAPIServer) next() string {
+	s.t.Helper()
+	return s.nextRequest().line
+}
+
+// drain returns the lines of the log so far.
+func (s *fakeAPIServer) drain() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for _, r := range s.requests {
+		lines = append(lines, r.line)
+	}
+	s.requests = nil
+	return lines
+}
+
+func (s *fakeAPIServer) serve(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	p, ok := parseFakePath(r.URL.Path)
+	verb := map[string]string{
+		http.MethodGet:    "get",
+		http.MethodPost:   "create",
+		http.MethodPut:    "update",
+		http.MethodPatch:  "patch",
+		http.MethodDelete: "delete",
+	}[r.Method]
+	if r.URL.Path == "/version" {
+		verb, ok = "version", true
+	} else if r.URL.Path == reviewPath {
+		verb, ok = "review", true
+	} else if isDiscoveryPath(r.URL.Path) {
+		verb, ok = "discovery", true
+	} else if verb == "get" && p.name == "" {
+		verb = "list"
+		if r.URL.Query().Get("watch") == "true" {
+			verb = "watch"
+		}
+	}
+	line := r.Method + " " + r.URL.Path
+	if r.URL.RawQuery != "" {
+		line += "?" + r.URL.RawQuery
+	}
+	if r.Method == http.MethodPatch {
+		line += " (" + r.Header.Get("Content-Type") + ")"
+	}
+	if len(data) > 0 {
+		line += " " + string(data)
+	}
+
+	s.mu.Lock()
+	f, failed := s.fail[verb]
+	watchList := s.watchList
+	s.mu.Unlock()
+	code := http.StatusOK
+	var result map[string]interface{}
+	switch {
+	case failed && f.code != 0:
+		code = f.code
+	case !ok:
+		code = http.StatusNotFound
+	case verb == "watch" && r.URL.Query().Get("sendInitialEvents") == "true" && !watchList:
+		code = http.StatusUnprocessableEntity
+	case verb == "get" || verb == "create" || verb == "update" || verb == "patch" || verb == "delete":
+		code, result = s.write(r, p, verb, data)
+	}
+	s.log(fakeRequest{verb: verb, line: fmt.Sprintf("%s -> %d", line, code), header: r.Header})
+	if result != nil {
+		writeJSON(w, code, result)
+		return
+	}
+	if code >= http.StatusMultipleChoices {
+		for k, v := range f.header {
+			w.Header()[k] = v
+		}
+		s.writeStatus(w, r, code, f.details)
+		return
+	}
+	switch verb {
+	case "version":
+		s.mu.Lock()
+		release := s.release
+		s.mu.Unlock()
+		writeJSON(w, http.StatusOK, release)
+	case "discovery":
+		s.serveDiscovery(w, r)
+	case "review":
+		s.serveReview(w, data)
+	case "list":
+		s.serveList(w, r, p)
+	case "watch":
+		s.serveWatch(w, r, p)
+	case "delete":
+		writeJSON(w, code, &metav1.Status{Status: k8s.String("Success"), Code: k8s.Int32(int32(code))})
+	default:
+		s.writeStatus(w, r, http.StatusMethodNotAllowed, nil)
+	}
+}
+
+// write serves a request of one of the object verbs, returning the
+// response's status code, and the object to respond with.
+func (s *fakeAPIServer) write(r *http.Request, p fakePath, verb string, data []byte) (int, map[string]interface{}) {
+	var body map[string]interface{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &body); err != nil {
+			return http.StatusBadRequest, nil
+		}
+	}
+	metadata, _ := body["metadata"].(map[string]interface{})
+	if metadata == nil && (verb == "create" || verb == "update" || verb == "patch") {
+		return http.StatusBadRequest, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.objects[p.String()]
+	if verb == "create" {
+		p.name, _ = metadata["name"].(string)
+		if _, exists := s.objects[p.String()]; exists {
+			return http.StatusConflict, nil
+		}
+		setUID(p, metadata)
+		s.store(p, body)
+		return http.StatusCreated, body
+	}
+	if !exists {
+		return http.StatusNotFound, nil
+	}
+	currentMetadata := current["metadata"].(map[string]interface{})
+	switch verb {
+	case "get":
+		return http.StatusOK, current
+	case "update", "patch":
+		if verb == "patch" && r.Header.Get("Content-Type") != k8sutil.MergePatchType {
+			return http.StatusUnsupportedMediaType, nil
+		}
+		if want, _ := metadata["resourceVersion"].(string); want != "" && want != currentMetadata["resourceVersion"] {
+			return http.StatusConflict, nil
+		}
+		object := body
+		if verb == "patch" {
+			object = mergePatch(current, body).(map[string]interface{})
+		}
+		object["metadata"].(map[string]interface{})["uid"] = currentMetadata["uid"]
+		s.store(p, object)
+		return http.StatusOK, object
+	default: // delete
+		preconditions, _ := body["preconditions"].(map[string]interface{})
+		if uid, ok := preconditions["uid"]; ok && uid != currentMetadata["uid"] {
+			return http.StatusConflict, nil
+		}
+		s.delete(p)
+		return http.StatusOK, nil
+	}
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386).
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, _ := target.(map[string]interface{})
+	ret := make(map[string]interface{}, len(t))
+	for k, v := range t {
+		ret[k] = v
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(ret, k)
+		} else {
+			ret[k] = mergePatch(ret[k], v)
+		}
+	}
+	return ret
+}
+
+const reviewPath = "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews"
+
+// serveReview answers a SelfSubjectAccessReview, allowing everything
+// that hasn't been denied.
+func (s *fakeAPIServer) serveReview(w http.ResponseWriter, data []byte) {
+	var review authorizationv1.SelfSubjectAccessReview
+	if err := json.Unmarshal(data, &review); err != nil {
+		s.t.Errorf("decode review: %v", err)
+	}
+	attributes := review.GetSpec().GetResourceAttributes()
+	s.mu.Lock()
+	denied := s.denied[attributes.GetVerb()+" "+attributes.GetResource()]
+	s.mu.Unlock()
+	review.Status = &authorizationv1.SubjectAccessReviewStatus{Allowed: k8s.Bool(!denied)}
+	writeJSON(w, http.StatusCreated, &review)
+}
+
+// isDiscoveryPath returns whether the path is of a discovery document:
+// "/api", "/apis", "/api/VERSION", or "/apis/GROUP/VERSION".
+func isDiscoveryPath(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch parts[0] {
+	case "api":
+		return len(parts) <= 2
+	case "apis":
+		return len(parts) == 1 || len(parts) == 3
+	}
+	return false
+}
+
+func (s *fakeAPIServer) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	missing := make(map[string]bool, len(s.missing))
+	for gv := range s.missing {
+		missing[gv] = true
+	}
+	s.mu.Unlock()
+
+	type groupVersion struct {
+		GroupVersion string `json:"groupVersion"`
+		Version      string `json:"version"`
+	}
+	type group struct {
+		Name             string         `json:"name"`
+		Versions         []groupVersion `json:"versions"`
+		PreferredVersion groupVersion   `json:"preferredVersion"`
+	}
+	groups := []group{}
+	addGroupVersion := func(gv string) {
+		i := strings.LastIndexByte(gv, '/')
+		name, version := gv[:i], gv[i+1:]
+		for i := range groups {
+			if groups[i].Name == name {
+				groups[i].Versions = append(groups[i].Versions, groupVersion{gv, version})
+				return
+			}
+		}
+		groups = append(groups, group{name, []groupVersion{{gv, version}}, groupVersion{gv, version}})
+	}
+	for _, ft := range fakeTypes {
+		if strings.HasPrefix(ft.prefix, "/apis/") {
+			addGroupVersion(strings.TrimPrefix(ft.prefix, "/apis/"))
+		}
+	}
+	var gvs []string
+	for gv := range missing {
+		gvs = append(gvs, gv)
+	}
+	sort.Strings(gvs)
+	for _, gv := range gvs {
+		addGroupVersion(gv)
+	}
+
+	switch p := strings.Trim(r.URL.Path, "/"); p {
+	case "api":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"versions": []string{"v1"}})
+	case "apis":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"groups": groups})
+	default:
+		gv := strings.SplitN(p, "/", 2)[1]
+		if missing[gv] {
+			s.writeStatus(w, r, http.StatusServiceUnavailable, nil)
+			return
+		}
+		resources := []map[string]interface{}{}
+		for _, ft := range fakeTypes {
+			if ft.prefix != "/"+p {
+				continue
+			}
+			kind := ft.kind()
+			resources = append(resources, map[string]interface{}{
+				"name":       ft.resource,
+				"namespaced": ft.namespaced,
+				"kind":       kind,
+				"verbs":      []string{"create", "delete", "get", "list", "patch", "update", "watch"},
+			}, map[string]interface{}{
+				"name":       ft.resource + "/status",
+				"namespaced": ft.namespaced,
+				"kind":       kind,
+				"verbs":      []string{"get", "patch", "update"},
+			})
+		}
+		if len(resources) == 0 {
+			s.writeStatus(w, r, http.StatusNotFound, nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"groupVersion": gv, "resources": resources})
+	}
+}
+
+func (s *fakeAPIServer) log(r fakeRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r)
+	s.notify()
+}
+
+// wantsProtobuf returns whether the response to r is to be protobuf,
+// and if so, what type of resource it is of.
+func wantsProtobuf(r *http.Request, p fakePath) (fakeType, bool) {
+	if !strings.Contains(r.Header.Get("Accept"), "protobuf") {
+		return fakeType{}, false
+	}
+	for _, ft := range fakeTypes {
+		if ft.prefix == p.prefix && ft.resource == p.resource {
+			return ft, true
+		}
+	}
+	return fakeType{}, false
+}
+
+// wantsMetadata returns whether the request asks for only the metadata
+// of objects, as PartialObjectMetadata.
+func wantsMetadata(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "as=PartialObjectMetadata")
+}
+
+// asRequested returns the object in the JSON form that the request
+// asks for: the whole object, or PartialObjectMetadata.
+func asRequested(r *http.Request, object map[string]interface{}) map[string]interface{} {
+	if !wantsMetadata(r) {
+		return object
+	}
+	return map[string]interface{}{
+		"apiVersion": "meta.k8s.io/v1",
+		"kind":       "PartialObjectMetadata",
+		"metadata":   object["metadata"],
+	}
+}
+
+// matches returns whether the object at the path is in the collection
+// of the request.
+func matches(r *http.Request, collection, path fakePath, object map[string]interface{}) bool {
+	if path.prefix != collection.prefix || path.resource != collection.resource {
+		return false
+	}
+	if collection.namespace != "" && path.namespace != collection.namespace {
+		return false
+	}
+	labels, _ := object["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	for _, requirement := range strings.Split(r.URL.Query().Get("labelSelector"), ",") {
+		if requirement == "" {
+			continue
+		}
+		kv := strings.SplitN(requirement, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *fakeAPIServer) serveList(w http.ResponseWriter, r *http.Request, p fakePath) {
+	s.mu.Lock()
+	var paths []string
+	for path, object := range s.objects {
+		if matches(r, p, s.paths[path], object) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	var items []map[string]interface{}
+	for _, path := range paths {
+		items = append(items, s.objects[path])
+	}
+	version := strconv.Itoa(s.version)
+	s.mu.Unlock()
+
+	if ft, ok := wantsProtobuf(r, p); ok {
+		list := reflect.New(reflect.TypeOf(ft.list).Elem())
+		itemsValue := list.Elem().FieldByName("Items")
+		for _, item := range items {
+			resource := reflect.New(reflect.TypeOf(ft.sample).Elem()).Interface().(k8s.Resource)
+			fromJSONMap(s.t, item, resource)
+			itemsValue.Set(reflect.Append(itemsValue, reflect.ValueOf(resource)))
+		}
+		list.Elem().FieldByName("Metadata").Set(reflect.ValueOf(&metav1.ListMeta{ResourceVersion: k8s.String(version)}))
+		writeProtobuf(w, http.StatusOK, list.Interface().(proto.Message))
+		return
+	}
+	kind, apiVersion := "List", "v1"
+	if wantsMetadata(r) {
+		kind, apiVersion = "PartialObjectMetadataList", "meta.k8s.io/v1"
+	}
+	for i, item := range items {
+		items[i] = asRequested(r, item)
+	}
+	if items == nil {
+		items = []map[string]interface{}{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":       kind,
+		"apiVersion": apiVersion,
+		"metadata":   map[string]interface{}{"resourceVersion": version},
+		"items":      items,
+	})
+}
+
+func (s *fakeAPIServer) serveWatch(w http.ResponseWriter, r *http.Request, p fakePath) {
+	ft, isProtobuf := wantsProtobuf(r, p)
+	if isProtobuf {
+		w.Header().Set("Content-Type", "application/vnd.kubernetes.protobuf;stream=watch")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	s.mu.Lock()
+	var pending []fakeEvent
+	cursor, err := strconv.Atoi(r.URL.Query().Get("resourceVersion"))
+	if err != nil {
+		// Start with the current state.
+		cursor = s.version
+		var paths []string
+		for path, object := range s.objects {
+			if matches(r, p, s.paths[path], object) {
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			pending = append(pending, fakeEvent{k8s.EventAdded, s.paths[path], s.objects[path], s.version})
+		}
+		if r.URL.Query().Get("sendInitialEvents") == "true" {
+			pending = append(pending, fakeEvent{"BOOKMARK", p, map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"resourceVersion": strconv.Itoa(s.version),
+					"annotations":     map[string]interface{}{"k8s.io/initial-events-end": "true"},
+				},
+			}, s.version})
+		}
+	}
+	s.mu.Unlock()
+	for {
+		for _, event := range pending {
+			var err error
+			if isProtobuf {
+				err = writeProtobufEvent(w, ft, event, s.t)
+			} else {
+				err = json.NewEncoder(w).Encode(map[string]interface{}{"type": event.eventType, "object": asRequested(r, event.object)})
+			}
+			if err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+		pending = nil
+
+		s.mu.Lock()
+		for _, event := range s.events {
+			if event.version > cursor && matches(r, p, event.path, event.object) {
+				pending = append(pending, event)
+			}
+		}
+		cursor = s.version
+		changed := s.changed
+		s.mu.Unlock()
+		if len(pending) > 0 {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// protobufMagic prefixes an object in the protobuf encoding of the
+// Kubernetes API.
+var protobufMagic = []byte("k8s\x00")
+
+func encodeProtobuf(msg proto.Message) ([]byte, error) {
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := (&runtime.Unknown{Raw: raw}).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), protobufMagic...), data...), nil
+}
+
+func writeProtobuf(w http.ResponseWriter, code int, msg proto.Message) {
+	data, err := encodeProtobuf(msg)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/vnd.kubernetes.protobuf")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+func writeProtobufEvent(w http.ResponseWriter, ft fakeType, event fakeEvent, t *testing.T) error {
+	resource := reflect.New(reflect.TypeOf(ft.sample).Elem()).Interface().(k8s.Resource)
+	fromJSONMap(t, event.object, resource)
+	raw, err := encodeProtobuf(resource.(proto.Message))
+	if err != nil {
+		return err
+	}
+	data, err := proto.Marshal(&metav1.WatchEvent{
+		Type:   k8s.String(event.eventType),
+		Object: &runtime.RawExtension{Raw: raw},
+	})
+	if err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	if _, err := w.Write(append(length, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeStatus writes a failure Status, in whichever encoding the
+// request asks for.
+func (s *fakeAPIServer) writeStatus(w http.ResponseWriter, r *http.Request, code int, details *metav1.StatusDetails) {
+	status := &metav1.Status{
+		Status:  k8s.String("Failure"),
+		Code:    k8s.Int32(int32(code)),
+		Message: k8s.String(http.StatusText(code)),
+		Details: details,
+	}
+	if strings.Contains(r.Header.Get("Accept"), "protobuf") {
+		writeProtobuf(w, code, status)
+		return
+	}
+	writeJSON(w, code, status)
+}
+
+func jsonMap(t *testing.T, v interface{}) map[string]interface{} {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret map[string]interface{}
+	if err := json.Unmarshal(data, &ret); err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func fromJSONMap(t *testing.T, object map[string]interface{}, resource k8s.Resource) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := json.Unmarshal(data, resource); err != nil {
+		t.Error(err)
+	}
+}
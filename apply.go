@@ -0,0 +1,580 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// ApplySetLabel is the label that an ApplySet puts on the resources
+// that it applies, with the ApplySet's Name as the value, so that it
+// can tell which resources to prune.
+const ApplySetLabel = "k8sutil.datawire.io/apply-set"
+
+// DefaultApplyInterval is how often an ApplySet reconciles if its
+// Interval is zero.
+const DefaultApplyInterval = 1 * time.Minute
+
+// An ApplySet keeps a fixed set of desired resources applied to the
+// cluster: a minimal embedded GitOps engine, for an operator that owns
+// a bundle of resources.  It creates the desired resources that are
+// missing, updates those that have drifted from the desired state (or
+// whose desired state has changed) by merging the desired state in to
+// them, and deletes ("prunes") the resources that it applied before but
+// that are no longer desired.  It learns the cluster's state from the
+// Store, which must watch every type of resource in the set.
+//
+// A resource has drifted if any field that is set in its desired state
+// has a different value in the cluster; fields that are only set in
+// the cluster (such as those filled in by defaulting) are ignored.
+//
+// Only the types of resources that the ApplySet has been given, and the
+// PruneTypes, are pruned.
+type ApplySet struct {
+	Client *k8s.Client    // must not be nil
+	Store  *WatchingStore // must not be nil
+	Logger Logger         // must not be nil
+
+	// Name identifies the set, in the ApplySetLabel of the
+	// resources that it applies.  It must not be empty, and must be
+	// unique among the ApplySets managing a cluster.
+	Name string
+
+	// PruneTypes are samples of types to prune resources of, in
+	// addition to those of the desired resources, so that
+	// resources of a type that has been dropped from the set
+	// altogether are still pruned after a restart.
+	PruneTypes []k8s.Resource
+
+	// Discovery, if set, is used to find the resource types of
+	// Unstructured resources; without it, an ApplySet can only
+	// apply types registered with the k8s package.
+	Discovery *Discovery
+
+	// Validator, if set, validates the desired resources before
+	// they are applied; invalid ones aren't, and their ApplyStatus
+	// has the *SchemaError.
+	Validator *SchemaValidator
+
+	// Interval is how often to reconcile, in addition to whenever
+	// the Store or the desired resources change.  If zero,
+	// DefaultApplyInterval is used.
+	Interval time.Duration
+
+	// DryRun makes every change with server-side dry run, for a plan
+	// or preview of what the ApplySet would do: the Status then says
+	// what would have been done to each resource, and has the
+	// result.  Nothing changes in the cluster, so the same changes
+	// are tried again on every reconcile.
+	DryRun bool
+
+	mu      sync.Mutex
+	desired map[ApplyKey]k8s.Resource
+	types   map[typeKey]k8s.Resource // the types seen, for pruning
+	status  map[ApplyKey]ApplyStatus
+	kick    chan struct{}
+}
+
+// An ApplyKey identifies a resource in an ApplySet.
+type ApplyKey struct {
+	GVK       GroupVersionKind
+	Namespace string
+	Name      string
+}
+
+func (k ApplyKey) String() string {
+	return k.GVK.String() + " " + ObjectKey{Namespace: k.Namespace, Name: k.Name}.String()
+}
+
+// ApplyStatus describes the outcome of the last attempt to reconcile a
+// resource.
+type ApplyStatus struct {
+	Key ApplyKey
+
+	// Synced is whether the resource matched its desired state
+	// (or, for a pruned resource, was gone) after the attempt; if
+	// not, Err says why.  With DryRun, a resource that needed a
+	// change isn't Synced, even if the change would have worked.
+	Synced bool
+	Err    error
+
+	// Action is what the attempt did: "created", "replaced",
+	// "pruned", or "" if nothing needed doing.
+	Action string
+
+	// Result is, with DryRun, the resource as the apiserver would
+	// have written it (or, if it was pruned, as it was deleted),
+	// if the apiserver accepted the change.
+	Result *Unstructured
+
+	// Time is when the attempt was made.
+	Time time.Time
+}
+
+// SetDesired replaces the set of desired resources.  Each must have a
+// name, and, if its type is namespaced, a namespace.  The resources are
+// copied, so the caller may go on to modify them.
+func (a *ApplySet) SetDesired(resources ...k8s.Resource) error {
+	desired := make(map[ApplyKey]k8s.Resource, len(resources))
+	for _, resource := range resources {
+		key, err := applyKeyOf(resource)
+		if err != nil {
+			return err
+		}
+		desired[key] = DeepCopy(resource)
+	}
+	a.mu.Lock()
+	a.init()
+	a.desired = desired
+	for _, resource := range desired {
+		a.types[typeKeyOf(resource)] = newResourceLike(resource)
+	}
+	a.mu.Unlock()
+	a.Kick()
+	return nil
+}
+
+// Kick makes Run reconcile now.
+func (a *ApplySet) Kick() {
+	a.mu.Lock()
+	a.init()
+	kick := a.kick
+	a.mu.Unlock()
+	select {
+	case kick <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the outcome of the last attempt to reconcile each
+// resource, sorted by key.
+func (a *ApplySet) Status() []ApplyStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ret := make([]ApplyStatus, 0, len(a.status))
+	for _, status := range a.status {
+		ret = append(ret, status)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key.String() < ret[j].Key.String()
+	})
+	return ret
+}
+
+// init initializes the ApplySet; a.mu must be held.
+func (a *ApplySet) init() {
+	if a.kick != nil {
+		return
+	}
+	a.types = make(map[typeKey]k8s.Resource)
+	a.status = make(map[ApplyKey]ApplyStatus)
+	a.kick = make(chan struct{}, 1)
+}
+
+// Run reconciles until the Context is done, whenever the Store or the
+// desired resources change, and every Interval.  It must be called
+// before the Store's Run returns, and should run for as long as it
+// does.  It returns nil once the Context is done.
+func (a *ApplySet) Run(ctx context.Context) error {
+	if a.Name == "" {
+		return errors.New("ApplySet: Name must not be empty")
+	}
+	events := a.Store.Events(1, EventsCoalesce)
+	interval := a.Interval
+	if interval <= 0 {
+		interval = DefaultApplyInterval
+	}
+	clock := a.Store.clock()
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	a.mu.Lock()
+	a.init()
+	kick := a.kick
+	a.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-events:
+			if !ok {
+				// The Store has stopped.
+				events = nil
+				continue
+			}
+		case <-kick:
+		case <-ticker.C():
+		}
+		store, err := a.Store.Snapshot()
+		if err != nil {
+			// Not synced yet; the first Delta will do.
+			continue
+		}
+		a.Reconcile(ctx, store)
+	}
+}
+
+// Reconcile makes one pass over the desired resources, and those to
+// prune, in order of key, against the state in the store, recording the
+// outcome in the Status.  It returns the number of resources that
+// couldn't be reconciled.
+func (a *ApplySet) Reconcile(ctx context.Context, store Store) int {
+	a.mu.Lock()
+	a.init()
+	desired := a.desired
+	types := make([]k8s.Resource, 0, len(a.types)+len(a.PruneTypes))
+	for _, sample := range a.types {
+		types = append(types, sample)
+	}
+	a.mu.Unlock()
+	types = append(types, a.PruneTypes...)
+
+	actual := map[ApplyKey]k8s.Resource{}
+	seen := map[typeKey]bool{}
+	for _, sample := range types {
+		if seen[typeKeyOf(sample)] {
+			continue
+		}
+		seen[typeKeyOf(sample)] = true
+		for _, resource := range store.List(sample) {
+			if key, err := applyKeyOf(resource); err == nil {
+				actual[key] = resource
+			}
+		}
+	}
+
+	failed := 0
+	record := func(key ApplyKey, action string, result *Unstructured, err error) {
+		if err != nil {
+			failed++
+			a.Logger.Errorf("apply %s %s: %v", a.Name, key, err)
+		}
+		a.mu.Lock()
+		a.status[key] = ApplyStatus{
+			Key:    key,
+			Synced: err == nil && (action == "" || !a.DryRun),
+			Err:    err,
+			Action: action,
+			Result: result,
+			Time:   a.Store.clock().Now(),
+		}
+		a.mu.Unlock()
+	}
+	for _, key := range sortedKeys(desired) {
+		if ctx.Err() != nil {
+			return failed
+		}
+		want := desired[key]
+		have, exists := actual[key]
+		switch {
+		case !exists && watches(store, want):
+			result, err := a.write(ctx, http.MethodPost, want, nil)
+			record(key, "created", result, err)
+		case !exists:
+			record(key, "", nil, errors.Errorf("the Store doesn't watch %s", key.GVK))
+		default:
+			drifted, err := a.drifted(want, have)
+			if err != nil || !drifted {
+				record(key, "", nil, err)
+				continue
+			}
+			result, err := a.write(ctx, http.MethodPatch, want, have)
+			record(key, "replaced", result, err)
+		}
+	}
+	a.mu.Lock()
+	for key := range a.status {
+		if _, ok := desired[key]; !ok {
+			if _, ok := actual[key]; !ok {
+				// Pruned, and gone.
+				delete(a.status, key)
+			}
+		}
+	}
+	a.mu.Unlock()
+	for _, key := range sortedKeys(actual) {
+		have := actual[key]
+		if _, ok := desired[key]; ok || have.GetMetadata().GetLabels()[ApplySetLabel] != a.Name {
+			continue
+		}
+		if ctx.Err() != nil {
+			return failed
+		}
+		if have.GetMetadata().GetDeletionTimestamp() != nil {
+			continue
+		}
+		result, err := a.delete(ctx, have)
+		record(key, "pruned", result, err)
+	}
+	return failed
+}
+
+func sortedKeys(resources map[ApplyKey]k8s.Resource) []ApplyKey {
+	keys := make([]ApplyKey, 0, len(resources))
+	for key := range resources {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	return keys
+}
+
+// watches returns whether the store watches the type of the resource,
+// as far as can be told.
+func watches(store Store, resource k8s.Resource) bool {
+	s, ok := store.(*snapshot)
+	if !ok {
+		return true
+	}
+	_, ok = s.types[typeKeyOf(resource)]
+	return ok
+}
+
+// drifted returns whether the actual resource must be updated to the
+// desired one: because the desired state has changed since it was
+// applied, or because a field of the desired state has been changed in
+// the cluster.
+func (a *ApplySet) drifted(desired, actual k8s.Resource) (bool, error) {
+	if actual.GetMetadata().GetLabels()[ApplySetLabel] != a.Name {
+		return true, nil
+	}
+	if needs, err := NeedsUpdate(desired, actual); err != nil || needs {
+		return needs, err
+	}
+	want, have, err := jsonObjects(desired, actual)
+	if err != nil {
+		return false, err
+	}
+	return !jsonContains(have, desiredState(want)), nil
+}
+
+// desiredMetadata is the metadata that an ApplySet applies; the rest is
+// managed by the apiserver.
+var desiredMetadata = []string{"name", "namespace", "labels", "annotations", "ownerReferences", "finalizers"}
+
+// desiredState returns the part of the resource's JSON object that an
+// ApplySet applies: everything but the status, and the metadata that
+// the apiserver manages.
+func desiredState(object map[string]interface{}) map[string]interface{} {
+	ret := make(map[string]interface{}, len(object))
+	for k, v := range object {
+		if k != "metadata" && k != "status" {
+			ret[k] = v
+		}
+	}
+	metadata := make(map[string]interface{})
+	if md, ok := object["metadata"].(map[string]interface{}); ok {
+		for _, k := range desiredMetadata {
+			if v, ok := md[k]; ok {
+				metadata[k] = v
+			}
+		}
+	}
+	ret["metadata"] = metadata
+	return ret
+}
+
+// jsonContains returns whether every field set in want has the same
+// value in have.  Lists must have the same length, and each element of
+// have must contain the corresponding element of want.
+func jsonContains(have, want interface{}) bool {
+	switch want := want.(type) {
+	case map[string]interface{}:
+		have, ok := have.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range want {
+			if !jsonContains(have[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		have, ok := have.([]interface{})
+		if !ok || len(have) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !jsonContains(have[i], want[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(have, want)
+	}
+}
+
+// write creates (POST) the resource with its desired state, or merges
+// its desired state in to the resource in the cluster (PATCH), labeled
+// with the ApplySet's name and annotated with its spec hash.  A merge
+// patch, rather than a PUT of the desired state alone, keeps what the
+// desired state doesn't set: the fields that the apiserver defaulted
+// (some of which, such as a Service's spec.clusterIP, can't be
+// changed), and the labels, annotations, and finalizers of others.  With
+// DryRun, it returns the result.
+func (a *ApplySet) write(ctx context.Context, verb string, desired, actual k8s.Resource) (*Unstructured, error) {
+	if a.Validator != nil {
+		if err := a.Validator.Validate(ctx, desired); err != nil {
+			return nil, err
+		}
+	}
+	resource, err := a.apiResource(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := SpecHash(desired)
+	if err != nil {
+		return nil, err
+	}
+	object, err := jsonObject(desired)
+	if err != nil {
+		return nil, errors.Wrap(err, "encode")
+	}
+	object = desiredState(object)
+	object["apiVersion"] = resource.GroupVersion()
+	object["kind"] = resource.Kind
+	metadata := object["metadata"].(map[string]interface{})
+	setJSONString(metadata, "labels", ApplySetLabel, a.Name)
+	setJSONString(metadata, "annotations", SpecHashAnnotation, hash)
+	md := desired.GetMetadata()
+	path := resource.Path(md.GetNamespace())
+	r := request{verb: verb, path: path}
+	if verb == http.MethodPatch {
+		// The resourceVersion makes the patch conditional on the
+		// resource being as the drift was detected in.
+		metadata["resourceVersion"] = actual.GetMetadata().GetResourceVersion()
+		r.path += "/" + url.PathEscape(md.GetName())
+		r.contentType = MergePatchType
+	}
+	options, result := a.mutateOptions()
+	if err := mutateOptionsOf(options).do(ctx, a.Client, r, object, nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// delete deletes the resource.  With DryRun, it returns the result.
+func (a *ApplySet) delete(ctx context.Context, actual k8s.Resource) (*Unstructured, error) {
+	resource, err := a.apiResource(ctx, actual)
+	if err != nil {
+		return nil, err
+	}
+	options, result := a.mutateOptions()
+	if err := deleteResource(ctx, a.Client, resource, actual, options...); err != nil {
+		return nil, err
+	}
+	if result != nil && (result.Object == nil || result.Kind() == "Status") {
+		// It was gone already, or its type returns a Status
+		// instead of the resource.
+		result = nil
+	}
+	return result, nil
+}
+
+// mutateOptions returns the options of a change, with DryRun, and the
+// result that a dry run fills in (or nil).
+func (a *ApplySet) mutateOptions() ([]MutateOption, *Unstructured) {
+	if !a.DryRun {
+		return nil, nil
+	}
+	result := new(Unstructured)
+	return []MutateOption{DryRun(result)}, result
+}
+
+// deleteResource deletes the resource, of the type, in the background,
+// provided that it is still the same resource (that it has the same
+// UID).  It returns nil if the resource is gone already.
+func deleteResource(ctx context.Context, client *k8s.Client, resource APIResource, actual k8s.Resource, options ...MutateOption) error {
+	md := actual.GetMetadata()
+	err := mutateOptionsOf(options).do(ctx, client, request{
+		verb: http.MethodDelete,
+		path: resource.Path(md.GetNamespace()) + "/" + url.PathEscape(md.GetName()),
+	}, map[string]interface{}{
+		"apiVersion":        "v1",
+		"kind":              "DeleteOptions",
+		"propagationPolicy": "Background",
+		"preconditions":     map[string]interface{}{"uid": md.GetUid()},
+	}, nil)
+	if apiErrorCode(err) == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// setJSONString sets object[field][key] = value.
+func setJSONString(object map[string]interface{}, field, key, value string) {
+	m, _ := object[field].(map[string]interface{})
+	if m == nil {
+		m = make(map[string]interface{})
+		object[field] = m
+	}
+	m[key] = value
+}
+
+// applyKeyOf returns the resource's key.
+func applyKeyOf(resource k8s.Resource) (ApplyKey, error) {
+	gvk, err := GVKOf(resource)
+	if err != nil {
+		return ApplyKey{}, err
+	}
+	md := resource.GetMetadata()
+	key := ApplyKey{GVK: gvk, Namespace: md.GetNamespace(), Name: md.GetName()}
+	if key.Name == "" {
+		return ApplyKey{}, errors.Errorf("%s has no name", gvk)
+	}
+	return key, nil
+}
+
+// apiResource returns the resource type of the resource.
+func (a *ApplySet) apiResource(ctx context.Context, resource k8s.Resource) (APIResource, error) {
+	return discoverAPIResource(ctx, a.Discovery, "ApplySet", resource)
+}
+
+// discoverAPIResource returns the type of the resource, using the
+// Discovery (if it isn't nil) to find that of an Unstructured resource.
+// The user, e.g. "ApplySet", is what needs the Discovery, for errors.
+func discoverAPIResource(ctx context.Context, discovery *Discovery, user string, resource k8s.Resource) (APIResource, error) {
+	ret, err := apiResourceForResource(resource)
+	if err != nil {
+		return APIResource{}, err
+	}
+	if ret.Name == "" {
+		if discovery == nil {
+			return APIResource{}, errors.Errorf("%s: the %s needs a Discovery to handle %s",
+				resource.GetMetadata().GetName(), user, ret.GroupVersionKind())
+		}
+		if ret, err = discovery.ResourceForKind(ctx, ret.GroupVersion(), ret.Kind); err != nil {
+			return APIResource{}, err
+		}
+	}
+	if ret.Namespaced && resource.GetMetadata().GetNamespace() == "" {
+		return APIResource{}, errors.Errorf("%s %s has no namespace", ret.GroupVersionKind(), resource.GetMetadata().GetName())
+	}
+	return ret, nil
+}
+
+// jsonObject returns the resource as a generic JSON object, in the
+// Kubernetes encoding.
+func jsonObject(resource k8s.Resource) (map[string]interface{}, error) {
+	data, err := marshalKubeJSON(resource)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestApplySetSession replays an ApplySet reconciling against a Store:
+// it creates what is missing, merges the desired state in to what has
+// drifted (keeping what others set, and what the apiserver defaulted),
+// and prunes what it applied before but is no longer desired.  Once the
+// Store has caught up, there is nothing left to do.
+func TestApplySetSession(t *testing.T) {
+	ss := newSession(t)
+	server := newFakeAPIServer(t)
+	store := ss.store()
+	store.AddWatch("default", &corev1.ConfigMapList{})
+	s := ss.stream("default")
+	ss.run(store)
+
+	drifted := configMap("default", "a", "1", "other", "keep", k8sutil.ApplySetLabel, "set")
+	drifted.Metadata.Annotations = map[string]string{"someone": "else"}
+	drifted.Data = map[string]string{"k": "old", "defaulted": "by the apiserver"}
+	pruned := configMap("default", "old", "2", k8sutil.ApplySetLabel, "set")
+	unmanaged := configMap("default", "mine", "3")
+	for _, cm := range []*corev1.ConfigMap{drifted, pruned, unmanaged} {
+		server.set(cm)
+	}
+	ss.list(s, "3", drifted, pruned, unmanaged)
+	ss.expect(1)
+	ss.waitForWatch(s, 1)
+
+	a := &k8sutil.ApplySet{
+		Client: server.client(),
+		Store:  store,
+		Logger: k8sutiltest.Logger(t),
+		Name:   "set",
+	}
+	desiredA := &corev1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String("a")},
+		Data:     map[string]string{"k": "new"},
+	}
+	desiredB := &corev1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String("b")},
+		Data:     map[string]string{"k": "v"},
+	}
+	if err := a.SetDesired(desiredA, desiredB); err != nil {
+		t.Fatal(err)
+	}
+	reconcile := func() {
+		snapshot, err := store.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss.logf("reconcile: %d failed", a.Reconcile(context.Background(), snapshot))
+		// The order of the changes isn't defined.
+		requests := server.drain()
+		sort.Strings(requests)
+		for _, request := range requests {
+			ss.logf("  %s", request)
+		}
+		for _, status := range a.Status() {
+			ss.logf("  status %s: action=%q synced=%v err=%v", status.Key, status.Action, status.Synced, status.Err)
+		}
+	}
+	reconcile()
+	ss.logf("a is now %s", jsonString(t, server.object(desiredA)))
+
+	// The watch catches up.
+	ss.send(s, k8s.EventModified, configMapOf(t, server.object(desiredA)))
+	ss.expect(1)
+	ss.send(s, k8s.EventAdded, configMapOf(t, server.object(desiredB)))
+	ss.expect(1)
+	ss.send(s, k8s.EventDeleted, pruned)
+	ss.expect(1)
+	reconcile()
+	ss.done()
+}
+
+func jsonString(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func configMapOf(t *testing.T, object map[string]interface{}) *corev1.ConfigMap {
+	t.Helper()
+	cm := &corev1.ConfigMap{}
+	fromJSONMap(t, object, cm)
+	return cm
+}
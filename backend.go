@@ -0,0 +1,195 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+)
+
+// ListOptions are the parameters of a list or watch request.
+type ListOptions struct {
+	// ResourceVersion, for a watch, is the resourceVersion to
+	// begin watching from; for a list (or a streaming list), the
+	// listing must be at least as new as it.
+	ResourceVersion string
+
+	// AllowBookmarks, for a watch, asks the apiserver to send
+	// BOOKMARK events.
+	AllowBookmarks bool
+
+	// SendInitialEvents, for a watch, asks the apiserver to begin
+	// the watch with an ADDED event for every existing resource,
+	// followed by a BOOKMARK event with the
+	// "k8s.io/initial-events-end" annotation (a "streaming list").
+	// This implies resourceVersionMatch=NotOlderThan.
+	SendInitialEvents bool
+
+	// ClientOptions are more parameters, such as label selectors
+	// and timeouts, as k8s.Options: those of the watch's
+	// ClientOptions.  A Backend that doesn't use a k8s.Client can
+	// get their query parameters with OptionQuery.
+	ClientOptions []k8s.Option
+}
+
+// A Backend is the Kubernetes client that a WatchingStore lists and
+// watches resources with.  Resource types are identified by a sample
+// k8s.ResourceList, as with the k8s.Client; a Backend must support
+// *UnstructuredList and *PartialObjectMetadataList as well as whichever
+// typed lists it's used with.
+//
+// NewClientBackend adapts a *k8s.Client; the
+// github.com/datawire/k8sutil/clientgo module adapts a client-go
+// configuration.
+type Backend interface {
+	// List fills in the list with the resources in the
+	// namespace (or all namespaces, if namespace is
+	// k8s.AllNamespaces).
+	List(ctx context.Context, namespace string, list k8s.ResourceList, options ListOptions) error
+
+	// Watch starts watching the resources in the namespace that
+	// the list would contain.  The list itself is not modified.
+	Watch(ctx context.Context, namespace string, list k8s.ResourceList, options ListOptions) (Watcher, error)
+}
+
+// A UserAgentBackend is a Backend that can identify the watch that each
+// of its requests is made for; a WatchingStore with a UserAgent uses
+// WithUserAgent to give each watch its own User-Agent.
+type UserAgentBackend interface {
+	Backend
+
+	// WithUserAgent returns a copy of the Backend that sends the
+	// userAgent as the User-Agent of its requests.
+	WithUserAgent(userAgent string) Backend
+}
+
+// A Watcher is a stream of watch events from a Backend; *k8s.Watcher
+// is a Watcher.
+type Watcher interface {
+	// Next decodes the next event in to the resource, and returns
+	// its type (k8s.EventAdded, etc.).  Errors are fatal; once
+	// Next has returned an error, the Watcher should be closed.
+	Next(resource k8s.Resource) (string, error)
+
+	// Close closes the stream.
+	Close() error
+}
+
+// NewClientBackend returns a Backend that uses the *k8s.Client.  Like
+// a WatchingStore's own requests, the Backend's requests honor the
+// Retry-After header of "429 Too Many Requests" responses.
+func NewClientBackend(client *k8s.Client) UserAgentBackend {
+	return clientBackend{WrapClient(client, recordRetryAfter(SystemClock))}
+}
+
+type clientBackend struct {
+	client *k8s.Client
+}
+
+func (b clientBackend) List(ctx context.Context, namespace string, list k8s.ResourceList, options ListOptions) error {
+	switch list := list.(type) {
+	case *UnstructuredList:
+		return b.listRaw(ctx, namespace, list.Resource, "", options, list)
+	case *PartialObjectMetadataList:
+		return b.listRaw(ctx, namespace, list.Resource, acceptPartialObjectMetadataList, options, list)
+	}
+	return b.client.List(ctx, namespace, list, clientOptions(options)...)
+}
+
+func (b clientBackend) Watch(ctx context.Context, namespace string, list k8s.ResourceList, options ListOptions) (Watcher, error) {
+	switch list := list.(type) {
+	case *UnstructuredList:
+		return b.watchRaw(ctx, namespace, list.Resource, "", options)
+	case *PartialObjectMetadataList:
+		return b.watchRaw(ctx, namespace, list.Resource, acceptPartialObjectMetadata, options)
+	}
+	return b.client.Watch(ctx, namespace, listItemSample(list), clientOptions(options)...)
+}
+
+func (b clientBackend) WithUserAgent(ua string) Backend {
+	return clientBackend{WrapClient(b.client, userAgent(ua))}
+}
+
+func clientOptions(options ListOptions) []k8s.Option {
+	var ret []k8s.Option
+	if options.ResourceVersion != "" {
+		ret = append(ret, k8s.ResourceVersion(options.ResourceVersion))
+	}
+	if options.AllowBookmarks {
+		ret = append(ret, k8s.QueryParam("allowWatchBookmarks", "true"))
+	}
+	if options.SendInitialEvents {
+		ret = append(ret,
+			k8s.QueryParam("sendInitialEvents", "true"),
+			k8s.QueryParam("resourceVersionMatch", "NotOlderThan"))
+	}
+	return append(ret, options.ClientOptions...)
+}
+
+// listQuery returns the query parameters for a raw list or watch
+// request.
+func listQuery(options ListOptions) url.Values {
+	query := OptionQuery(options.ClientOptions...)
+	if options.ResourceVersion != "" {
+		query.Set("resourceVersion", options.ResourceVersion)
+	}
+	if options.AllowBookmarks {
+		query.Set("allowWatchBookmarks", "true")
+	}
+	if options.SendInitialEvents {
+		query.Set("sendInitialEvents", "true")
+		query.Set("resourceVersionMatch", "NotOlderThan")
+	}
+	return query
+}
+
+// OptionQuery returns the query parameters that the k8s.Options add to
+// list and watch requests, for Backends that don't use the k8s.Client
+// to make them.
+func OptionQuery(options ...k8s.Option) url.Values {
+	query := url.Values{}
+	if len(options) == 0 {
+		return query
+	}
+	// k8s.Option's methods are unexported; have the k8s.Client
+	// build a request with the options instead.
+	u := captureURL(func(client *k8s.Client) error {
+		return client.List(context.Background(), k8s.AllNamespaces, new(corev1.ConfigMapList), options...)
+	})
+	if u != nil {
+		query = u.Query()
+	}
+	return query
+}
+
+// listRaw lists a resource type that the k8s.Client doesn't know
+// about in to out.
+func (b clientBackend) listRaw(ctx context.Context, namespace string, resource APIResource, accept string, options ListOptions, out k8s.ResourceList) error {
+	return doJSON(ctx, b.client, request{
+		verb:   http.MethodGet,
+		path:   resource.Path(namespace),
+		query:  listQuery(options),
+		accept: accept,
+	}, nil, out)
+}
+
+// watchRaw watches a resource type that the k8s.Client doesn't know
+// about.
+func (b clientBackend) watchRaw(ctx context.Context, namespace string, resource APIResource, accept string, options ListOptions) (Watcher, error) {
+	query := listQuery(options)
+	query.Set("watch", "true")
+	resp, err := do(ctx, b.client, request{
+		verb:   http.MethodGet,
+		path:   resource.Path(namespace),
+		query:  query,
+		accept: accept,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newJSONWatcher(resp.Body), nil
+}
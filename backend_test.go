@@ -0,0 +1,66 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestBackend checks that a WatchingStore with only a Backend watches
+// with it, giving it the UserAgent.
+func TestBackend(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a", "k", "v"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:   k8sutil.NewClientBackend(server.client()),
+		Logger:    testLogger{t},
+		Callback:  func(s k8sutil.Store) { stores <- s },
+		UserAgent: "test/1.0",
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	want := "test/1.0 (k8sutil watch=v1 ConfigMap; namespace=default)"
+	for _, verb := range []string{"list", "watch"} {
+		if got := server.await(verb).header.Get("User-Agent"); got != want {
+			t.Errorf("%s: got User-Agent %q, want %q", verb, got, want)
+		}
+	}
+	select {
+	case store := <-stores:
+		if resources := store.List(&corev1.ConfigMap{}); len(resources) != 1 {
+			t.Errorf("got %v", resources)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the store")
+	}
+}
+
+// TestClientBackendRetryAfter checks that a ClientBackend's errors have
+// the delay of the Retry-After header.
+func TestClientBackendRetryAfter(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.setFailure("list", failure{
+		code:    http.StatusTooManyRequests,
+		header:  http.Header{"Retry-After": {"1"}},
+		details: &metav1.StatusDetails{RetryAfterSeconds: k8s.Int32(60)},
+	})
+	backend := k8sutil.NewClientBackend(server.client())
+	err := backend.List(context.Background(), "default", &corev1.ConfigMapList{}, k8sutil.ListOptions{})
+	apiErr, ok := err.(*k8s.APIError)
+	if !ok || apiErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %v, want a 429 *k8s.APIError", err)
+	}
+	if seconds := apiErr.Status.GetDetails().GetRetryAfterSeconds(); seconds != 1 {
+		t.Errorf("got RetryAfterSeconds %d, want 1", seconds)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// An OverflowPolicy says what a watch does when Run falls behind on its
+// events, and the EventBuffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes the watch wait until there is room,
+	// leaving the apiserver's events unread in the HTTP stream (or
+	// in the apiserver) meanwhile, which may make the apiserver
+	// drop the watch.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowCoalesce holds the watch's events that don't fit,
+	// merging those of each resource by UID into its latest, so
+	// that the watch keeps reading and the events held are bounded
+	// by the number of resources.  Nothing is lost but the
+	// intermediate versions.
+	OverflowCoalesce
+
+	// OverflowRelist drops the event that doesn't fit, and the rest
+	// of the watch, and lists the type again: one listing in place
+	// of the dropped events.  Events of the watch that are still
+	// buffered are discarded in favor of the listing.
+	OverflowRelist
+)
+
+// Overflows returns the number of events that watches have merged into
+// others, with OverflowCoalesce, plus the number of times that they have
+// dropped their events and listed again, with OverflowRelist.
+func (w *WatchingStore) Overflows() uint64 {
+	var n uint64
+	for _, wa := range w.currentWatches() {
+		n += atomic.LoadUint64(&wa.overflows)
+	}
+	return n
+}
+
+// An eventQueue holds a watch's events for Run, with OverflowCoalesce,
+// merging those of each resource until it is sent.  The zero value is
+// not usable; use newEventQueue.
+type eventQueue struct {
+	mu      sync.Mutex
+	pending list.List                // of watchEvent, oldest first
+	byUID   map[string]*list.Element // of pending
+	ready   chan struct{}            // signaled when an event is queued
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{
+		byUID: map[string]*list.Element{},
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// put queues the event, returning whether it was merged into one that
+// was already queued.
+func (q *eventQueue) put(event watchEvent) bool {
+	uid := event.resource.GetMetadata().GetUid()
+	q.mu.Lock()
+	elem, merged := q.byUID[uid]
+	if merged {
+		old := elem.Value.(watchEvent)
+		event.statusOnly = event.statusOnly && old.statusOnly
+		elem.Value = event
+	} else {
+		q.byUID[uid] = q.pending.PushBack(event)
+	}
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return merged
+}
+
+// take removes the oldest queued event, if there is one.
+func (q *eventQueue) take() (watchEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	elem := q.pending.Front()
+	if elem == nil {
+		return watchEvent{}, false
+	}
+	event := q.pending.Remove(elem).(watchEvent)
+	delete(q.byUID, event.resource.GetMetadata().GetUid())
+	return event, true
+}
+
+// forward sends the queued events to the channel, in order, until the
+// Context is done.
+func (q *eventQueue) forward(ctx context.Context, watchCh chan<- watchEvent) {
+	for {
+		event, ok := q.take()
+		if !ok {
+			select {
+			case <-q.ready:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case watchCh <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
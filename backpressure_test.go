@@ -0,0 +1,99 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// backpressureStore returns a WatchingStore of ConfigMaps in "default",
+// listed with "a", whose callback the gate can hold up, and its stream.
+func backpressureStore(t *testing.T, g *gate, configure func(*k8sutil.WatchingStore)) (*k8sutil.WatchingStore, *k8sutiltest.Stream, *k8sutiltest.Recorder) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	rec := k8sutiltest.NewRecorder(&corev1.ConfigMap{})
+	w := &k8sutil.WatchingStore{
+		Backend: backend,
+		Logger:  testLogger{t},
+		Callback: func(s k8sutil.Store) {
+			g.pass()
+			rec.Callback(s)
+		},
+	}
+	configure(w)
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	s := backend.Stream("default", &corev1.ConfigMapList{})
+	s.List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.ConfigMap{configMap("default", "a", "1")}})
+	runStore(t, w)
+	rec.Expect(t, "v1 ConfigMap: default/a@1")
+	s.WaitForWatch(1)
+	return w, s, rec
+}
+
+// TestOverflowCoalesce checks that a watch that falls behind keeps
+// reading, merging the events of each resource into its latest.
+func TestOverflowCoalesce(t *testing.T) {
+	g := newGate()
+	w, s, rec := backpressureStore(t, g, func(w *k8sutil.WatchingStore) {
+		w.Overflow = k8sutil.OverflowCoalesce
+	})
+	g.hold()
+	s.Send(k8s.EventModified, configMap("default", "a", "2"))
+	g.waitHeld(t)
+	// Run holds at most one of these; the rest wait in the queue.
+	for rv := 3; rv <= 10; rv++ {
+		s.Send(k8s.EventModified, configMap("default", "a", strconv.Itoa(rv)))
+	}
+	s.Send(k8s.EventAdded, configMap("default", "b", "11"))
+	g.release()
+
+	var callbacks int
+	for {
+		snapshot, ok := rec.Next(k8sutiltest.DefaultTimeout)
+		if !ok {
+			t.Fatal("timed out waiting for the latest versions")
+		}
+		callbacks++
+		if snapshot == "v1 ConfigMap: default/a@10 default/b@11" {
+			break
+		}
+	}
+	if callbacks > 4 {
+		t.Errorf("%d callbacks for 10 events, want them merged", callbacks)
+	}
+	if n := w.Overflows(); n < 6 {
+		t.Errorf("got %d overflows, want at least 6", n)
+	}
+}
+
+// TestEventBuffer checks that a watch keeps reading while a callback is
+// held up, until its EventBuffer is full, and that nothing is lost.
+func TestEventBuffer(t *testing.T) {
+	g := newGate()
+	w, s, rec := backpressureStore(t, g, func(w *k8sutil.WatchingStore) {
+		w.EventBuffer = 3
+	})
+	g.hold()
+	s.Send(k8s.EventModified, configMap("default", "a", "2"))
+	g.waitHeld(t)
+	// Three fill the buffer; the watch reads the fourth, and waits.
+	for rv := 3; rv <= 6; rv++ {
+		s.Send(k8s.EventModified, configMap("default", "a", strconv.Itoa(rv)))
+	}
+	g.release()
+	rec.Expect(t,
+		"v1 ConfigMap: default/a@2",
+		"v1 ConfigMap: default/a@3",
+		"v1 ConfigMap: default/a@4",
+		"v1 ConfigMap: default/a@5",
+		"v1 ConfigMap: default/a@6")
+	if n := w.Overflows(); n != 0 {
+		t.Errorf("got %d overflows with OverflowBlock", n)
+	}
+}
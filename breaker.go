@@ -0,0 +1,165 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A FailingError describes a watch that keeps failing.  Run gives up,
+// returning a *RunError that wraps one, per the WatchingStore's
+// FailAfter or FailAfterDuration.
+type FailingError struct {
+	Watch    WatchID
+	Failures int       // the number of failures in a row
+	Since    time.Time // when the first of them was
+	Err      error     // the last of them
+}
+
+func (e *FailingError) Error() string {
+	return fmt.Sprintf("%s failed %d times in a row since %s: %v",
+		e.Watch, e.Failures, e.Since.Format(time.RFC3339), e.Err)
+}
+
+func (e *FailingError) Unwrap() error {
+	return e.Err
+}
+
+// A breaker counts a watch's consecutive failures, and trips once there
+// are too many, or they have gone on for too long.  It is only used by
+// the watch's goroutine.  A nil *breaker never trips.
+type breaker struct {
+	failAfter         int
+	failAfterDuration time.Duration
+	trip              func(*FailingError)
+
+	failures int
+	since    time.Time
+	err      error // the last failure
+}
+
+// success notes that the watch listed or started watching.
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+	b.failures = 0
+}
+
+// failure notes that the watch failed with err.
+func (b *breaker) failure(now time.Time, w *watch, err error) {
+	if b == nil {
+		return
+	}
+	if b.failures == 0 {
+		b.since = now
+	}
+	b.failures++
+	b.err = err
+	if (b.failAfter > 0 && b.failures >= b.failAfter) ||
+		(b.failAfterDuration > 0 && now.Sub(b.since) >= b.failAfterDuration) {
+		b.trip(&FailingError{Watch: w.id(), Failures: b.failures, Since: b.since, Err: err})
+	}
+}
+
+// failing returns a FailingError describing the watch's current run
+// of failures, or nil if it isn't failing.
+func (b *breaker) failing(w *watch) *FailingError {
+	if b == nil || b.failures == 0 {
+		return nil
+	}
+	return &FailingError{Watch: w.id(), Failures: b.failures, Since: b.since, Err: b.err}
+}
+
+// A RunError is what Run returns when it gives up.  Err is why, and
+// Failing describes each of the watches that were failing at the time,
+// in the order that they were added.
+type RunError struct {
+	Err     error // a *FailingError
+	Failing []*FailingError
+}
+
+func (e *RunError) Error() string {
+	msg := "giving up: " + e.Err.Error()
+	var others []string
+	for _, failing := range e.Failing {
+		if failing.Watch != e.failingWatch() {
+			others = append(others, failing.Error())
+		}
+	}
+	if len(others) > 0 {
+		msg += "; also failing: " + strings.Join(others, "; ")
+	}
+	return msg
+}
+
+func (e *RunError) Unwrap() error {
+	return e.Err
+}
+
+// failingWatch returns the watch that Run gave up on.
+func (e *RunError) failingWatch() WatchID {
+	var failing *FailingError
+	if errors.As(e.Err, &failing) {
+		return failing.Watch
+	}
+	return WatchID{}
+}
+
+// runError returns the error that Run returns when err stops it, once
+// the watches have exited.
+func (w *WatchingStore) runError(err error) *RunError {
+	ret := &RunError{Err: err}
+	for _, wa := range w.watches {
+		if failing := wa.breaker.failing(wa); failing != nil {
+			ret.Failing = append(ret.Failing, failing)
+		}
+	}
+	return ret
+}
+
+// A tripwire stops Run when one of the watches' breakers trips.
+type tripwire struct {
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err *FailingError // the first to trip
+}
+
+func (t *tripwire) trip(err *FailingError) {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mu.Unlock()
+	t.cancel()
+}
+
+// tripped returns the error that stopped Run, if one did.
+func (t *tripwire) tripped() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		return nil
+	}
+	return t.err
+}
+
+// newBreaker returns a breaker for a watch, or nil if the
+// WatchingStore doesn't give up on failing watches.
+func (w *WatchingStore) newBreaker(t *tripwire) *breaker {
+	if w.FailAfter <= 0 && w.FailAfterDuration <= 0 {
+		return nil
+	}
+	return &breaker{
+		failAfter:         w.FailAfter,
+		failAfterDuration: w.FailAfterDuration,
+		trip:              t.trip,
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// runFailing runs the store, whose lists fail, returning what Run does.
+func runFailing(t *testing.T, w *k8sutil.WatchingStore, server *fakeAPIServer) <-chan error {
+	server.setFailure("list", failure{code: http.StatusInternalServerError})
+	w.Client = server.client()
+	w.Logger = testLogger{t}
+	w.Callback = func(k8sutil.Store) {}
+	w.RepeatedErrorInterval = -1
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Run(ctx) }()
+	return errCh
+}
+
+func TestFailAfter(t *testing.T) {
+	server := newFakeAPIServer(t)
+	err := <-runFailing(t, &k8sutil.WatchingStore{FailAfter: 3}, server)
+	var failing *k8sutil.FailingError
+	if !errors.As(err, &failing) {
+		t.Fatalf("got error %v, want a *FailingError", err)
+	}
+	want := k8sutil.WatchID{Type: "v1 ConfigMap", Namespace: "default"}
+	if failing.Watch != want || failing.Failures != 3 {
+		t.Errorf("gave up on %v after %d failures", failing.Watch, failing.Failures)
+	}
+	if failing.Err == nil {
+		t.Errorf("lost the last failure")
+	}
+	var runErr *k8sutil.RunError
+	if !errors.As(err, &runErr) {
+		t.Fatalf("got error %v, want a *RunError", err)
+	}
+	if len(runErr.Failing) != 1 || runErr.Failing[0].Watch != want {
+		t.Errorf("got failing watches %v", runErr.Failing)
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) {},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Run(ctx) }()
+	server.await("watch")
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("got %v on shutdown, want nil", err)
+	}
+}
+
+func TestFailAfterDuration(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	errCh := runFailing(t, &k8sutil.WatchingStore{FailAfterDuration: time.Minute, Clock: clock}, server)
+	server.await("list")
+	server.await("list")
+	select {
+	case err := <-errCh:
+		t.Fatalf("gave up before the FailAfterDuration: %v", err)
+	default:
+	}
+	clock.Advance(time.Minute)
+	err := <-errCh
+	var failing *k8sutil.FailingError
+	if !errors.As(err, &failing) {
+		t.Fatalf("got error %v, want a *FailingError", err)
+	}
+	if !failing.Since.Equal(epoch) {
+		t.Errorf("failing since %v, want %v", failing.Since, epoch)
+	}
+}
@@ -0,0 +1,500 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// A CacheServer is an http.Handler that serves the contents of a
+// WatchingStore read-only, in the conventions of the Kubernetes API:
+// the same paths, query parameters, and JSON documents, for the get,
+// list, and watch verbs, along with the discovery documents that
+// describe the watched types.  This lets kubectl and client libraries
+// be pointed at the cache, to take read-heavy workloads off of the
+// apiserver, or to debug without access to the cluster, e.g.
+//
+//	http.Handle("/", &k8sutil.CacheServer{Store: store})
+//	...
+//	kubectl --server=http://localhost:8080 get pods
+//
+// Only the watched types are served, and only what is stored of them:
+// a list of every namespace holds just the namespaces that are
+// watched, and trimmed fields are missing.  Label selectors and the
+// metadata.name and metadata.namespace field selectors are supported;
+// the limit parameter is ignored, so lists are never paginated.
+//
+// The resourceVersion of a list is the Sequence of the Store that it
+// was listed from, and a watch may start from the most recent one (or,
+// with a resourceVersion of "" or "0", from the start, with an ADDED
+// event of each resource); for any other resourceVersion, including
+// those of the resources themselves, the watch reports that it is
+// expired (410 Gone), so that clients list again.
+type CacheServer struct {
+	Store *WatchingStore // must not be nil
+}
+
+// cacheServerVerbs are the verbs that a CacheServer supports.
+var cacheServerVerbs = []string{"get", "list", "watch"}
+
+// A servedResource is a type served by a CacheServer: its description,
+// and a sample of the type that it is stored as.
+type servedResource struct {
+	APIResource
+	sample k8s.Resource
+}
+
+// A cacheRequest is a request for the resources of a type.
+type cacheRequest struct {
+	resource  servedResource
+	namespace string // k8s.AllNamespaces for every namespace
+	name      string // if set, the resource to get or watch
+	watch     bool
+	labels    func(map[string]string) bool
+	fields    func(k8s.Resource) bool
+}
+
+// ServeHTTP serves a request.
+func (s *CacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "the cache is read-only")
+		return
+	}
+	if r.URL.Path == "/version" {
+		version := s.Store.ServerVersion()
+		if version == nil {
+			writeStatus(w, http.StatusNotFound, "NotFound", "the server version is not known")
+			return
+		}
+		writeJSON(w, http.StatusOK, version.Version)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var group, version string
+	switch {
+	case parts[0] == "api" && len(parts) == 1:
+		writeJSON(w, http.StatusOK, s.apiVersions())
+		return
+	case parts[0] == "api":
+		version, parts = parts[1], parts[2:]
+	case parts[0] == "apis" && len(parts) == 1:
+		writeJSON(w, http.StatusOK, s.apiGroupList())
+		return
+	case parts[0] == "apis" && len(parts) >= 3:
+		group, version, parts = parts[1], parts[2], parts[3:]
+	default:
+		writeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+	if len(parts) == 0 {
+		list, ok := s.apiResourceList(group, version)
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+	req, code, err := parseCacheRequest(r, parts, func(name string) (servedResource, bool) {
+		return s.resource(group, version, name)
+	})
+	if err != nil {
+		writeStatus(w, code, strings.Replace(http.StatusText(code), " ", "", -1), err.Error())
+		return
+	}
+	if req.watch {
+		s.serveWatch(w, r, req)
+		return
+	}
+	s.serveList(w, req)
+}
+
+// parseCacheRequest parses a request for resources, given the parts of
+// the path after the version and a function that looks up the served
+// type with a resource name, returning an HTTP status code along with
+// any error.
+func parseCacheRequest(r *http.Request, parts []string, lookup func(name string) (servedResource, bool)) (cacheRequest, int, error) {
+	req := cacheRequest{namespace: k8s.AllNamespaces}
+	query := r.URL.Query()
+	if parts[0] == "watch" {
+		req.watch, parts = true, parts[1:]
+	}
+	if req.watch || query.Get("watch") == "true" || query.Get("watch") == "1" {
+		req.watch = true
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		req.namespace, parts = parts[1], parts[2:]
+	}
+	if len(parts) == 0 || len(parts) > 2 {
+		return req, http.StatusNotFound, errors.New("the server could not find the requested resource")
+	}
+	resource, ok := lookup(parts[0])
+	if !ok || (!resource.Namespaced && req.namespace != k8s.AllNamespaces) {
+		return req, http.StatusNotFound, errors.Errorf("the server doesn't have a resource type %q", parts[0])
+	}
+	req.resource = resource
+	if len(parts) == 2 {
+		req.name = parts[1]
+	}
+	var err error
+	if req.labels, err = parseLabelSelector(query.Get("labelSelector")); err != nil {
+		return req, http.StatusBadRequest, err
+	}
+	if req.fields, err = parseFieldSelector(query.Get("fieldSelector")); err != nil {
+		return req, http.StatusBadRequest, err
+	}
+	return req, 0, nil
+}
+
+// matches returns whether the resource is one that was requested.
+func (req cacheRequest) matches(resource k8s.Resource) bool {
+	md := resource.GetMetadata()
+	if req.namespace != k8s.AllNamespaces && md.GetNamespace() != req.namespace {
+		return false
+	}
+	if req.name != "" && md.GetName() != req.name {
+		return false
+	}
+	return req.labels(md.GetLabels()) && req.fields(resource)
+}
+
+// serveList serves a get or list request.
+func (s *CacheServer) serveList(w http.ResponseWriter, req cacheRequest) {
+	store, err := s.Store.Snapshot()
+	if err != nil {
+		writeStatus(w, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+		return
+	}
+	writeResources(w, req, store.Sequence(), store.ListSorted(req.resource.sample))
+}
+
+// writeResources responds to a get or list request with the matching
+// resources, which are sorted, from the Store with the sequence.
+func writeResources(w http.ResponseWriter, req cacheRequest, sequence uint64, resources []k8s.Resource) {
+	items := []interface{}{}
+	for _, resource := range resources {
+		if !req.matches(resource) {
+			continue
+		}
+		object, err := req.resource.object(resource)
+		if err != nil {
+			writeStatus(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		items = append(items, object)
+	}
+	if req.name != "" {
+		if len(items) == 0 {
+			writeStatus(w, http.StatusNotFound, "NotFound",
+				req.resource.Name+" "+strconv.Quote(req.name)+" not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, items[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion": req.resource.GroupVersion(),
+		"kind":       req.resource.Kind + "List",
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.FormatUint(sequence, 10)},
+		"items":      items,
+	})
+}
+
+// serveWatch serves a watch request, until the client goes away, the
+// timeoutSeconds elapse, or Run returns.
+func (s *CacheServer) serveWatch(w http.ResponseWriter, r *http.Request, req cacheRequest) {
+	query := r.URL.Query()
+	var timeout <-chan time.Time
+	if seconds, err := strconv.Atoi(query.Get("timeoutSeconds")); err == nil && seconds > 0 {
+		timer := s.Store.clock().NewTimer(time.Duration(seconds) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+
+	// Subscribe before taking the snapshot, so that no change is
+	// missed in between.
+	sub := s.Store.subscribe(1, EventsCoalesce)
+	defer s.Store.unsubscribe(sub)
+	prev, err := s.Store.Snapshot()
+	if err != nil {
+		writeStatus(w, http.StatusServiceUnavailable, "ServiceUnavailable", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	send := func(eventType string, object interface{}) bool {
+		if err := enc.Encode(map[string]interface{}{"type": eventType, "object": object}); err != nil {
+			return false
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return true
+	}
+	sendResource := func(eventType string, resource k8s.Resource) bool {
+		object, err := req.resource.object(resource)
+		if err != nil {
+			return send("ERROR", statusObject(http.StatusInternalServerError, "InternalError", err.Error()))
+		}
+		return send(eventType, object)
+	}
+
+	switch rv := query.Get("resourceVersion"); rv {
+	case "", "0":
+		for _, resource := range prev.ListSorted(req.resource.sample) {
+			if req.matches(resource) && !sendResource("ADDED", resource) {
+				return
+			}
+		}
+	case strconv.FormatUint(prev.Sequence(), 10):
+	default:
+		send("ERROR", statusObject(http.StatusGone, "Expired",
+			"too old resource version: "+rv+" ("+strconv.FormatUint(prev.Sequence(), 10)+")"))
+		return
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	key := typeKeyOf(req.resource.sample)
+	for {
+		var d Delta
+		var ok bool
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			return
+		case d, ok = <-sub.out:
+			if !ok {
+				return
+			}
+		}
+		if d.Store.Sequence() <= prev.Sequence() || !changedType(d, key) {
+			continue
+		}
+		diff := DiffStores(prev, d.Store, req.resource.sample)
+		prev = d.Store
+		for _, resource := range diff.Added {
+			if req.matches(resource) && !sendResource("ADDED", resource) {
+				return
+			}
+		}
+		for _, change := range diff.Changed {
+			var ok bool
+			switch was, is := req.matches(change.Old), req.matches(change.New); {
+			case was && is:
+				ok = sendResource("MODIFIED", change.New)
+			case was:
+				ok = sendResource("DELETED", change.New)
+			case is:
+				ok = sendResource("ADDED", change.New)
+			default:
+				ok = true
+			}
+			if !ok {
+				return
+			}
+		}
+		for _, resource := range diff.Removed {
+			if req.matches(resource) && !sendResource("DELETED", resource) {
+				return
+			}
+		}
+	}
+}
+
+// changedType returns whether the Delta changed the type.
+func changedType(d Delta, key typeKey) bool {
+	for _, sample := range d.Changed {
+		if typeKeyOf(sample) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// object returns the JSON object of a resource of the type, with its
+// apiVersion and kind, which typed resources don't carry.
+func (r servedResource) object(resource k8s.Resource) (map[string]interface{}, error) {
+	object, err := jsonObject(resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "encode %s", r.GroupVersionKind())
+	}
+	object["apiVersion"] = r.GroupVersion()
+	object["kind"] = r.Kind
+	return object, nil
+}
+
+// resources returns the types that are served: those of the watches,
+// in the types that they are stored as.
+func (s *CacheServer) resources() []servedResource {
+	var ret []servedResource
+	seen := make(map[typeKey]bool)
+	for _, wa := range s.Store.currentWatches() {
+		sample := wa.storeSample()
+		key := typeKeyOf(sample)
+		if seen[key] {
+			continue
+		}
+		resource, err := apiResourceForType(sample)
+		if err == nil && resource.Name == "" && wa.normalized == nil {
+			resource, err = apiResourceForList(wa.list)
+		}
+		if err != nil || resource.Name == "" {
+			continue
+		}
+		seen[key] = true
+		resource.Verbs = cacheServerVerbs
+		ret = append(ret, servedResource{APIResource: resource, sample: sample})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].GroupVersion() != ret[j].GroupVersion() {
+			return ret[i].GroupVersion() < ret[j].GroupVersion()
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// resource returns the served type with the group, version, and
+// resource name.
+func (s *CacheServer) resource(group, version, name string) (servedResource, bool) {
+	for _, resource := range s.resources() {
+		if resource.Group == group && resource.Version == version && resource.Name == name {
+			return resource, true
+		}
+	}
+	return servedResource{}, false
+}
+
+// apiVersions returns the /api discovery document.
+func (s *CacheServer) apiVersions() map[string]interface{} {
+	versions := []string{}
+	for _, resource := range s.resources() {
+		if resource.Group == "" && !containsString(versions, resource.Version) {
+			versions = append(versions, resource.Version)
+		}
+	}
+	return map[string]interface{}{
+		"kind":                       "APIVersions",
+		"versions":                   versions,
+		"serverAddressByClientCIDRs": []interface{}{},
+	}
+}
+
+// apiGroupList returns the /apis discovery document.  The first served
+// version of each group is its preferred version.
+func (s *CacheServer) apiGroupList() map[string]interface{} {
+	groups := []interface{}{}
+	versions := make(map[string][]interface{})
+	var names []string
+	for _, resource := range s.resources() {
+		if resource.Group == "" {
+			continue
+		}
+		gv := map[string]interface{}{"groupVersion": resource.GroupVersion(), "version": resource.Version}
+		if _, ok := versions[resource.Group]; !ok {
+			names = append(names, resource.Group)
+		}
+		if list := versions[resource.Group]; len(list) == 0 || list[len(list)-1].(map[string]interface{})["version"] != resource.Version {
+			versions[resource.Group] = append(list, gv)
+		}
+	}
+	for _, name := range names {
+		groups = append(groups, map[string]interface{}{
+			"name":             name,
+			"versions":         versions[name],
+			"preferredVersion": versions[name][0],
+		})
+	}
+	return map[string]interface{}{
+		"kind":       "APIGroupList",
+		"apiVersion": "v1",
+		"groups":     groups,
+	}
+}
+
+// apiResourceList returns the discovery document of a group and
+// version, and whether any of its types are served.
+func (s *CacheServer) apiResourceList(group, version string) (map[string]interface{}, bool) {
+	var served []servedResource
+	for _, resource := range s.resources() {
+		if resource.Group == group && resource.Version == version {
+			served = append(served, resource)
+		}
+	}
+	gv := GroupVersionKind{Group: group, Version: version}.APIVersion()
+	return apiResourceListObject(gv, served), len(served) > 0
+}
+
+// apiResourceListObject returns the discovery document of the types of
+// a group and version.
+func apiResourceListObject(groupVersion string, served []servedResource) map[string]interface{} {
+	resources := []interface{}{}
+	for _, resource := range served {
+		resources = append(resources, map[string]interface{}{
+			"name":         resource.Name,
+			"singularName": "",
+			"namespaced":   resource.Namespaced,
+			"kind":         resource.Kind,
+			"verbs":        resource.Verbs,
+		})
+	}
+	return map[string]interface{}{
+		"kind":         "APIResourceList",
+		"apiVersion":   "v1",
+		"groupVersion": groupVersion,
+		"resources":    resources,
+	}
+}
+
+// statusObject returns a failure Status, as the apiserver reports
+// errors.
+func statusObject(code int, reason, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"metadata":   map[string]interface{}{},
+		"status":     "Failure",
+		"message":    message,
+		"reason":     reason,
+		"code":       code,
+	}
+}
+
+// writeStatus responds with a failure Status.
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	writeJSON(w, code, statusObject(code, reason, message))
+}
+
+// writeJSON responds with a JSON document.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// newCacheServer returns the URL of a CacheServer of the store, once
+// it has synced.
+func newCacheServer(t *testing.T, w *k8sutil.WatchingStore) string {
+	t.Helper()
+	synced := make(chan struct{})
+	var once bool
+	w.Callback = func(k8sutil.Store) {
+		if !once {
+			once = true
+			close(synced)
+		}
+	}
+	runStore(t, w)
+	select {
+	case <-synced:
+	case <-time.After(timeout):
+		t.Fatal("the store never synced")
+	}
+	server := httptest.NewServer(&k8sutil.CacheServer{Store: w})
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// getJSON gets the JSON document at the URL, returning the status code.
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return resp.StatusCode
+}
+
+type cacheList struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+func (l cacheList) names() []string {
+	var ret []string
+	for _, item := range l.Items {
+		ret = append(ret, item.Metadata.Name)
+	}
+	return ret
+}
+
+func TestCacheServer(t *testing.T) {
+	server := newFakeAPIServer(t)
+	a := newConfigMap("default", "a")
+	a.Metadata.Labels = map[string]string{"app": "web"}
+	server.set(a)
+	server.set(newConfigMap("default", "b"))
+	server.set(newConfigMap("other", "c"))
+	w := &k8sutil.WatchingStore{Client: server.client(), Logger: testLogger{t}}
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{})
+	url := newCacheServer(t, w)
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/configmaps", "a b c"},
+		{"/api/v1/namespaces/default/configmaps", "a b"},
+		{"/api/v1/configmaps?labelSelector=app%3Dweb", "a"},
+		{"/api/v1/configmaps?labelSelector=app%21%3Dweb", "b c"},
+		{"/api/v1/configmaps?fieldSelector=metadata.namespace%3Dother", "c"},
+	} {
+		var list cacheList
+		if code := getJSON(t, url+tc.path, &list); code != http.StatusOK {
+			t.Errorf("GET %s: %d", tc.path, code)
+			continue
+		}
+		if got := strings.Join(list.names(), " "); got != tc.want || list.Kind != "ConfigMapList" {
+			t.Errorf("GET %s: got %s %q, want %q", tc.path, list.Kind, got, tc.want)
+		}
+		for _, item := range list.Items {
+			if item.APIVersion != "v1" || item.Kind != "ConfigMap" {
+				t.Errorf("GET %s: got an item of %s %s", tc.path, item.APIVersion, item.Kind)
+			}
+		}
+	}
+
+	var cm corev1.ConfigMap
+	if code := getJSON(t, url+"/api/v1/namespaces/default/configmaps/a", &cm); code != http.StatusOK || cm.GetMetadata().GetName() != "a" {
+		t.Errorf("get: %d %v", code, cm.GetMetadata())
+	}
+	var status map[string]interface{}
+	for path, want := range map[string]int{
+		"/api/v1/namespaces/default/configmaps/missing": http.StatusNotFound,
+		"/api/v1/secrets":                      http.StatusNotFound,
+		"/api/v1/configmaps?labelSelector=%3D": http.StatusBadRequest,
+	} {
+		if code := getJSON(t, url+path, &status); code != want || status["kind"] != "Status" {
+			t.Errorf("GET %s: got %d %v, want %d", path, code, status, want)
+		}
+	}
+	resp, err := http.Post(url+"/api/v1/namespaces/default/configmaps", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d", resp.StatusCode)
+	}
+
+	var discovery struct {
+		Resources []struct {
+			Name  string   `json:"name"`
+			Verbs []string `json:"verbs"`
+		} `json:"resources"`
+	}
+	if getJSON(t, url+"/api/v1", &discovery); len(discovery.Resources) != 1 || discovery.Resources[0].Name != "configmaps" {
+		t.Errorf("discovered %+v", discovery)
+	}
+}
+
+func TestCacheServerWatch(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	w := &k8sutil.WatchingStore{Client: server.client(), Logger: testLogger{t}}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	url := newCacheServer(t, w)
+
+	var list cacheList
+	getJSON(t, url+"/api/v1/namespaces/default/configmaps", &list)
+	resp, err := http.Get(url + "/api/v1/namespaces/default/configmaps?watch=true&resourceVersion=" + list.Metadata.ResourceVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	server.set(newConfigMap("default", "b"))
+	server.remove(newConfigMap("default", "a"))
+	decoder := json.NewDecoder(resp.Body)
+	var got []string
+	for len(got) < 2 {
+		var event struct {
+			Type   string `json:"type"`
+			Object struct {
+				Metadata struct {
+					Name string `json:"name"`
+				} `json:"metadata"`
+			} `json:"object"`
+		}
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, event.Type+" "+event.Object.Metadata.Name)
+	}
+	if want := "ADDED b, DELETED a"; strings.Join(got, ", ") != want {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+
+	var event struct {
+		Type   string `json:"type"`
+		Object struct {
+			Code int `json:"code"`
+		} `json:"object"`
+	}
+	if getJSON(t, url+"/api/v1/namespaces/default/configmaps?watch=true&resourceVersion=1", &event); event.Type != "ERROR" || event.Object.Code != http.StatusGone {
+		t.Errorf("watch from an old resourceVersion: got %+v", event)
+	}
+}
+
+// TestCacheServerKubeJSON checks that typed resources are served in
+// the apiserver's JSON encoding.
+func TestCacheServerKubeJSON(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	w := &k8sutil.WatchingStore{Backend: backend, Logger: testLogger{t}}
+	w.AddWatch("default", &appsv1.DeploymentList{})
+	backend.Stream("default", &appsv1.DeploymentList{}).List(&appsv1.DeploymentList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items: []*appsv1.Deployment{{
+			Metadata: k8sutiltest.ObjectMeta("default", "web", "1"),
+			Spec: &appsv1.DeploymentSpec{Template: &corev1.PodTemplateSpec{Spec: &corev1.PodSpec{
+				Containers: []*corev1.Container{{
+					Name:      k8s.String("web"),
+					Ports:     []*corev1.ContainerPort{{ContainerPort: k8s.Int32(8080)}},
+					Resources: &corev1.ResourceRequirements{Requests: map[string]*resource.Quantity{"cpu": {String_: k8s.String("100m")}}},
+				}},
+			}}},
+		}},
+	})
+	url := newCacheServer(t, w)
+
+	var deployment struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					Containers []struct {
+						Ports []struct {
+							ContainerPort int `json:"containerPort"`
+						} `json:"ports"`
+						Resources struct {
+							Requests map[string]string `json:"requests"`
+						} `json:"resources"`
+					} `json:"containers"`
+				} `json:"spec"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if code := getJSON(t, url+"/apis/apps/v1/namespaces/default/deployments/web", &deployment); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	containers := deployment.Spec.Template.Spec.Containers
+	if len(containers) != 1 || containers[0].Resources.Requests["cpu"] != "100m" ||
+		len(containers[0].Ports) != 1 || containers[0].Ports[0].ContainerPort != 8080 {
+		t.Errorf("got containers %+v", containers)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+)
+
+// InjectCAFromAnnotation is the annotation of a webhook configuration,
+// CustomResourceDefinition, or APIService that asks a CAInjector to
+// keep its caBundle up to date, with the "namespace/name" of the Secret
+// that holds the CA as the value.
+const InjectCAFromAnnotation = "k8sutil.datawire.io/inject-ca-from"
+
+// CABundleKey is the key of the CA bundle in the Secrets that a
+// CAInjector injects from, as with the Secrets of service account
+// tokens and cert-manager certificates.
+const CABundleKey = "ca.crt"
+
+// caInjectionTargets are the types that a CAInjector injects in to.
+var caInjectionTargets = []APIResource{
+	{Group: "admissionregistration.k8s.io", Version: "v1", Name: "mutatingwebhookconfigurations", Kind: "MutatingWebhookConfiguration"},
+	{Group: "admissionregistration.k8s.io", Version: "v1", Name: "validatingwebhookconfigurations", Kind: "ValidatingWebhookConfiguration"},
+	{Group: "apiextensions.k8s.io", Version: "v1", Name: "customresourcedefinitions", Kind: "CustomResourceDefinition"},
+	{Group: "apiregistration.k8s.io", Version: "v1", Name: "apiservices", Kind: "APIService"},
+}
+
+// A CAInjector keeps the caBundle of the webhook configurations
+// (Mutating and Validating), CustomResourceDefinitions (for their
+// conversion webhooks), and APIServices that have an
+// InjectCAFromAnnotation up to date with the CA in the Secret that the
+// annotation names, so that rotating the CA of a webhook or aggregated
+// API server takes no more than updating the Secret.
+//
+// It learns of both from the Store, which must watch Secrets (as
+// *corev1.Secret) in the namespaces of the CAs, and the targets as
+// Unstructured resources, with AddWatchEverything: v1 of the
+// admissionregistration.k8s.io, apiextensions.k8s.io, and
+// apiregistration.k8s.io groups.  Types that it doesn't watch are left
+// alone.
+type CAInjector struct {
+	Client *k8s.Client    // must not be nil
+	Store  *WatchingStore // must not be nil
+	Logger Logger         // must not be nil
+}
+
+// Run injects CAs whenever the Store changes, until the Context is
+// done, and then returns nil.
+func (c *CAInjector) Run(ctx context.Context) error {
+	logger := newDedupLogger(c.Logger, 0, c.Store.clock())
+	sub := c.Store.subscribe(1, EventsCoalesce)
+	defer c.Store.unsubscribe(sub)
+	if s, err := c.Store.Snapshot(); err == nil {
+		c.inject(ctx, s, logger)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-sub.out:
+			if !ok {
+				<-ctx.Done()
+				return nil
+			}
+			c.inject(ctx, d.Store, logger)
+		}
+	}
+}
+
+// inject patches the caBundle of every target whose CA has changed.
+func (c *CAInjector) inject(ctx context.Context, s Store, logger Logger) {
+	for _, target := range caInjectionTargets {
+		for _, r := range s.ListSorted(NewUnstructured(target.GroupVersion(), target.Kind)) {
+			object := r.(*Unstructured)
+			md := object.GetMetadata()
+			from, ok := md.GetAnnotations()[InjectCAFromAnnotation]
+			if !ok {
+				continue
+			}
+			where := target.Kind + " " + md.GetName()
+			bundle, err := caBundleFrom(s, from)
+			if err != nil {
+				logger.Errorf("inject CA in to %s: %v", where, err)
+				continue
+			}
+			ops := caBundleOps(target.Kind, object.Object, base64.StdEncoding.EncodeToString(bundle))
+			if len(ops) == 0 {
+				continue
+			}
+			err = doJSON(ctx, c.Client, request{
+				verb:        http.MethodPatch,
+				path:        target.Path("") + "/" + url.PathEscape(md.GetName()),
+				contentType: JSONPatchType,
+			}, ops, nil)
+			if err != nil && ctx.Err() == nil {
+				logger.Errorf("inject CA in to %s: %v", where, err)
+			}
+		}
+	}
+}
+
+// caBundleFrom returns the CA bundle in the Secret with the
+// "namespace/name".
+func caBundleFrom(s Store, from string) ([]byte, error) {
+	i := strings.Index(from, "/")
+	if i < 0 {
+		return nil, errors.Errorf("%s %q isn't a namespace/name", InjectCAFromAnnotation, from)
+	}
+	key := ObjectKey{Namespace: from[:i], Name: from[i+1:]}
+	for _, r := range s.List(&corev1.Secret{}) {
+		if objectKeyOf(r) != key {
+			continue
+		}
+		bundle := r.(*corev1.Secret).GetData()[CABundleKey]
+		if len(bundle) == 0 {
+			return nil, errors.Errorf("secret %s has no %s", key, CABundleKey)
+		}
+		return bundle, nil
+	}
+	return nil, errors.Errorf("no secret %s", key)
+}
+
+// caBundleOps returns the JSON patch that sets the caBundle fields of
+// the object of the kind to the (base64-encoded) bundle, for those that
+// aren't set to it already.
+func caBundleOps(kind string, object map[string]interface{}, bundle string) []jsonPatchOp {
+	var ops []jsonPatchOp
+	switch kind {
+	case "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration":
+		webhooks, _ := object["webhooks"].([]interface{})
+		for i, webhook := range webhooks {
+			webhook, _ := webhook.(map[string]interface{})
+			if jsonPath(webhook, "clientConfig", "caBundle") == bundle {
+				continue
+			}
+			// The webhooks are patched by index, so make sure
+			// that they haven't moved since.
+			path := "/webhooks/" + strconv.Itoa(i)
+			ops = append(ops,
+				jsonPatchOp{Op: "test", Path: path + "/name", Value: webhook["name"]},
+				jsonPatchOp{Op: "add", Path: path + "/clientConfig/caBundle", Value: bundle})
+		}
+	case "CustomResourceDefinition":
+		if _, ok := jsonPath(object, "spec", "conversion", "webhook", "clientConfig").(map[string]interface{}); !ok {
+			// It has no conversion webhook.
+			break
+		}
+		if jsonPath(object, "spec", "conversion", "webhook", "clientConfig", "caBundle") != bundle {
+			ops = append(ops, jsonPatchOp{Op: "add", Path: "/spec/conversion/webhook/clientConfig/caBundle", Value: bundle})
+		}
+	case "APIService":
+		if jsonPath(object, "spec", "service") == nil || jsonPath(object, "spec", "insecureSkipTLSVerify") == true {
+			// It is served locally, or without verification.
+			break
+		}
+		if jsonPath(object, "spec", "caBundle") != bundle {
+			ops = append(ops, jsonPatchOp{Op: "add", Path: "/spec/caBundle", Value: bundle})
+		}
+	}
+	return ops
+}
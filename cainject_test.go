@@ -0,0 +1,150 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// A fakePatches records the PATCH requests that it is sent.
+type fakePatches struct {
+	mu      sync.Mutex
+	patches []string
+}
+
+func (f *fakePatches) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.patches = append(f.patches, r.Method+" "+r.URL.Path+" "+string(data))
+	f.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// wait waits for n patches to have been sent, and returns them, sorted.
+func (f *fakePatches) wait(t *testing.T, n int) []string {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); ; time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		patches := append([]string(nil), f.patches...)
+		f.mu.Unlock()
+		if len(patches) >= n {
+			time.Sleep(quiet)
+			f.mu.Lock()
+			patches, f.patches = f.patches, nil
+			f.mu.Unlock()
+			sort.Strings(patches)
+			return patches
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d patches; got %q", n, patches)
+		}
+	}
+}
+
+func caTarget(group, name, kind string, annotated bool, object map[string]interface{}) (k8sutil.APIResource, *k8sutil.Unstructured) {
+	resource := k8sutil.APIResource{Group: group, Version: "v1", Name: name, Kind: kind}
+	metadata := map[string]interface{}{"name": strings.ToLower(kind), "uid": kind, "resourceVersion": "1"}
+	if annotated {
+		metadata["annotations"] = map[string]interface{}{k8sutil.InjectCAFromAnnotation: "certs/ca"}
+	}
+	object["apiVersion"], object["kind"], object["metadata"] = resource.GroupVersion(), kind, metadata
+	return resource, &k8sutil.Unstructured{Object: object}
+}
+
+func TestCAInjector(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	server := httptest.NewServer(&fakePatches{})
+	defer server.Close()
+	f := server.Config.Handler.(*fakePatches)
+	backend := k8sutiltest.NewScriptedBackend(t)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) {},
+	}
+	w.AddWatch("certs", &corev1.SecretList{})
+	secret := func(rv, ca string) *corev1.Secret {
+		return &corev1.Secret{Metadata: k8sutiltest.ObjectMeta("certs", "ca", rv), Data: map[string][]byte{k8sutil.CABundleKey: []byte(ca)}}
+	}
+	secrets := backend.Stream("certs", &corev1.SecretList{})
+	secrets.List(&corev1.SecretList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.Secret{secret("1", "CA1")}})
+
+	targets := []struct {
+		annotated bool
+		group     string
+		name      string
+		kind      string
+		object    map[string]interface{}
+	}{
+		{true, "admissionregistration.k8s.io", "mutatingwebhookconfigurations", "MutatingWebhookConfiguration", map[string]interface{}{
+			"webhooks": []interface{}{
+				map[string]interface{}{"name": "a", "clientConfig": map[string]interface{}{}},
+				map[string]interface{}{"name": "b", "clientConfig": map[string]interface{}{"caBundle": b64([]byte("CA1"))}},
+			},
+		}},
+		{false, "admissionregistration.k8s.io", "validatingwebhookconfigurations", "ValidatingWebhookConfiguration", map[string]interface{}{
+			"webhooks": []interface{}{map[string]interface{}{"name": "a", "clientConfig": map[string]interface{}{}}},
+		}},
+		{true, "apiextensions.k8s.io", "customresourcedefinitions", "CustomResourceDefinition", map[string]interface{}{
+			"spec": map[string]interface{}{"conversion": map[string]interface{}{"webhook": map[string]interface{}{"clientConfig": map[string]interface{}{}}}},
+		}},
+		{true, "apiregistration.k8s.io", "apiservices", "APIService", map[string]interface{}{
+			"spec": map[string]interface{}{"service": map[string]interface{}{"name": "api"}},
+		}},
+	}
+	for _, target := range targets {
+		resource, u := caTarget(target.group, target.name, target.kind, target.annotated, target.object)
+		list := &k8sutil.UnstructuredList{Resource: resource}
+		w.AddWatch("", list)
+		backend.Stream("", list).List(&k8sutil.UnstructuredList{Metadata: k8sutiltest.ListMeta("1"), Items: []*k8sutil.Unstructured{u}})
+	}
+	runStore(t, w)
+	c := &k8sutil.CAInjector{
+		Client: &k8s.Client{Endpoint: server.URL, Client: server.Client()},
+		Store:  w,
+		Logger: testLogger{t},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = c.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	want := []string{
+		`PATCH /apis/admissionregistration.k8s.io/v1/mutatingwebhookconfigurations/mutatingwebhookconfiguration [{"op":"test","path":"/webhooks/0/name","value":"a"},{"op":"add","path":"/webhooks/0/clientConfig/caBundle","value":"Q0Ex"}]`,
+		`PATCH /apis/apiextensions.k8s.io/v1/customresourcedefinitions/customresourcedefinition [{"op":"add","path":"/spec/conversion/webhook/clientConfig/caBundle","value":"Q0Ex"}]`,
+		`PATCH /apis/apiregistration.k8s.io/v1/apiservices/apiservice [{"op":"add","path":"/spec/caBundle","value":"Q0Ex"}]`,
+	}
+	if got := f.wait(t, len(want)); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got patches\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Rotating the CA updates every target, as they still have the
+	// old one in the store.
+	secrets.WaitForWatch(1)
+	secrets.Send(k8s.EventModified, secret("2", "CA2"))
+	got := f.wait(t, 3)
+	if len(got) != 3 || !strings.Contains(got[0], `"path":"/webhooks/1/clientConfig/caBundle","value":"Q0Ey"`) {
+		t.Errorf("got patches after rotation\n%s", strings.Join(got, "\n"))
+	}
+}
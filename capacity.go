@@ -0,0 +1,241 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"expvar"
+	"math"
+	"strconv"
+	"strings"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+	"github.com/pkg/errors"
+)
+
+// ResourceAmounts are amounts of CPU and memory.
+type ResourceAmounts struct {
+	CPU    int64 `json:"cpu_millicores"`
+	Memory int64 `json:"memory_bytes"`
+}
+
+func (a *ResourceAmounts) add(b ResourceAmounts) {
+	a.CPU += b.CPU
+	a.Memory += b.Memory
+}
+
+// ResourceUsage is how much CPU and memory a set of Pods requests and
+// is limited to.  A container without a limit isn't counted in the
+// Limits, so they understate what the Pods may use.
+type ResourceUsage struct {
+	Pods     int             `json:"pods"`
+	Requests ResourceAmounts `json:"requests"`
+	Limits   ResourceAmounts `json:"limits"`
+}
+
+func (u *ResourceUsage) add(requests, limits ResourceAmounts) {
+	u.Pods++
+	u.Requests.add(requests)
+	u.Limits.add(limits)
+}
+
+// NamespaceCapacity is the usage of a namespace's Pods, and the
+// quota that its ResourceQuotas impose.
+type NamespaceCapacity struct {
+	ResourceUsage
+
+	// Quota, if the namespace has any ResourceQuotas, is the
+	// tightest of their hard limits on the number of Pods, and on
+	// the requests and limits of CPU and memory; zero where none of
+	// them sets one.
+	Quota *ResourceUsage `json:"quota,omitempty"`
+}
+
+// NodeCapacity is the usage of the Pods scheduled to a Node, and
+// what the Node can allocate to them.
+type NodeCapacity struct {
+	ResourceUsage
+	Allocatable ResourceAmounts `json:"allocatable"`
+	MaxPods     int             `json:"max_pods"`
+}
+
+// A CapacitySummary aggregates the CPU and memory requests and limits
+// of the stored Pods, by namespace and by node, alongside the stored
+// ResourceQuotas and the Nodes' allocatable resources, for insight in
+// to capacity without any further requests to the apiserver.  Only
+// Pods that are pending or running are counted.
+type CapacitySummary struct {
+	Total      ResourceUsage                `json:"total"`
+	Namespaces map[string]NamespaceCapacity `json:"namespaces"`
+
+	// Nodes are by name; Pods that aren't scheduled are under "".
+	Nodes map[string]NodeCapacity `json:"nodes"`
+}
+
+// SummarizeCapacity summarizes the Pods, ResourceQuotas, and Nodes in
+// the store, which should be watching all three, in all namespaces.
+// The CPU and memory of a Pod are those of its containers, or of its
+// largest init container, if that is more, as the scheduler counts
+// them.  Quantities that can't be parsed are ignored.
+func SummarizeCapacity(store Store) CapacitySummary {
+	ret := CapacitySummary{
+		Namespaces: make(map[string]NamespaceCapacity),
+		Nodes:      make(map[string]NodeCapacity),
+	}
+	for _, r := range store.List(&corev1.Pod{}) {
+		pod := r.(*corev1.Pod)
+		switch pod.GetStatus().GetPhase() {
+		case "Succeeded", "Failed":
+			continue
+		}
+		requests, limits := podResources(pod.GetSpec())
+		ret.Total.add(requests, limits)
+		ns := ret.Namespaces[pod.GetMetadata().GetNamespace()]
+		ns.add(requests, limits)
+		ret.Namespaces[pod.GetMetadata().GetNamespace()] = ns
+		node := ret.Nodes[pod.GetSpec().GetNodeName()]
+		node.add(requests, limits)
+		ret.Nodes[pod.GetSpec().GetNodeName()] = node
+	}
+	for _, r := range store.List(&corev1.ResourceQuota{}) {
+		quota := r.(*corev1.ResourceQuota)
+		hard := quota.GetStatus().GetHard()
+		if len(hard) == 0 {
+			hard = quota.GetSpec().GetHard()
+		}
+		ns := ret.Namespaces[quota.GetMetadata().GetNamespace()]
+		if ns.Quota == nil {
+			ns.Quota = new(ResourceUsage)
+		}
+		tighten := func(have *int64, names ...string) {
+			for _, name := range names {
+				if v, ok := quantityOf(hard, name, name == "cpu" || strings.HasSuffix(name, ".cpu")); ok && (*have == 0 || v < *have) {
+					*have = v
+				}
+			}
+		}
+		pods := int64(ns.Quota.Pods)
+		tighten(&pods, "pods")
+		ns.Quota.Pods = int(pods)
+		tighten(&ns.Quota.Requests.CPU, "cpu", "requests.cpu")
+		tighten(&ns.Quota.Requests.Memory, "memory", "requests.memory")
+		tighten(&ns.Quota.Limits.CPU, "limits.cpu")
+		tighten(&ns.Quota.Limits.Memory, "limits.memory")
+		ret.Namespaces[quota.GetMetadata().GetNamespace()] = ns
+	}
+	for _, r := range store.List(&corev1.Node{}) {
+		n := r.(*corev1.Node)
+		allocatable := n.GetStatus().GetAllocatable()
+		node := ret.Nodes[n.GetMetadata().GetName()]
+		node.Allocatable.CPU, _ = quantityOf(allocatable, "cpu", true)
+		node.Allocatable.Memory, _ = quantityOf(allocatable, "memory", false)
+		pods, _ := quantityOf(allocatable, "pods", false)
+		node.MaxPods = int(pods)
+		ret.Nodes[n.GetMetadata().GetName()] = node
+	}
+	return ret
+}
+
+// podResources returns the CPU and memory that a Pod requests and is
+// limited to.
+func podResources(spec *corev1.PodSpec) (requests, limits ResourceAmounts) {
+	for _, c := range spec.GetContainers() {
+		requests.add(containerAmounts(c.GetResources().GetRequests()))
+		limits.add(containerAmounts(c.GetResources().GetLimits()))
+	}
+	for _, c := range spec.GetInitContainers() {
+		maxAmounts(&requests, containerAmounts(c.GetResources().GetRequests()))
+		maxAmounts(&limits, containerAmounts(c.GetResources().GetLimits()))
+	}
+	return requests, limits
+}
+
+func containerAmounts(quantities map[string]*resource.Quantity) ResourceAmounts {
+	var ret ResourceAmounts
+	ret.CPU, _ = quantityOf(quantities, "cpu", true)
+	ret.Memory, _ = quantityOf(quantities, "memory", false)
+	return ret
+}
+
+func maxAmounts(a *ResourceAmounts, b ResourceAmounts) {
+	if b.CPU > a.CPU {
+		a.CPU = b.CPU
+	}
+	if b.Memory > a.Memory {
+		a.Memory = b.Memory
+	}
+}
+
+// quantityOf returns the named quantity, in thousandths if milli, or
+// false if it isn't set or can't be parsed.
+func quantityOf(quantities map[string]*resource.Quantity, name string, milli bool) (int64, bool) {
+	q, ok := quantities[name]
+	if !ok {
+		return 0, false
+	}
+	v, err := ParseQuantity(q.GetString_())
+	if err != nil {
+		return 0, false
+	}
+	if milli {
+		v *= 1000
+	}
+	return int64(math.Ceil(v)), true
+}
+
+// quantitySuffixes are the multipliers of the suffixes of quantities.
+var quantitySuffixes = map[string]float64{
+	"n": 1e-9, "u": 1e-6, "m": 1e-3, "": 1,
+	"k": 1e3, "M": 1e6, "G": 1e9, "T": 1e12, "P": 1e15, "E": 1e18,
+	"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40, "Pi": 1 << 50, "Ei": 1 << 60,
+}
+
+// ParseQuantity parses a quantity in the syntax of the Kubernetes API,
+// such as "100m", "1.5Gi", or "1e3", to its value.
+func ParseQuantity(str string) (float64, error) {
+	str = strings.TrimSpace(str)
+	end := strings.IndexFunc(str, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.' || r == '+' || r == '-')
+	})
+	if end < 0 {
+		end = len(str)
+	}
+	number, suffix := str[:end], str[end:]
+	multiplier, ok := quantitySuffixes[suffix]
+	if !ok && len(suffix) > 1 && (suffix[0] == 'e' || suffix[0] == 'E') {
+		exponent, err := strconv.Atoi(suffix[1:])
+		if err != nil {
+			return 0, errors.Errorf("invalid quantity %q", str)
+		}
+		multiplier, ok = math.Pow10(exponent), true
+	}
+	if !ok {
+		return 0, errors.Errorf("invalid quantity %q: unknown suffix %q", str, suffix)
+	}
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid quantity %q", str)
+	}
+	return v * multiplier, nil
+}
+
+// PublishCapacity publishes the SummarizeCapacity of the WatchingStore's
+// latest Store with the expvar package, as "k8sutil.<name>.capacity"
+// (or just "k8sutil.capacity", if name is empty), alongside the
+// variable of PublishExpvar on /debug/vars.  The variable is null
+// until the store has synced.  Like expvar.Publish, it panics if the
+// name is already in use, so call it once per WatchingStore.
+func (w *WatchingStore) PublishCapacity(name string) {
+	if name == "" {
+		name = "k8sutil.capacity"
+	} else {
+		name = "k8sutil." + name + ".capacity"
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		store, err := w.Snapshot()
+		if err != nil {
+			return nil
+		}
+		return SummarizeCapacity(store)
+	}))
+}
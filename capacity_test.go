@@ -0,0 +1,121 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestParseQuantity(t *testing.T) {
+	for str, want := range map[string]float64{
+		"100m":  0.1,
+		"2":     2,
+		"1.5Gi": 1.5 * (1 << 30),
+		"10k":   1e4,
+		"1e3":   1e3,
+		"250u":  250e-6,
+	} {
+		if got, err := k8sutil.ParseQuantity(str); err != nil || got != want {
+			t.Errorf("ParseQuantity(%q) = %v, %v, want %v", str, got, err, want)
+		}
+	}
+	for _, str := range []string{"", "1x", "ten", "1eX"} {
+		if _, err := k8sutil.ParseQuantity(str); err == nil {
+			t.Errorf("ParseQuantity(%q) succeeded", str)
+		}
+	}
+}
+
+// quantities returns a map of quantities of alternating names and
+// values.
+func quantities(kv ...string) map[string]*resource.Quantity {
+	ret := make(map[string]*resource.Quantity)
+	for i := 0; i < len(kv); i += 2 {
+		ret[kv[i]] = &resource.Quantity{String_: k8s.String(kv[i+1])}
+	}
+	return ret
+}
+
+func capacityPod(namespace, name, node, phase string, containers ...*corev1.Container) *corev1.Pod {
+	p := pod(namespace, name, phase)
+	p.Spec = &corev1.PodSpec{NodeName: k8s.String(node), Containers: containers}
+	return p
+}
+
+func container(requests, limits map[string]*resource.Quantity) *corev1.Container {
+	return &corev1.Container{Resources: &corev1.ResourceRequirements{Requests: requests, Limits: limits}}
+}
+
+func TestSummarizeCapacity(t *testing.T) {
+	web := capacityPod("a", "web", "node1", "Running",
+		container(quantities("cpu", "100m", "memory", "64Mi"), quantities("cpu", "1", "memory", "128Mi")),
+		container(quantities("cpu", "50m"), nil))
+	// The scheduler counts the larger of an init container and the
+	// sum of the containers.
+	web.Spec.InitContainers = []*corev1.Container{container(quantities("cpu", "500m"), nil)}
+	store := staticStore{
+		web,
+		capacityPod("a", "pending", "", "Pending", container(quantities("cpu", "200m"), nil)),
+		capacityPod("b", "done", "node1", "Succeeded", container(quantities("cpu", "4"), nil)),
+		&corev1.ResourceQuota{
+			Metadata: &metav1.ObjectMeta{Namespace: k8s.String("a"), Name: k8s.String("q1")},
+			Spec:     &corev1.ResourceQuotaSpec{Hard: quantities("pods", "10", "requests.cpu", "2", "limits.memory", "1Gi")},
+		},
+		&corev1.ResourceQuota{
+			Metadata: &metav1.ObjectMeta{Namespace: k8s.String("a"), Name: k8s.String("q2")},
+			Spec:     &corev1.ResourceQuotaSpec{Hard: quantities("pods", "5", "cpu", "4")},
+		},
+		&corev1.Node{
+			Metadata: &metav1.ObjectMeta{Name: k8s.String("node1")},
+			Status:   &corev1.NodeStatus{Allocatable: quantities("cpu", "3500m", "memory", "8Gi", "pods", "110")},
+		},
+	}
+
+	got := k8sutil.SummarizeCapacity(store)
+	webUsage := k8sutil.ResourceUsage{
+		Pods:     1,
+		Requests: k8sutil.ResourceAmounts{CPU: 500, Memory: 64 << 20},
+		Limits:   k8sutil.ResourceAmounts{CPU: 1000, Memory: 128 << 20},
+	}
+	pendingUsage := k8sutil.ResourceUsage{Pods: 1, Requests: k8sutil.ResourceAmounts{CPU: 200}}
+	want := k8sutil.CapacitySummary{
+		Total: k8sutil.ResourceUsage{
+			Pods:     2,
+			Requests: k8sutil.ResourceAmounts{CPU: 700, Memory: 64 << 20},
+			Limits:   webUsage.Limits,
+		},
+		Namespaces: map[string]k8sutil.NamespaceCapacity{
+			"a": {
+				ResourceUsage: k8sutil.ResourceUsage{
+					Pods:     2,
+					Requests: k8sutil.ResourceAmounts{CPU: 700, Memory: 64 << 20},
+					Limits:   webUsage.Limits,
+				},
+				Quota: &k8sutil.ResourceUsage{
+					Pods:     5,
+					Requests: k8sutil.ResourceAmounts{CPU: 2000},
+					Limits:   k8sutil.ResourceAmounts{Memory: 1 << 30},
+				},
+			},
+		},
+		Nodes: map[string]k8sutil.NodeCapacity{
+			"node1": {
+				ResourceUsage: webUsage,
+				Allocatable:   k8sutil.ResourceAmounts{CPU: 3500, Memory: 8 << 30},
+				MaxPods:       110,
+			},
+			"": {ResourceUsage: pendingUsage},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// A Checkpointer keeps the resourceVersion that each watch has caught up
+// to where the application wants it (a file, a ConfigMap, a database),
+// so that when the application restarts, its watches list the state of
+// the cluster at least as new as what it saw before, rather than
+// whatever an apiserver with a stale cache has.  A WatchingStore Loads
+// each watch's checkpoint once, before its first listing, and Saves it
+// after each listing, on each BOOKMARK, and, as events arrive, at most
+// every checkpointInterval.
+//
+// A Checkpointer is called from the watches' goroutines, so must be safe
+// for concurrent use; since a watch doesn't read its events while Save
+// runs, Save should be quick, or hand the saving off.
+type Checkpointer interface {
+	// Load returns the saved resourceVersion of the watch, or ""
+	// if there isn't one.
+	Load(ctx context.Context, id WatchID) (string, error)
+
+	// Save saves the resourceVersion of the watch.
+	Save(ctx context.Context, id WatchID, resourceVersion string) error
+}
+
+// checkpointInterval is how often a watch's checkpoint is saved, at
+// most, as events arrive.
+const checkpointInterval = 10 * time.Second
+
+// loadCheckpoint sets the resourceVersion that the watch's first
+// listing must be at least as new as from its Checkpointer, if it has
+// one.  It only does anything the first time that it is called.
+func (w *watch) loadCheckpoint(ctx context.Context, logger Logger) {
+	if w.checkpointer == nil || w.checkpointLoaded {
+		return
+	}
+	w.checkpointLoaded = true
+	resourceVersion, err := w.checkpointer.Load(ctx, w.id())
+	if err != nil {
+		logger.Errorf("load checkpoint of %s: %v", w.id(), err)
+		return
+	}
+	w.minVersion = resourceVersion
+}
+
+// checkpoint saves the resourceVersion with the watch's Checkpointer,
+// if it has one: if force is set, or if checkpointInterval has passed
+// since it last did.
+func (w *watch) checkpoint(ctx context.Context, logger Logger, resourceVersion string, force bool) {
+	if w.checkpointer == nil || resourceVersion == "" || resourceVersion == w.checkpointed {
+		return
+	}
+	now := w.clock.Now()
+	if !force && now.Sub(w.checkpointedAt) < checkpointInterval {
+		return
+	}
+	if err := w.checkpointer.Save(ctx, w.id(), resourceVersion); err != nil {
+		if ctx.Err() == nil {
+			logger.Errorf("save checkpoint of %s: %v", w.id(), err)
+		}
+		return
+	}
+	w.checkpointed, w.checkpointedAt = resourceVersion, now
+}
+
+// isStaleCheckpoint returns whether err is the apiserver refusing to
+// list at least as new as a checkpointed resourceVersion: because it
+// hasn't caught up to it ("Too large resource version"), which it never
+// will if the cluster was restored from a backup, or because it isn't
+// valid.
+func isStaleCheckpoint(err error) bool {
+	return apiErrorCode(err) == http.StatusGatewayTimeout || isRejected(err)
+}
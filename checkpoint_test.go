@@ -0,0 +1,117 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestCheckpointSession replays a watch that lists from its checkpoint,
+// and saves its progress after listing, on bookmarks, and otherwise at
+// most every ten seconds.
+func TestCheckpointSession(t *testing.T) {
+	ss := newSession(t)
+	clock := k8sutiltest.NewFakeClock(time.Unix(0, 0))
+	checkpointer := newCheckpointer("7")
+	store := ss.store()
+	store.Clock = clock
+	store.Checkpointer = checkpointer
+	store.AddWatch("default", &corev1.ConfigMapList{})
+	s := ss.stream("default")
+	ss.run(store)
+
+	ss.waitForList(s, 1)
+	ss.list(s, "9", configMap("default", "a", "8"))
+	ss.expect(1)
+	checkpointer.expect(ss)
+	ss.waitForWatch(s, 1)
+	ss.send(s, k8s.EventModified, configMap("default", "a", "10"))
+	ss.expect(1)
+	checkpointer.expectNone(ss)
+	clock.Advance(10 * time.Second)
+	ss.logf("ten seconds pass")
+	ss.send(s, k8s.EventModified, configMap("default", "a", "11"))
+	ss.expect(1)
+	checkpointer.expect(ss)
+	s.Bookmark("12")
+	ss.logf("%s BOOKMARK 12", s)
+	checkpointer.expect(ss)
+	ss.done()
+}
+
+// TestStaleCheckpointSession replays a watch whose checkpoint is newer
+// than anything the apiserver has, as after a restore from a backup:
+// it gives up on the checkpoint, and lists whatever there is.
+func TestStaleCheckpointSession(t *testing.T) {
+	ss := newSession(t)
+	checkpointer := newCheckpointer("99")
+	store := ss.store()
+	store.Checkpointer = checkpointer
+	store.AddWatch("default", &corev1.ConfigMapList{})
+	s := ss.stream("default")
+	ss.run(store)
+
+	ss.waitForList(s, 1)
+	s.FailList(&k8s.APIError{
+		Code:   504,
+		Status: &metav1.Status{Message: k8s.String("Too large resource version")},
+	})
+	ss.logf("%s fails with 504 Too large resource version", s)
+	ss.waitForList(s, 2)
+	ss.list(s, "3", configMap("default", "a", "2"))
+	ss.expect(1)
+	checkpointer.expect(ss)
+	ss.waitForWatch(s, 1)
+	ss.done()
+}
+
+// A checkpointer is a k8sutil.Checkpointer that loads the same
+// resourceVersion for every watch, and sends what it saves to the test.
+type checkpointer struct {
+	load  string
+	saves chan string
+}
+
+func newCheckpointer(load string) *checkpointer {
+	return &checkpointer{load: load, saves: make(chan string, 100)}
+}
+
+func (c *checkpointer) Load(ctx context.Context, id k8sutil.WatchID) (string, error) {
+	return c.load, nil
+}
+
+func (c *checkpointer) Save(ctx context.Context, id k8sutil.WatchID, resourceVersion string) error {
+	c.saves <- fmt.Sprintf("%v: %s", id, resourceVersion)
+	return nil
+}
+
+// expect logs the next checkpoint saved.
+func (c *checkpointer) expect(ss *session) {
+	ss.t.Helper()
+	select {
+	case save := <-c.saves:
+		ss.logf("  checkpoint %s", save)
+	case <-time.After(k8sutiltest.DefaultTimeout):
+		ss.t.Fatalf("timed out waiting for a checkpoint; so far:\n%s", ss.log.String())
+	}
+}
+
+// expectNone fails the test if a checkpoint is saved soon.
+func (c *checkpointer) expectNone(ss *session) {
+	ss.t.Helper()
+	select {
+	case save := <-c.saves:
+		ss.t.Fatalf("unexpected checkpoint %s", save)
+	case <-time.After(quiet):
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package clientgo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/ericchiang/k8s"
+	ericmetav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	ericruntime "github.com/ericchiang/k8s/runtime"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/rest"
+
+	"github.com/datawire/k8sutil"
+)
+
+const (
+	contentTypeProtobuf = "application/vnd.kubernetes.protobuf"
+	contentTypeJSON     = "application/json"
+
+	// The Accept headers that ask for PartialObjectMetadata.
+	acceptPartialObjectMetadata     = "application/json;as=PartialObjectMetadata;g=meta.k8s.io;v=v1"
+	acceptPartialObjectMetadataList = "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1"
+)
+
+// codecs decode the Status of failed requests, in protobuf or JSON.
+var codecs = func() serializer.CodecFactory {
+	scheme := runtime.NewScheme()
+	metav1.AddToGroupVersion(scheme, schema.GroupVersion{Version: "v1"})
+	return serializer.NewCodecFactory(scheme)
+}()
+
+// NewBackend returns a k8sutil.Backend that lists and watches with a
+// client-go REST client, talking to the apiserver described by the
+// client-go configuration.  Typed lists are requested as protobuf, and
+// decoded straight in to the k8s package's types, which share the
+// apiserver's protobuf encoding; an *UnstructuredList or
+// *PartialObjectMetadataList is requested as JSON.  client-go's errors are converted to *k8s.APIErrors, so that a
+// WatchingStore handles them as it does those of a *k8s.Client.
+//
+// Typed lists must be of types registered with the k8s package; an
+// *UnstructuredList or *PartialObjectMetadataList must have the
+// resource name of its Resource.
+func NewBackend(config *rest.Config) (k8sutil.UserAgentBackend, error) {
+	config = rest.CopyConfig(config)
+	// All requests have absolute paths.
+	config.APIPath = "/"
+	config.GroupVersion = &schema.GroupVersion{}
+	config.AcceptContentTypes = contentTypeProtobuf + "," + contentTypeJSON
+	config.ContentType = contentTypeJSON
+	config.NegotiatedSerializer = codecs.WithoutConversion()
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "REST client")
+	}
+	return backend{client: client}, nil
+}
+
+type backend struct {
+	client    *rest.RESTClient
+	userAgent string
+}
+
+func (b backend) WithUserAgent(userAgent string) k8sutil.Backend {
+	b.userAgent = userAgent
+	return b
+}
+
+func (b backend) List(ctx context.Context, namespace string, list k8s.ResourceList, options k8sutil.ListOptions) error {
+	var resource k8sutil.APIResource
+	var accept string
+	switch list := list.(type) {
+	case *k8sutil.UnstructuredList:
+		resource, accept = list.Resource, contentTypeJSON
+	case *k8sutil.PartialObjectMetadataList:
+		resource, accept = list.Resource, acceptPartialObjectMetadataList
+	}
+	if accept != "" {
+		data, err := b.get(resource.Path(namespace), listQuery(options), accept).DoRaw(ctx)
+		if err != nil {
+			return convertError(err)
+		}
+		if err := json.Unmarshal(data, list); err != nil {
+			return errors.Wrap(err, "decode response")
+		}
+		return nil
+	}
+	u, err := listURL(namespace, list)
+	if err != nil {
+		return err
+	}
+	data, err := b.get(u.Path, listQuery(options), contentTypeProtobuf).DoRaw(ctx)
+	if err != nil {
+		return convertError(err)
+	}
+	if err := unmarshalProtobuf(data, list); err != nil {
+		return errors.Wrap(err, "decode response")
+	}
+	return nil
+}
+
+func (b backend) Watch(ctx context.Context, namespace string, list k8s.ResourceList, options k8sutil.ListOptions) (k8sutil.Watcher, error) {
+	query := listQuery(options)
+	query.Set("watch", "true")
+	var resource k8sutil.APIResource
+	var accept string
+	switch list := list.(type) {
+	case *k8sutil.UnstructuredList:
+		resource, accept = list.Resource, contentTypeJSON
+	case *k8sutil.PartialObjectMetadataList:
+		resource, accept = list.Resource, acceptPartialObjectMetadata
+	}
+	if accept != "" {
+		body, err := b.get(resource.Path(namespace), query, accept).Stream(ctx)
+		if err != nil {
+			return nil, convertError(err)
+		}
+		return &jsonWatcher{body: body, decoder: json.NewDecoder(body)}, nil
+	}
+	u, err := listURL(namespace, list)
+	if err != nil {
+		return nil, err
+	}
+	body, err := b.get(u.Path, query, contentTypeProtobuf).Stream(ctx)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return &protobufWatcher{body: body, reader: bufio.NewReader(body)}, nil
+}
+
+// get returns a GET request of the path that accepts the content type.
+func (b backend) get(path string, query url.Values, accept string) *rest.Request {
+	req := b.client.Get().AbsPath(path).SetHeader("Accept", accept)
+	for key, values := range query {
+		for _, value := range values {
+			req = req.Param(key, value)
+		}
+	}
+	if b.userAgent != "" {
+		req = req.SetHeader("User-Agent", b.userAgent)
+	}
+	return req
+}
+
+// listQuery returns the query parameters for the options.
+func listQuery(options k8sutil.ListOptions) url.Values {
+	query := url.Values{}
+	if options.ResourceVersion != "" {
+		query.Set("resourceVersion", options.ResourceVersion)
+	}
+	if options.AllowBookmarks {
+		query.Set("allowWatchBookmarks", "true")
+	}
+	if options.SendInitialEvents {
+		query.Set("sendInitialEvents", "true")
+		query.Set("resourceVersionMatch", "NotOlderThan")
+	}
+	return query
+}
+
+// errCaptured stops a request whose URL listURL has captured.
+var errCaptured = errors.New("captured")
+
+// listURL returns the URL at which the k8s package would list the
+// typed list's resources in the namespace; the k8s package doesn't
+// otherwise say where it has registered a type.
+func listURL(namespace string, list k8s.ResourceList) (*url.URL, error) {
+	var ret *url.URL
+	client := &k8s.Client{
+		Endpoint: "http://localhost",
+		Client: &http.Client{Transport: k8sutil.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			ret = req.URL
+			return nil, errCaptured
+		})},
+	}
+	err := client.List(context.Background(), namespace, list)
+	if ret == nil {
+		return nil, errors.Wrapf(err, "type %T", list)
+	}
+	return ret, nil
+}
+
+// protobufMagic prefixes an object in the protobuf encoding of the
+// Kubernetes API.
+var protobufMagic = []byte("k8s\x00")
+
+// unmarshalProtobuf decodes an object in the protobuf encoding of the
+// Kubernetes API, which is the magic number followed by a
+// runtime.Unknown, in to one of the k8s package's types.
+func unmarshalProtobuf(data []byte, out interface{}) error {
+	if !bytes.HasPrefix(data, protobufMagic) {
+		return errors.New("not a protobuf object")
+	}
+	var unknown ericruntime.Unknown
+	if err := unknown.Unmarshal(data[len(protobufMagic):]); err != nil {
+		return err
+	}
+	msg, ok := out.(protoUnmarshaler)
+	if !ok {
+		return errors.Errorf("%T is not a protobuf message", out)
+	}
+	return msg.Unmarshal(unknown.Raw)
+}
+
+// convertError converts a client-go API error to a *k8s.APIError.
+func convertError(err error) error {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		return err
+	}
+	s := status.Status()
+	ret := &k8s.APIError{Status: new(ericmetav1.Status), Code: int(s.Code)}
+	if err := convert(&s, ret.Status); err != nil {
+		return err
+	}
+	return ret
+}
+
+// A protobufWatcher decodes a protobuf watch stream, which is a series
+// of WatchEvents, each preceded by its length as a big-endian uint32.
+type protobufWatcher struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+func (w *protobufWatcher) Next(resource k8s.Resource) (string, error) {
+	var length uint32
+	if err := binary.Read(w.reader, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(w.reader, frame); err != nil {
+		return "", err
+	}
+	var event ericmetav1.WatchEvent
+	if err := event.Unmarshal(frame); err != nil {
+		return "", errors.Wrap(err, "decode event")
+	}
+	if event.GetType() == k8s.EventError {
+		status := new(ericmetav1.Status)
+		if err := unmarshalProtobuf(event.GetObject().GetRaw(), status); err != nil {
+			return "", errors.Wrap(err, "decode error event")
+		}
+		return event.GetType(), &k8s.APIError{Status: status, Code: int(status.GetCode())}
+	}
+	if err := unmarshalProtobuf(event.GetObject().GetRaw(), resource); err != nil {
+		return "", errors.Wrap(err, "decode resource")
+	}
+	return event.GetType(), nil
+}
+
+func (w *protobufWatcher) Close() error {
+	return w.body.Close()
+}
+
+// A jsonWatcher decodes a JSON watch stream.
+type jsonWatcher struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (w *jsonWatcher) Next(resource k8s.Resource) (string, error) {
+	var event struct {
+		Type   string          `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := w.decoder.Decode(&event); err != nil {
+		return "", err
+	}
+	if event.Type == k8s.EventError {
+		status := new(ericmetav1.Status)
+		if err := json.Unmarshal(event.Object, status); err != nil {
+			return "", errors.Wrap(err, "decode error event")
+		}
+		return event.Type, &k8s.APIError{Status: status, Code: int(status.GetCode())}
+	}
+	if err := json.Unmarshal(event.Object, resource); err != nil {
+		return "", errors.Wrap(err, "decode resource")
+	}
+	return event.Type, nil
+}
+
+func (w *jsonWatcher) Close() error {
+	return w.body.Close()
+}
@@ -0,0 +1,257 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package clientgo_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	ericcorev1 "github.com/ericchiang/k8s/apis/core/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/rest"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/clientgo"
+)
+
+// marshaler is a client-go type, which can be encoded as protobuf.
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// encodeProtobuf encodes the object as the apiserver would.
+func encodeProtobuf(t *testing.T, apiVersion, kind string, obj marshaler) []byte {
+	t.Helper()
+	raw, err := obj.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := (&runtime.Unknown{
+		TypeMeta: runtime.TypeMeta{APIVersion: apiVersion, Kind: kind},
+		Raw:      raw,
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte("k8s\x00"), data...)
+}
+
+func writeProtobuf(w http.ResponseWriter, code int, data []byte) {
+	w.Header().Set("Content-Type", "application/vnd.kubernetes.protobuf")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+// newServer returns an apiserver that serves a Pod, a watch of
+// Services, Deployments as JSON, and the metadata of Secrets, in the
+// encodings that the real one would, and records the User-Agent of
+// each request.
+func newServer(t *testing.T, userAgents chan<- string) *rest.Config {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", ResourceVersion: "5"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "app",
+			Resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			}},
+		}}},
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "service", Namespace: "default", ResourceVersion: "6"},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "number", Port: 80, TargetPort: intstr.FromInt32(8080)},
+			{Name: "name", Port: 443, TargetPort: intstr.FromString("https")},
+		}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if userAgents != nil {
+			userAgents <- r.Header.Get("User-Agent")
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/default/pods":
+			list := &corev1.PodList{ListMeta: metav1.ListMeta{ResourceVersion: "7"}, Items: []corev1.Pod{*pod}}
+			writeProtobuf(w, http.StatusOK, encodeProtobuf(t, "v1", "PodList", list))
+		case "/api/v1/services":
+			if r.URL.Query().Get("watch") != "true" || r.URL.Query().Get("resourceVersion") != "6" {
+				t.Errorf("got query %s", r.URL.RawQuery)
+			}
+			frame, err := (&metav1.WatchEvent{
+				Type:   "ADDED",
+				Object: runtime.RawExtension{Raw: encodeProtobuf(t, "v1", "Service", service)},
+			}).Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			length := make([]byte, 4)
+			binary.BigEndian.PutUint32(length, uint32(len(frame)))
+			w.Header().Set("Content-Type", "application/vnd.kubernetes.protobuf;stream=watch")
+			_, _ = w.Write(append(length, frame...))
+		case "/apis/apps/v1/deployments":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"metadata": map[string]interface{}{"resourceVersion": "8"},
+				"items": []interface{}{map[string]interface{}{
+					"metadata": map[string]interface{}{"name": "deployment", "namespace": "default"},
+					"spec":     map[string]interface{}{"replicas": 3},
+				}},
+			})
+		case "/api/v1/secrets":
+			if accept := r.Header.Get("Accept"); accept != "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1" {
+				t.Errorf("got Accept %q", accept)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"apiVersion": "meta.k8s.io/v1",
+				"kind":       "PartialObjectMetadataList",
+				"metadata":   map[string]interface{}{"resourceVersion": "9"},
+				"items": []interface{}{map[string]interface{}{
+					"apiVersion": "meta.k8s.io/v1",
+					"kind":       "PartialObjectMetadata",
+					"metadata":   map[string]interface{}{"name": "secret", "labels": map[string]string{"app": "a"}},
+				}},
+			})
+		default:
+			status := &metav1.Status{
+				TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+				Status:   metav1.StatusFailure,
+				Reason:   metav1.StatusReasonNotFound,
+				Code:     http.StatusNotFound,
+			}
+			writeProtobuf(w, http.StatusNotFound, encodeProtobuf(t, "v1", "Status", status))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return &rest.Config{Host: server.URL}
+}
+
+func TestBackendList(t *testing.T) {
+	backend, err := clientgo.NewBackend(newServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list ericcorev1.PodList
+	if err := backend.List(context.Background(), "default", &list, k8sutil.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if rv := list.GetMetadata().GetResourceVersion(); rv != "7" || len(list.Items) != 1 {
+		t.Fatalf("got resourceVersion %q, %d items", rv, len(list.Items))
+	}
+	requests := list.Items[0].GetSpec().GetContainers()[0].GetResources().GetRequests()
+	if cpu := requests["cpu"].GetString_(); cpu != "100m" {
+		t.Errorf("got cpu %q, want 100m", cpu)
+	}
+	if memory := requests["memory"].GetString_(); memory != "64Mi" {
+		t.Errorf("got memory %q, want 64Mi", memory)
+	}
+}
+
+func TestBackendWatch(t *testing.T) {
+	backend, err := clientgo.NewBackend(newServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := backend.Watch(context.Background(), k8s.AllNamespaces, &ericcorev1.ServiceList{}, k8sutil.ListOptions{ResourceVersion: "6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	var service ericcorev1.Service
+	eventType, err := w.Next(&service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eventType != k8s.EventAdded || service.GetMetadata().GetName() != "service" {
+		t.Errorf("got %s of %q", eventType, service.GetMetadata().GetName())
+	}
+	ports := service.GetSpec().GetPorts()
+	if len(ports) != 2 {
+		t.Fatalf("got %d ports", len(ports))
+	}
+	if target := ports[0].GetTargetPort(); target.GetType() != 0 || target.GetIntVal() != 8080 {
+		t.Errorf("got targetPort %v, want 8080", target)
+	}
+	if target := ports[1].GetTargetPort(); target.GetType() != 1 || target.GetStrVal() != "https" {
+		t.Errorf("got targetPort %v, want https", target)
+	}
+}
+
+func TestBackendUnstructured(t *testing.T) {
+	backend, err := clientgo.NewBackend(newServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &k8sutil.UnstructuredList{Resource: k8sutil.APIResource{
+		Group: "apps", Version: "v1", Name: "deployments", Kind: "Deployment", Namespaced: true,
+	}}
+	if err := backend.List(context.Background(), k8s.AllNamespaces, list, k8sutil.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 {
+		t.Fatalf("got %d items", len(list.Items))
+	}
+	deployment := list.Items[0]
+	if deployment.APIVersion() != "apps/v1" || deployment.Kind() != "Deployment" || deployment.GetMetadata().GetName() != "deployment" {
+		t.Errorf("got %v", deployment.Object)
+	}
+}
+
+func TestBackendMetadata(t *testing.T) {
+	backend, err := clientgo.NewBackend(newServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := &k8sutil.PartialObjectMetadataList{Resource: k8sutil.APIResource{
+		Version: "v1", Name: "secrets", Kind: "Secret", Namespaced: true,
+	}}
+	if err := backend.List(context.Background(), k8s.AllNamespaces, list, k8sutil.ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 {
+		t.Fatalf("got %d items", len(list.Items))
+	}
+	secret := list.Items[0]
+	if secret.APIVersion != "v1" || secret.Kind != "Secret" || secret.GetMetadata().GetLabels()["app"] != "a" {
+		t.Errorf("got %+v", secret)
+	}
+}
+
+func TestBackendError(t *testing.T) {
+	backend, err := clientgo.NewBackend(newServer(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.List(context.Background(), "default", &ericcorev1.ConfigMapList{}, k8sutil.ListOptions{})
+	apiErr, ok := err.(*k8s.APIError)
+	if !ok {
+		t.Fatalf("got %T %v, want a *k8s.APIError", err, err)
+	}
+	if apiErr.Code != http.StatusNotFound || apiErr.Status.GetReason() != "NotFound" {
+		t.Errorf("got %d %q", apiErr.Code, apiErr.Status.GetReason())
+	}
+}
+
+func TestBackendUserAgent(t *testing.T) {
+	userAgents := make(chan string, 1)
+	backend, err := clientgo.NewBackend(newServer(t, userAgents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list ericcorev1.PodList
+	err = backend.WithUserAgent("test/1.0 (watch)").List(context.Background(), "default", &list, k8sutil.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ua := <-userAgents; ua != "test/1.0 (watch)" {
+		t.Errorf("got User-Agent %q", ua)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+// Package clientgo adapts k8s.io/client-go for use with k8sutil, as a
+// migration path away from github.com/ericchiang/k8s: a client-go
+// configuration can make a *k8s.Client, or a k8sutil.Backend that
+// lists and watches with client-go itself.
+//
+// It is a separate module so that users of k8sutil who don't use
+// client-go don't have to depend on it.
+package clientgo
+
+import (
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+)
+
+// NewClient returns a *k8s.Client that talks to the apiserver described
+// by the client-go configuration, using client-go's transport and
+// authentication (including exec and auth-provider credential
+// plugins, which the k8s package doesn't support).
+//
+// Requests made with the client are still encoded and decoded by the
+// k8s package.
+func NewClient(config *rest.Config) (*k8s.Client, error) {
+	server, _, err := rest.DefaultServerUrlFor(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "server URL")
+	}
+	httpClient, err := rest.HTTPClientFor(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "HTTP client")
+	}
+	return &k8s.Client{
+		Endpoint:  server.String(),
+		Namespace: "default",
+		Client:    httpClient,
+	}, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package clientgo
+
+import (
+	"encoding/json"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// The types in github.com/ericchiang/k8s/apis and in k8s.io/api are
+// both generated from the same Kubernetes protobuf definitions, so
+// an object can be converted between them by marshaling it with one
+// and unmarshaling it with the other.  Fields that only one side knows
+// about survive the trip, since the k8s package's types keep
+// unrecognized fields.  Types that aren't protobuf messages (such as
+// CRD types) are converted through JSON instead.
+
+type protoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type protoUnmarshaler interface {
+	Unmarshal([]byte) error
+}
+
+// convert copies in to out, which must be the same Kubernetes type.
+func convert(in, out interface{}) error {
+	if m, ok := in.(protoMarshaler); ok {
+		if u, ok := out.(protoUnmarshaler); ok {
+			data, err := m.Marshal()
+			if err != nil {
+				return errors.Wrapf(err, "marshal %T", in)
+			}
+			if err := u.Unmarshal(data); err != nil {
+				return errors.Wrapf(err, "unmarshal %T", out)
+			}
+			return nil
+		}
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %T", in)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return errors.Wrapf(err, "unmarshal %T", out)
+	}
+	return nil
+}
+
+// ToClientGo converts a resource from the k8s package (for instance,
+// one from a k8sutil.Store) to the equivalent client-go type, for
+// handing to libraries that expect client-go objects.  The out
+// argument must be a pointer to the same Kubernetes type as in; for
+// example:
+//
+//	var pod corev1.Pod // k8s.io/api/core/v1
+//	err := clientgo.ToClientGo(resource, &pod)
+//
+// Since the objects in a Store must not be mutated, out never shares
+// memory with in.
+func ToClientGo(in k8s.Resource, out runtime.Object) error {
+	return convert(in, out)
+}
+
+// FromClientGo converts a client-go object to the equivalent type from
+// the k8s package; it is the inverse of ToClientGo.
+func FromClientGo(in runtime.Object, out k8s.Resource) error {
+	return convert(in, out)
+}
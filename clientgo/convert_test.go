@@ -0,0 +1,95 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package clientgo_test
+
+import (
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	ericcorev1 "github.com/ericchiang/k8s/apis/core/v1"
+	ericmetav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	ericresource "github.com/ericchiang/k8s/apis/resource"
+	ericintstr "github.com/ericchiang/k8s/util/intstr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/clientgo"
+)
+
+func TestToClientGo(t *testing.T) {
+	stringType := int64(intstr.String)
+	in := &ericcorev1.Pod{
+		Metadata: &ericmetav1.ObjectMeta{Name: k8s.String("pod"), Labels: map[string]string{"app": "a"}},
+		Spec: &ericcorev1.PodSpec{Containers: []*ericcorev1.Container{{
+			Name: k8s.String("app"),
+			Resources: &ericcorev1.ResourceRequirements{Requests: map[string]*ericresource.Quantity{
+				"cpu": {String_: k8s.String("100m")},
+			}},
+			Ports: []*ericcorev1.ContainerPort{{ContainerPort: k8s.Int32(8080)}},
+			ReadinessProbe: &ericcorev1.Probe{Handler: &ericcorev1.Handler{HttpGet: &ericcorev1.HTTPGetAction{
+				Port: &ericintstr.IntOrString{Type: &stringType, StrVal: k8s.String("http")},
+			}}},
+		}}},
+	}
+	var out corev1.Pod
+	if err := clientgo.ToClientGo(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "pod" || out.Labels["app"] != "a" {
+		t.Errorf("got metadata %+v", out.ObjectMeta)
+	}
+	container := out.Spec.Containers[0]
+	if cpu := container.Resources.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse("100m")) != 0 {
+		t.Errorf("got cpu %s, want 100m", cpu.String())
+	}
+	if port := container.Ports[0].ContainerPort; port != 8080 {
+		t.Errorf("got port %d", port)
+	}
+	if port := container.ReadinessProbe.HTTPGet.Port; port != intstr.FromString("http") {
+		t.Errorf("got probe port %v", port)
+	}
+
+	// The output doesn't share memory with the input.
+	out.Labels["app"] = "b"
+	if in.Metadata.Labels["app"] != "a" {
+		t.Errorf("modifying the output modified the input")
+	}
+}
+
+func TestFromClientGo(t *testing.T) {
+	in := &corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+		{Port: 80, TargetPort: intstr.FromInt32(8080)},
+	}}}
+	in.Name = "service"
+	var out ericcorev1.Service
+	if err := clientgo.FromClientGo(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.GetMetadata().GetName() != "service" {
+		t.Errorf("got name %q", out.GetMetadata().GetName())
+	}
+	port := out.GetSpec().GetPorts()[0]
+	if port.GetPort() != 80 || port.GetTargetPort().GetType() != 0 || port.GetTargetPort().GetIntVal() != 8080 {
+		t.Errorf("got port %v", port)
+	}
+}
+
+// TestConvertJSON checks that types that aren't protobuf messages go
+// through JSON.
+func TestConvertJSON(t *testing.T) {
+	in := k8sutil.NewUnstructured("example.com/v1", "Widget")
+	in.Object["spec"] = map[string]interface{}{"size": "large"}
+	var out unstructured.Unstructured
+	if err := clientgo.ToClientGo(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.GetAPIVersion() != "example.com/v1" || out.GetKind() != "Widget" {
+		t.Errorf("got %v", out.Object)
+	}
+	if size, _, _ := unstructured.NestedString(out.Object, "spec", "size"); size != "large" {
+		t.Errorf("got size %q", size)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestClientOptions checks that watches of the same type with different
+// label selectors each list and watch what their selector selects.
+func TestClientOptions(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(labeledConfigMap("default", "a", map[string]string{"app": "web"}))
+	server.set(labeledConfigMap("default", "b", map[string]string{"app": "db"}))
+	server.set(newConfigMap("default", "c"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{}, k8sutil.ClientOptions(k8s.QueryParam("labelSelector", "app=web")))
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{}, k8sutil.ClientOptions(k8s.QueryParam("labelSelector", "app=db")))
+	runStore(t, w)
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("got ConfigMaps %v", got)
+	}
+	var lines []string
+	for watches := 0; watches < 2; {
+		r := server.nextRequest()
+		if r.verb == "watch" {
+			watches++
+		}
+		lines = append(lines, r.line)
+	}
+	for _, selector := range []string{"labelSelector=app%3Dweb", "labelSelector=app%3Ddb"} {
+		var lists, watches int
+		for _, line := range lines {
+			if strings.HasPrefix(line, "GET /api/v1/configmaps?") && strings.Contains(line, selector) {
+				if strings.Contains(line, "watch=true") {
+					watches++
+				} else {
+					lists++
+				}
+			}
+		}
+		if lists != 1 || watches != 1 {
+			t.Errorf("%d lists and %d watches with %s in\n%s", lists, watches, selector, strings.Join(lines, "\n"))
+		}
+	}
+
+	server.set(labeledConfigMap("other", "d", map[string]string{"app": "web"}))
+	server.set(newConfigMap("other", "e"))
+	server.set(labeledConfigMap("other", "f", map[string]string{"app": "db"}))
+	for {
+		got := names((<-stores).List(&corev1.ConfigMap{}))
+		if reflect.DeepEqual(got, []string{"a", "b", "d", "f"}) {
+			break
+		}
+		if len(got) > 4 {
+			t.Fatalf("got ConfigMaps %v", got)
+		}
+	}
+}
+
+// TestClientOptionsLateListing checks that a watch that lists after
+// the others, having missed the SyncTimeout, removes only what it
+// stored, and not the resources of another watch of the type that its
+// selector doesn't select.
+func TestClientOptionsLateListing(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:     backend,
+		Logger:      testLogger{t},
+		Callback:    func(s k8sutil.Store) { stores <- s },
+		SyncTimeout: 50 * time.Millisecond,
+		SyncPartial: true,
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{}, k8sutil.ClientOptions(k8s.QueryParam("labelSelector", "app=web")))
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	configMap := func(namespace, name string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{Metadata: k8sutiltest.ObjectMeta(namespace, name, "1")}
+	}
+	backend.Stream("default", &corev1.ConfigMapList{}).List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.ConfigMap{configMap("default", "a")}})
+	runStore(t, w)
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("got ConfigMaps %v", got)
+	}
+
+	backend.SelectorStream(k8s.AllNamespaces, "app=web", &corev1.ConfigMapList{}).List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.ConfigMap{configMap("other", "b")}})
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got ConfigMaps %v after the late listing, want the other watch's kept", got)
+	}
+}
+
+func TestOptionQuery(t *testing.T) {
+	query := k8sutil.OptionQuery(k8s.QueryParam("labelSelector", "app=web"), k8s.QueryParam("fieldSelector", "metadata.name=a"))
+	if got, want := query.Encode(), "fieldSelector=metadata.name%3Da&labelSelector=app%3Dweb"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if query := k8sutil.OptionQuery(); len(query) != 0 {
+		t.Errorf("got %v without options", query)
+	}
+}
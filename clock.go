@@ -0,0 +1,74 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"time"
+)
+
+// A Clock is the source of time for a WatchingStore (or a Discovery):
+// what it retries, coalesces, evicts, and times out by.  The default
+// is the system clock; tests may substitute a fake one that they
+// advance by hand (see k8sutiltest.FakeClock), instead of sleeping.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer returns a Timer that fires once, after d.
+	NewTimer(d time.Duration) Timer
+
+	// NewTicker returns a Timer that fires every d, dropping ticks
+	// that aren't received in time, like a time.Ticker.
+	NewTicker(d time.Duration) Timer
+}
+
+// A Timer is a time.Timer or a time.Ticker from a Clock.
+type Timer interface {
+	// C returns the channel that the time is sent on when the
+	// Timer fires.
+	C() <-chan time.Time
+
+	// Stop stops the Timer from firing.  It does not drain the
+	// channel.
+	Stop()
+}
+
+// SystemClock is the Clock that is used when none is given.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+func (systemClock) NewTicker(d time.Duration) Timer { return systemTicker{time.NewTicker(d)} }
+
+type systemTimer struct{ *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+func (t systemTimer) Stop() { t.Timer.Stop() }
+
+type systemTicker struct{ *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// orSystemClock returns the clock, or SystemClock if it is nil.
+func orSystemClock(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
+
+// sleep waits for the duration d on the clock, or until the Context is
+// canceled, whichever comes first.
+func sleep(ctx context.Context, clock Clock, d time.Duration) {
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C():
+	}
+}
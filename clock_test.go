@@ -0,0 +1,165 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// epoch is where the FakeClocks of these tests start: far enough from
+// the real time that anything measured by the system clock is wrong.
+var epoch = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// waitForTimers fails the test unless n timers are soon waiting on the
+// clock.
+func waitForTimers(t *testing.T, clock *k8sutiltest.FakeClock, n int) {
+	t.Helper()
+	if !clock.WaitForTimers(n, timeout) {
+		t.Fatalf("got %d timers, want %d", clock.Timers(), n)
+	}
+}
+
+// TestClockRetryAfter checks that a Retry-After date is relative to the
+// Clock, and that the retry waits on it.
+func TestClockRetryAfter(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	server.setFailure("list", failure{
+		code:   http.StatusTooManyRequests,
+		header: http.Header{"Retry-After": {epoch.Add(30 * time.Second).Format(http.TimeFormat)}},
+	})
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) {},
+		Clock:    clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+
+	server.await("list")
+	server.setFailure("list", failure{})
+	waitForTimers(t, clock, 1)
+	clock.Advance(29 * time.Second)
+	if clock.Timers() != 1 {
+		t.Fatalf("retried before the Retry-After date")
+	}
+	clock.Advance(time.Second)
+	server.await("list")
+	if n := w.Throttled(); n != 1 {
+		t.Errorf("Throttled: got %d, want 1", n)
+	}
+}
+
+// TestClockTTL checks that the TTL is measured by the Clock.
+func TestClockTTL(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	server.set(newConfigMap("default", "b"))
+	events := make(chan []string, 10)
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: testLogger{t},
+		Callback: func(s k8sutil.Store) {
+			events <- append([]string{"callback"}, names(s.List(&corev1.ConfigMap{}))...)
+		},
+		OnEvict: func(evicted []k8s.Resource) {
+			events <- append([]string{"evict"}, names(evicted)...)
+		},
+		Clock: clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.TTL(time.Minute))
+	runStore(t, w)
+
+	expect := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+	expect("callback", "a", "b")
+	clock.Advance(30 * time.Second)
+	server.set(newConfigMap("default", "b", "k", "v"))
+	expect("callback", "a", "b")
+	clock.Advance(31 * time.Second)
+	expect("evict", "a")
+	expect("callback", "b")
+}
+
+// TestClockCoalesce checks that the CoalesceWindow is measured by the
+// Clock.
+func TestClockCoalesce(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:         server.client(),
+		Logger:         testLogger{t},
+		Callback:       func(s k8sutil.Store) { stores <- s },
+		CoalesceWindow: time.Minute,
+		Clock:          clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	<-stores
+
+	server.set(newConfigMap("default", "a"))
+	waitForTimers(t, clock, 1)
+	clock.Advance(59 * time.Second)
+	select {
+	case <-stores:
+		t.Fatalf("notified before the CoalesceWindow")
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case s := <-stores:
+		if n := s.Count(&corev1.ConfigMap{}); n != 1 {
+			t.Errorf("got %d ConfigMaps", n)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("not notified after the CoalesceWindow")
+	}
+}
+
+// TestDiscoveryClock checks that the Discovery TTL is measured by the
+// Clock.
+func TestDiscoveryClock(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	d := &k8sutil.Discovery{Client: server.client(), TTL: time.Minute, Clock: clock}
+	if _, err := d.Resources(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server.drain()
+	clock.Advance(59 * time.Second)
+	if _, err := d.Resources(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := server.drain(); len(lines) != 0 {
+		t.Errorf("within the TTL: made requests %q", lines)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := d.Resources(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := server.drain(); len(lines) == 0 {
+		t.Errorf("made no requests after the TTL")
+	}
+}
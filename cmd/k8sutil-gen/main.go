@@ -0,0 +1,253 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+// Command k8sutil-gen generates, for a list of resource types, the
+// code that lets k8sutil watch them without reflection: a
+// k8sutil.ListType for each type, registered from an init function,
+// and typed functions to watch the type and read it from a
+// k8sutil.Store.
+//
+// Usage:
+//
+//	k8sutil-gen -package NAME [-o FILE] [NAME=]IMPORTPATH.TYPE...
+//
+// For example,
+//
+//	//go:generate k8sutil-gen -package main -o zz_k8sutil.go github.com/ericchiang/k8s/apis/core/v1.Pod github.com/ericchiang/k8s/apis/apps/v1.Deployment
+//
+// generates, for the Pod type,
+//
+//	func WatchPods(w *k8sutil.WatchingStore, namespace string, options ...k8sutil.WatchOption)
+//	func ListPods(store k8sutil.Store) []*corev1.Pod
+//	func ListPodsSorted(store k8sutil.Store) []*corev1.Pod
+//
+// The list type must be named TYPE + "List", as the types in
+// github.com/ericchiang/k8s/apis are.  The plural in the function
+// names is TYPE + "s" unless NAME is given; give one to tell apart
+// types of the same name, e.g. "DeploymentsV1beta2=...".  Since the
+// generated code refers to the types directly, a type that doesn't
+// exist, or whose list's items aren't pointers to it, is a compile
+// error rather than a panic when the watch is added.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// A resourceType is one of the types to generate code for.
+type resourceType struct {
+	Alias  string // of the import
+	Path   string // import path
+	Type   string // e.g. "Pod"
+	Plural string // e.g. "Pods"
+}
+
+// Ident returns the name of the generated ListType.
+func (t resourceType) Ident() string {
+	return lowerFirst(t.Plural) + "ListType"
+}
+
+// parseType parses an argument of the form [NAME=]IMPORTPATH.TYPE.
+func parseType(arg string) (resourceType, error) {
+	var ret resourceType
+	if i := strings.Index(arg, "="); i >= 0 {
+		ret.Plural, arg = arg[:i], arg[i+1:]
+	}
+	i := strings.LastIndex(arg, ".")
+	if i <= 0 || i < strings.LastIndex(arg, "/") {
+		return resourceType{}, fmt.Errorf("invalid type %q: must be IMPORTPATH.TYPE", arg)
+	}
+	ret.Path, ret.Type = arg[:i], arg[i+1:]
+	if !isExported(ret.Type) {
+		return resourceType{}, fmt.Errorf("invalid type %q: %q isn't an exported identifier", arg, ret.Type)
+	}
+	if ret.Plural == "" {
+		ret.Plural = ret.Type + "s"
+	}
+	if !isExported(ret.Plural) {
+		return resourceType{}, fmt.Errorf("invalid name %q: must be an exported identifier", ret.Plural)
+	}
+	return ret, nil
+}
+
+// assignAliases gives each import path an alias, e.g. "corev1" for
+// ".../apis/core/v1", and returns the imports, sorted.
+func assignAliases(types []resourceType) [][2]string {
+	aliases := make(map[string]string) // by import path
+	taken := map[string]bool{"k8s": true, "k8sutil": true}
+	for i, t := range types {
+		alias, ok := aliases[t.Path]
+		if !ok {
+			dir, version := path.Split(t.Path)
+			base := sanitize(path.Base(dir) + version)
+			alias = base
+			for n := 2; taken[alias]; n++ {
+				alias = fmt.Sprintf("%s_%d", base, n)
+			}
+			taken[alias] = true
+			aliases[t.Path] = alias
+		}
+		types[i].Alias = alias
+	}
+	var imports [][2]string
+	for importPath, alias := range aliases {
+		imports = append(imports, [2]string{alias, importPath})
+	}
+	sort.Slice(imports, func(i, j int) bool { return imports[i][1] < imports[j][1] })
+	return imports
+}
+
+// sanitize makes s in to a valid Go identifier.
+func sanitize(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	if b.Len() == 0 || unicode.IsDigit(rune(b.String()[0])) {
+		return "pkg" + b.String()
+	}
+	return b.String()
+}
+
+func isExported(s string) bool {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return s != "" && unicode.IsUpper([]rune(s)[0])
+}
+
+func lowerFirst(s string) string {
+	r := []rune(s)
+	r[0] = unicode.ToLower(r[0])
+	return string(r)
+}
+
+var tmpl = template.Must(template.New("").Parse(`// Code generated by k8sutil-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"github.com/datawire/k8sutil"
+	"github.com/ericchiang/k8s"
+{{range .Imports}}
+	{{index . 0}} "{{index . 1}}"
+{{- end}}
+)
+
+func init() {
+{{- range .Types}}
+	k8sutil.RegisterListType({{.Ident}}{})
+{{- end}}
+}
+{{range .Types}}
+// {{.Ident}} is the k8sutil.ListType of {{.Alias}}.{{.Type}}List.
+type {{.Ident}} struct{}
+
+func ({{.Ident}}) NewList() k8s.ResourceList { return &{{.Alias}}.{{.Type}}List{} }
+
+func ({{.Ident}}) NewItem() k8s.Resource { return &{{.Alias}}.{{.Type}}{} }
+
+func ({{.Ident}}) Items(list k8s.ResourceList) []k8s.Resource {
+	items := list.(*{{.Alias}}.{{.Type}}List).Items
+	ret := make([]k8s.Resource, len(items))
+	for i, item := range items {
+		ret[i] = item
+	}
+	return ret
+}
+
+// Watch{{.Plural}} adds a watch of the {{.Type}}s in the namespace (or
+// all namespaces, if namespace is k8s.AllNamespaces) to w.
+func Watch{{.Plural}}(w *k8sutil.WatchingStore, namespace string, options ...k8sutil.WatchOption) {
+	w.AddWatch(namespace, &{{.Alias}}.{{.Type}}List{}, options...)
+}
+
+// List{{.Plural}} returns the {{.Type}}s in the store.
+func List{{.Plural}}(store k8sutil.Store) []*{{.Alias}}.{{.Type}} {
+	return as{{.Plural}}(store.List(&{{.Alias}}.{{.Type}}{}))
+}
+
+// List{{.Plural}}Sorted returns the {{.Type}}s in the store, sorted by
+// namespace and then name.
+func List{{.Plural}}Sorted(store k8sutil.Store) []*{{.Alias}}.{{.Type}} {
+	return as{{.Plural}}(store.ListSorted(&{{.Alias}}.{{.Type}}{}))
+}
+
+func as{{.Plural}}(resources []k8s.Resource) []*{{.Alias}}.{{.Type}} {
+	ret := make([]*{{.Alias}}.{{.Type}}, len(resources))
+	for i, resource := range resources {
+		ret[i] = resource.(*{{.Alias}}.{{.Type}})
+	}
+	return ret
+}
+{{end}}`))
+
+func generate(pkg string, args []string) ([]byte, error) {
+	var types []resourceType
+	plurals := make(map[string]string)
+	for _, arg := range args {
+		t, err := parseType(arg)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := plurals[t.Plural]; ok {
+			return nil, fmt.Errorf("%q and %q would both be named %q; give one a NAME", other, arg, t.Plural)
+		}
+		plurals[t.Plural] = arg
+		types = append(types, t)
+	}
+	imports := assignAliases(types)
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, map[string]interface{}{
+		"Package": pkg,
+		"Imports": imports,
+		"Types":   types,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+func main() {
+	pkg := flag.String("package", "", "the `name` of the package to generate code in")
+	output := flag.String("o", "", "write the code to `file` instead of stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -package NAME [-o FILE] [NAME=]IMPORTPATH.TYPE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *pkg == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	code, err := generate(*pkg, flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "k8sutil-gen: %v\n", err)
+		os.Exit(1)
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(code)
+	} else {
+		err = ioutil.WriteFile(*output, code, 0666)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "k8sutil-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	code, err := generate("example", []string{
+		"github.com/ericchiang/k8s/apis/core/v1.Pod",
+		"github.com/ericchiang/k8s/apis/apps/v1.Deployment",
+		"DeploymentsV1beta2=github.com/ericchiang/k8s/apis/apps/v1beta2.Deployment",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"package example\n",
+		`corev1 "github.com/ericchiang/k8s/apis/core/v1"`,
+		`appsv1 "github.com/ericchiang/k8s/apis/apps/v1"`,
+		`appsv1beta2 "github.com/ericchiang/k8s/apis/apps/v1beta2"`,
+		"k8sutil.RegisterListType(podsListType{})",
+		"func WatchPods(w *k8sutil.WatchingStore, namespace string, options ...k8sutil.WatchOption)",
+		"func ListPods(store k8sutil.Store) []*corev1.Pod",
+		"func ListDeploymentsSorted(store k8sutil.Store) []*appsv1.Deployment",
+		"func ListDeploymentsV1beta2(store k8sutil.Store) []*appsv1beta2.Deployment",
+		"items := list.(*appsv1beta2.DeploymentList).Items",
+	} {
+		if !strings.Contains(string(code), want) {
+			t.Errorf("generated code lacks %q:\n%s", want, code)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for args, want := range map[string]string{
+		"github.com/ericchiang/k8s/apis/core/v1":                "must be IMPORTPATH.TYPE",
+		"github.com/ericchiang/k8s/apis/core/v1.pod":            "isn't an exported identifier",
+		"pods=github.com/ericchiang/k8s/apis/core/v1.Pod":       "must be an exported identifier",
+		"a.Pod github.com/ericchiang/k8s/apis/core/v1.Pod":      "would both be named",
+		"Pods=a.Pod github.com/ericchiang/k8s/apis/core/v1.Pod": "would both be named",
+	} {
+		_, err := generate("example", strings.Fields(args))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", args, err, want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+// Command k8sutil-top watches every type of resource in a cluster with a
+// k8sutil.WatchingStore, and shows the live contents of the store in
+// the terminal: the number of stored resources of each type, the most
+// recent changes, the health of each watch, and recent errors.  It
+// redraws on each notification of changes, and at least every second.
+// It is a quick operational view of a cluster, and an end-to-end
+// exercise of the package.
+//
+// Usage:
+//
+//	k8sutil-top [-kubeconfig FILE] [-namespace NAME] [-include PATTERN,...] [-exclude PATTERN,...] [-changes N]
+//
+// It uses the in-cluster configuration when run in a pod, and the
+// current context of the kubeconfig otherwise.  The patterns are those
+// of k8sutil.EverythingFilter, e.g. "deployments.apps" or
+// "*.networking.k8s.io".  Press Ctrl-C to exit.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/datawire/k8sutil"
+	"github.com/ericchiang/k8s"
+	"sigs.k8s.io/yaml"
+)
+
+// A change is one of the most recent changes to the store.
+type change struct {
+	time     time.Time
+	verb     string // "ADDED", "MODIFIED", or "DELETED"
+	typeName string
+	key      k8sutil.ObjectKey
+}
+
+// A logger keeps the most recent errors, to show them instead of
+// writing them over the display.
+type logger struct {
+	mu     sync.Mutex
+	max    int
+	errors []string
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, time.Now().Format("15:04:05")+" "+fmt.Sprintf(format, args...))
+	if len(l.errors) > l.max {
+		l.errors = l.errors[len(l.errors)-l.max:]
+	}
+}
+
+func (l *logger) recent() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.errors...)
+}
+
+// A top is the state of the display.
+type top struct {
+	store   *k8sutil.WatchingStore
+	logger  *logger
+	max     int // changes to keep
+	changes []change
+	prev    k8sutil.Store
+}
+
+// record records the changes in a Delta.
+func (t *top) record(d k8sutil.Delta) {
+	prev := t.prev
+	t.prev = d.Store
+	if prev == nil {
+		return // the initial listing isn't interesting
+	}
+	now := time.Now()
+	for _, sample := range d.Changed {
+		diff := k8sutil.DiffStores(prev, d.Store, sample)
+		typeName := typeNameOf(sample)
+		add := func(verb string, resource k8s.Resource) {
+			md := resource.GetMetadata()
+			t.changes = append(t.changes, change{
+				time:     now,
+				verb:     verb,
+				typeName: typeName,
+				key:      k8sutil.ObjectKey{Namespace: md.GetNamespace(), Name: md.GetName()},
+			})
+		}
+		for _, resource := range diff.Added {
+			add("ADDED", resource)
+		}
+		for _, c := range diff.Changed {
+			add("MODIFIED", c.New)
+		}
+		for _, resource := range diff.Removed {
+			add("DELETED", resource)
+		}
+	}
+	if len(t.changes) > t.max {
+		t.changes = t.changes[len(t.changes)-t.max:]
+	}
+}
+
+// render returns the display.
+func (t *top) render() string {
+	var b strings.Builder
+	stats := t.store.Stats()
+	sequence := uint64(0)
+	if store, err := t.store.Snapshot(); err == nil {
+		sequence = store.Sequence()
+	}
+	fmt.Fprintf(&b, "k8sutil-top  %s  store #%d  %d objects  %s\n\n",
+		time.Now().Format("15:04:05"), sequence, stats.Objects, formatBytes(stats.Bytes))
+
+	types := stats.Types
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Objects != types[j].Objects {
+			return types[i].Objects > types[j].Objects
+		}
+		return types[i].Type < types[j].Type
+	})
+	fmt.Fprintf(&b, "%-50s %8s %10s\n", "TYPE", "OBJECTS", "BYTES")
+	for _, stat := range types {
+		fmt.Fprintf(&b, "%-50s %8d %10s\n", stat.Type, stat.Objects, formatBytes(stat.Bytes))
+	}
+
+	fmt.Fprintf(&b, "\nRECENT CHANGES\n")
+	if len(t.changes) == 0 {
+		fmt.Fprintf(&b, "  (none yet)\n")
+	}
+	for i := len(t.changes) - 1; i >= 0; i-- {
+		c := t.changes[i]
+		fmt.Fprintf(&b, "  %s %-8s %s %s\n", c.time.Format("15:04:05"), c.verb, c.typeName, c.key)
+	}
+
+	fmt.Fprintf(&b, "\nWATCHES\n")
+	statuses := t.store.Status()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID.String() < statuses[j].ID.String() })
+	var unhealthy int
+	for _, status := range statuses {
+		if status.Synced && status.LastError == nil {
+			continue
+		}
+		unhealthy++
+		state := "synced"
+		if !status.Synced {
+			state = "listing since " + status.RelistingSince.Format("15:04:05")
+		}
+		fmt.Fprintf(&b, "  %s: %s", status.ID, state)
+		if status.LastError != nil {
+			fmt.Fprintf(&b, "; last error at %s: %v", status.LastErrorTime.Format("15:04:05"), status.LastError)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "  %d of %d watches synced without errors\n", len(statuses)-unhealthy, len(statuses))
+
+	if errors := t.logger.recent(); len(errors) > 0 {
+		fmt.Fprintf(&b, "\nERRORS\n")
+		for _, err := range errors {
+			fmt.Fprintf(&b, "  %s\n", err)
+		}
+	}
+	return b.String()
+}
+
+// typeNameOf describes the type of a sample, as TypeStats does.
+func typeNameOf(sample k8s.Resource) string {
+	gvk, err := k8sutil.GVKOf(sample)
+	if err != nil {
+		return fmt.Sprintf("%T", sample)
+	}
+	return gvk.String()
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// newClient returns a client for the cluster that the pod is running
+// in, or for the current context of the kubeconfig.
+func newClient(kubeconfig string) (*k8s.Client, error) {
+	if kubeconfig == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return k8s.NewInClusterClient()
+	}
+	if kubeconfig == "" {
+		kubeconfig = strings.Split(os.Getenv("KUBECONFIG"), string(filepath.ListSeparator))[0]
+	}
+	if kubeconfig == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		kubeconfig = filepath.Join(home, ".kube", "config")
+	}
+	data, err := ioutil.ReadFile(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	var config k8s.Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", kubeconfig, err)
+	}
+	return k8s.NewClient(&config)
+}
+
+func splitList(str string) []string {
+	var ret []string
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func main() {
+	kubeconfig := flag.String("kubeconfig", "", "the kubeconfig `file` to use, instead of $KUBECONFIG or ~/.kube/config")
+	namespace := flag.String("namespace", k8s.AllNamespaces, "watch only the `namespace`, instead of all of them")
+	include := flag.String("include", "", "watch only the types matching these comma-separated `patterns`")
+	exclude := flag.String("exclude", "events,events.events.k8s.io", "don't watch the types matching these comma-separated `patterns`")
+	changes := flag.Int("changes", 15, "show the `n` most recent changes")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	client, err := newClient(*kubeconfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "k8sutil-top: %v\n", err)
+		os.Exit(1)
+	}
+	l := &logger{max: 5}
+	store := &k8sutil.WatchingStore{
+		Client: client,
+		Logger: l,
+		// Redraw at most every 100ms, however busy the
+		// cluster is.
+		CoalesceWindow: 100 * time.Millisecond,
+		UserAgent:      "k8sutil-top",
+	}
+	store.AddWatchEverything(*namespace, k8sutil.EverythingFilter{
+		Include: splitList(*include),
+		Exclude: splitList(*exclude),
+	})
+	t := &top{store: store, logger: l, max: *changes}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	events := store.Events(1, k8sutil.EventsCoalesce)
+	errCh := make(chan error, 1)
+	go func() { errCh <- store.Run(ctx) }()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	fmt.Print("\x1b[2J")
+	for {
+		select {
+		case d, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			t.record(d)
+		case <-ticker.C:
+		case err := <-errCh:
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "k8sutil-top: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		// Move to the top left, draw, and clear the rest of the
+		// screen.
+		fmt.Print("\x1b[H" + strings.Replace(t.render(), "\n", "\x1b[K\n", -1) + "\x1b[J")
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// next returns the next Delta.
+func next(t *testing.T, events <-chan k8sutil.Delta) k8sutil.Delta {
+	t.Helper()
+	select {
+	case d := <-events:
+		return d
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for a delta")
+		return k8sutil.Delta{}
+	}
+}
+
+// TestTop checks that the display shows the stored types, the changes
+// after the initial listing, and the health of the watches.
+func TestTop(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	l := &logger{max: 5}
+	store := &k8sutil.WatchingStore{Backend: backend, Logger: l}
+	store.AddWatch("default", &corev1.ConfigMapList{})
+	stream := backend.Stream("default", &corev1.ConfigMapList{})
+	stream.List(&corev1.ConfigMapList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items:    []*corev1.ConfigMap{{Metadata: k8sutiltest.ObjectMeta("default", "a", "1")}},
+	})
+	events := store.Events(10, k8sutil.EventsBlock)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- store.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	top := &top{store: store, logger: l, max: 1}
+	top.record(next(t, events))
+	if len(top.changes) != 0 {
+		t.Errorf("recorded the initial listing: %+v", top.changes)
+	}
+	stream.WaitForWatch(1)
+	stream.Send("ADDED", &corev1.ConfigMap{Metadata: k8sutiltest.ObjectMeta("default", "b", "2")})
+	top.record(next(t, events))
+	stream.Send("DELETED", &corev1.ConfigMap{Metadata: k8sutiltest.ObjectMeta("default", "a", "3")})
+	top.record(next(t, events))
+	if len(top.changes) != 1 || top.changes[0].verb != "DELETED" || top.changes[0].key.Name != "a" {
+		t.Errorf("got changes %+v", top.changes)
+	}
+
+	l.Errorf("watch %s: %s", "configmaps", "boom")
+	display := top.render()
+	for _, want := range []string{"1 objects", "v1 ConfigMap", "DELETED  v1 ConfigMap default/a", "1 of 1 watches synced", "boom"} {
+		if !strings.Contains(display, want) {
+			t.Errorf("display doesn't have %q:\n%s", want, display)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int]string{10: "10B", 2048: "2.0KiB", 3 << 20: "3.0MiB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// newCorrelationPrefix returns a random prefix for the correlation IDs
+// of a store's snapshots, so that those of different stores (and
+// processes) don't collide.
+func newCorrelationPrefix() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// correlated is a Store that has a correlation ID: a snapshot, or a view
+// of one.
+type correlated interface {
+	correlationID() string
+}
+
+func (s *snapshot) correlationID() string {
+	return s.id
+}
+
+func (f *filteredStore) correlationID() string {
+	return CorrelationID(f.store)
+}
+
+// CorrelationID returns the correlation ID of the notification that
+// the store was passed to a callback with (or sent in a Delta with), e.g.
+// "3f9a01c2-17", or "" if the store isn't from a WatchingStore.  Each
+// notification has its own ID, which the WatchingStore includes in what
+// it logs of it, and sets as the pprof label "k8sutil.correlation_id"
+// while the callbacks run; pass it on (see WithCorrelationID) to trace a
+// change from the apiserver through the rest of the processing.  The
+// IDs aren't metric labels, as every notification would be a new time
+// series.
+func CorrelationID(store Store) string {
+	if c, ok := store.(correlated); ok {
+		return c.correlationID()
+	}
+	return ""
+}
+
+// CorrelationID returns the correlation ID of the store.
+func (r *RestrictedStore) CorrelationID() string {
+	return CorrelationID(r.store)
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of the context that carries the
+// correlation ID of the store, for the work that a callback hands off.
+func WithCorrelationID(ctx context.Context, store Store) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, CorrelationID(store))
+}
+
+// CorrelationIDFrom returns the correlation ID that the context carries,
+// or "" if it doesn't carry one.
+func CorrelationIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestCorrelationID checks that each notification has its own
+// correlation ID, which the Delta, views of the store, and the slow
+// callback log carry.
+func TestCorrelationID(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	logs := make(chan string, 100)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: chanLogger{t, logs},
+		Callback: func(s k8sutil.Store) {
+			clock.Advance(2 * time.Second)
+			stores <- s
+		},
+		SlowCallback: time.Second,
+		Clock:        clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	events := w.Events(10, k8sutil.EventsBlock)
+	runStore(t, w)
+
+	pattern := regexp.MustCompile(`^[0-9a-z]+-[0-9]+$`)
+	var ids []string
+	for n := 1; n <= 2; n++ {
+		if n == 2 {
+			server.set(newConfigMap("default", "b"))
+		}
+		s := <-stores
+		id := k8sutil.CorrelationID(s)
+		if !pattern.MatchString(id) || !strings.HasSuffix(id, "-"+strconv.FormatUint(s.Sequence(), 10)) {
+			t.Errorf("got correlation ID %q of sequence %d", id, s.Sequence())
+		}
+		if d := <-events; d.ID != id {
+			t.Errorf("delivered a Delta with ID %q, want %q", d.ID, id)
+		}
+		for line := range logs {
+			if strings.HasPrefix(line, "slow callback: ") {
+				if !strings.HasSuffix(line, "(correlation ID "+id+")") {
+					t.Errorf("logged %q, without the correlation ID %q", line, id)
+				}
+				break
+			}
+		}
+		filtered, err := k8sutil.Filtered(s, "app=web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := k8sutil.CorrelationID(filtered); got != id {
+			t.Errorf("Filtered: got %q, want %q", got, id)
+		}
+		if got := k8sutil.Restrict(s).CorrelationID(); got != id {
+			t.Errorf("Restrict: got %q, want %q", got, id)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("two notifications with the correlation ID %q", ids[0])
+	}
+
+	s, err := w.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := k8sutil.WithCorrelationID(context.Background(), s)
+	if got := k8sutil.CorrelationIDFrom(ctx); got != ids[1] {
+		t.Errorf("the context carries %q, want %q", got, ids[1])
+	}
+	if got := k8sutil.CorrelationIDFrom(context.Background()); got != "" {
+		t.Errorf("a context without one carries %q", got)
+	}
+}
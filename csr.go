@@ -0,0 +1,236 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// Some of the signers that are built in to Kubernetes, for the
+// SignerName of a CertificateRequest.
+const (
+	// Issues client certificates that the apiserver trusts.  They
+	// are never auto-approved.
+	SignerAPIServerClient = "kubernetes.io/kube-apiserver-client"
+
+	// Issues the kubelets' serving certificates.
+	SignerKubeletServing = "kubernetes.io/kubelet-serving"
+)
+
+// csrResource is the CertificateSigningRequest resource.
+var csrResource = APIResource{
+	Group:   "certificates.k8s.io",
+	Version: "v1",
+	Name:    "certificatesigningrequests",
+	Kind:    "CertificateSigningRequest",
+}
+
+// A CertificateRequest describes a certificate to have signed by one of
+// the cluster's signers, with RequestCertificate.
+type CertificateRequest struct {
+	// Name is the name of the CertificateSigningRequest; if empty,
+	// one is generated, with the prefix "k8sutil-".
+	Name string
+
+	SignerName  string // e.g. SignerAPIServerClient; must not be empty
+	Subject     pkix.Name
+	DNSNames    []string
+	IPAddresses []net.IP
+
+	// Usages are the key usages to ask for, as the API names them,
+	// e.g. "digital signature", "client auth", or "server auth".
+	Usages []string
+
+	// Duration, if non-zero, is the lifetime to ask for; not every
+	// signer honors it.
+	Duration time.Duration
+
+	// Approve approves the request, as "kubectl certificate
+	// approve" does, instead of waiting for something else to.  The
+	// client needs permission to approve requests for the signer.
+	Approve bool
+}
+
+// RequestCertificate generates a key, submits a
+// CertificateSigningRequest for it, approves it if asked to, and waits,
+// with a watch, for the certificate to be issued.  It returns the
+// PEM-encoded certificate chain and private key.  It returns an error
+// if the request is denied or fails, and the Context's error if it is
+// done first, for example because nothing has approved the request.
+// The CertificateSigningRequest is left for the garbage collection of
+// the apiserver.
+func RequestCertificate(ctx context.Context, client *k8s.Client, req CertificateRequest) (certPEM, keyPEM []byte, err error) {
+	if req.SignerName == "" {
+		return nil, nil, errors.New("RequestCertificate: no SignerName")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "generate key")
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     req.Subject,
+		DNSNames:    req.DNSNames,
+		IPAddresses: req.IPAddresses,
+	}, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create certificate request")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "encode key")
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	metadata := map[string]interface{}{"generateName": "k8sutil-"}
+	if req.Name != "" {
+		metadata = map[string]interface{}{"name": req.Name}
+	}
+	spec := map[string]interface{}{
+		// A []byte is encoded as base64, as the API expects.
+		"request":    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}),
+		"signerName": req.SignerName,
+		"usages":     req.Usages,
+	}
+	if req.Duration > 0 {
+		spec["expirationSeconds"] = int64(req.Duration / time.Second)
+	}
+	csr := &Unstructured{}
+	err = doJSON(ctx, client, request{verb: http.MethodPost, path: csrResource.Path("")}, map[string]interface{}{
+		"apiVersion": csrResource.GroupVersion(),
+		"kind":       csrResource.Kind,
+		"metadata":   metadata,
+		"spec":       spec,
+	}, csr)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "create CertificateSigningRequest")
+	}
+	name := csr.GetMetadata().GetName()
+
+	if req.Approve {
+		if csr, err = approveCSR(ctx, client, csr); err != nil {
+			return nil, nil, errors.Wrapf(err, "approve CertificateSigningRequest %s", name)
+		}
+	}
+	certPEM, err = waitForCertificate(ctx, client, csr)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "CertificateSigningRequest %s", name)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// approveCSR adds an Approved condition to the CertificateSigningRequest,
+// and returns the result.
+func approveCSR(ctx context.Context, client *k8s.Client, csr *Unstructured) (*Unstructured, error) {
+	object := csr.Object
+	status, _ := object["status"].(map[string]interface{})
+	if status == nil {
+		status = map[string]interface{}{}
+		object["status"] = status
+	}
+	conditions, _ := status["conditions"].([]interface{})
+	status["conditions"] = append(conditions, map[string]interface{}{
+		"type":           "Approved",
+		"status":         "True",
+		"reason":         "K8sutilApprove",
+		"message":        "approved by the requester, with k8sutil.RequestCertificate",
+		"lastUpdateTime": time.Now().UTC().Format(time.RFC3339),
+	})
+	ret := &Unstructured{}
+	err := doJSON(ctx, client, request{
+		verb: http.MethodPut,
+		path: csrResource.Path("") + "/" + url.PathEscape(csr.GetMetadata().GetName()) + "/approval",
+	}, object, ret)
+	return ret, err
+}
+
+// csrStatus is the status of a CertificateSigningRequest.
+type csrStatus struct {
+	Certificate []byte `json:"certificate"`
+	Conditions  []struct {
+		Type    string `json:"type"`
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"conditions"`
+}
+
+// issued returns the certificate of the CertificateSigningRequest, if it
+// has been issued, or an error if it has been denied or has failed.
+func issued(csr *Unstructured) ([]byte, error) {
+	data, err := json.Marshal(csr.Object["status"])
+	if err != nil {
+		return nil, err
+	}
+	var status csrStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, errors.Wrap(err, "decode status")
+	}
+	for _, c := range status.Conditions {
+		if c.Type == "Denied" || c.Type == "Failed" {
+			return nil, errors.Errorf("%s: %s: %s", c.Type, c.Reason, c.Message)
+		}
+	}
+	return status.Certificate, nil
+}
+
+// waitForCertificate watches the CertificateSigningRequest until its
+// certificate is issued.
+func waitForCertificate(ctx context.Context, client *k8s.Client, csr *Unstructured) ([]byte, error) {
+	name := csr.GetMetadata().GetName()
+	for {
+		if cert, err := issued(csr); len(cert) > 0 || err != nil {
+			return cert, err
+		}
+		query := url.Values{}
+		query.Set("watch", "true")
+		query.Set("fieldSelector", "metadata.name="+name)
+		query.Set("resourceVersion", csr.GetMetadata().GetResourceVersion())
+		resp, err := do(ctx, client, request{verb: http.MethodGet, path: csrResource.Path(""), query: query})
+		if err != nil {
+			return nil, errors.Wrap(err, "watch")
+		}
+		w := newJSONWatcher(resp.Body)
+		for {
+			event := &Unstructured{}
+			eventType, err := w.Next(event)
+			if err != nil || eventType == k8s.EventDeleted {
+				w.Close()
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if eventType == k8s.EventDeleted {
+					return nil, errors.New("deleted before it was issued")
+				}
+				break
+			}
+			if eventType == "BOOKMARK" {
+				continue
+			}
+			csr = event
+			if cert, err := issued(csr); len(cert) > 0 || err != nil {
+				w.Close()
+				return cert, err
+			}
+		}
+		// The watch ended, e.g. because it timed out, or its
+		// resourceVersion expired: start again from the current
+		// state.
+		csr = &Unstructured{}
+		if err := getJSON(ctx, client, csrResource.Path("")+"/"+url.PathEscape(name), csr); err != nil {
+			return nil, errors.Wrap(err, "get")
+		}
+	}
+}
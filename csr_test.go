@@ -0,0 +1,134 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+
+	"github.com/datawire/k8sutil"
+)
+
+// A fakeSigner stands in for the apiserver's CertificateSigningRequest
+// endpoints, and issues each approved request the certificate "cert",
+// or denies it if deny is set.
+type fakeSigner struct {
+	t    *testing.T
+	deny bool
+
+	mu      sync.Mutex
+	csr     map[string]interface{}
+	request *x509.CertificateRequest
+	verbs   []string
+}
+
+const csrPath = "/apis/certificates.k8s.io/v1/certificatesigningrequests"
+
+func (f *fakeSigner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.verbs = append(f.verbs, r.Method+" "+r.URL.Path)
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == csrPath:
+		if err := json.NewDecoder(r.Body).Decode(&f.csr); err != nil {
+			f.t.Error(err)
+		}
+		f.csr["metadata"] = map[string]interface{}{"name": "k8sutil-x1", "resourceVersion": "1"}
+		spec := f.csr["spec"].(map[string]interface{})
+		var request []byte
+		if err := json.Unmarshal([]byte(`"`+spec["request"].(string)+`"`), &request); err != nil {
+			f.t.Error(err)
+		}
+		block, _ := pem.Decode(request)
+		var err error
+		if f.request, err = x509.ParseCertificateRequest(block.Bytes); err != nil {
+			f.t.Error(err)
+		}
+		writeJSON(w, http.StatusCreated, f.csr)
+	case r.Method == http.MethodPut && r.URL.Path == csrPath+"/k8sutil-x1/approval":
+		if err := json.NewDecoder(r.Body).Decode(&f.csr); err != nil {
+			f.t.Error(err)
+		}
+		f.csr["metadata"].(map[string]interface{})["resourceVersion"] = "2"
+		writeJSON(w, http.StatusOK, f.csr)
+	case r.Method == http.MethodGet && r.URL.Path == csrPath && r.URL.Query().Get("watch") == "true":
+		if got := r.URL.Query().Get("fieldSelector"); got != "metadata.name=k8sutil-x1" {
+			f.t.Errorf("watched %s", got)
+		}
+		status := map[string]interface{}{"certificate": []byte("cert")}
+		if f.deny {
+			status = map[string]interface{}{"conditions": []interface{}{
+				map[string]interface{}{"type": "Denied", "reason": "Nope", "message": "not today"},
+			}}
+		}
+		f.csr["status"] = status
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"type": "MODIFIED", "object": f.csr})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeSigner) client() *k8s.Client {
+	server := httptest.NewServer(f)
+	f.t.Cleanup(server.Close)
+	return &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+}
+
+func TestRequestCertificate(t *testing.T) {
+	f := &fakeSigner{t: t}
+	client := f.client()
+	certPEM, keyPEM, err := k8sutil.RequestCertificate(context.Background(), client, k8sutil.CertificateRequest{
+		SignerName: k8sutil.SignerAPIServerClient,
+		Subject:    pkix.Name{CommonName: "alice", Organization: []string{"devs"}},
+		DNSNames:   []string{"alice.example.com"},
+		Usages:     []string{"client auth"},
+		Approve:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(certPEM) != "cert" {
+		t.Errorf("got certificate %q", certPEM)
+	}
+	block, _ := pem.Decode(keyPEM)
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.PublicKey.Equal(f.request.PublicKey) {
+		t.Error("the key isn't that of the request")
+	}
+	if f.request.Subject.CommonName != "alice" || strings.Join(f.request.DNSNames, ",") != "alice.example.com" {
+		t.Errorf("requested %+v", f.request)
+	}
+	spec := f.csr["spec"].(map[string]interface{})
+	if spec["signerName"] != k8sutil.SignerAPIServerClient || f.csr["metadata"].(map[string]interface{})["name"] != "k8sutil-x1" {
+		t.Errorf("got spec %v", spec)
+	}
+	want := []string{"POST " + csrPath, "PUT " + csrPath + "/k8sutil-x1/approval", "GET " + csrPath}
+	if strings.Join(f.verbs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests %q, want %q", f.verbs, want)
+	}
+}
+
+func TestRequestCertificateDenied(t *testing.T) {
+	client := (&fakeSigner{t: t, deny: true}).client()
+	_, _, err := k8sutil.RequestCertificate(context.Background(), client, k8sutil.CertificateRequest{SignerName: k8sutil.SignerAPIServerClient})
+	if err == nil || !strings.Contains(err.Error(), "Denied: Nope: not today") {
+		t.Errorf("got %v", err)
+	}
+	if _, _, err := k8sutil.RequestCertificate(context.Background(), client, k8sutil.CertificateRequest{}); err == nil {
+		t.Error("requested a certificate without a signer")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// DeepCopy returns a copy of the resource that shares no memory with
+// it.  Resources from a Store are shared with every other reader of
+// the Store, and must not be modified; DeepCopy one first.
+//
+// The protobuf-generated types in github.com/ericchiang/k8s/apis are
+// copied with proto.Clone; *Unstructured and *PartialObjectMetadata
+// are copied field by field.  Any other type is copied by encoding and
+// decoding it as JSON, and DeepCopy panics if that fails.
+func DeepCopy(resource k8s.Resource) k8s.Resource {
+	switch r := resource.(type) {
+	case nil:
+		return nil
+	case *Unstructured:
+		if r == nil {
+			return r
+		}
+		ret := &Unstructured{
+			metadata: cloneObjectMeta(r.metadata),
+		}
+		if r.Object != nil {
+			ret.Object = copyJSONValue(r.Object).(map[string]interface{})
+		}
+		return ret
+	case *PartialObjectMetadata:
+		if r == nil {
+			return r
+		}
+		ret := *r
+		ret.Metadata = cloneObjectMeta(r.Metadata)
+		return &ret
+	case proto.Message:
+		return proto.Clone(r).(k8s.Resource)
+	}
+	data, err := encodeResource(resource)
+	if err != nil {
+		panic(err)
+	}
+	ret := getNewResourceInstance(resource)
+	if err := decodeResource(data, ret); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// cloneObjectMeta returns a deep copy of the ObjectMeta.
+func cloneObjectMeta(meta *metav1.ObjectMeta) *metav1.ObjectMeta {
+	if meta == nil {
+		return nil
+	}
+	return proto.Clone(meta).(*metav1.ObjectMeta)
+}
+
+// copyJSONValue returns a deep copy of a value decoded by
+// encoding/json in to an interface{}.
+func copyJSONValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			ret[k] = copyJSONValue(v)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(value))
+		for i, v := range value {
+			ret[i] = copyJSONValue(v)
+		}
+		return ret
+	}
+	return value
+}
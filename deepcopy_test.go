@@ -0,0 +1,55 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestDeepCopy(t *testing.T) {
+	cm := newConfigMap("default", "a", "k", "v")
+	cp := k8sutil.DeepCopy(cm).(*corev1.ConfigMap)
+	if !reflect.DeepEqual(cp, cm) {
+		t.Fatalf("got %v, want %v", cp, cm)
+	}
+	cp.Data["k"] = "changed"
+	*cp.Metadata.Name = "changed"
+	if cm.Data["k"] != "v" || cm.GetMetadata().GetName() != "a" {
+		t.Errorf("changing the copy changed the original to %v", cm)
+	}
+}
+
+func TestDeepCopyUnstructured(t *testing.T) {
+	u := &k8sutil.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata":   map[string]interface{}{"name": "a"},
+		"spec":       map[string]interface{}{"sizes": []interface{}{1.0, 2.0}},
+	}}
+	cp := k8sutil.DeepCopy(u).(*k8sutil.Unstructured)
+	if !reflect.DeepEqual(cp.Object, u.Object) {
+		t.Fatalf("got %v, want %v", cp.Object, u.Object)
+	}
+	cp.Object["spec"].(map[string]interface{})["sizes"].([]interface{})[0] = 3.0
+	if got := u.Object["spec"].(map[string]interface{})["sizes"].([]interface{})[0]; got != 1.0 {
+		t.Errorf("changing the copy changed the original to %v", got)
+	}
+
+	p := &k8sutil.PartialObjectMetadata{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   &metav1.ObjectMeta{Name: k8s.String("a"), Labels: map[string]string{"app": "a"}},
+	}
+	pcp := k8sutil.DeepCopy(p).(*k8sutil.PartialObjectMetadata)
+	pcp.Metadata.Labels["app"] = "b"
+	if p.Metadata.Labels["app"] != "a" {
+		t.Errorf("changing the copy changed the original's labels to %v", p.Metadata.Labels)
+	}
+}
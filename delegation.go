@@ -0,0 +1,230 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	authenticationv1 "github.com/ericchiang/k8s/apis/authentication/v1"
+	authorizationv1 "github.com/ericchiang/k8s/apis/authorization/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+)
+
+// A RequestUser is the user that a request was made by, as
+// authenticated by an AuthDelegation.
+type RequestUser struct {
+	Name   string
+	UID    string
+	Groups []string
+	Extra  map[string][]string
+}
+
+// An AuthDelegation authenticates and authorizes requests to an
+// aggregated API server the way that the apiserver's own extension
+// servers do, by delegating to the apiserver: requests proxied by the
+// apiserver carry the user in headers, and are trusted because they
+// are made with a client certificate signed by the request-header CA;
+// other requests must carry a bearer token, which is checked with a
+// TokenReview.  Every request is then authorized with a
+// SubjectAccessReview.
+//
+// The Client's service account needs the "system:auth-delegator"
+// ClusterRole, and to be able to read the
+// "extension-apiserver-authentication" ConfigMap in "kube-system", which
+// the "extension-apiserver-authentication-reader" Role there grants.
+type AuthDelegation struct {
+	Client *k8s.Client // must not be nil
+
+	// ClientCAs verifies the client certificates of proxied
+	// requests.  If nil, only bearer tokens are accepted.
+	ClientCAs *x509.CertPool
+
+	// AllowedNames, if set, are the common names that a proxied
+	// request's client certificate must have one of.
+	AllowedNames []string
+
+	// The headers that proxied requests carry the user's name,
+	// groups, and extra information in.
+	UsernameHeaders     []string
+	GroupHeaders        []string
+	ExtraHeaderPrefixes []string
+}
+
+// LoadAuthDelegation configures an AuthDelegation from the
+// "extension-apiserver-authentication" ConfigMap in "kube-system", which
+// the apiserver publishes for its extension servers.
+func LoadAuthDelegation(ctx context.Context, client *k8s.Client) (*AuthDelegation, error) {
+	var cm corev1.ConfigMap
+	if err := client.Get(ctx, "kube-system", "extension-apiserver-authentication", &cm); err != nil {
+		return nil, errors.Wrap(err, "get extension-apiserver-authentication")
+	}
+	data := cm.GetData()
+	ret := &AuthDelegation{Client: client}
+	if ca := data["requestheader-client-ca-file"]; ca != "" {
+		ret.ClientCAs = x509.NewCertPool()
+		if !ret.ClientCAs.AppendCertsFromPEM([]byte(ca)) {
+			return nil, errors.New("extension-apiserver-authentication: invalid requestheader-client-ca-file")
+		}
+	}
+	for key, field := range map[string]*[]string{
+		"requestheader-allowed-names":        &ret.AllowedNames,
+		"requestheader-username-headers":     &ret.UsernameHeaders,
+		"requestheader-group-headers":        &ret.GroupHeaders,
+		"requestheader-extra-headers-prefix": &ret.ExtraHeaderPrefixes,
+	} {
+		if str := data[key]; str != "" {
+			if err := json.Unmarshal([]byte(str), field); err != nil {
+				return nil, errors.Wrapf(err, "extension-apiserver-authentication: %s", key)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Authenticate returns the user that made the request, or an error if
+// it can't be authenticated.
+func (d *AuthDelegation) Authenticate(r *http.Request) (*RequestUser, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && d.ClientCAs != nil {
+		if err := d.verifyProxy(r); err != nil {
+			return nil, err
+		}
+		user := &RequestUser{Name: firstHeader(r.Header, d.UsernameHeaders)}
+		if user.Name == "" {
+			return nil, errors.New("proxied request without a user")
+		}
+		for _, header := range d.GroupHeaders {
+			user.Groups = append(user.Groups, r.Header[http.CanonicalHeaderKey(header)]...)
+		}
+		for header, values := range r.Header {
+			for _, prefix := range d.ExtraHeaderPrefixes {
+				if key := strings.ToLower(header); strings.HasPrefix(key, strings.ToLower(prefix)) {
+					if user.Extra == nil {
+						user.Extra = make(map[string][]string)
+					}
+					user.Extra[strings.TrimPrefix(key, strings.ToLower(prefix))] = values
+				}
+			}
+		}
+		return user, nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if token == "" || token == r.Header.Get("Authorization") {
+		return nil, errors.New("no credentials")
+	}
+	review := &authenticationv1.TokenReview{
+		Spec: &authenticationv1.TokenReviewSpec{Token: k8s.String(token)},
+	}
+	var ret authenticationv1.TokenReview
+	err := doJSON(r.Context(), d.Client, request{
+		verb: http.MethodPost,
+		path: "/apis/authentication.k8s.io/v1/tokenreviews",
+	}, review, &ret)
+	if err != nil {
+		return nil, errors.Wrap(err, "review token")
+	}
+	if !ret.GetStatus().GetAuthenticated() {
+		if msg := ret.GetStatus().GetError(); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, errors.New("invalid token")
+	}
+	info := ret.GetStatus().GetUser()
+	user := &RequestUser{Name: info.GetUsername(), UID: info.GetUid(), Groups: info.GetGroups()}
+	for key, value := range info.GetExtra() {
+		if user.Extra == nil {
+			user.Extra = make(map[string][]string)
+		}
+		user.Extra[key] = value.GetItems()
+	}
+	return user, nil
+}
+
+// verifyProxy checks that the request was made with a client
+// certificate of the apiserver's front proxy.
+func (d *AuthDelegation) verifyProxy(r *http.Request) error {
+	certs := r.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         d.ClientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return errors.Wrap(err, "verify client certificate")
+	}
+	if len(d.AllowedNames) > 0 && !containsString(d.AllowedNames, certs[0].Subject.CommonName) {
+		return errors.Errorf("client certificate %q is not allowed to proxy requests", certs[0].Subject.CommonName)
+	}
+	return nil
+}
+
+// RequestAttributes describe what a request does, for authorization:
+// the verb on a resource of the type (or, if the type is the zero
+// APIResource, on the non-resource path).
+type RequestAttributes struct {
+	Verb      string
+	Resource  APIResource
+	Namespace string
+	Name      string
+	Path      string
+}
+
+// Authorize asks the apiserver, with a SubjectAccessReview, whether the
+// user may make the request.
+func (d *AuthDelegation) Authorize(ctx context.Context, user *RequestUser, attrs RequestAttributes) (bool, error) {
+	spec := &authorizationv1.SubjectAccessReviewSpec{
+		User:   k8s.String(user.Name),
+		Uid:    k8s.String(user.UID),
+		Groups: user.Groups,
+	}
+	for key, values := range user.Extra {
+		if spec.Extra == nil {
+			spec.Extra = make(map[string]*authorizationv1.ExtraValue)
+		}
+		spec.Extra[key] = &authorizationv1.ExtraValue{Items: values}
+	}
+	if attrs.Resource.Name != "" {
+		spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Namespace: k8s.String(attrs.Namespace),
+			Verb:      k8s.String(attrs.Verb),
+			Group:     k8s.String(attrs.Resource.Group),
+			Version:   k8s.String(attrs.Resource.Version),
+			Resource:  k8s.String(attrs.Resource.Name),
+			Name:      k8s.String(attrs.Name),
+		}
+	} else {
+		spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{
+			Path: k8s.String(attrs.Path),
+			Verb: k8s.String(attrs.Verb),
+		}
+	}
+	var ret authorizationv1.SubjectAccessReview
+	err := doJSON(ctx, d.Client, request{
+		verb: http.MethodPost,
+		path: "/apis/authorization.k8s.io/v1/subjectaccessreviews",
+	}, &authorizationv1.SubjectAccessReview{Spec: spec}, &ret)
+	if err != nil {
+		return false, errors.Wrapf(err, "review %s %s", attrs.Verb, attrs.Path)
+	}
+	return ret.GetStatus().GetAllowed(), nil
+}
+
+// firstHeader returns the value of the first of the headers that is
+// set.
+func firstHeader(header http.Header, names []string) string {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
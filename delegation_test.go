@@ -0,0 +1,116 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	authenticationv1 "github.com/ericchiang/k8s/apis/authentication/v1"
+	authorizationv1 "github.com/ericchiang/k8s/apis/authorization/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// newReviewServer returns a client of an apiserver that authenticates
+// the token "good" as alice, in the group "devs", and allows her only
+// to list.
+func newReviewServer(t *testing.T) *k8s.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apis/authentication.k8s.io/v1/tokenreviews":
+			var review authenticationv1.TokenReview
+			if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+				t.Error(err)
+			}
+			status := &authenticationv1.TokenReviewStatus{Authenticated: k8s.Bool(false)}
+			if review.GetSpec().GetToken() == "good" {
+				status = &authenticationv1.TokenReviewStatus{
+					Authenticated: k8s.Bool(true),
+					User:          &authenticationv1.UserInfo{Username: k8s.String("alice"), Groups: []string{"devs"}},
+				}
+			}
+			review.Status = status
+			writeJSON(w, http.StatusCreated, &review)
+		case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+			var review authorizationv1.SubjectAccessReview
+			if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+				t.Error(err)
+			}
+			spec := review.GetSpec()
+			allowed := spec.GetUser() == "alice" && spec.GetResourceAttributes().GetVerb() == "list"
+			review.Status = &authorizationv1.SubjectAccessReviewStatus{Allowed: k8s.Bool(allowed)}
+			writeJSON(w, http.StatusCreated, &review)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+}
+
+func TestAuthDelegation(t *testing.T) {
+	d := &k8sutil.AuthDelegation{Client: newReviewServer(t)}
+	for token, want := range map[string]string{"good": "alice", "bad": "", "": ""} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		user, err := d.Authenticate(r)
+		switch {
+		case want == "" && err == nil:
+			t.Errorf("token %q: authenticated %+v", token, user)
+		case want != "" && err != nil:
+			t.Errorf("token %q: %v", token, err)
+		case want != "" && (user.Name != want || len(user.Groups) != 1 || user.Groups[0] != "devs"):
+			t.Errorf("token %q: got %+v", token, user)
+		}
+	}
+
+	alice := &k8sutil.RequestUser{Name: "alice"}
+	resource := k8sutil.APIResource{Group: "counts.example.com", Version: "v1", Name: "configmapcounts"}
+	for verb, want := range map[string]bool{"list": true, "get": false} {
+		allowed, err := d.Authorize(context.Background(), alice, k8sutil.RequestAttributes{Verb: verb, Resource: resource})
+		if err != nil || allowed != want {
+			t.Errorf("%s: got %v, %v, want %v", verb, allowed, err, want)
+		}
+	}
+}
+
+// TestAPIServiceAuth checks that an APIService with an Auth refuses
+// unauthenticated and unauthorized requests, but not the health checks.
+func TestAPIServiceAuth(t *testing.T) {
+	store := &k8sutil.WatchingStore{}
+	api := &k8sutil.APIService{
+		Store:   store,
+		Group:   "counts.example.com",
+		Version: "v1",
+		Views:   []k8sutil.View{countView},
+		Auth:    &k8sutil.AuthDelegation{Client: newReviewServer(t)},
+	}
+	for _, tc := range []struct {
+		path, token string
+		want        int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/apis/counts.example.com/v1/configmapcounts", "", http.StatusUnauthorized},
+		{"/apis/counts.example.com/v1/configmapcounts", "bad", http.StatusUnauthorized},
+		{"/apis/counts.example.com/v1/namespaces/default/configmapcounts/count", "good", http.StatusForbidden},
+		// Allowed, but the store hasn't synced.
+		{"/apis/counts.example.com/v1/configmapcounts", "good", http.StatusServiceUnavailable},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("GET %s with %q: got %d, want %d", tc.path, tc.token, w.Code, tc.want)
+		}
+	}
+}
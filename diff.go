@@ -0,0 +1,128 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"sort"
+
+	"github.com/ericchiang/k8s"
+)
+
+// A StoreDiff is what changed, for one type of resource, between two
+// Stores; see DiffStores.  Each list is sorted by namespace and then
+// name.
+type StoreDiff struct {
+	Added   []k8s.Resource   // in next, but not prev
+	Removed []k8s.Resource   // in prev, but not next, as they were
+	Changed []ResourceChange // in both, with different resourceVersions
+}
+
+// A ResourceChange is a resource as it was, and as it is.
+type ResourceChange struct {
+	Old k8s.Resource
+	New k8s.Resource
+}
+
+// Empty returns whether nothing changed.
+func (d StoreDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffStores compares the resources of the same type as the sample in
+// two Stores, such as those passed to successive Callbacks, so that a
+// consumer of the coalesced Callback can tell what changed between
+// invocations without keeping its own copy of everything.  Resources
+// are matched by namespace and name, so one that was deleted and
+// re-created shows up as Changed.  A nil prev is treated as empty.
+//
+// For the Stores passed to Callbacks, only the resources that differ
+// are decoded, even in a LazyDecode store.
+func DiffStores(prev, next Store, resourceType k8s.Resource) StoreDiff {
+	before := versionsOf(prev, resourceType)
+	after := versionsOf(next, resourceType)
+	var diff StoreDiff
+	for key, n := range after {
+		p, ok := before[key]
+		switch {
+		case !ok:
+			diff.Added = appendResource(diff.Added, n.get())
+		case p.resourceVersion != n.resourceVersion || p.uid != n.uid:
+			if old, cur := p.get(), n.get(); old != nil && cur != nil {
+				diff.Changed = append(diff.Changed, ResourceChange{Old: old, New: cur})
+			}
+		}
+	}
+	for key, p := range before {
+		if _, ok := after[key]; !ok {
+			diff.Removed = appendResource(diff.Removed, p.get())
+		}
+	}
+	sortResources(diff.Added)
+	sortResources(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return lessResource(diff.Changed[i].New, diff.Changed[j].New)
+	})
+	return diff
+}
+
+// A version identifies a stored resource's version, and gets the
+// resource.
+type version struct {
+	uid             string
+	resourceVersion string
+	get             func() k8s.Resource // nil if it can't be decoded
+}
+
+// versionsOf returns the versions of the stored resources of the type,
+// by namespace and name.
+func versionsOf(store Store, resourceType k8s.Resource) map[ObjectKey]version {
+	ret := map[ObjectKey]version{}
+	switch s := store.(type) {
+	case nil:
+	case *snapshot:
+		types, ok := s.types[typeKeyOf(resourceType)]
+		if !ok {
+			break
+		}
+		types.entries.each(func(uid string, e *entry) {
+			ret[ObjectKey{Namespace: e.namespace, Name: e.name}] = version{
+				uid:             uid,
+				resourceVersion: e.resourceVersion,
+				get:             func() k8s.Resource { return e.decode(types.sample, s.lazy) },
+			}
+		})
+	default:
+		for _, resource := range store.List(resourceType) {
+			resource := resource
+			md := resource.GetMetadata()
+			ret[ObjectKey{Namespace: md.GetNamespace(), Name: md.GetName()}] = version{
+				uid:             md.GetUid(),
+				resourceVersion: md.GetResourceVersion(),
+				get:             func() k8s.Resource { return resource },
+			}
+		}
+	}
+	return ret
+}
+
+func appendResource(resources []k8s.Resource, resource k8s.Resource) []k8s.Resource {
+	if resource == nil {
+		return resources
+	}
+	return append(resources, resource)
+}
+
+func sortResources(resources []k8s.Resource) {
+	sort.Slice(resources, func(i, j int) bool {
+		return lessResource(resources[i], resources[j])
+	})
+}
+
+// lessResource orders resources by namespace and then name.
+func lessResource(a, b k8s.Resource) bool {
+	am, bm := a.GetMetadata(), b.GetMetadata()
+	if am.GetNamespace() != bm.GetNamespace() {
+		return am.GetNamespace() < bm.GetNamespace()
+	}
+	return am.GetName() < bm.GetName()
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// diffNames returns the names in a StoreDiff, as added, removed, and
+// changed.
+func diffNames(diff k8sutil.StoreDiff) [3][]string {
+	var ret [3][]string
+	for _, resource := range diff.Added {
+		ret[0] = append(ret[0], resource.GetMetadata().GetName())
+	}
+	for _, resource := range diff.Removed {
+		ret[1] = append(ret[1], resource.GetMetadata().GetName())
+	}
+	for _, change := range diff.Changed {
+		ret[2] = append(ret[2], change.Old.(*corev1.ConfigMap).Data["k"]+">"+change.New.(*corev1.ConfigMap).Data["k"])
+	}
+	return ret
+}
+
+func TestDiffStores(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		server := newFakeAPIServer(t)
+		server.set(newConfigMap("default", "a", "k", "1"))
+		server.set(newConfigMap("default", "b", "k", "1"))
+		server.set(newConfigMap("default", "d", "k", "1"))
+		stores := make(chan k8sutil.Store, 10)
+		w := &k8sutil.WatchingStore{
+			Client:     server.client(),
+			Logger:     testLogger{t},
+			Callback:   func(s k8sutil.Store) { stores <- s },
+			LazyDecode: lazy,
+		}
+		w.AddWatch("default", &corev1.ConfigMapList{})
+		runStore(t, w)
+		prev := <-stores
+
+		server.set(newConfigMap("default", "a", "k", "2"))
+		server.remove(newConfigMap("default", "b"))
+		server.set(newConfigMap("default", "c", "k", "1"))
+		// Once c is in the store, so are the earlier changes.
+		var next k8sutil.Store
+		deadline := time.After(timeout)
+		for next == nil || len(next.List(&corev1.ConfigMap{})) != 3 || next.Keys(&corev1.ConfigMap{})[1].Name != "c" {
+			select {
+			case next = <-stores:
+			case <-deadline:
+				t.Fatalf("lazy=%v: never got all of the changes", lazy)
+			}
+		}
+		want := [3][]string{{"c"}, {"b"}, {"1>2"}}
+		if got := diffNames(k8sutil.DiffStores(prev, next, &corev1.ConfigMap{})); !reflect.DeepEqual(got, want) {
+			t.Errorf("lazy=%v: got %v, want %v", lazy, got, want)
+		}
+		if diff := k8sutil.DiffStores(next, next, &corev1.ConfigMap{}); !diff.Empty() {
+			t.Errorf("lazy=%v: a store differs from itself: %v", lazy, diffNames(diff))
+		}
+	}
+}
+
+// TestDiffStoresOther checks DiffStores of Stores that aren't from a
+// WatchingStore, and of a nil prev.
+func TestDiffStoresOther(t *testing.T) {
+	a := newConfigMap("default", "a", "k", "1")
+	b := newConfigMap("default", "b", "k", "1")
+	a2 := newConfigMap("default", "a", "k", "2")
+	for _, cm := range []*corev1.ConfigMap{a, b} {
+		cm.Metadata.ResourceVersion = k8s.String("1")
+	}
+	a2.Metadata.ResourceVersion = k8s.String("2")
+	got := diffNames(k8sutil.DiffStores(staticStore{a, b}, staticStore{a2}, &corev1.ConfigMap{}))
+	if want := [3][]string{nil, {"b"}, {"1>2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got = diffNames(k8sutil.DiffStores(nil, staticStore{b, a}, &corev1.ConfigMap{}))
+	if want := [3][]string{{"a", "b"}, nil, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("from nil: got %v, want %v", got, want)
+	}
+}
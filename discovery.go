@@ -0,0 +1,249 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// An APIResource describes a resource type that the apiserver serves.
+type APIResource struct {
+	Group      string // "" for the core group
+	Version    string
+	Name       string // the plural resource name used in URLs, e.g. "deployments"
+	Kind       string // e.g. "Deployment"
+	Namespaced bool
+	Verbs      []string
+
+	// Preferred is whether Version is the group's preferred
+	// version.
+	Preferred bool
+}
+
+// GroupVersion returns the resource's API version as it would appear
+// in an object's apiVersion field, e.g. "apps/v1" or "v1".
+func (r APIResource) GroupVersion() string {
+	if r.Group == "" {
+		return r.Version
+	}
+	return r.Group + "/" + r.Version
+}
+
+// Supports returns whether the resource supports the given verb, e.g.
+// "list" or "watch".
+func (r APIResource) Supports(verb string) bool {
+	for _, v := range r.Verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the URL path of the resource's collection in the given
+// namespace (or across all namespaces, if namespace is
+// k8s.AllNamespaces or the resource isn't namespaced).
+func (r APIResource) Path(namespace string) string {
+	p := "/apis/" + r.GroupVersion()
+	if r.Group == "" {
+		p = "/api/" + r.Version
+	}
+	if r.Namespaced && namespace != k8s.AllNamespaces {
+		p += "/namespaces/" + namespace
+	}
+	return p + "/" + r.Name
+}
+
+// DefaultDiscoveryTTL is how long a Discovery caches its results for
+// if its TTL is zero.
+const DefaultDiscoveryTTL = 10 * time.Minute
+
+// Discovery enumerates the resource types that the apiserver serves,
+// caching the result.  The zero value is not usable; Client must be
+// set.  It is safe to use a Discovery from multiple goroutines.
+type Discovery struct {
+	Client *k8s.Client // must not be nil
+
+	// TTL is how long results are cached for before being
+	// fetched again.  If zero, DefaultDiscoveryTTL is used.
+	TTL time.Duration
+
+	// Clock, if set, is used instead of the system clock to
+	// expire the cache.
+	Clock Clock
+
+	mu        sync.Mutex
+	fetched   time.Time
+	resources []APIResource
+}
+
+// GroupDiscoveryError is returned (along with the resources that
+// could be discovered) when some API group versions could not be
+// discovered, which is usually because an aggregated API server (such
+// as metrics-server) is unavailable.  It maps group versions to the
+// error encountered fetching them.
+type GroupDiscoveryError map[string]error
+
+func (e GroupDiscoveryError) Error() string {
+	gvs := make([]string, 0, len(e))
+	for gv := range e {
+		gvs = append(gvs, gv)
+	}
+	sort.Strings(gvs)
+	msgs := make([]string, 0, len(gvs))
+	for _, gv := range gvs {
+		msgs = append(msgs, gv+": "+e[gv].Error())
+	}
+	return "unable to discover some API group versions: " + strings.Join(msgs, "; ")
+}
+
+// Invalidate discards the cached results, so that the next call
+// fetches them again.  Call it when you have reason to believe that the
+// set of resource types has changed, for example when a
+// CustomResourceDefinition is created.
+func (d *Discovery) Invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resources = nil
+}
+
+// Resources returns every resource type that the apiserver serves, at
+// every version that it is served at.  Subresources (such as
+// "pods/log") are not included.
+//
+// If only some group versions could be discovered, the ones that could
+// are returned along with a GroupDiscoveryError.  Partial results are
+// cached just like complete ones.
+//
+// The returned slice is shared; it is not valid to mutate it.
+func (d *Discovery) Resources(ctx context.Context) ([]APIResource, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ttl := d.TTL
+	if ttl == 0 {
+		ttl = DefaultDiscoveryTTL
+	}
+	clock := orSystemClock(d.Clock)
+	if d.resources != nil && clock.Now().Sub(d.fetched) < ttl {
+		return d.resources, nil
+	}
+	resources, err := discover(ctx, d.Client)
+	if resources == nil {
+		return nil, err
+	}
+	d.resources = resources
+	d.fetched = clock.Now()
+	return resources, err
+}
+
+// ResourceForKind returns the resource type for the given apiVersion
+// (e.g. "apps/v1") and kind (e.g. "Deployment").  If apiVersion is
+// just a group name (e.g. "apps"), the group's preferred version is
+// used.
+func (d *Discovery) ResourceForKind(ctx context.Context, apiVersion, kind string) (APIResource, error) {
+	resources, err := d.Resources(ctx)
+	if resources == nil {
+		return APIResource{}, err
+	}
+	for _, r := range resources {
+		if r.Kind == kind && (r.GroupVersion() == apiVersion || (r.Group == apiVersion && r.Preferred)) {
+			return r, nil
+		}
+	}
+	return APIResource{}, errors.Errorf("no resource for kind %q in %q", kind, apiVersion)
+}
+
+// The JSON forms of the discovery documents.  The metav1 types can't
+// be used, since their Verbs field doesn't decode from JSON.
+type (
+	apiVersionsJSON struct {
+		Versions []string `json:"versions"`
+	}
+	apiGroupListJSON struct {
+		Groups []struct {
+			Name     string `json:"name"`
+			Versions []struct {
+				Version string `json:"version"`
+			} `json:"versions"`
+			PreferredVersion struct {
+				Version string `json:"version"`
+			} `json:"preferredVersion"`
+		} `json:"groups"`
+	}
+	apiResourceListJSON struct {
+		Resources []struct {
+			Name       string   `json:"name"`
+			Namespaced bool     `json:"namespaced"`
+			Kind       string   `json:"kind"`
+			Verbs      []string `json:"verbs"`
+		} `json:"resources"`
+	}
+)
+
+// discover fetches every discovery document from the apiserver.
+func discover(ctx context.Context, client *k8s.Client) ([]APIResource, error) {
+	type groupVersion struct {
+		group, version string
+		preferred      bool
+	}
+	var gvs []groupVersion
+
+	var core apiVersionsJSON
+	if err := getJSON(ctx, client, "/api", &core); err != nil {
+		return nil, errors.Wrap(err, "discover core API versions")
+	}
+	for i, version := range core.Versions {
+		gvs = append(gvs, groupVersion{"", version, i == 0})
+	}
+	var groups apiGroupListJSON
+	if err := getJSON(ctx, client, "/apis", &groups); err != nil {
+		return nil, errors.Wrap(err, "discover API groups")
+	}
+	for _, group := range groups.Groups {
+		for _, version := range group.Versions {
+			gvs = append(gvs, groupVersion{group.Name, version.Version, version.Version == group.PreferredVersion.Version})
+		}
+	}
+
+	ret := []APIResource{}
+	failed := GroupDiscoveryError{}
+	for _, gv := range gvs {
+		path := "/apis/" + gv.group + "/" + gv.version
+		if gv.group == "" {
+			path = "/api/" + gv.version
+		}
+		var list apiResourceListJSON
+		if err := getJSON(ctx, client, path, &list); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			failed[strings.TrimPrefix(gv.group+"/"+gv.version, "/")] = err
+			continue
+		}
+		for _, r := range list.Resources {
+			if strings.Contains(r.Name, "/") {
+				continue
+			}
+			ret = append(ret, APIResource{
+				Group:      gv.group,
+				Version:    gv.version,
+				Name:       r.Name,
+				Kind:       r.Kind,
+				Namespaced: r.Namespaced,
+				Verbs:      r.Verbs,
+				Preferred:  gv.preferred,
+			})
+		}
+	}
+	if len(failed) > 0 {
+		return ret, failed
+	}
+	return ret, nil
+}
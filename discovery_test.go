@@ -0,0 +1,86 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestDiscovery(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.setUnavailable("metrics.k8s.io/v1beta1")
+	d := &k8sutil.Discovery{Client: server.client()}
+
+	resources, err := d.Resources(context.Background())
+	groupErr, ok := err.(k8sutil.GroupDiscoveryError)
+	if !ok || len(groupErr) != 1 || groupErr["metrics.k8s.io/v1beta1"] == nil {
+		t.Errorf("got error %v, want a GroupDiscoveryError for metrics.k8s.io/v1beta1", err)
+	}
+	var names []string
+	for _, r := range resources {
+		names = append(names, r.GroupVersion()+" "+r.Kind+" "+r.Name)
+	}
+	if want := []string{"v1 ConfigMap configmaps", "v1 Namespace namespaces"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got resources %q, want %q", names, want)
+	}
+	server.drain()
+
+	// The results, partial as they are, are cached.
+	if _, err := d.Resources(context.Background()); err != nil {
+		t.Errorf("cached: got error %v", err)
+	}
+	if lines := server.drain(); len(lines) != 0 {
+		t.Errorf("cached: made requests %q", lines)
+	}
+	d.Invalidate()
+	if _, err := d.Resources(context.Background()); err == nil {
+		t.Errorf("invalidated: got no error")
+	}
+	if lines := server.drain(); len(lines) == 0 {
+		t.Errorf("invalidated: made no requests")
+	}
+}
+
+func TestDiscoveryTTL(t *testing.T) {
+	server := newFakeAPIServer(t)
+	d := &k8sutil.Discovery{Client: server.client(), TTL: time.Millisecond}
+	if _, err := d.Resources(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server.drain()
+	time.Sleep(2 * time.Millisecond)
+	if _, err := d.Resources(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := server.drain(); len(lines) == 0 {
+		t.Errorf("made no requests after the TTL")
+	}
+}
+
+func TestResourceForKind(t *testing.T) {
+	server := newFakeAPIServer(t)
+	d := &k8sutil.Discovery{Client: server.client()}
+	r, err := d.ResourceForKind(context.Background(), "v1", "ConfigMap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Namespaced || !r.Supports("watch") || r.Supports("deletecollection") || !r.Preferred {
+		t.Errorf("got %+v", r)
+	}
+	if got, want := r.Path("default"), "/api/v1/namespaces/default/configmaps"; got != want {
+		t.Errorf("Path: got %q, want %q", got, want)
+	}
+	if got, want := r.Path(k8s.AllNamespaces), "/api/v1/configmaps"; got != want {
+		t.Errorf("Path: got %q, want %q", got, want)
+	}
+	if _, err := d.ResourceForKind(context.Background(), "v1", "Deployment"); err == nil {
+		t.Errorf("found a v1 Deployment")
+	}
+}
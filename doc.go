@@ -1,4 +1,14 @@
 // Copyright 2018 Datawire. All rights reserved.
 
 // Package k8sutil provides utility functions for github.com/ericchiang/k8s
+//
+// # Encoding
+//
+// The list and watch requests that k8sutil makes already ask for
+// application/vnd.kubernetes.protobuf whenever the resource type is a
+// protobuf message, as all of the built-in types in
+// github.com/ericchiang/k8s/apis are; there is no option to turn on.
+// Types that aren't protobuf messages (such as hand-written CRD types)
+// are requested as application/json, since the apiserver cannot encode
+// custom resources as protobuf.
 package k8sutil
@@ -0,0 +1,284 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+)
+
+// Cordon marks a node unschedulable, as "kubectl cordon" does, so that
+// no new pods are scheduled to it.
+func Cordon(ctx context.Context, client *k8s.Client, node string, options ...MutateOption) error {
+	return setUnschedulable(ctx, client, node, true, options)
+}
+
+// Uncordon marks a node schedulable again, as "kubectl uncordon" does.
+func Uncordon(ctx context.Context, client *k8s.Client, node string, options ...MutateOption) error {
+	return setUnschedulable(ctx, client, node, false, options)
+}
+
+func setUnschedulable(ctx context.Context, client *k8s.Client, node string, unschedulable bool, options []MutateOption) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{"unschedulable": unschedulable},
+	}
+	err := mutateOptionsOf(options).do(ctx, client, request{
+		verb:        http.MethodPatch,
+		path:        "/api/v1/nodes/" + url.PathEscape(node),
+		contentType: MergePatchType,
+	}, patch, nil)
+	return errors.Wrapf(err, "patch node %s", node)
+}
+
+// DrainPolicy says which pods Drain may evict, and how.  As with
+// "kubectl drain", by default Drain refuses to drain a node with pods
+// that it would have to skip or lose data to evict: pods of
+// DaemonSets, pods that aren't managed by a controller, and pods with
+// emptyDir volumes.  It always skips mirror pods, which the kubelet
+// manages.
+type DrainPolicy struct {
+	// IgnoreDaemonSets skips pods of DaemonSets, which would be
+	// recreated on the node anyway.
+	IgnoreDaemonSets bool
+
+	// Force evicts pods that aren't managed by a controller, and so
+	// won't be recreated elsewhere.
+	Force bool
+
+	// DeleteEmptyDirData evicts pods with emptyDir volumes, whose
+	// data is lost.
+	DeleteEmptyDirData bool
+
+	// GracePeriod, if positive, overrides the termination grace
+	// period of the evicted pods.
+	GracePeriod time.Duration
+
+	// Timeout, if positive, is how long to wait for the node to be
+	// drained before giving up.
+	Timeout time.Duration
+
+	// RetryInterval is how long to wait before retrying an eviction
+	// that a PodDisruptionBudget refused.  If zero, it is the
+	// RetryAfter of the refusal.
+	RetryInterval time.Duration
+
+	// Progress, if set, is called with each step of the drain.
+	Progress func(DrainProgress)
+
+	// Clock, if set, is used instead of the system clock for the
+	// Timeout and RetryInterval.
+	Clock Clock
+}
+
+// The Events of DrainProgress.
+const (
+	DrainEvicting = "Evicting" // the eviction of the pod was requested
+	DrainBlocked  = "Blocked"  // a PodDisruptionBudget refused the eviction, for now
+	DrainEvicted  = "Evicted"  // the pod is gone
+	DrainSkipped  = "Skipped"  // the pod is left on the node, per the policy
+)
+
+// DrainProgress is a step of a drain.
+type DrainProgress struct {
+	Node      string
+	Pod       ObjectKey
+	Event     string // DrainEvicting, DrainBlocked, etc.
+	Err       error  // why the eviction was blocked, if it was
+	Remaining int    // the number of pods still to be evicted
+}
+
+// Drain cordons a node and evicts its pods, as "kubectl drain" does,
+// and waits for them to be gone.  The pods are those on the node in the
+// store, which must be watching Pods in all namespaces.  Evictions
+// respect PodDisruptionBudgets: one that a budget refuses is retried
+// until the budget allows it, or the Timeout.
+func Drain(ctx context.Context, client *k8s.Client, store *WatchingStore, node string, policy DrainPolicy) error {
+	clock := orSystemClock(policy.Clock)
+	if policy.Timeout > 0 {
+		timer := clock.NewTimer(policy.Timeout)
+		defer timer.Stop()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-timer.C():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	progress := func(p DrainProgress) {
+		if policy.Progress != nil {
+			p.Node = node
+			policy.Progress(p)
+		}
+	}
+
+	if err := Cordon(ctx, client, node); err != nil {
+		return err
+	}
+	sub := store.subscribe(1, EventsCoalesce)
+	defer store.unsubscribe(sub)
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		return errors.Wrap(err, "drain")
+	}
+
+	// The pods to evict, by UID, so that a replacement of the same
+	// name isn't mistaken for the original.
+	pending := make(map[string]*corev1.Pod)
+	var refused []string
+	for _, r := range snapshot.ListSorted(&corev1.Pod{}) {
+		pod := r.(*corev1.Pod)
+		if pod.GetSpec().GetNodeName() != node {
+			continue
+		}
+		skip, reason := drainFilter(pod, policy)
+		switch {
+		case reason != "":
+			refused = append(refused, objectKeyOf(pod).String()+" ("+reason+")")
+		case skip:
+			progress(DrainProgress{Pod: objectKeyOf(pod), Event: DrainSkipped})
+		default:
+			pending[pod.GetMetadata().GetUid()] = pod
+		}
+	}
+	if len(refused) > 0 {
+		return errors.Errorf("cannot drain node %s: %s", node, strings.Join(refused, ", "))
+	}
+
+	events := sub.out
+	evicted := make(map[string]bool)           // by UID
+	blockedUntil := make(map[string]time.Time) // by UID
+	for len(pending) > 0 {
+		// Evict, or retry evicting, each pod that a budget has
+		// refused, in a stable order.
+		now := clock.Now()
+		uids := make([]string, 0, len(pending))
+		for uid := range pending {
+			if !evicted[uid] && !now.Before(blockedUntil[uid]) {
+				uids = append(uids, uid)
+			}
+		}
+		sort.Slice(uids, func(i, j int) bool {
+			return objectKeyOf(pending[uids[i]]).String() < objectKeyOf(pending[uids[j]]).String()
+		})
+		for _, uid := range uids {
+			pod := pending[uid]
+			key := objectKeyOf(pod)
+			err := Evict(ctx, client, key, EvictOptions{UID: uid, GracePeriod: policy.GracePeriod})
+			var budgetErr *DisruptionBudgetError
+			switch code := apiErrorCode(err); {
+			case err == nil:
+				evicted[uid] = true
+				progress(DrainProgress{Pod: key, Event: DrainEvicting, Remaining: len(pending)})
+			case code == http.StatusNotFound || code == http.StatusConflict:
+				// It is gone, or has been replaced.
+				delete(pending, uid)
+				progress(DrainProgress{Pod: key, Event: DrainEvicted, Remaining: len(pending)})
+			case errors.As(err, &budgetErr):
+				retryAfter := policy.RetryInterval
+				if retryAfter == 0 {
+					retryAfter = budgetErr.RetryAfter
+				}
+				blockedUntil[uid] = now.Add(retryAfter)
+				progress(DrainProgress{Pod: key, Event: DrainBlocked, Err: err, Remaining: len(pending)})
+			default:
+				if ctx.Err() != nil {
+					return errors.Wrapf(ctx.Err(), "drain node %s", node)
+				}
+				return errors.Wrapf(err, "drain node %s", node)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		// Wait for the evicted pods to go, or to retry the
+		// first of the refused ones.
+		var retry time.Time
+		for uid := range pending {
+			if until := blockedUntil[uid]; !evicted[uid] && (retry.IsZero() || until.Before(retry)) {
+				retry = until
+			}
+		}
+		var timer Timer
+		var retryC <-chan time.Time
+		if !retry.IsZero() {
+			timer = clock.NewTimer(retry.Sub(now))
+			retryC = timer.C()
+		}
+		select {
+		case <-ctx.Done():
+		case <-retryC:
+		case d, ok := <-events:
+			if !ok {
+				events = nil
+				break
+			}
+			snapshot = d.Store
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "drain node %s: %d pods remaining", node, len(pending))
+		}
+		present := make(map[string]bool)
+		for _, r := range snapshot.List(&corev1.Pod{}) {
+			present[r.GetMetadata().GetUid()] = true
+		}
+		for uid, pod := range pending {
+			if !present[uid] {
+				delete(pending, uid)
+				progress(DrainProgress{Pod: objectKeyOf(pod), Event: DrainEvicted, Remaining: len(pending)})
+			}
+		}
+	}
+	return nil
+}
+
+// drainFilter returns whether the policy skips the pod, or why it
+// refuses to drain a node with it.
+func drainFilter(pod *corev1.Pod, policy DrainPolicy) (skip bool, refuse string) {
+	md := pod.GetMetadata()
+	if _, ok := md.GetAnnotations()["kubernetes.io/config.mirror"]; ok {
+		return true, ""
+	}
+	var controller string
+	for _, ref := range md.GetOwnerReferences() {
+		if ref.GetController() {
+			controller = ref.GetKind()
+		}
+	}
+	switch {
+	case controller == "DaemonSet" && policy.IgnoreDaemonSets:
+		return true, ""
+	case controller == "DaemonSet":
+		return false, "managed by a DaemonSet"
+	case controller == "" && !policy.Force:
+		return false, "not managed by a controller"
+	}
+	switch pod.GetStatus().GetPhase() {
+	case "Succeeded", "Failed":
+		// It has no data left to lose.
+		return false, ""
+	}
+	if !policy.DeleteEmptyDirData {
+		for _, v := range pod.GetSpec().GetVolumes() {
+			if v.GetVolumeSource().GetEmptyDir() != nil {
+				return false, "has emptyDir volume " + v.GetName()
+			}
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,211 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// A fakeEvictions stands in for the apiserver's node and eviction
+// endpoints.
+type fakeEvictions struct {
+	mu       sync.Mutex
+	requests []string       // method, path, and body of each request
+	refuse   map[string]int // how many more evictions of each pod to refuse
+}
+
+func (f *fakeEvictions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	data, _ := json.Marshal(body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+string(data))
+	if strings.HasSuffix(r.URL.Path, "/eviction") {
+		pod := strings.Split(r.URL.Path, "/")[6]
+		if f.refuse[pod] > 0 {
+			f.refuse[pod]--
+			writeJSON(w, http.StatusTooManyRequests, &metav1.Status{
+				Status:  k8s.String("Failure"),
+				Message: k8s.String("Cannot evict pod as it would violate the pod's disruption budget."),
+				Reason:  k8s.String("TooManyRequests"),
+				Code:    k8s.Int32(http.StatusTooManyRequests),
+			})
+			return
+		}
+		writeJSON(w, http.StatusCreated, body)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (f *fakeEvictions) client(t *testing.T) *k8s.Client {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+}
+
+// nodePod returns a pod on the node, controlled by a resource of the
+// kind, if it isn't "".
+func nodePod(name, node, kind string) *corev1.Pod {
+	p := &corev1.Pod{
+		Metadata: k8sutiltest.ObjectMeta("default", name, "1"),
+		Spec:     &corev1.PodSpec{NodeName: k8s.String(node)},
+		Status:   &corev1.PodStatus{Phase: k8s.String("Running")},
+	}
+	if kind != "" {
+		p.Metadata.OwnerReferences = []*metav1.OwnerReference{{Kind: k8s.String(kind), Name: k8s.String("owner"), Controller: k8s.Bool(true)}}
+	}
+	return p
+}
+
+func TestCordon(t *testing.T) {
+	f := &fakeEvictions{}
+	client := f.client(t)
+	if err := k8sutil.Cordon(context.Background(), client, "n1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k8sutil.Uncordon(context.Background(), client, "n1"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`PATCH /api/v1/nodes/n1 {"spec":{"unschedulable":true}}`,
+		`PATCH /api/v1/nodes/n1 {"spec":{"unschedulable":false}}`,
+	}
+	if strings.Join(f.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests\n%s\nwant\n%s", strings.Join(f.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestDrain checks that Drain evicts the pods that it may, retries
+// those that a PodDisruptionBudget blocks, and waits for them all to be
+// gone.
+func TestDrain(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	synced := make(chan struct{}, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { synced <- struct{}{} },
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.PodList{})
+	stream := backend.Stream(k8s.AllNamespaces, &corev1.PodList{})
+	mirror := nodePod("mirror", "n1", "")
+	mirror.Metadata.Annotations = map[string]string{"kubernetes.io/config.mirror": "x"}
+	stream.List(&corev1.PodList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items: []*corev1.Pod{
+			nodePod("a", "n1", "ReplicaSet"),
+			nodePod("b", "n1", "ReplicaSet"),
+			nodePod("ds", "n1", "DaemonSet"),
+			mirror,
+			nodePod("elsewhere", "n2", ""),
+		},
+	})
+	runStore(t, w)
+	<-synced
+
+	f := &fakeEvictions{refuse: map[string]int{"b": 1}}
+	clock := k8sutiltest.NewFakeClock(epoch)
+	progress := make(chan string, 10)
+	policy := k8sutil.DrainPolicy{
+		IgnoreDaemonSets: true,
+		GracePeriod:      30 * time.Second,
+		Clock:            clock,
+		Progress: func(p k8sutil.DrainProgress) {
+			progress <- p.Event + " " + p.Pod.String()
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- k8sutil.Drain(context.Background(), f.client(t), w, "n1", policy) }()
+	expect := func(events ...string) {
+		t.Helper()
+		for _, want := range events {
+			select {
+			case got := <-progress:
+				if got != want {
+					t.Errorf("got progress %q, want %q", got, want)
+				}
+			case <-time.After(timeout):
+				t.Fatalf("timed out waiting for %q", want)
+			}
+		}
+	}
+	expect("Skipped default/ds", "Skipped default/mirror", "Evicting default/a", "Blocked default/b")
+	stream.WaitForWatch(1)
+	stream.Send(k8s.EventDeleted, nodePod("a", "n1", "ReplicaSet"))
+	expect("Evicted default/a")
+	if !clock.WaitForTimers(1, timeout) {
+		t.Fatal("timed out waiting to retry")
+	}
+	clock.Advance(5 * time.Second)
+	expect("Evicting default/b")
+	stream.Send(k8s.EventDeleted, nodePod("b", "n1", "ReplicaSet"))
+	expect("Evicted default/b")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	evictB := `POST /api/v1/namespaces/default/pods/b/eviction {"apiVersion":"policy/v1","deleteOptions":{"gracePeriodSeconds":30,"preconditions":{"uid":"default/b"}},"kind":"Eviction","metadata":{"name":"b","namespace":"default"}}`
+	want := []string{
+		`PATCH /api/v1/nodes/n1 {"spec":{"unschedulable":true}}`,
+		`POST /api/v1/namespaces/default/pods/a/eviction {"apiVersion":"policy/v1","deleteOptions":{"gracePeriodSeconds":30,"preconditions":{"uid":"default/a"}},"kind":"Eviction","metadata":{"name":"a","namespace":"default"}}`,
+		evictB,
+		evictB,
+	}
+	if strings.Join(f.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests\n%s\nwant\n%s", strings.Join(f.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestDrainRefused checks that Drain refuses to drain a node with pods
+// that the policy doesn't allow it to evict, before evicting any.
+func TestDrainRefused(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	synced := make(chan struct{}, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { synced <- struct{}{} },
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.PodList{})
+	withData := nodePod("data", "n1", "ReplicaSet")
+	withData.Spec.Volumes = []*corev1.Volume{{
+		Name:         k8s.String("scratch"),
+		VolumeSource: &corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	}}
+	backend.Stream(k8s.AllNamespaces, &corev1.PodList{}).List(&corev1.PodList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items:    []*corev1.Pod{nodePod("bare", "n1", ""), withData, nodePod("ds", "n1", "DaemonSet")},
+	})
+	runStore(t, w)
+	<-synced
+
+	f := &fakeEvictions{}
+	err := k8sutil.Drain(context.Background(), f.client(t), w, "n1", k8sutil.DrainPolicy{})
+	want := "cannot drain node n1: default/bare (not managed by a controller), default/data (has emptyDir volume scratch), default/ds (managed by a DaemonSet)"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	for _, r := range f.requests {
+		if strings.Contains(r, "eviction") {
+			t.Errorf("evicted: %s", r)
+		}
+	}
+}
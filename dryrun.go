@@ -0,0 +1,76 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// A MutateOption is an option of the helpers that change a resource,
+// such as Scale and SetImage.
+type MutateOption func(*mutateOptions)
+
+type mutateOptions struct {
+	dryRun bool
+	result interface{}
+}
+
+// DryRun makes the change with server-side dry run, for plan and
+// preview modes: the apiserver validates, defaults, and admits it as it
+// would otherwise (webhooks included, which is why they must declare
+// that they have no side effects), but doesn't persist it.  If result
+// is non-nil, the resource as the apiserver would have written it is
+// unmarshaled in to it: a *Unstructured, say, or the resource's Go
+// type.
+func DryRun(result interface{}) MutateOption {
+	return func(o *mutateOptions) {
+		o.dryRun = true
+		o.result = result
+	}
+}
+
+func mutateOptionsOf(options []MutateOption) mutateOptions {
+	var o mutateOptions
+	for _, option := range options {
+		option(&o)
+	}
+	return o
+}
+
+// do sends the request (with the body marshaled from in as JSON), as
+// doJSON does, with the options, and unmarshals the response in to out
+// (if non-nil), and in to the result of a dry run (if asked for).
+func (o mutateOptions) do(ctx context.Context, client *k8s.Client, r request, in, out interface{}) error {
+	r.dryRun = o.dryRun
+	if o.result == nil {
+		return doJSON(ctx, client, r, in, out)
+	}
+	var data json.RawMessage
+	if err := doJSON(ctx, client, r, in, &data); err != nil {
+		return err
+	}
+	if err := unmarshalResult(data, o.result); err != nil {
+		return errors.Wrap(err, "decode dry run result")
+	}
+	if out != nil {
+		if err := unmarshalResult(data, out); err != nil {
+			return errors.Wrap(err, "decode response")
+		}
+	}
+	return nil
+}
+
+// unmarshalResult decodes the apiserver's JSON in to v, which, if it is
+// a resource of the k8s package's types, is decoded with
+// unmarshalKubeJSON, since encoding/json can't decode their quantities
+// and int-or-strings.
+func unmarshalResult(data []byte, v interface{}) error {
+	if r, ok := v.(k8s.Resource); ok {
+		return unmarshalKubeJSON(data, r)
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// dryRunDeployment is a Deployment as the apiserver encodes it, with
+// quantities and int-or-strings.
+const dryRunDeployment = `{
+	"apiVersion": "apps/v1",
+	"kind": "Deployment",
+	"metadata": {"namespace": "default", "name": "web", "annotations": {"kubectl.kubernetes.io/restartedAt": "now"}},
+	"spec": {
+		"strategy": {"rollingUpdate": {"maxSurge": "25%", "maxUnavailable": 1}},
+		"template": {"spec": {"containers": [{
+			"name": "web",
+			"resources": {"limits": {"cpu": "100m"}},
+			"ports": [{"containerPort": 8080}]
+		}]}}
+	}
+}`
+
+// A fakeDryRun answers every request with dryRunDeployment, logging the
+// requests.
+type fakeDryRun struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (f *fakeDryRun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, _ = ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.String())
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(dryRunDeployment))
+}
+
+func TestDryRun(t *testing.T) {
+	f := &fakeDryRun{}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	client := &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+	ref := k8sutil.ObjectRef{GroupVersionResource: k8sutil.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, Namespace: "default", Name: "web"}
+
+	result := new(appsv1.Deployment)
+	if err := k8sutil.RolloutRestart(context.Background(), client, ref, k8sutil.DryRun(result)); err != nil {
+		t.Fatal(err)
+	}
+	container := result.GetSpec().GetTemplate().GetSpec().GetContainers()[0]
+	if cpu := container.GetResources().GetLimits()["cpu"].GetString_(); cpu != "100m" {
+		t.Errorf("decoded the cpu limit as %q", cpu)
+	}
+	if port := container.GetPorts()[0].GetContainerPort(); port != 8080 {
+		t.Errorf("decoded the port as %d", port)
+	}
+	if surge := result.GetSpec().GetStrategy().GetRollingUpdate().GetMaxSurge().GetStrVal(); surge != "25%" {
+		t.Errorf("decoded maxSurge as %q", surge)
+	}
+	if err := k8sutil.Cordon(context.Background(), client, "n1", k8sutil.DryRun(nil)); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, request := range f.requests {
+		if !strings.HasSuffix(request, "?dryRun=All") {
+			t.Errorf("not a dry run: %s", request)
+		}
+	}
+	if len(f.requests) != 2 {
+		t.Errorf("got requests %q", f.requests)
+	}
+}
+
+// TestApplySetDryRun checks that an ApplySet with DryRun makes its
+// changes as dry runs, reports what they would have done, and doesn't
+// count them as synced.
+func TestApplySetDryRun(t *testing.T) {
+	server := newFakeAPIServer(t)
+	store := syncedWatchingStore(t, server, &corev1.ConfigMapList{})
+	a := &k8sutil.ApplySet{
+		Client: server.client(),
+		Store:  store,
+		Logger: testLogger{t},
+		Name:   "set",
+		DryRun: true,
+	}
+	desired := &corev1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String("a")},
+		Data:     map[string]string{"k": "v"},
+	}
+	if err := a.SetDesired(desired); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.drain()
+	a.Reconcile(context.Background(), snapshot)
+	status := a.Status()
+	if len(status) != 1 || status[0].Action != "created" || status[0].Synced || status[0].Result == nil {
+		t.Fatalf("got status %+v", status)
+	}
+	if name := status[0].Result.GetMetadata().GetName(); name != "a" {
+		t.Errorf("got the result %s", name)
+	}
+	var posted bool
+	for _, line := range server.drain() {
+		if strings.HasPrefix(line, "POST ") {
+			posted = true
+			if !strings.Contains(line, "?dryRun=All ") {
+				t.Errorf("not a dry run: %s", line)
+			}
+		}
+	}
+	if !posted {
+		t.Errorf("didn't try to create the ConfigMap")
+	}
+}
+
+func TestLabelAllDryRun(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(labeledConfigMap("default", "a", map[string]string{"app": "web"}))
+	store := syncedSnapshot(t, server, &corev1.ConfigMapList{})
+	server.drain()
+	n, err := k8sutil.LabelAll(context.Background(), server.client(), store, &corev1.ConfigMap{}, "",
+		func(_ k8s.Resource, labels, _ map[string]string) { labels["tier"] = "front" },
+		k8sutil.LabelOptions{DryRun: true})
+	if err != nil || n != 1 {
+		t.Fatalf("got %d, %v, want 1 resource patched", n, err)
+	}
+	for _, line := range server.drain() {
+		if strings.HasPrefix(line, "PATCH ") && !strings.Contains(line, "?dryRun=All ") {
+			t.Errorf("not a dry run: %s", line)
+		}
+	}
+}
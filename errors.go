@@ -0,0 +1,137 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// The errors that k8sutil returns and logs wrap these types (and the
+// *k8s.APIError that they come from, if any), so that callers can
+// branch on them with errors.Is and errors.As.
+
+// ErrNotSynced is returned when the store is asked for before it has
+// completed its initial listing.
+var ErrNotSynced = errors.New("store has not synced")
+
+// ErrWatchExpired is what a "410 Gone" response to a watch is: the
+// resourceVersion that it started from is too old, and the watch must
+// re-list.
+var ErrWatchExpired = errors.New("watch expired")
+
+// A GroupVersionResource identifies a type of resource by its API
+// group, version, and (plural, lower-case) resource name.
+type GroupVersionResource struct {
+	Group    string
+	Version  string
+	Resource string
+}
+
+// String returns the GroupVersionResource as "resource.version.group",
+// as kubectl shows it.
+func (gvr GroupVersionResource) String() string {
+	if gvr.Group == "" {
+		return gvr.Resource + "." + gvr.Version
+	}
+	return gvr.Resource + "." + gvr.Version + "." + gvr.Group
+}
+
+// GroupVersionResource returns the resource's GroupVersionResource.
+func (r APIResource) GroupVersionResource() GroupVersionResource {
+	return GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Name}
+}
+
+// A PermissionError is a lack of permission to perform the verb on the
+// resource; Err is the "403 Forbidden" response, if there was one.
+type PermissionError struct {
+	Verb      string
+	GVR       GroupVersionResource
+	Namespace string // or k8s.AllNamespaces
+	Err       error
+}
+
+func (e *PermissionError) Error() string {
+	msg := fmt.Sprintf("not permitted to %s %s", e.Verb, e.GVR)
+	if e.Namespace != k8s.AllNamespaces {
+		msg += fmt.Sprintf(" in namespace %q", e.Namespace)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+// A TooManyRequestsError is a "429 Too Many Requests" response, asking
+// the client to wait for RetryAfter before trying again.
+type TooManyRequestsError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *TooManyRequestsError) Error() string {
+	return fmt.Sprintf("too many requests (retry after %v): %v", e.RetryAfter, e.Err)
+}
+
+func (e *TooManyRequestsError) Unwrap() error {
+	return e.Err
+}
+
+// expiredError is an error that is ErrWatchExpired, but that also
+// wraps the response that said so.
+type expiredError struct {
+	err error
+}
+
+func (e *expiredError) Error() string {
+	return ErrWatchExpired.Error() + ": " + e.err.Error()
+}
+
+func (e *expiredError) Unwrap() error {
+	return e.err
+}
+
+func (e *expiredError) Is(target error) bool {
+	return target == ErrWatchExpired
+}
+
+// apiErrorCode returns the HTTP status code of the *k8s.APIError that
+// err is or wraps, or 0.
+func apiErrorCode(err error) int {
+	var apiErr *k8s.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
+
+// classifyError wraps err, from attempting the verb on the resource in
+// the namespace, in the typed error that describes it, if there is
+// one.
+func classifyError(err error, verb string, gvr GroupVersionResource, namespace string) error {
+	var apiErr *k8s.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch apiErr.Code {
+	case http.StatusForbidden:
+		return &PermissionError{Verb: verb, GVR: gvr, Namespace: namespace, Err: err}
+	case http.StatusTooManyRequests:
+		d := defaultRetryAfter
+		if seconds := apiErr.Status.GetDetails().GetRetryAfterSeconds(); seconds > 0 {
+			d = time.Duration(seconds) * time.Second
+		}
+		return &TooManyRequestsError{RetryAfter: d, Err: err}
+	case http.StatusGone:
+		return &expiredError{err}
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+func TestClassifyError(t *testing.T) {
+	gvr := GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	apiError := func(code int, retryAfter int32) error {
+		status := &metav1.Status{Code: k8s.Int32(int32(code))}
+		if retryAfter != 0 {
+			status.Details = &metav1.StatusDetails{RetryAfterSeconds: k8s.Int32(retryAfter)}
+		}
+		return errors.Wrap(&k8s.APIError{Status: status, Code: code}, "list")
+	}
+
+	err := classifyError(apiError(http.StatusForbidden, 0), "list", gvr, "default")
+	var permErr *PermissionError
+	if !errors.As(err, &permErr) || permErr.Verb != "list" || permErr.GVR != gvr || permErr.Namespace != "default" {
+		t.Errorf("403: got %v", err)
+	}
+	if code := apiErrorCode(err); code != http.StatusForbidden {
+		t.Errorf("403: wraps code %d", code)
+	}
+
+	for seconds, want := range map[int32]time.Duration{0: defaultRetryAfter, 5: 5 * time.Second} {
+		err := classifyError(apiError(http.StatusTooManyRequests, seconds), "list", gvr, "default")
+		if d, ok := retryAfter(err); !ok || d != want {
+			t.Errorf("429 with retryAfterSeconds %d: got %v, %v", seconds, d, ok)
+		}
+	}
+
+	err = classifyError(apiError(http.StatusGone, 0), "watch", gvr, "default")
+	if !errors.Is(err, ErrWatchExpired) {
+		t.Errorf("410: got %v", err)
+	}
+
+	err = classifyError(apiError(http.StatusInternalServerError, 0), "list", gvr, "default")
+	if errors.Is(err, ErrWatchExpired) || errors.As(err, &permErr) {
+		t.Errorf("500: got %v", err)
+	}
+}
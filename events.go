@@ -0,0 +1,215 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+)
+
+// A Delta is one notification of changes to the store, as delivered by
+// Events.
+type Delta struct {
+	// Store is a snapshot of the whole store, as it would be
+	// passed to the Callback.
+	Store Store
+
+	// Changed is a sample of each type of resource that changed
+	// since the previous Delta, sorted by type name.
+	Changed []k8s.Resource
+
+	// ID is the correlation ID of the notification, that of the
+	// Store.
+	ID string
+}
+
+// An EventsPolicy says what Events does when its consumer falls behind,
+// and the buffer is full.
+type EventsPolicy int
+
+const (
+	// EventsDropOldest discards the oldest buffered Delta to make room.
+	// The types that it changed are lost from the subsequent
+	// Deltas' Changed, though not from their Stores.
+	EventsDropOldest EventsPolicy = iota
+
+	// EventsBlock makes Run wait until there is room, stalling the
+	// processing of events, as a slow Callback does.
+	EventsBlock
+
+	// EventsCoalesce merges the new Delta into the newest buffered one,
+	// so that nothing is lost but the intermediate Stores.
+	EventsCoalesce
+)
+
+// Events returns a channel of each notification of changes to the
+// store, for consumers who prefer a select loop to a Callback.  Up to
+// buffer Deltas (at least 1) are held for the consumer; the policy says
+// what happens when it falls behind, beyond that.  Deltas are sent
+// regardless of OnChange and OnSync, for every change to the store
+// after it is first synced, in addition to any callbacks.
+//
+// The channel is closed, once any buffered Deltas are received, when
+// Run returns.  The consumer must keep receiving until then; with the
+// EventsBlock policy, a consumer that stops stalls Run.  It is invalid to
+// call Events after Run has returned.
+func (w *WatchingStore) Events(buffer int, policy EventsPolicy) <-chan Delta {
+	return w.subscribe(buffer, policy).out
+}
+
+// subscribe adds a consumer of Events.
+func (w *WatchingStore) subscribe(buffer int, policy EventsPolicy) *subscription {
+	if buffer < 1 {
+		buffer = 1
+	}
+	sub := &subscription{
+		buffer: buffer,
+		policy: policy,
+		out:    make(chan Delta),
+		stop:   make(chan struct{}),
+		depth:  &w.metrics.queueDepth,
+	}
+	sub.cond = sync.NewCond(&sub.mu)
+	go sub.deliver()
+	w.mu.Lock()
+	w.subscriptions = append(w.subscriptions, sub)
+	w.mu.Unlock()
+	return sub
+}
+
+// unsubscribe removes a consumer of Events that has stopped receiving,
+// discarding anything buffered for it, and closes its channel.
+func (w *WatchingStore) unsubscribe(sub *subscription) {
+	w.mu.Lock()
+	subscriptions := make([]*subscription, 0, len(w.subscriptions))
+	for _, s := range w.subscriptions {
+		if s != sub {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	w.subscriptions = subscriptions
+	w.mu.Unlock()
+	close(sub.stop)
+	sub.close()
+}
+
+// A subscription queues Deltas for a consumer of Events.
+type subscription struct {
+	buffer int
+	policy EventsPolicy
+	out    chan Delta
+	stop   chan struct{} // closed when the consumer unsubscribes
+	depth  *histogram    // of the queue, as Deltas are queued
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signaled when queue or closed change
+	queue  []delta
+	closed bool
+}
+
+// A delta is a queued Delta, with its changes as a set, for coalescing.
+type delta struct {
+	store   Store
+	changed map[typeKey]k8s.Resource
+}
+
+// put queues a Delta, applying the policy if the queue is full.
+func (s *subscription) put(d delta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) >= s.buffer && !s.closed {
+		switch s.policy {
+		case EventsBlock:
+			s.cond.Wait()
+			continue
+		case EventsCoalesce:
+			last := &s.queue[len(s.queue)-1]
+			last.store = d.store
+			for key, sample := range d.changed {
+				last.changed[key] = sample
+			}
+			s.depth.observe(depthBuckets, float64(len(s.queue)))
+			return
+		default:
+			s.queue = s.queue[1:]
+		}
+	}
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, d)
+	s.depth.observe(depthBuckets, float64(len(s.queue)))
+	s.cond.Broadcast()
+}
+
+// close closes the channel once the queue is drained.
+func (s *subscription) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// deliver sends the queued Deltas to the consumer.
+func (s *subscription) deliver() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		d := s.queue[0]
+		s.queue = s.queue[1:]
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		select {
+		case s.out <- d.Delta():
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Delta returns the Delta to deliver.
+func (d delta) Delta() Delta {
+	ret := Delta{Store: d.store, ID: CorrelationID(d.store)}
+	for _, sample := range d.changed {
+		ret.Changed = append(ret.Changed, sample)
+	}
+	sort.Slice(ret.Changed, func(i, j int) bool {
+		return resourceTypeName(ret.Changed[i]) < resourceTypeName(ret.Changed[j])
+	})
+	return ret
+}
+
+// publish queues a Delta of the changes for each consumer of Events.
+func (w *WatchingStore) publish(changes changeSet, snap *snapshot) {
+	w.mu.Lock()
+	subscriptions := w.subscriptions
+	w.mu.Unlock()
+	for _, sub := range subscriptions {
+		d := delta{store: snap, changed: make(map[typeKey]k8s.Resource, len(changes))}
+		for key := range changes {
+			if types, ok := w.store.types[key]; ok {
+				d.changed[key] = types.sample
+			}
+		}
+		sub.put(d)
+	}
+}
+
+// closeSubscriptions closes the channels returned by Events.
+func (w *WatchingStore) closeSubscriptions() {
+	w.mu.Lock()
+	subscriptions := w.subscriptions
+	w.mu.Unlock()
+	for _, sub := range subscriptions {
+		sub.close()
+	}
+}
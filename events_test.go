@@ -0,0 +1,104 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+)
+
+// newTestSubscription returns a subscription that isn't delivering, so
+// that its queue can be inspected.
+func newTestSubscription(buffer int, policy EventsPolicy) *subscription {
+	sub := &subscription{buffer: buffer, policy: policy, out: make(chan Delta), depth: new(histogram)}
+	sub.cond = sync.NewCond(&sub.mu)
+	return sub
+}
+
+// changed returns a delta of changes to the samples' types, with the
+// store named by its sequence.
+func changed(sequence uint64, samples ...k8s.Resource) delta {
+	d := delta{store: &snapshot{sequence: sequence}, changed: map[typeKey]k8s.Resource{}}
+	for _, sample := range samples {
+		d.changed[typeKeyOf(sample)] = sample
+	}
+	return d
+}
+
+// queued returns the sequences and changed types of the queued deltas.
+func queued(sub *subscription) (sequences []uint64, types [][]string) {
+	for _, d := range sub.queue {
+		sequences = append(sequences, d.store.Sequence())
+		var names []string
+		for _, sample := range d.Delta().Changed {
+			names = append(names, resourceTypeName(sample))
+		}
+		types = append(types, names)
+	}
+	return sequences, types
+}
+
+func TestEventsDropOldest(t *testing.T) {
+	sub := newTestSubscription(2, EventsDropOldest)
+	sub.put(changed(1, &corev1.ConfigMap{}))
+	sub.put(changed(2, &corev1.Namespace{}))
+	sub.put(changed(3, &corev1.Pod{}))
+	sequences, _ := queued(sub)
+	if want := []uint64{2, 3}; !reflect.DeepEqual(sequences, want) {
+		t.Errorf("queued %v, want %v", sequences, want)
+	}
+}
+
+func TestEventsCoalesce(t *testing.T) {
+	sub := newTestSubscription(1, EventsCoalesce)
+	sub.put(changed(1, &corev1.ConfigMap{}))
+	sub.put(changed(2, &corev1.Namespace{}))
+	sequences, types := queued(sub)
+	if want := []uint64{2}; !reflect.DeepEqual(sequences, want) {
+		t.Errorf("queued %v, want %v", sequences, want)
+	}
+	if want := [][]string{{"v1 ConfigMap", "v1 Namespace"}}; !reflect.DeepEqual(types, want) {
+		t.Errorf("queued changes to %v, want %v", types, want)
+	}
+}
+
+func TestEventsBlock(t *testing.T) {
+	sub := newTestSubscription(1, EventsBlock)
+	sub.put(changed(1, &corev1.ConfigMap{}))
+	put := make(chan struct{})
+	go func() {
+		sub.put(changed(2, &corev1.ConfigMap{}))
+		close(put)
+	}()
+	go sub.deliver()
+	for sequence := uint64(1); sequence <= 2; sequence++ {
+		if d := <-sub.out; d.Store.Sequence() != sequence {
+			t.Errorf("got store %d, want %d", d.Store.Sequence(), sequence)
+		}
+	}
+	<-put
+	sub.close()
+	if _, ok := <-sub.out; ok {
+		t.Errorf("delivered after closing")
+	}
+}
+
+// TestEventsQueueDepth checks that the depth of the queue is observed
+// as each Delta is queued.
+func TestEventsQueueDepth(t *testing.T) {
+	sub := newTestSubscription(2, EventsDropOldest)
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		sub.put(changed(sequence, &corev1.ConfigMap{}))
+	}
+	h := sub.depth.snapshot(depthBuckets)
+	if h.Count != 3 || h.Sum != 5 {
+		t.Errorf("got %d observations summing to %v, want 3 summing to 5", h.Count, h.Sum)
+	}
+	if want := []uint64{0, 1, 3, 3, 3, 3, 3, 3, 3}; !reflect.DeepEqual(h.Counts, want) {
+		t.Errorf("got bucket counts %v, want %v", h.Counts, want)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestEverythingFilter(t *testing.T) {
+	deployments := k8sutil.APIResource{Group: "apps", Version: "v1", Name: "deployments"}
+	pods := k8sutil.APIResource{Version: "v1", Name: "pods"}
+	tests := []struct {
+		filter      k8sutil.EverythingFilter
+		deployments bool
+		pods        bool
+	}{
+		{k8sutil.EverythingFilter{}, true, true},
+		{k8sutil.EverythingFilter{Include: []string{"*.apps"}}, true, false},
+		{k8sutil.EverythingFilter{Include: []string{"pods"}}, false, true},
+		{k8sutil.EverythingFilter{Exclude: []string{"deployments.*"}}, false, true},
+		{k8sutil.EverythingFilter{Include: []string{"*"}, Exclude: []string{"pods"}}, true, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Matches(deployments); got != test.deployments {
+			t.Errorf("%+v: deployments: got %v", test.filter, got)
+		}
+		if got := test.filter.Matches(pods); got != test.pods {
+			t.Errorf("%+v: pods: got %v", test.filter, got)
+		}
+	}
+}
+
+// TestWatchEverything checks that AddWatchEverything watches the
+// discovered resource types that the filter selects, as Unstructured.
+func TestWatchEverything(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.setUnavailable("metrics.k8s.io/v1beta1")
+	server.set(newConfigMap("default", "a", "k", "v"))
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("default")}})
+	stores := make(chan k8sutil.Store, 100)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatchEverything(k8s.AllNamespaces, k8sutil.EverythingFilter{Exclude: []string{"namespaces"}})
+	runStore(t, w)
+
+	server.await("watch")
+	server.set(newConfigMap("default", "b"))
+	deadline := time.After(timeout)
+	for {
+		var store k8sutil.Store
+		select {
+		case store = <-stores:
+		case <-deadline:
+			t.Fatal("timed out waiting for configmap b")
+		}
+		if n := len(store.List(k8sutil.NewUnstructured("v1", "Namespace"))); n != 0 {
+			t.Fatalf("stored %d excluded namespaces", n)
+		}
+		configMaps := store.List(k8sutil.NewUnstructured("v1", "ConfigMap"))
+		if len(configMaps) < 2 {
+			continue
+		}
+		byName := map[string]*k8sutil.Unstructured{}
+		for _, r := range configMaps {
+			byName[r.GetMetadata().GetName()] = r.(*k8sutil.Unstructured)
+		}
+		if len(byName) != 2 || byName["a"] == nil || byName["b"] == nil {
+			t.Fatalf("got configmaps %v", byName)
+		}
+		if data, _ := byName["a"].Object["data"].(map[string]interface{}); data["k"] != "v" {
+			t.Errorf("got configmap a %v", byName["a"].Object)
+		}
+		break
+	}
+}
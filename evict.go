@@ -0,0 +1,174 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// limits bound the number of stored resources of one type.  A zero
+// value means no limit.
+type limits struct {
+	maxObjects int
+	maxAge     time.Duration
+	ttl        time.Duration
+}
+
+// merge returns the stricter of each of the limits.
+func (l limits) merge(other limits) limits {
+	if other.maxObjects > 0 && (l.maxObjects == 0 || other.maxObjects < l.maxObjects) {
+		l.maxObjects = other.maxObjects
+	}
+	if other.maxAge > 0 && (l.maxAge == 0 || other.maxAge < l.maxAge) {
+		l.maxAge = other.maxAge
+	}
+	if other.ttl > 0 && (l.ttl == 0 || other.ttl < l.ttl) {
+		l.ttl = other.ttl
+	}
+	return l
+}
+
+// timed returns whether enforcing the limits requires checking the
+// store periodically.
+func (l limits) timed() bool {
+	return l.maxAge > 0 || l.ttl > 0
+}
+
+// evictionInterval is how often the store is checked for resources
+// that have outlived a time-based limit.
+const evictionInterval = 1 * time.Second
+
+// MaxObjects is a WatchOption that caps the number of resources of
+// the watched type that the store keeps, for high-churn types such as
+// corev1.Event.  Once there are more than n, the resources that were
+// least recently added or modified are evicted.  An evicted resource
+// was present in the Store passed to previous Callbacks; it is passed
+// to the WatchingStore's OnEvict, and then the Callback that follows its
+// eviction no longer has it.
+//
+// If several watches of the same type set a limit, the lowest one
+// applies.
+func MaxObjects(n int) WatchOption {
+	return func(w *watch) {
+		w.limits.maxObjects = n
+	}
+}
+
+// MaxAge is a WatchOption that evicts resources of the watched type
+// once their creationTimestamp is more than d in the past.  As with
+// MaxObjects, evicted resources are passed to OnEvict, and eviction is
+// followed by a Callback.
+func MaxAge(d time.Duration) WatchOption {
+	return func(w *watch) {
+		w.limits.maxAge = d
+	}
+}
+
+// TTL is a WatchOption that evicts resources of the watched type that
+// haven't been refreshed, by an event or a re-list that includes them,
+// for d.  This makes the Store a view of what has been seen recently,
+// rather than a mirror of everything that exists.  Evicted resources
+// are passed to OnEvict, and eviction is followed by a Callback, just as
+// if the resource had been deleted.
+func TTL(d time.Duration) WatchOption {
+	return func(w *watch) {
+		w.limits.ttl = d
+	}
+}
+
+// creationTime returns the resource's creationTimestamp.
+func creationTime(resource k8s.Resource) time.Time {
+	ts := resource.GetMetadata().GetCreationTimestamp()
+	if ts == nil {
+		return time.Time{}
+	}
+	return time.Unix(ts.GetSeconds(), int64(ts.GetNanos()))
+}
+
+// expired returns whether the entry has outlived the time-based
+// limits.
+func (l limits) expired(e *entry, now time.Time) bool {
+	if l.maxAge > 0 && now.Sub(e.created) > l.maxAge {
+		return true
+	}
+	return l.ttl > 0 && now.Sub(e.refreshed) > l.ttl
+}
+
+// refresh notes that the stored resource of the given type and UID was
+// seen again, unchanged.
+func (s *resourceStore) refresh(key typeKey, uid string) {
+	if e := s.types[key].get(uid); e != nil {
+		e.refreshed = s.clock.Now()
+	}
+}
+
+// touch marks the entry, for the given UID, as the most recently
+// stored.
+func (t *typeStore) touch(uid string, e *entry, old *entry) {
+	if old != nil {
+		e.elem = old.elem
+		t.order.MoveToFront(e.elem)
+	} else {
+		e.elem = t.order.PushFront(uid)
+	}
+}
+
+// evictExcess evicts the least recently stored resources over the
+// type's maxObjects, returning whether there were any.
+func (s *resourceStore) evictExcess(t *typeStore) bool {
+	if t.limits.maxObjects <= 0 {
+		return false
+	}
+	evicted := false
+	for t.order.Len() > t.limits.maxObjects {
+		oldest := t.order.Back()
+		s.evict(t, oldest.Value.(string))
+		evicted = true
+	}
+	return evicted
+}
+
+// evict removes the resource of the given UID from the typeStore,
+// keeping it to be passed to OnEvict.
+func (s *resourceStore) evict(t *typeStore, uid string) {
+	e := t.remove(uid)
+	if e == nil {
+		return
+	}
+	if resource := e.decode(t.sample, s.lazy); resource != nil {
+		s.evicted = append(s.evicted, resource)
+	}
+	t.order.Remove(e.elem)
+}
+
+// takeEvicted returns the resources evicted since it was last called.
+func (s *resourceStore) takeEvicted() []k8s.Resource {
+	evicted := s.evicted
+	s.evicted = nil
+	return evicted
+}
+
+// expire evicts resources that have outlived the time-based limits,
+// returning the types that it evicted any from.
+func (s *resourceStore) expire(now time.Time) []typeKey {
+	var changed []typeKey
+	for key, t := range s.types {
+		if !t.limits.timed() {
+			continue
+		}
+		for elem := t.order.Back(); elem != nil; {
+			prev := elem.Prev()
+			uid := elem.Value.(string)
+			if e := t.get(uid); e != nil && t.limits.expired(e, now) {
+				s.evict(t, uid)
+				if len(changed) == 0 || changed[len(changed)-1] != key {
+					changed = append(changed, key)
+				}
+			}
+			elem = prev
+		}
+	}
+	return changed
+}
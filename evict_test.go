@@ -0,0 +1,143 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// names returns the sorted names of the resources.
+func names(resources []k8s.Resource) []string {
+	var ret []string
+	for _, resource := range resources {
+		ret = append(ret, resource.GetMetadata().GetName())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// TestMaxObjects checks that MaxObjects evicts the least recently stored
+// resources, passing them to OnEvict before the Callback without them.
+func TestMaxObjects(t *testing.T) {
+	server := newFakeAPIServer(t)
+	for _, name := range []string{"a", "b", "c"} {
+		server.set(newConfigMap("default", name))
+	}
+	events := make(chan []string, 10)
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: testLogger{t},
+		Callback: func(s k8sutil.Store) {
+			events <- append([]string{"callback"}, names(s.List(&corev1.ConfigMap{}))...)
+		},
+		OnEvict: func(evicted []k8s.Resource) {
+			events <- append([]string{"evict"}, names(evicted)...)
+		},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.MaxObjects(2))
+	runStore(t, w)
+
+	expect := func(want ...string) {
+		t.Helper()
+		if got := <-events; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	expect("evict", "a")
+	expect("callback", "b", "c")
+
+	server.set(newConfigMap("default", "b", "k", "v"))
+	expect("callback", "b", "c")
+	server.set(newConfigMap("default", "d"))
+	expect("evict", "c")
+	expect("callback", "b", "d")
+}
+
+// TestMaxAge checks that MaxAge evicts resources created too long ago.
+func TestMaxAge(t *testing.T) {
+	server := newFakeAPIServer(t)
+	for name, age := range map[string]time.Duration{"old": time.Hour, "new": 0} {
+		cm := newConfigMap("default", name)
+		seconds := time.Now().Add(-age).Unix()
+		cm.Metadata.CreationTimestamp = &metav1.Time{Seconds: &seconds}
+		server.set(cm)
+	}
+	events := make(chan []string, 10)
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: testLogger{t},
+		Callback: func(s k8sutil.Store) {
+			events <- append([]string{"callback"}, names(s.List(&corev1.ConfigMap{}))...)
+		},
+		OnEvict: func(evicted []k8s.Resource) {
+			events <- append([]string{"evict"}, names(evicted)...)
+		},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.MaxAge(time.Minute))
+	runStore(t, w)
+
+	for _, want := range [][]string{
+		{"callback", "new", "old"},
+		{"evict", "old"},
+		{"callback", "new"},
+	} {
+		select {
+		case got := <-events:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+}
+
+// TestTTL checks that TTL evicts resources that haven't been seen for
+// that long.
+func TestTTL(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	server.set(newConfigMap("default", "b"))
+	events := make(chan []string, 10)
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: testLogger{t},
+		Callback: func(s k8sutil.Store) {
+			events <- append([]string{"callback"}, names(s.List(&corev1.ConfigMap{}))...)
+		},
+		OnEvict: func(evicted []k8s.Resource) {
+			events <- append([]string{"evict"}, names(evicted)...)
+		},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.TTL(1500*time.Millisecond))
+	runStore(t, w)
+
+	expect := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("timed out waiting for %v", want)
+		}
+	}
+	expect("callback", "a", "b")
+	time.Sleep(700 * time.Millisecond)
+	server.set(newConfigMap("default", "b", "k", "v"))
+	expect("callback", "a", "b")
+	expect("evict", "a")
+	expect("callback", "b")
+	expect("evict", "b")
+	expect("callback")
+}
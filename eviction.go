@@ -0,0 +1,109 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// EvictOptions are the options of Evict.
+type EvictOptions struct {
+	// GracePeriod, if positive, overrides the pod's termination
+	// grace period.
+	GracePeriod time.Duration
+
+	// UID, if set, is a precondition: the eviction fails with "409
+	// Conflict" if the pod of the name has a different UID, because
+	// it has been replaced since it was seen.
+	UID string
+
+	// DryRun checks whether the pod could be evicted, without
+	// evicting it.
+	DryRun bool
+}
+
+// A DisruptionBudgetError is the refusal of an eviction because it
+// would violate a PodDisruptionBudget, for now: once enough of the
+// pods that the budget covers are ready again, the eviction will be
+// allowed.  It wraps the "429 Too Many Requests" *k8s.APIError of the
+// refusal.
+type DisruptionBudgetError struct {
+	Pod ObjectKey
+
+	// RetryAfter is how long the apiserver suggests waiting before
+	// retrying.
+	RetryAfter time.Duration
+
+	Err error
+}
+
+func (e *DisruptionBudgetError) Error() string {
+	return fmt.Sprintf("evict pod %s: blocked by a disruption budget, retry after %v: %v", e.Pod, e.RetryAfter, e.Err)
+}
+
+func (e *DisruptionBudgetError) Unwrap() error {
+	return e.Err
+}
+
+// defaultEvictionRetryAfter is the RetryAfter of a DisruptionBudgetError
+// if the apiserver doesn't give one, as it doesn't for budgets; it is
+// how often "kubectl drain" retries.
+const defaultEvictionRetryAfter = 5 * time.Second
+
+// evictionGVR is the subresource that evictions are created in, for
+// PermissionErrors.
+var evictionGVR = GroupVersionResource{Version: "v1", Resource: "pods/eviction"}
+
+// Evict asks for a pod to be evicted, with the Eviction API, as "kubectl
+// drain" does: unlike deleting it, eviction respects
+// PodDisruptionBudgets.  It returns a *DisruptionBudgetError if a
+// budget refuses the eviction, which is worth retrying after its
+// RetryAfter, and a *PermissionError if the client may not evict the
+// pod.  Other refusals, such as "404 Not Found" if the pod is gone, or
+// "500 Internal Server Error" if the pod is covered by more than one
+// budget, are returned as the *k8s.APIError of the response.
+func Evict(ctx context.Context, client *k8s.Client, pod ObjectKey, options EvictOptions) error {
+	deleteOptions := map[string]interface{}{}
+	if options.GracePeriod > 0 {
+		deleteOptions["gracePeriodSeconds"] = int64(options.GracePeriod / time.Second)
+	}
+	if options.UID != "" {
+		deleteOptions["preconditions"] = map[string]interface{}{"uid": options.UID}
+	}
+	if options.DryRun {
+		deleteOptions["dryRun"] = []string{"All"}
+	}
+	eviction := map[string]interface{}{
+		"apiVersion": "policy/v1",
+		"kind":       "Eviction",
+		"metadata": map[string]interface{}{
+			"namespace": pod.Namespace,
+			"name":      pod.Name,
+		},
+		"deleteOptions": deleteOptions,
+	}
+	err := doJSON(ctx, client, request{
+		verb: http.MethodPost,
+		path: "/api/v1/namespaces/" + url.PathEscape(pod.Namespace) + "/pods/" + url.PathEscape(pod.Name) + "/eviction",
+	}, eviction, nil)
+	if err == nil {
+		return nil
+	}
+	if apiErrorCode(err) == http.StatusTooManyRequests {
+		retryAfter := defaultEvictionRetryAfter
+		var apiErr *k8s.APIError
+		errors.As(err, &apiErr)
+		if seconds := apiErr.Status.GetDetails().GetRetryAfterSeconds(); seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return &DisruptionBudgetError{Pod: pod, RetryAfter: retryAfter, Err: err}
+	}
+	return errors.Wrapf(classifyError(err, "create", evictionGVR, pod.Namespace), "evict pod %s", pod)
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestEvict(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := &metav1.Status{Status: k8s.String("Failure")}
+		switch strings.Split(r.URL.Path, "/")[6] {
+		case "budgeted":
+			status.Code = k8s.Int32(http.StatusTooManyRequests)
+			status.Details = &metav1.StatusDetails{RetryAfterSeconds: k8s.Int32(10)}
+		case "unbudgeted":
+			status.Code = k8s.Int32(http.StatusTooManyRequests)
+		case "forbidden":
+			status.Code = k8s.Int32(http.StatusForbidden)
+		case "gone":
+			status.Code = k8s.Int32(http.StatusNotFound)
+		default:
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+			writeJSON(w, http.StatusCreated, json.RawMessage(data))
+			return
+		}
+		writeJSON(w, int(status.GetCode()), status)
+	}))
+	defer server.Close()
+	client := &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+	evict := func(name string, options k8sutil.EvictOptions) error {
+		return k8sutil.Evict(context.Background(), client, k8sutil.ObjectKey{Namespace: "default", Name: name}, options)
+	}
+
+	if err := evict("web", k8sutil.EvictOptions{UID: "1234", GracePeriod: 10 * time.Second, DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"apiVersion":"policy/v1","deleteOptions":{"dryRun":["All"],"gracePeriodSeconds":10,"preconditions":{"uid":"1234"}},"kind":"Eviction","metadata":{"name":"web","namespace":"default"}}`
+	if body != want {
+		t.Errorf("sent %s, want %s", body, want)
+	}
+
+	for name, retryAfter := range map[string]time.Duration{"budgeted": 10 * time.Second, "unbudgeted": 5 * time.Second} {
+		var budgetErr *k8sutil.DisruptionBudgetError
+		if err := evict(name, k8sutil.EvictOptions{}); !errors.As(err, &budgetErr) || budgetErr.RetryAfter != retryAfter || budgetErr.Pod.Name != name {
+			t.Errorf("%s: got %v, want a retry after %v", name, err, retryAfter)
+		}
+	}
+	var permErr *k8sutil.PermissionError
+	if err := evict("forbidden", k8sutil.EvictOptions{}); !errors.As(err, &permErr) || permErr.Verb != "create" {
+		t.Errorf("got %v, want a PermissionError", err)
+	}
+	var apiErr *k8s.APIError
+	if err := evict("gone", k8sutil.EvictOptions{}); !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		t.Errorf("got %v, want a 404", err)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+// ExecStreams are the standard streams of a command run by Exec.  A nil
+// stream isn't attached.
+type ExecStreams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer // ignored with TTY, which merges it in to Stdout
+
+	// TTY allocates a terminal for the command.
+	TTY bool
+
+	// Resize, if set with TTY, sends the size of the terminal; send
+	// the initial size first.
+	Resize <-chan TerminalSize
+}
+
+// A TerminalSize is the size of a terminal, in characters.
+type TerminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// An ExitError is the non-zero exit status of a command run by Exec.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("command terminated with exit code %d", e.Code)
+}
+
+// The channels of the Kubernetes streaming protocol; each message
+// starts with the channel that it is for.
+const (
+	execStdin  = 0
+	execStdout = 1
+	execStderr = 2
+	execStatus = 3
+	execResize = 4
+	execClose  = 255 // v5: closes the channel in the next byte
+)
+
+// execProtocols are the versions of the streaming protocol that Exec
+// speaks, most preferred first.
+var execProtocols = []string{"v5.channel.k8s.io", "v4.channel.k8s.io"}
+
+// Exec runs a command in a container of a pod, as "kubectl exec" does,
+// and returns once it has exited and its output has been copied.  The
+// container may be "" if the pod has only one.  It returns an
+// *ExitError if the command exits with a non-zero status.
+//
+// Exec speaks the WebSocket flavor of the streaming protocol, through
+// the client's own transport, rather than the SPDY flavor, which would
+// need a multiplexer that isn't in the standard library.  Against an
+// apiserver older than 1.30, which doesn't speak version 5 of the
+// protocol, the command can't be sent the end of Stdin, so a command
+// that reads its input to the end will never exit; end it by
+// cancelling the Context.
+func Exec(ctx context.Context, client *k8s.Client, namespace, pod, container string, cmd []string, streams ExecStreams) error {
+	if len(cmd) == 0 {
+		return errors.New("exec: no command")
+	}
+	query := url.Values{"command": cmd}
+	if container != "" {
+		query.Set("container", container)
+	}
+	if streams.Stdin != nil {
+		query.Set("stdin", "true")
+	}
+	if streams.Stdout != nil {
+		query.Set("stdout", "true")
+	}
+	if streams.Stderr != nil && !streams.TTY {
+		query.Set("stderr", "true")
+	}
+	if streams.TTY {
+		query.Set("tty", "true")
+	}
+	conn, protocol, err := dialWebSocket(ctx, client, request{
+		verb:  http.MethodGet,
+		path:  "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods/" + url.PathEscape(pod) + "/exec",
+		query: query,
+	}, execProtocols)
+	if err != nil {
+		return errors.Wrapf(err, "exec in %s/%s", namespace, pod)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if streams.Stdin != nil {
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := streams.Stdin.Read(buf[1:])
+				if n > 0 {
+					buf[0] = execStdin
+					if conn.WriteMessage(buf[:1+n]) != nil {
+						return
+					}
+				}
+				if err != nil {
+					if protocol == execProtocols[0] {
+						_ = conn.WriteMessage([]byte{execClose, execStdin})
+					}
+					return
+				}
+			}
+		}()
+	}
+	if streams.TTY && streams.Resize != nil {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case size := <-streams.Resize:
+					data, _ := json.Marshal(size)
+					if conn.WriteMessage(append([]byte{execResize}, data...)) != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err == io.EOF {
+			return errors.Errorf("exec in %s/%s: connection closed without an exit status", namespace, pod)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrapf(err, "exec in %s/%s", namespace, pod)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		var w io.Writer
+		switch msg[0] {
+		case execStdout:
+			w = streams.Stdout
+		case execStderr:
+			w = streams.Stderr
+		case execStatus:
+			return execStatusError(msg[1:])
+		}
+		if w != nil && len(msg) > 1 {
+			if _, err := w.Write(msg[1:]); err != nil {
+				return errors.Wrap(err, "write output")
+			}
+		}
+	}
+}
+
+// execStatusError returns the error of the Status that ends an exec,
+// or nil if it succeeded.
+func execStatusError(data []byte) error {
+	var status metav1.Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return errors.Wrap(err, "decode exec status")
+	}
+	if status.GetStatus() == "Success" {
+		return nil
+	}
+	if status.GetReason() == "NonZeroExitCode" {
+		for _, cause := range status.GetDetails().GetCauses() {
+			if cause.GetReason() == "ExitCode" {
+				if code, err := strconv.Atoi(cause.GetMessage()); err == nil {
+					return &ExitError{Code: code}
+				}
+			}
+		}
+	}
+	return &k8s.APIError{Status: &status, Code: int(status.GetCode())}
+}
+
+// A webSocket is the client end of a WebSocket connection, which sends
+// and receives binary messages.
+type webSocket struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+
+	mu sync.Mutex // serializes writes
+}
+
+// webSocketGUID is the key of the Sec-WebSocket-Accept header, from RFC
+// 6455.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// dialWebSocket upgrades the request to a WebSocket connection,
+// speaking one of the subprotocols, which it returns.  A response other
+// than "101 Switching Protocols" is returned as a *k8s.APIError.
+func dialWebSocket(ctx context.Context, client *k8s.Client, r request, protocols []string) (*webSocket, string, error) {
+	req, err := newRequest(ctx, client, r)
+	if err != nil {
+		return nil, "", err
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, "", errors.Wrap(err, "generate key")
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	// The http.Transport falls back to HTTP/1.1 for an upgrade, and
+	// returns the connection as the body of the response.
+	resp, err := httpClientOf(client).Do(req)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "performing request")
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		return nil, "", newAPIError(resp)
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, "", errors.New("upgraded connection isn't writable")
+	}
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, "", errors.New("invalid Sec-WebSocket-Accept")
+	}
+	protocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if !containsString(protocols, protocol) {
+		conn.Close()
+		return nil, "", errors.Errorf("unsupported WebSocket protocol %q", protocol)
+	}
+	return &webSocket{conn: conn, r: bufio.NewReader(conn)}, protocol, nil
+}
+
+// The opcodes of WebSocket frames.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WriteMessage sends a binary message.
+func (ws *webSocket) WriteMessage(msg []byte) error {
+	return ws.writeFrame(wsBinary, msg)
+}
+
+// writeFrame sends a final frame, masked, as a client must.
+func (ws *webSocket) writeFrame(opcode byte, payload []byte) error {
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = 0x80 | byte(n)
+	case n <= 0xFFFF:
+		header[1] = 0x80 | 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 0x80 | 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	header = append(header, mask[:]...)
+	frame := append(header, payload...)
+	for i := range payload {
+		frame[len(header)+i] ^= mask[i%4]
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// ReadMessage returns the next text or binary message, answering pings
+// along the way.  It returns io.EOF once the server closes the
+// connection.
+func (ws *webSocket) ReadMessage() ([]byte, error) {
+	var msg []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsClose:
+			_ = ws.writeFrame(wsClose, nil)
+			return nil, io.EOF
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsText, wsBinary, wsContinuation:
+			msg = append(msg, payload...)
+		default:
+			return nil, errors.Errorf("unknown WebSocket opcode %#x", opcode)
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+// readFrame reads a frame.
+func (ws *webSocket) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0F
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 64<<20 {
+		return false, 0, nil, errors.Errorf("WebSocket frame of %d bytes is too large", n)
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// Close closes the connection, without the closing handshake.
+func (ws *webSocket) Close() error {
+	return ws.conn.Close()
+}
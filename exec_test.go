@@ -0,0 +1,172 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+)
+
+// A fakeExecConn is the server end of an exec's WebSocket connection.
+type fakeExecConn struct {
+	r *bufio.Reader
+	w *bufio.ReadWriter
+}
+
+// read returns the payload of the next message from the client, which
+// must be masked.
+func (c *fakeExecConn) read() ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return nil, errors.New("unmasked frame")
+	}
+	n := int(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		return nil, errors.New("frame too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return payload, nil
+}
+
+// write sends a binary message on the channel, unmasked, as a server
+// does.
+func (c *fakeExecConn) write(channel byte, data []byte) {
+	payload := append([]byte{channel}, data...)
+	c.w.Write([]byte{0x82, byte(len(payload))})
+	c.w.Write(payload)
+	c.w.Flush()
+}
+
+// writeStatus ends the exec with the Status.
+func (c *fakeExecConn) writeStatus(status *metav1.Status) {
+	data, _ := json.Marshal(status)
+	c.write(3, data)
+}
+
+// newFakeStream returns a client of a server that upgrades requests of
+// the subresource of the pod default/web to WebSocket connections of
+// the protocol, and serves each with run, as it does exec'd commands.
+func newFakeStream(t *testing.T, subresource, protocol string, run func(query map[string][]string, c *fakeExecConn)) *k8s.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/pods/web/"+subresource {
+			writeJSON(w, http.StatusNotFound, &metav1.Status{Status: k8s.String("Failure"), Reason: k8s.String("NotFound"), Code: k8s.Int32(404)})
+			return
+		}
+		if r.Header.Get("Upgrade") != "websocket" || !strings.Contains(r.Header.Get("Sec-WebSocket-Protocol"), protocol) {
+			t.Errorf("got headers %v", r.Header)
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n" +
+			"Sec-WebSocket-Protocol: " + protocol + "\r\n\r\n")
+		rw.Flush()
+		run(r.URL.Query(), &fakeExecConn{r: rw.Reader, w: rw})
+	}))
+	t.Cleanup(server.Close)
+	return &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+}
+
+// TestExec checks that Exec sends the command's input, and the end of
+// it, and copies its output, until it exits.
+func TestExec(t *testing.T) {
+	client := newFakeStream(t, "exec", "v5.channel.k8s.io", func(query map[string][]string, c *fakeExecConn) {
+		if got := strings.Join(query["command"], " "); got != "tr a-z A-Z" {
+			t.Errorf("got command %q", got)
+		}
+		// Echo stdin until it is closed.
+		for {
+			msg, err := c.read()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if bytes.Equal(msg, []byte{255, 0}) {
+				break
+			}
+			if msg[0] != 0 {
+				t.Errorf("got message %q", msg)
+				continue
+			}
+			c.write(1, bytes.ToUpper(msg[1:]))
+		}
+		c.write(2, []byte("done\n"))
+		c.writeStatus(&metav1.Status{Status: k8s.String("Success")})
+	})
+	var stdout, stderr bytes.Buffer
+	err := k8sutil.Exec(context.Background(), client, "default", "web", "", []string{"tr", "a-z", "A-Z"}, k8sutil.ExecStreams{
+		Stdin:  strings.NewReader("hello"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil || stdout.String() != "HELLO" || stderr.String() != "done\n" {
+		t.Errorf("got %v, stdout %q, stderr %q", err, stdout.String(), stderr.String())
+	}
+}
+
+func TestExecExitCode(t *testing.T) {
+	client := newFakeStream(t, "exec", "v4.channel.k8s.io", func(query map[string][]string, c *fakeExecConn) {
+		c.writeStatus(&metav1.Status{
+			Status: k8s.String("Failure"),
+			Reason: k8s.String("NonZeroExitCode"),
+			Details: &metav1.StatusDetails{Causes: []*metav1.StatusCause{
+				{Reason: k8s.String("ExitCode"), Message: k8s.String("3")},
+			}},
+		})
+	})
+	err := k8sutil.Exec(context.Background(), client, "default", "web", "app", []string{"false"}, k8sutil.ExecStreams{})
+	var exitErr *k8sutil.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Errorf("got %v", err)
+	}
+
+	err = k8sutil.Exec(context.Background(), client, "default", "missing", "", []string{"true"}, k8sutil.ExecStreams{})
+	var apiErr *k8s.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+		t.Errorf("got %v", err)
+	}
+	if err := k8sutil.Exec(context.Background(), client, "default", "web", "", nil, k8sutil.ExecStreams{}); err == nil {
+		t.Error("ran no command")
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+)
+
+// A StateMetric is a Prometheus gauge computed from the contents of
+// the store, as opposed to a metric about the WatchingStore itself.
+type StateMetric struct {
+	Name   string   // e.g. "k8sutil_pods"
+	Help   string   // the metric's HELP text
+	Labels []string // the names of the labels of each sample
+
+	// Collect returns the samples of the metric.  It is called
+	// with each Store that the exporter is updated with.
+	Collect func(Store) []StateSample
+}
+
+// A StateSample is one sample of a StateMetric: its label values, in
+// the order of the StateMetric's Labels, and the value.
+type StateSample struct {
+	Labels []string
+	Value  float64
+}
+
+// A StateExporter turns the contents of the store in to Prometheus
+// gauges, a "cluster state exporter" built on the cache.  Wrap the
+// WatchingStore's Callback with Wrap, so that the metrics are updated
+// on each notification, and serve them from the exporter's ServeHTTP
+// (in the Prometheus text format) on a scraped endpoint, e.g.
+//
+//	exporter := k8sutil.NewStateExporter(k8sutil.PodsByPhase(), k8sutil.DeploymentsNotAvailable())
+//	store.Callback = exporter.Wrap(store.Callback)
+//	http.Handle("/metrics/cluster", exporter)
+//
+// The store must be watching the types that the metrics describe.
+type StateExporter struct {
+	metrics []StateMetric
+
+	mu       sync.Mutex
+	rendered []byte
+}
+
+// NewStateExporter returns a StateExporter of the metrics.
+func NewStateExporter(metrics ...StateMetric) *StateExporter {
+	return &StateExporter{metrics: metrics}
+}
+
+// Update recomputes the metrics from the store.
+func (e *StateExporter) Update(store Store) {
+	var buf bytes.Buffer
+	for _, metric := range e.metrics {
+		writeStateMetric(&buf, metric, metric.Collect(store))
+	}
+	e.mu.Lock()
+	e.rendered = buf.Bytes()
+	e.mu.Unlock()
+}
+
+// Wrap returns a Callback that updates the metrics and then calls
+// callback, if it is not nil.
+func (e *StateExporter) Wrap(callback func(Store)) func(Store) {
+	return func(store Store) {
+		e.Update(store)
+		if callback != nil {
+			callback(store)
+		}
+	}
+}
+
+// ServeHTTP serves the metrics as of the last Update, in the
+// Prometheus text exposition format.
+func (e *StateExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	rendered := e.rendered
+	e.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(rendered)
+}
+
+// writeStateMetric writes the metric's samples in the text format,
+// sorted by their labels so that the output is stable.
+func writeStateMetric(buf *bytes.Buffer, metric StateMetric, samples []StateSample) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", metric.Name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(metric.Help))
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", metric.Name)
+	lines := make([]string, 0, len(samples))
+	for _, sample := range samples {
+		var line strings.Builder
+		line.WriteString(metric.Name)
+		if len(metric.Labels) > 0 {
+			line.WriteByte('{')
+			for i, name := range metric.Labels {
+				if i > 0 {
+					line.WriteByte(',')
+				}
+				var value string
+				if i < len(sample.Labels) {
+					value = sample.Labels[i]
+				}
+				line.WriteString(name + `="` + labelValueEscaper.Replace(value) + `"`)
+			}
+			line.WriteByte('}')
+		}
+		line.WriteString(" " + strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		lines = append(lines, line.String())
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		buf.WriteString(line + "\n")
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// countBy returns samples counting the resources by the labels that
+// labels returns for each; a resource with nil labels isn't counted.
+func countBy(resources []k8s.Resource, labels func(k8s.Resource) []string) []StateSample {
+	counts := map[string]*StateSample{}
+	var order []string
+	for _, resource := range resources {
+		values := labels(resource)
+		if values == nil {
+			continue
+		}
+		key := strings.Join(values, "\x00")
+		if sample, ok := counts[key]; ok {
+			sample.Value++
+			continue
+		}
+		counts[key] = &StateSample{Labels: values, Value: 1}
+		order = append(order, key)
+	}
+	ret := make([]StateSample, len(order))
+	for i, key := range order {
+		ret[i] = *counts[key]
+	}
+	return ret
+}
+
+// PodsByPhase is the number of Pods in each phase, by namespace, as
+// "k8sutil_pods{namespace,phase}".
+func PodsByPhase() StateMetric {
+	return StateMetric{
+		Name:   "k8sutil_pods",
+		Help:   "The number of pods, by namespace and phase.",
+		Labels: []string{"namespace", "phase"},
+		Collect: func(store Store) []StateSample {
+			return countBy(store.List(&corev1.Pod{}), func(resource k8s.Resource) []string {
+				pod := resource.(*corev1.Pod)
+				return []string{pod.GetMetadata().GetNamespace(), pod.GetStatus().GetPhase()}
+			})
+		},
+	}
+}
+
+// DeploymentsNotAvailable is the number of Deployments with fewer
+// available replicas than they are meant to have, by namespace, as
+// "k8sutil_deployments_not_available{namespace}".
+func DeploymentsNotAvailable() StateMetric {
+	return StateMetric{
+		Name:   "k8sutil_deployments_not_available",
+		Help:   "The number of deployments that are not fully available, by namespace.",
+		Labels: []string{"namespace"},
+		Collect: func(store Store) []StateSample {
+			return countBy(store.List(&appsv1.Deployment{}), func(resource k8s.Resource) []string {
+				deployment := resource.(*appsv1.Deployment)
+				replicas := int32(1) // the default
+				if spec := deployment.GetSpec(); spec != nil && spec.Replicas != nil {
+					replicas = deployment.GetSpec().GetReplicas()
+				}
+				if deployment.GetStatus().GetAvailableReplicas() >= replicas {
+					return nil
+				}
+				return []string{deployment.GetMetadata().GetNamespace()}
+			})
+		},
+	}
+}
+
+// ResourcesByCondition is the number of resources of the type of the
+// sample (typically an *Unstructured, for a custom resource) with each
+// status of each of their status.conditions, by namespace, as
+// "<name>{namespace,type,status}".
+func ResourcesByCondition(name, help string, sample k8s.Resource) StateMetric {
+	return StateMetric{
+		Name:   name,
+		Help:   help,
+		Labels: []string{"namespace", "type", "status"},
+		Collect: func(store Store) []StateSample {
+			var samples []StateSample
+			counts := map[[3]string]int{}
+			for _, resource := range store.List(sample) {
+				namespace := resource.GetMetadata().GetNamespace()
+				for _, condition := range conditionsOf(resource) {
+					counts[[3]string{namespace, condition[0], condition[1]}]++
+				}
+			}
+			for labels, count := range counts {
+				samples = append(samples, StateSample{
+					Labels: []string{labels[0], labels[1], labels[2]},
+					Value:  float64(count),
+				})
+			}
+			return samples
+		},
+	}
+}
+
+// conditionsOf returns the type and status of each of the resource's
+// status.conditions.
+func conditionsOf(resource k8s.Resource) [][2]string {
+	var object map[string]interface{}
+	if u, ok := resource.(*Unstructured); ok {
+		object = u.Object
+	} else {
+		data, err := marshalKubeJSON(resource)
+		if err != nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &object); err != nil {
+			return nil
+		}
+	}
+	status, _ := object["status"].(map[string]interface{})
+	conditions, _ := status["conditions"].([]interface{})
+	var ret [][2]string
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		conditionType, _ := condition["type"].(string)
+		conditionStatus, _ := condition["status"].(string)
+		if conditionType != "" {
+			ret = append(ret, [2]string{conditionType, conditionStatus})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// A staticStore is a Store of a fixed set of resources.
+type staticStore []k8s.Resource
+
+func (s staticStore) List(sample k8s.Resource) []k8s.Resource {
+	var ret []k8s.Resource
+	for _, resource := range s {
+		if reflect.TypeOf(resource) == reflect.TypeOf(sample) {
+			ret = append(ret, resource)
+		}
+	}
+	return ret
+}
+
+func (s staticStore) ListSorted(sample k8s.Resource) []k8s.Resource { return s.List(sample) }
+
+func (s staticStore) All(sample k8s.Resource) func(yield func(k8s.Resource) bool) {
+	return func(yield func(k8s.Resource) bool) {
+		for _, resource := range s.List(sample) {
+			if !yield(resource) {
+				return
+			}
+		}
+	}
+}
+
+func (s staticStore) Keys(sample k8s.Resource) []k8sutil.ObjectKey { return nil }
+
+func (s staticStore) Count(sample k8s.Resource) int { return len(s.List(sample)) }
+
+func (s staticStore) Sequence() uint64 { return 1 }
+
+func pod(namespace, name, phase string) *corev1.Pod {
+	return &corev1.Pod{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String(namespace), Name: k8s.String(name)},
+		Status:   &corev1.PodStatus{Phase: k8s.String(phase)},
+	}
+}
+
+func deployment(namespace, name string, replicas, available int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String(namespace), Name: k8s.String(name)},
+		Spec:     &appsv1.DeploymentSpec{Replicas: &replicas},
+		Status:   &appsv1.DeploymentStatus{AvailableReplicas: &available},
+	}
+}
+
+func widget(namespace, name string, conditions ...string) *k8sutil.Unstructured {
+	var list []interface{}
+	for i := 0; i+1 < len(conditions); i += 2 {
+		list = append(list, map[string]interface{}{"type": conditions[i], "status": conditions[i+1]})
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name},
+		"status":     map[string]interface{}{"conditions": list},
+	})
+	u := &k8sutil.Unstructured{}
+	if err := json.Unmarshal(data, u); err != nil {
+		panic(err)
+	}
+	return u
+}
+
+func TestStateExporter(t *testing.T) {
+	exporter := k8sutil.NewStateExporter(
+		k8sutil.PodsByPhase(),
+		k8sutil.DeploymentsNotAvailable(),
+		k8sutil.ResourcesByCondition("widgets", "The number of widgets.", k8sutil.NewUnstructured("example.com/v1", "Widget")),
+	)
+	var called k8sutil.Store
+	callback := exporter.Wrap(func(s k8sutil.Store) { called = s })
+	store := staticStore{
+		pod("a", "p1", "Running"),
+		pod("a", "p2", "Running"),
+		pod("b", "p3", "Pending"),
+		deployment("a", "ok", 2, 2),
+		deployment("a", "short", 2, 1),
+		deployment("b", "new", 1, 0),
+		widget("a", "w1", "Ready", "True"),
+		widget("a", "w2", "Ready", "False", "Degraded", "True"),
+	}
+	callback(store)
+	if called == nil {
+		t.Errorf("didn't call the wrapped Callback")
+	}
+
+	rec := httptest.NewRecorder()
+	exporter.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP k8sutil_pods The number of pods, by namespace and phase.
+# TYPE k8sutil_pods gauge
+k8sutil_pods{namespace="a",phase="Running"} 2
+k8sutil_pods{namespace="b",phase="Pending"} 1
+# HELP k8sutil_deployments_not_available The number of deployments that are not fully available, by namespace.
+# TYPE k8sutil_deployments_not_available gauge
+k8sutil_deployments_not_available{namespace="a"} 1
+k8sutil_deployments_not_available{namespace="b"} 1
+# HELP widgets The number of widgets.
+# TYPE widgets gauge
+widgets{namespace="a",type="Degraded",status="True"} 1
+widgets{namespace="a",type="Ready",status="False"} 1
+widgets{namespace="a",type="Ready",status="True"} 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestStateExporterTyped checks that the conditions of a typed resource
+// are found in its Kubernetes JSON.
+func TestStateExporterTyped(t *testing.T) {
+	d := deployment("a", "d", 1, 1)
+	d.Status.Conditions = []*appsv1.DeploymentCondition{{Type: k8s.String("Available"), Status: k8s.String("True")}}
+	exporter := k8sutil.NewStateExporter(k8sutil.ResourcesByCondition("deployments", "Deployments.", &appsv1.Deployment{}))
+	exporter.Update(staticStore{d})
+	rec := httptest.NewRecorder()
+	exporter.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP deployments Deployments.
+# TYPE deployments gauge
+deployments{namespace="a",type="Available",status="True"} 1
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"expvar"
+)
+
+// PublishExpvar publishes the WatchingStore's Stats and Status with
+// the expvar package, as "k8sutil.<name>" (or just "k8sutil", if name
+// is empty), for environments that scrape /debug/vars rather than
+// Prometheus.  The variable is a JSON object:
+//
+//	{
+//	  "objects": 1234, "bytes": 567890, "slow_callbacks": 0,
+//	  "types": {"v1 Pod": {"objects": 1000, "bytes": 456789}, ...},
+//	  "watches": [{"type": "v1 Pod", "namespace": "", "synced": true,
+//	               "events": 42, "reconnects": 1}, ...]
+//	}
+//
+// The "slow_callbacks", "events", and "reconnects" are counts since Run
+// started, from which a scraper can compute rates.  Like
+// expvar.Publish, it panics if the name is already in use, so call it
+// once per WatchingStore.
+func (w *WatchingStore) PublishExpvar(name string) {
+	if name == "" {
+		name = "k8sutil"
+	} else {
+		name = "k8sutil." + name
+	}
+	expvar.Publish(name, expvar.Func(w.expvar))
+}
+
+type expvarTypeStats struct {
+	Objects int `json:"objects"`
+	Bytes   int `json:"bytes"`
+}
+
+type expvarWatchStatus struct {
+	Type          string `json:"type"`
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"label_selector,omitempty"`
+	FieldSelector string `json:"field_selector,omitempty"`
+	Synced        bool   `json:"synced"`
+	Events        int64  `json:"events"`
+	Reconnects    int    `json:"reconnects"`
+}
+
+type expvarStats struct {
+	Objects       int                        `json:"objects"`
+	Bytes         int                        `json:"bytes"`
+	SlowCallbacks uint64                     `json:"slow_callbacks"`
+	Types         map[string]expvarTypeStats `json:"types"`
+	Watches       []expvarWatchStatus        `json:"watches"`
+}
+
+// expvar returns the value of the variable that PublishExpvar
+// publishes.
+func (w *WatchingStore) expvar() interface{} {
+	stats := w.Stats()
+	ret := expvarStats{
+		Objects:       stats.Objects,
+		Bytes:         stats.Bytes,
+		SlowCallbacks: w.SlowCallbacks(),
+		Types:         make(map[string]expvarTypeStats, len(stats.Types)),
+		Watches:       []expvarWatchStatus{},
+	}
+	for _, t := range stats.Types {
+		ret.Types[t.Type] = expvarTypeStats{Objects: t.Objects, Bytes: t.Bytes}
+	}
+	for _, s := range w.Status() {
+		ret.Watches = append(ret.Watches, expvarWatchStatus{
+			Type:          s.ID.Type,
+			Namespace:     s.ID.Namespace,
+			LabelSelector: s.ID.LabelSelector,
+			FieldSelector: s.ID.FieldSelector,
+			Synced:        s.Synced,
+			Events:        s.Events,
+			Reconnects:    s.Reconnects,
+		})
+	}
+	return ret
+}
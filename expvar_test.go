@@ -0,0 +1,67 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"testing"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// published counts the runs of TestPublishExpvar, whose variables are
+// never unpublished, so that each has a new name.
+var published int
+
+func TestPublishExpvar(t *testing.T) {
+	published++
+	name := fmt.Sprintf("TestPublishExpvar%d", published)
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.PublishExpvar(name)
+	runStore(t, w)
+	<-stores
+	server.await("watch")
+	server.set(newConfigMap("default", "b"))
+	<-stores
+
+	v := expvar.Get("k8sutil." + name)
+	if v == nil {
+		t.Fatal("not published")
+	}
+	var got struct {
+		Objects int `json:"objects"`
+		Types   map[string]struct {
+			Objects int `json:"objects"`
+		} `json:"types"`
+		Watches []struct {
+			Type      string `json:"type"`
+			Namespace string `json:"namespace"`
+			Synced    bool   `json:"synced"`
+			Events    int64  `json:"events"`
+		} `json:"watches"`
+	}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Objects != 2 || got.Types["v1 ConfigMap"].Objects != 2 {
+		t.Errorf("got %d objects, %d ConfigMaps; want 2", got.Objects, got.Types["v1 ConfigMap"].Objects)
+	}
+	if len(got.Watches) != 1 {
+		t.Fatalf("got %d watches", len(got.Watches))
+	}
+	if ws := got.Watches[0]; ws.Type != "v1 ConfigMap" || ws.Namespace != "default" || !ws.Synced || ws.Events != 1 {
+		t.Errorf("got watch %+v", ws)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestFiltered checks that a Filtered view of a store has only the
+// resources, of every type, that match its selector.
+func TestFiltered(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(labeledConfigMap("default", "a", map[string]string{"tenant": "alice"}))
+	server.set(labeledConfigMap("default", "b", map[string]string{"tenant": "bob"}))
+	server.set(labeledConfigMap("other", "c", map[string]string{"tenant": "alice"}))
+	server.set(newConfigMap("other", "d"))
+	server.set(namespace("alice", map[string]string{"tenant": "alice"}))
+	server.set(namespace("bob", map[string]string{"tenant": "bob"}))
+	store := syncedSnapshot(t, server, &corev1.ConfigMapList{}, &corev1.NamespaceList{})
+
+	alice, err := k8sutil.Filtered(store, "tenant=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(alice.ListSorted(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("ListSorted: got %v", got)
+	}
+	if got := names(alice.List(&corev1.Namespace{})); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Errorf("List: got Namespaces %v", got)
+	}
+	want := []k8sutil.ObjectKey{{Namespace: "default", Name: "a"}, {Namespace: "other", Name: "c"}}
+	if got := alice.Keys(&corev1.ConfigMap{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys: got %v, want %v", got, want)
+	}
+	if n := alice.Count(&corev1.ConfigMap{}); n != 2 {
+		t.Errorf("Count: got %d", n)
+	}
+	var all []k8s.Resource
+	alice.All(&corev1.ConfigMap{})(func(r k8s.Resource) bool {
+		all = append(all, r)
+		return false
+	})
+	if len(all) != 1 {
+		t.Errorf("All: got %d resources after stopping", len(all))
+	}
+	if alice.Sequence() != store.Sequence() {
+		t.Errorf("got Sequence %d, want %d", alice.Sequence(), store.Sequence())
+	}
+
+	untenanted, err := k8sutil.Filtered(store, "!tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(untenanted.List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"d"}) {
+		t.Errorf("got untenanted ConfigMaps %v", got)
+	}
+	if _, err := k8sutil.Filtered(store, "=alice"); err == nil {
+		t.Error("filtered by an invalid selector")
+	}
+}
@@ -2,6 +2,9 @@ module github.com/datawire/k8sutil
 
 require (
 	github.com/ericchiang/k8s v1.2.1-0.20190205025945-b68231b30f2d
-	github.com/pkg/errors v0.8.1
+	github.com/golang/protobuf v1.2.0
+	github.com/pkg/errors v0.9.1
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	golang.org/x/sync v0.0.0-20181221193216-37e7f081c4d4 // indirect
+	sigs.k8s.io/yaml v1.4.0
 )
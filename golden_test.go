@@ -0,0 +1,176 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares the test's output with its golden file,
+// testdata/<test name>.golden, or, with -update, rewrites it.
+func checkGolden(t *testing.T, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", strings.Replace(t.Name(), "/", "_", -1)+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Fatalf("the session differs from %s (run with -update to accept it):\n--- got\n%s--- want\n%s", path, got, want)
+	}
+}
+
+// quiet is how long a session waits to be sure that nothing more
+// happens.
+const quiet = 50 * time.Millisecond
+
+// A session scripts a WatchingStore's ConfigMap watches, logging each
+// step; the log, with the Store's snapshots as they are recorded, is
+// what is compared with the golden file.
+type session struct {
+	t       *testing.T
+	backend *k8sutiltest.ScriptedBackend
+	rec     *k8sutiltest.Recorder
+	log     strings.Builder
+}
+
+func newSession(t *testing.T) *session {
+	return &session{
+		t:       t,
+		backend: k8sutiltest.NewScriptedBackend(t),
+		rec:     k8sutiltest.NewRecorder(&corev1.ConfigMap{}),
+	}
+}
+
+// store returns a WatchingStore of the session's backend, recording
+// with its Recorder.
+func (ss *session) store() *k8sutil.WatchingStore {
+	return &k8sutil.WatchingStore{
+		Backend:  ss.backend,
+		Logger:   k8sutiltest.Logger(ss.t),
+		Callback: ss.rec.Callback,
+	}
+}
+
+// run runs the store until the test ends.
+func (ss *session) run(store *k8sutil.WatchingStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = store.Run(ctx)
+		close(done)
+	}()
+	ss.t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// stream returns the Stream of ConfigMaps in the namespace.
+func (ss *session) stream(namespace string) *k8sutiltest.Stream {
+	return ss.backend.Stream(namespace, &corev1.ConfigMapList{})
+}
+
+// selectorStream returns the Stream of ConfigMaps in the namespace that
+// the label selector selects.
+func (ss *session) selectorStream(namespace, selector string) *k8sutiltest.Stream {
+	return ss.backend.SelectorStream(namespace, selector, &corev1.ConfigMapList{})
+}
+
+func (ss *session) logf(format string, args ...interface{}) {
+	fmt.Fprintf(&ss.log, format+"\n", args...)
+}
+
+// list scripts the next listing of the stream.
+func (ss *session) list(s *k8sutiltest.Stream, resourceVersion string, items ...*corev1.ConfigMap) {
+	ss.t.Helper()
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = describe(item)
+	}
+	ss.logf("list %s@%s: %s", streamName(s), resourceVersion, strings.Join(names, " "))
+	s.List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta(resourceVersion), Items: items})
+}
+
+// send sends an event on the stream.
+func (ss *session) send(s *k8sutiltest.Stream, eventType string, item *corev1.ConfigMap) {
+	ss.t.Helper()
+	ss.logf("%s %s %s", streamName(s), eventType, describe(item))
+	s.Send(eventType, item)
+}
+
+// waitForWatch waits for the nth watch of the stream, logging the
+// resourceVersion that it starts from.
+func (ss *session) waitForWatch(s *k8sutiltest.Stream, n int) {
+	ss.t.Helper()
+	ss.logf("%s watch #%d from %q", streamName(s), n, s.WaitForWatch(n))
+}
+
+// waitForList waits for the nth List call of the stream, logging the
+// resourceVersion that it must be at least as new as.
+func (ss *session) waitForList(s *k8sutiltest.Stream, n int) {
+	ss.t.Helper()
+	ss.logf("%s list #%d from %q", streamName(s), n, s.WaitForList(n))
+}
+
+// expect logs the next n snapshots.
+func (ss *session) expect(n int) {
+	ss.t.Helper()
+	for i := 0; i < n; i++ {
+		snapshot, ok := ss.rec.Next(k8sutiltest.DefaultTimeout)
+		if !ok {
+			ss.t.Fatalf("timed out waiting for a snapshot; so far:\n%s", ss.log.String())
+		}
+		ss.logf("  => %s", snapshot)
+	}
+}
+
+// done checks that there are no more snapshots, and compares the log
+// with the golden file.
+func (ss *session) done() {
+	ss.t.Helper()
+	ss.rec.ExpectNone(ss.t, quiet)
+	checkGolden(ss.t, ss.log.String())
+}
+
+// streamName names the stream in the log.
+func streamName(s *k8sutiltest.Stream) string {
+	return fmt.Sprint(s)
+}
+
+// configMap returns a ConfigMap with the labels, as key, value, ....
+func configMap(namespace, name, resourceVersion string, labels ...string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{Metadata: k8sutiltest.ObjectMeta(namespace, name, resourceVersion)}
+	if len(labels) > 0 {
+		cm.Metadata.Labels = map[string]string{}
+		for i := 0; i+1 < len(labels); i += 2 {
+			cm.Metadata.Labels[labels[i]] = labels[i+1]
+		}
+	}
+	return cm
+}
+
+func describe(cm *corev1.ConfigMap) string {
+	md := cm.GetMetadata()
+	return fmt.Sprintf("%s/%s@%s", md.GetNamespace(), md.GetName(), md.GetResourceVersion())
+}
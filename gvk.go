@@ -0,0 +1,129 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// A GroupVersionKind identifies a type of resource by its API group,
+// version, and kind.
+type GroupVersionKind struct {
+	Group   string
+	Version string
+	Kind    string
+}
+
+// APIVersion returns the GroupVersionKind's "apiVersion": the group
+// and the version, e.g. "apps/v1", or just the version for the core
+// group.
+func (gvk GroupVersionKind) APIVersion() string {
+	if gvk.Group == "" {
+		return gvk.Version
+	}
+	return gvk.Group + "/" + gvk.Version
+}
+
+// String returns the GroupVersionKind as "apiVersion Kind", e.g.
+// "apps/v1 Deployment".
+func (gvk GroupVersionKind) String() string {
+	return gvk.APIVersion() + " " + gvk.Kind
+}
+
+// GroupVersionKind returns the resource's GroupVersionKind.
+func (r APIResource) GroupVersionKind() GroupVersionKind {
+	return GroupVersionKind{Group: r.Group, Version: r.Version, Kind: r.Kind}
+}
+
+// registry remembers the APIResource of each Go type that has been
+// looked up, and the Go type of each GroupVersionKind.
+var registry struct {
+	sync.Mutex
+	byType map[reflect.Type]APIResource
+	byGVK  map[GroupVersionKind]reflect.Type
+}
+
+// apiResourceForType returns the APIResource of the resource's Go
+// type, as it was registered with the k8s package.  *Unstructured and
+// *PartialObjectMetadata resources aren't of a single type, so they
+// are described by their own apiVersion and kind instead, without a
+// resource name.
+func apiResourceForType(resource k8s.Resource) (APIResource, error) {
+	switch resource.(type) {
+	case *Unstructured, *PartialObjectMetadata:
+		return apiResourceForResource(resource)
+	}
+	goType := reflect.TypeOf(resource)
+	registry.Lock()
+	defer registry.Unlock()
+	if ret, ok := registry.byType[goType]; ok {
+		return ret, nil
+	}
+	ret, err := apiResourceForResource(resource)
+	if err != nil {
+		return APIResource{}, err
+	}
+	if registry.byType == nil {
+		registry.byType = make(map[reflect.Type]APIResource)
+		registry.byGVK = make(map[GroupVersionKind]reflect.Type)
+	}
+	registry.byType[goType] = ret
+	registry.byGVK[ret.GroupVersionKind()] = goType
+	return ret, nil
+}
+
+// GVKOf returns the GroupVersionKind of the resource's type.  For
+// typed resources, it comes from the k8s package's registration of
+// the type, not from the resource's contents.
+func GVKOf(resource k8s.Resource) (GroupVersionKind, error) {
+	r, err := apiResourceForType(resource)
+	if err != nil {
+		return GroupVersionKind{}, err
+	}
+	return r.GroupVersionKind(), nil
+}
+
+// GVROf returns the GroupVersionResource of the resource's type.  The
+// resource name of an *Unstructured or *PartialObjectMetadata can't be
+// known without discovery (see Discovery.ResourceForKind), so GVROf
+// returns an error for them.
+func GVROf(resource k8s.Resource) (GroupVersionResource, error) {
+	r, err := apiResourceForType(resource)
+	if err != nil {
+		return GroupVersionResource{}, err
+	}
+	if r.Name == "" {
+		return GroupVersionResource{}, errors.Errorf("the resource name of %s is not known", r.GroupVersionKind())
+	}
+	return r.GroupVersionResource(), nil
+}
+
+// RegisterTypes makes NewResourceFor aware of the types of the sample
+// resources, as well as every type that GVKOf or GVROf has been asked
+// about.  It returns an error if one of them isn't registered with the
+// k8s package.
+func RegisterTypes(samples ...k8s.Resource) error {
+	for _, sample := range samples {
+		if _, err := apiResourceForType(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewResourceFor returns a new, empty resource of the Go type for the
+// GroupVersionKind, if it has been registered with RegisterTypes (or
+// looked up with GVKOf), and an *Unstructured otherwise.
+func NewResourceFor(gvk GroupVersionKind) k8s.Resource {
+	registry.Lock()
+	goType, ok := registry.byGVK[gvk]
+	registry.Unlock()
+	if !ok {
+		return NewUnstructured(gvk.APIVersion(), gvk.Kind)
+	}
+	return reflect.New(goType.Elem()).Interface().(k8s.Resource)
+}
@@ -0,0 +1,63 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestGVKOf(t *testing.T) {
+	for _, test := range []struct {
+		resource k8s.Resource
+		gvk      string
+		gvr      string
+	}{
+		{&corev1.ConfigMap{}, "v1 ConfigMap", "configmaps.v1"},
+		{&corev1.Namespace{}, "v1 Namespace", "namespaces.v1"},
+		{&appsv1.Deployment{}, "apps/v1 Deployment", "deployments.v1.apps"},
+	} {
+		gvk, err := k8sutil.GVKOf(test.resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gvk.String() != test.gvk {
+			t.Errorf("got GVK %s, want %s", gvk, test.gvk)
+		}
+		gvr, err := k8sutil.GVROf(test.resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gvr.String() != test.gvr {
+			t.Errorf("got GVR %s, want %s", gvr, test.gvr)
+		}
+	}
+
+	u := k8sutil.NewUnstructured("example.com/v1", "Widget")
+	if gvk, err := k8sutil.GVKOf(u); err != nil || gvk.String() != "example.com/v1 Widget" {
+		t.Errorf("got %v, %v for an Unstructured", gvk, err)
+	}
+	if _, err := k8sutil.GVROf(u); err == nil {
+		t.Errorf("got the GVR of an Unstructured")
+	}
+}
+
+func TestNewResourceFor(t *testing.T) {
+	if err := k8sutil.RegisterTypes(&appsv1.Deployment{}); err != nil {
+		t.Fatal(err)
+	}
+	gvk := k8sutil.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	if r, ok := k8sutil.NewResourceFor(gvk).(*appsv1.Deployment); !ok || r.Metadata != nil {
+		t.Errorf("got %#v", r)
+	}
+	gvk = k8sutil.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	u, ok := k8sutil.NewResourceFor(gvk).(*k8sutil.Unstructured)
+	if !ok || u.APIVersion() != "example.com/v1" || u.Kind() != "Widget" {
+		t.Errorf("got %#v", u)
+	}
+}
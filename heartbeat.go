@@ -0,0 +1,142 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// DefaultHeartbeatInterval is how often a Heartbeat renews its Lease if
+// its Interval is zero.
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// leaseResource is the coordination.k8s.io/v1 Lease resource.
+var leaseResource = APIResource{
+	Group:      "coordination.k8s.io",
+	Version:    "v1",
+	Name:       "leases",
+	Kind:       "Lease",
+	Namespaced: true,
+}
+
+// microTimeFormat is the format of a metav1.MicroTime, such as the
+// renewTime of a Lease.
+const microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// A Heartbeat keeps a Lease renewed on behalf of the running component,
+// as the kubelet does for its node, so that other systems can tell
+// whether the component is alive through the API: it is, if the Lease's
+// renewTime is less than leaseDurationSeconds ago.  This isn't leader
+// election; a Heartbeat takes over the Lease whoever holds it, so give
+// each instance of a component its own Lease, e.g. named after its pod.
+type Heartbeat struct {
+	Client    *k8s.Client // must not be nil
+	Logger    Logger      // must not be nil
+	Namespace string
+	Name      string
+
+	// Identity is the holderIdentity of the Lease.  If empty, it is
+	// the hostname, which in a pod is the pod's name.
+	Identity string
+
+	// Interval is how often to renew the Lease.  If zero,
+	// DefaultHeartbeatInterval is used.
+	Interval time.Duration
+
+	// Duration is how long the Lease is valid for after each
+	// renewal, its leaseDurationSeconds.  If zero, it is four times
+	// the Interval, so that a missed renewal or two isn't taken for
+	// a dead component.
+	Duration time.Duration
+
+	// Clock, if set, is used instead of the system clock.
+	Clock Clock
+
+	mu      sync.Mutex
+	renewed time.Time
+}
+
+// Renewed returns when the Lease was last renewed by the Heartbeat, or
+// the zero time if it hasn't been yet.
+func (h *Heartbeat) Renewed() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.renewed
+}
+
+// Run renews the Lease, creating it if need be, every Interval until
+// the Context is done, and then returns nil.  It logs failures to renew
+// it, and carries on.  The Lease is left as it is when Run returns, to
+// expire.
+func (h *Heartbeat) Run(ctx context.Context) error {
+	if h.Namespace == "" || h.Name == "" {
+		return errors.New("Heartbeat: Namespace and Name must not be empty")
+	}
+	identity := h.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.Wrap(err, "Heartbeat: no Identity")
+		}
+		identity = hostname
+	}
+	interval := h.Interval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	duration := h.Duration
+	if duration <= 0 {
+		duration = 4 * interval
+	}
+	clock := orSystemClock(h.Clock)
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		now := clock.Now()
+		if err := h.renew(ctx, identity, duration, now); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			h.Logger.Errorf("renew lease %s/%s: %v", h.Namespace, h.Name, err)
+		} else {
+			h.mu.Lock()
+			h.renewed = now
+			h.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+// renew patches the Lease, or creates it if it doesn't exist.
+func (h *Heartbeat) renew(ctx context.Context, identity string, duration time.Duration, now time.Time) error {
+	spec := map[string]interface{}{
+		"holderIdentity":       identity,
+		"leaseDurationSeconds": int64((duration + time.Second - 1) / time.Second),
+		"renewTime":            now.UTC().Format(microTimeFormat),
+	}
+	path := leaseResource.Path(h.Namespace) + "/" + url.PathEscape(h.Name)
+	err := doJSON(ctx, h.Client, request{verb: http.MethodPatch, path: path, contentType: MergePatchType},
+		map[string]interface{}{"spec": spec}, nil)
+	if apiErrorCode(err) != http.StatusNotFound {
+		return err
+	}
+	spec["acquireTime"] = spec["renewTime"]
+	return doJSON(ctx, h.Client, request{verb: http.MethodPost, path: leaseResource.Path(h.Namespace)}, map[string]interface{}{
+		"apiVersion": leaseResource.GroupVersion(),
+		"kind":       leaseResource.Kind,
+		"metadata":   map[string]interface{}{"namespace": h.Namespace, "name": h.Name},
+		"spec":       spec,
+	}, nil)
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// A fakeLeases stands in for the apiserver's Lease endpoints in the
+// namespace default.
+type fakeLeases struct {
+	mu       sync.Mutex
+	leases   map[string]bool
+	requests []string
+	failing  bool
+}
+
+const leasesPath = "/apis/coordination.k8s.io/v1/namespaces/default/leases"
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	data, _ := json.Marshal(body)
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path+" "+string(data))
+	failure := func(code int) {
+		writeJSON(w, code, &metav1.Status{Status: k8s.String("Failure"), Code: k8s.Int32(int32(code))})
+	}
+	switch {
+	case f.failing:
+		failure(http.StatusInternalServerError)
+	case r.Method == http.MethodPost && r.URL.Path == leasesPath:
+		f.leases[body["metadata"].(map[string]interface{})["name"].(string)] = true
+		writeJSON(w, http.StatusCreated, body)
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, leasesPath+"/"):
+		if !f.leases[strings.TrimPrefix(r.URL.Path, leasesPath+"/")] {
+			failure(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, body)
+	default:
+		failure(http.StatusNotFound)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	f := &fakeLeases{leases: map[string]bool{}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	clock := k8sutiltest.NewFakeClock(epoch)
+	h := &k8sutil.Heartbeat{
+		Client:    &k8s.Client{Endpoint: server.URL, Client: server.Client()},
+		Logger:    testLogger{t},
+		Namespace: "default",
+		Name:      "web-1",
+		Identity:  "web-1",
+		Interval:  5 * time.Second,
+		Clock:     clock,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- h.Run(ctx) }()
+	waitForRenewal := func(want time.Time) {
+		t.Helper()
+		for deadline := time.Now().Add(timeout); !h.Renewed().Equal(want); time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("renewed at %v, want %v", h.Renewed(), want)
+			}
+		}
+	}
+	waitForRenewal(epoch)
+	if !clock.WaitForTimers(1, timeout) {
+		t.Fatal("timed out waiting for the ticker")
+	}
+
+	// A failure to renew is logged, and retried at the next tick.
+	f.mu.Lock()
+	f.failing = true
+	f.mu.Unlock()
+	clock.Advance(5 * time.Second)
+	for deadline := time.Now().Add(timeout); ; time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		n := len(f.requests)
+		f.failing = n < 3
+		f.mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the failed renewal")
+		}
+	}
+	clock.Advance(5 * time.Second)
+	waitForRenewal(epoch.Add(10 * time.Second))
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	spec := func(renewed string) string {
+		return `"holderIdentity":"web-1","leaseDurationSeconds":20,"renewTime":"` + renewed + `"}`
+	}
+	want := []string{
+		`PATCH ` + leasesPath + `/web-1 {"spec":{` + spec("2019-01-01T00:00:00.000000Z") + `}`,
+		`POST ` + leasesPath + ` {"apiVersion":"coordination.k8s.io/v1","kind":"Lease","metadata":{"name":"web-1","namespace":"default"},"spec":{"acquireTime":"2019-01-01T00:00:00.000000Z",` + spec("2019-01-01T00:00:00.000000Z") + `}`,
+		`PATCH ` + leasesPath + `/web-1 {"spec":{` + spec("2019-01-01T00:00:05.000000Z") + `}`,
+		`PATCH ` + leasesPath + `/web-1 {"spec":{` + spec("2019-01-01T00:00:10.000000Z") + `}`,
+	}
+	if strings.Join(f.requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got requests\n%s\nwant\n%s", strings.Join(f.requests, "\n"), strings.Join(want, "\n"))
+	}
+}
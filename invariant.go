@@ -0,0 +1,157 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// An Invariant is a condition that should hold of the whole store,
+// possibly across types, such as "every Service of type LoadBalancer
+// has an owning Mapping".
+type Invariant struct {
+	Name string
+
+	// Violations returns what violates the invariant in the store:
+	// a message describing each violation, by a subject that
+	// identifies it from one Store to the next (such as the
+	// namespace/name of the offending resource), so that the
+	// InvariantChecker can tell when it starts and stops.
+	Violations func(Store) map[string]string
+}
+
+// EachResource returns the Violations function of an invariant that
+// each resource of the sample's type must satisfy on its own: check
+// returns why the resource violates it, or "" if it doesn't.  The
+// subject of each violation is the resource's namespace/name.
+func EachResource(sample k8s.Resource, check func(k8s.Resource) string) func(Store) map[string]string {
+	return func(store Store) map[string]string {
+		ret := make(map[string]string)
+		for _, resource := range store.List(sample) {
+			if msg := check(resource); msg != "" {
+				ret[objectKeyOf(resource).String()] = msg
+			}
+		}
+		return ret
+	}
+}
+
+// An Alert reports that a violation of an invariant started (Firing),
+// or stopped.
+type Alert struct {
+	Invariant string
+	Subject   string
+	Message   string    // the last message of the violation
+	Firing    bool      // whether it started, rather than stopped
+	Since     time.Time // when the violation started
+}
+
+// An InvariantChecker checks invariants against each Store, and alerts
+// when a violation of one starts or stops, tracking which are active
+// across notifications.  Wrap the WatchingStore's Callback with Wrap,
+// e.g.
+//
+//	checker := &k8sutil.InvariantChecker{Invariants: invariants, OnAlert: page}
+//	store.Callback = checker.Wrap(store.Callback)
+//
+// The store must be watching the types that the invariants are about.
+type InvariantChecker struct {
+	Invariants []Invariant
+
+	// OnAlert, if set, is called with each Alert, synchronously,
+	// from the Callback.
+	OnAlert func(Alert)
+
+	// Clock, if set, is used instead of the system clock for the
+	// Since of Alerts.
+	Clock Clock
+
+	mu     sync.Mutex
+	active map[alertKey]Alert
+}
+
+// An alertKey identifies a violation.
+type alertKey struct {
+	invariant int
+	subject   string
+}
+
+// Wrap returns a callback that checks the Store, and then calls the
+// callback, if it isn't nil.
+func (c *InvariantChecker) Wrap(callback func(Store)) func(Store) {
+	return func(store Store) {
+		c.Check(store)
+		if callback != nil {
+			callback(store)
+		}
+	}
+}
+
+// Check checks the invariants against the Store, alerting of the
+// violations that started or stopped since the last check.
+func (c *InvariantChecker) Check(store Store) {
+	now := orSystemClock(c.Clock).Now()
+	c.mu.Lock()
+	if c.active == nil {
+		c.active = make(map[alertKey]Alert)
+	}
+	var alerts []Alert
+	for i, invariant := range c.Invariants {
+		violations := invariant.Violations(store)
+		for subject, msg := range violations {
+			key := alertKey{i, subject}
+			alert, ok := c.active[key]
+			if !ok {
+				alert = Alert{Invariant: invariant.Name, Subject: subject, Firing: true, Since: now}
+			}
+			alert.Message = msg
+			c.active[key] = alert
+			if !ok {
+				alerts = append(alerts, alert)
+			}
+		}
+		for key, alert := range c.active {
+			if key.invariant != i {
+				continue
+			}
+			if _, ok := violations[key.subject]; !ok {
+				delete(c.active, key)
+				alert.Firing = false
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	c.mu.Unlock()
+	sortAlerts(alerts)
+	if c.OnAlert != nil {
+		for _, alert := range alerts {
+			c.OnAlert(alert)
+		}
+	}
+}
+
+// Active returns the violations that are active as of the last check,
+// as firing Alerts, sorted by invariant and then subject.
+func (c *InvariantChecker) Active() []Alert {
+	c.mu.Lock()
+	ret := make([]Alert, 0, len(c.active))
+	for _, alert := range c.active {
+		ret = append(ret, alert)
+	}
+	c.mu.Unlock()
+	sortAlerts(ret)
+	return ret
+}
+
+func sortAlerts(alerts []Alert) {
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Invariant != alerts[j].Invariant {
+			return alerts[i].Invariant < alerts[j].Invariant
+		}
+		return alerts[i].Subject < alerts[j].Subject
+	})
+}
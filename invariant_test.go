@@ -0,0 +1,64 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+func TestInvariantChecker(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	var alerts []k8sutil.Alert
+	checker := &k8sutil.InvariantChecker{
+		Invariants: []k8sutil.Invariant{{
+			Name: "available",
+			Violations: k8sutil.EachResource(&appsv1.Deployment{}, func(resource k8s.Resource) string {
+				if resource.(*appsv1.Deployment).GetStatus().GetAvailableReplicas() == 0 {
+					return "no replicas available"
+				}
+				return ""
+			}),
+		}},
+		OnAlert: func(alert k8sutil.Alert) { alerts = append(alerts, alert) },
+		Clock:   clock,
+	}
+	callback := checker.Wrap(nil)
+
+	callback(staticStore{deployment("a", "one", 1, 0), deployment("a", "two", 1, 1)})
+	started := k8sutil.Alert{Invariant: "available", Subject: "a/one", Message: "no replicas available", Firing: true, Since: epoch}
+	if want := []k8sutil.Alert{started}; !reflect.DeepEqual(alerts, want) {
+		t.Errorf("got alerts %+v, want %+v", alerts, want)
+	}
+
+	// A violation that continues doesn't alert again, and keeps
+	// when it started.
+	alerts = nil
+	clock.Advance(time.Minute)
+	callback(staticStore{deployment("a", "one", 1, 0), deployment("a", "two", 1, 1)})
+	if len(alerts) != 0 {
+		t.Errorf("got alerts %+v", alerts)
+	}
+	if want := []k8sutil.Alert{started}; !reflect.DeepEqual(checker.Active(), want) {
+		t.Errorf("got active %+v, want %+v", checker.Active(), want)
+	}
+
+	clock.Advance(time.Minute)
+	callback(staticStore{deployment("a", "one", 1, 1), deployment("a", "two", 1, 0)})
+	stopped := started
+	stopped.Firing = false
+	two := k8sutil.Alert{Invariant: "available", Subject: "a/two", Message: "no replicas available", Firing: true, Since: epoch.Add(2 * time.Minute)}
+	if want := []k8sutil.Alert{stopped, two}; !reflect.DeepEqual(alerts, want) {
+		t.Errorf("got alerts %+v, want %+v", alerts, want)
+	}
+	if want := []k8sutil.Alert{two}; !reflect.DeepEqual(checker.Active(), want) {
+		t.Errorf("got active %+v, want %+v", checker.Active(), want)
+	}
+}
@@ -0,0 +1,469 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/datawire/k8sutil"
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/golang/protobuf/proto"
+)
+
+// TestingT is the part of *testing.T that the helpers in this package
+// use to fail a test.
+type TestingT interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// DefaultTimeout is how long the helpers in this package wait for the
+// code under test before failing the test, unless told otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// A ScriptedBackend is a k8sutil.Backend whose responses are scripted
+// by a test, one Stream per type, namespace, and label selector: each
+// List call returns the next scripted listing, and each watch delivers
+// the scripted events, disconnects, and expiries in order.  Nothing happens that
+// hasn't been scripted; a List with no listing scripted waits for one.
+//
+// The scripting methods are meant to be called from the test's
+// goroutine, and fail the test if the WatchingStore doesn't get to
+// the point that they are waiting for in time.
+type ScriptedBackend struct {
+	// Timeout is how long to wait for the WatchingStore.  If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	t       TestingT
+	mu      sync.Mutex
+	streams map[streamKey]*Stream
+}
+
+// NewScriptedBackend returns a ScriptedBackend with nothing scripted,
+// that fails t if the script can't be carried out.
+func NewScriptedBackend(t TestingT) *ScriptedBackend {
+	return &ScriptedBackend{t: t, streams: make(map[streamKey]*Stream)}
+}
+
+var _ k8sutil.Backend = (*ScriptedBackend)(nil)
+
+// streamKey identifies the Stream of a type, namespace, and label
+// selector.
+type streamKey struct {
+	listType  string
+	namespace string
+	selector  string
+}
+
+func newStreamKey(namespace, selector string, list k8s.ResourceList) streamKey {
+	listType := fmt.Sprintf("%T", list)
+	switch list := list.(type) {
+	case *k8sutil.UnstructuredList:
+		listType += " " + list.Resource.GroupVersion() + " " + list.Resource.Kind
+	case *k8sutil.PartialObjectMetadataList:
+		listType += " " + list.Resource.GroupVersion() + " " + list.Resource.Kind
+	}
+	return streamKey{listType, namespace, selector}
+}
+
+// Stream returns the Stream of the list's type in the namespace (or
+// all namespaces, if namespace is k8s.AllNamespaces), which is what a
+// watch added with the same namespace and list, and no label selector,
+// uses.
+func (b *ScriptedBackend) Stream(namespace string, list k8s.ResourceList) *Stream {
+	return b.SelectorStream(namespace, "", list)
+}
+
+// SelectorStream returns the Stream of the list's type in the namespace
+// that is selected by the label selector, which is what a watch added
+// with the same namespace and list, and ClientOptions with the
+// "labelSelector" query parameter, uses.
+func (b *ScriptedBackend) SelectorStream(namespace, selector string, list k8s.ResourceList) *Stream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := newStreamKey(namespace, selector, list)
+	s, ok := b.streams[key]
+	if !ok {
+		name := fmt.Sprintf("%T (namespace=%q)", list, namespace)
+		if selector != "" {
+			name = fmt.Sprintf("%T (namespace=%q, labelSelector=%q)", list, namespace, selector)
+		}
+		s = &Stream{
+			backend: b,
+			name:    name,
+			changed: make(chan struct{}),
+		}
+		b.streams[key] = s
+	}
+	return s
+}
+
+func (b *ScriptedBackend) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return DefaultTimeout
+}
+
+// List implements k8sutil.Backend.
+func (b *ScriptedBackend) List(ctx context.Context, namespace string, list k8s.ResourceList, options k8sutil.ListOptions) error {
+	return b.stream(namespace, list, options).list(ctx, list, options)
+}
+
+// Watch implements k8sutil.Backend.
+func (b *ScriptedBackend) Watch(ctx context.Context, namespace string, list k8s.ResourceList, options k8sutil.ListOptions) (k8sutil.Watcher, error) {
+	return b.stream(namespace, list, options).watch(ctx, options)
+}
+
+// stream returns the Stream that a request with the options uses.
+func (b *ScriptedBackend) stream(namespace string, list k8s.ResourceList, options k8sutil.ListOptions) *Stream {
+	selector := k8sutil.OptionQuery(options.ClientOptions...).Get("labelSelector")
+	return b.SelectorStream(namespace, selector, list)
+}
+
+// A Stream is the script of the lists and watches of one type in one
+// namespace, with one label selector.
+type Stream struct {
+	backend *ScriptedBackend
+	name    string
+
+	mu       sync.Mutex
+	lists    []scriptedList
+	watchErr []error
+	current  *scriptedWatcher // the open watch, if any
+	watches  int              // the number of watches opened
+	versions []string         // the resourceVersion of each watch
+	listed   []string         // the resourceVersion of each list call
+	changed  chan struct{}    // closed, and replaced, on any change
+}
+
+type scriptedList struct {
+	data  []byte
+	proto bool // whether data is protobuf, rather than JSON
+	err   error
+}
+
+// An event is what a scriptedWatcher's Next returns.
+type event struct {
+	eventType string
+	data      []byte
+	proto     bool // whether data is protobuf, rather than JSON
+	err       error
+}
+
+// encode encodes a scripted list or resource, so that what is
+// delivered shares nothing with what the test goes on to modify.  The
+// k8s package's types are encoded as protobuf, as the apiserver sends
+// them: their JSON decoding mangles the nanoseconds of timestamps.
+func encode(v interface{}) ([]byte, bool, error) {
+	if msg, ok := v.(proto.Message); ok {
+		data, err := proto.Marshal(msg)
+		return data, true, err
+	}
+	data, err := json.Marshal(v)
+	return data, false, err
+}
+
+// decode decodes what encode encoded.
+func decode(data []byte, isProto bool, v interface{}) error {
+	if isProto {
+		return proto.Unmarshal(data, v.(proto.Message))
+	}
+	return json.Unmarshal(data, v)
+}
+
+// String names the stream by its type and namespace.
+func (s *Stream) String() string {
+	return s.name
+}
+
+// changedLocked wakes up anything waiting for the stream to change.
+func (s *Stream) changedLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// awaitLocked waits, until the backend's timeout, for cond to hold,
+// returning whether it does.  It is called with s.mu held, and returns
+// with it held.
+func (s *Stream) awaitLocked(cond func() bool) bool {
+	deadline := time.After(s.backend.timeout())
+	for !cond() {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+			s.mu.Lock()
+		case <-deadline:
+			s.mu.Lock()
+			return cond()
+		}
+	}
+	return true
+}
+
+// fatalf fails the test.
+func (s *Stream) fatalf(format string, args ...interface{}) {
+	s.backend.t.Helper()
+	s.backend.t.Fatalf("%s: "+format, append([]interface{}{s.name}, args...)...)
+}
+
+// List scripts the result of the next List call: the list's items and
+// resourceVersion.  The list is copied, so the test may go on to
+// modify it.
+func (s *Stream) List(list k8s.ResourceList) {
+	data, isProto, err := encode(list)
+	if err != nil {
+		s.backend.t.Helper()
+		s.fatalf("%v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists = append(s.lists, scriptedList{data: data, proto: isProto})
+	s.changedLocked()
+}
+
+// FailList scripts the next List call to return err, such as a
+// *k8s.APIError.
+func (s *Stream) FailList(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists = append(s.lists, scriptedList{err: err})
+	s.changedLocked()
+}
+
+// FailWatch scripts the next attempt to start a watch to return err.
+func (s *Stream) FailWatch(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchErr = append(s.watchErr, err)
+	s.changedLocked()
+}
+
+// Send delivers a watch event (k8s.EventAdded, k8s.EventModified,
+// k8s.EventDeleted, or "BOOKMARK") of the resource, once there is an
+// open watch, and waits for it to be received.  Nothing stops a script
+// from sending events out of order, or more than once.
+func (s *Stream) Send(eventType string, resource k8s.Resource) {
+	data, isProto, err := encode(resource)
+	if err != nil {
+		s.backend.t.Helper()
+		s.fatalf("%v", err)
+		return
+	}
+	s.backend.t.Helper()
+	s.deliver("send "+eventType, event{eventType: eventType, data: data, proto: isProto})
+}
+
+// Bookmark delivers a BOOKMARK event with the resourceVersion.
+func (s *Stream) Bookmark(resourceVersion string) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": resourceVersion},
+	})
+	s.backend.t.Helper()
+	s.deliver("bookmark", event{eventType: "BOOKMARK", data: data})
+}
+
+// Disconnect ends the open watch, the way that a dropped connection
+// does.
+func (s *Stream) Disconnect() {
+	s.backend.t.Helper()
+	s.deliver("disconnect", event{err: io.EOF})
+}
+
+// Expire ends the open watch with a "410 Gone", as the apiserver does
+// once the watch's resourceVersion is too old, forcing a re-list.
+func (s *Stream) Expire() {
+	s.backend.t.Helper()
+	s.deliver("expire", event{err: &k8s.APIError{
+		Code:   410,
+		Status: &metav1.Status{Message: stringPtr("too old resource version")},
+	}})
+}
+
+// Fail ends the open watch with err.
+func (s *Stream) Fail(err error) {
+	s.backend.t.Helper()
+	s.deliver("fail", event{err: err})
+}
+
+// deliver waits for an open watch, and for it to receive the event.
+func (s *Stream) deliver(what string, e event) {
+	s.mu.Lock()
+	ok := s.awaitLocked(func() bool { return s.current != nil })
+	current := s.current
+	if ok && e.err != nil {
+		s.current = nil
+		s.changedLocked()
+	}
+	s.mu.Unlock()
+	s.backend.t.Helper()
+	if !ok {
+		s.fatalf("timed out waiting for a watch to %s on", what)
+		return
+	}
+	select {
+	case current.events <- e:
+	case <-current.ctx.Done():
+		// The watch was shut down first; the event is lost,
+		// as it would be on a real connection.
+	case <-time.After(s.backend.timeout()):
+		s.fatalf("timed out waiting for the watch to receive %s", what)
+	}
+}
+
+// WaitForWatch waits until the nth watch (counting from 1) of the
+// stream has been started, and returns the resourceVersion that it
+// started from.
+func (s *Stream) WaitForWatch(n int) string {
+	s.mu.Lock()
+	ok := s.awaitLocked(func() bool { return s.watches >= n })
+	var resourceVersion string
+	if ok {
+		resourceVersion = s.versions[n-1]
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.backend.t.Helper()
+		s.fatalf("timed out waiting for watch #%d", n)
+	}
+	return resourceVersion
+}
+
+// WaitForList waits until the nth List call (counting from 1) of the
+// stream has been made, and returns the resourceVersion that the
+// listing had to be at least as new as ("" for any).
+func (s *Stream) WaitForList(n int) string {
+	s.mu.Lock()
+	ok := s.awaitLocked(func() bool { return len(s.listed) >= n })
+	var resourceVersion string
+	if ok {
+		resourceVersion = s.listed[n-1]
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.backend.t.Helper()
+		s.fatalf("timed out waiting for list #%d", n)
+	}
+	return resourceVersion
+}
+
+// Watches returns the number of watches that have been started.
+func (s *Stream) Watches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watches
+}
+
+// Lists returns the number of List calls that have been made.
+func (s *Stream) Lists() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.listed)
+}
+
+func (s *Stream) list(ctx context.Context, list k8s.ResourceList, options k8sutil.ListOptions) error {
+	s.mu.Lock()
+	s.listed = append(s.listed, options.ResourceVersion)
+	s.changedLocked()
+	for len(s.lists) == 0 {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.mu.Lock()
+	}
+	next := s.lists[0]
+	s.lists = s.lists[1:]
+	s.changedLocked()
+	s.mu.Unlock()
+	if next.err != nil {
+		return next.err
+	}
+	return decode(next.data, next.proto, list)
+}
+
+func (s *Stream) watch(ctx context.Context, options k8sutil.ListOptions) (k8sutil.Watcher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.watchErr) > 0 {
+		err := s.watchErr[0]
+		s.watchErr = s.watchErr[1:]
+		s.changedLocked()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &scriptedWatcher{
+		stream: s,
+		ctx:    ctx,
+		cancel: cancel,
+		events: make(chan event),
+	}
+	s.current = w
+	s.watches++
+	s.versions = append(s.versions, options.ResourceVersion)
+	s.changedLocked()
+	return w, nil
+}
+
+// A scriptedWatcher is the k8sutil.Watcher of a Stream.
+type scriptedWatcher struct {
+	stream *Stream
+	ctx    context.Context
+	cancel context.CancelFunc
+	events chan event
+}
+
+func (w *scriptedWatcher) Next(resource k8s.Resource) (string, error) {
+	select {
+	case e := <-w.events:
+		if e.err != nil {
+			return "", e.err
+		}
+		return e.eventType, decode(e.data, e.proto, resource)
+	case <-w.ctx.Done():
+		return "", w.ctx.Err()
+	}
+}
+
+func (w *scriptedWatcher) Close() error {
+	w.cancel()
+	s := w.stream
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == w {
+		s.current = nil
+		s.changedLocked()
+	}
+	return nil
+}
+
+// ObjectMeta returns metadata for a scripted resource.  The UID, which
+// is how the Store tells resources apart, is derived from the
+// namespace and name.
+func ObjectMeta(namespace, name, resourceVersion string) *metav1.ObjectMeta {
+	return &metav1.ObjectMeta{
+		Namespace:       stringPtr(namespace),
+		Name:            stringPtr(name),
+		Uid:             stringPtr(namespace + "/" + name),
+		ResourceVersion: stringPtr(resourceVersion),
+	}
+}
+
+// ListMeta returns metadata for a scripted list.
+func ListMeta(resourceVersion string) *metav1.ListMeta {
+	return &metav1.ListMeta{ResourceVersion: stringPtr(resourceVersion)}
+}
+
+func stringPtr(s string) *string { return &s }
@@ -0,0 +1,184 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/datawire/k8sutil"
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+// A ChaosBackend wraps a k8sutil.Backend, and misbehaves the ways that
+// an apiserver under stress does, at random: dropping watch
+// connections, expiring watches with a "410 Gone", rejecting requests
+// with a "429 Too Many Requests", responding slowly, and delivering
+// events twice.  Use it, against a real apiserver or a
+// ScriptedBackend, to check that a controller copes.
+//
+// Each probability is per request (List or Watch) or per watch
+// event received, as its comment says; zero disables that misbehavior.
+type ChaosBackend struct {
+	Backend k8sutil.Backend // must not be nil
+
+	// Seed seeds the random choices.  If zero, the choices
+	// aren't reproducible.
+	Seed int64
+
+	// Disconnect is the probability, per event, of the watch's
+	// connection dropping instead.
+	Disconnect float64
+
+	// Expire is the probability, per event, of the watch ending
+	// with a "410 Gone" instead.
+	Expire float64
+
+	// Duplicate is the probability, per event, of the event being
+	// delivered again after itself.
+	Duplicate float64
+
+	// TooManyRequests is the probability, per request, of a "429
+	// Too Many Requests" response asking to retry after
+	// RetryAfter (which, if zero, is 1 second).
+	TooManyRequests float64
+	RetryAfter      time.Duration
+
+	// Slow is the probability, per request and per event, of a
+	// delay of up to SlowDelay (which, if zero, is 1 second).
+	Slow      float64
+	SlowDelay time.Duration
+
+	once sync.Once
+	mu   sync.Mutex
+	rng  *rand.Rand
+}
+
+var _ k8sutil.Backend = (*ChaosBackend)(nil)
+
+// chance returns true with probability p.
+func (b *ChaosBackend) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	return b.float64() < p
+}
+
+func (b *ChaosBackend) float64() float64 {
+	b.once.Do(func() {
+		seed := b.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		b.rng = rand.New(rand.NewSource(seed))
+	})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rng.Float64()
+}
+
+// delay maybe sleeps, as a slow apiserver would.
+func (b *ChaosBackend) delay(ctx context.Context) {
+	if !b.chance(b.Slow) {
+		return
+	}
+	max := b.SlowDelay
+	if max <= 0 {
+		max = time.Second
+	}
+	timer := time.NewTimer(time.Duration(b.float64() * float64(max)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// request maybe delays, or rejects, a request.
+func (b *ChaosBackend) request(ctx context.Context) error {
+	b.delay(ctx)
+	if !b.chance(b.TooManyRequests) {
+		return nil
+	}
+	retryAfter := b.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	seconds := int32((retryAfter + time.Second - 1) / time.Second)
+	return &k8s.APIError{
+		Code: 429,
+		Status: &metav1.Status{
+			Message: stringPtr("too many requests"),
+			Details: &metav1.StatusDetails{RetryAfterSeconds: &seconds},
+		},
+	}
+}
+
+// List implements k8sutil.Backend.
+func (b *ChaosBackend) List(ctx context.Context, namespace string, list k8s.ResourceList, options k8sutil.ListOptions) error {
+	if err := b.request(ctx); err != nil {
+		return err
+	}
+	return b.Backend.List(ctx, namespace, list, options)
+}
+
+// Watch implements k8sutil.Backend.
+func (b *ChaosBackend) Watch(ctx context.Context, namespace string, list k8s.ResourceList, options k8sutil.ListOptions) (k8sutil.Watcher, error) {
+	if err := b.request(ctx); err != nil {
+		return nil, err
+	}
+	watcher, err := b.Backend.Watch(ctx, namespace, list, options)
+	if err != nil {
+		return nil, err
+	}
+	// The Watcher interface has no Context, so delays are cut
+	// short by Close instead.
+	ctx, cancel := context.WithCancel(ctx)
+	return &chaosWatcher{backend: b, watcher: watcher, ctx: ctx, cancel: cancel}, nil
+}
+
+type chaosWatcher struct {
+	backend *ChaosBackend
+	watcher k8sutil.Watcher
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	repeat    k8s.Resource // if set, an event to deliver again
+	eventType string       // of the event to deliver again
+}
+
+func (w *chaosWatcher) Next(resource k8s.Resource) (string, error) {
+	b := w.backend
+	b.delay(w.ctx)
+	if w.repeat != nil {
+		repeat := w.repeat
+		w.repeat = nil
+		reflect.ValueOf(resource).Elem().Set(reflect.ValueOf(repeat).Elem())
+		return w.eventType, nil
+	}
+	switch {
+	case b.chance(b.Disconnect):
+		return "", io.ErrUnexpectedEOF
+	case b.chance(b.Expire):
+		return "", &k8s.APIError{
+			Code:   410,
+			Status: &metav1.Status{Message: stringPtr("too old resource version")},
+		}
+	}
+	eventType, err := w.watcher.Next(resource)
+	if err == nil && b.chance(b.Duplicate) {
+		w.repeat = k8sutil.DeepCopy(resource)
+		w.eventType = eventType
+	}
+	return eventType, err
+}
+
+func (w *chaosWatcher) Close() error {
+	w.cancel()
+	return w.watcher.Close()
+}
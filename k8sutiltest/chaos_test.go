@@ -0,0 +1,101 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// chaosWatch starts a watch of the ConfigMaps in "default" through a
+// ChaosBackend around a ScriptedBackend.
+func chaosWatch(t *testing.T, chaos *k8sutiltest.ChaosBackend) (*k8sutiltest.Stream, k8sutil.Watcher) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	chaos.Backend = backend
+	chaos.Seed = 1
+	watcher, err := chaos.Watch(context.Background(), "default", &corev1.ConfigMapList{}, k8sutil.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { watcher.Close() })
+	return backend.Stream("default", &corev1.ConfigMapList{}), watcher
+}
+
+func TestChaosTooManyRequests(t *testing.T) {
+	chaos := &k8sutiltest.ChaosBackend{
+		Backend:         k8sutiltest.NewScriptedBackend(t),
+		Seed:            1,
+		TooManyRequests: 1,
+		RetryAfter:      1500 * time.Millisecond,
+	}
+	err := chaos.List(context.Background(), "default", &corev1.ConfigMapList{}, k8sutil.ListOptions{})
+	var apiErr *k8s.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got error %v, want a 429", err)
+	}
+	if seconds := apiErr.Status.GetDetails().GetRetryAfterSeconds(); seconds != 2 {
+		t.Errorf("asked to retry after %ds, want 2s", seconds)
+	}
+}
+
+func TestChaosDuplicate(t *testing.T) {
+	s, watcher := chaosWatch(t, &k8sutiltest.ChaosBackend{Duplicate: 1})
+	go s.Send(k8s.EventAdded, &corev1.ConfigMap{Metadata: k8sutiltest.ObjectMeta("default", "a", "1")})
+	for i := 0; i < 2; i++ {
+		var cm corev1.ConfigMap
+		eventType, err := watcher.Next(&cm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eventType != k8s.EventAdded || cm.GetMetadata().GetName() != "a" {
+			t.Errorf("event %d: got %s %s", i, eventType, cm.GetMetadata().GetName())
+		}
+	}
+}
+
+func TestChaosDisconnect(t *testing.T) {
+	_, watcher := chaosWatch(t, &k8sutiltest.ChaosBackend{Disconnect: 1})
+	if _, err := watcher.Next(&corev1.ConfigMap{}); err != io.ErrUnexpectedEOF {
+		t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestChaosExpire(t *testing.T) {
+	_, watcher := chaosWatch(t, &k8sutiltest.ChaosBackend{Expire: 1})
+	_, err := watcher.Next(&corev1.ConfigMap{})
+	var apiErr *k8s.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusGone {
+		t.Errorf("got error %v, want a 410", err)
+	}
+}
+
+// TestChaosSlow checks that a slow request is cut short when its
+// Context is canceled.
+func TestChaosSlow(t *testing.T) {
+	chaos := &k8sutiltest.ChaosBackend{
+		Backend:   k8sutiltest.NewScriptedBackend(t),
+		Seed:      1,
+		Slow:      1,
+		SlowDelay: time.Hour,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := chaos.List(ctx, "default", &corev1.ConfigMapList{}, k8sutil.ListOptions{})
+	if err == nil {
+		t.Errorf("listed nothing scripted")
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("took %v", elapsed)
+	}
+}
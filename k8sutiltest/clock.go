@@ -0,0 +1,177 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+// Package k8sutiltest provides helpers for testing k8sutil, and code
+// that uses it.
+package k8sutiltest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/datawire/k8sutil"
+)
+
+// A FakeClock is a k8sutil.Clock whose time only moves when it is told
+// to, so that tests of time-based behavior are deterministic and don't
+// have to sleep.  Its timers fire (in order of their deadlines) as
+// Advance or Set moves the time past them.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{} // closed, and replaced, when timers changes
+}
+
+// NewFakeClock returns a FakeClock set to the time now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now, changed: make(chan struct{})}
+}
+
+var _ k8sutil.Clock = (*FakeClock)(nil)
+
+// Now implements k8sutil.Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements k8sutil.Clock.
+func (c *FakeClock) NewTimer(d time.Duration) k8sutil.Timer {
+	return c.newTimer(d, 0)
+}
+
+// NewTicker implements k8sutil.Clock.
+func (c *FakeClock) NewTicker(d time.Duration) k8sutil.Timer {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return c.newTimer(d, d)
+}
+
+func (c *FakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		period:   period,
+		ch:       make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		t.fire(c.now)
+		if period == 0 {
+			return t
+		}
+	}
+	c.timers = append(c.timers, t)
+	c.notifyLocked()
+	return t
+}
+
+// Advance moves the time forward by d, firing the timers that are due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the time to t, firing the timers that are due.  Moving it
+// backward fires nothing.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		next := c.nextLocked()
+		if next == nil || next.deadline.After(t) {
+			break
+		}
+		if c.now.Before(next.deadline) {
+			c.now = next.deadline
+		}
+		next.fire(c.now)
+		if next.period > 0 {
+			next.deadline = next.deadline.Add(next.period)
+		} else {
+			c.removeLocked(next)
+		}
+	}
+	c.now = t
+}
+
+// Timers returns the number of timers and tickers that haven't fired
+// or been stopped.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers blocks until at least n timers and tickers are
+// waiting to fire, or until the timeout elapses (in real time),
+// returning whether there are.  Use it to make sure that the code
+// under test has started waiting before advancing the clock.
+func (c *FakeClock) WaitForTimers(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		count, changed := len(c.timers), c.changed
+		c.mu.Unlock()
+		if count >= n {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// nextLocked returns the timer with the earliest deadline.
+func (c *FakeClock) nextLocked() *fakeTimer {
+	var next *fakeTimer
+	for _, t := range c.timers {
+		if next == nil || t.deadline.Before(next.deadline) {
+			next = t
+		}
+	}
+	return next
+}
+
+func (c *FakeClock) removeLocked(t *fakeTimer) {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.notifyLocked()
+			return
+		}
+	}
+}
+
+func (c *FakeClock) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// A fakeTimer is a timer or, if it has a period, a ticker.
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	period   time.Duration
+	ch       chan time.Time
+}
+
+// fire sends the time, unless the previous one hasn't been received.
+func (t *fakeTimer) fire(now time.Time) {
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.clock.removeLocked(t)
+}
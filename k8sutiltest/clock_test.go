@@ -0,0 +1,83 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+var epoch = time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// fired returns the time that the channel has been sent, if any.
+func fired(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	timer := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Minute)
+	stopped.Stop()
+	if n := clock.Timers(); n != 1 {
+		t.Errorf("got %d timers, want 1", n)
+	}
+	clock.Advance(59 * time.Second)
+	if _, ok := fired(timer.C()); ok {
+		t.Errorf("fired early")
+	}
+	clock.Advance(2 * time.Second)
+	if got, ok := fired(timer.C()); !ok || !got.Equal(epoch.Add(time.Minute)) {
+		t.Errorf("fired at %v, %v; want %v", got, ok, epoch.Add(time.Minute))
+	}
+	if _, ok := fired(stopped.C()); ok {
+		t.Errorf("stopped timer fired")
+	}
+	if got, want := clock.Now(), epoch.Add(61*time.Second); !got.Equal(want) {
+		t.Errorf("now %v, want %v", got, want)
+	}
+	if n := clock.Timers(); n != 0 {
+		t.Errorf("got %d timers after firing, want 0", n)
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	ticker := clock.NewTicker(time.Second)
+	defer ticker.Stop()
+	clock.Advance(time.Second)
+	if got, ok := fired(ticker.C()); !ok || !got.Equal(epoch.Add(time.Second)) {
+		t.Errorf("first tick at %v, %v", got, ok)
+	}
+	// Ticks that aren't received are dropped.
+	clock.Advance(3 * time.Second)
+	if got, ok := fired(ticker.C()); !ok || !got.Equal(epoch.Add(2*time.Second)) {
+		t.Errorf("second tick at %v, %v", got, ok)
+	}
+	if _, ok := fired(ticker.C()); ok {
+		t.Errorf("kept a dropped tick")
+	}
+	clock.Set(epoch)
+	clock.Advance(time.Second)
+	if _, ok := fired(ticker.C()); ok {
+		t.Errorf("ticked after moving backward")
+	}
+}
+
+func TestFakeClockWaitForTimers(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	if clock.WaitForTimers(1, 10*time.Millisecond) {
+		t.Errorf("waited for a timer that doesn't exist")
+	}
+	go clock.NewTimer(time.Second)
+	if !clock.WaitForTimers(1, 10*time.Second) {
+		t.Errorf("timed out waiting for a timer")
+	}
+}
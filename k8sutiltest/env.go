@@ -0,0 +1,438 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/datawire/k8sutil"
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// UseExistingClusterEnv is the environment variable that, if "true",
+// makes an Environment use the cluster of the current KUBECONFIG
+// context (such as a kind cluster) instead of starting its own.
+const UseExistingClusterEnv = "USE_EXISTING_CLUSTER"
+
+// AssetsEnv is the environment variable naming the directory that an
+// Environment looks for the etcd and kube-apiserver binaries in, as
+// installed by "setup-envtest".
+const AssetsEnv = "KUBEBUILDER_ASSETS"
+
+// An Environment is a Kubernetes apiserver for integration tests: either
+// a kube-apiserver and etcd started for the purpose on localhost, with
+// no controllers or nodes, or an existing cluster.  It is like
+// controller-runtime's envtest, for github.com/ericchiang/k8s clients.
+//
+//	env := &k8sutiltest.Environment{CRDs: []string{"testdata/crd.json"}}
+//	if err := env.Start(ctx); err != nil {
+//		t.Skip(err)
+//	}
+//	defer env.Stop()
+//	store := &k8sutil.WatchingStore{Client: env.Client, ...}
+type Environment struct {
+	// UseExistingCluster makes Start use the cluster of the
+	// current KUBECONFIG context, through "kubectl config view".
+	// It is also set by the UseExistingClusterEnv environment
+	// variable.  CRDs are still registered, and Stop leaves them
+	// in place.
+	UseExistingCluster bool
+
+	// BinaryDir is the directory containing the etcd and
+	// kube-apiserver binaries.  If empty, the AssetsEnv
+	// environment variable is used, and if that is unset, the
+	// PATH is searched.
+	BinaryDir string
+
+	// CRDs are paths to JSON files of
+	// apiextensions.k8s.io/v1 CustomResourceDefinitions, which
+	// Start registers and waits to be established.
+	CRDs []string
+
+	// Output, if set, receives the output of etcd and
+	// kube-apiserver.
+	Output io.Writer
+
+	// StartTimeout is how long Start waits for the apiserver to
+	// become ready.  If zero, 1 minute.
+	StartTimeout time.Duration
+
+	// Client is a client of the apiserver with full access, set
+	// by Start.
+	Client *k8s.Client
+
+	dir       string
+	processes []*exec.Cmd
+}
+
+// Start starts the etcd and kube-apiserver (unless UseExistingCluster),
+// sets Client, and registers the CRDs.
+func (e *Environment) Start(ctx context.Context) error {
+	timeout := e.StartTimeout
+	if timeout == 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if e.UseExistingCluster || os.Getenv(UseExistingClusterEnv) == "true" {
+		e.UseExistingCluster = true
+		client, err := kubeconfigClient(ctx)
+		if err != nil {
+			return err
+		}
+		e.Client = client
+	} else if err := e.startLocal(ctx); err != nil {
+		_ = e.Stop()
+		return err
+	}
+	for _, path := range e.CRDs {
+		if err := e.registerCRD(ctx, path); err != nil {
+			_ = e.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops the etcd and kube-apiserver, if Start started them, and
+// removes their data.
+func (e *Environment) Stop() error {
+	var firstErr error
+	// Stop them in the reverse order of starting them.
+	for i := len(e.processes) - 1; i >= 0; i-- {
+		p := e.processes[i]
+		_ = p.Process.Signal(os.Interrupt)
+		done := make(chan struct{})
+		go func() {
+			_ = p.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			if err := p.Process.Kill(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			<-done
+		}
+	}
+	e.processes = nil
+	if e.dir != "" {
+		if err := os.RemoveAll(e.dir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		e.dir = ""
+	}
+	return firstErr
+}
+
+// kubeconfigClient returns a client for the current KUBECONFIG
+// context.  The KUBECONFIG is YAML, which the k8s package can't parse,
+// so kubectl converts it to JSON.
+func kubeconfigClient(ctx context.Context) (*k8s.Client, error) {
+	out, err := exec.CommandContext(ctx, "kubectl", "config", "view", "--raw", "--minify", "-o", "json").Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "kubectl config view")
+	}
+	var config k8s.Config
+	if err := json.Unmarshal(out, &config); err != nil {
+		return nil, errors.Wrap(err, "kubectl config view")
+	}
+	return k8s.NewClient(&config)
+}
+
+// binary returns the path of the named binary.
+func (e *Environment) binary(name string) (string, error) {
+	dir := e.BinaryDir
+	if dir == "" {
+		dir = os.Getenv(AssetsEnv)
+	}
+	if dir != "" {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	return exec.LookPath(name)
+}
+
+// freePort returns a TCP port on localhost that is not in use.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (e *Environment) start(name string, args ...string) error {
+	path, err := e.binary(name)
+	if err != nil {
+		return errors.Wrapf(err, "find %s (set %s, or put it on the PATH)", name, AssetsEnv)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = e.Output
+	cmd.Stderr = e.Output
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start %s", name)
+	}
+	e.processes = append(e.processes, cmd)
+	return nil
+}
+
+func (e *Environment) startLocal(ctx context.Context) error {
+	dir, err := ioutil.TempDir("", "k8sutiltest")
+	if err != nil {
+		return err
+	}
+	e.dir = dir
+
+	etcdPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	etcdPeerPort, err := freePort()
+	if err != nil {
+		return err
+	}
+	etcdURL := "http://127.0.0.1:" + strconv.Itoa(etcdPort)
+	err = e.start("etcd",
+		"--data-dir="+filepath.Join(dir, "etcd"),
+		"--listen-client-urls="+etcdURL,
+		"--advertise-client-urls="+etcdURL,
+		"--listen-peer-urls=http://127.0.0.1:"+strconv.Itoa(etcdPeerPort),
+		"--unsafe-no-fsync=true")
+	if err != nil {
+		return err
+	}
+
+	certPEM, keyPEM, err := selfSignedCert()
+	if err != nil {
+		return err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{
+		"apiserver.crt": certPEM,
+		"apiserver.key": keyPEM,
+		"tokens.csv":    []byte(token + `,admin,admin,"system:masters"` + "\n"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	err = e.start("kube-apiserver",
+		"--etcd-servers="+etcdURL,
+		"--bind-address=127.0.0.1",
+		"--advertise-address=127.0.0.1",
+		"--secure-port="+strconv.Itoa(port),
+		"--cert-dir="+dir,
+		"--tls-cert-file="+filepath.Join(dir, "apiserver.crt"),
+		"--tls-private-key-file="+filepath.Join(dir, "apiserver.key"),
+		"--token-auth-file="+filepath.Join(dir, "tokens.csv"),
+		"--authorization-mode=RBAC",
+		"--service-cluster-ip-range=10.0.0.0/24",
+		// The serving key does for signing service account
+		// tokens, too.
+		"--service-account-issuer=https://kubernetes.default.svc",
+		"--service-account-key-file="+filepath.Join(dir, "apiserver.key"),
+		"--service-account-signing-key-file="+filepath.Join(dir, "apiserver.key"),
+		"--disable-admission-plugins=ServiceAccount",
+		"--allow-privileged=true")
+	if err != nil {
+		return err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	e.Client = &k8s.Client{
+		Endpoint:  "https://127.0.0.1:" + strconv.Itoa(port),
+		Namespace: "default",
+		SetHeaders: func(h http.Header) error {
+			h.Set("Authorization", "Bearer "+token)
+			return nil
+		},
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		},
+	}
+	return e.waitReady(ctx)
+}
+
+// waitReady waits for the apiserver's /readyz to say that it is ready.
+func (e *Environment) waitReady(ctx context.Context) error {
+	var lastErr error
+	for {
+		lastErr = e.request(ctx, http.MethodGet, "/readyz", nil, nil)
+		if lastErr == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(lastErr, "wait for kube-apiserver to be ready")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// request makes a request of the apiserver, encoding in and decoding
+// the response in to out as JSON.
+func (e *Environment) request(ctx context.Context, verb, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(verb, e.Client.Endpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if e.Client.SetHeaders != nil {
+		if err := e.Client.SetHeaders(req.Header); err != nil {
+			return err
+		}
+	}
+	httpClient := e.Client.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return &k8s.APIError{Code: resp.StatusCode}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// crdPath is where CustomResourceDefinitions are created.
+const crdPath = "/apis/apiextensions.k8s.io/v1/customresourcedefinitions"
+
+// registerCRD creates (or, if it exists, leaves be) the
+// CustomResourceDefinition in the file, and waits for it to be
+// established.
+func (e *Environment) registerCRD(ctx context.Context, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	crd := &k8sutil.Unstructured{}
+	if err := json.Unmarshal(data, crd); err != nil {
+		return errors.Wrapf(err, "CRD %s", path)
+	}
+	name := crd.GetMetadata().GetName()
+	err = e.request(ctx, http.MethodPost, crdPath, crd, nil)
+	var apiErr *k8s.APIError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict) {
+		return errors.Wrapf(err, "create CRD %s", name)
+	}
+	for {
+		var current struct {
+			Status struct {
+				Conditions []struct {
+					Type   string `json:"type"`
+					Status string `json:"status"`
+				} `json:"conditions"`
+			} `json:"status"`
+		}
+		err := e.request(ctx, http.MethodGet, crdPath+"/"+name, nil, &current)
+		if err == nil {
+			for _, condition := range current.Status.Conditions {
+				if condition.Type == "Established" && condition.Status == "True" {
+					return nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("CRD %s was not established", name)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// selfSignedCert returns a certificate, and its key, for serving on
+// localhost, that is its own CA.
+func selfSignedCert() (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "k8sutiltest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+func randomToken() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
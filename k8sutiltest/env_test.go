@@ -0,0 +1,117 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+func TestEnvironmentMissingBinary(t *testing.T) {
+	e := &Environment{BinaryDir: t.TempDir()}
+	err := e.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "find etcd") {
+		t.Fatalf("got error %v, want one finding etcd", err)
+	}
+	if e.dir != "" {
+		t.Errorf("left %s behind", e.dir)
+	}
+}
+
+// TestEnvironmentNotReady checks that Start gives up on an apiserver
+// that doesn't become ready, stopping what it started.
+func TestEnvironmentNotReady(t *testing.T) {
+	bin := t.TempDir()
+	for _, name := range []string{"etcd", "kube-apiserver"} {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := &Environment{BinaryDir: bin, StartTimeout: 300 * time.Millisecond}
+	err := e.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "wait for kube-apiserver to be ready") {
+		t.Fatalf("got error %v, want one waiting to be ready", err)
+	}
+	if len(e.processes) != 0 || e.dir != "" {
+		t.Errorf("left %d processes, and %q, behind", len(e.processes), e.dir)
+	}
+}
+
+// TestRegisterCRD checks that a CRD that already exists is left be,
+// and waited for until it is established.
+func TestRegisterCRD(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusConflict)
+		case http.MethodGet:
+			gets++
+			status := "False"
+			if gets > 1 {
+				status = "True"
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": map[string]interface{}{
+					"conditions": []interface{}{map[string]interface{}{"type": "Established", "status": status}},
+				},
+			})
+		}
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "crd.json")
+	crd := `{"apiVersion": "apiextensions.k8s.io/v1", "kind": "CustomResourceDefinition", "metadata": {"name": "widgets.example.com"}}`
+	if err := ioutil.WriteFile(path, []byte(crd), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Environment{Client: &k8s.Client{Endpoint: server.URL}}
+	if err := e.registerCRD(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"POST " + crdPath,
+		"GET " + crdPath + "/widgets.example.com",
+		"GET " + crdPath + "/widgets.example.com",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Errorf("made requests %q, want %q", requests, want)
+	}
+}
+
+// TestEnvironment starts a real apiserver, if there is one to start.
+func TestEnvironment(t *testing.T) {
+	e := &Environment{}
+	if _, err := e.binary("kube-apiserver"); err != nil && os.Getenv(UseExistingClusterEnv) != "true" {
+		t.Skip(err)
+	}
+	if err := e.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+	var namespaces struct {
+		Items []interface{} `json:"items"`
+	}
+	if err := e.request(context.Background(), http.MethodGet, "/api/v1/namespaces", nil, &namespaces); err != nil {
+		t.Fatal(err)
+	}
+	if len(namespaces.Items) == 0 {
+		t.Errorf("listed no namespaces")
+	}
+}
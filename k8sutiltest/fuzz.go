@@ -0,0 +1,242 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datawire/k8sutil"
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+)
+
+// FuzzT is the part of *testing.T that Fuzz uses.
+type FuzzT interface {
+	TestingT
+	Logf(format string, args ...interface{})
+}
+
+// A FuzzConfig configures Fuzz.  The zero value is a reasonable
+// default.
+type FuzzConfig struct {
+	// Seed seeds the random choices.  If zero, a seed is chosen
+	// from the time.  Either way, it is logged, so that a failure
+	// can be reproduced.
+	Seed int64
+
+	// Namespaces is the number of namespaces, each of which is
+	// watched separately.  If zero, 3.
+	Namespaces int
+
+	// Names is the number of names that resources in each
+	// namespace are chosen from.  If zero, 5.
+	Names int
+
+	// Steps is the number of changes to make.  If zero, 200.
+	Steps int
+
+	// CheckEvery is how many steps to take between checks that
+	// the store has converged.  If zero, 10.
+	CheckEvery int
+
+	// Verbose makes the WatchingStore log to the test.
+	Verbose bool
+}
+
+func (c FuzzConfig) withDefaults() FuzzConfig {
+	if c.Seed == 0 {
+		c.Seed = time.Now().UnixNano()
+	}
+	if c.Namespaces <= 0 {
+		c.Namespaces = 3
+	}
+	if c.Names <= 0 {
+		c.Names = 5
+	}
+	if c.Steps <= 0 {
+		c.Steps = 200
+	}
+	if c.CheckEvery <= 0 {
+		c.CheckEvery = 10
+	}
+	return c
+}
+
+// Fuzz drives a WatchingStore, with a watch of the Pods in each of
+// several namespaces, through a random interleaving of creations,
+// modifications, and deletions in a simulated cluster, along with
+// dropped connections and expired watches (which force every watch to
+// re-list).  Every so often, and at the end, it checks that the Store
+// converges to the simulated cluster's state, and fails the test if it
+// doesn't.
+func Fuzz(t FuzzT, config FuzzConfig) {
+	t.Helper()
+	config = config.withDefaults()
+	t.Logf("fuzz seed: %d", config.Seed)
+	f := &fuzzer{
+		t:       t,
+		config:  config,
+		rng:     rand.New(rand.NewSource(config.Seed)),
+		backend: NewScriptedBackend(t),
+		cluster: make(map[string]map[string]string),
+	}
+	var logger k8sutil.Logger = discardLogger{}
+	if config.Verbose {
+		logger = Logger(t)
+	}
+	f.store = &k8sutil.WatchingStore{
+		Backend:  f.backend,
+		Logger:   logger,
+		Callback: func(k8sutil.Store) {},
+	}
+	for i := 0; i < config.Namespaces; i++ {
+		namespace := fmt.Sprintf("ns%d", i)
+		f.namespaces = append(f.namespaces, namespace)
+		f.cluster[namespace] = make(map[string]string)
+		f.store.AddWatch(namespace, &corev1.PodList{})
+		f.stream(namespace).List(f.listing(namespace))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.store.Run(ctx) }()
+	defer func() {
+		cancel()
+		<-errCh
+	}()
+	for _, namespace := range f.namespaces {
+		f.stream(namespace).WaitForWatch(1)
+	}
+
+	for step := 1; step <= config.Steps; step++ {
+		f.step()
+		if step%config.CheckEvery == 0 {
+			f.check(step)
+		}
+	}
+	f.check(config.Steps)
+}
+
+type fuzzer struct {
+	t          FuzzT
+	config     FuzzConfig
+	rng        *rand.Rand
+	backend    *ScriptedBackend
+	store      *k8sutil.WatchingStore
+	namespaces []string
+	cluster    map[string]map[string]string // the resourceVersions, by namespace and name
+	version    int                          // the cluster's resourceVersion
+	log        []string                     // of the steps taken
+}
+
+func (f *fuzzer) stream(namespace string) *Stream {
+	return f.backend.Stream(namespace, &corev1.PodList{})
+}
+
+// listing returns what a list of the namespace returns.
+func (f *fuzzer) listing(namespace string) *corev1.PodList {
+	list := &corev1.PodList{Metadata: ListMeta(fmt.Sprint(f.version))}
+	for name, resourceVersion := range f.cluster[namespace] {
+		list.Items = append(list.Items, &corev1.Pod{Metadata: ObjectMeta(namespace, name, resourceVersion)})
+	}
+	return list
+}
+
+// step makes one random change.
+func (f *fuzzer) step() {
+	f.t.Helper()
+	namespace := f.namespaces[f.rng.Intn(len(f.namespaces))]
+	name := fmt.Sprintf("pod%d", f.rng.Intn(f.config.Names))
+	s := f.stream(namespace)
+	_, exists := f.cluster[namespace][name]
+	switch n := f.rng.Intn(20); {
+	case n < 2:
+		f.log = append(f.log, "disconnect "+namespace)
+		watches := s.Watches()
+		s.Disconnect()
+		s.WaitForWatch(watches + 1)
+	case n < 3:
+		f.log = append(f.log, "expire "+namespace)
+		watches := make(map[string]int)
+		for _, namespace := range f.namespaces {
+			watches[namespace] = f.stream(namespace).Watches()
+		}
+		s.Expire()
+		// Every watch starts over.
+		for _, namespace := range f.namespaces {
+			f.stream(namespace).List(f.listing(namespace))
+		}
+		for _, namespace := range f.namespaces {
+			f.stream(namespace).WaitForWatch(watches[namespace] + 1)
+		}
+	default:
+		f.version++
+		resourceVersion := fmt.Sprint(f.version)
+		pod := &corev1.Pod{Metadata: ObjectMeta(namespace, name, resourceVersion)}
+		var eventType string
+		switch {
+		case !exists:
+			eventType = k8s.EventAdded
+			f.cluster[namespace][name] = resourceVersion
+		case n < 8:
+			eventType = k8s.EventDeleted
+			delete(f.cluster[namespace], name)
+		default:
+			eventType = k8s.EventModified
+			f.cluster[namespace][name] = resourceVersion
+		}
+		f.log = append(f.log, fmt.Sprintf("%s %s/%s@%s", eventType, namespace, name, resourceVersion))
+		s.Send(eventType, pod)
+	}
+}
+
+// want renders the cluster's state as Render renders the Store.
+func (f *fuzzer) want() string {
+	var keys []k8sutil.ObjectKey
+	for namespace, names := range f.cluster {
+		for name := range names {
+			keys = append(keys, k8sutil.ObjectKey{Namespace: namespace, Name: name})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Namespace != keys[j].Namespace {
+			return keys[i].Namespace < keys[j].Namespace
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	resources := []string{"(none)"}
+	if len(keys) > 0 {
+		resources = resources[:0]
+	}
+	for _, key := range keys {
+		resources = append(resources, fmt.Sprintf("%s@%s", key, f.cluster[key.Namespace][key.Name]))
+	}
+	return typeName(&corev1.Pod{}) + ": " + strings.Join(resources, " ")
+}
+
+// check waits for the Store to converge to the cluster's state.
+func (f *fuzzer) check(step int) {
+	f.t.Helper()
+	want := f.want()
+	var got string
+	deadline := time.Now().Add(f.backend.timeout())
+	for time.Now().Before(deadline) {
+		if store, err := f.store.Snapshot(); err == nil {
+			if got = Render(store, &corev1.Pod{}); got == want {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f.t.Fatalf("seed %d, step %d: the store did not converge:\n\tgot  %s\n\twant %s\nsteps:\n\t%s",
+		f.config.Seed, step, got, want, strings.Join(f.log, "\n\t"))
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Errorf(string, ...interface{}) {}
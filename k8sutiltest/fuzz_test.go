@@ -0,0 +1,24 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest_test
+
+import (
+	"testing"
+
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// FuzzWatchingStore runs the convergence check of Fuzz with each seed;
+// "go test" runs the seeds added here, and "go test -fuzz" finds more.
+func FuzzWatchingStore(f *testing.F) {
+	for _, seed := range []int64{1, 2, 3, 42, 1000} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, seed int64) {
+		if seed == 0 {
+			// Zero means a seed chosen from the time.
+			seed = 1
+		}
+		k8sutiltest.Fuzz(t, k8sutiltest.FuzzConfig{Seed: seed, Steps: 100})
+	})
+}
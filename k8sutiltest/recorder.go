@@ -0,0 +1,132 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutiltest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/datawire/k8sutil"
+	"github.com/ericchiang/k8s"
+)
+
+// A Recorder records each Store that it is called with, rendered with
+// Render, so that a test can compare the sequence of snapshots with
+// the one that a script should produce.  Use its Callback as a
+// WatchingStore's Callback (and OnSync, if the test uses it).
+type Recorder struct {
+	// Timeout is how long Expect waits for each snapshot.  If
+	// zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	samples   []k8s.Resource
+	snapshots chan string
+}
+
+// NewRecorder returns a Recorder that renders the resources of the
+// types of the samples.
+func NewRecorder(samples ...k8s.Resource) *Recorder {
+	return &Recorder{
+		samples:   samples,
+		snapshots: make(chan string, 1000),
+	}
+}
+
+// Callback records the store.
+func (r *Recorder) Callback(store k8sutil.Store) {
+	r.snapshots <- Render(store, r.samples...)
+}
+
+func (r *Recorder) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DefaultTimeout
+}
+
+// Next returns the next snapshot, waiting up to the timeout for it.
+func (r *Recorder) Next(timeout time.Duration) (string, bool) {
+	select {
+	case snapshot := <-r.snapshots:
+		return snapshot, true
+	case <-time.After(timeout):
+		return "", false
+	}
+}
+
+// Expect fails the test unless the next snapshots are the wanted ones,
+// in order.
+func (r *Recorder) Expect(t TestingT, want ...string) {
+	t.Helper()
+	for i, w := range want {
+		got, ok := r.Next(r.timeout())
+		if !ok {
+			t.Fatalf("snapshot %d of %d: timed out waiting for\n\t%s", i+1, len(want), w)
+			return
+		}
+		if got != w {
+			t.Fatalf("snapshot %d of %d:\n\tgot  %s\n\twant %s", i+1, len(want), got, w)
+			return
+		}
+	}
+}
+
+// ExpectNone fails the test if there is a snapshot within d.
+func (r *Recorder) ExpectNone(t TestingT, d time.Duration) {
+	t.Helper()
+	if got, ok := r.Next(d); ok {
+		t.Fatalf("unexpected snapshot: %s", got)
+	}
+}
+
+// Render describes the resources in the store, of the types of the
+// samples, in a form that is stable and easy to compare: for each
+// type, its name followed by the namespace, name, and resourceVersion
+// of each resource, sorted:
+//
+//	v1 Pod: default/a@12 default/b@9; v1 Service: (none)
+func Render(store k8sutil.Store, samples ...k8s.Resource) string {
+	parts := make([]string, len(samples))
+	for i, sample := range samples {
+		var resources []string
+		for _, resource := range store.ListSorted(sample) {
+			metadata := resource.GetMetadata()
+			resources = append(resources, fmt.Sprintf("%s/%s@%s",
+				metadata.GetNamespace(), metadata.GetName(), metadata.GetResourceVersion()))
+		}
+		if len(resources) == 0 {
+			resources = []string{"(none)"}
+		}
+		parts[i] = typeName(sample) + ": " + strings.Join(resources, " ")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// typeName names the sample's type.
+func typeName(sample k8s.Resource) string {
+	if gvk, err := k8sutil.GVKOf(sample); err == nil {
+		return gvk.String()
+	}
+	return fmt.Sprintf("%T", sample)
+}
+
+// Logger returns a k8sutil.Logger that logs to the test.
+func Logger(t interface {
+	Logf(format string, args ...interface{})
+}) k8sutil.Logger {
+	return testLogger{t}
+}
+
+type testLogger struct {
+	t interface {
+		Logf(format string, args ...interface{})
+	}
+}
+
+func (l testLogger) Errorf(format string, args ...interface{}) {
+	if h, ok := l.t.(interface{ Helper() }); ok {
+		h.Helper()
+	}
+	l.t.Logf(format, args...)
+}
@@ -0,0 +1,420 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	admissionregistrationv1beta1 "github.com/ericchiang/k8s/apis/admissionregistration/v1beta1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	extensionsv1beta1 "github.com/ericchiang/k8s/apis/extensions/v1beta1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+	"github.com/ericchiang/k8s/util/intstr"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+)
+
+// The k8s package's types are generated from the apiserver's protobuf
+// definitions, and encoding/json encodes them as those definitions
+// are, not as the apiserver encodes them as JSON: a Quantity is
+// {"string":"100m"} rather than "100m", an IntOrString is
+// {"type":0,"intVal":8080} rather than 8080, and a MicroTime is
+// {"seconds":...,"nanos":...} rather than a timestamp, and the fields
+// of embedded structs, such as a Probe's Handler, are nested rather
+// than inline.  Anything that
+// is sent to the apiserver as JSON, or compared with what it sends as
+// JSON, must go through marshalKubeJSON and unmarshalKubeJSON instead.
+
+var (
+	quantityType    = reflect.TypeOf(resource.Quantity{})
+	intOrStringType = reflect.TypeOf(intstr.IntOrString{})
+	timeType        = reflect.TypeOf(metav1.Time{})
+	microTimeType   = reflect.TypeOf(metav1.MicroTime{})
+)
+
+// inlined names, for each of the k8s package's types that has one, the
+// field that is an embedded struct in the apiserver's type, whose
+// fields it encodes inline.
+var inlined = map[reflect.Type]string{
+	reflect.TypeOf(admissionregistrationv1beta1.RuleWithOperations{}): "Rule",
+	reflect.TypeOf(corev1.ConfigMapEnvSource{}):                       "LocalObjectReference",
+	reflect.TypeOf(corev1.ConfigMapKeySelector{}):                     "LocalObjectReference",
+	reflect.TypeOf(corev1.ConfigMapProjection{}):                      "LocalObjectReference",
+	reflect.TypeOf(corev1.ConfigMapVolumeSource{}):                    "LocalObjectReference",
+	reflect.TypeOf(corev1.PersistentVolumeSpec{}):                     "PersistentVolumeSource",
+	reflect.TypeOf(corev1.Probe{}):                                    "Handler",
+	reflect.TypeOf(corev1.SecretEnvSource{}):                          "LocalObjectReference",
+	reflect.TypeOf(corev1.SecretKeySelector{}):                        "LocalObjectReference",
+	reflect.TypeOf(corev1.SecretProjection{}):                         "LocalObjectReference",
+	reflect.TypeOf(corev1.Volume{}):                                   "VolumeSource",
+	reflect.TypeOf(extensionsv1beta1.IngressRule{}):                   "IngressRuleValue",
+}
+
+// The layouts of Time and MicroTime in the apiserver's JSON.
+const (
+	timeLayout      = time.RFC3339
+	microTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// marshalKubeJSON encodes the resource as the apiserver would encode
+// it as JSON.  Resources that aren't of the k8s package's types, such
+// as *Unstructured, are encoded with encoding/json.
+func marshalKubeJSON(r k8s.Resource) ([]byte, error) {
+	if _, ok := r.(proto.Message); !ok {
+		return json.Marshal(r)
+	}
+	return json.Marshal(kubeJSONValue(reflect.ValueOf(r)))
+}
+
+// unmarshalKubeJSON decodes the apiserver's JSON encoding of a
+// resource in to r, which is the inverse of marshalKubeJSON.
+func unmarshalKubeJSON(data []byte, r k8s.Resource) error {
+	if _, ok := r.(proto.Message); !ok {
+		return json.Unmarshal(data, r)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	return setKubeJSONValue(reflect.ValueOf(r).Elem(), value)
+}
+
+// kubeJSONValue returns a value that encoding/json encodes as the
+// apiserver would encode v.
+func kubeJSONValue(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Type() {
+	case quantityType:
+		if s := v.FieldByName("String_"); !s.IsNil() {
+			return s.Elem().String()
+		}
+		return nil
+	case intOrStringType:
+		if t := v.FieldByName("Type"); !t.IsNil() && t.Elem().Int() == 1 {
+			if s := v.FieldByName("StrVal"); !s.IsNil() {
+				return s.Elem().String()
+			}
+			return ""
+		}
+		if i := v.FieldByName("IntVal"); !i.IsNil() {
+			return i.Elem().Int()
+		}
+		return 0
+	case timeType, microTimeType:
+		var seconds, nanos int64
+		if s := v.FieldByName("Seconds"); !s.IsNil() {
+			seconds = s.Elem().Int()
+		}
+		if n := v.FieldByName("Nanos"); !n.IsNil() {
+			nanos = n.Elem().Int()
+		}
+		t := time.Unix(seconds, nanos).UTC()
+		if v.Type() == timeType {
+			return t.Format(timeLayout)
+		}
+		return t.Format(microTimeLayout)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		object := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, omitEmpty, ok := jsonField(t.Field(i))
+			if !ok {
+				continue
+			}
+			field := v.Field(i)
+			if omitEmpty && isEmptyJSONValue(field) {
+				continue
+			}
+			value := kubeJSONValue(field)
+			if t.Field(i).Name == inlined[t] {
+				if fields, ok := value.(map[string]interface{}); ok {
+					for name, value := range fields {
+						object[name] = value
+					}
+				}
+				continue
+			}
+			object[name] = value
+		}
+		return object
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// encoding/json encodes it in base64.
+			return v.Bytes()
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = kubeJSONValue(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		object := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			object[key.String()] = kubeJSONValue(v.MapIndex(key))
+		}
+		return object
+	}
+	return v.Interface()
+}
+
+// setKubeJSONValue sets v to value, as decoded (with UseNumber) from
+// the apiserver's JSON encoding of something of v's type.  Unknown
+// fields are ignored, as encoding/json ignores them.
+func setKubeJSONValue(v reflect.Value, value interface{}) error {
+	if value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setKubeJSONValue(v.Elem(), value)
+	}
+	mismatch := func() error {
+		return errors.Errorf("cannot decode %v in to %s", value, v.Type())
+	}
+	switch v.Type() {
+	case quantityType:
+		switch value := value.(type) {
+		case string, json.Number:
+			// A Quantity may be written as a plain number.
+			v.Set(reflect.ValueOf(resource.Quantity{String_: k8s.String(fmt.Sprint(value))}))
+			return nil
+		}
+		return mismatch()
+	case intOrStringType:
+		switch value := value.(type) {
+		case string:
+			v.Set(reflect.ValueOf(intstr.IntOrString{Type: int64Ptr(1), StrVal: k8s.String(value)}))
+			return nil
+		case json.Number:
+			i, err := value.Int64()
+			if err != nil {
+				return mismatch()
+			}
+			v.Set(reflect.ValueOf(intstr.IntOrString{Type: int64Ptr(0), IntVal: k8s.Int32(int32(i))}))
+			return nil
+		}
+		return mismatch()
+	case timeType, microTimeType:
+		s, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return errors.Wrapf(err, "decode %s", v.Type())
+		}
+		v.FieldByName("Seconds").Set(reflect.ValueOf(int64Ptr(t.Unix())))
+		if t.Nanosecond() != 0 {
+			v.FieldByName("Nanos").Set(reflect.ValueOf(k8s.Int32(int32(t.Nanosecond()))))
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, _, ok := jsonField(t.Field(i))
+			if !ok {
+				continue
+			}
+			if t.Field(i).Name == inlined[t] {
+				if hasJSONFields(t.Field(i).Type, object) {
+					if err := setKubeJSONValue(v.Field(i), object); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if fieldValue, ok := object[name]; ok {
+				if err := setKubeJSONValue(v.Field(i), fieldValue); err != nil {
+					return errors.Wrap(err, name)
+				}
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s, ok := value.(string)
+			if !ok {
+				return mismatch()
+			}
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return errors.Wrapf(err, "decode %s", v.Type())
+			}
+			v.SetBytes(data)
+			return nil
+		}
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setKubeJSONValue(slice.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(object))
+		for key, item := range object {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setKubeJSONValue(elem, item); err != nil {
+				return errors.Wrap(err, key)
+			}
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		v.Set(m)
+		return nil
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch()
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		i, err := n.Int64()
+		if err != nil || v.OverflowInt(i) {
+			return mismatch()
+		}
+		v.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		i, err := strconv.ParseUint(n.String(), 10, 64)
+		if err != nil || v.OverflowUint(i) {
+			return mismatch()
+		}
+		v.SetUint(i)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		n, ok := value.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return mismatch()
+		}
+		v.SetFloat(f)
+		return nil
+	}
+	return errors.Errorf("cannot decode in to %s", v.Type())
+}
+
+// int64Ptr returns a pointer to i; the k8s package has no k8s.Int64.
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+// jsonField returns the name that encoding/json gives the struct
+// field, and whether it is omitted when empty; ok is false for fields
+// that encoding/json skips.
+func jsonField(f reflect.StructField) (name string, omitEmpty bool, ok bool) {
+	if f.PkgPath != "" {
+		return "", false, false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	parts := strings.Split(tag, ",")
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+	return name, omitEmpty, true
+}
+
+// hasJSONFields returns whether the object has any of the fields of
+// the struct type t.
+func hasJSONFields(t reflect.Type, object map[string]interface{}) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, ok := jsonField(t.Field(i)); ok {
+			if _, ok := object[name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isEmptyJSONValue returns whether encoding/json considers v empty, for
+// "omitempty".
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+	"github.com/ericchiang/k8s/util/intstr"
+)
+
+// testDeployment returns a Deployment with the fields that the k8s
+// package's types don't encode as the apiserver does.
+func testDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		Metadata: &metav1.ObjectMeta{
+			Namespace:         k8s.String("default"),
+			Name:              k8s.String("web"),
+			CreationTimestamp: &metav1.Time{Seconds: int64Ptr(1546300800)},
+		},
+		Spec: &appsv1.DeploymentSpec{
+			Replicas: k8s.Int32(2),
+			Strategy: &appsv1.DeploymentStrategy{RollingUpdate: &appsv1.RollingUpdateDeployment{
+				MaxSurge:       &intstr.IntOrString{Type: int64Ptr(1), StrVal: k8s.String("25%")},
+				MaxUnavailable: &intstr.IntOrString{Type: int64Ptr(0), IntVal: k8s.Int32(1)},
+			}},
+			Template: &corev1.PodTemplateSpec{Spec: &corev1.PodSpec{
+				Containers: []*corev1.Container{{
+					Name:  k8s.String("web"),
+					Ports: []*corev1.ContainerPort{{ContainerPort: k8s.Int32(8080)}},
+					Resources: &corev1.ResourceRequirements{
+						Requests: map[string]*resource.Quantity{"cpu": {String_: k8s.String("100m")}},
+						Limits:   map[string]*resource.Quantity{"memory": {String_: k8s.String("64Mi")}},
+					},
+					ReadinessProbe: &corev1.Probe{Handler: &corev1.Handler{HttpGet: &corev1.HTTPGetAction{
+						Path: k8s.String("/healthz"),
+						Port: &intstr.IntOrString{Type: int64Ptr(1), StrVal: k8s.String("http")},
+					}}},
+				}},
+				Volumes: []*corev1.Volume{{
+					Name: k8s.String("config"),
+					VolumeSource: &corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+						LocalObjectReference: &corev1.LocalObjectReference{Name: k8s.String("web")},
+					}},
+				}},
+			}},
+		},
+	}
+}
+
+// testDeploymentJSON is testDeployment as the apiserver encodes it.
+const testDeploymentJSON = `{
+	"metadata": {"namespace": "default", "name": "web", "creationTimestamp": "2019-01-01T00:00:00Z"},
+	"spec": {
+		"replicas": 2,
+		"strategy": {"rollingUpdate": {"maxSurge": "25%", "maxUnavailable": 1}},
+		"template": {"spec": {"containers": [{
+			"name": "web",
+			"ports": [{"containerPort": 8080}],
+			"resources": {"requests": {"cpu": "100m"}, "limits": {"memory": "64Mi"}},
+			"readinessProbe": {"httpGet": {"path": "/healthz", "port": "http"}}
+		}],
+		"volumes": [{"name": "config", "configMap": {"name": "web"}}]}}
+	}
+}`
+
+func TestMarshalKubeJSON(t *testing.T) {
+	data, err := marshalKubeJSON(testDeployment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(testDeploymentJSON), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s", data)
+	}
+}
+
+func TestUnmarshalKubeJSON(t *testing.T) {
+	var got appsv1.Deployment
+	if err := unmarshalKubeJSON([]byte(testDeploymentJSON), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := testDeployment(); !reflect.DeepEqual(&got, want) {
+		t.Errorf("got %v, want %v", &got, want)
+	}
+
+	// A Quantity may be a plain number, and bytes are base64.
+	var secret corev1.Secret
+	if err := unmarshalKubeJSON([]byte(`{"data": {"k": "dg=="}}`), &secret); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["k"]) != "v" {
+		t.Errorf("got data %q", secret.Data)
+	}
+	var limitRange corev1.LimitRange
+	if err := unmarshalKubeJSON([]byte(`{"spec": {"limits": [{"max": {"cpu": 2}}]}}`), &limitRange); err != nil {
+		t.Fatal(err)
+	}
+	if cpu := limitRange.GetSpec().GetLimits()[0].GetMax()["cpu"].GetString_(); cpu != "2" {
+		t.Errorf("got cpu %q", cpu)
+	}
+	if err := unmarshalKubeJSON([]byte(`{"spec": {"replicas": "2"}}`), &got); err == nil {
+		t.Errorf("decoded a string as a number")
+	}
+}
+
+// TestApplySetKubeJSON checks that an ApplySet applies typed resources
+// in the apiserver's JSON encoding, and doesn't see what it applied as
+// drift.
+func TestApplySetKubeJSON(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	a := &ApplySet{Client: &k8s.Client{Endpoint: server.URL, Client: server.Client()}, Name: "set"}
+	desired := testDeployment()
+	if _, err := a.write(context.Background(), http.MethodPost, desired, nil); err != nil {
+		t.Fatal(err)
+	}
+	var sent, want map[string]interface{}
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(testDeploymentJSON), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sent["spec"], want["spec"]) {
+		t.Errorf("applied %s", body)
+	}
+
+	var applied appsv1.Deployment
+	if err := unmarshalKubeJSON(body, &applied); err != nil {
+		t.Fatal(err)
+	}
+	if drifted, err := a.drifted(desired, &applied); err != nil || drifted {
+		t.Errorf("what was applied has drifted: %v, %v", drifted, err)
+	}
+	applied.Spec.Template.Spec.Containers[0].Resources.Requests["cpu"].String_ = k8s.String("200m")
+	if drifted, err := a.drifted(desired, &applied); err != nil || !drifted {
+		t.Errorf("a changed request hasn't drifted: %v, %v", drifted, err)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// DefaultLabelConcurrency is how many resources LabelAll patches at
+// once if the Concurrency of its LabelOptions is zero.
+const DefaultLabelConcurrency = 4
+
+// labelConflictRetries is how many times LabelAll retries patching a
+// resource that keeps changing under it.
+const labelConflictRetries = 5
+
+// LabelOptions are the options of LabelAll.
+type LabelOptions struct {
+	// Concurrency is how many resources to patch at once.  If zero,
+	// DefaultLabelConcurrency is used.
+	Concurrency int
+
+	// Progress, if set, is called as each resource is done with,
+	// from the goroutine that patched it.
+	Progress func(LabelProgress)
+
+	// Discovery, if set, is used to find the resource type of
+	// Unstructured resources.
+	Discovery *Discovery
+
+	// DryRun patches the resources with server-side dry run, so that
+	// the count, and the Progress, are of the resources that would
+	// have been patched (and that the apiserver would have allowed
+	// to be), without changing any.
+	DryRun bool
+}
+
+// LabelProgress is the outcome of LabelAll for one resource.
+type LabelProgress struct {
+	Resource ObjectKey
+	Changed  bool  // whether it was patched
+	Err      error // why it couldn't be, if it couldn't
+	Done     int   // the number of resources done with so far
+	Total    int
+}
+
+// LabelAll changes the labels and annotations of every resource of the
+// type in the store that matches the label selector (or of every one,
+// if it is empty), for migrations and re-labeling.  The mutate function
+// is given a resource and copies of its labels and annotations to
+// change, which LabelAll then patches; resources whose labels and
+// annotations mutate leaves as they were aren't patched.  The patches
+// are made against the resources as they are in the cluster: if one has
+// changed since the store saw it, its labels and annotations are read
+// again, and mutate is called again with them (and the resource from
+// the store).  Mutate may be called from several goroutines at once.
+//
+// LabelAll returns the number of resources that it patched, and an
+// error if any couldn't be.
+func LabelAll(ctx context.Context, client *k8s.Client, store Store, resourceType k8s.Resource, selector string,
+	mutate func(resource k8s.Resource, labels, annotations map[string]string), options LabelOptions) (int, error) {
+	matches, err := parseLabelSelector(selector)
+	if err != nil {
+		return 0, err
+	}
+	var resources []k8s.Resource
+	for _, resource := range store.ListSorted(resourceType) {
+		if matches(resource.GetMetadata().GetLabels()) {
+			resources = append(resources, resource)
+		}
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultLabelConcurrency
+	}
+
+	var mu sync.Mutex
+	var changed, done, failed int
+	var firstErr error
+	work := make(chan k8s.Resource)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for resource := range work {
+				ok, err := labelResource(ctx, client, options, resource, matches, mutate)
+				mu.Lock()
+				done++
+				if ok {
+					changed++
+				}
+				if err != nil {
+					failed++
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+				progress := LabelProgress{Resource: objectKeyOf(resource), Changed: ok, Err: err, Done: done, Total: len(resources)}
+				mu.Unlock()
+				if options.Progress != nil {
+					options.Progress(progress)
+				}
+			}
+		}()
+	}
+feed:
+	for _, resource := range resources {
+		select {
+		case work <- resource:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if ctx.Err() != nil && done < len(resources) {
+		return changed, errors.Wrapf(ctx.Err(), "label: %d of %d resources done", done, len(resources))
+	}
+	if failed > 0 {
+		return changed, errors.Wrapf(firstErr, "label: %d of %d resources failed, the first", failed, len(resources))
+	}
+	return changed, nil
+}
+
+// labelMetadata is the metadata that LabelAll reads again after a
+// conflict.
+type labelMetadata struct {
+	Metadata struct {
+		UID             string            `json:"uid"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+}
+
+// labelResource patches the labels and annotations of the resource with
+// mutate, and returns whether it changed them.
+func labelResource(ctx context.Context, client *k8s.Client, options LabelOptions, resource k8s.Resource,
+	matches func(map[string]string) bool, mutate func(k8s.Resource, map[string]string, map[string]string)) (bool, error) {
+	key := objectKeyOf(resource)
+	apiResource, err := discoverAPIResource(ctx, options.Discovery, "LabelAll", resource)
+	if err != nil {
+		return false, errors.Wrapf(err, "label %s", key)
+	}
+	path := apiResource.Path(key.Namespace) + "/" + url.PathEscape(key.Name)
+
+	var current labelMetadata
+	md := resource.GetMetadata()
+	current.Metadata.UID = md.GetUid()
+	current.Metadata.ResourceVersion = md.GetResourceVersion()
+	current.Metadata.Labels = md.GetLabels()
+	current.Metadata.Annotations = md.GetAnnotations()
+	for attempt := 0; ; attempt++ {
+		labels := copyStringMap(current.Metadata.Labels)
+		annotations := copyStringMap(current.Metadata.Annotations)
+		mutate(resource, labels, annotations)
+		labelsPatch := stringMapPatch(current.Metadata.Labels, labels)
+		annotationsPatch := stringMapPatch(current.Metadata.Annotations, annotations)
+		if len(labelsPatch) == 0 && len(annotationsPatch) == 0 {
+			return false, nil
+		}
+		metadata := map[string]interface{}{
+			// Make it conflict if the resource has changed.
+			"resourceVersion": current.Metadata.ResourceVersion,
+		}
+		if len(labelsPatch) > 0 {
+			metadata["labels"] = labelsPatch
+		}
+		if len(annotationsPatch) > 0 {
+			metadata["annotations"] = annotationsPatch
+		}
+		err := doJSON(ctx, client, request{verb: http.MethodPatch, path: path, contentType: MergePatchType, dryRun: options.DryRun},
+			map[string]interface{}{"metadata": metadata}, nil)
+		switch code := apiErrorCode(err); {
+		case err == nil:
+			return true, nil
+		case code == http.StatusNotFound:
+			return false, nil
+		case code != http.StatusConflict || attempt == labelConflictRetries:
+			return false, errors.Wrapf(err, "label %s", key)
+		}
+
+		uid := current.Metadata.UID
+		current = labelMetadata{}
+		if err := getJSON(ctx, client, path, &current); err != nil {
+			if apiErrorCode(err) == http.StatusNotFound {
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "label %s", key)
+		}
+		if current.Metadata.UID != uid || !matches(current.Metadata.Labels) {
+			// It has been replaced, or no longer matches.
+			return false, nil
+		}
+	}
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// stringMapPatch returns the merge patch from the old map to the new
+// one, with nil for the keys that have been removed.
+func stringMapPatch(old, new map[string]string) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for k, v := range new {
+		if ov, ok := old[k]; !ok || ov != v {
+			patch[k] = v
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	return patch
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// syncedSnapshot returns a snapshot of a WatchingStore of the lists on
+// the fakeAPIServer, once it has synced.
+func syncedSnapshot(t *testing.T, server *fakeAPIServer, lists ...k8s.ResourceList) k8sutil.Store {
+	t.Helper()
+	store, err := syncedWatchingStore(t, server, lists...).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// syncedWatchingStore returns a WatchingStore of the lists on the
+// fakeAPIServer, once it has synced.
+func syncedWatchingStore(t *testing.T, server *fakeAPIServer, lists ...k8s.ResourceList) *k8sutil.WatchingStore {
+	t.Helper()
+	synced := make(chan struct{}, 1)
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: testLogger{t},
+		Callback: func(k8sutil.Store) {
+			select {
+			case synced <- struct{}{}:
+			default:
+			}
+		},
+	}
+	for _, list := range lists {
+		w.AddWatch("", list)
+	}
+	runStore(t, w)
+	<-synced
+	return w
+}
+
+func labeledConfigMap(namespace, name string, labels map[string]string) *corev1.ConfigMap {
+	cm := newConfigMap(namespace, name)
+	cm.Metadata.Labels = labels
+	return cm
+}
+
+func TestLabelAll(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(labeledConfigMap("default", "done", map[string]string{"app": "web", "tier": "front"}))
+	server.set(labeledConfigMap("default", "todo", map[string]string{"app": "web", "old": "x"}))
+	stale := labeledConfigMap("default", "stale", map[string]string{"app": "web"})
+	server.set(stale)
+	server.set(labeledConfigMap("default", "other", map[string]string{"app": "db"}))
+	store := syncedSnapshot(t, server, &corev1.ConfigMapList{})
+	server.drain()
+	// It changes after the store saw it, so that the first patch
+	// conflicts.
+	stale.Metadata.Annotations = map[string]string{"changed": "yes"}
+	server.set(stale)
+
+	var mu sync.Mutex
+	var progress []string
+	n, err := k8sutil.LabelAll(context.Background(), server.client(), store, &corev1.ConfigMap{}, "app=web",
+		func(resource k8s.Resource, labels, annotations map[string]string) {
+			labels["tier"] = "front"
+			delete(labels, "old")
+			annotations["migrated"] = "true"
+		}, k8sutil.LabelOptions{
+			Progress: func(p k8sutil.LabelProgress) {
+				mu.Lock()
+				defer mu.Unlock()
+				if p.Err != nil || p.Total != 3 {
+					t.Errorf("progress %+v", p)
+				}
+				progress = append(progress, p.Resource.Name)
+			},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("patched %d resources, want 3", n)
+	}
+	sort.Strings(progress)
+	if len(progress) != 3 {
+		t.Errorf("got progress of %v", progress)
+	}
+	conflicted := false
+	for _, line := range server.drain() {
+		if strings.HasPrefix(line, "PATCH /api/v1/namespaces/default/configmaps/stale") && strings.HasSuffix(line, "-> 409") {
+			conflicted = true
+		}
+	}
+	if !conflicted {
+		t.Errorf("the patch of the stale resource didn't conflict")
+	}
+
+	for _, name := range []string{"done", "todo", "stale"} {
+		cm := configMapOf(t, server.object(newConfigMap("default", name)))
+		labels := cm.Metadata.Labels
+		if labels["tier"] != "front" || labels["app"] != "web" || labels["old"] != "" {
+			t.Errorf("%s: got labels %v", name, labels)
+		}
+		if cm.Metadata.Annotations["migrated"] != "true" {
+			t.Errorf("%s: got annotations %v", name, cm.Metadata.Annotations)
+		}
+	}
+	if cm := configMapOf(t, server.object(newConfigMap("default", "stale"))); cm.Metadata.Annotations["changed"] != "yes" {
+		t.Errorf("the retried patch lost the change made in between: %v", cm.Metadata.Annotations)
+	}
+	if cm := configMapOf(t, server.object(newConfigMap("default", "other"))); cm.Metadata.Labels["tier"] != "" {
+		t.Errorf("labeled a resource that doesn't match: %v", cm.Metadata.Labels)
+	}
+}
+
+func TestLabelAllUnchanged(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(labeledConfigMap("default", "a", map[string]string{"app": "web"}))
+	store := syncedSnapshot(t, server, &corev1.ConfigMapList{})
+	server.drain()
+	n, err := k8sutil.LabelAll(context.Background(), server.client(), store, &corev1.ConfigMap{}, "",
+		func(k8s.Resource, map[string]string, map[string]string) {}, k8sutil.LabelOptions{})
+	if err != nil || n != 0 {
+		t.Fatalf("got %d, %v, want nothing patched", n, err)
+	}
+	for _, line := range server.drain() {
+		if strings.HasPrefix(line, "PATCH") {
+			t.Errorf("patched a resource that mutate left alone: %s", line)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+)
+
+// A ListType performs, for one k8s.ResourceList type, the operations
+// that k8sutil otherwise performs with reflection: creating lists and
+// resources of the type, and extracting the items of a list.  The
+// k8sutil-gen command generates ListTypes, along with typed accessors
+// for the Store; see cmd/k8sutil-gen.
+type ListType interface {
+	// NewList returns a new, empty list.
+	NewList() k8s.ResourceList
+
+	// NewItem returns a new, empty resource of the type of the
+	// list's items.
+	NewItem() k8s.Resource
+
+	// Items returns the items of the list, which is of the type
+	// that NewList returns.
+	Items(list k8s.ResourceList) []k8s.Resource
+}
+
+// listTypes are the registered ListTypes, by the Go type of their
+// lists.
+var listTypes struct {
+	sync.RWMutex
+	byList map[reflect.Type]ListType
+}
+
+// RegisterListType makes watches of the ListType's list type use it
+// instead of reflection.  It is meant to be called from the init
+// function of generated code; it only affects watches added after it
+// is called.
+func RegisterListType(lt ListType) {
+	listTypes.Lock()
+	defer listTypes.Unlock()
+	if listTypes.byList == nil {
+		listTypes.byList = make(map[reflect.Type]ListType)
+	}
+	listTypes.byList[reflect.TypeOf(lt.NewList())] = lt
+}
+
+// lookupListType returns the registered ListType of the list's type,
+// or nil if there isn't one.
+func lookupListType(list k8s.ResourceList) ListType {
+	listTypes.RLock()
+	defer listTypes.RUnlock()
+	return listTypes.byList[reflect.TypeOf(list)]
+}
+
+// newList returns a new, empty list of the type being watched.
+func (w *watch) newList() k8s.ResourceList {
+	if w.listType != nil {
+		return w.listType.NewList()
+	}
+	return newResourceListLike(w.list)
+}
+
+// newResource returns a new, empty resource of the type being watched.
+func (w *watch) newResource() k8s.Resource {
+	if w.listType != nil {
+		return w.listType.NewItem()
+	}
+	return newResourceLike(w.resource)
+}
+
+// items returns the items of a list of the type being watched.
+func (w *watch) items(list k8s.ResourceList) []k8s.Resource {
+	if w.listType != nil {
+		return w.listType.Items(list)
+	}
+	return getResourceListItems(list)
+}
@@ -0,0 +1,41 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+//go:generate go run ./cmd/k8sutil-gen -package k8sutil_test -o zz_k8sutil_test.go github.com/ericchiang/k8s/apis/core/v1.Namespace
+
+import (
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestGeneratedListType checks that a watch of a type with a ListType
+// generated by k8sutil-gen (in zz_k8sutil_test.go) works, through the
+// generated accessors.
+func TestGeneratedListType(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("b")}})
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("a")}})
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	WatchNamespaces(w, k8s.AllNamespaces)
+	runStore(t, w)
+
+	namespaces := ListNamespacesSorted(<-stores)
+	if len(namespaces) != 2 || namespaces[0].GetMetadata().GetName() != "a" || namespaces[1].GetMetadata().GetName() != "b" {
+		t.Errorf("got %v", namespaces)
+	}
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("c")}})
+	if n := len(ListNamespaces(<-stores)); n != 3 {
+		t.Errorf("got %d Namespaces", n)
+	}
+}
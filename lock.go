@@ -0,0 +1,299 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// DefaultLockTTL is how long a lock lasts without being renewed if the
+// ttl given to Lock is zero.
+const DefaultLockTTL = 15 * time.Second
+
+// A HeldLock is a lock that Lock acquired.
+type HeldLock struct {
+	// Token is the fencing token of the lock: it is greater than
+	// that of every earlier holder of the lock.  The lock may be
+	// lost, for example if this process is paused for longer than
+	// the ttl, so resources that the critical section changes
+	// should, if they can, be passed the token, and refuse changes
+	// with a token lower than the highest they have seen.
+	Token int64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error // of the release, once done is closed
+	once   sync.Once
+}
+
+// Context returns a Context that is done once the lock is released, or
+// lost because it couldn't be renewed before its ttl ran out.  Run the
+// critical section with it, and stop once it is done.
+func (l *HeldLock) Context() context.Context {
+	return l.ctx
+}
+
+// Unlock releases the lock, so that the next waiter may acquire it
+// without waiting for it to expire.  It returns an error if the lock
+// couldn't be released (it then expires after its ttl), but not if it
+// had been lost already.
+func (l *HeldLock) Unlock() error {
+	l.once.Do(l.cancel)
+	<-l.done
+	return l.err
+}
+
+// A LockOption is an option of Lock.
+type LockOption func(*lease)
+
+// LockClock makes Lock use the Clock, instead of the system clock, to
+// time the lock's renewal and expiry.
+func LockClock(clock Clock) LockOption {
+	return func(l *lease) {
+		l.clock = clock
+	}
+}
+
+// lockMargin is the fraction of the ttl before the lock expires that
+// the Context of a HeldLock that couldn't renew it is done at, so that
+// the critical section stops before another replica may take over.
+const lockMargin = 5
+
+// Lock acquires the lock of the name in the namespace, waiting for as
+// long as another holder has it, to make sure that only one of the
+// replicas of a component runs a critical section at a time, such as a
+// migration.  The lock is a coordination.k8s.io Lease, which Lock
+// creates if need be (it is compatible with other users of Leases, such
+// as leader election).  The lock is held, and renewed every third of
+// the ttl, until Unlock, or until the Context is done, when it is
+// released automatically.  If it can't be renewed, the HeldLock's
+// Context is done a fifth of the ttl before the lock expires.  Lock
+// returns the Context's error if it is done before the lock is
+// acquired.
+//
+// Expiry relies on the clocks of the holders agreeing to within a
+// fraction of the ttl; see the Token of the HeldLock for what to rely on
+// instead.
+func Lock(ctx context.Context, client *k8s.Client, name, namespace string, ttl time.Duration, options ...LockOption) (*HeldLock, error) {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, errors.Wrap(err, "lock: generate identity")
+	}
+	l := &lease{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		identity:  hex.EncodeToString(idBytes),
+		ttl:       ttl,
+	}
+	for _, option := range options {
+		option(l)
+	}
+	l.clock = orSystemClock(l.clock)
+	for {
+		acquired, err := l.acquire(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "lock %s/%s", namespace, name)
+		}
+		if acquired {
+			break
+		}
+		sleep(ctx, l.clock, ttl/4)
+		if ctx.Err() != nil {
+			return nil, errors.Wrapf(ctx.Err(), "lock %s/%s", namespace, name)
+		}
+	}
+
+	held := &HeldLock{Token: l.token, done: make(chan struct{})}
+	held.ctx, held.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(held.done)
+		defer held.once.Do(held.cancel)
+		ticker := l.clock.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		// The lock must be given up by the deadline, whether
+		// or not a renewal is still in flight.
+		deadline := l.renewed.Add(ttl - ttl/lockMargin)
+		expiry := l.clock.NewTimer(deadline.Sub(l.clock.Now()))
+		defer func() { expiry.Stop() }()
+		for {
+			select {
+			case <-held.ctx.Done():
+				held.err = l.release()
+				return
+			case <-expiry.C():
+				return
+			case <-ticker.C():
+			}
+			now := l.clock.Now()
+			rctx, cancel := context.WithTimeout(held.ctx, deadline.Sub(now))
+			ok, err := l.renew(rctx, now)
+			cancel()
+			switch {
+			case ok:
+				deadline = now.Add(ttl - ttl/lockMargin)
+				expiry.Stop()
+				expiry = l.clock.NewTimer(deadline.Sub(l.clock.Now()))
+			case err == nil, !l.clock.Now().Before(deadline):
+				// Another holder has it, or it is about
+				// to expire.
+				return
+			}
+		}
+	}()
+	return held, nil
+}
+
+// A lease is a Lease that is used as a lock.
+type lease struct {
+	client    *k8s.Client
+	namespace string
+	name      string
+	identity  string
+	ttl       time.Duration
+	clock     Clock
+	renewed   time.Time // when it was last acquired or renewed
+
+	object *Unstructured // as last read or written
+	token  int64         // the leaseTransitions when it was acquired
+}
+
+func (l *lease) path() string {
+	return leaseResource.Path(l.namespace) + "/" + url.PathEscape(l.name)
+}
+
+func (l *lease) spec() map[string]interface{} {
+	spec, _ := l.object.Object["spec"].(map[string]interface{})
+	if spec == nil {
+		spec = map[string]interface{}{}
+		l.object.Object["spec"] = spec
+	}
+	return spec
+}
+
+// transitions returns the leaseTransitions of the Lease.
+func (l *lease) transitions() int64 {
+	n, _ := l.spec()["leaseTransitions"].(float64)
+	return int64(n)
+}
+
+// acquire acquires the Lease, if it is free, and returns whether it did.
+func (l *lease) acquire(ctx context.Context) (bool, error) {
+	now := l.clock.Now()
+	l.object = &Unstructured{}
+	err := getJSON(ctx, l.client, l.path(), l.object)
+	if apiErrorCode(err) == http.StatusNotFound {
+		l.object = &Unstructured{Object: map[string]interface{}{
+			"apiVersion": leaseResource.GroupVersion(),
+			"kind":       leaseResource.Kind,
+			"metadata":   map[string]interface{}{"namespace": l.namespace, "name": l.name},
+		}}
+		l.hold(now, 1)
+		created := &Unstructured{}
+		err = doJSON(ctx, l.client, request{verb: http.MethodPost, path: leaseResource.Path(l.namespace)}, l.object, created)
+		return l.written(created, err)
+	}
+	if err != nil {
+		return false, err
+	}
+	spec := l.spec()
+	if holder, _ := spec["holderIdentity"].(string); holder != "" {
+		renewTimeString, _ := spec["renewTime"].(string)
+		renewTime, _ := time.Parse(time.RFC3339Nano, renewTimeString)
+		duration, _ := spec["leaseDurationSeconds"].(float64)
+		if now.Before(renewTime.Add(time.Duration(duration) * time.Second)) {
+			return false, nil
+		}
+	}
+	l.hold(now, l.transitions()+1)
+	return l.put(ctx)
+}
+
+// renew renews the Lease, and returns whether it is still held.
+func (l *lease) renew(ctx context.Context, now time.Time) (bool, error) {
+	l.spec()["renewTime"] = now.UTC().Format(microTimeFormat)
+	ok, err := l.put(ctx)
+	if ok || err != nil {
+		return ok, err
+	}
+	// Someone else wrote it first; it may just have been this
+	// process, with a write whose response was lost.
+	if ok, err := l.refresh(ctx); !ok || err != nil {
+		return false, err
+	}
+	l.spec()["renewTime"] = now.UTC().Format(microTimeFormat)
+	return l.put(ctx)
+}
+
+// release frees the Lease, if it is still held.
+func (l *lease) release() error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl)
+	defer cancel()
+	for {
+		delete(l.spec(), "holderIdentity")
+		ok, err := l.put(ctx)
+		if ok || err != nil {
+			return errors.Wrapf(err, "unlock %s/%s", l.namespace, l.name)
+		}
+		if ok, err := l.refresh(ctx); !ok || err != nil {
+			return errors.Wrapf(err, "unlock %s/%s", l.namespace, l.name)
+		}
+	}
+}
+
+// refresh reads the Lease again, and returns whether it is still held
+// by this process.
+func (l *lease) refresh(ctx context.Context) (bool, error) {
+	current := &Unstructured{}
+	if err := getJSON(ctx, l.client, l.path(), current); err != nil {
+		return false, err
+	}
+	l.object = current
+	return l.spec()["holderIdentity"] == l.identity && l.transitions() == l.token, nil
+}
+
+// hold sets the spec of the Lease to be held by this process.
+func (l *lease) hold(now time.Time, transitions int64) {
+	spec := l.spec()
+	spec["holderIdentity"] = l.identity
+	spec["leaseDurationSeconds"] = int64((l.ttl + time.Second - 1) / time.Second)
+	spec["acquireTime"] = now.UTC().Format(microTimeFormat)
+	spec["renewTime"] = spec["acquireTime"]
+	spec["leaseTransitions"] = transitions
+	l.token = transitions
+	l.renewed = now
+}
+
+// put replaces the Lease, if it hasn't changed since it was read, and
+// returns whether it did.
+func (l *lease) put(ctx context.Context) (bool, error) {
+	updated := &Unstructured{}
+	err := doJSON(ctx, l.client, request{verb: http.MethodPut, path: l.path()}, l.object, updated)
+	return l.written(updated, err)
+}
+
+// written records the result of writing the Lease.  A conflict means
+// that someone else wrote it first.
+func (l *lease) written(result *Unstructured, err error) (bool, error) {
+	if apiErrorCode(err) == http.StatusConflict {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	l.object = result
+	return true, nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// A fakeLockServer stands in for the apiserver's endpoints of the
+// Lease ns/l: GET, POST to create it, and PUT, conditional on its
+// resourceVersion.  Each request is logged, with the Leases in it
+// described by their holders (by the order in which they are first
+// seen, since identities are random), renewTimes (from the start), and
+// leaseTransitions.
+type fakeLockServer struct {
+	t      *testing.T
+	server *httptest.Server
+	start  time.Time
+	log    chan string
+
+	mu      sync.Mutex
+	lease   map[string]interface{} // or nil, if there is none
+	version int
+	holders map[string]string
+	fail    map[string]int  // by method
+	hang    map[string]bool // by method
+}
+
+const lockPath = "/apis/coordination.k8s.io/v1/namespaces/ns/leases"
+
+func newFakeLockServer(t *testing.T, start time.Time) *fakeLockServer {
+	s := &fakeLockServer{
+		t:       t,
+		start:   start,
+		log:     make(chan string, 100),
+		holders: map[string]string{},
+		fail:    map[string]int{},
+		hang:    map[string]bool{},
+	}
+	s.server = httptest.NewServer(s)
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *fakeLockServer) client() *k8s.Client {
+	return &k8s.Client{Endpoint: s.server.URL, Client: s.server.Client()}
+}
+
+// failNext makes requests of the method fail with the code, until it is
+// called with 0.
+func (s *fakeLockServer) failNext(method string, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail[method] = code
+}
+
+// hangNext makes requests of the method hang until they are canceled,
+// until it is called with false.
+func (s *fakeLockServer) hangNext(method string, hang bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hang[method] = hang
+}
+
+// next returns the next line of the log.
+func (s *fakeLockServer) next() string {
+	s.t.Helper()
+	select {
+	case line := <-s.log:
+		return line
+	case <-time.After(timeout):
+		s.t.Fatal("timed out waiting for a request")
+		return ""
+	}
+}
+
+// drain returns the lines of the log so far.
+func (s *fakeLockServer) drain() []string {
+	var lines []string
+	for {
+		select {
+		case line := <-s.log:
+			lines = append(lines, line)
+		default:
+			return lines
+		}
+	}
+}
+
+// describe describes a Lease.  s.mu must be held.
+func (s *fakeLockServer) describe(object map[string]interface{}) string {
+	spec, _ := object["spec"].(map[string]interface{})
+	holder, _ := spec["holderIdentity"].(string)
+	if holder != "" {
+		if _, ok := s.holders[holder]; !ok {
+			s.holders[holder] = fmt.Sprintf("holder%d", len(s.holders)+1)
+		}
+		holder = s.holders[holder]
+	} else {
+		holder = "(free)"
+	}
+	renewTime, _ := time.Parse(time.RFC3339Nano, fmt.Sprint(spec["renewTime"]))
+	return fmt.Sprintf("{%s renewed +%v transitions=%v}", holder, renewTime.Sub(s.start), spec["leaseTransitions"])
+}
+
+func (s *fakeLockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	line := r.Method + " " + r.URL.Path
+	if body != nil {
+		line += " " + s.describe(body)
+	}
+	if s.hang[r.Method] {
+		s.mu.Unlock()
+		s.log <- line + " -> hangs"
+		<-r.Context().Done()
+		return
+	}
+	code, result := s.handle(r, body)
+	if result != nil {
+		line += fmt.Sprintf(" -> %d %s", code, s.describe(result))
+	} else {
+		line += fmt.Sprintf(" -> %d", code)
+	}
+	s.mu.Unlock()
+	s.log <- line
+	if result == nil {
+		result = map[string]interface{}{"kind": "Status", "status": "Failure", "code": code}
+	}
+	writeJSON(w, code, result)
+}
+
+// handle serves a request, returning the response's status code, and
+// the Lease to respond with.  s.mu must be held.
+func (s *fakeLockServer) handle(r *http.Request, body map[string]interface{}) (int, map[string]interface{}) {
+	if code := s.fail[r.Method]; code != 0 {
+		return code, nil
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == lockPath+"/l":
+		if s.lease == nil {
+			return http.StatusNotFound, nil
+		}
+		return http.StatusOK, s.lease
+	case r.Method == http.MethodPost && r.URL.Path == lockPath:
+		if s.lease != nil {
+			return http.StatusConflict, nil
+		}
+		return http.StatusCreated, s.store(body)
+	case r.Method == http.MethodPut && r.URL.Path == lockPath+"/l":
+		if s.lease == nil {
+			return http.StatusNotFound, nil
+		}
+		metadata, _ := body["metadata"].(map[string]interface{})
+		if metadata["resourceVersion"] != s.lease["metadata"].(map[string]interface{})["resourceVersion"] {
+			return http.StatusConflict, nil
+		}
+		return http.StatusOK, s.store(body)
+	}
+	return http.StatusNotFound, nil
+}
+
+// store stores the Lease, with the next resourceVersion.  s.mu must be
+// held.
+func (s *fakeLockServer) store(object map[string]interface{}) map[string]interface{} {
+	s.version++
+	metadata, _ := object["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		object["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = strconv.Itoa(s.version)
+	s.lease = object
+	return object
+}
+
+// TestLockSession replays a lock that is acquired, renewed, and then
+// lost because it can't be renewed: its Context is done a margin before
+// the lease expires, after which another process takes it over, with a
+// greater fencing token, and releases it.
+func TestLockSession(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeLockServer(t, epoch)
+	var log strings.Builder
+	logf := func(format string, args ...interface{}) {
+		fmt.Fprintf(&log, format+"\n", args...)
+	}
+	request := func() {
+		logf("  %s", server.next())
+	}
+	// advance moves the clock on, once the lock is waiting for it.
+	advance := func(d time.Duration, timers int) {
+		t.Helper()
+		if !clock.WaitForTimers(timers, timeout) {
+			t.Fatalf("timed out waiting for %d timers", timers)
+		}
+		clock.Advance(d)
+		logf("+%v", clock.Now().Sub(epoch))
+	}
+	ctx := context.Background()
+	const ttl = 15 * time.Second
+
+	held, err := k8sutil.Lock(ctx, server.client(), "l", "ns", ttl, k8sutil.LockClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logf("lock: token %d", held.Token)
+	request()
+	request()
+	advance(5*time.Second, 2)
+	request()
+	server.failNext(http.MethodPut, http.StatusInternalServerError)
+	advance(5*time.Second, 2)
+	request()
+	advance(5*time.Second, 2)
+	request()
+	logf("context: %v", held.Context().Err())
+	advance(2*time.Second, 2)
+	select {
+	case <-held.Context().Done():
+		logf("context: %v", held.Context().Err())
+	case <-time.After(timeout):
+		t.Fatalf("the lock's Context isn't done once it is about to expire")
+	}
+	logf("unlock: %v", held.Unlock())
+	server.failNext(http.MethodPut, 0)
+
+	type result struct {
+		held *k8sutil.HeldLock
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		held, err := k8sutil.Lock(ctx, server.client(), "l", "ns", ttl, k8sutil.LockClock(clock))
+		resultCh <- result{held, err}
+	}()
+	request()
+	advance(ttl/4, 1)
+	request()
+	r := <-resultCh
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	request()
+	logf("lock: token %d", r.held.Token)
+	logf("unlock: %v", r.held.Unlock())
+	request()
+	if lines := server.drain(); len(lines) > 0 {
+		t.Fatalf("unexpected requests: %q", lines)
+	}
+	checkGolden(t, log.String())
+}
+
+// TestLockRenewDeadline checks that a renewal that hangs doesn't hold
+// on to the lock past its expiry.
+func TestLockRenewDeadline(t *testing.T) {
+	server := newFakeLockServer(t, epoch)
+	server.hangNext(http.MethodPut, true)
+	const ttl = time.Second
+	start := time.Now()
+	held, err := k8sutil.Lock(context.Background(), server.client(), "l", "ns", ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Unlock()
+	select {
+	case <-held.Context().Done():
+		if elapsed := time.Since(start); elapsed >= ttl {
+			t.Fatalf("the lock's Context was done %v after it was acquired, after its ttl of %v", elapsed, ttl)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("the lock's Context isn't done while its renewal hangs")
+	}
+}
+
+// TestLockWaits checks that Lock waits for a lock that another process
+// holds, and gives up when its Context is done.
+func TestLockWaits(t *testing.T) {
+	server := newFakeLockServer(t, epoch)
+	held, err := k8sutil.Lock(context.Background(), server.client(), "l", "ns", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := k8sutil.Lock(ctx, server.client(), "l", "ns", time.Minute); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("got %v, want the lock to be waited for until the deadline", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultRepeatedErrorInterval is the RepeatedErrorInterval used if
+// the WatchingStore doesn't set one.
+const DefaultRepeatedErrorInterval = 1 * time.Minute
+
+// maxRepeatedErrors is how many distinct errors a dedupLogger
+// remembers before forgetting those that it hasn't seen within the
+// interval.
+const maxRepeatedErrors = 256
+
+// A dedupLogger wraps a Logger, suppressing repeats of an error within
+// the interval.
+type dedupLogger struct {
+	logger   Logger
+	interval time.Duration
+	clock    Clock
+
+	mu     sync.Mutex
+	errors map[string]*repeatedError // by message
+}
+
+type repeatedError struct {
+	logged     time.Time // when it was last logged
+	seen       time.Time // when it last occurred
+	suppressed int       // since it was last logged
+}
+
+// newDedupLogger returns a Logger that suppresses repeated errors, or
+// the logger itself if interval is negative.
+func newDedupLogger(logger Logger, interval time.Duration, clock Clock) Logger {
+	if interval < 0 {
+		return logger
+	}
+	if interval == 0 {
+		interval = DefaultRepeatedErrorInterval
+	}
+	return &dedupLogger{
+		logger:   logger,
+		interval: interval,
+		clock:    orSystemClock(clock),
+		errors:   make(map[string]*repeatedError),
+	}
+}
+
+func (l *dedupLogger) Errorf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	r, ok := l.errors[msg]
+	if !ok {
+		l.forget(now)
+		r = &repeatedError{}
+		l.errors[msg] = r
+	} else if now.Sub(r.logged) < l.interval {
+		r.suppressed++
+		r.seen = now
+		l.mu.Unlock()
+		return
+	}
+	suppressed := r.suppressed
+	r.logged, r.seen, r.suppressed = now, now, 0
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		l.logger.Errorf("%s (still failing: %d occurrences suppressed in the last %v)", msg, suppressed, l.interval)
+	} else {
+		l.logger.Errorf("%s", msg)
+	}
+}
+
+// forget drops the errors that haven't occurred within the interval,
+// if there are too many to remember.
+func (l *dedupLogger) forget(now time.Time) {
+	if len(l.errors) < maxRepeatedErrors {
+		return
+	}
+	for msg, r := range l.errors {
+		if now.Sub(r.seen) >= l.interval {
+			delete(l.errors, msg)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A setClock is the system clock, except that Now is whatever the test
+// sets it to.
+type setClock struct {
+	Clock
+	now time.Time
+}
+
+func (c *setClock) Now() time.Time { return c.now }
+
+// recordLogger records what is logged.
+type recordLogger []string
+
+func (l *recordLogger) Errorf(format string, args ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, args...))
+}
+
+func TestDedupLogger(t *testing.T) {
+	clock := &setClock{Clock: SystemClock, now: time.Unix(0, 0)}
+	var logged recordLogger
+	logger := newDedupLogger(&logged, time.Minute, clock)
+
+	logger.Errorf("list: %v", "connection refused")
+	logger.Errorf("list: %v", "connection refused")
+	logger.Errorf("watch: %v", "EOF")
+	clock.now = clock.now.Add(30 * time.Second)
+	logger.Errorf("list: %v", "connection refused")
+	clock.now = clock.now.Add(30 * time.Second)
+	logger.Errorf("list: %v", "connection refused")
+	logger.Errorf("list: %v", "connection refused")
+	clock.now = clock.now.Add(time.Minute)
+	logger.Errorf("list: %v", "connection refused")
+
+	want := recordLogger{
+		"list: connection refused",
+		"watch: EOF",
+		"list: connection refused (still failing: 2 occurrences suppressed in the last 1m0s)",
+		"list: connection refused (still failing: 1 occurrences suppressed in the last 1m0s)",
+	}
+	if !reflect.DeepEqual(logged, want) {
+		t.Errorf("logged %q, want %q", logged, want)
+	}
+}
+
+func TestDedupLoggerDisabled(t *testing.T) {
+	var logged recordLogger
+	logger := newDedupLogger(&logged, -1, nil)
+	logger.Errorf("x")
+	logger.Errorf("x")
+	if len(logged) != 2 {
+		t.Errorf("logged %q", logged)
+	}
+}
+
+// TestDedupLoggerForgets checks that the errors that haven't occurred
+// within the interval are forgotten, once there are too many.
+func TestDedupLoggerForgets(t *testing.T) {
+	clock := &setClock{Clock: SystemClock, now: time.Unix(0, 0)}
+	var logged recordLogger
+	logger := newDedupLogger(&logged, time.Minute, clock).(*dedupLogger)
+	for i := 0; i < maxRepeatedErrors; i++ {
+		logger.Errorf("error %d", i)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	logger.Errorf("another")
+	if n := len(logger.errors); n != 1 {
+		t.Errorf("remembering %d errors, want 1", n)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+)
+
+// LogOptions say which of a container's logs to stream.
+type LogOptions struct {
+	// Follow keeps streaming the log as it is written, until the
+	// container terminates, reconnecting if the stream ends
+	// before then, as it does when the kubelet rotates the log
+	// file.
+	Follow bool
+
+	// TailLines, if positive, starts with the last TailLines
+	// lines of the log, instead of the start of it.
+	TailLines int64
+
+	// Since, if non-zero, starts with the lines written at or
+	// after the time, instead of the start of the log.
+	Since time.Time
+
+	// Timestamps prefixes each line with the RFC 3339 time that it
+	// was written, and a space.
+	Timestamps bool
+
+	// Previous streams the log of the previous instance of the
+	// container, if it has restarted, instead of the current one.
+	// It can't be combined with Follow.
+	Previous bool
+
+	// Clock, if set, is used instead of the system clock to wait
+	// before reconnecting.
+	Clock Clock
+}
+
+// logReconnectDelay is how long StreamLogs waits before reconnecting.
+const logReconnectDelay = time.Second
+
+// StreamLogs streams the log of a container of a pod, as "kubectl
+// logs" does.  The container may be "" if the pod has only one.  The
+// stream ends when the log does, or, with Follow, when the container
+// terminates; or with the Context.  Close the stream to stop it
+// early.
+//
+// To reconnect without repeating or missing lines, StreamLogs always
+// asks for timestamps, and strips them if they weren't asked for.
+func StreamLogs(ctx context.Context, client *k8s.Client, namespace, pod, container string, options LogOptions) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &logStream{
+		client:    client,
+		namespace: namespace,
+		pod:       pod,
+		container: container,
+		options:   options,
+	}
+	resp, err := s.open(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer cancel()
+		w.CloseWithError(s.copy(ctx, resp, w))
+	}()
+	return &logReader{PipeReader: r, cancel: cancel}, nil
+}
+
+// A logReader is the reader of a log stream, which stops the stream
+// when it is closed.
+type logReader struct {
+	*io.PipeReader
+	cancel func()
+}
+
+func (r *logReader) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+// A logStream is the state of StreamLogs.
+type logStream struct {
+	client    *k8s.Client
+	namespace string
+	pod       string
+	container string
+	options   LogOptions
+
+	last     time.Time // the timestamp of the last line copied
+	lastSeen int       // how many lines copied had that timestamp
+}
+
+// open requests the log, from where it left off, if it has copied any
+// of it.
+func (s *logStream) open(ctx context.Context) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("timestamps", "true")
+	if s.container != "" {
+		query.Set("container", s.container)
+	}
+	if s.options.Follow {
+		query.Set("follow", "true")
+	}
+	if s.options.Previous {
+		query.Set("previous", "true")
+	}
+	switch {
+	case !s.last.IsZero():
+		query.Set("sinceTime", s.last.Format(time.RFC3339))
+	case s.options.TailLines > 0:
+		query.Set("tailLines", strconv.FormatInt(s.options.TailLines, 10))
+	}
+	if s.last.IsZero() && !s.options.Since.IsZero() {
+		query.Set("sinceTime", s.options.Since.Format(time.RFC3339))
+	}
+	resp, err := do(ctx, s.client, request{
+		verb:   http.MethodGet,
+		path:   "/api/v1/namespaces/" + url.PathEscape(s.namespace) + "/pods/" + url.PathEscape(s.pod) + "/log",
+		query:  query,
+		accept: "*/*",
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "stream logs of %s/%s", s.namespace, s.pod)
+	}
+	return resp, nil
+}
+
+// copy copies the log to w, reconnecting if it is following.
+func (s *logStream) copy(ctx context.Context, resp *http.Response, w io.Writer) error {
+	for {
+		readErr, writeErr := s.copyLines(resp.Body, w)
+		resp.Body.Close()
+		if ctx.Err() != nil || writeErr != nil {
+			return nil
+		}
+		if !s.options.Follow {
+			return readErr
+		}
+		// However the stream ended, reconnect if there might
+		// be more.
+		running, err := s.running(ctx)
+		if err != nil || !running {
+			return err
+		}
+		sleep(ctx, orSystemClock(s.options.Clock), logReconnectDelay)
+		if resp, err = s.open(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// copyLines copies the lines of a response body to w, skipping those
+// that have already been copied, until it fails to read or write.
+func (s *logStream) copyLines(body io.Reader, w io.Writer) (readErr, writeErr error) {
+	// sinceTime has a resolution of seconds, so a reconnection
+	// repeats the lines of the second that it left off in.
+	resumeAt, skip := s.last, s.lastSeen
+	r := bufio.NewReader(body)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			ts, text := splitLogTimestamp(line)
+			switch {
+			case !resumeAt.IsZero() && !ts.IsZero() && ts.Before(resumeAt):
+				// already copied
+			case !resumeAt.IsZero() && ts.Equal(resumeAt) && skip > 0:
+				skip--
+			default:
+				if !ts.IsZero() {
+					if ts.Equal(s.last) {
+						s.lastSeen++
+					} else {
+						s.last, s.lastSeen = ts, 1
+					}
+				}
+				if s.options.Timestamps {
+					text = line
+				}
+				if _, err := w.Write(text); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return err, nil
+		}
+	}
+}
+
+// running returns whether the container is still running, and so might
+// write more to its log.
+func (s *logStream) running(ctx context.Context) (bool, error) {
+	var pod corev1.Pod
+	if err := s.client.Get(ctx, s.namespace, s.pod, &pod); err != nil {
+		if apiErrorCode(err) == http.StatusNotFound {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "get pod %s/%s", s.namespace, s.pod)
+	}
+	switch pod.GetStatus().GetPhase() {
+	case "Succeeded", "Failed":
+		return false, nil
+	}
+	for _, status := range pod.GetStatus().GetContainerStatuses() {
+		if s.container == "" || status.GetName() == s.container {
+			return status.GetState().GetTerminated() == nil || pod.GetSpec().GetRestartPolicy() != "Never", nil
+		}
+	}
+	return true, nil
+}
+
+// splitLogTimestamp splits the timestamp off of a line of a log, if it
+// has one.
+func splitLogTimestamp(line []byte) (time.Time, []byte) {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return time.Time{}, line
+	}
+	ts, err := time.Parse(time.RFC3339Nano, string(line[:i]))
+	if err != nil {
+		return time.Time{}, line
+	}
+	return ts, line[i+1:]
+}
+
+// A LogLine is a line of the log of a container, from a LogTailer.
+type LogLine struct {
+	Namespace string
+	Pod       string
+	Container string
+	Text      string // without the newline
+}
+
+// A LogTailer follows the logs of every running pod in the store that
+// matches a label selector, as pods come and go, as "kubectl logs -l"
+// does (and "stern" does better).  The WatchingStore must be watching
+// Pods.
+type LogTailer struct {
+	Store  *WatchingStore // must not be nil
+	Client *k8s.Client    // must not be nil
+	Logger Logger         // must not be nil
+
+	// Namespace, if not k8s.AllNamespaces, limits the pods to those
+	// in the namespace.
+	Namespace string
+
+	// Selector is a label selector, as for "kubectl -l"; if empty,
+	// every pod's logs are followed.
+	Selector string
+
+	// Container, if set, is the name of the container to follow in
+	// each pod; if empty, all of their containers are followed.
+	Container string
+
+	// Options are the LogOptions of each stream; Follow is always
+	// set.
+	Options LogOptions
+
+	// Line is called with each line, from multiple goroutines.
+	Line func(LogLine)
+}
+
+// Run follows the logs until the Context is done, and then returns
+// nil.  It returns an error if the Selector is invalid.
+func (t *LogTailer) Run(ctx context.Context) error {
+	matches, err := parseLabelSelector(t.Selector)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub := t.Store.subscribe(1, EventsCoalesce)
+	defer t.Store.unsubscribe(sub)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	streams := make(map[LogLine]func()) // by all but Text, to stop them
+	update := func(store Store) {
+		mu.Lock()
+		defer mu.Unlock()
+		want := make(map[LogLine]bool)
+		for _, r := range store.List(&corev1.Pod{}) {
+			pod := r.(*corev1.Pod)
+			md := pod.GetMetadata()
+			if t.Namespace != k8s.AllNamespaces && md.GetNamespace() != t.Namespace {
+				continue
+			}
+			if pod.GetStatus().GetPhase() != "Running" || !matches(md.GetLabels()) {
+				continue
+			}
+			for _, c := range pod.GetSpec().GetContainers() {
+				if t.Container == "" || c.GetName() == t.Container {
+					want[LogLine{Namespace: md.GetNamespace(), Pod: md.GetName(), Container: c.GetName()}] = true
+				}
+			}
+		}
+		for key, stop := range streams {
+			if !want[key] {
+				stop()
+				delete(streams, key)
+			}
+		}
+		for key := range want {
+			if _, ok := streams[key]; ok {
+				continue
+			}
+			streamCtx, stop := context.WithCancel(ctx)
+			streams[key] = stop
+			wg.Add(1)
+			go func(key LogLine) {
+				defer wg.Done()
+				err := t.follow(streamCtx, key)
+				if err != nil && streamCtx.Err() == nil {
+					t.Logger.Errorf("follow logs of %s/%s %s: %v", key.Namespace, key.Pod, key.Container, err)
+				}
+				// Let the next notification start it
+				// again, if it is still wanted.
+				mu.Lock()
+				if streamCtx.Err() == nil {
+					delete(streams, key)
+				}
+				mu.Unlock()
+				stop()
+			}(key)
+		}
+	}
+
+	if store, err := t.Store.Snapshot(); err == nil {
+		update(store)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			cancel()
+			wg.Wait()
+			return nil
+		case d, ok := <-sub.out:
+			if !ok {
+				cancel()
+				wg.Wait()
+				return nil
+			}
+			update(d.Store)
+		}
+	}
+}
+
+// follow streams the log of one container to the Line function.
+func (t *LogTailer) follow(ctx context.Context, key LogLine) error {
+	options := t.Options
+	options.Follow = true
+	stream, err := StreamLogs(ctx, t.Client, key.Namespace, key.Pod, key.Container, options)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := key
+		line.Text = scanner.Text()
+		t.Line(line)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
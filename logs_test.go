@@ -0,0 +1,203 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// A fakeKubelet serves the logs and status of pods, in place of the
+// apiserver.
+type fakeKubelet struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	logs    []string // the responses to successive log requests
+	queries []string // the queries of the log requests
+	phases  []string // the phases of successive gets of the pod
+}
+
+func (k *fakeKubelet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 6 || parts[0] != "api" || parts[3] != "default" || parts[4] != "pods" {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 7 && parts[6] == "log" {
+		k.queries = append(k.queries, r.URL.RawQuery)
+		log := ""
+		if len(k.logs) > 0 {
+			log, k.logs = k.logs[0], k.logs[1:]
+		}
+		fmt.Fprint(w, strings.Replace(log, "{pod}", parts[5], -1))
+		return
+	}
+	phase := "Succeeded"
+	if len(k.phases) > 0 {
+		phase, k.phases = k.phases[0], k.phases[1:]
+	}
+	writeProtobuf(w, http.StatusOK, &corev1.Pod{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String(parts[5])},
+		Status:   &corev1.PodStatus{Phase: k8s.String(phase)},
+	})
+}
+
+func (k *fakeKubelet) client() *k8s.Client {
+	server := httptest.NewServer(k)
+	k.t.Cleanup(server.Close)
+	return &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+}
+
+func TestStreamLogs(t *testing.T) {
+	kubelet := &fakeKubelet{t: t, logs: []string{
+		"2019-01-01T00:00:00.5Z one\n2019-01-01T00:00:01Z two\n",
+	}}
+	for _, timestamps := range []bool{false, true} {
+		kubelet.logs = append(kubelet.logs, kubelet.logs[0])
+		stream, err := k8sutil.StreamLogs(context.Background(), kubelet.client(), "default", "web", "app", k8sutil.LogOptions{TailLines: 10, Timestamps: timestamps})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(stream)
+		stream.Close()
+		want := "one\ntwo\n"
+		if timestamps {
+			want = "2019-01-01T00:00:00.5Z one\n2019-01-01T00:00:01Z two\n"
+		}
+		if err != nil || string(data) != want {
+			t.Errorf("timestamps %v: got %q, %v, want %q", timestamps, data, err, want)
+		}
+	}
+	if want := "container=app&tailLines=10&timestamps=true"; kubelet.queries[0] != want {
+		t.Errorf("got query %q, want %q", kubelet.queries[0], want)
+	}
+
+	kubelet.logs = nil
+	if _, err := k8sutil.StreamLogs(context.Background(), kubelet.client(), "other", "web", "", k8sutil.LogOptions{}); err == nil {
+		t.Error("streamed the logs of a missing pod")
+	}
+}
+
+// TestStreamLogsFollow checks that a followed log is reconnected to
+// where it left off, without repeating the lines of the second that it
+// was in, until the container terminates.
+func TestStreamLogsFollow(t *testing.T) {
+	kubelet := &fakeKubelet{
+		t: t,
+		logs: []string{
+			"2019-01-01T00:00:00Z a\n2019-01-01T00:00:01.1Z b\n",
+			"2019-01-01T00:00:01.1Z b\n2019-01-01T00:00:01.2Z c\n2019-01-01T00:00:02Z d\n",
+		},
+		phases: []string{"Running", "Succeeded"},
+	}
+	clock := k8sutiltest.NewFakeClock(epoch)
+	stream, err := k8sutil.StreamLogs(context.Background(), kubelet.client(), "default", "web", "", k8sutil.LogOptions{Follow: true, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	go func() {
+		if clock.WaitForTimers(1, timeout) {
+			clock.Advance(time.Second)
+		}
+	}()
+	data, err := ioutil.ReadAll(stream)
+	if want := "a\nb\nc\nd\n"; err != nil || string(data) != want {
+		t.Errorf("got %q, %v, want %q", data, err, want)
+	}
+	if len(kubelet.queries) != 2 || !strings.Contains(kubelet.queries[1], "sinceTime=2019-01-01T00%3A00%3A01Z") {
+		t.Errorf("got queries %q", kubelet.queries)
+	}
+}
+
+func TestLogTailer(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	w := &k8sutil.WatchingStore{Backend: backend, Logger: testLogger{t}}
+	w.AddWatch("default", &corev1.PodList{})
+	stream := backend.Stream("default", &corev1.PodList{})
+	tailedPod := func(name, phase string, labels ...string) *corev1.Pod {
+		p := pod("default", name, phase)
+		p.Metadata = k8sutiltest.ObjectMeta("default", name, "1")
+		p.Metadata.Labels = map[string]string{labels[0]: labels[1]}
+		p.Spec = &corev1.PodSpec{Containers: []*corev1.Container{{Name: k8s.String("app")}}}
+		return p
+	}
+	stream.List(&corev1.PodList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items: []*corev1.Pod{
+			tailedPod("web-1", "Running", "app", "web"),
+			tailedPod("web-2", "Pending", "app", "web"),
+			tailedPod("db", "Running", "app", "db"),
+		},
+	})
+	kubelet := &fakeKubelet{t: t, logs: []string{
+		"2019-01-01T00:00:00Z hello from {pod}\n",
+		"2019-01-01T00:00:00Z hello from {pod}\n",
+	}}
+	lines := make(chan k8sutil.LogLine, 10)
+	tailer := &k8sutil.LogTailer{
+		Store:     w,
+		Client:    kubelet.client(),
+		Logger:    testLogger{t},
+		Namespace: "default",
+		Selector:  "app=web",
+		Line:      func(line k8sutil.LogLine) { lines <- line },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runStore(t, w)
+	done := make(chan error, 1)
+	go func() { done <- tailer.Run(ctx) }()
+
+	next := func() k8sutil.LogLine {
+		t.Helper()
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(timeout):
+			t.Fatal("timed out waiting for a line")
+			return k8sutil.LogLine{}
+		}
+	}
+	if line, want := next(), (k8sutil.LogLine{Namespace: "default", Pod: "web-1", Container: "app", Text: "hello from web-1"}); line != want {
+		t.Errorf("got %+v, want %+v", line, want)
+	}
+	// Pods that start running are followed too.
+	stream.WaitForWatch(1)
+	running := tailedPod("web-2", "Running", "app", "web")
+	running.Metadata.ResourceVersion = k8s.String("2")
+	stream.Send(k8s.EventModified, running)
+	if line := next(); line.Pod != "web-2" {
+		t.Errorf("got %+v", line)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	kubelet.mu.Lock()
+	if len(kubelet.queries) != 2 {
+		t.Errorf("followed %q", kubelet.queries)
+	}
+	kubelet.mu.Unlock()
+	if err := (&k8sutil.LogTailer{Store: w, Selector: "=web"}).Run(context.Background()); err == nil {
+		t.Error("ran with an invalid selector")
+	}
+}
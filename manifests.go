@@ -0,0 +1,332 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// LoadManifests reads the resources in the manifests in dir and its
+// subdirectories: every *.yaml, *.yml, and *.json file, each of which
+// may hold several YAML documents separated by "---", and "List"s of
+// resources.  Hidden files and directories (such as ".git") are
+// skipped.  Each resource is decoded as the Go type registered for its
+// GroupVersionKind (see RegisterTypes), or as an *Unstructured.
+func LoadManifests(dir string) ([]k8s.Resource, error) {
+	var ret []k8s.Resource
+	err := walkManifests(dir, func(path string) error {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		resources, err := DecodeManifests(data)
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+		ret = append(ret, resources...)
+		return nil
+	})
+	return ret, err
+}
+
+// DecodeManifests decodes the resources in data, which is YAML (maybe
+// several documents separated by "---") or JSON, as LoadManifests does.
+func DecodeManifests(data []byte) ([]k8s.Resource, error) {
+	var ret []k8s.Resource
+	for i, doc := range splitYAML(data) {
+		object, err := yaml.YAMLToJSON(doc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "document %d", i+1)
+		}
+		resources, err := decodeManifest(object)
+		if err != nil {
+			return nil, errors.Wrapf(err, "document %d", i+1)
+		}
+		ret = append(ret, resources...)
+	}
+	return ret, nil
+}
+
+// decodeManifest decodes a JSON object, which is a resource or a List,
+// skipping empty documents.
+func decodeManifest(data []byte) ([]k8s.Resource, error) {
+	var header struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Items      []json.RawMessage `json:"items"`
+	}
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil, nil
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	if header.Kind == "" || header.APIVersion == "" {
+		return nil, errors.New("missing apiVersion or kind")
+	}
+	if header.APIVersion == "v1" && header.Kind == "List" {
+		var ret []k8s.Resource
+		for _, item := range header.Items {
+			resources, err := decodeManifest(item)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, resources...)
+		}
+		return ret, nil
+	}
+	gvk := apiResourceForAPIVersion(header.APIVersion, header.Kind).GroupVersionKind()
+	resource := NewResourceFor(gvk)
+	if err := unmarshalKubeJSON(data, resource); err != nil {
+		return nil, errors.Wrapf(err, "decode %s", gvk)
+	}
+	return []k8s.Resource{resource}, nil
+}
+
+// splitYAML splits a YAML stream in to its documents.
+func splitYAML(data []byte) [][]byte {
+	var docs [][]byte
+	var doc bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "---") && strings.TrimSpace(strings.TrimPrefix(line, "---")) == "" {
+			docs = appendDoc(docs, doc.Bytes())
+			doc.Reset()
+			continue
+		}
+		doc.WriteString(line)
+		doc.WriteByte('\n')
+	}
+	return appendDoc(docs, doc.Bytes())
+}
+
+func appendDoc(docs [][]byte, doc []byte) [][]byte {
+	if len(bytes.TrimSpace(doc)) == 0 {
+		return docs
+	}
+	return append(docs, append([]byte(nil), doc...))
+}
+
+// walkManifests calls fn with the path of each manifest in dir, in
+// lexical order.
+func walkManifests(dir string, fn func(path string) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml", ".json":
+			return fn(path)
+		}
+		return nil
+	})
+}
+
+// manifestsDigest returns a digest of the manifests in dir, which
+// changes if any of them does.
+func manifestsDigest(dir string) (string, error) {
+	h := sha256.New()
+	err := walkManifests(dir, func(path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, _ = io.WriteString(h, path+"\x00")
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DefaultManifestInterval is how often a ManifestSync checks for
+// changes if its Interval is zero.
+const DefaultManifestInterval = 10 * time.Second
+
+// A ManifestSync keeps an ApplySet's desired resources in sync with the
+// manifests in a directory, optionally a checkout of a Git repository
+// that it keeps up to date, so that a simple delivery agent can be
+// built entirely on this package.  It polls for changes every
+// Interval.
+type ManifestSync struct {
+	ApplySet *ApplySet // must not be nil
+	Dir      string    // must not be empty
+	Logger   Logger    // must not be nil
+
+	// GitRepo, if set, is the URL of a Git repository to clone in
+	// to Dir (if it isn't a checkout already), and to fetch and
+	// check out GitBranch (if empty, "master") from every
+	// Interval.  This runs the git command.
+	GitRepo   string
+	GitBranch string
+
+	// Interval is how often to check for changes.  If zero,
+	// DefaultManifestInterval is used.
+	Interval time.Duration
+
+	mu     sync.Mutex
+	status ManifestStatus
+}
+
+// ManifestStatus describes the state of a ManifestSync.
+type ManifestStatus struct {
+	// Revision identifies the manifests that were last loaded: the
+	// Git commit, or a digest of the files.
+	Revision string
+
+	// Loaded is when the manifests were last loaded successfully,
+	// and Resources how many resources they held.
+	Loaded    time.Time
+	Resources int
+
+	// Err is the error of the last attempt to update or load the
+	// manifests, if it failed; the ApplySet carries on applying
+	// the last good ones.
+	Err error
+
+	// Objects is the sync status of each resource, from the
+	// ApplySet.
+	Objects []ApplyStatus
+}
+
+// Status returns the status of the sync, and of each resource.
+func (s *ManifestSync) Status() ManifestStatus {
+	s.mu.Lock()
+	ret := s.status
+	s.mu.Unlock()
+	ret.Objects = s.ApplySet.Status()
+	return ret
+}
+
+// Run syncs until the Context is done, and then returns nil.  Run the
+// ApplySet (and its WatchingStore) alongside it.
+func (s *ManifestSync) Run(ctx context.Context) error {
+	if s.Dir == "" {
+		return errors.New("ManifestSync: Dir must not be empty")
+	}
+	interval := s.Interval
+	if interval <= 0 {
+		interval = DefaultManifestInterval
+	}
+	clock := s.ApplySet.Store.clock()
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+	}
+}
+
+// sync updates the checkout, if any, and loads the manifests if they
+// have changed.
+func (s *ManifestSync) sync(ctx context.Context) {
+	revision, err := s.update(ctx)
+	if err == nil && revision == s.revision() {
+		s.setStatus(func(status *ManifestStatus) { status.Err = nil })
+		return
+	}
+	var resources []k8s.Resource
+	if err == nil {
+		resources, err = LoadManifests(s.Dir)
+	}
+	if err == nil {
+		err = s.ApplySet.SetDesired(resources...)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		s.Logger.Errorf("sync manifests from %s: %v", s.Dir, err)
+		s.setStatus(func(status *ManifestStatus) { status.Err = err })
+		return
+	}
+	now := s.ApplySet.Store.clock().Now()
+	s.setStatus(func(status *ManifestStatus) {
+		*status = ManifestStatus{Revision: revision, Loaded: now, Resources: len(resources)}
+	})
+}
+
+func (s *ManifestSync) revision() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status.Revision
+}
+
+func (s *ManifestSync) setStatus(fn func(*ManifestStatus)) {
+	s.mu.Lock()
+	fn(&s.status)
+	s.mu.Unlock()
+}
+
+// update updates the checkout, if there is one, and returns the
+// revision of the manifests.
+func (s *ManifestSync) update(ctx context.Context) (string, error) {
+	if s.GitRepo == "" {
+		return manifestsDigest(s.Dir)
+	}
+	branch := s.GitBranch
+	if branch == "" {
+		branch = "master"
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, ".git")); os.IsNotExist(err) {
+		if _, err := s.git(ctx, "", "clone", "--branch", branch, "--", s.GitRepo, s.Dir); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := s.git(ctx, s.Dir, "fetch", "origin", branch); err != nil {
+			return "", err
+		}
+		if _, err := s.git(ctx, s.Dir, "checkout", "--force", "--detach", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	}
+	return s.git(ctx, s.Dir, "rev-parse", "HEAD")
+}
+
+// git runs a git command in dir, returning its trimmed output.
+func (s *ManifestSync) git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
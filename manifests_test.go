@@ -0,0 +1,244 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+const testManifests = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  namespace: default
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        ports:
+        - containerPort: 8080
+        resources:
+          requests:
+            cpu: 100m
+---
+# An empty document.
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata: {namespace: default, name: a}
+  data: {k: v}
+- apiVersion: example.com/v1
+  kind: Widget
+  metadata: {namespace: default, name: w}
+`
+
+func TestDecodeManifests(t *testing.T) {
+	if err := k8sutil.RegisterTypes(&appsv1.Deployment{}, &corev1.ConfigMap{}); err != nil {
+		t.Fatal(err)
+	}
+	resources, err := k8sutil.DecodeManifests([]byte(testManifests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 3 {
+		t.Fatalf("decoded %d resources, want 3", len(resources))
+	}
+	deployment, ok := resources[0].(*appsv1.Deployment)
+	if !ok {
+		t.Fatalf("decoded a %T, want a Deployment", resources[0])
+	}
+	container := deployment.GetSpec().GetTemplate().GetSpec().GetContainers()[0]
+	if cpu := container.GetResources().GetRequests()["cpu"].GetString_(); cpu != "100m" {
+		t.Errorf("got cpu request %q", cpu)
+	}
+	if port := container.GetPorts()[0].GetContainerPort(); port != 8080 {
+		t.Errorf("got port %d", port)
+	}
+	if cm, ok := resources[1].(*corev1.ConfigMap); !ok || cm.Data["k"] != "v" {
+		t.Errorf("decoded %#v, want the ConfigMap", resources[1])
+	}
+	if u, ok := resources[2].(*k8sutil.Unstructured); !ok || u.GetMetadata().GetName() != "w" {
+		t.Errorf("decoded %#v, want an Unstructured Widget", resources[2])
+	}
+
+	if _, err := k8sutil.DecodeManifests([]byte("metadata: {name: a}\n")); err == nil {
+		t.Errorf("decoded a manifest without a kind")
+	}
+}
+
+// writeManifests writes the files, by path, in to dir.
+func writeManifests(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for path, data := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadManifests(t *testing.T) {
+	dir := t.TempDir()
+	writeManifests(t, dir, map[string]string{
+		"a.yaml":        "apiVersion: v1\nkind: ConfigMap\nmetadata: {namespace: default, name: a}\n",
+		"sub/b.json":    `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"namespace": "default", "name": "b"}}`,
+		"README.md":     "not a manifest",
+		".hidden.yaml":  "not: [a manifest",
+		".git/c.yaml":   "not: [a manifest",
+		"sub/.d/d.yaml": "not: [a manifest",
+	})
+	resources, err := k8sutil.LoadManifests(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, resource := range resources {
+		names = append(names, resource.GetMetadata().GetName())
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("loaded %v, want [a b]", names)
+	}
+
+	writeManifests(t, dir, map[string]string{"bad.yml": "kind: [\n"})
+	if _, err := k8sutil.LoadManifests(dir); err == nil {
+		t.Errorf("loaded a bad manifest")
+	}
+}
+
+// TestManifestSync checks that a ManifestSync loads the manifests in to
+// the ApplySet, and again once they change, but keeps the last good
+// ones if they break.
+func TestManifestSync(t *testing.T) {
+	dir := t.TempDir()
+	writeManifests(t, dir, map[string]string{
+		"a.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata: {namespace: default, name: a}\n",
+	})
+	clock := k8sutiltest.NewFakeClock(epoch)
+	store := &k8sutil.WatchingStore{Clock: clock}
+	s := &k8sutil.ManifestSync{
+		ApplySet: &k8sutil.ApplySet{Store: store, Name: "set"},
+		Dir:      dir,
+		Logger:   testLogger{t},
+		Interval: time.Minute,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	waitForManifests := func(what string, ok func(k8sutil.ManifestStatus) bool) k8sutil.ManifestStatus {
+		t.Helper()
+		deadline := time.Now().Add(timeout)
+		for {
+			status := s.Status()
+			if ok(status) {
+				return status
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: got status %+v", what, status)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	first := waitForManifests("first load", func(status k8sutil.ManifestStatus) bool {
+		return status.Resources == 1
+	})
+	if first.Revision == "" || !first.Loaded.Equal(epoch) {
+		t.Errorf("got status %+v", first)
+	}
+
+	writeManifests(t, dir, map[string]string{
+		"b.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata: {namespace: default, name: b}\n",
+	})
+	waitForTimers(t, clock, 1)
+	clock.Advance(time.Minute)
+	second := waitForManifests("reload", func(status k8sutil.ManifestStatus) bool {
+		return status.Resources == 2
+	})
+	if second.Revision == first.Revision {
+		t.Errorf("the revision didn't change")
+	}
+
+	writeManifests(t, dir, map[string]string{"bad.yaml": "kind: [\n"})
+	clock.Advance(time.Minute)
+	broken := waitForManifests("broken", func(status k8sutil.ManifestStatus) bool {
+		return status.Err != nil
+	})
+	if broken.Resources != 2 || broken.Revision != second.Revision {
+		t.Errorf("lost the last good manifests: %+v", broken)
+	}
+}
+
+// TestManifestSyncGit checks that a ManifestSync clones the GitRepo,
+// and checks out its GitBranch.
+func TestManifestSyncGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	repo := t.TempDir()
+	writeManifests(t, repo, map[string]string{
+		"a.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata: {namespace: default, name: a}\n",
+	})
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "manifests"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	s := &k8sutil.ManifestSync{
+		ApplySet:  &k8sutil.ApplySet{Store: &k8sutil.WatchingStore{}, Name: "set"},
+		Dir:       filepath.Join(t.TempDir(), "checkout"),
+		Logger:    testLogger{t},
+		GitRepo:   repo,
+		GitBranch: "main",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	deadline := time.Now().Add(timeout)
+	for s.Status().Resources != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %+v", s.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if revision := s.Status().Revision; len(revision) != 40 {
+		t.Errorf("got revision %q, want a commit", revision)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"encoding/json"
+
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+// PartialObjectMetadata is a resource of which only the metadata is
+// known; it is what is stored for a watch added with the MetadataOnly
+// option.
+//
+// Because every PartialObjectMetadata has the same Go type, the Store
+// tells them apart by the apiVersion and kind of the resource that they
+// describe; use NewPartialObjectMetadata to create a sample to pass to
+// Store.List:
+//
+//	store.List(k8sutil.NewPartialObjectMetadata("v1", "Pod"))
+type PartialObjectMetadata struct {
+	// APIVersion and Kind are those of the resource that this is
+	// the metadata of (not "meta.k8s.io/v1" and
+	// "PartialObjectMetadata", which the apiserver sends).
+	APIVersion string
+	Kind       string
+
+	Metadata *metav1.ObjectMeta
+}
+
+// NewPartialObjectMetadata returns empty metadata for a resource of the
+// given apiVersion and kind.
+func NewPartialObjectMetadata(apiVersion, kind string) *PartialObjectMetadata {
+	return &PartialObjectMetadata{APIVersion: apiVersion, Kind: kind}
+}
+
+// GetMetadata implements k8s.Resource.
+func (m *PartialObjectMetadata) GetMetadata() *metav1.ObjectMeta {
+	if m.Metadata == nil {
+		return new(metav1.ObjectMeta)
+	}
+	return m.Metadata
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  Only the metadata is
+// decoded; APIVersion and Kind are left as they were.
+func (m *PartialObjectMetadata) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Metadata *metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	m.Metadata = raw.Metadata
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m *PartialObjectMetadata) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		APIVersion string             `json:"apiVersion"`
+		Kind       string             `json:"kind"`
+		Metadata   *metav1.ObjectMeta `json:"metadata,omitempty"`
+	}{m.APIVersion, m.Kind, m.Metadata})
+}
+
+// PartialObjectMetadataList is a list of the metadata of resources of
+// the type identified by Resource.
+type PartialObjectMetadataList struct {
+	Resource APIResource `json:"-"`
+
+	Metadata *metav1.ListMeta         `json:"metadata"`
+	Items    []*PartialObjectMetadata `json:"items"`
+}
+
+// GetMetadata implements k8s.ResourceList.
+func (l *PartialObjectMetadataList) GetMetadata() *metav1.ListMeta {
+	if l.Metadata == nil {
+		return new(metav1.ListMeta)
+	}
+	return l.Metadata
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  The items' APIVersion
+// and Kind are filled in from Resource.
+func (l *PartialObjectMetadataList) UnmarshalJSON(data []byte) error {
+	type list PartialObjectMetadataList // without the UnmarshalJSON method
+	raw := list{Resource: l.Resource}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for _, item := range raw.Items {
+		item.APIVersion = raw.Resource.GroupVersion()
+		item.Kind = raw.Resource.Kind
+	}
+	*l = PartialObjectMetadataList(raw)
+	return nil
+}
+
+// The Accept headers that ask the apiserver for PartialObjectMetadata
+// (Kubernetes 1.15+).
+const (
+	acceptPartialObjectMetadata     = "application/json;as=PartialObjectMetadata;g=meta.k8s.io;v=v1"
+	acceptPartialObjectMetadataList = "application/json;as=PartialObjectMetadataList;g=meta.k8s.io;v=v1"
+)
+
+// MetadataOnly makes the watch fetch only the metadata (labels,
+// annotations, owner references, and so on) of the resources, and store
+// them as *PartialObjectMetadata.  This drastically reduces memory and
+// bandwidth for consumers, such as garbage collectors, that don't need
+// the rest of the object.  It requires Kubernetes 1.15 or later.
+//
+// The type must be registered with the k8s package (or be an
+// *UnstructuredList).
+func MetadataOnly() WatchOption {
+	return func(w *watch) {
+		resource, err := apiResourceForList(w.list)
+		if err != nil {
+			panic(errors.Wrap(err, "MetadataOnly"))
+		}
+		w.list = &PartialObjectMetadataList{Resource: resource}
+		w.resource = listItemSample(w.list)
+		w.listType = nil
+	}
+}
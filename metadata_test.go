@@ -0,0 +1,59 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestMetadataOnly checks that a MetadataOnly watch asks for, and
+// stores, only the metadata of the resources, of both namespaced and
+// cluster-scoped types.
+func TestMetadataOnly(t *testing.T) {
+	server := newFakeAPIServer(t)
+	a := newConfigMap("default", "a", "secret", "value")
+	a.Metadata.Labels = map[string]string{"app": "a"}
+	server.set(a)
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("default")}})
+	stores := make(chan k8sutil.Store, 100)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.MetadataOnly())
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{}, k8sutil.MetadataOnly())
+	runStore(t, w)
+
+	for _, verb := range []string{"list", "watch"} {
+		req := server.await(verb)
+		if accept := req.header.Get("Accept"); !strings.Contains(accept, "as=PartialObjectMetadata") {
+			t.Errorf("%s: got Accept %q", verb, accept)
+		}
+	}
+	var store k8sutil.Store
+	select {
+	case store = <-stores:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the store")
+	}
+	if n := len(store.List(&corev1.ConfigMap{})); n != 0 {
+		t.Errorf("stored %d whole ConfigMaps", n)
+	}
+	configMaps := store.List(k8sutil.NewPartialObjectMetadata("v1", "ConfigMap"))
+	if len(configMaps) != 1 || configMaps[0].GetMetadata().GetLabels()["app"] != "a" {
+		t.Errorf("got ConfigMaps %v", configMaps)
+	}
+	namespaces := store.List(k8sutil.NewPartialObjectMetadata("v1", "Namespace"))
+	if len(namespaces) != 1 || namespaces[0].GetMetadata().GetName() != "default" {
+		t.Errorf("got Namespaces %v", namespaces)
+	}
+}
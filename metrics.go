@@ -0,0 +1,175 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The upper bounds of the buckets of the WatchingStore's histograms.
+var (
+	secondsBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	depthBuckets   = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128}
+)
+
+// A Histogram is a distribution of observations, as a Prometheus
+// histogram describes one: the number of observations no greater than
+// the upper bound of each bucket, as well as their total number, and
+// their sum.
+type Histogram struct {
+	Buckets []float64 // the upper bounds, in increasing order
+	Counts  []uint64  // of observations <= each of the Buckets
+	Count   uint64
+	Sum     float64
+}
+
+// histogram accumulates a Histogram.  The zero value is empty.
+type histogram struct {
+	mu sync.Mutex
+	h  Histogram
+}
+
+// observe adds an observation, initializing the histogram with the
+// buckets if it is empty.
+func (h *histogram) observe(buckets []float64, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.h.Buckets == nil {
+		h.h.Buckets = buckets
+		h.h.Counts = make([]uint64, len(buckets))
+	}
+	for i, bound := range h.h.Buckets {
+		if v <= bound {
+			h.h.Counts[i]++
+		}
+	}
+	h.h.Count++
+	h.h.Sum += v
+}
+
+// snapshot returns a copy of the Histogram, with the buckets if it is
+// empty.
+func (h *histogram) snapshot(buckets []float64) Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.h.Buckets == nil {
+		return Histogram{Buckets: buckets, Counts: make([]uint64, len(buckets))}
+	}
+	ret := h.h
+	ret.Counts = append([]uint64(nil), h.h.Counts...)
+	return ret
+}
+
+// storeMetrics are the histograms of a WatchingStore, other than the
+// coalescing delays, which its coalescer keeps.
+type storeMetrics struct {
+	mu         sync.Mutex
+	callbacks  map[string]*histogram // by name
+	queueDepth histogram
+}
+
+// observeCallback records that the named callback took the seconds to
+// run.
+func (m *storeMetrics) observeCallback(name string, seconds float64) {
+	m.mu.Lock()
+	if m.callbacks == nil {
+		m.callbacks = map[string]*histogram{}
+	}
+	h := m.callbacks[name]
+	if h == nil {
+		h = new(histogram)
+		m.callbacks[name] = h
+	}
+	m.mu.Unlock()
+	h.observe(secondsBuckets, seconds)
+}
+
+// StoreMetrics are histograms of where a WatchingStore spends the time
+// between learning of a change and its consumers having handled it, so
+// that operators can tell when the consumers are the bottleneck, and
+// not the apiserver.
+type StoreMetrics struct {
+	// CallbackSeconds is how long each callback takes to run, by
+	// its name: "Callback", "OnSync", or that of an OnChange
+	// function.  Since callbacks are called synchronously, a slow
+	// one holds up everything.
+	CallbackSeconds map[string]Histogram
+
+	// CoalesceSeconds is how long changes are held, by Coalesce
+	// and the CoalesceWindow, before they are notified of.
+	CoalesceSeconds Histogram
+
+	// EventsQueueDepth is the number of Deltas queued for a
+	// consumer of Events, as each is queued: a consumer that keeps
+	// a deep queue is falling behind.
+	EventsQueueDepth Histogram
+}
+
+// Metrics returns the WatchingStore's StoreMetrics so far.
+func (w *WatchingStore) Metrics() StoreMetrics {
+	ret := StoreMetrics{
+		CallbackSeconds:  map[string]Histogram{},
+		CoalesceSeconds:  w.coalescer.delays.snapshot(secondsBuckets),
+		EventsQueueDepth: w.metrics.queueDepth.snapshot(depthBuckets),
+	}
+	w.metrics.mu.Lock()
+	for name, h := range w.metrics.callbacks {
+		ret.CallbackSeconds[name] = h.snapshot(secondsBuckets)
+	}
+	w.metrics.mu.Unlock()
+	return ret
+}
+
+// ServeMetrics serves the Metrics in the Prometheus text exposition
+// format, as the histograms "k8sutil_callback_duration_seconds" (with a
+// "callback" label), "k8sutil_coalesce_delay_seconds", and
+// "k8sutil_events_queue_depth":
+//
+//	http.HandleFunc("/metrics/k8sutil", store.ServeMetrics)
+func (w *WatchingStore) ServeMetrics(rw http.ResponseWriter, r *http.Request) {
+	metrics := w.Metrics()
+	var buf bytes.Buffer
+	names := make([]string, 0, len(metrics.CallbackSeconds))
+	for name := range metrics.CallbackSeconds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeHistogramHeader(&buf, "k8sutil_callback_duration_seconds", "How long the WatchingStore's callbacks take to run.")
+	for _, name := range names {
+		writeHistogram(&buf, "k8sutil_callback_duration_seconds", `callback="`+labelValueEscaper.Replace(name)+`"`, metrics.CallbackSeconds[name])
+	}
+	writeHistogramHeader(&buf, "k8sutil_coalesce_delay_seconds", "How long changes are held before they are notified of.")
+	writeHistogram(&buf, "k8sutil_coalesce_delay_seconds", "", metrics.CoalesceSeconds)
+	writeHistogramHeader(&buf, "k8sutil_events_queue_depth", "The number of Deltas queued for a consumer of Events, as each is queued.")
+	writeHistogram(&buf, "k8sutil_events_queue_depth", "", metrics.EventsQueueDepth)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = rw.Write(buf.Bytes())
+}
+
+func writeHistogramHeader(buf *bytes.Buffer, name, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+}
+
+// writeHistogram writes the samples of the histogram, with the labels
+// (`name="value",...`, or "").
+func writeHistogram(buf *bytes.Buffer, name, labels string, h Histogram) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	for i, bound := range h.Buckets {
+		fmt.Fprintf(buf, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), h.Counts[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.Count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, labels, h.Count)
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestMetrics checks that the time taken by callbacks, and the time
+// that changes are held for, are observed, and served.
+func TestMetrics(t *testing.T) {
+	server := newFakeAPIServer(t)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: testLogger{t},
+		Callback: func(s k8sutil.Store) {
+			time.Sleep(20 * time.Millisecond)
+			stores <- s
+		},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.Coalesce(50*time.Millisecond))
+	runStore(t, w)
+	<-stores
+	server.set(newConfigMap("default", "a"))
+	<-stores
+
+	metrics := w.Metrics()
+	if h := metrics.CallbackSeconds["Callback"]; h.Count != 2 || h.Sum < 0.04 || h.Counts[0] != 0 {
+		t.Errorf("got CallbackSeconds %+v", h)
+	}
+	if h := metrics.CoalesceSeconds; h.Count != 1 || h.Sum < 0.05 {
+		t.Errorf("got CoalesceSeconds %+v", h)
+	}
+	if h := metrics.EventsQueueDepth; h.Count != 0 || len(h.Counts) != len(h.Buckets) {
+		t.Errorf("got EventsQueueDepth %+v without any Events", h)
+	}
+
+	rw := httptest.NewRecorder()
+	w.ServeMetrics(rw, httptest.NewRequest("GET", "/metrics", nil))
+	body := rw.Body.String()
+	for _, want := range []string{
+		"# TYPE k8sutil_callback_duration_seconds histogram\n",
+		`k8sutil_callback_duration_seconds_bucket{callback="Callback",le="0.001"} 0` + "\n",
+		`k8sutil_callback_duration_seconds_bucket{callback="Callback",le="+Inf"} 2` + "\n",
+		`k8sutil_callback_duration_seconds_count{callback="Callback"} 2` + "\n",
+		"k8sutil_coalesce_delay_seconds_count 1\n",
+		`k8sutil_events_queue_depth_bucket{le="0"} 0` + "\n",
+		"k8sutil_events_queue_depth_sum 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("served no %q in\n%s", want, body)
+		}
+	}
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("served %s", ct)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// namespacePollInterval is how often the namespace helpers check on a
+// namespace that they are waiting for.
+const namespacePollInterval = 500 * time.Millisecond
+
+// namespaceState is what the namespace helpers need of a Namespace.
+type namespaceState struct {
+	Metadata struct {
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Status struct {
+		Phase      string `json:"phase"`
+		Conditions []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func namespacePath(name string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(name)
+}
+
+// getNamespace returns the namespace, or nil if it doesn't exist.
+func getNamespace(ctx context.Context, client *k8s.Client, name string) (*namespaceState, error) {
+	ns := new(namespaceState)
+	err := getJSON(ctx, client, namespacePath(name), ns)
+	if apiErrorCode(err) == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// EnsureNamespace makes sure that the namespace exists, and is active,
+// with the labels (and whatever others it has already).  If the
+// namespace is being deleted, EnsureNamespace waits for it to be gone,
+// and creates it again, instead of failing as creating it does until
+// then.  Once the namespace is created, EnsureNamespace waits for its
+// "default" ServiceAccount to be, since pods can't be created in the
+// namespace until it is.
+func EnsureNamespace(ctx context.Context, client *k8s.Client, name string, labels map[string]string) error {
+	for {
+		ns, err := getNamespace(ctx, client, name)
+		if err != nil {
+			return errors.Wrapf(err, "ensure namespace %s", name)
+		}
+		switch {
+		case ns == nil:
+			err := doJSON(ctx, client, request{verb: http.MethodPost, path: "/api/v1/namespaces"}, map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Namespace",
+				"metadata":   map[string]interface{}{"name": name, "labels": labels},
+			}, nil)
+			if apiErrorCode(err) == http.StatusConflict {
+				// Someone else created it first.
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "create namespace %s", name)
+			}
+			return waitForDefaultServiceAccount(ctx, client, name)
+		case ns.Status.Phase == "Terminating":
+			if err := WaitForNamespaceDeleted(ctx, client, name); err != nil {
+				return errors.Wrapf(err, "ensure namespace %s", name)
+			}
+		default:
+			patch := stringMapPatch(ns.Metadata.Labels, labels)
+			for k, v := range patch {
+				if v == nil {
+					// Keep labels that weren't asked for.
+					delete(patch, k)
+				}
+			}
+			if len(patch) == 0 {
+				return nil
+			}
+			err := doJSON(ctx, client, request{verb: http.MethodPatch, path: namespacePath(name), contentType: MergePatchType},
+				map[string]interface{}{"metadata": map[string]interface{}{"labels": patch}}, nil)
+			return errors.Wrapf(err, "label namespace %s", name)
+		}
+	}
+}
+
+// waitForDefaultServiceAccount waits for the "default" ServiceAccount of
+// the namespace to exist.
+func waitForDefaultServiceAccount(ctx context.Context, client *k8s.Client, namespace string) error {
+	path := namespacePath(namespace) + "/serviceaccounts/default"
+	for {
+		err := getJSON(ctx, client, path, new(struct{}))
+		if apiErrorCode(err) != http.StatusNotFound {
+			return errors.Wrapf(err, "namespace %s: get default service account", namespace)
+		}
+		sleep(ctx, SystemClock, namespacePollInterval)
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "namespace %s: wait for default service account", namespace)
+		}
+	}
+}
+
+// WaitForNamespaceDeleted waits for the namespace to be gone, after it
+// has been deleted: for everything in it to have been deleted, and its
+// finalizers run.  It returns nil at once if the namespace doesn't
+// exist.  If the Context is done first, the error says what is holding
+// the deletion up, if the namespace controller has said.
+func WaitForNamespaceDeleted(ctx context.Context, client *k8s.Client, name string) error {
+	var last *namespaceState
+	for {
+		ns, err := getNamespace(ctx, client, name)
+		if err != nil && ctx.Err() == nil {
+			return errors.Wrapf(err, "wait for namespace %s to be deleted", name)
+		}
+		if ns == nil && err == nil {
+			return nil
+		}
+		if ns != nil {
+			last = ns
+		}
+		sleep(ctx, SystemClock, namespacePollInterval)
+		if ctx.Err() != nil {
+			var stuck []string
+			if last != nil {
+				for _, c := range last.Status.Conditions {
+					if c.Status == "True" {
+						stuck = append(stuck, c.Type+": "+c.Message)
+					}
+				}
+			}
+			if len(stuck) > 0 {
+				return errors.Wrapf(ctx.Err(), "wait for namespace %s to be deleted (%s)", name, strings.Join(stuck, "; "))
+			}
+			return errors.Wrapf(ctx.Err(), "wait for namespace %s to be deleted", name)
+		}
+	}
+}
+
+// DeleteNamespace deletes the namespace, if it exists, and waits for it
+// to be gone, with WaitForNamespaceDeleted.
+func DeleteNamespace(ctx context.Context, client *k8s.Client, name string) error {
+	err := doJSON(ctx, client, request{verb: http.MethodDelete, path: namespacePath(name)}, nil, nil)
+	if err != nil && apiErrorCode(err) != http.StatusNotFound {
+		return errors.Wrapf(err, "delete namespace %s", name)
+	}
+	return WaitForNamespaceDeleted(ctx, client, name)
+}
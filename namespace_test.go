@@ -0,0 +1,213 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// A fakeNamespaces stands in for the apiserver's Namespace endpoints,
+// and those of the default ServiceAccounts.  A Namespace that is
+// deleted is Terminating for the next terminating GETs of it, and then
+// gone; a Namespace that is created gets its default ServiceAccount
+// after the next GET of it.
+type fakeNamespaces struct {
+	mu          sync.Mutex
+	namespaces  map[string]map[string]interface{}
+	accounts    map[string]bool
+	terminating map[string]int
+	requests    []string
+}
+
+func newFakeNamespaces(t *testing.T) (*fakeNamespaces, *k8s.Client) {
+	f := &fakeNamespaces{
+		namespaces:  map[string]map[string]interface{}{},
+		accounts:    map[string]bool{},
+		terminating: map[string]int{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+}
+
+// add adds the Namespace, with the labels, in the phase.
+func (f *fakeNamespaces) add(name string, labels map[string]interface{}, phase string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.namespaces[name] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": name, "labels": labels},
+		"status": map[string]interface{}{
+			"phase": phase,
+			"conditions": []interface{}{map[string]interface{}{
+				"type": "NamespaceContentRemaining", "status": "True", "message": "Some resources are remaining: pods has 1 resource instances",
+			}},
+		},
+	}
+}
+
+func (f *fakeNamespaces) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var body map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	line := r.Method + " " + r.URL.Path
+	if body != nil {
+		data, _ := json.Marshal(body)
+		line += " " + string(data)
+	}
+	f.requests = append(f.requests, line)
+	failure := func(code int) {
+		writeJSON(w, code, &metav1.Status{Status: k8s.String("Failure"), Code: k8s.Int32(int32(code))})
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces"), "/")
+	switch {
+	case r.Method == http.MethodPost && len(parts) == 1:
+		name := body["metadata"].(map[string]interface{})["name"].(string)
+		if f.namespaces[name] != nil {
+			failure(http.StatusConflict)
+			return
+		}
+		body["status"] = map[string]interface{}{"phase": "Active"}
+		f.namespaces[name] = body
+		writeJSON(w, http.StatusCreated, body)
+	case len(parts) == 4 && parts[2] == "serviceaccounts" && parts[3] == "default":
+		if !f.accounts[parts[1]] {
+			// It is created in the background.
+			f.accounts[parts[1]] = f.namespaces[parts[1]] != nil
+			failure(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+	case len(parts) == 2 && f.namespaces[parts[1]] == nil:
+		failure(http.StatusNotFound)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		ns := f.namespaces[parts[1]]
+		if ns["status"].(map[string]interface{})["phase"] == "Terminating" {
+			if f.terminating[parts[1]] == 0 {
+				delete(f.namespaces, parts[1])
+				failure(http.StatusNotFound)
+				return
+			}
+			f.terminating[parts[1]]--
+		}
+		writeJSON(w, http.StatusOK, ns)
+	case len(parts) == 2 && r.Method == http.MethodPatch:
+		labels := body["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+		metadata := f.namespaces[parts[1]]["metadata"].(map[string]interface{})
+		if metadata["labels"] == nil {
+			metadata["labels"] = map[string]interface{}{}
+		}
+		for k, v := range labels {
+			metadata["labels"].(map[string]interface{})[k] = v
+		}
+		writeJSON(w, http.StatusOK, f.namespaces[parts[1]])
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		f.namespaces[parts[1]]["status"].(map[string]interface{})["phase"] = "Terminating"
+		writeJSON(w, http.StatusOK, f.namespaces[parts[1]])
+	default:
+		failure(http.StatusNotFound)
+	}
+}
+
+func (f *fakeNamespaces) takeRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := f.requests
+	f.requests = nil
+	return ret
+}
+
+func TestEnsureNamespace(t *testing.T) {
+	f, client := newFakeNamespaces(t)
+	ctx := context.Background()
+
+	// It is created, and waited for.
+	if err := k8sutil.EnsureNamespace(ctx, client, "new", map[string]string{"team": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /api/v1/namespaces/new",
+		`POST /api/v1/namespaces {"apiVersion":"v1","kind":"Namespace","metadata":{"labels":{"team":"x"},"name":"new"}}`,
+		"GET /api/v1/namespaces/new/serviceaccounts/default",
+		"GET /api/v1/namespaces/new/serviceaccounts/default",
+	}
+	if got := f.takeRequests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("creating: got requests\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Only the missing labels are added.
+	f.add("labeled", map[string]interface{}{"team": "x", "other": "keep"}, "Active")
+	if err := k8sutil.EnsureNamespace(ctx, client, "labeled", map[string]string{"team": "x", "env": "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"GET /api/v1/namespaces/labeled",
+		`PATCH /api/v1/namespaces/labeled {"metadata":{"labels":{"env":"dev"}}}`,
+	}
+	if got := f.takeRequests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("labeling: got requests\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if err := k8sutil.EnsureNamespace(ctx, client, "labeled", map[string]string{"env": "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.takeRequests(); len(got) != 1 {
+		t.Errorf("patched a namespace that has the labels: %q", got)
+	}
+
+	// One that is being deleted is waited for, and created again.
+	f.add("terminating", nil, "Terminating")
+	f.terminating["terminating"] = 1
+	if err := k8sutil.EnsureNamespace(ctx, client, "terminating", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.takeRequests(); !strings.HasPrefix(got[len(got)-3], "POST /api/v1/namespaces ") {
+		t.Errorf("didn't create the namespace again: %q", got)
+	}
+}
+
+func TestDeleteNamespace(t *testing.T) {
+	f, client := newFakeNamespaces(t)
+	f.add("old", nil, "Active")
+	f.terminating["old"] = 1
+	if err := k8sutil.DeleteNamespace(context.Background(), client, "old"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DELETE /api/v1/namespaces/old",
+		"GET /api/v1/namespaces/old",
+		"GET /api/v1/namespaces/old",
+	}
+	if got := f.takeRequests(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got requests\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if err := k8sutil.DeleteNamespace(context.Background(), client, "old"); err != nil {
+		t.Errorf("deleting a namespace that is gone: %v", err)
+	}
+}
+
+// TestWaitForNamespaceDeletedStuck checks that the error of a wait for
+// a namespace that isn't deleted in time says what is holding it up.
+func TestWaitForNamespaceDeletedStuck(t *testing.T) {
+	f, client := newFakeNamespaces(t)
+	f.add("stuck", nil, "Terminating")
+	f.terminating["stuck"] = 1000
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := k8sutil.WaitForNamespaceDeleted(ctx, client, "stuck")
+	if err == nil || !strings.Contains(err.Error(), "NamespaceContentRemaining: Some resources are remaining") {
+		t.Fatalf("got %v, want the condition holding the deletion up", err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// A Normalizer converts a resource to the canonical version of its
+// type.
+type Normalizer func(k8s.Resource) (k8s.Resource, error)
+
+// Normalize is a WatchOption for watching one version of a type whose
+// resources are stored as another, canonical, version.  Every resource
+// that the watch receives is passed to fn, which must return a
+// resource of the same type as the sample; that is what is stored, and
+// what Store.List of the sample returns.  Watching each version that a
+// type is served at, normalizing each to the same canonical version,
+// lets controllers carry on through a version migration (e.g. of a CRD
+// from v2 to v3alpha1) without caring which version a resource was
+// written as.
+//
+// A resource that fn fails to convert is logged and skipped.
+func Normalize(sample k8s.Resource, fn Normalizer) WatchOption {
+	return func(w *watch) {
+		w.normalized = newResourceLike(sample)
+		w.normalize = fn
+	}
+}
+
+// KeepIf is a WatchOption that stores only the resources that keep
+// returns true for, so that those that the consumer will never act on
+// (say, Services without an annotation that it looks for) take no
+// memory, and trigger no callbacks.  keep is given each resource as it
+// would be stored, after Normalize; a resource that changes so that
+// keep returns false for it is dropped from the store, as if it had
+// been deleted.  It must not modify the resource.  If the watch has
+// several KeepIfs, a resource must pass them all to be stored.
+func KeepIf(keep func(k8s.Resource) bool) WatchOption {
+	return func(w *watch) {
+		w.keep = append(w.keep, keep)
+	}
+}
+
+// keeps returns whether the (normalized) resource passes the watch's
+// KeepIfs.
+func (w *watch) keeps(resource k8s.Resource) bool {
+	for _, keep := range w.keep {
+		if !keep(resource) {
+			return false
+		}
+	}
+	return true
+}
+
+// storeSample returns a sample of the type that the watch's resources
+// are stored as.
+func (w *watch) storeSample() k8s.Resource {
+	if w.normalized != nil {
+		return w.normalized
+	}
+	return w.resource
+}
+
+// storeKey returns the key of the type that the watch's resources are
+// stored as.
+func (w *watch) storeKey() typeKey {
+	return typeKeyOf(w.storeSample())
+}
+
+// matches returns whether the watch is of the namespace, and either
+// watches or stores the type.
+func (w *watch) matches(key typeKey, namespace string) bool {
+	if w.namespace != namespace {
+		return false
+	}
+	return typeKeyOf(w.resource) == key || w.storeKey() == key
+}
+
+// normalizeResource converts the resource with the watch's Normalizer,
+// if it has one, checking that it returns the right type, and then
+// validates it, if the watch validates.
+func (w *watch) normalizeResource(resource k8s.Resource) (k8s.Resource, error) {
+	if w.normalize != nil {
+		normalized, err := w.normalize(resource)
+		if err != nil {
+			return nil, err
+		}
+		if typeKeyOf(normalized) != w.storeKey() {
+			return nil, errors.Errorf("normalized to %s, not %s", resourceTypeName(normalized), resourceTypeName(w.normalized))
+		}
+		resource = normalized
+	}
+	if w.validate != nil {
+		if err := w.validate(resource); err != nil {
+			return nil, err
+		}
+	}
+	return resource, nil
+}
+
+// normalizeItems normalizes the items of a listing, logging and
+// dropping any that fail, and dropping any that the watch doesn't keep.
+func (w *watch) normalizeItems(logger Logger, items []k8s.Resource) []k8s.Resource {
+	if w.normalize == nil && w.validate == nil && len(w.keep) == 0 {
+		return items
+	}
+	ret := make([]k8s.Resource, 0, len(items))
+	for _, item := range items {
+		normalized, err := w.normalizeResource(item)
+		if err != nil {
+			w.logDropped(logger, item, err)
+			continue
+		}
+		if !w.keeps(normalized) {
+			continue
+		}
+		ret = append(ret, normalized)
+	}
+	return ret
+}
+
+// logDropped logs that the resource failed to be normalized, or
+// validated, and so isn't stored.
+func (w *watch) logDropped(logger Logger, resource k8s.Resource, err error) {
+	if _, invalid := err.(*SchemaError); invalid {
+		logger.Errorf("validate %s: %v", w.id(), err)
+		return
+	}
+	logger.Errorf("normalize %s: %s: %v", w.id(), resource.GetMetadata().GetName(), err)
+}
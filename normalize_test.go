@@ -0,0 +1,108 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestNormalize checks that normalized resources are stored as the
+// canonical type, alongside those watched as it, from both the listing
+// and the watch, and that those that fail to normalize are skipped.
+// The fake apiserver only serves two types, so Namespaces stand in for
+// an old version of ConfigMaps.
+func TestNormalize(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("b")}})
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("bad")}})
+	logs := make(chan string, 100)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   chanLogger{t, logs},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{}, k8sutil.Normalize(&corev1.ConfigMap{}, func(r k8s.Resource) (k8s.Resource, error) {
+		name := r.GetMetadata().GetName()
+		if name == "bad" {
+			return nil, errors.New("can't convert")
+		}
+		return &corev1.ConfigMap{Metadata: &metav1.ObjectMeta{
+			Namespace: k8s.String("default"),
+			Name:      k8s.String(name),
+			Uid:       r.GetMetadata().Uid,
+		}}, nil
+	}))
+	runStore(t, w)
+
+	s := <-stores
+	if got := names(s.List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got ConfigMaps %v", got)
+	}
+	if n := s.Count(&corev1.Namespace{}); n != 0 {
+		t.Errorf("stored %d Namespaces", n)
+	}
+	if line := <-logs; line != `normalize v1 Namespace (namespace=""): bad: can't convert` {
+		t.Errorf("logged %q", line)
+	}
+
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("c")}})
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("got ConfigMaps %v", got)
+	}
+}
+
+// TestKeepIf checks that only the resources that pass the KeepIf are
+// stored, and that one that changes to no longer pass is dropped.
+func TestKeepIf(t *testing.T) {
+	annotated := func(name string, annotated bool) *corev1.ConfigMap {
+		cm := newConfigMap("default", name)
+		if annotated {
+			cm.Metadata.Annotations = map[string]string{"getambassador.io/config": ""}
+		}
+		return cm
+	}
+	server := newFakeAPIServer(t)
+	server.set(annotated("a", true))
+	server.set(annotated("b", false))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.KeepIf(func(r k8s.Resource) bool {
+		_, ok := r.GetMetadata().GetAnnotations()["getambassador.io/config"]
+		return ok
+	}))
+	runStore(t, w)
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("got ConfigMaps %v", got)
+	}
+
+	server.set(annotated("b", true))
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got ConfigMaps %v once b was annotated", got)
+	}
+	server.set(annotated("a", false))
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got ConfigMaps %v once a wasn't annotated", got)
+	}
+
+	// Changes to resources that aren't kept don't call the Callback.
+	server.set(annotated("c", false))
+	server.set(annotated("d", true))
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"b", "d"}) {
+		t.Errorf("got ConfigMaps %v", got)
+	}
+}
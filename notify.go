@@ -0,0 +1,331 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// OnChange is a WatchOption that routes changes to the watched
+// resources to fn, instead of to the WatchingStore's Callback.  This
+// lets, say, ConfigMaps drive a config reload while Endpoints drive
+// routing, without one Callback re-examining everything on every
+// change.  Like the Callback, fn is passed a snapshot of the whole
+// store, and is called synchronously.
+//
+// If several watches of the same type route to different functions,
+// a change to a resource of that type is sent to all of them.  Since
+// each function is only called for some changes, the Sequence of the
+// Stores that it is passed may skip numbers.
+func OnChange(fn func(Store)) WatchOption {
+	return func(w *watch) {
+		w.callback = fn
+	}
+}
+
+// A changeSet is the set of types that changed.
+type changeSet map[typeKey]struct{}
+
+func (c changeSet) add(keys ...typeKey) {
+	for _, key := range keys {
+		c[key] = struct{}{}
+	}
+}
+
+// A callback is a function to notify, and the name that it is labeled
+// with in profiles.
+type callback struct {
+	fn   func(Store)
+	name string // "Callback", or the WatchID of the OnChange watch
+}
+
+// A router decides which callbacks to call for a changeSet.
+type router struct {
+	callbacks []callback        // [0] is the WatchingStore's Callback
+	routes    map[typeKey][]int // indexes into callbacks
+	windows   map[typeKey]time.Duration
+}
+
+func newRouter(fn func(Store), window time.Duration, watches []*watch) *router {
+	r := &router{
+		callbacks: []callback{{fn: fn, name: "Callback"}},
+		routes:    map[typeKey][]int{},
+		windows:   map[typeKey]time.Duration{},
+	}
+	for _, wa := range watches {
+		key := wa.storeKey()
+		d := window
+		if wa.coalesce != nil {
+			d = *wa.coalesce
+		}
+		if cur, ok := r.windows[key]; !ok || d < cur {
+			r.windows[key] = d
+		}
+		idx := 0
+		if wa.callback != nil {
+			idx = len(r.callbacks)
+			r.callbacks = append(r.callbacks, callback{fn: wa.callback, name: wa.id().String()})
+		}
+		r.routes[key] = appendUnique(r.routes[key], idx)
+	}
+	return r
+}
+
+func appendUnique(idxs []int, idx int) []int {
+	for _, i := range idxs {
+		if i == idx {
+			return idxs
+		}
+	}
+	return append(idxs, idx)
+}
+
+// route returns the callbacks to call for the changes, in a stable
+// order.
+func (r *router) route(changes changeSet) []callback {
+	called := make([]bool, len(r.callbacks))
+	for key := range changes {
+		for _, idx := range r.routes[key] {
+			called[idx] = true
+		}
+	}
+	var ret []callback
+	for idx, cb := range r.callbacks {
+		if called[idx] && cb.fn != nil {
+			ret = append(ret, cb)
+		}
+	}
+	return ret
+}
+
+// flushEvicted passes anything evicted since it was last called to
+// OnEvict.
+func (w *WatchingStore) flushEvicted() {
+	if evicted := w.store.takeEvicted(); len(evicted) > 0 && w.OnEvict != nil {
+		w.OnEvict(evicted)
+	}
+}
+
+// notify calls the callbacks of the changed types with a snapshot of
+// the store, after passing anything evicted to OnEvict, and sends it to
+// the consumers of Events.  Each callback runs with the pprof label
+// "k8sutil.callback" set to its name, so that CPU profiles attribute
+// the time spent in it, and "k8sutil.correlation_id" set to the
+// CorrelationID of the snapshot.
+func (w *WatchingStore) notify(changes changeSet) {
+	w.flushEvicted()
+	if len(changes) == 0 {
+		return
+	}
+	// The snapshot is published even if nothing is told of it, for
+	// Snapshot: a consumer of Events may subscribe after the changes.
+	callbacks := w.router.route(changes)
+	snap := w.store.snapshot()
+	for _, cb := range callbacks {
+		w.call(cb, snap)
+	}
+	w.publish(changes, snap)
+}
+
+// call calls the callback with the snapshot, and, if it takes longer
+// than the SlowCallback threshold, logs and counts it: a slow callback
+// holds up the processing of every event, since callbacks are called
+// synchronously.
+func (w *WatchingStore) call(cb callback, snap *snapshot) {
+	clock := w.clock()
+	start := clock.Now()
+	labels := pprof.Labels("k8sutil.callback", cb.name, "k8sutil.correlation_id", snap.id)
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		cb.fn(snap)
+	})
+	took := clock.Now().Sub(start)
+	w.metrics.observeCallback(cb.name, took.Seconds())
+	if w.SlowCallback > 0 && took >= w.SlowCallback {
+		atomic.AddUint64(&w.slowCallbacks, 1)
+		w.logger.Errorf("slow callback: %s took %v to handle store sequence %d (correlation ID %s)", cb.name, took, snap.Sequence(), snap.id)
+	}
+}
+
+// Coalesce is a WatchOption that holds changes to the watched resources
+// for up to d before notifying, so that a burst of changes to a noisy
+// type (such as Pods) results in a single notification.  It overrides
+// the WatchingStore's CoalesceWindow for the watch.  Any notification
+// that is sent sooner, because of a change to a type with a shorter
+// window, also covers the changes being held.
+//
+// If several watches of the same type set a window, the shortest one
+// applies.
+func Coalesce(d time.Duration) WatchOption {
+	return func(w *watch) {
+		w.coalesce = &d
+	}
+}
+
+// HighPriority is a WatchOption that notifies of changes to the watched
+// resources immediately, regardless of the WatchingStore's
+// CoalesceWindow; it is the same as Coalesce(0).  Use it for
+// latency-critical types, such as Ingresses.
+func HighPriority() WatchOption {
+	return Coalesce(0)
+}
+
+// IgnoreStatus is a WatchOption for consumers that only act on the spec
+// (and metadata) of the watched resources: a change to a resource that
+// is only to its status, such as a kubelet's status heartbeat, is
+// stored, but doesn't notify of a change.  It is seen with the next
+// change that does.
+func IgnoreStatus() WatchOption {
+	return func(w *watch) {
+		w.fingerprints = map[string]uint64{}
+	}
+}
+
+// fingerprint returns a hash of the resource without its status, and
+// the metadata that changes with it.
+func fingerprint(resource k8s.Resource) (uint64, error) {
+	object, err := jsonObject(resource)
+	if err != nil {
+		return 0, err
+	}
+	delete(object, "status")
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "resourceVersion")
+		delete(metadata, "managedFields")
+	}
+	// The keys of the maps are marshaled sorted.
+	data, err := json.Marshal(object)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum64(), nil
+}
+
+// statusOnly records the fingerprint of the resource of the event,
+// if the watch IgnoreStatus, and returns whether that is all that has
+// changed.
+func (w *watch) statusOnly(eventType string, resource k8s.Resource) bool {
+	if w.fingerprints == nil {
+		return false
+	}
+	uid := resource.GetMetadata().GetUid()
+	if eventType == k8s.EventDeleted {
+		delete(w.fingerprints, uid)
+		return false
+	}
+	fp, err := fingerprint(resource)
+	if err != nil {
+		delete(w.fingerprints, uid)
+		return false
+	}
+	old, ok := w.fingerprints[uid]
+	w.fingerprints[uid] = fp
+	return ok && old == fp && eventType == k8s.EventModified
+}
+
+// listed resets the fingerprints to those of the listing, if the watch
+// IgnoreStatus.
+func (w *watch) listed(items []k8s.Resource) {
+	if w.fingerprints == nil {
+		return
+	}
+	w.fingerprints = make(map[string]uint64, len(items))
+	for _, item := range items {
+		w.statusOnly(k8s.EventAdded, item)
+	}
+}
+
+// window returns how long changes may be held before notifying of
+// them.
+func (r *router) window(changes changeSet) time.Duration {
+	window := time.Duration(-1)
+	for key := range changes {
+		if d := r.windows[key]; window < 0 || d < window {
+			window = d
+		}
+	}
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+// A coalescer holds changes until it is time to notify of them.
+type coalescer struct {
+	pending  changeSet
+	timer    Timer
+	deadline time.Time
+	since    time.Time // when the pending changes were first held
+	clock    Clock
+
+	delays histogram // of how long changes are held, in seconds
+}
+
+// C returns the channel that fires when the held changes are due.
+func (c *coalescer) C() <-chan time.Time {
+	if c.timer == nil {
+		return nil
+	}
+	return c.timer.C()
+}
+
+// hold adds changes to those being held, making sure that they are
+// notified of by the deadline.
+func (c *coalescer) hold(clock Clock, changes changeSet, deadline time.Time) {
+	if c.pending == nil {
+		c.pending = changeSet{}
+		c.since, c.clock = clock.Now(), clock
+	}
+	for key := range changes {
+		c.pending[key] = struct{}{}
+	}
+	if c.timer != nil && !deadline.Before(c.deadline) {
+		return
+	}
+	c.stop()
+	c.timer = clock.NewTimer(deadline.Sub(clock.Now()))
+	c.deadline = deadline
+}
+
+// take returns, and stops holding, the held changes along with the
+// given ones.
+func (c *coalescer) take(changes changeSet) changeSet {
+	c.stop()
+	if c.pending != nil {
+		c.delays.observe(secondsBuckets, c.clock.Now().Sub(c.since).Seconds())
+	}
+	for key := range c.pending {
+		changes[key] = struct{}{}
+	}
+	c.pending = nil
+	return changes
+}
+
+func (c *coalescer) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// changed notifies of the changes, either now or, if all of the changed
+// types allow it, once their coalescing window has passed.
+func (w *WatchingStore) changed(changes changeSet) {
+	if len(changes) == 0 {
+		return
+	}
+	if window := w.router.window(changes); window > 0 {
+		clock := w.clock()
+		w.coalescer.hold(clock, changes, clock.Now().Add(window))
+		return
+	}
+	w.notify(w.coalescer.take(changes))
+}
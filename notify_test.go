@@ -0,0 +1,313 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestOnChange checks that changes to a watch with OnChange go to its
+// function, and the others to the Callback.
+func TestOnChange(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	calls := make(chan string, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { calls <- "callback" },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.OnChange(func(k8sutil.Store) { calls <- "configmaps" }))
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{})
+	runStore(t, w)
+
+	// Both types are new, so both are told of the initial listing,
+	// the Callback first.
+	for _, want := range []string{"callback", "configmaps"} {
+		if got := <-calls; got != want {
+			t.Errorf("initial listing: got %s, want %s", got, want)
+		}
+	}
+	server.set(newConfigMap("default", "b"))
+	if got := <-calls; got != "configmaps" {
+		t.Errorf("a ConfigMap change went to the %s", got)
+	}
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("default")}})
+	if got := <-calls; got != "callback" {
+		t.Errorf("a Namespace change went to the %s", got)
+	}
+}
+
+// TestCoalesce checks that changes are held for the CoalesceWindow, but
+// that changes to a HighPriority watch are notified of immediately,
+// along with any being held.
+func TestCoalesce(t *testing.T) {
+	server := newFakeAPIServer(t)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:         server.client(),
+		Logger:         testLogger{t},
+		Callback:       func(s k8sutil.Store) { stores <- s },
+		CoalesceWindow: time.Hour,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{}, k8sutil.HighPriority())
+	runStore(t, w)
+	<-stores
+
+	server.set(newConfigMap("default", "a"))
+	server.set(newConfigMap("default", "b"))
+	select {
+	case s := <-stores:
+		t.Fatalf("notified before the CoalesceWindow: %d ConfigMaps", s.Count(&corev1.ConfigMap{}))
+	case <-time.After(200 * time.Millisecond):
+	}
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("default")}})
+	s := <-stores
+	if n := s.Count(&corev1.Namespace{}); n != 1 {
+		t.Errorf("got %d Namespaces", n)
+	}
+	if n := s.Count(&corev1.ConfigMap{}); n != 2 {
+		t.Errorf("got %d ConfigMaps", n)
+	}
+}
+
+// TestCoalesceWindow checks that held changes are notified of once the
+// window has passed.
+func TestCoalesceWindow(t *testing.T) {
+	server := newFakeAPIServer(t)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{}, k8sutil.Coalesce(300*time.Millisecond))
+	runStore(t, w)
+	<-stores
+
+	start := time.Now()
+	server.set(newConfigMap("default", "a"))
+	server.set(newConfigMap("default", "b"))
+	s := <-stores
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("notified after %v", elapsed)
+	}
+	if n := s.Count(&corev1.ConfigMap{}); n != 2 {
+		t.Errorf("got %d ConfigMaps", n)
+	}
+}
+
+// TestOnSync checks that OnSync is told of the listing, and the Callback
+// only of the changes after it.
+func TestOnSync(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	calls := make(chan string, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { calls <- "callback" },
+		OnSync: func(s k8sutil.Store) {
+			if n := s.Count(&corev1.ConfigMap{}); n != 1 {
+				t.Errorf("OnSync: got %d ConfigMaps", n)
+			}
+			calls <- "sync"
+		},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	if got := <-calls; got != "sync" {
+		t.Errorf("initial listing: got %s", got)
+	}
+	server.set(newConfigMap("default", "b"))
+	if got := <-calls; got != "callback" {
+		t.Errorf("change: got %s", got)
+	}
+}
+
+// TestOnStop checks that stopping Run delivers the notification being
+// held by the CoalesceWindow, and then calls OnStop with the Store that
+// it was delivered with.
+func TestOnStop(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	stores := make(chan k8sutil.Store, 10)
+	var stopped []k8sutil.Store
+	w := &k8sutil.WatchingStore{
+		Client:         server.client(),
+		Logger:         testLogger{t},
+		Callback:       func(s k8sutil.Store) { stores <- s },
+		OnStop:         func(s k8sutil.Store) { stopped = append(stopped, s) },
+		CoalesceWindow: time.Minute,
+		Clock:          clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Run(ctx) }()
+	<-stores
+
+	server.set(newConfigMap("default", "a"))
+	waitForTimers(t, clock, 1)
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	var last k8sutil.Store
+	select {
+	case last = <-stores:
+		if n := last.Count(&corev1.ConfigMap{}); n != 1 {
+			t.Errorf("delivered %d ConfigMaps", n)
+		}
+	default:
+		t.Fatalf("didn't deliver the held notification")
+	}
+	if len(stopped) != 1 || stopped[0] != last {
+		t.Errorf("called OnStop with %v, want the last Store", stopped)
+	}
+}
+
+// TestOnStopBeforeSync checks that OnStop is called with nil if Run
+// stops before anything was delivered.
+func TestOnStopBeforeSync(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.setFailure("list", failure{code: 500})
+	called := false
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { t.Error("called the Callback") },
+		OnStop: func(s k8sutil.Store) {
+			called = true
+			if s != nil {
+				t.Errorf("called OnStop with %v, want nil", s)
+			}
+		},
+		RepeatedErrorInterval: -1,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Run(ctx) }()
+	server.await("list")
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Errorf("didn't call OnStop")
+	}
+}
+
+// TestSlowCallback checks that callbacks that take longer than the
+// SlowCallback, by the Clock, are counted, and the others aren't.
+func TestSlowCallback(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	stores := make(chan k8sutil.Store, 10)
+	slow := true
+	w := &k8sutil.WatchingStore{
+		Client: server.client(),
+		Logger: testLogger{t},
+		Callback: func(s k8sutil.Store) {
+			if slow {
+				clock.Advance(2 * time.Second)
+				slow = false
+			}
+			stores <- s
+		},
+		SlowCallback: time.Second,
+		Clock:        clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	<-stores
+	server.set(newConfigMap("default", "b"))
+	<-stores
+	if n := w.SlowCallbacks(); n != 1 {
+		t.Errorf("counted %d slow callbacks, want 1", n)
+	}
+}
+
+// TestEvents checks that Events delivers each change to the store, and
+// is closed when Run returns.
+func TestEvents(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) {},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	events := w.Events(10, k8sutil.EventsBlock)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- w.Run(ctx) }()
+	for n := 1; n <= 2; n++ {
+		if n == 2 {
+			server.set(newConfigMap("default", "b"))
+		}
+		d := <-events
+		if got := d.Store.Count(&corev1.ConfigMap{}); got != n {
+			t.Errorf("delivered %d ConfigMaps, want %d", got, n)
+		}
+		if len(d.Changed) != 1 {
+			t.Errorf("changed %v, want the ConfigMaps", d.Changed)
+		}
+	}
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := <-events; ok {
+		t.Errorf("delivered %v after Run returned", d)
+	}
+}
+
+// TestIgnoreStatus checks that a change only to a resource's status is
+// stored without notifying of it, and is seen with the next change.
+func TestIgnoreStatus(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.PodList{}, k8sutil.IgnoreStatus())
+	statusPod := func(rv, phase string, labels map[string]string) *corev1.Pod {
+		p := pod("default", "web", phase)
+		p.Metadata = k8sutiltest.ObjectMeta("default", "web", rv)
+		p.Metadata.Labels = labels
+		return p
+	}
+	stream := backend.Stream("default", &corev1.PodList{})
+	stream.List(&corev1.PodList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.Pod{statusPod("1", "Pending", nil)}})
+	runStore(t, w)
+	<-stores
+
+	stream.WaitForWatch(1)
+	stream.Send(k8s.EventModified, statusPod("2", "Running", nil))
+	select {
+	case <-stores:
+		t.Fatal("notified of a change only to the status")
+	case <-time.After(quiet):
+	}
+	stream.Send(k8s.EventModified, statusPod("3", "Running", map[string]string{"app": "web"}))
+	p := (<-stores).List(&corev1.Pod{})[0].(*corev1.Pod)
+	if phase, rv := p.GetStatus().GetPhase(), p.GetMetadata().GetResourceVersion(); phase != "Running" || rv != "3" {
+		t.Errorf("got phase %s at resourceVersion %s", phase, rv)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// An Observation is when a WatchingStore saw a stored resource, by its
+// own Clock rather than the apiserver's timestamps, for showing how
+// stale resources are, or which changed recently.
+type Observation struct {
+	// FirstSeen is when the resource (by UID) was first stored, by
+	// a listing or an event.  It is kept across relistings, but not
+	// across the resource being deleted, or evicted, and stored
+	// again.
+	FirstSeen time.Time
+
+	// LastUpdated is when the stored version of the resource was
+	// stored: when it was last seen to change.
+	LastUpdated time.Time
+}
+
+// observer is a Store that records Observations: a snapshot, or a view
+// of one.
+type observer interface {
+	observed(resource k8s.Resource) (Observation, bool)
+	changedSince(resourceType k8s.Resource, since time.Time) []k8s.Resource
+}
+
+// Observed returns the Observation of the stored resource with the same
+// type and UID as the resource, or false if there isn't one, or if the
+// store isn't from a WatchingStore.
+func Observed(store Store, resource k8s.Resource) (Observation, bool) {
+	if o, ok := store.(observer); ok {
+		return o.observed(resource)
+	}
+	return Observation{}, false
+}
+
+// ChangedSince returns the stored resources of the same type as the
+// sample that were LastUpdated after the time, most recently updated
+// first.  It returns nil if the store isn't from a WatchingStore.
+func ChangedSince(store Store, resourceType k8s.Resource, since time.Time) []k8s.Resource {
+	if o, ok := store.(observer); ok {
+		return o.changedSince(resourceType, since)
+	}
+	return nil
+}
+
+func (s *snapshot) observed(resource k8s.Resource) (Observation, bool) {
+	types, ok := s.types[typeKeyOf(resource)]
+	if !ok {
+		return Observation{}, false
+	}
+	uid := resource.GetMetadata().GetUid()
+	e := types.entries.get(hashUID(uid), uid)
+	if e == nil {
+		return Observation{}, false
+	}
+	return Observation{FirstSeen: e.firstSeen, LastUpdated: e.updated}, true
+}
+
+func (s *snapshot) changedSince(resourceType k8s.Resource, since time.Time) []k8s.Resource {
+	types, ok := s.types[typeKeyOf(resourceType)]
+	if !ok {
+		return []k8s.Resource{}
+	}
+	var entries []*entry
+	types.entries.each(func(_ string, e *entry) {
+		if e.updated.After(since) {
+			entries = append(entries, e)
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].updated.After(entries[j].updated)
+	})
+	ret := make([]k8s.Resource, 0, len(entries))
+	for _, e := range entries {
+		if resource := e.decode(types.sample, s.lazy); resource != nil {
+			ret = append(ret, resource)
+		}
+	}
+	return ret
+}
+
+func (f *filteredStore) observed(resource k8s.Resource) (Observation, bool) {
+	if !f.matches(resource.GetMetadata().GetLabels()) {
+		return Observation{}, false
+	}
+	return Observed(f.store, resource)
+}
+
+func (f *filteredStore) changedSince(resourceType k8s.Resource, since time.Time) []k8s.Resource {
+	resources := ChangedSince(f.store, resourceType, since)
+	if resources == nil {
+		return nil
+	}
+	return f.filter(resources)
+}
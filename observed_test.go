@@ -0,0 +1,99 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestObserved checks that a store records when each resource was first
+// seen, by its Clock, and keeps it across changes, but not across the
+// resource being deleted and stored again; and that ChangedSince has
+// what was updated since, most recent first.
+func TestObserved(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	backend := k8sutiltest.NewScriptedBackend(t)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+		Clock:    clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	s := backend.Stream("default", &corev1.ConfigMapList{})
+	s.List(&corev1.ConfigMapList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items:    []*corev1.ConfigMap{configMap("default", "a", "1", "app", "web"), configMap("default", "b", "1")},
+	})
+	runStore(t, w)
+	<-stores
+	s.WaitForWatch(1)
+
+	clock.Advance(time.Minute)
+	s.Send(k8s.EventModified, configMap("default", "a", "2", "app", "web"))
+	<-stores
+	clock.Advance(time.Minute)
+	s.Send(k8s.EventAdded, configMap("default", "c", "3"))
+	<-stores
+	clock.Advance(time.Minute)
+	s.Send(k8s.EventDeleted, configMap("default", "b", "4"))
+	<-stores
+	s.Send(k8s.EventAdded, configMap("default", "b", "5"))
+	store := <-stores
+
+	for _, tc := range []struct {
+		name                   string
+		firstSeen, lastUpdated time.Duration
+	}{
+		{"a", 0, time.Minute},
+		{"b", 3 * time.Minute, 3 * time.Minute},
+		{"c", 2 * time.Minute, 2 * time.Minute},
+	} {
+		o, ok := k8sutil.Observed(store, configMap("default", tc.name, ""))
+		if !ok || !o.FirstSeen.Equal(epoch.Add(tc.firstSeen)) || !o.LastUpdated.Equal(epoch.Add(tc.lastUpdated)) {
+			t.Errorf("%s: got %+v, %v", tc.name, o, ok)
+		}
+	}
+	if o, ok := k8sutil.Observed(store, configMap("default", "d", "")); ok {
+		t.Errorf("observed a resource that isn't stored: %+v", o)
+	}
+
+	if got := inOrder(k8sutil.ChangedSince(store, &corev1.ConfigMap{}, epoch)); !reflect.DeepEqual(got, []string{"b", "c", "a"}) {
+		t.Errorf("ChangedSince: got %v", got)
+	}
+	if got := inOrder(k8sutil.ChangedSince(store, &corev1.ConfigMap{}, epoch.Add(90*time.Second))); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("ChangedSince 1m30s: got %v", got)
+	}
+	if got := k8sutil.ChangedSince(store, &corev1.Secret{}, epoch); len(got) != 0 {
+		t.Errorf("ChangedSince of an unwatched type: got %d", len(got))
+	}
+
+	web, err := k8sutil.Filtered(store, "app=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inOrder(k8sutil.ChangedSince(web, &corev1.ConfigMap{}, epoch)); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("Filtered ChangedSince: got %v", got)
+	}
+	if _, ok := k8sutil.Observed(web, configMap("default", "c", "")); ok {
+		t.Error("a Filtered view observed what it doesn't select")
+	}
+}
+
+// inOrder returns the names of the resources, in their order.
+func inOrder(resources []k8s.Resource) []string {
+	ret := []string{}
+	for _, resource := range resources {
+		ret = append(ret, resource.GetMetadata().GetName())
+	}
+	return ret
+}
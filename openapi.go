@@ -0,0 +1,215 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// An OpenAPI fetches the OpenAPI documents that the apiserver publishes
+// of the types that it serves, and looks up the schemas of types in
+// them, for validation, defaulting, and documentation tools.  It uses
+// the OpenAPI v3 documents, one per group version, where the apiserver
+// publishes them (from Kubernetes 1.24 on, by default), and the single
+// OpenAPI v2 document otherwise.
+//
+// The documents are cached; once a document is older than the TTL, it
+// is revalidated with its ETag, and only fetched again if it has
+// changed.  The zero value is not usable; Client must be set.  It is
+// safe to use an OpenAPI from multiple goroutines.
+type OpenAPI struct {
+	Client *k8s.Client // must not be nil
+
+	// TTL is how long to use a document for before revalidating
+	// it.  If zero, DefaultDiscoveryTTL is used.
+	TTL time.Duration
+
+	// Clock, if set, is used instead of the system clock to decide
+	// when to revalidate documents.
+	Clock Clock
+
+	mu   sync.Mutex
+	docs map[string]*openAPIDocument // by path
+}
+
+type openAPIDocument struct {
+	mu      sync.Mutex // held while it is fetched
+	etag    string
+	fetched time.Time
+	data    map[string]interface{}
+}
+
+// An OpenAPISchema is the schema of a type, from an OpenAPI document.
+type OpenAPISchema struct {
+	// Name is the name of the schema in the document, e.g.
+	// "io.k8s.api.apps.v1.Deployment".
+	Name string
+
+	// Schema is the schema itself, as a generic JSON object.  The
+	// schemas of its fields may be references to other schemas in
+	// the document; see Resolve.
+	Schema map[string]interface{}
+
+	// V3 is whether the schema is from an OpenAPI v3 document, not
+	// a v2 one.
+	V3 bool
+
+	definitions map[string]interface{}
+}
+
+// Resolve returns the schema that a "$ref" of the schema refers to, e.g.
+// "#/components/schemas/io.k8s.api.core.v1.PodSpec", or nil if it refers
+// to a schema that isn't in the document.  The schemas that Resolve
+// returns can be resolved with the same OpenAPISchema.
+func (s *OpenAPISchema) Resolve(ref string) map[string]interface{} {
+	for _, prefix := range []string{"#/components/schemas/", "#/definitions/"} {
+		if strings.HasPrefix(ref, prefix) {
+			schema, _ := s.definitions[strings.TrimPrefix(ref, prefix)].(map[string]interface{})
+			return schema
+		}
+	}
+	return nil
+}
+
+// Document returns the OpenAPI document at the path, e.g. "/openapi/v2"
+// or "/openapi/v3/apis/apps/v1", as a generic JSON object, fetching it
+// if it isn't cached, or revalidating it if it is stale.  The returned
+// object is shared; it is not valid to mutate it.
+func (o *OpenAPI) Document(ctx context.Context, path string) (map[string]interface{}, error) {
+	o.mu.Lock()
+	if o.docs == nil {
+		o.docs = make(map[string]*openAPIDocument)
+	}
+	doc := o.docs[path]
+	if doc == nil {
+		doc = new(openAPIDocument)
+		o.docs[path] = doc
+	}
+	o.mu.Unlock()
+
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	ttl := o.TTL
+	if ttl == 0 {
+		ttl = DefaultDiscoveryTTL
+	}
+	now := orSystemClock(o.Clock).Now()
+	if doc.data != nil && now.Sub(doc.fetched) < ttl {
+		return doc.data, nil
+	}
+	r := request{verb: http.MethodGet, path: path}
+	if i := strings.Index(path, "?"); i >= 0 {
+		query, err := url.ParseQuery(path[i+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "OpenAPI document %s", path)
+		}
+		r.path, r.query = path[:i], query
+	}
+	req, err := newRequest(ctx, o.Client, r)
+	if err != nil {
+		return nil, err
+	}
+	if doc.data != nil && doc.etag != "" {
+		req.Header.Set("If-None-Match", doc.etag)
+	}
+	resp, err := httpClientOf(o.Client).Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get OpenAPI document %s", path)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		doc.fetched = now
+		return doc.data, nil
+	case resp.StatusCode/100 != 2:
+		return nil, errors.Wrapf(newAPIError(resp), "get OpenAPI document %s", path)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get OpenAPI document %s", path)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, errors.Wrapf(err, "decode OpenAPI document %s", path)
+	}
+	doc.data, doc.etag, doc.fetched = data, resp.Header.Get("ETag"), now
+	return data, nil
+}
+
+// SchemaForKind returns the schema of the type, or an error if the
+// apiserver doesn't publish one.
+func (o *OpenAPI) SchemaForKind(ctx context.Context, gvk GroupVersionKind) (*OpenAPISchema, error) {
+	index, err := o.Document(ctx, "/openapi/v3")
+	switch {
+	case apiErrorCode(err) == http.StatusNotFound:
+		// The apiserver predates OpenAPI v3.
+		doc, err := o.Document(ctx, "/openapi/v2")
+		if err != nil {
+			return nil, err
+		}
+		definitions, _ := doc["definitions"].(map[string]interface{})
+		return findOpenAPISchema(definitions, gvk, false)
+	case err != nil:
+		return nil, err
+	}
+
+	gvPath := "apis/" + gvk.Group + "/" + gvk.Version
+	if gvk.Group == "" {
+		gvPath = "api/" + gvk.Version
+	}
+	entry, _ := jsonPath(index, "paths", gvPath).(map[string]interface{})
+	if entry == nil {
+		return nil, errors.Errorf("no OpenAPI document of %s", gvk.APIVersion())
+	}
+	// The URL changes with the document, so that it can be cached
+	// forever, but keeping the cache to the TTL works as well.
+	docURL, _ := entry["serverRelativeURL"].(string)
+	if docURL == "" {
+		docURL = "/openapi/v3/" + gvPath
+	}
+	doc, err := o.Document(ctx, docURL)
+	if err != nil {
+		return nil, err
+	}
+	o.forgetOthers("/openapi/v3/"+gvPath, docURL)
+	schemas, _ := jsonPath(doc, "components", "schemas").(map[string]interface{})
+	return findOpenAPISchema(schemas, gvk, true)
+}
+
+// forgetOthers drops the cached documents of the path other than the
+// one at the URL, which have been replaced by it.
+func (o *OpenAPI) forgetOthers(path, docURL string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for p := range o.docs {
+		if p != docURL && (p == path || strings.HasPrefix(p, path+"?")) {
+			delete(o.docs, p)
+		}
+	}
+}
+
+// findOpenAPISchema returns the schema of the type among the schemas of
+// a document, by their x-kubernetes-group-version-kind.
+func findOpenAPISchema(schemas map[string]interface{}, gvk GroupVersionKind, v3 bool) (*OpenAPISchema, error) {
+	for name, s := range schemas {
+		schema, _ := s.(map[string]interface{})
+		gvks, _ := schema["x-kubernetes-group-version-kind"].([]interface{})
+		for _, g := range gvks {
+			g, _ := g.(map[string]interface{})
+			if g["group"] == gvk.Group && g["version"] == gvk.Version && g["kind"] == gvk.Kind {
+				return &OpenAPISchema{Name: name, Schema: schema, V3: v3, definitions: schemas}, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("no OpenAPI schema of %s", gvk)
+}
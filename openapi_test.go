@@ -0,0 +1,157 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+var deploymentGVK = k8sutil.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+
+// A fakeOpenAPI serves OpenAPI documents, v3 unless v2Only, with ETags,
+// logging the requests for them.
+type fakeOpenAPI struct {
+	v2Only bool
+
+	mu       sync.Mutex
+	etag     string
+	requests []string
+}
+
+func (f *fakeOpenAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	line := r.URL.String()
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		line += " If-None-Match=" + match
+	}
+	f.requests = append(f.requests, line)
+	deployment := map[string]interface{}{
+		"type": "object",
+		"x-kubernetes-group-version-kind": []interface{}{
+			map[string]interface{}{"group": "apps", "version": "v1", "kind": "Deployment"},
+		},
+		"properties": map[string]interface{}{
+			"spec": map[string]interface{}{"$ref": "#/components/schemas/io.k8s.api.apps.v1.DeploymentSpec"},
+		},
+	}
+	switch {
+	case r.URL.Path == "/openapi/v2" && f.v2Only:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"definitions": map[string]interface{}{
+			"io.k8s.api.apps.v1.Deployment": deployment,
+		}})
+	case f.v2Only:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"kind": "Status", "code": 404})
+	case r.URL.Path == "/openapi/v3":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"paths": map[string]interface{}{
+			"apis/apps/v1": map[string]interface{}{"serverRelativeURL": "/openapi/v3/apis/apps/v1?hash=" + f.etag},
+		}})
+	case r.URL.Path == "/openapi/v3/apis/apps/v1":
+		w.Header().Set("ETag", f.etag)
+		if r.Header.Get("If-None-Match") == f.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"components": map[string]interface{}{"schemas": map[string]interface{}{
+			"io.k8s.api.apps.v1.Deployment":     deployment,
+			"io.k8s.api.apps.v1.DeploymentSpec": map[string]interface{}{"type": "object", "description": f.etag},
+		}}})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"kind": "Status", "code": 404})
+	}
+}
+
+func (f *fakeOpenAPI) takeRequests() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := strings.Join(f.requests, "\n")
+	f.requests = nil
+	return ret
+}
+
+func TestOpenAPI(t *testing.T) {
+	f := &fakeOpenAPI{etag: "a"}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	clock := k8sutiltest.NewFakeClock(epoch)
+	o := &k8sutil.OpenAPI{
+		Client: &k8s.Client{Endpoint: server.URL, Client: server.Client()},
+		TTL:    time.Minute,
+		Clock:  clock,
+	}
+	ctx := context.Background()
+	schema, err := o.SchemaForKind(ctx, deploymentGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Name != "io.k8s.api.apps.v1.Deployment" || !schema.V3 {
+		t.Errorf("got schema %s (v3 %v)", schema.Name, schema.V3)
+	}
+	spec := schema.Resolve(schema.Schema["properties"].(map[string]interface{})["spec"].(map[string]interface{})["$ref"].(string))
+	if spec == nil || spec["description"] != "a" {
+		t.Errorf("resolved the spec to %v", spec)
+	}
+	if got, want := f.takeRequests(), "/openapi/v3\n/openapi/v3/apis/apps/v1?hash=a"; got != want {
+		t.Errorf("got requests\n%s\nwant\n%s", got, want)
+	}
+
+	// Within the TTL, the documents are cached.
+	if _, err := o.SchemaForKind(ctx, deploymentGVK); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.takeRequests(); got != "" {
+		t.Errorf("made requests within the TTL: %s", got)
+	}
+
+	// After it, they are revalidated.
+	clock.Advance(time.Minute)
+	if _, err := o.SchemaForKind(ctx, deploymentGVK); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := f.takeRequests(), "/openapi/v3\n/openapi/v3/apis/apps/v1?hash=a If-None-Match=a"; got != want {
+		t.Errorf("got requests\n%s\nwant\n%s", got, want)
+	}
+
+	// Once the group version's document changes, so does its URL.
+	f.mu.Lock()
+	f.etag = "b"
+	f.mu.Unlock()
+	clock.Advance(time.Minute)
+	schema, err = o.SchemaForKind(ctx, deploymentGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec := schema.Resolve("#/components/schemas/io.k8s.api.apps.v1.DeploymentSpec"); spec["description"] != "b" {
+		t.Errorf("got the old document: %v", spec)
+	}
+	if _, err := o.SchemaForKind(ctx, k8sutil.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}); err == nil {
+		t.Errorf("found a schema of a group version without a document")
+	}
+}
+
+func TestOpenAPIV2(t *testing.T) {
+	server := httptest.NewServer(&fakeOpenAPI{v2Only: true})
+	defer server.Close()
+	o := &k8sutil.OpenAPI{Client: &k8s.Client{Endpoint: server.URL, Client: server.Client()}}
+	schema, err := o.SchemaForKind(context.Background(), deploymentGVK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Name != "io.k8s.api.apps.v1.Deployment" || schema.V3 {
+		t.Errorf("got schema %s (v3 %v)", schema.Name, schema.V3)
+	}
+	if _, err := o.SchemaForKind(context.Background(), k8sutil.GroupVersionKind{Version: "v1", Kind: "Pod"}); err == nil {
+		t.Errorf("found a schema that isn't in the document")
+	}
+}
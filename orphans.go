@@ -0,0 +1,189 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// DefaultOrphanInterval is how often an OrphanCollector scans if its
+// Interval is zero.
+const DefaultOrphanInterval = 5 * time.Minute
+
+// An OrphanCollector deletes resources whose owner no longer exists,
+// for owners that are named by a label or an annotation instead of by
+// an owner reference (which the garbage collector of Kubernetes handles
+// itself): for example, resources in other namespaces than their owner,
+// which owner references can't refer to.  It scans the Store every
+// Interval.
+//
+// A resource is only deleted once it has been found orphaned in two
+// scans in a row, so that one whose owner was created just after it,
+// and that the Store saw first, isn't mistaken for an orphan.
+type OrphanCollector struct {
+	Client *k8s.Client    // must not be nil
+	Store  *WatchingStore // must not be nil
+	Logger Logger         // must not be nil
+
+	// OwnerType is a sample of the type of the owners, and Types
+	// are samples of the types of the resources to collect.  The
+	// Store must watch all of them, in every namespace that the
+	// resources and their owners may be in.
+	OwnerType k8s.Resource
+	Types     []k8s.Resource
+
+	// OwnerLabel, or else OwnerAnnotation, is the key of the label
+	// or annotation of a resource that names its owner: as "name",
+	// for an owner in the same namespace as the resource (or a
+	// cluster-scoped owner), or, for an annotation, as
+	// "namespace/name".  Resources without it are left alone.
+	OwnerLabel      string
+	OwnerAnnotation string
+
+	// Discovery, if set, is used to find the resource types of
+	// Unstructured resources, to delete them.
+	Discovery *Discovery
+
+	// Interval is how often to scan.  If zero,
+	// DefaultOrphanInterval is used.
+	Interval time.Duration
+
+	// DryRun reports orphans, to Deleted, without deleting them.
+	DryRun bool
+
+	// DeleteInterval, if positive, is the least time between
+	// deletions, to limit the load of collecting many orphans at
+	// once on the apiserver, and on whatever watches them.
+	DeleteInterval time.Duration
+
+	// Deleted, if set, is called with each orphan that is deleted,
+	// or that would be, with DryRun.
+	Deleted func(k8s.Resource)
+
+	suspects map[string]bool // the UIDs of the orphans of the last scan
+}
+
+// Run scans every Interval until the Context is done, and then returns
+// nil.
+func (c *OrphanCollector) Run(ctx context.Context) error {
+	if c.OwnerLabel == "" && c.OwnerAnnotation == "" {
+		return errors.New("OrphanCollector: OwnerLabel or OwnerAnnotation must be set")
+	}
+	interval := c.Interval
+	if interval <= 0 {
+		interval = DefaultOrphanInterval
+	}
+	ticker := c.Store.clock().NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+		store, err := c.Store.Snapshot()
+		if err != nil {
+			// Not synced yet.
+			continue
+		}
+		c.Collect(ctx, store)
+	}
+}
+
+// Collect makes one scan of the store, deleting (or, with DryRun,
+// reporting) the resources that were orphans at the last scan as well.
+// It returns the number of them.
+func (c *OrphanCollector) Collect(ctx context.Context, store Store) int {
+	if !watches(store, c.OwnerType) {
+		c.Logger.Errorf("collect orphans: the Store doesn't watch %T", c.OwnerType)
+		return 0
+	}
+	ownerType, err := apiResourceForResource(c.OwnerType)
+	if err == nil && ownerType.Name == "" {
+		// Whether the owners are namespaced is needed to find them.
+		if c.Discovery == nil {
+			err = errors.Errorf("the OrphanCollector needs a Discovery to handle %s", ownerType.GroupVersionKind())
+		} else {
+			ownerType, err = c.Discovery.ResourceForKind(ctx, ownerType.GroupVersion(), ownerType.Kind)
+		}
+	}
+	if err != nil {
+		c.Logger.Errorf("collect orphans: %v", err)
+		return 0
+	}
+	owners := make(map[ObjectKey]bool)
+	for _, owner := range store.List(c.OwnerType) {
+		owners[objectKeyOf(owner)] = true
+	}
+
+	suspects := make(map[string]bool)
+	var orphans []k8s.Resource
+	for _, sample := range c.Types {
+		for _, resource := range store.ListSorted(sample) {
+			md := resource.GetMetadata()
+			owner, ok := c.ownerOf(resource, ownerType.Namespaced)
+			if !ok || owners[owner] || md.GetDeletionTimestamp() != nil {
+				continue
+			}
+			suspects[md.GetUid()] = true
+			if c.suspects[md.GetUid()] {
+				orphans = append(orphans, resource)
+			}
+		}
+	}
+	c.suspects = suspects
+
+	collected := 0
+	for i, orphan := range orphans {
+		if ctx.Err() != nil {
+			break
+		}
+		if i > 0 && c.DeleteInterval > 0 && !c.DryRun {
+			sleep(ctx, c.Store.clock(), c.DeleteInterval)
+		}
+		if !c.DryRun {
+			resource, err := discoverAPIResource(ctx, c.Discovery, "OrphanCollector", orphan)
+			if err == nil {
+				err = deleteResource(ctx, c.Client, resource, orphan)
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					c.Logger.Errorf("collect orphan %s: %v", objectKeyOf(orphan), err)
+				}
+				continue
+			}
+		}
+		collected++
+		if c.Deleted != nil {
+			c.Deleted(orphan)
+		}
+	}
+	return collected
+}
+
+// ownerOf returns the key of the owner that the resource names, if it
+// names one.
+func (c *OrphanCollector) ownerOf(resource k8s.Resource, namespaced bool) (ObjectKey, bool) {
+	md := resource.GetMetadata()
+	var name string
+	if c.OwnerLabel != "" {
+		name = md.GetLabels()[c.OwnerLabel]
+	} else {
+		name = md.GetAnnotations()[c.OwnerAnnotation]
+	}
+	if name == "" {
+		return ObjectKey{}, false
+	}
+	if i := strings.Index(name, "/"); i >= 0 {
+		return ObjectKey{Namespace: name[:i], Name: name[i+1:]}, true
+	}
+	if !namespaced {
+		return ObjectKey{Name: name}, true
+	}
+	return ObjectKey{Namespace: md.GetNamespace(), Name: name}, true
+}
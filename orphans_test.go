@@ -0,0 +1,82 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestOrphanCollector(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		server := newFakeAPIServer(t)
+		server.set(namespace("a", nil))
+		server.set(namespace("b", nil))
+		owned := newConfigMap("b", "owned")
+		owned.Metadata.Labels = map[string]string{"owner": "a"}
+		orphan := newConfigMap("b", "orphan")
+		orphan.Metadata.Labels = map[string]string{"owner": "gone"}
+		for _, cm := range []*corev1.ConfigMap{owned, orphan, newConfigMap("b", "unowned")} {
+			server.set(cm)
+		}
+
+		synced := make(chan struct{}, 1)
+		w := &k8sutil.WatchingStore{
+			Client: server.client(),
+			Logger: testLogger{t},
+			Callback: func(k8sutil.Store) {
+				select {
+				case synced <- struct{}{}:
+				default:
+				}
+			},
+		}
+		w.AddWatch("", &corev1.ConfigMapList{})
+		w.AddWatch("", &corev1.NamespaceList{})
+		runStore(t, w)
+		<-synced
+		store, err := w.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var deleted []string
+		c := &k8sutil.OrphanCollector{
+			Client:     server.client(),
+			Store:      w,
+			Logger:     testLogger{t},
+			OwnerType:  &corev1.Namespace{},
+			Types:      []k8s.Resource{&corev1.ConfigMap{}},
+			OwnerLabel: "owner",
+			DryRun:     dryRun,
+			Deleted: func(resource k8s.Resource) {
+				deleted = append(deleted, resource.GetMetadata().GetName())
+			},
+		}
+		// An orphan is only collected once it has been seen twice.
+		if n := c.Collect(context.Background(), store); n != 0 {
+			t.Fatalf("dry run %v: collected %d at the first scan", dryRun, n)
+		}
+		if n := c.Collect(context.Background(), store); n != 1 || len(deleted) != 1 || deleted[0] != "orphan" {
+			t.Fatalf("dry run %v: collected %d (%v), want the orphan", dryRun, n, deleted)
+		}
+		if gone := server.object(orphan) == nil; gone == dryRun {
+			t.Errorf("dry run %v: orphan deleted %v", dryRun, gone)
+		}
+		if server.object(owned) == nil {
+			t.Errorf("dry run %v: deleted a resource whose owner exists", dryRun)
+		}
+	}
+}
+
+func TestOrphanCollectorOwnerKey(t *testing.T) {
+	c := &k8sutil.OrphanCollector{}
+	if err := c.Run(context.Background()); err == nil {
+		t.Fatal("ran without an OwnerLabel or OwnerAnnotation")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// The content types of the PATCH requests that PatchBetween and
+// JSONPatchBetween produce the bodies of.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// PatchBetween returns a JSON merge patch (RFC 7386) that transforms
+// old in to new: new's value of each field that differs, and null for
+// each field that new lacks.  Lists are replaced whole, as merge
+// patches can't modify them in place.  If old and new are the same,
+// the patch is "{}".
+//
+// The resources are compared as the apiserver encodes them as JSON, so
+// old and new may be of different Go types, e.g. one typed and one
+// *Unstructured.
+func PatchBetween(old, new k8s.Resource) ([]byte, error) {
+	oldObj, newObj, err := jsonObjects(old, new)
+	if err != nil {
+		return nil, err
+	}
+	patch := mergePatch(oldObj, newObj)
+	if patch == nil {
+		patch = map[string]interface{}{}
+	}
+	return json.Marshal(patch)
+}
+
+// JSONPatchBetween is like PatchBetween, but returns a JSON patch (RFC
+// 6902): a list of operations, or "[]" if old and new are the same.
+// Like PatchBetween, it replaces lists whole rather than adding or
+// removing their items, since the indices in old aren't stable once
+// the patch reaches the apiserver.
+func JSONPatchBetween(old, new k8s.Resource) ([]byte, error) {
+	oldObj, newObj, err := jsonObjects(old, new)
+	if err != nil {
+		return nil, err
+	}
+	ops := jsonPatch("", oldObj, newObj, []jsonPatchOp{})
+	return json.Marshal(ops)
+}
+
+// jsonObjects returns the resources as generic JSON objects.
+func jsonObjects(old, new k8s.Resource) (oldObj, newObj map[string]interface{}, err error) {
+	for _, r := range []struct {
+		resource k8s.Resource
+		object   *map[string]interface{}
+	}{{old, &oldObj}, {new, &newObj}} {
+		data, err := marshalKubeJSON(r.resource)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "patch")
+		}
+		if err := json.Unmarshal(data, r.object); err != nil {
+			return nil, nil, errors.Wrap(err, "patch")
+		}
+	}
+	return oldObj, newObj, nil
+}
+
+// mergePatch returns the merge patch between two JSON objects, or nil
+// if they are the same.
+func mergePatch(old, new map[string]interface{}) map[string]interface{} {
+	var patch map[string]interface{}
+	set := func(key string, value interface{}) {
+		if patch == nil {
+			patch = make(map[string]interface{})
+		}
+		patch[key] = value
+	}
+	for key, oldValue := range old {
+		newValue, ok := new[key]
+		if !ok {
+			set(key, nil)
+			continue
+		}
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := newValue.(map[string]interface{})
+		if oldIsMap && newIsMap {
+			if sub := mergePatch(oldMap, newMap); sub != nil {
+				set(key, sub)
+			}
+		} else if !reflect.DeepEqual(oldValue, newValue) {
+			set(key, newValue)
+		}
+	}
+	for key, newValue := range new {
+		if _, ok := old[key]; !ok {
+			set(key, newValue)
+		}
+	}
+	return patch
+}
+
+// A jsonPatchOp is one operation of a JSON patch.
+type jsonPatchOp struct {
+	Op    string
+	Path  string
+	Value interface{}
+}
+
+// MarshalJSON implements json.Marshaler.  The value is omitted from
+// "remove" operations only; "omitempty" would also omit values such as
+// false and 0.
+func (op jsonPatchOp) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(map[string]interface{}{"op": op.Op, "path": op.Path})
+	}
+	return json.Marshal(map[string]interface{}{"op": op.Op, "path": op.Path, "value": op.Value})
+}
+
+// jsonPatch appends the operations that transform the old object at
+// path in to the new one to ops, in a stable order.
+func jsonPatch(path string, old, new map[string]interface{}, ops []jsonPatchOp) []jsonPatchOp {
+	keys := make([]string, 0, len(old)+len(new))
+	for key := range old {
+		keys = append(keys, key)
+	}
+	for key := range new {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		keyPath := path + "/" + jsonPointerEscaper.Replace(key)
+		oldValue, inOld := old[key]
+		newValue, inNew := new[key]
+		switch {
+		case !inNew:
+			ops = append(ops, jsonPatchOp{Op: "remove", Path: keyPath})
+		case !inOld:
+			ops = append(ops, jsonPatchOp{Op: "add", Path: keyPath, Value: newValue})
+		default:
+			oldMap, oldIsMap := oldValue.(map[string]interface{})
+			newMap, newIsMap := newValue.(map[string]interface{})
+			if oldIsMap && newIsMap {
+				ops = jsonPatch(keyPath, oldMap, newMap, ops)
+			} else if !reflect.DeepEqual(oldValue, newValue) {
+				ops = append(ops, jsonPatchOp{Op: "replace", Path: keyPath, Value: newValue})
+			}
+		}
+	}
+	return ops
+}
+
+// jsonPointerEscaper escapes a key for use in a JSON pointer (RFC
+// 6901).
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
@@ -0,0 +1,130 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+
+	"github.com/datawire/k8sutil"
+)
+
+// newDeployment returns a Deployment of one container, with a CPU
+// request and a port.
+func newDeployment(name, cpu string, port int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String(name)},
+		Spec: &appsv1.DeploymentSpec{
+			Template: &corev1.PodTemplateSpec{Spec: &corev1.PodSpec{Containers: []*corev1.Container{{
+				Name:  k8s.String("app"),
+				Ports: []*corev1.ContainerPort{{ContainerPort: k8s.Int32(port)}},
+				Resources: &corev1.ResourceRequirements{
+					Requests: map[string]*resource.Quantity{"cpu": {String_: k8s.String(cpu)}},
+				},
+			}}}},
+		},
+	}
+}
+
+// equalJSON returns whether the JSON documents are equal.
+func equalJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var aValue, bValue interface{}
+	if err := json.Unmarshal(a, &aValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &bValue); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+func TestPatchBetween(t *testing.T) {
+	old := newConfigMap("default", "a", "k", "v", "gone", "x")
+	new := newConfigMap("default", "a", "k", "w", "added", "y")
+	patch, err := k8sutil.PatchBetween(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"data": {"k": "w", "gone": null, "added": "y"}}`; !equalJSON(t, patch, []byte(want)) {
+		t.Errorf("got %s, want %s", patch, want)
+	}
+	patch, err = k8sutil.PatchBetween(old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(patch) != "{}" {
+		t.Errorf("got %s between the same ConfigMap", patch)
+	}
+}
+
+// TestPatchBetweenDeployments checks that patches are of the JSON that
+// the apiserver understands, with Quantities as strings, and that a
+// typed resource compares equal to an *Unstructured with the same
+// content.
+func TestPatchBetweenDeployments(t *testing.T) {
+	patch, err := k8sutil.PatchBetween(newDeployment("web", "100m", 8080), newDeployment("web", "200m", 8080))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"spec": {"template": {"spec": {"containers": [{
+		"name": "app",
+		"ports": [{"containerPort": 8080}],
+		"resources": {"requests": {"cpu": "200m"}}
+	}]}}}}`
+	if !equalJSON(t, patch, []byte(want)) {
+		t.Errorf("got %s, want %s", patch, want)
+	}
+
+	var u k8sutil.Unstructured
+	if err := json.Unmarshal([]byte(`{
+		"metadata": {"namespace": "default", "name": "web"},
+		"spec": {"template": {"spec": {"containers": [{
+			"name": "app",
+			"ports": [{"containerPort": 8080}],
+			"resources": {"requests": {"cpu": "100m"}}
+		}]}}}
+	}`), &u); err != nil {
+		t.Fatal(err)
+	}
+	patch, err = k8sutil.PatchBetween(&u, newDeployment("web", "100m", 8080))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(patch) != "{}" {
+		t.Errorf("got %s between equal Unstructured and typed Deployments", patch)
+	}
+}
+
+func TestJSONPatchBetween(t *testing.T) {
+	patch, err := k8sutil.JSONPatchBetween(newDeployment("web", "100m", 8080), newDeployment("web", "100m", 9090))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"op": "replace", "path": "/spec/template/spec/containers", "value": [{
+		"name": "app",
+		"ports": [{"containerPort": 9090}],
+		"resources": {"requests": {"cpu": "100m"}}
+	}]}]`
+	if !equalJSON(t, patch, []byte(want)) {
+		t.Errorf("got %s, want %s", patch, want)
+	}
+
+	old := newConfigMap("default", "a", "a/b", "v", "gone", "x")
+	new := newConfigMap("default", "a", "a/b", "w")
+	patch, err = k8sutil.JSONPatchBetween(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `[{"op": "replace", "path": "/data/a~1b", "value": "w"}, {"op": "remove", "path": "/data/gone"}]`
+	if !equalJSON(t, patch, []byte(want)) {
+		t.Errorf("got %s, want %s", patch, want)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+)
+
+// Pause stops delivering events for the watches of resources of the
+// same type as the sample, in the namespace, without tearing down the
+// rest of the WatchingStore; the store keeps the resources as of the
+// pause.  If disconnect is set, the watches also close their
+// connections to the apiserver, rather than leaving them idle.
+// Pause returns the number of watches that it paused.
+//
+// Resume picks up where Pause left off; if the resourceVersion that a
+// disconnected watch paused at has since expired, the WatchingStore
+// re-lists as it does for any expired watch.
+func (w *WatchingStore) Pause(resourceType k8s.Resource, namespace string, disconnect bool) int {
+	n := 0
+	for _, wa := range w.matchingWatches(resourceType, namespace) {
+		wa.pauser.pause(disconnect)
+		n++
+	}
+	return n
+}
+
+// Resume resumes the watches paused by Pause, returning the number of
+// watches that it resumed.
+func (w *WatchingStore) Resume(resourceType k8s.Resource, namespace string) int {
+	n := 0
+	for _, wa := range w.matchingWatches(resourceType, namespace) {
+		if wa.pauser.resume() {
+			n++
+		}
+	}
+	return n
+}
+
+func (w *WatchingStore) matchingWatches(resourceType k8s.Resource, namespace string) []*watch {
+	key := typeKeyOf(resourceType)
+	var ret []*watch
+	for _, wa := range w.currentWatches() {
+		if wa.matches(key, namespace) {
+			ret = append(ret, wa)
+		}
+	}
+	return ret
+}
+
+// A pauser is the pause state of a watch.
+type pauser struct {
+	mu         sync.Mutex
+	paused     bool
+	disconnect bool
+	resumed    chan struct{} // closed by resume
+	watcher    Watcher       // the watch's current Watcher, if any
+	closed     bool          // whether pause closed the watcher
+}
+
+func (p *pauser) pause(disconnect bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		p.paused = true
+		p.resumed = make(chan struct{})
+	}
+	if disconnect && !p.disconnect {
+		p.disconnect = true
+		if p.watcher != nil {
+			_ = p.watcher.Close()
+			p.closed = true
+		}
+	}
+}
+
+func (p *pauser) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false
+	}
+	close(p.resumed)
+	p.paused = false
+	p.disconnect = false
+	return true
+}
+
+// setWatcher tells the pauser about the watch's current Watcher, so
+// that a disconnecting pause can close it.  If the watch is already
+// paused with disconnect, setWatcher closes it immediately.
+func (p *pauser) setWatcher(watcher Watcher) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watcher = watcher
+	p.closed = false
+	if watcher != nil && p.disconnect {
+		_ = watcher.Close()
+		p.closed = true
+	}
+}
+
+// tookWatcher returns whether the pauser closed the current Watcher,
+// in which case the error from reading it isn't worth reporting.
+func (p *pauser) tookWatcher() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// wait blocks while the watch is paused, or until the Context is
+// canceled.
+func (p *pauser) wait(ctx context.Context) {
+	p.mu.Lock()
+	paused, resumed := p.paused, p.resumed
+	p.mu.Unlock()
+	if !paused {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-resumed:
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"testing"
+	"time"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestPause checks that a paused watch delivers nothing until it is
+// resumed, whether or not it disconnected, and then catches up.
+func TestPause(t *testing.T) {
+	for _, disconnect := range []bool{false, true} {
+		server := newFakeAPIServer(t)
+		server.set(newConfigMap("default", "a"))
+		stores := make(chan k8sutil.Store, 10)
+		w := &k8sutil.WatchingStore{
+			Client:   server.client(),
+			Logger:   testLogger{t},
+			Callback: func(s k8sutil.Store) { stores <- s },
+		}
+		w.AddWatch("default", &corev1.ConfigMapList{})
+		runStore(t, w)
+		<-stores
+
+		if n := w.Pause(&corev1.ConfigMap{}, "default", disconnect); n != 1 {
+			t.Fatalf("disconnect=%v: paused %d watches", disconnect, n)
+		}
+		if n := w.Pause(&corev1.ConfigMap{}, "other", disconnect); n != 0 {
+			t.Errorf("disconnect=%v: paused %d watches of another namespace", disconnect, n)
+		}
+		server.set(newConfigMap("default", "b"))
+		select {
+		case s := <-stores:
+			t.Fatalf("disconnect=%v: got %d ConfigMaps while paused", disconnect, s.Count(&corev1.ConfigMap{}))
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if n := w.Resume(&corev1.ConfigMap{}, "default"); n != 1 {
+			t.Fatalf("disconnect=%v: resumed %d watches", disconnect, n)
+		}
+		if n := w.Resume(&corev1.ConfigMap{}, "default"); n != 0 {
+			t.Errorf("disconnect=%v: resumed %d watches twice", disconnect, n)
+		}
+		select {
+		case s := <-stores:
+			if n := s.Count(&corev1.ConfigMap{}); n != 2 {
+				t.Errorf("disconnect=%v: got %d ConfigMaps after resuming", disconnect, n)
+			}
+		case <-time.After(timeout):
+			t.Fatalf("disconnect=%v: timed out after resuming", disconnect)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"hash/fnv"
+	"math/bits"
+)
+
+// A pnode is a node of a persistent hash array mapped trie, mapping
+// UIDs to entries; a nil *pnode is the empty map.  A pnode is never
+// modified once it has been built: "modifying" a trie builds new nodes
+// along the path to the change, and shares the rest with the original.
+// This is what allows the store to hand out snapshots in O(1).
+type pnode struct {
+	bitmap   uint32   // which of the 32 possible children are present
+	children []pchild // the present children, in order
+}
+
+// A pchild is either a subtrie, or a leaf.
+type pchild struct {
+	node *pnode
+	leaf *pleaf
+}
+
+// A pleaf holds the entries whose UIDs have the same hash; there is
+// more than one only if their hashes collide.
+type pleaf struct {
+	hash  uint32
+	pairs []pair
+}
+
+type pair struct {
+	uid   string
+	entry *entry
+}
+
+// pmapBits is the number of bits of the hash consumed by each level of
+// the trie.
+const pmapBits = 5
+
+func hashUID(uid string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(uid))
+	return h.Sum32()
+}
+
+func (n *pnode) index(hash uint32, shift uint) (bit uint32, pos int) {
+	bit = 1 << ((hash >> shift) & (1<<pmapBits - 1))
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *pnode) get(hash uint32, uid string) *entry {
+	for shift := uint(0); n != nil; shift += pmapBits {
+		bit, pos := n.index(hash, shift)
+		if n.bitmap&bit == 0 {
+			return nil
+		}
+		child := n.children[pos]
+		if child.leaf != nil {
+			return child.leaf.get(hash, uid)
+		}
+		n = child.node
+	}
+	return nil
+}
+
+// with returns the trie with the UID mapped to the entry, along with
+// the entry that it replaced, if any.
+func (n *pnode) with(hash uint32, shift uint, uid string, e *entry) (*pnode, *entry) {
+	if n == nil {
+		n = &pnode{}
+	}
+	bit, pos := n.index(hash, shift)
+	if n.bitmap&bit == 0 {
+		children := make([]pchild, len(n.children)+1)
+		copy(children, n.children[:pos])
+		children[pos] = pchild{leaf: &pleaf{hash, []pair{{uid, e}}}}
+		copy(children[pos+1:], n.children[pos:])
+		return &pnode{n.bitmap | bit, children}, nil
+	}
+
+	var replacement pchild
+	var old *entry
+	switch child := n.children[pos]; {
+	case child.node != nil:
+		var node *pnode
+		node, old = child.node.with(hash, shift+pmapBits, uid, e)
+		replacement = pchild{node: node}
+	case child.leaf.hash == hash:
+		var leaf *pleaf
+		leaf, old = child.leaf.with(uid, e)
+		replacement = pchild{leaf: leaf}
+	default:
+		// Push the existing leaf down a level, alongside the
+		// new one.
+		lbit, _ := (&pnode{}).index(child.leaf.hash, shift+pmapBits)
+		node := &pnode{lbit, []pchild{child}}
+		node, _ = node.with(hash, shift+pmapBits, uid, e)
+		replacement = pchild{node: node}
+	}
+	return n.replace(pos, replacement), old
+}
+
+// without returns the trie without the UID, along with the entry that
+// it was mapped to, if any.
+func (n *pnode) without(hash uint32, shift uint, uid string) (*pnode, *entry) {
+	if n == nil {
+		return nil, nil
+	}
+	bit, pos := n.index(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, nil
+	}
+
+	var replacement pchild
+	var old *entry
+	if child := n.children[pos]; child.leaf != nil {
+		var leaf *pleaf
+		leaf, old = child.leaf.without(hash, uid)
+		replacement = pchild{leaf: leaf}
+	} else {
+		var node *pnode
+		node, old = child.node.without(hash, shift+pmapBits, uid)
+		switch {
+		case node == nil:
+		case len(node.children) == 1 && node.children[0].leaf != nil:
+			// Pull a lone leaf back up.
+			replacement = node.children[0]
+		default:
+			replacement = pchild{node: node}
+		}
+	}
+	if old == nil {
+		return n, nil
+	}
+	if replacement.node != nil || replacement.leaf != nil {
+		return n.replace(pos, replacement), old
+	}
+	if len(n.children) == 1 {
+		return nil, old
+	}
+	children := make([]pchild, len(n.children)-1)
+	copy(children, n.children[:pos])
+	copy(children[pos:], n.children[pos+1:])
+	return &pnode{n.bitmap &^ bit, children}, old
+}
+
+// replace returns a copy of the node with the child at pos replaced.
+func (n *pnode) replace(pos int, child pchild) *pnode {
+	children := make([]pchild, len(n.children))
+	copy(children, n.children)
+	children[pos] = child
+	return &pnode{n.bitmap, children}
+}
+
+// each calls fn for every UID in the trie.
+func (n *pnode) each(fn func(uid string, e *entry)) {
+	n.until(func(uid string, e *entry) bool {
+		fn(uid, e)
+		return true
+	})
+}
+
+// until calls fn for each entry until it returns false, returning
+// whether it got through them all.
+func (n *pnode) until(fn func(uid string, e *entry) bool) bool {
+	if n == nil {
+		return true
+	}
+	for _, child := range n.children {
+		if child.leaf != nil {
+			for _, p := range child.leaf.pairs {
+				if !fn(p.uid, p.entry) {
+					return false
+				}
+			}
+		} else if !child.node.until(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *pleaf) get(hash uint32, uid string) *entry {
+	if l.hash != hash {
+		return nil
+	}
+	for _, p := range l.pairs {
+		if p.uid == uid {
+			return p.entry
+		}
+	}
+	return nil
+}
+
+func (l *pleaf) with(uid string, e *entry) (*pleaf, *entry) {
+	pairs := make([]pair, len(l.pairs), len(l.pairs)+1)
+	copy(pairs, l.pairs)
+	for i, p := range pairs {
+		if p.uid == uid {
+			pairs[i].entry = e
+			return &pleaf{l.hash, pairs}, p.entry
+		}
+	}
+	return &pleaf{l.hash, append(pairs, pair{uid, e})}, nil
+}
+
+// without returns the leaf without the UID (or nil, if that leaves it
+// empty), along with the entry that it was mapped to, if any.
+func (l *pleaf) without(hash uint32, uid string) (*pleaf, *entry) {
+	if l.hash != hash {
+		return l, nil
+	}
+	for i, p := range l.pairs {
+		if p.uid == uid {
+			if len(l.pairs) == 1 {
+				return nil, p.entry
+			}
+			pairs := make([]pair, 0, len(l.pairs)-1)
+			pairs = append(pairs, l.pairs[:i]...)
+			pairs = append(pairs, l.pairs[i+1:]...)
+			return &pleaf{l.hash, pairs}, p.entry
+		}
+	}
+	return l, nil
+}
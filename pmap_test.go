@@ -0,0 +1,109 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// pmapModel checks a trie against the map that it should be equal to.
+func pmapModel(t *testing.T, n *pnode, hash func(string) uint32, want map[string]*entry) {
+	t.Helper()
+	got := map[string]*entry{}
+	n.each(func(uid string, e *entry) {
+		if _, ok := got[uid]; ok {
+			t.Fatalf("%s is in the trie twice", uid)
+		}
+		got[uid] = e
+	})
+	if len(got) != len(want) {
+		t.Fatalf("the trie has %d entries, want %d", len(got), len(want))
+	}
+	for uid, e := range want {
+		if got[uid] != e {
+			t.Fatalf("each: %s is %p, want %p", uid, got[uid], e)
+		}
+		if g := n.get(hash(uid), uid); g != e {
+			t.Fatalf("get: %s is %p, want %p", uid, g, e)
+		}
+	}
+}
+
+func TestPmap(t *testing.T) {
+	hashes := map[string]func(string) uint32{
+		"fnv": hashUID,
+		// Few enough distinct hashes that many UIDs collide, and
+		// leaves are pushed down to the bottom of the trie.
+		"colliding": func(uid string) uint32 { return hashUID(uid) & 0xc0000007 },
+	}
+	for name, hash := range hashes {
+		hash := hash
+		t.Run(name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			var n *pnode
+			want := map[string]*entry{}
+			type version struct {
+				n    *pnode
+				want map[string]*entry
+			}
+			var versions []version
+			for i := 0; i < 5000; i++ {
+				uid := fmt.Sprintf("uid-%d", rng.Intn(500))
+				var old *entry
+				if rng.Intn(3) == 0 {
+					n, old = n.without(hash(uid), 0, uid)
+					if old != want[uid] {
+						t.Fatalf("step %d: without %s returned %p, want %p", i, uid, old, want[uid])
+					}
+					delete(want, uid)
+				} else {
+					e := &entry{resourceVersion: uid}
+					n, old = n.with(hash(uid), 0, uid, e)
+					if old != want[uid] {
+						t.Fatalf("step %d: with %s returned %p, want %p", i, uid, old, want[uid])
+					}
+					want[uid] = e
+				}
+				if i%250 == 0 {
+					copied := make(map[string]*entry, len(want))
+					for uid, e := range want {
+						copied[uid] = e
+					}
+					versions = append(versions, version{n, copied})
+				}
+			}
+			pmapModel(t, n, hash, want)
+			// Every earlier version is unchanged by what was
+			// built from it.
+			for _, v := range versions {
+				pmapModel(t, v.n, hash, v.want)
+			}
+			for uid := range want {
+				n, _ = n.without(hash(uid), 0, uid)
+			}
+			if n != nil {
+				t.Fatalf("the trie isn't empty once everything is removed")
+			}
+		})
+	}
+}
+
+func TestPmapUntil(t *testing.T) {
+	var n *pnode
+	for i := 0; i < 100; i++ {
+		uid := fmt.Sprint(i)
+		n, _ = n.with(hashUID(uid), 0, uid, &entry{})
+	}
+	calls := 0
+	if n.until(func(string, *entry) bool {
+		calls++
+		return calls < 10
+	}) {
+		t.Fatalf("until got through every entry")
+	}
+	if calls != 10 {
+		t.Fatalf("until called fn %d times after it returned false, want 10", calls)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// A Policy checks resources against a rule.  The package doesn't embed
+// a policy language; a CEL expression or a Rego query is plugged in by
+// implementing Policy, usually with JSONPolicy, since both evaluate
+// the JSON form of the resource, e.g. with cel-go:
+//
+//	policy := k8sutil.JSONPolicy(func(object map[string]interface{}) ([]string, error) {
+//		out, _, err := program.Eval(map[string]interface{}{"object": object})
+//		if err != nil {
+//			return nil, err
+//		}
+//		if out.Value() == true {
+//			return nil, nil
+//		}
+//		return []string{"replicas must be at least 2"}, nil
+//	})
+type Policy interface {
+	// Evaluate returns the ways in which the resource violates the
+	// policy, or none if it complies.  An error means that the
+	// policy couldn't be evaluated.
+	Evaluate(resource k8s.Resource) ([]string, error)
+}
+
+// PolicyFunc is a Policy of a function.
+type PolicyFunc func(resource k8s.Resource) ([]string, error)
+
+// Evaluate implements Policy.
+func (f PolicyFunc) Evaluate(resource k8s.Resource) ([]string, error) {
+	return f(resource)
+}
+
+// JSONPolicy returns a Policy that evaluates the JSON form of a
+// resource, as a generic object with its apiVersion and kind, which
+// typed resources don't carry.
+func JSONPolicy(fn func(object map[string]interface{}) ([]string, error)) Policy {
+	return PolicyFunc(func(resource k8s.Resource) ([]string, error) {
+		object, err := jsonObject(resource)
+		if err != nil {
+			return nil, errors.Wrap(err, "encode")
+		}
+		if gvk, err := GVKOf(resource); err == nil {
+			object["apiVersion"] = gvk.APIVersion()
+			object["kind"] = gvk.Kind
+		}
+		return fn(object)
+	})
+}
+
+// A PolicyRule applies a Policy to the resources of a type.
+type PolicyRule struct {
+	Name   string       // identifies the rule in PolicyViolations
+	Type   k8s.Resource // a sample of the type that the rule applies to
+	Policy Policy
+}
+
+// A PolicyViolation is a resource that violates a rule.
+type PolicyViolation struct {
+	Rule     string
+	Resource k8s.Resource
+	Messages []string // as returned by the Policy
+}
+
+// A PolicyChecker evaluates rules against resources as they are added
+// or updated, for audit-mode policy checking: it reports violations,
+// but doesn't prevent them.  Wrap the WatchingStore's Callback with
+// Wrap, so that the resources are checked on each notification, e.g.
+//
+//	checker := &k8sutil.PolicyChecker{Rules: rules, Sink: report}
+//	store.Callback = checker.Wrap(store.Callback)
+//
+// The store must be watching the types that the rules apply to.  Each
+// resource is evaluated when it is first seen, including by the first
+// check, and each time that its resourceVersion changes.
+type PolicyChecker struct {
+	Rules []PolicyRule
+
+	// Sink, if set, is called with each violation, each time that
+	// a resource is evaluated and violates a rule.  It is called
+	// synchronously, from the Callback.
+	Sink func(PolicyViolation)
+
+	// Logger, if set, is told about rules that can't be
+	// evaluated.
+	Logger Logger
+
+	mu         sync.Mutex
+	prev       Store
+	violations map[policyKey]PolicyViolation
+}
+
+// A policyKey identifies the violation of a rule by a resource.
+type policyKey struct {
+	rule int
+	key  ObjectKey
+}
+
+// Wrap returns a callback that checks the Store, and then calls the
+// callback, if it isn't nil.
+func (c *PolicyChecker) Wrap(callback func(Store)) func(Store) {
+	return func(store Store) {
+		c.Check(store)
+		if callback != nil {
+			callback(store)
+		}
+	}
+}
+
+// Check evaluates the rules against the resources that were added or
+// updated since the last Store that was checked.
+func (c *PolicyChecker) Check(store Store) {
+	c.mu.Lock()
+	prev := c.prev
+	c.prev = store
+	if c.violations == nil {
+		c.violations = make(map[policyKey]PolicyViolation)
+	}
+	var found []PolicyViolation
+	for i, rule := range c.Rules {
+		diff := DiffStores(prev, store, rule.Type)
+		for _, resource := range diff.Removed {
+			delete(c.violations, policyKey{i, objectKeyOf(resource)})
+		}
+		evaluate := func(resource k8s.Resource) {
+			key := policyKey{i, objectKeyOf(resource)}
+			messages, err := rule.Policy.Evaluate(resource)
+			if err != nil {
+				if c.Logger != nil {
+					c.Logger.Errorf("evaluate policy %s on %s: %v", rule.Name, key.key, err)
+				}
+				return
+			}
+			if len(messages) == 0 {
+				delete(c.violations, key)
+				return
+			}
+			violation := PolicyViolation{Rule: rule.Name, Resource: resource, Messages: messages}
+			c.violations[key] = violation
+			found = append(found, violation)
+		}
+		for _, resource := range diff.Added {
+			evaluate(resource)
+		}
+		for _, change := range diff.Changed {
+			evaluate(change.New)
+		}
+	}
+	c.mu.Unlock()
+	if c.Sink != nil {
+		for _, violation := range found {
+			c.Sink(violation)
+		}
+	}
+}
+
+// Violations returns the current violations: those of the resources in
+// the last Store that was checked, as of when each was last evaluated,
+// sorted by rule and then by namespace and name.
+func (c *PolicyChecker) Violations() []PolicyViolation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]policyKey, 0, len(c.violations))
+	for key := range c.violations {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].rule != keys[j].rule {
+			return keys[i].rule < keys[j].rule
+		}
+		if keys[i].key.Namespace != keys[j].key.Namespace {
+			return keys[i].key.Namespace < keys[j].key.Namespace
+		}
+		return keys[i].key.Name < keys[j].key.Name
+	})
+	ret := make([]PolicyViolation, len(keys))
+	for i, key := range keys {
+		ret[i] = c.violations[key]
+	}
+	return ret
+}
+
+// objectKeyOf returns the resource's key.
+func objectKeyOf(resource k8s.Resource) ObjectKey {
+	md := resource.GetMetadata()
+	return ObjectKey{Namespace: md.GetNamespace(), Name: md.GetName()}
+}
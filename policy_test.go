@@ -0,0 +1,107 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+
+	"github.com/datawire/k8sutil"
+)
+
+// replicasPolicy requires at least two replicas.
+var replicasPolicy = k8sutil.PolicyFunc(func(resource k8s.Resource) ([]string, error) {
+	if resource.(*appsv1.Deployment).GetSpec().GetReplicas() < 2 {
+		return []string{"replicas must be at least 2"}, nil
+	}
+	return nil, nil
+})
+
+// versioned sets the resource's resourceVersion.
+func versioned(resource k8s.Resource, resourceVersion string) k8s.Resource {
+	resource.GetMetadata().ResourceVersion = k8s.String(resourceVersion)
+	return resource
+}
+
+func TestPolicyChecker(t *testing.T) {
+	var reported []string
+	checker := &k8sutil.PolicyChecker{
+		Rules: []k8sutil.PolicyRule{{Name: "replicas", Type: &appsv1.Deployment{}, Policy: replicasPolicy}},
+		Sink: func(v k8sutil.PolicyViolation) {
+			reported = append(reported, v.Rule+" "+v.Resource.GetMetadata().GetName())
+		},
+	}
+	violations := func() []string {
+		var ret []string
+		for _, v := range checker.Violations() {
+			ret = append(ret, fmt.Sprintf("%s %s %v", v.Rule, v.Resource.GetMetadata().GetName(), v.Messages))
+		}
+		return ret
+	}
+
+	var callbacks int
+	callback := checker.Wrap(func(k8sutil.Store) { callbacks++ })
+	callback(staticStore{
+		versioned(deployment("a", "one", 1, 1), "1"),
+		versioned(deployment("a", "two", 2, 2), "1"),
+	})
+	if want := []string{"replicas one [replicas must be at least 2]"}; !reflect.DeepEqual(violations(), want) {
+		t.Errorf("got violations %q, want %q", violations(), want)
+	}
+
+	// An unchanged resource isn't evaluated, or reported, again.
+	callback(staticStore{
+		versioned(deployment("a", "one", 1, 1), "1"),
+		versioned(deployment("a", "two", 1, 1), "2"),
+	})
+	if want := []string{"replicas one [replicas must be at least 2]", "replicas two [replicas must be at least 2]"}; !reflect.DeepEqual(violations(), want) {
+		t.Errorf("got violations %q, want %q", violations(), want)
+	}
+	if want := []string{"replicas one", "replicas two"}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("reported %q, want %q", reported, want)
+	}
+
+	// Fixed and removed resources no longer violate the rule.
+	callback(staticStore{versioned(deployment("a", "two", 3, 3), "3")})
+	if got := violations(); len(got) != 0 {
+		t.Errorf("got violations %q", got)
+	}
+	if callbacks != 3 {
+		t.Errorf("called the callback %d times", callbacks)
+	}
+}
+
+// TestJSONPolicy checks that a JSONPolicy sees the resource in the
+// apiserver's JSON encoding, with its apiVersion and kind.
+func TestJSONPolicy(t *testing.T) {
+	var object map[string]interface{}
+	policy := k8sutil.JSONPolicy(func(o map[string]interface{}) ([]string, error) {
+		object = o
+		return nil, nil
+	})
+	d := versioned(deployment("a", "web", 1, 1), "1").(*appsv1.Deployment)
+	d.Spec.Template = &corev1.PodTemplateSpec{Spec: &corev1.PodSpec{Containers: []*corev1.Container{{
+		Name:      k8s.String("web"),
+		Ports:     []*corev1.ContainerPort{{ContainerPort: k8s.Int32(8080)}},
+		Resources: &corev1.ResourceRequirements{Limits: map[string]*resource.Quantity{"cpu": {String_: k8s.String("100m")}}},
+	}}}}
+	if _, err := policy.Evaluate(d); err != nil {
+		t.Fatal(err)
+	}
+	if object["apiVersion"] != "apps/v1" || object["kind"] != "Deployment" {
+		t.Errorf("got apiVersion %v, kind %v", object["apiVersion"], object["kind"])
+	}
+	container := object["spec"].(map[string]interface{})["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0].(map[string]interface{})
+	if cpu := container["resources"].(map[string]interface{})["limits"].(map[string]interface{})["cpu"]; cpu != "100m" {
+		t.Errorf("got cpu %#v", cpu)
+	}
+	if port := container["ports"].([]interface{})[0].(map[string]interface{})["containerPort"]; port != 8080.0 {
+		t.Errorf("got containerPort %#v", port)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+)
+
+// portForwardProtocols are the versions of the streaming protocol that
+// port forwarding speaks over WebSocket.  Each port has a pair of
+// channels, for its data and its errors; each channel starts with the
+// port number, as a little-endian uint16.
+var portForwardProtocols = []string{"v4.channel.k8s.io"}
+
+// PortForward forwards connections to localPort, on the loopback
+// interface, to remotePort of a pod, as "kubectl port-forward" does,
+// until the Context is done, and then returns nil.  It returns an error
+// if it can't listen on localPort.
+//
+// Each connection is forwarded over a WebSocket connection of its own,
+// so if the pod dies, the connections to it are closed, but new
+// connections are forwarded to the pod of the same name as soon as it
+// is replaced (as a StatefulSet's pods are).
+func PortForward(ctx context.Context, client *k8s.Client, namespace, pod string, localPort, remotePort int) error {
+	return portForward(ctx, client, nil, localPort, func() (ObjectKey, int, error) {
+		return ObjectKey{Namespace: namespace, Name: pod}, remotePort, nil
+	})
+}
+
+// PortForwardService is like PortForward, but forwards each connection
+// to a ready pod of a service, chosen from the store, which must be
+// watching Services and Pods in the namespace.  remotePort is a port of
+// the Service, which is forwarded to its target port on the pod.  As a
+// new pod is chosen for each connection, connections continue to be
+// forwarded when the pod that they were forwarded to dies.  Errors
+// forwarding connections are logged to the store's Logger.
+func PortForwardService(ctx context.Context, store *WatchingStore, namespace, service string, localPort, remotePort int) error {
+	return portForward(ctx, store.Client, store.Logger, localPort, func() (ObjectKey, int, error) {
+		snapshot, err := store.Snapshot()
+		if err != nil {
+			return ObjectKey{}, 0, err
+		}
+		return readyServicePod(snapshot, namespace, service, remotePort)
+	})
+}
+
+// portForward listens on localPort, and forwards each connection to the
+// pod and port that target returns for it.
+func portForward(ctx context.Context, client *k8s.Client, logger Logger, localPort int, target func() (pod ObjectKey, port int, err error)) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort)))
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				sleep(ctx, SystemClock, 10*time.Millisecond)
+				continue
+			}
+			return errors.Wrap(err, "accept")
+		}
+		go func() {
+			pod, port, err := target()
+			if err == nil {
+				err = forwardConn(ctx, client, pod, port, conn)
+			}
+			conn.Close()
+			if err != nil && ctx.Err() == nil && logger != nil {
+				logger.Errorf("port forward to %s:%d: %v", pod, port, err)
+			}
+		}()
+	}
+}
+
+// forwardConn forwards a connection to a port of a pod, until either
+// end closes it.
+func forwardConn(ctx context.Context, client *k8s.Client, key ObjectKey, port int, conn net.Conn) error {
+	ws, _, err := dialWebSocket(ctx, client, request{
+		verb:  http.MethodGet,
+		path:  "/api/v1/namespaces/" + url.PathEscape(key.Namespace) + "/pods/" + url.PathEscape(key.Name) + "/portforward",
+		query: url.Values{"ports": {strconv.Itoa(port)}},
+	}, portForwardProtocols)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+		conn.Close()
+	}()
+
+	go func() {
+		defer cancel()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := conn.Read(buf[1:])
+			if n > 0 {
+				buf[0] = 0 // the data channel
+				if ws.WriteMessage(buf[:1+n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// The number of bytes of the port number still to skip on the
+	// data and error channels.
+	skip := [2]int{2, 2}
+	for {
+		msg, err := ws.ReadMessage()
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if len(msg) == 0 || msg[0] > 1 {
+			continue
+		}
+		channel, data := msg[0], msg[1:]
+		n := skip[channel]
+		if n > len(data) {
+			n = len(data)
+		}
+		skip[channel] -= n
+		data = data[n:]
+		if len(data) == 0 {
+			continue
+		}
+		if channel == 1 {
+			return errors.New(string(data))
+		}
+		if _, err := conn.Write(data); err != nil {
+			return nil
+		}
+	}
+}
+
+// readyServicePod returns a ready pod of the service in the store, and
+// the port of it that the service port targets.
+func readyServicePod(store Store, namespace, service string, servicePort int) (ObjectKey, int, error) {
+	var svc *corev1.Service
+	for _, r := range store.List(&corev1.Service{}) {
+		md := r.GetMetadata()
+		if md.GetNamespace() == namespace && md.GetName() == service {
+			svc = r.(*corev1.Service)
+			break
+		}
+	}
+	if svc == nil {
+		return ObjectKey{}, 0, errors.Errorf("service %s/%s not found", namespace, service)
+	}
+	var port *corev1.ServicePort
+	for _, p := range svc.GetSpec().GetPorts() {
+		if int(p.GetPort()) == servicePort {
+			port = p
+			break
+		}
+	}
+	if port == nil {
+		return ObjectKey{}, 0, errors.Errorf("service %s/%s has no port %d", namespace, service, servicePort)
+	}
+	selector := svc.GetSpec().GetSelector()
+	if len(selector) == 0 {
+		return ObjectKey{}, 0, errors.Errorf("service %s/%s has no selector", namespace, service)
+	}
+	for _, r := range store.ListSorted(&corev1.Pod{}) {
+		pod := r.(*corev1.Pod)
+		md := pod.GetMetadata()
+		if md.GetNamespace() != namespace || md.GetDeletionTimestamp() != nil || !podReady(pod) {
+			continue
+		}
+		matches := true
+		for k, v := range selector {
+			if md.GetLabels()[k] != v {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		target, ok := targetPort(pod, port)
+		if !ok {
+			continue
+		}
+		return objectKeyOf(pod), target, nil
+	}
+	return ObjectKey{}, 0, errors.Errorf("service %s/%s has no ready pods", namespace, service)
+}
+
+// podReady returns whether the pod is running and its Ready condition
+// is true.
+func podReady(pod *corev1.Pod) bool {
+	if pod.GetStatus().GetPhase() != "Running" {
+		return false
+	}
+	for _, c := range pod.GetStatus().GetConditions() {
+		if c.GetType() == "Ready" {
+			return c.GetStatus() == "True"
+		}
+	}
+	return false
+}
+
+// targetPort returns the port of the pod that the service port targets,
+// or false if it targets a named port that the pod doesn't have.
+func targetPort(pod *corev1.Pod, port *corev1.ServicePort) (int, bool) {
+	target := port.GetTargetPort()
+	switch {
+	case target == nil:
+		return int(port.GetPort()), true
+	case target.GetType() == 1: // a name
+		for _, c := range pod.GetSpec().GetContainers() {
+			for _, p := range c.GetPorts() {
+				if p.GetName() == target.GetStrVal() {
+					return int(p.GetContainerPort()), true
+				}
+			}
+		}
+		return 0, false
+	case target.GetIntVal() == 0:
+		return int(port.GetPort()), true
+	}
+	return int(target.GetIntVal()), true
+}
@@ -0,0 +1,148 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/ericchiang/k8s/util/intstr"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// freePort returns a local port that isn't in use.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// newFakePortForward returns a client of a server that forwards the
+// port of the pod default/web to a service that upper-cases what it
+// is sent.
+func newFakePortForward(t *testing.T, port int) *k8s.Client {
+	return newFakeStream(t, "portforward", "v4.channel.k8s.io", func(query map[string][]string, c *fakeExecConn) {
+		if got := query["ports"]; len(got) != 1 || got[0] != strconv.Itoa(port) {
+			t.Errorf("got ports %q", got)
+		}
+		// Each channel starts with the port.
+		prefix := []byte{byte(port), byte(port >> 8)}
+		c.write(0, prefix)
+		c.write(1, prefix)
+		msg, err := c.read()
+		if err != nil || msg[0] != 0 {
+			t.Errorf("got %q, %v", msg, err)
+			return
+		}
+		c.write(0, bytes.ToUpper(msg[1:]))
+	})
+}
+
+// dialForwarded sends msg to the local port, and returns the reply.
+func dialForwarded(t *testing.T, localPort int, msg string) string {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	// Wait for PortForward to listen.
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(reply)
+}
+
+func TestPortForward(t *testing.T) {
+	client := newFakePortForward(t, 8080)
+	localPort := freePort(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- k8sutil.PortForward(ctx, client, "default", "web", localPort, 8080) }()
+	for i := 0; i < 2; i++ {
+		if reply := dialForwarded(t, localPort, "hello"); reply != "HELLO" {
+			t.Errorf("connection %d: got %q", i, reply)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// TestPortForwardService checks that a connection is forwarded to the
+// target port of a ready pod of the service.
+func TestPortForwardService(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	synced := make(chan struct{}, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Client:   newFakePortForward(t, 8080),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { synced <- struct{}{} },
+	}
+	w.AddWatch("default", &corev1.ServiceList{})
+	named := int64(1)
+	w.AddWatch("default", &corev1.PodList{})
+	backend.Stream("default", &corev1.ServiceList{}).List(&corev1.ServiceList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items: []*corev1.Service{{
+			Metadata: k8sutiltest.ObjectMeta("default", "web", "1"),
+			Spec: &corev1.ServiceSpec{
+				Selector: map[string]string{"app": "web"},
+				Ports:    []*corev1.ServicePort{{Port: k8s.Int32(80), TargetPort: &intstr.IntOrString{Type: &named, StrVal: k8s.String("http")}}},
+			},
+		}},
+	})
+	servicePod := func(name, ready string) *corev1.Pod {
+		p := pod("default", name, "Running")
+		p.Metadata = k8sutiltest.ObjectMeta("default", name, "1")
+		p.Metadata.Labels = map[string]string{"app": "web"}
+		p.Spec = &corev1.PodSpec{Containers: []*corev1.Container{{
+			Ports: []*corev1.ContainerPort{{Name: k8s.String("http"), ContainerPort: k8s.Int32(8080)}},
+		}}}
+		p.Status.Conditions = []*corev1.PodCondition{{Type: k8s.String("Ready"), Status: k8s.String(ready)}}
+		return p
+	}
+	backend.Stream("default", &corev1.PodList{}).List(&corev1.PodList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items:    []*corev1.Pod{servicePod("unready", "False"), servicePod("web", "True")},
+	})
+	runStore(t, w)
+	<-synced
+
+	localPort := freePort(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- k8sutil.PortForwardService(ctx, w, "default", "web", localPort, 80) }()
+	if reply := dialForwarded(t, localPort, "hello"); reply != "HELLO" {
+		t.Errorf("got %q", reply)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"bytes"
+	"runtime/pprof"
+	"strings"
+	"testing"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// goroutineLabels returns the label sets of the running goroutines, as
+// the goroutine profile prints them.
+func goroutineLabels(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	var labels []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "# labels: ") {
+			labels = append(labels, strings.TrimPrefix(line, "# labels: "))
+		}
+	}
+	return strings.Join(labels, "\n")
+}
+
+func TestPprofLabels(t *testing.T) {
+	server := newFakeAPIServer(t)
+	profiles := make(chan string, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { profiles <- goroutineLabels(t) },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	server.await("watch")
+
+	labels := <-profiles
+	for _, want := range []string{
+		`"k8sutil.callback":"Callback"`,
+		`"k8sutil.namespace":"default"`,
+		`"k8sutil.watch":"v1 ConfigMap"`,
+	} {
+		if !strings.Contains(labels, want) {
+			t.Errorf("no goroutine labeled %s in:\n%s", want, labels)
+		}
+	}
+}
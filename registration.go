@@ -0,0 +1,153 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// The k8s package keeps the group, version, and resource name that
+// each type was registered with to itself; the only way to get at them
+// is to have it build a request URL for the type.  captureURL does that
+// with a client whose transport records the URL instead of sending the
+// request.
+
+var errCaptured = errors.New("request captured")
+
+// captureURL returns the URL of the request that fn makes with the
+// client it is given, or nil if it doesn't make one.
+func captureURL(fn func(*k8s.Client) error) *url.URL {
+	var captured *url.URL
+	client := &k8s.Client{
+		Endpoint: "http://k8sutil.invalid",
+		Client: &http.Client{
+			Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				captured = req.URL
+				return nil, errCaptured
+			}),
+		},
+	}
+	_ = fn(client)
+	return captured
+}
+
+// apiResourceForList describes the type of the list using its
+// registration with the k8s package.  The Kind is assumed to be the
+// name of the Go type of the list's items, which is true of all of the
+// types in github.com/ericchiang/k8s/apis.  The Verbs are unknown.
+func apiResourceForList(list k8s.ResourceList) (APIResource, error) {
+	switch list := list.(type) {
+	case *UnstructuredList:
+		return list.Resource, nil
+	case *PartialObjectMetadataList:
+		return list.Resource, nil
+	}
+	ret := APIResource{
+		Kind:       reflect.TypeOf(listItemSample(list)).Elem().Name(),
+		Namespaced: true,
+	}
+	const namespace = "k8sutil"
+	u := captureURL(func(client *k8s.Client) error {
+		return client.List(context.Background(), namespace, newResourceListLike(list))
+	})
+	if u == nil {
+		// Either the type isn't registered, or it isn't
+		// namespaced.
+		ret.Namespaced = false
+		u = captureURL(func(client *k8s.Client) error {
+			return client.List(context.Background(), k8s.AllNamespaces, newResourceListLike(list))
+		})
+	}
+	if u == nil {
+		return APIResource{}, errors.Errorf("type %T is not registered with the k8s package", list)
+	}
+
+	return parseResourceURL(ret, u.Path, namespace, "")
+}
+
+// parseResourceURL fills in the group, version, and resource name of
+// ret from the path of a URL that the k8s package built for the type,
+// with the namespace (if ret.Namespaced) and the name (if any).
+func parseResourceURL(ret APIResource, urlPath, namespace, name string) (APIResource, error) {
+	// The path is one of
+	//     /api/{version}[/namespaces/{namespace}]/{resource}[/{name}]
+	//     /apis/{group}/{version}[/namespaces/{namespace}]/{resource}[/{name}]
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if len(parts) > 0 && parts[0] == "apis" && len(parts) > 1 {
+		ret.Group = parts[1]
+		parts = parts[2:]
+	} else if len(parts) > 0 && parts[0] == "api" {
+		parts = parts[1:]
+	} else {
+		return APIResource{}, errors.Errorf("unexpected URL %q", urlPath)
+	}
+	if name != "" {
+		if len(parts) == 0 || parts[len(parts)-1] != name {
+			return APIResource{}, errors.Errorf("unexpected URL %q", urlPath)
+		}
+		parts = parts[:len(parts)-1]
+	}
+	if ret.Namespaced {
+		if len(parts) != 4 || parts[1] != "namespaces" || parts[2] != namespace {
+			return APIResource{}, errors.Errorf("unexpected URL %q", urlPath)
+		}
+		parts = []string{parts[0], parts[3]}
+	}
+	if len(parts) != 2 {
+		return APIResource{}, errors.Errorf("unexpected URL %q", urlPath)
+	}
+	ret.Version = parts[0]
+	ret.Name = parts[1]
+	return ret, nil
+}
+
+// apiResourceForResource is like apiResourceForList, but for the type
+// of a single resource.
+func apiResourceForResource(resource k8s.Resource) (APIResource, error) {
+	switch r := resource.(type) {
+	case *Unstructured:
+		return apiResourceForAPIVersion(r.APIVersion(), r.Kind()), nil
+	case *PartialObjectMetadata:
+		return apiResourceForAPIVersion(r.APIVersion, r.Kind), nil
+	}
+	ret := APIResource{
+		Kind:       reflect.TypeOf(resource).Elem().Name(),
+		Namespaced: true,
+	}
+	const namespace, name = "k8sutil", "k8sutil"
+	u := captureURL(func(client *k8s.Client) error {
+		return client.Get(context.Background(), namespace, name, getNewResourceInstance(resource))
+	})
+	if u == nil {
+		ret.Namespaced = false
+		u = captureURL(func(client *k8s.Client) error {
+			return client.Get(context.Background(), "", name, getNewResourceInstance(resource))
+		})
+	}
+	if u == nil {
+		return APIResource{}, errors.Errorf("type %T is not registered with the k8s package", resource)
+	}
+	ret, err := parseResourceURL(ret, u.Path, namespace, name)
+	if err != nil {
+		return APIResource{}, errors.Wrapf(err, "type %T", resource)
+	}
+	return ret, nil
+}
+
+// apiResourceForAPIVersion returns what can be known about a type from
+// its apiVersion and kind: not its resource name, or whether it is
+// namespaced.
+func apiResourceForAPIVersion(apiVersion, kind string) APIResource {
+	ret := APIResource{Version: apiVersion, Kind: kind}
+	if i := strings.Index(apiVersion, "/"); i >= 0 {
+		ret.Group, ret.Version = apiVersion[:i], apiVersion[i+1:]
+	}
+	return ret
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// A listLimiter keeps the watches of a WatchingStore from listing too
+// often, or too many at once: see MinRelistInterval and
+// MaxConcurrentRelists.
+type listLimiter struct {
+	interval time.Duration
+	slots    chan struct{} // nil if unlimited
+}
+
+func newListLimiter(interval time.Duration, concurrency int) *listLimiter {
+	l := &listLimiter{interval: interval}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// acquire waits until the watch may list, returning false if the
+// Context is done first.  If it returns true, release must be called
+// once the listing is done.
+func (l *listLimiter) acquire(ctx context.Context, w *watch) bool {
+	if l.interval > 0 && !w.listStarted.IsZero() {
+		jitter := time.Duration(rand.Int63n(int64(l.interval)/2 + 1))
+		if delay := w.listStarted.Add(l.interval + jitter).Sub(w.clock.Now()); delay > 0 {
+			sleep(ctx, w.clock, delay)
+		}
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	w.listStarted = w.clock.Now()
+	return true
+}
+
+func (l *listLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
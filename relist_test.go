@@ -0,0 +1,91 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"testing"
+	"time"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestMinRelistInterval checks that a watch that expires doesn't list
+// again until the MinRelistInterval, and its jitter, have passed.
+func TestMinRelistInterval(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	backend := k8sutiltest.NewScriptedBackend(t)
+	rec := k8sutiltest.NewRecorder(&corev1.ConfigMap{})
+	w := &k8sutil.WatchingStore{
+		Backend:           backend,
+		Logger:            testLogger{t},
+		Callback:          rec.Callback,
+		Clock:             clock,
+		MinRelistInterval: time.Minute,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	s := backend.Stream("default", &corev1.ConfigMapList{})
+	s.List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.ConfigMap{configMap("default", "a", "1")}})
+	runStore(t, w)
+	rec.Expect(t, "v1 ConfigMap: default/a@1")
+	s.WaitForWatch(1)
+
+	s.List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("3"), Items: []*corev1.ConfigMap{configMap("default", "a", "2")}})
+	s.Expire()
+	if !clock.WaitForTimers(1, k8sutiltest.DefaultTimeout) {
+		t.Fatal("timed out waiting for the watch to wait")
+	}
+	rec.ExpectNone(t, quiet)
+	if n := s.Lists(); n != 1 {
+		t.Fatalf("listed %d times before the MinRelistInterval", n)
+	}
+	clock.Advance(90 * time.Second) // the interval, and the most jitter
+	rec.Expect(t, "v1 ConfigMap: default/a@2")
+	s.WaitForWatch(2)
+}
+
+// TestMaxConcurrentRelists checks that watches wait for their turn to
+// list.
+func TestMaxConcurrentRelists(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	rec := k8sutiltest.NewRecorder(&corev1.ConfigMap{})
+	w := &k8sutil.WatchingStore{
+		Backend:              backend,
+		Logger:               testLogger{t},
+		Callback:             rec.Callback,
+		MaxConcurrentRelists: 1,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch("other", &corev1.ConfigMapList{})
+	streams := map[string]*k8sutiltest.Stream{
+		"default": backend.Stream("default", &corev1.ConfigMapList{}),
+		"other":   backend.Stream("other", &corev1.ConfigMapList{}),
+	}
+	runStore(t, w)
+
+	// Whichever lists first holds up the other.
+	var first string
+	deadline := time.Now().Add(k8sutiltest.DefaultTimeout)
+	for first == "" {
+		for namespace, s := range streams {
+			if s.Lists() > 0 {
+				first = namespace
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a listing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	second := map[string]string{"default": "other", "other": "default"}[first]
+	time.Sleep(quiet)
+	if n := streams[second].Lists(); n != 0 {
+		t.Fatalf("%s listed %d times while %s was listing", second, n, first)
+	}
+	streams[first].List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.ConfigMap{configMap(first, "x", "1")}})
+	streams[second].WaitForList(1)
+	streams[second].List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1"), Items: []*corev1.ConfigMap{configMap(second, "x", "1")}})
+	rec.Expect(t, "v1 ConfigMap: default/x@1 other/x@1")
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+
+	"github.com/ericchiang/k8s"
+)
+
+// A removal is a request, from RemoveWatch, to the Run goroutine.
+type removal struct {
+	key       typeKey
+	namespace string
+	reply     chan<- int
+}
+
+// RemoveWatch stops the watches of resources of the same type as the
+// sample, in the namespace, and purges the resources that they were
+// keeping fresh from the store, unless another watch is keeping them
+// fresh too.  The Callbacks are then notified, just as if the
+// resources had been deleted, so that consumers never act on data that
+// the store is no longer keeping up to date.  RemoveWatch returns the
+// number of watches that it removed.
+//
+// Unlike AddWatch, RemoveWatch may be called while Run is running.
+func (w *WatchingStore) RemoveWatch(resourceType k8s.Resource, namespace string) int {
+	key := typeKeyOf(resourceType)
+	w.mu.Lock()
+	removeCh, doneCh := w.removeCh, w.doneCh
+	if removeCh == nil {
+		// Run isn't running; there is nothing to purge.
+		defer w.mu.Unlock()
+		n := 0
+		watches := make([]*watch, 0, len(w.watches))
+		for _, wa := range w.watches {
+			if wa.matches(key, namespace) {
+				n++
+				continue
+			}
+			watches = append(watches, wa)
+		}
+		w.watches = watches
+		return n
+	}
+	w.mu.Unlock()
+
+	reply := make(chan int, 1)
+	select {
+	case removeCh <- removal{key: key, namespace: namespace, reply: reply}:
+		return <-reply
+	case <-doneCh:
+		return 0
+	}
+}
+
+// remove carries out the removal, in the Run goroutine: it stops the
+// matching watches and forgets about them, returning them.
+func (w *WatchingStore) remove(r removal, cancels map[*watch]context.CancelFunc, removed map[*watch]bool) []*watch {
+	var ret []*watch
+	watches := make([]*watch, 0, len(w.watches))
+	for _, wa := range w.watches {
+		if wa.matches(r.key, r.namespace) {
+			ret = append(ret, wa)
+			if cancel, ok := cancels[wa]; ok {
+				cancel()
+			}
+			removed[wa] = true
+			continue
+		}
+		watches = append(watches, wa)
+	}
+	w.mu.Lock()
+	w.watches = watches
+	w.mu.Unlock()
+	r.reply <- len(ret)
+	return ret
+}
+
+// purge removes the resources that the removed watch was keeping fresh,
+// and that no remaining watch is, returning whether there were any.
+func (w *WatchingStore) purge(removed *watch) bool {
+	uids := make([]string, 0, len(w.owned[removed]))
+	for uid := range w.owned[removed] {
+		uids = append(uids, uid)
+	}
+	ret := w.disown(removed, uids)
+	delete(w.owned, removed)
+	return ret
+}
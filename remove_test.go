@@ -0,0 +1,91 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// TestRemoveWatch checks that removing a watch while Run is running
+// purges what only it was keeping fresh, and notifies the Callback.
+func TestRemoveWatch(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	server.set(newConfigMap("other", "b"))
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("default")}})
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch("other", &corev1.ConfigMapList{})
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{})
+	runStore(t, w)
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("got ConfigMaps %v", got)
+	}
+
+	if n := w.RemoveWatch(&corev1.ConfigMap{}, "default"); n != 1 {
+		t.Fatalf("removed %d watches", n)
+	}
+	s := <-stores
+	if got := names(s.List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("got ConfigMaps %v after removing a watch", got)
+	}
+	if n := s.Count(&corev1.Namespace{}); n != 1 {
+		t.Errorf("got %d Namespaces", n)
+	}
+
+	// What the removed watch would have seen is ignored.
+	server.set(newConfigMap("default", "c"))
+	server.set(newConfigMap("other", "d"))
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"b", "d"}) {
+		t.Errorf("got ConfigMaps %v", got)
+	}
+}
+
+// TestRemoveCoveredWatch checks that removing a watch doesn't purge what
+// another watch is keeping fresh too.
+func TestRemoveCoveredWatch(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{})
+	runStore(t, w)
+	<-stores
+
+	if n := w.RemoveWatch(&corev1.ConfigMap{}, "default"); n != 1 {
+		t.Fatalf("removed %d watches", n)
+	}
+	server.set(newConfigMap("default", "b"))
+	if got := names((<-stores).List(&corev1.ConfigMap{})); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got ConfigMaps %v", got)
+	}
+}
+
+func TestRemoveWatchBeforeRun(t *testing.T) {
+	w := &k8sutil.WatchingStore{}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch("other", &corev1.ConfigMapList{})
+	if n := w.RemoveWatch(&corev1.ConfigMap{}, "default"); n != 1 {
+		t.Errorf("removed %d watches", n)
+	}
+	if n := w.RemoveWatch(&corev1.ConfigMap{}, "default"); n != 0 {
+		t.Errorf("removed %d watches twice", n)
+	}
+}
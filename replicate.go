@@ -0,0 +1,123 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+// ReplicatedFromAnnotation is the annotation that a Replicator puts on
+// the copies that it makes, with the "namespace/name" of the source as
+// the value.
+const ReplicatedFromAnnotation = "k8sutil.datawire.io/replicated-from"
+
+// A Replicator mirrors a Secret or a ConfigMap in to every namespace
+// whose labels match a selector, such as the CA bundle of a webhook, or
+// a pull secret: it keeps the copies up to date with the source, makes
+// copies in new namespaces that match, and deletes the copies in those
+// that no longer match, and all of them if the source is deleted.  The
+// copies have the source's data, type, and labels, and replace any
+// resource of the same name that is in their way.
+//
+// The Replicator applies the copies with the ApplySet, which should be
+// given over to it, and whose Store must watch Namespaces and the type
+// of the source, in all namespaces.  Add the Sample to the ApplySet's
+// PruneTypes, so that the copies are deleted even if the source is gone
+// by the time of a restart.  Run the ApplySet (and its WatchingStore)
+// alongside the Replicator.
+type Replicator struct {
+	ApplySet *ApplySet    // must not be nil
+	Source   ObjectKey    // the Secret or ConfigMap to copy
+	Sample   k8s.Resource // &corev1.Secret{} or &corev1.ConfigMap{}
+
+	// NamespaceSelector is the label selector of the namespaces to
+	// copy the source in to; if empty, it is all of them.  The
+	// source's own namespace is always skipped.
+	NamespaceSelector string
+}
+
+// Run keeps the copies in sync until the Context is done, and then
+// returns nil.
+func (r *Replicator) Run(ctx context.Context) error {
+	switch r.Sample.(type) {
+	case *corev1.Secret, *corev1.ConfigMap:
+	default:
+		return errors.Errorf("Replicator: cannot replicate a %T", r.Sample)
+	}
+	matches, err := parseLabelSelector(r.NamespaceSelector)
+	if err != nil {
+		return errors.Wrap(err, "Replicator")
+	}
+	store := r.ApplySet.Store
+	sub := store.subscribe(1, EventsCoalesce)
+	defer store.unsubscribe(sub)
+	if s, err := store.Snapshot(); err == nil {
+		r.sync(s, matches)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-sub.out:
+			if !ok {
+				<-ctx.Done()
+				return nil
+			}
+			r.sync(d.Store, matches)
+		}
+	}
+}
+
+// sync sets the desired resources of the ApplySet to the copies that
+// the state in the store calls for.
+func (r *Replicator) sync(s Store, matches func(map[string]string) bool) {
+	var source k8s.Resource
+	for _, resource := range s.List(r.Sample) {
+		if objectKeyOf(resource) == r.Source {
+			source = resource
+		}
+	}
+	var copies []k8s.Resource
+	if source != nil && source.GetMetadata().GetDeletionTimestamp() == nil {
+		for _, ns := range s.List(&corev1.Namespace{}) {
+			md := ns.GetMetadata()
+			if md.GetName() == r.Source.Namespace || !matches(md.GetLabels()) {
+				continue
+			}
+			if ns.(*corev1.Namespace).GetStatus().GetPhase() == "Terminating" {
+				continue
+			}
+			copies = append(copies, replicaOf(source, md.GetName()))
+		}
+	}
+	if err := r.ApplySet.SetDesired(copies...); err != nil {
+		r.ApplySet.Logger.Errorf("replicate %s: %v", r.Source, err)
+	}
+}
+
+// replicaOf returns the copy of the source in the namespace.
+func replicaOf(source k8s.Resource, namespace string) k8s.Resource {
+	md := source.GetMetadata()
+	labels := make(map[string]string, len(md.GetLabels()))
+	for k, v := range md.GetLabels() {
+		labels[k] = v
+	}
+	metadata := &metav1.ObjectMeta{
+		Name:        k8s.String(md.GetName()),
+		Namespace:   k8s.String(namespace),
+		Labels:      labels,
+		Annotations: map[string]string{ReplicatedFromAnnotation: objectKeyOf(source).String()},
+	}
+	switch source := source.(type) {
+	case *corev1.Secret:
+		return &corev1.Secret{Metadata: metadata, Data: source.Data, Type: source.Type}
+	case *corev1.ConfigMap:
+		return &corev1.ConfigMap{Metadata: metadata, Data: source.Data, BinaryData: source.BinaryData}
+	}
+	panic("replicaOf: not a Secret or a ConfigMap")
+}
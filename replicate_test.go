@@ -0,0 +1,121 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func namespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String(name), Labels: labels}}
+}
+
+// waitForServer waits until the condition on the fakeAPIServer holds.
+func waitForServer(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestReplicator(t *testing.T) {
+	server := newFakeAPIServer(t)
+	source := newConfigMap("src", "ca", "ca.crt", "PEM")
+	source.Metadata.Labels = map[string]string{"app": "web"}
+	server.set(source)
+	server.set(namespace("src", map[string]string{"team": "x"}))
+	server.set(namespace("a", map[string]string{"team": "x"}))
+	server.set(namespace("b", map[string]string{"team": "y"}))
+
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) {},
+	}
+	w.AddWatch("", &corev1.ConfigMapList{})
+	w.AddWatch("", &corev1.NamespaceList{})
+	a := &k8sutil.ApplySet{
+		Client:     server.client(),
+		Store:      w,
+		Logger:     testLogger{t},
+		Name:       "replicas",
+		PruneTypes: []k8s.Resource{&corev1.ConfigMap{}},
+	}
+	r := &k8sutil.Replicator{
+		ApplySet:          a,
+		Source:            k8sutil.ObjectKey{Namespace: "src", Name: "ca"},
+		Sample:            &corev1.ConfigMap{},
+		NamespaceSelector: "team=x",
+	}
+	runStore(t, w)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	for _, run := range []func(context.Context) error{a.Run, r.Run} {
+		go func(run func(context.Context) error) {
+			_ = run(ctx)
+			done <- struct{}{}
+		}(run)
+	}
+	defer func() {
+		cancel()
+		<-done
+		<-done
+	}()
+
+	copyIn := func(ns string) map[string]interface{} {
+		return server.object(newConfigMap(ns, "ca"))
+	}
+	waitForServer(t, "the copy in a", func() bool { return copyIn("a") != nil })
+	cm := configMapOf(t, copyIn("a"))
+	if want := map[string]string{"ca.crt": "PEM"}; !reflect.DeepEqual(cm.Data, want) {
+		t.Errorf("copied data %v, want %v", cm.Data, want)
+	}
+	if got := cm.Metadata.Annotations[k8sutil.ReplicatedFromAnnotation]; got != "src/ca" {
+		t.Errorf("got %s annotation %q, want %q", k8sutil.ReplicatedFromAnnotation, got, "src/ca")
+	}
+	if cm.Metadata.Labels["app"] != "web" {
+		t.Errorf("didn't copy the labels: %v", cm.Metadata.Labels)
+	}
+	if copyIn("b") != nil {
+		t.Errorf("copied in to a namespace that doesn't match")
+	}
+
+	// A namespace that comes to match gets a copy, and the copies
+	// follow the source.
+	server.set(namespace("b", map[string]string{"team": "x"}))
+	waitForServer(t, "the copy in b", func() bool { return copyIn("b") != nil })
+	source.Data["ca.crt"] = "NEW"
+	server.set(source)
+	waitForServer(t, "the copies to be updated", func() bool {
+		for _, ns := range []string{"a", "b"} {
+			if configMapOf(t, copyIn(ns)).Data["ca.crt"] != "NEW" {
+				return false
+			}
+		}
+		return true
+	})
+
+	// Once the source is gone, so are the copies.
+	server.remove(source)
+	waitForServer(t, "the copies to be deleted", func() bool {
+		return copyIn("a") == nil && copyIn("b") == nil
+	})
+}
+
+func TestReplicatorSample(t *testing.T) {
+	r := &k8sutil.Replicator{Sample: &corev1.Pod{}}
+	if err := r.Run(context.Background()); err == nil {
+		t.Fatal("replicating a Pod succeeded")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+// The k8s.Client only knows how to make requests for a fixed set of
+// verbs against registered types, and most of its methods ignore the
+// Context.  The helpers in this file make arbitrary requests using the
+// k8s.Client's endpoint, credentials, and transport.
+
+// request is an arbitrary request against the apiserver.
+type request struct {
+	verb        string
+	path        string // e.g. "/api/v1/namespaces/default/pods"
+	query       url.Values
+	contentType string
+	accept      string
+	body        []byte
+	dryRun      bool // whether to only pretend to make a change
+}
+
+// do sends the request, honoring ctx.  A non-2xx response is returned
+// as a *k8s.APIError.  On success, the caller must close the response
+// body.
+func do(ctx context.Context, client *k8s.Client, r request) (*http.Response, error) {
+	req, err := newRequest(ctx, client, r)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClientOf(client).Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "performing request")
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+	return resp, nil
+}
+
+// newRequest returns the *http.Request of the request, with the
+// client's headers.
+func newRequest(ctx context.Context, client *k8s.Client, r request) (*http.Request, error) {
+	u := strings.TrimSuffix(client.Endpoint, "/") + r.path
+	query := r.query
+	if r.dryRun {
+		query = url.Values{}
+		for k, v := range r.query {
+			query[k] = v
+		}
+		query.Set("dryRun", "All")
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequest(r.verb, u, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	if client.SetHeaders != nil {
+		if err := client.SetHeaders(req.Header); err != nil {
+			return nil, errors.Wrap(err, "set headers")
+		}
+	}
+	if r.contentType != "" {
+		req.Header.Set("Content-Type", r.contentType)
+	}
+	accept := r.accept
+	if accept == "" {
+		accept = "application/json"
+	}
+	req.Header.Set("Accept", accept)
+	return req, nil
+}
+
+// httpClientOf returns the client's *http.Client.
+func httpClientOf(client *k8s.Client) *http.Client {
+	if client.Client == nil {
+		return http.DefaultClient
+	}
+	return client.Client
+}
+
+// newAPIError reads a non-2xx response in to a *k8s.APIError.
+func newAPIError(resp *http.Response) error {
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read error status %d", resp.StatusCode)
+	}
+	// The k8s.Client will have asked for protobuf for protobuf
+	// types, but error responses from this file's requests are
+	// always JSON.
+	status := new(metav1.Status)
+	if err := json.Unmarshal(data, status); err != nil || status.Status == nil {
+		status = &metav1.Status{
+			Status:  k8s.String("Failure"),
+			Message: k8s.String(strings.TrimSpace(string(data))),
+		}
+		if *status.Message == "" {
+			*status.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	return &k8s.APIError{Status: status, Code: resp.StatusCode}
+}
+
+// doJSON sends the request (with the body, if any, marshaled from in
+// as JSON) and unmarshals the JSON response in to out, if out is
+// non-nil.
+func doJSON(ctx context.Context, client *k8s.Client, r request, in, out interface{}) error {
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return errors.Wrap(err, "encode request")
+		}
+		r.body = data
+		if r.contentType == "" {
+			r.contentType = "application/json"
+		}
+	}
+	resp, err := do(ctx, client, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return errors.Wrap(err, "decode response")
+	}
+	return nil
+}
+
+// getJSON GETs the path and unmarshals the JSON response in to out.
+func getJSON(ctx context.Context, client *k8s.Client, path string, out interface{}) error {
+	return doJSON(ctx, client, request{verb: http.MethodGet, path: path}, nil, out)
+}
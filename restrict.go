@@ -0,0 +1,160 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"strings"
+
+	"github.com/ericchiang/k8s"
+)
+
+// An AccessRule allows a RestrictedStore's user to read the resources of
+// a type in a namespace.
+type AccessRule struct {
+	// Type is a sample of the type.
+	Type k8s.Resource
+
+	// Namespace is the namespace, or k8s.AllNamespaces for every
+	// namespace (and for cluster-scoped types).
+	Namespace string
+
+	// Verbs are what may be done: "list", to read the resources,
+	// and "keys", to only learn of their namespaces and names (with
+	// Keys and Count), say to show the names of Secrets without
+	// their contents.  "list" implies "keys".
+	Verbs []string
+}
+
+// allows returns whether the rule allows the verb on the type in the
+// namespace.
+func (r AccessRule) allows(verb string, key typeKey, namespace string) bool {
+	if typeKeyOf(r.Type) != key || (r.Namespace != k8s.AllNamespaces && r.Namespace != namespace) {
+		return false
+	}
+	for _, v := range r.Verbs {
+		if v == verb || (v == "list" && verb == "keys") {
+			return true
+		}
+	}
+	return false
+}
+
+// A RestrictedStore is a handle on a Store through which only the
+// resources that its AccessRules allow can be read, for exposing the
+// store to plugins or tenant code without exposing everything in it,
+// such as Secrets.  Reads that the rules don't allow fail with a
+// *PermissionError.  Give each consumer its own RestrictedStore.
+//
+// Unlike a Store, a RestrictedStore is read by namespace, as with RBAC:
+// reading every namespace (k8s.AllNamespaces) needs a rule for every
+// namespace.
+type RestrictedStore struct {
+	store Store
+	rules []AccessRule
+}
+
+// Restrict returns a handle on the store that allows only what the
+// rules do.
+func Restrict(store Store, rules ...AccessRule) *RestrictedStore {
+	return &RestrictedStore{store: store, rules: append([]AccessRule(nil), rules...)}
+}
+
+// WithStore returns a handle on another store, such as a later snapshot
+// of the same WatchingStore, with the same rules.
+func (r *RestrictedStore) WithStore(store Store) *RestrictedStore {
+	return &RestrictedStore{store: store, rules: r.rules}
+}
+
+// Check returns nil if the verb ("list" or "keys") is allowed on the
+// type in the namespace, and a *PermissionError if it isn't.
+func (r *RestrictedStore) Check(verb string, resourceType k8s.Resource, namespace string) error {
+	key := typeKeyOf(resourceType)
+	for _, rule := range r.rules {
+		if rule.allows(verb, key, namespace) {
+			return nil
+		}
+	}
+	return &PermissionError{Verb: verb, GVR: accessGVR(resourceType), Namespace: namespace}
+}
+
+// accessGVR returns the GroupVersionResource of the type, for
+// PermissionErrors, falling back to the lower-case kind (which kubectl
+// accepts too) if the resource name isn't known.
+func accessGVR(resourceType k8s.Resource) GroupVersionResource {
+	resource, err := apiResourceForResource(resourceType)
+	if err != nil {
+		return GroupVersionResource{Resource: resourceTypeName(resourceType)}
+	}
+	if resource.Name == "" {
+		resource.Name = strings.ToLower(resource.Kind)
+	}
+	return resource.GroupVersionResource()
+}
+
+// inNamespace returns the resources that are in the namespace.
+func inNamespace(resources []k8s.Resource, namespace string) []k8s.Resource {
+	if namespace == k8s.AllNamespaces {
+		return resources
+	}
+	ret := make([]k8s.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if resource.GetMetadata().GetNamespace() == namespace {
+			ret = append(ret, resource)
+		}
+	}
+	return ret
+}
+
+// List returns the resources of the type in the namespace, as
+// Store.List does.
+func (r *RestrictedStore) List(resourceType k8s.Resource, namespace string) ([]k8s.Resource, error) {
+	if err := r.Check("list", resourceType, namespace); err != nil {
+		return nil, err
+	}
+	return inNamespace(r.store.List(resourceType), namespace), nil
+}
+
+// ListSorted returns the resources of the type in the namespace, as
+// Store.ListSorted does.
+func (r *RestrictedStore) ListSorted(resourceType k8s.Resource, namespace string) ([]k8s.Resource, error) {
+	if err := r.Check("list", resourceType, namespace); err != nil {
+		return nil, err
+	}
+	return inNamespace(r.store.ListSorted(resourceType), namespace), nil
+}
+
+// Keys returns the keys of the resources of the type in the namespace,
+// as Store.Keys does.
+func (r *RestrictedStore) Keys(resourceType k8s.Resource, namespace string) ([]ObjectKey, error) {
+	if err := r.Check("keys", resourceType, namespace); err != nil {
+		return nil, err
+	}
+	keys := r.store.Keys(resourceType)
+	if namespace == k8s.AllNamespaces {
+		return keys, nil
+	}
+	ret := make([]ObjectKey, 0, len(keys))
+	for _, key := range keys {
+		if key.Namespace == namespace {
+			ret = append(ret, key)
+		}
+	}
+	return ret, nil
+}
+
+// Count returns the number of resources of the type in the namespace.
+func (r *RestrictedStore) Count(resourceType k8s.Resource, namespace string) (int, error) {
+	if namespace == k8s.AllNamespaces {
+		if err := r.Check("keys", resourceType, namespace); err != nil {
+			return 0, err
+		}
+		return r.store.Count(resourceType), nil
+	}
+	keys, err := r.Keys(resourceType, namespace)
+	return len(keys), err
+}
+
+// Sequence returns the Sequence of the store.
+func (r *RestrictedStore) Sequence() uint64 {
+	return r.store.Sequence()
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestRestrictedStore(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	server.set(newConfigMap("other", "b"))
+	server.set(namespace("default", nil))
+	server.set(namespace("other", nil))
+	store := syncedSnapshot(t, server, &corev1.ConfigMapList{}, &corev1.NamespaceList{})
+	r := k8sutil.Restrict(store,
+		k8sutil.AccessRule{Type: &corev1.ConfigMap{}, Namespace: "default", Verbs: []string{"list"}},
+		k8sutil.AccessRule{Type: &corev1.Namespace{}, Namespace: k8s.AllNamespaces, Verbs: []string{"keys"}})
+
+	configMaps, err := r.List(&corev1.ConfigMap{}, "default")
+	if err != nil || !reflect.DeepEqual(names(configMaps), []string{"a"}) {
+		t.Errorf("List: got %v, %v", names(configMaps), err)
+	}
+	if n, err := r.Count(&corev1.ConfigMap{}, "default"); err != nil || n != 1 {
+		t.Errorf("Count: got %d, %v", n, err)
+	}
+	keys, err := r.Keys(&corev1.Namespace{}, k8s.AllNamespaces)
+	if want := []k8sutil.ObjectKey{{Name: "default"}, {Name: "other"}}; err != nil || !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys: got %v, %v, want %v", keys, err, want)
+	}
+	if n, err := r.Count(&corev1.Namespace{}, k8s.AllNamespaces); err != nil || n != 2 {
+		t.Errorf("Count: got %d, %v", n, err)
+	}
+
+	for _, tc := range []struct {
+		read func() error
+		want k8sutil.PermissionError
+	}{
+		{
+			func() error { _, err := r.List(&corev1.ConfigMap{}, "other"); return err },
+			k8sutil.PermissionError{Verb: "list", GVR: k8sutil.GroupVersionResource{Version: "v1", Resource: "configmaps"}, Namespace: "other"},
+		},
+		{
+			// Every namespace needs a rule for every namespace.
+			func() error { _, err := r.ListSorted(&corev1.ConfigMap{}, k8s.AllNamespaces); return err },
+			k8sutil.PermissionError{Verb: "list", GVR: k8sutil.GroupVersionResource{Version: "v1", Resource: "configmaps"}},
+		},
+		{
+			// "keys" doesn't imply "list".
+			func() error { _, err := r.List(&corev1.Namespace{}, k8s.AllNamespaces); return err },
+			k8sutil.PermissionError{Verb: "list", GVR: k8sutil.GroupVersionResource{Version: "v1", Resource: "namespaces"}},
+		},
+		{
+			func() error { _, err := r.Count(&corev1.Secret{}, "default"); return err },
+			k8sutil.PermissionError{Verb: "keys", GVR: k8sutil.GroupVersionResource{Version: "v1", Resource: "secrets"}, Namespace: "default"},
+		},
+	} {
+		err := tc.read()
+		if perm, ok := err.(*k8sutil.PermissionError); !ok || *perm != tc.want {
+			t.Errorf("got %v, want %v", err, &tc.want)
+		}
+	}
+
+	// A later store has the same rules.
+	server.set(newConfigMap("default", "c"))
+	later := r.WithStore(syncedSnapshot(t, server, &corev1.ConfigMapList{}))
+	if configMaps, err := later.List(&corev1.ConfigMap{}, "default"); err != nil || !reflect.DeepEqual(names(configMaps), []string{"a", "c"}) {
+		t.Errorf("WithStore: got %v, %v", names(configMaps), err)
+	}
+	if err := later.Check("list", &corev1.ConfigMap{}, "other"); err == nil {
+		t.Error("WithStore: allowed what the rules don't")
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	"github.com/pkg/errors"
+)
+
+// RestartedAtAnnotation is the annotation of a pod template that
+// RolloutRestart sets, as "kubectl rollout restart" does.
+const RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// RolloutRestart restarts the pods of a Deployment, StatefulSet, or
+// DaemonSet, as "kubectl rollout restart" does, by setting the
+// RestartedAtAnnotation of its pod template to the current time, which
+// rolls it out as any other change to the template would.  Follow it
+// with the waiter of the workload, such as WaitForRollout.
+func RolloutRestart(ctx context.Context, client *k8s.Client, ref ObjectRef, options ...MutateOption) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						RestartedAtAnnotation: time.Now().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	}
+	err := mutateOptionsOf(options).do(ctx, client, request{verb: http.MethodPatch, path: ref.path(), contentType: MergePatchType}, patch, nil)
+	return errors.Wrapf(err, "restart %s", ref)
+}
+
+// SetImage sets the image of the named container (or init container)
+// of the pod template of a Deployment, StatefulSet, DaemonSet, or other
+// workload with a spec.template, as "kubectl set image" does.  Follow
+// it with the waiter of the workload, such as WaitForRollout.
+//
+// The merge patches of custom resources replace lists whole, so
+// SetImage reads the workload, and patches the container by its index,
+// with a JSON patch that fails if the container has moved since.
+func SetImage(ctx context.Context, client *k8s.Client, ref ObjectRef, container, image string, options ...MutateOption) error {
+	var workload map[string]interface{}
+	if err := getJSON(ctx, client, ref.path(), &workload); err != nil {
+		return errors.Wrapf(err, "get %s", ref)
+	}
+	spec, _ := jsonPath(workload, "spec", "template", "spec").(map[string]interface{})
+	for _, field := range []string{"containers", "initContainers"} {
+		containers, _ := spec[field].([]interface{})
+		for i, c := range containers {
+			if c, _ := c.(map[string]interface{}); c["name"] != container {
+				continue
+			}
+			path := "/spec/template/spec/" + field + "/" + strconv.Itoa(i)
+			patch := []jsonPatchOp{
+				{Op: "test", Path: path + "/name", Value: container},
+				{Op: "add", Path: path + "/image", Value: image},
+			}
+			err := mutateOptionsOf(options).do(ctx, client, request{verb: http.MethodPatch, path: ref.path(), contentType: JSONPatchType}, patch, nil)
+			return errors.Wrapf(err, "set image of %s", ref)
+		}
+	}
+	return errors.Errorf("%s has no container %q", ref, container)
+}
+
+// jsonPath returns the value at the path of fields in a JSON object, or
+// nil if there isn't one.
+func jsonPath(object map[string]interface{}, fields ...string) interface{} {
+	var value interface{} = object
+	for _, field := range fields {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[field]
+	}
+	return value
+}
+
+// WaitForRollout waits for the rollout of a Deployment to complete, as
+// "kubectl rollout status" does: for the controller to have observed its
+// latest spec, and for all of its replicas to be updated and available,
+// with none of the old ones left.  It is driven by the store, which must
+// be watching Deployments (as *appsv1.Deployment) in the namespace.  It
+// returns an error if the rollout exceeds its progress deadline, and
+// the Context's error if it is done first; it keeps waiting while the
+// Deployment doesn't exist.
+//
+// The store lags the apiserver, so straight after a change, such as
+// SetImage, the store may still hold the Deployment as it was, with
+// its previous rollout complete; wait for the store to have seen the
+// change (for its generation to have increased) first.
+func WaitForRollout(ctx context.Context, store *WatchingStore, namespace, name string) error {
+	return waitFor(ctx, store, &appsv1.Deployment{}, ObjectKey{Namespace: namespace, Name: name}, func(resource k8s.Resource) (bool, error) {
+		d := resource.(*appsv1.Deployment)
+		status := d.GetStatus()
+		if d.GetMetadata().GetGeneration() > status.GetObservedGeneration() {
+			return false, nil
+		}
+		for _, c := range status.GetConditions() {
+			if c.GetType() == "Progressing" && c.GetReason() == "ProgressDeadlineExceeded" {
+				return false, errors.Errorf("deployment %s/%s exceeded its progress deadline", namespace, name)
+			}
+		}
+		replicas := int32(1)
+		if d.GetSpec().Replicas != nil {
+			replicas = d.GetSpec().GetReplicas()
+		}
+		return status.GetUpdatedReplicas() >= replicas &&
+			status.GetReplicas() <= status.GetUpdatedReplicas() &&
+			status.GetAvailableReplicas() >= status.GetUpdatedReplicas(), nil
+	})
+}
+
+// WaitForStatefulSet is like WaitForRollout, but for a StatefulSet (as
+// an *appsv1.StatefulSet): it waits for all of its replicas to be ready
+// and, with the RollingUpdate strategy, for the update revision to have
+// been rolled out to all of them (or to all of those at or beyond the
+// partition, if there is one).
+func WaitForStatefulSet(ctx context.Context, store *WatchingStore, namespace, name string) error {
+	return waitFor(ctx, store, &appsv1.StatefulSet{}, ObjectKey{Namespace: namespace, Name: name}, func(resource k8s.Resource) (bool, error) {
+		ss := resource.(*appsv1.StatefulSet)
+		status := ss.GetStatus()
+		if ss.GetMetadata().GetGeneration() > status.GetObservedGeneration() {
+			return false, nil
+		}
+		replicas := int32(1)
+		if ss.GetSpec().Replicas != nil {
+			replicas = ss.GetSpec().GetReplicas()
+		}
+		if status.GetReadyReplicas() < replicas {
+			return false, nil
+		}
+		strategy := ss.GetSpec().GetUpdateStrategy()
+		if strategy.GetType() == "OnDelete" {
+			// The pods are only updated as they are deleted.
+			return true, nil
+		}
+		if partition := strategy.GetRollingUpdate().GetPartition(); partition > 0 {
+			return status.GetUpdatedReplicas() >= replicas-partition, nil
+		}
+		return status.GetUpdateRevision() == status.GetCurrentRevision(), nil
+	})
+}
+
+// WaitForDaemonSet is like WaitForRollout, but for a DaemonSet (as an
+// *appsv1.DaemonSet): it waits for its pod to be updated and available
+// on every node that should run it.
+func WaitForDaemonSet(ctx context.Context, store *WatchingStore, namespace, name string) error {
+	return waitFor(ctx, store, &appsv1.DaemonSet{}, ObjectKey{Namespace: namespace, Name: name}, func(resource k8s.Resource) (bool, error) {
+		ds := resource.(*appsv1.DaemonSet)
+		status := ds.GetStatus()
+		if ds.GetMetadata().GetGeneration() > status.GetObservedGeneration() {
+			return false, nil
+		}
+		desired := status.GetDesiredNumberScheduled()
+		if ds.GetSpec().GetUpdateStrategy().GetType() != "OnDelete" && status.GetUpdatedNumberScheduled() < desired {
+			return false, nil
+		}
+		return status.GetNumberAvailable() >= desired, nil
+	})
+}
+
+// waitFor waits until check says that the resource of the sample's type
+// with the key is done, checking it in each Store that the WatchingStore
+// notifies of as well as the current one.
+func waitFor(ctx context.Context, store *WatchingStore, sample k8s.Resource, key ObjectKey, check func(k8s.Resource) (bool, error)) error {
+	sub := store.subscribe(1, EventsCoalesce)
+	defer store.unsubscribe(sub)
+	done := func(s Store) (bool, error) {
+		for _, resource := range s.List(sample) {
+			if objectKeyOf(resource) == key {
+				return check(resource)
+			}
+		}
+		return false, nil
+	}
+	if s, err := store.Snapshot(); err == nil {
+		if ok, err := done(s); ok || err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-sub.out:
+			if !ok {
+				return errors.New("the WatchingStore stopped running")
+			}
+			if ok, err := done(d.Store); ok || err != nil {
+				return err
+			}
+		}
+	}
+}
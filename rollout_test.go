@@ -0,0 +1,307 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+var webDeployment = k8sutil.ObjectRef{
+	GroupVersionResource: k8sutil.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+	Namespace:            "default",
+	Name:                 "web",
+}
+
+// newFakeWorkload returns a client of a server that serves the
+// Deployment default/web, with an init container and a container, and
+// records the patches of it.
+func newFakeWorkload(t *testing.T, patches *[]string) *k8s.Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/apps/v1/namespaces/default/deployments/web" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPatch {
+			data, _ := ioutil.ReadAll(r.Body)
+			*patches = append(*patches, r.Header.Get("Content-Type")+" "+string(data))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"spec": map[string]interface{}{"template": map[string]interface{}{"spec": map[string]interface{}{
+				"initContainers": []interface{}{map[string]interface{}{"name": "init", "image": "init:1"}},
+				"containers": []interface{}{
+					map[string]interface{}{"name": "sidecar", "image": "sidecar:1"},
+					map[string]interface{}{"name": "app", "image": "app:1"},
+				},
+			}}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+}
+
+func TestRolloutRestart(t *testing.T) {
+	var patches []string
+	client := newFakeWorkload(t, &patches)
+	if err := k8sutil.RolloutRestart(context.Background(), client, webDeployment); err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 1 || !strings.HasPrefix(patches[0], k8sutil.MergePatchType+" ") {
+		t.Fatalf("got patches %q", patches)
+	}
+	var patch struct {
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(patches[0], k8sutil.MergePatchType+" ")), &patch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, patch.Spec.Template.Metadata.Annotations[k8sutil.RestartedAtAnnotation]); err != nil {
+		t.Errorf("got annotations %v: %v", patch.Spec.Template.Metadata.Annotations, err)
+	}
+}
+
+func TestSetImage(t *testing.T) {
+	var patches []string
+	client := newFakeWorkload(t, &patches)
+	for _, container := range []string{"app", "init"} {
+		if err := k8sutil.SetImage(context.Background(), client, webDeployment, container, container+":2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		k8sutil.JSONPatchType + ` [{"op":"test","path":"/spec/template/spec/containers/1/name","value":"app"},{"op":"add","path":"/spec/template/spec/containers/1/image","value":"app:2"}]`,
+		k8sutil.JSONPatchType + ` [{"op":"test","path":"/spec/template/spec/initContainers/0/name","value":"init"},{"op":"add","path":"/spec/template/spec/initContainers/0/image","value":"init:2"}]`,
+	}
+	if strings.Join(patches, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got patches\n%s\nwant\n%s", strings.Join(patches, "\n"), strings.Join(want, "\n"))
+	}
+	if err := k8sutil.SetImage(context.Background(), client, webDeployment, "missing", "x"); err == nil {
+		t.Error("set the image of a missing container")
+	}
+}
+
+func generation(n int64) *int64 { return &n }
+
+// rolloutDeployment returns the Deployment default/web at the
+// generation, with the status.
+func rolloutDeployment(resourceVersion string, gen int64, status *appsv1.DeploymentStatus) *appsv1.Deployment {
+	md := k8sutiltest.ObjectMeta("default", "web", resourceVersion)
+	md.Generation = &gen
+	return &appsv1.Deployment{
+		Metadata: md,
+		Spec:     &appsv1.DeploymentSpec{Replicas: k8s.Int32(2)},
+		Status:   status,
+	}
+}
+
+func TestWaitForRollout(t *testing.T) {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	synced := make(chan struct{}, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { synced <- struct{}{} },
+	}
+	w.AddWatch("default", &appsv1.DeploymentList{})
+	stream := backend.Stream("default", &appsv1.DeploymentList{})
+	// The controller hasn't seen generation 2 yet, so the complete
+	// status is of generation 1.
+	stream.List(&appsv1.DeploymentList{
+		Metadata: k8sutiltest.ListMeta("1"),
+		Items: []*appsv1.Deployment{rolloutDeployment("1", 2, &appsv1.DeploymentStatus{
+			ObservedGeneration: generation(1),
+			Replicas:           k8s.Int32(2),
+			UpdatedReplicas:    k8s.Int32(2),
+			AvailableReplicas:  k8s.Int32(2),
+		})},
+	})
+	runStore(t, w)
+	<-synced
+
+	done := make(chan error, 1)
+	go func() { done <- k8sutil.WaitForRollout(context.Background(), w, "default", "web") }()
+	stream.WaitForWatch(1)
+	for i, status := range []*appsv1.DeploymentStatus{
+		// Surging: an old replica is left.
+		{ObservedGeneration: generation(2), Replicas: k8s.Int32(3), UpdatedReplicas: k8s.Int32(2), AvailableReplicas: k8s.Int32(3)},
+		// An updated replica isn't available yet.
+		{ObservedGeneration: generation(2), Replicas: k8s.Int32(2), UpdatedReplicas: k8s.Int32(2), AvailableReplicas: k8s.Int32(1)},
+	} {
+		stream.Send(k8s.EventModified, rolloutDeployment(string(rune('2'+i)), 2, status))
+		select {
+		case err := <-done:
+			t.Fatalf("status %d: done: %v", i, err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	stream.Send(k8s.EventModified, rolloutDeployment("4", 2, &appsv1.DeploymentStatus{
+		ObservedGeneration: generation(2), Replicas: k8s.Int32(2), UpdatedReplicas: k8s.Int32(2), AvailableReplicas: k8s.Int32(2),
+	}))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	stream.Send(k8s.EventModified, rolloutDeployment("5", 3, &appsv1.DeploymentStatus{
+		ObservedGeneration: generation(3),
+		Conditions: []*appsv1.DeploymentCondition{{
+			Type:   k8s.String("Progressing"),
+			Status: k8s.String("False"),
+			Reason: k8s.String("ProgressDeadlineExceeded"),
+		}},
+	}))
+	// Wait for the store to have seen the change, as the doc says.
+	for deadline := time.Now().Add(timeout); ; time.Sleep(time.Millisecond) {
+		store, err := w.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list := store.List(&appsv1.Deployment{}); len(list) == 1 && list[0].GetMetadata().GetResourceVersion() == "5" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the store to see the change")
+		}
+	}
+	if err := k8sutil.WaitForRollout(context.Background(), w, "default", "web"); err == nil || !strings.Contains(err.Error(), "progress deadline") {
+		t.Errorf("got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := k8sutil.WaitForRollout(ctx, w, "default", "missing"); err != context.DeadlineExceeded {
+		t.Errorf("got %v, waiting for a missing deployment", err)
+	}
+}
+
+// waitOnce lists the list in a store, and returns what wait returns
+// within a moment, or context.DeadlineExceeded if it is still waiting.
+func waitOnce(t *testing.T, list k8s.ResourceList, wait func(context.Context, *k8sutil.WatchingStore) error) error {
+	backend := k8sutiltest.NewScriptedBackend(t)
+	synced := make(chan struct{}, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) { synced <- struct{}{} },
+	}
+	sample := reflect.New(reflect.TypeOf(list).Elem()).Interface().(k8s.ResourceList)
+	w.AddWatch("default", sample)
+	backend.Stream("default", sample).List(list)
+	runStore(t, w)
+	<-synced
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	return wait(ctx, w)
+}
+
+func TestWaitForStatefulSet(t *testing.T) {
+	wait := func(ctx context.Context, w *k8sutil.WatchingStore) error {
+		return k8sutil.WaitForStatefulSet(ctx, w, "default", "db")
+	}
+	for _, tc := range []struct {
+		name     string
+		strategy *appsv1.StatefulSetUpdateStrategy
+		status   *appsv1.StatefulSetStatus
+		done     bool
+	}{
+		{
+			name:   "rolled out",
+			status: &appsv1.StatefulSetStatus{ReadyReplicas: k8s.Int32(3), UpdateRevision: k8s.String("b"), CurrentRevision: k8s.String("b")},
+			done:   true,
+		},
+		{
+			name:   "rolling",
+			status: &appsv1.StatefulSetStatus{ReadyReplicas: k8s.Int32(3), UpdateRevision: k8s.String("b"), CurrentRevision: k8s.String("a")},
+		},
+		{
+			name:   "not ready",
+			status: &appsv1.StatefulSetStatus{ReadyReplicas: k8s.Int32(2), UpdateRevision: k8s.String("b"), CurrentRevision: k8s.String("b")},
+		},
+		{
+			name:     "on delete",
+			strategy: &appsv1.StatefulSetUpdateStrategy{Type: k8s.String("OnDelete")},
+			status:   &appsv1.StatefulSetStatus{ReadyReplicas: k8s.Int32(3), UpdateRevision: k8s.String("b"), CurrentRevision: k8s.String("a")},
+			done:     true,
+		},
+		{
+			name: "partitioned",
+			strategy: &appsv1.StatefulSetUpdateStrategy{
+				Type:          k8s.String("RollingUpdate"),
+				RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: k8s.Int32(2)},
+			},
+			status: &appsv1.StatefulSetStatus{ReadyReplicas: k8s.Int32(3), UpdatedReplicas: k8s.Int32(1), UpdateRevision: k8s.String("b"), CurrentRevision: k8s.String("a")},
+			done:   true,
+		},
+	} {
+		tc.status.ObservedGeneration = generation(1)
+		md := k8sutiltest.ObjectMeta("default", "db", "1")
+		md.Generation = generation(1)
+		err := waitOnce(t, &appsv1.StatefulSetList{
+			Metadata: k8sutiltest.ListMeta("1"),
+			Items: []*appsv1.StatefulSet{{
+				Metadata: md,
+				Spec:     &appsv1.StatefulSetSpec{Replicas: k8s.Int32(3), UpdateStrategy: tc.strategy},
+				Status:   tc.status,
+			}},
+		}, wait)
+		if done := err == nil; done != tc.done {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+func TestWaitForDaemonSet(t *testing.T) {
+	wait := func(ctx context.Context, w *k8sutil.WatchingStore) error {
+		return k8sutil.WaitForDaemonSet(ctx, w, "default", "agent")
+	}
+	for _, tc := range []struct {
+		name               string
+		strategy           string
+		observed           int64
+		updated, available int32
+		done               bool
+	}{
+		{name: "rolled out", observed: 2, updated: 3, available: 3, done: true},
+		{name: "not observed", observed: 1, updated: 3, available: 3},
+		{name: "rolling", observed: 2, updated: 2, available: 3},
+		{name: "unavailable", observed: 2, updated: 3, available: 2},
+		{name: "on delete", strategy: "OnDelete", observed: 2, updated: 0, available: 3, done: true},
+	} {
+		md := k8sutiltest.ObjectMeta("default", "agent", "1")
+		md.Generation = generation(2)
+		err := waitOnce(t, &appsv1.DaemonSetList{
+			Metadata: k8sutiltest.ListMeta("1"),
+			Items: []*appsv1.DaemonSet{{
+				Metadata: md,
+				Spec:     &appsv1.DaemonSetSpec{UpdateStrategy: &appsv1.DaemonSetUpdateStrategy{Type: k8s.String(tc.strategy)}},
+				Status: &appsv1.DaemonSetStatus{
+					ObservedGeneration:     generation(tc.observed),
+					DesiredNumberScheduled: k8s.Int32(3),
+					UpdatedNumberScheduled: k8s.Int32(tc.updated),
+					NumberAvailable:        k8s.Int32(tc.available),
+				},
+			}},
+		}, wait)
+		if done := err == nil; done != tc.done {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
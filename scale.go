@@ -0,0 +1,81 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/ericchiang/k8s"
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	"github.com/pkg/errors"
+)
+
+// An ObjectRef identifies a resource of any type, including types
+// without a Go type, such as custom resources.
+type ObjectRef struct {
+	GroupVersionResource
+	Namespace string // "" for a cluster-scoped resource
+	Name      string
+}
+
+// ObjectRefOf returns the ObjectRef of a typed resource.
+func ObjectRefOf(resource k8s.Resource) (ObjectRef, error) {
+	gvr, err := GVROf(resource)
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	md := resource.GetMetadata()
+	return ObjectRef{GroupVersionResource: gvr, Namespace: md.GetNamespace(), Name: md.GetName()}, nil
+}
+
+// String returns the ObjectRef as "resource.version.group
+// namespace/name".
+func (ref ObjectRef) String() string {
+	return ref.GroupVersionResource.String() + " " + ObjectKey{Namespace: ref.Namespace, Name: ref.Name}.String()
+}
+
+// path returns the URL path of the resource.
+func (ref ObjectRef) path() string {
+	p := "/apis/" + ref.Group + "/" + ref.Version
+	if ref.Group == "" {
+		p = "/api/" + ref.Version
+	}
+	if ref.Namespace != "" {
+		p += "/namespaces/" + url.PathEscape(ref.Namespace)
+	}
+	return p + "/" + ref.Resource + "/" + url.PathEscape(ref.Name)
+}
+
+// GetScale returns the scale subresource of a Deployment, ReplicaSet,
+// StatefulSet, or other scalable resource, such as a custom resource
+// whose CustomResourceDefinition enables the subresource: the desired
+// and observed numbers of replicas, and the selector of its pods.
+func GetScale(ctx context.Context, client *k8s.Client, ref ObjectRef) (*autoscalingv1.Scale, error) {
+	scale := new(autoscalingv1.Scale)
+	err := doJSON(ctx, client, request{verb: http.MethodGet, path: ref.path() + "/scale"}, nil, scale)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get scale of %s", ref)
+	}
+	return scale, nil
+}
+
+// Scale sets the desired number of replicas of a scalable resource,
+// through its scale subresource, as "kubectl scale" does.  It returns
+// the updated scale (or, with DryRun, the scale that it would be).
+func Scale(ctx context.Context, client *k8s.Client, ref ObjectRef, replicas int32, options ...MutateOption) (*autoscalingv1.Scale, error) {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{"replicas": replicas},
+	}
+	scale := new(autoscalingv1.Scale)
+	err := mutateOptionsOf(options).do(ctx, client, request{
+		verb:        http.MethodPatch,
+		path:        ref.path() + "/scale",
+		contentType: MergePatchType,
+	}, patch, scale)
+	if err != nil {
+		return nil, errors.Wrapf(err, "scale %s", ref)
+	}
+	return scale, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	autoscalingv1 "github.com/ericchiang/k8s/apis/autoscaling/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestObjectRefOf(t *testing.T) {
+	ref, err := k8sutil.ObjectRefOf(&appsv1.Deployment{Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String("web")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "deployments.v1.apps default/web"; ref.String() != want {
+		t.Errorf("got %s, want %s", ref, want)
+	}
+}
+
+func TestScale(t *testing.T) {
+	replicas := int32(1)
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/apps/v1/namespaces/default/deployments/web/scale" {
+			writeJSON(w, http.StatusNotFound, &metav1.Status{Code: k8s.Int32(http.StatusNotFound)})
+			return
+		}
+		if r.Method == http.MethodPatch {
+			contentType = r.Header.Get("Content-Type")
+			var patch struct {
+				Spec struct {
+					Replicas int32 `json:"replicas"`
+				} `json:"spec"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				t.Error(err)
+			}
+			replicas = patch.Spec.Replicas
+		}
+		writeJSON(w, http.StatusOK, &autoscalingv1.Scale{
+			Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String("web")},
+			Spec:     &autoscalingv1.ScaleSpec{Replicas: k8s.Int32(replicas)},
+			Status:   &autoscalingv1.ScaleStatus{Replicas: k8s.Int32(1), Selector: k8s.String("app=web")},
+		})
+	}))
+	defer server.Close()
+	client := &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+	ref := k8sutil.ObjectRef{
+		GroupVersionResource: k8sutil.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		Namespace:            "default",
+		Name:                 "web",
+	}
+
+	scale, err := k8sutil.GetScale(context.Background(), client, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scale.GetSpec().GetReplicas() != 1 || scale.GetStatus().GetSelector() != "app=web" {
+		t.Errorf("got %v", scale)
+	}
+	if scale, err = k8sutil.Scale(context.Background(), client, ref, 3); err != nil {
+		t.Fatal(err)
+	}
+	if scale.GetSpec().GetReplicas() != 3 || contentType != k8sutil.MergePatchType {
+		t.Errorf("got %v, sent as %s", scale, contentType)
+	}
+
+	ref.Name = "missing"
+	if _, err := k8sutil.GetScale(context.Background(), client, ref); err == nil {
+		t.Error("got the scale of a missing deployment")
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// schemaFetchTimeout is how long a watch waits for the schema of a
+// resource that it is validating to be fetched.
+const schemaFetchTimeout = 30 * time.Second
+
+// A SchemaViolation is a way in which a resource doesn't match the
+// schema of its type.
+type SchemaViolation struct {
+	Field   string // e.g. "spec.ports[0].port"
+	Message string // e.g. "must be at most 65535"
+}
+
+// A SchemaError is the error of a resource that doesn't match the
+// schema of its type.
+type SchemaError struct {
+	GVK        GroupVersionKind
+	Resource   ObjectKey
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Field + ": " + v.Message
+	}
+	return fmt.Sprintf("%s %s is invalid: %s", e.GVK, e.Resource, strings.Join(msgs, "; "))
+}
+
+// A SchemaValidator validates Unstructured resources of custom types
+// against the OpenAPI v3 schemas of their CustomResourceDefinitions, so
+// that invalid resources can be caught before they are applied, or as
+// they are watched.  It checks most of what the apiserver checks of
+// the schema: types, required fields, enums, bounds, and patterns, and
+// the allOf, anyOf, oneOf, and not of them; but not formats, or the CEL
+// rules of x-kubernetes-validations.  As the apiserver prunes them, it
+// ignores unknown fields.  Resources of built-in types, and of types
+// without a schema, are valid.
+//
+// The schemas are fetched as they are needed, and cached for the TTL.
+// It is safe to use a SchemaValidator from multiple goroutines.
+type SchemaValidator struct {
+	Client    *k8s.Client // must not be nil
+	Discovery *Discovery  // must not be nil; e.g. the WatchingStore's
+
+	// TTL is how long to cache schemas for.  If zero,
+	// DefaultDiscoveryTTL is used.
+	TTL time.Duration
+
+	// Logger, if set, is told about the schemas that couldn't be
+	// fetched, while validating a watch.
+	Logger Logger
+
+	mu      sync.Mutex
+	schemas map[GroupVersionKind]cachedSchema
+}
+
+type cachedSchema struct {
+	schema  map[string]interface{} // nil if there is none
+	fetched time.Time
+}
+
+// Validate returns a *SchemaError if the resource doesn't match the
+// schema of its type, or an error if the schema couldn't be fetched.
+func (v *SchemaValidator) Validate(ctx context.Context, resource k8s.Resource) error {
+	u, ok := resource.(*Unstructured)
+	if !ok {
+		// Its Go type has done what it can.
+		return nil
+	}
+	gvk := apiResourceForAPIVersion(u.APIVersion(), u.Kind()).GroupVersionKind()
+	schema, err := v.schema(ctx, gvk)
+	if err != nil || schema == nil {
+		return err
+	}
+	var violations []SchemaViolation
+	validateSchema(schema, u.Object, "", &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &SchemaError{GVK: gvk, Resource: objectKeyOf(u), Violations: violations}
+}
+
+// schema returns the schema of the type, or nil if it has none.
+func (v *SchemaValidator) schema(ctx context.Context, gvk GroupVersionKind) (map[string]interface{}, error) {
+	ttl := v.TTL
+	if ttl == 0 {
+		ttl = DefaultDiscoveryTTL
+	}
+	clock := orSystemClock(v.Discovery.Clock)
+	v.mu.Lock()
+	cached, ok := v.schemas[gvk]
+	v.mu.Unlock()
+	if ok && clock.Now().Sub(cached.fetched) < ttl {
+		return cached.schema, nil
+	}
+
+	resource, err := v.Discovery.ResourceForKind(ctx, gvk.APIVersion(), gvk.Kind)
+	if err != nil {
+		return nil, errors.Wrapf(err, "schema of %s", gvk)
+	}
+	var crd struct {
+		Spec struct {
+			Versions []struct {
+				Name   string `json:"name"`
+				Schema struct {
+					OpenAPIV3Schema map[string]interface{} `json:"openAPIV3Schema"`
+				} `json:"schema"`
+			} `json:"versions"`
+		} `json:"spec"`
+	}
+	err = getJSON(ctx, v.Client, "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/"+resource.Name+"."+resource.Group, &crd)
+	if err != nil && apiErrorCode(err) != http.StatusNotFound {
+		return nil, errors.Wrapf(err, "schema of %s", gvk)
+	}
+	// If there is no CustomResourceDefinition, it is a built-in type,
+	// or an aggregated one.
+	var schema map[string]interface{}
+	for _, version := range crd.Spec.Versions {
+		if version.Name == gvk.Version {
+			schema = version.Schema.OpenAPIV3Schema
+		}
+	}
+	v.mu.Lock()
+	if v.schemas == nil {
+		v.schemas = make(map[GroupVersionKind]cachedSchema)
+	}
+	v.schemas[gvk] = cachedSchema{schema: schema, fetched: clock.Now()}
+	v.mu.Unlock()
+	return schema, nil
+}
+
+// ValidateSchema is a WatchOption that validates each resource that the
+// watch receives (after normalizing it, if it is), with the
+// SchemaValidator.  Invalid resources are logged and skipped, as if
+// they didn't exist; resources whose schema can't be fetched are kept.
+func ValidateSchema(v *SchemaValidator) WatchOption {
+	return func(w *watch) {
+		w.validate = func(resource k8s.Resource) error {
+			ctx, cancel := context.WithTimeout(context.Background(), schemaFetchTimeout)
+			defer cancel()
+			err := v.Validate(ctx, resource)
+			if _, invalid := err.(*SchemaError); err != nil && !invalid {
+				if v.Logger != nil {
+					v.Logger.Errorf("validate %s: %v", objectKeyOf(resource), err)
+				}
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// validateSchema appends the ways in which the value doesn't match the
+// schema to the violations.
+func validateSchema(schema map[string]interface{}, value interface{}, field string, violations *[]SchemaViolation) {
+	violate := func(format string, args ...interface{}) {
+		f := field
+		if f == "" {
+			f = "<root>"
+		}
+		*violations = append(*violations, SchemaViolation{Field: f, Message: fmt.Sprintf(format, args...)})
+	}
+	if value == nil {
+		// The apiserver drops null fields that aren't nullable.
+		return
+	}
+
+	if schema["x-kubernetes-int-or-string"] == true {
+		if _, isString := value.(string); !isString && !isInteger(value) {
+			violate("must be an integer or a string")
+			return
+		}
+	} else if typ, _ := schema["type"].(string); typ != "" && !hasSchemaType(value, typ) {
+		violate("must be of type %s", typ)
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violate("must be one of %s", jsonList(enum))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		n := float64(utf8.RuneCountInString(value))
+		if min, ok := schemaNumber(schema, "minLength"); ok && n < min {
+			violate("must be at least %v characters long", min)
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && n > max {
+			violate("must be at most %v characters long", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			// RE2 differs from the ECMA 262 of the schema, so
+			// patterns that it can't compile are skipped.
+			if re, err := regexp.Compile(pattern); err == nil && !re.MatchString(value) {
+				violate("must match %q", pattern)
+			}
+		}
+	case []interface{}:
+		n := float64(len(value))
+		if min, ok := schemaNumber(schema, "minItems"); ok && n < min {
+			violate("must have at least %v items", min)
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && n > max {
+			violate("must have at most %v items", max)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				validateSchema(items, item, field+"["+strconv.Itoa(i)+"]", violations)
+			}
+		}
+	case map[string]interface{}:
+		n := float64(len(value))
+		if min, ok := schemaNumber(schema, "minProperties"); ok && n < min {
+			violate("must have at least %v properties", min)
+		}
+		if max, ok := schemaNumber(schema, "maxProperties"); ok && n > max {
+			violate("must have at most %v properties", max)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if name, _ := r.(string); value[name] == nil {
+				*violations = append(*violations, SchemaViolation{Field: joinField(field, name), Message: "is required"})
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if property, ok := properties[k].(map[string]interface{}); ok {
+				validateSchema(property, value[k], joinField(field, k), violations)
+			} else if additional != nil {
+				validateSchema(additional, value[k], field+"["+k+"]", violations)
+			}
+		}
+	default:
+		n, ok := jsonNumber(value)
+		if !ok {
+			break
+		}
+		if min, ok := schemaNumber(schema, "minimum"); ok {
+			if exclusive := schema["exclusiveMinimum"] == true; n < min || (exclusive && n == min) {
+				violate("must be greater than %s%v", orEqual(!exclusive), min)
+			}
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok {
+			if exclusive := schema["exclusiveMaximum"] == true; n > max || (exclusive && n == max) {
+				violate("must be less than %s%v", orEqual(!exclusive), max)
+			}
+		}
+		if m, ok := schemaNumber(schema, "multipleOf"); ok && m != 0 && math.Mod(n, m) != 0 {
+			violate("must be a multiple of %v", m)
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range allOf {
+			if s, ok := s.(map[string]interface{}); ok {
+				validateSchema(s, value, field, violations)
+			}
+		}
+	}
+	matching := func(schemas []interface{}) int {
+		n := 0
+		for _, s := range schemas {
+			if s, ok := s.(map[string]interface{}); ok {
+				var v []SchemaViolation
+				if validateSchema(s, value, field, &v); len(v) == 0 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok && matching(anyOf) == 0 {
+		violate("must match at least one of the schemas of anyOf")
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok && matching(oneOf) != 1 {
+		violate("must match exactly one of the schemas of oneOf")
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok && matching([]interface{}{not}) == 1 {
+		violate("must not match the schema of not")
+	}
+}
+
+func joinField(field, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func orEqual(b bool) string {
+	if b {
+		return "or equal to "
+	}
+	return ""
+}
+
+// hasSchemaType returns whether the JSON value is of the schema type.
+func hasSchemaType(value interface{}, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer":
+		return isInteger(value)
+	case "number":
+		_, ok := jsonNumber(value)
+		return ok
+	}
+	return true
+}
+
+// jsonNumber returns the value as a float64, if it is a number.
+func jsonNumber(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	}
+	return 0, false
+}
+
+func isInteger(value interface{}) bool {
+	n, ok := jsonNumber(value)
+	return ok && n == math.Trunc(n)
+}
+
+// schemaNumber returns the numeric keyword of the schema, if it is set.
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	return jsonNumber(schema[keyword])
+}
+
+// jsonEqual returns whether the JSON values are equal, whatever the Go
+// types of their numbers.
+func jsonEqual(a, b interface{}) bool {
+	if an, ok := jsonNumber(a); ok {
+		bn, ok := jsonNumber(b)
+		return ok && an == bn
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// jsonList formats the values as a list, for messages.
+func jsonList(values []interface{}) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			strs[i] = strconv.Quote(s)
+		} else {
+			strs[i] = fmt.Sprint(v)
+		}
+	}
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,156 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// widgetSchema is the OpenAPI v3 schema of the Widgets of newSchemaServer.
+var widgetSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"spec": map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"size"},
+			"properties": map[string]interface{}{
+				"size":  map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 10},
+				"color": map[string]interface{}{"type": "string", "enum": []interface{}{"red", "blue"}},
+				"port":  map[string]interface{}{"x-kubernetes-int-or-string": true},
+				"tags": map[string]interface{}{
+					"type":     "array",
+					"maxItems": 2,
+					"items":    map[string]interface{}{"type": "string", "pattern": "^[a-z]+$"},
+				},
+			},
+		},
+	},
+}
+
+// newSchemaServer returns a client of a server that discovers the
+// Widgets of example.com/v1, and serves their CustomResourceDefinition,
+// counting how often it is fetched.
+func newSchemaServer(t *testing.T) (*k8s.Client, *int32) {
+	var fetches int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"versions": []string{"v1"}})
+	})
+	mux.HandleFunc("/api/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"groupVersion": "v1", "resources": []interface{}{}})
+	})
+	mux.HandleFunc("/apis", func(w http.ResponseWriter, r *http.Request) {
+		gv := map[string]interface{}{"groupVersion": "example.com/v1", "version": "v1"}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"groups": []interface{}{
+			map[string]interface{}{"name": "example.com", "versions": []interface{}{gv}, "preferredVersion": gv},
+		}})
+	})
+	mux.HandleFunc("/apis/example.com/v1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"groupVersion": "example.com/v1", "resources": []interface{}{
+			map[string]interface{}{"name": "widgets", "namespaced": true, "kind": "Widget", "verbs": []string{"get", "list", "watch"}},
+		}})
+	})
+	mux.HandleFunc("/apis/apiextensions.k8s.io/v1/customresourcedefinitions/widgets.example.com", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"spec": map[string]interface{}{"versions": []interface{}{
+			map[string]interface{}{"name": "v1", "schema": map[string]interface{}{"openAPIV3Schema": widgetSchema}},
+		}}})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return &k8s.Client{Endpoint: server.URL, Client: server.Client()}, &fetches
+}
+
+// specWidget returns a Widget with the spec.
+func specWidget(name string, spec map[string]interface{}) *k8sutil.Unstructured {
+	u := widget("default", name)
+	u.Object["spec"] = spec
+	u.Object["metadata"].(map[string]interface{})["uid"] = name
+	u.Object["metadata"].(map[string]interface{})["resourceVersion"] = "1"
+	return u
+}
+
+func TestSchemaValidator(t *testing.T) {
+	client, fetches := newSchemaServer(t)
+	v := &k8sutil.SchemaValidator{Client: client, Discovery: &k8sutil.Discovery{Client: client}}
+	ctx := context.Background()
+
+	valid := specWidget("valid", map[string]interface{}{"size": 3, "color": "red", "port": "http", "tags": []interface{}{"a"}, "unknown": true})
+	if err := v.Validate(ctx, valid); err != nil {
+		t.Errorf("valid: %v", err)
+	}
+	invalid := specWidget("invalid", map[string]interface{}{"size": 11, "color": "green", "port": 1.5, "tags": []interface{}{"A", "b", "c"}})
+	err := v.Validate(ctx, invalid)
+	schemaErr, ok := err.(*k8sutil.SchemaError)
+	if !ok {
+		t.Fatalf("invalid: got %v, want a *SchemaError", err)
+	}
+	want := []k8sutil.SchemaViolation{
+		{Field: "spec.color", Message: `must be one of "red", "blue"`},
+		{Field: "spec.port", Message: "must be an integer or a string"},
+		{Field: "spec.size", Message: "must be less than or equal to 10"},
+		{Field: "spec.tags", Message: "must have at most 2 items"},
+		{Field: "spec.tags[0]", Message: `must match "^[a-z]+$"`},
+	}
+	if !reflect.DeepEqual(schemaErr.Violations, want) {
+		t.Errorf("got violations\n%v\nwant\n%v", schemaErr.Violations, want)
+	}
+	if err := v.Validate(ctx, specWidget("missing", map[string]interface{}{})); err == nil {
+		t.Errorf("missing a required field: valid")
+	}
+	if n := atomic.LoadInt32(fetches); n != 1 {
+		t.Errorf("fetched the schema %d times, want it cached", n)
+	}
+	// Typed resources are left to their Go types.
+	if err := v.Validate(ctx, newConfigMap("default", "a")); err != nil {
+		t.Errorf("ConfigMap: %v", err)
+	}
+}
+
+// TestValidateSchema checks that a watch that validates drops the
+// invalid resources that it receives.
+func TestValidateSchema(t *testing.T) {
+	client, _ := newSchemaServer(t)
+	v := &k8sutil.SchemaValidator{Client: client, Discovery: &k8sutil.Discovery{Client: client}}
+	backend := k8sutiltest.NewScriptedBackend(t)
+	synced := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { synced <- s },
+	}
+	list := &k8sutil.UnstructuredList{Resource: k8sutil.APIResource{Group: "example.com", Version: "v1", Name: "widgets", Kind: "Widget", Namespaced: true}}
+	w.AddWatch("default", list, k8sutil.ValidateSchema(v))
+	stream := backend.Stream("default", list)
+	stream.List(&k8sutil.UnstructuredList{Metadata: k8sutiltest.ListMeta("1"), Items: []*k8sutil.Unstructured{
+		specWidget("valid", map[string]interface{}{"size": 3}),
+		specWidget("invalid", map[string]interface{}{"size": 0}),
+	}})
+	runStore(t, w)
+	names := func(s k8sutil.Store) []string {
+		var ret []string
+		for _, r := range s.ListSorted(k8sutil.NewUnstructured("example.com/v1", "Widget")) {
+			ret = append(ret, r.GetMetadata().GetName())
+		}
+		return ret
+	}
+	if got := names(<-synced); !reflect.DeepEqual(got, []string{"valid"}) {
+		t.Errorf("listed %q, want only the valid Widget", got)
+	}
+	stream.WaitForWatch(1)
+	stream.Send(k8s.EventAdded, specWidget("also-invalid", map[string]interface{}{"size": "big"}))
+	stream.Send(k8s.EventAdded, specWidget("also-valid", map[string]interface{}{"size": 1}))
+	if got := names(<-synced); !reflect.DeepEqual(got, []string{"also-valid", "valid"}) {
+		t.Errorf("watched %q, want only the valid Widgets", got)
+	}
+}
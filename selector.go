@@ -0,0 +1,242 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+// parseLabelSelector parses a label selector in the syntax of the
+// labelSelector query parameter: comma-separated requirements, each of
+// which is "key", "!key", "key=value" (or "=="), "key!=value",
+// "key in (value,...)", or "key notin (value,...)".  It returns a
+// function that says whether a set of labels matches.
+func parseLabelSelector(selector string) (func(map[string]string) bool, error) {
+	var requirements []func(map[string]string) bool
+	for _, str := range splitSelector(selector) {
+		requirement, err := parseLabelRequirement(strings.TrimSpace(str))
+		if err != nil {
+			return nil, errors.Wrapf(err, "label selector %q", selector)
+		}
+		requirements = append(requirements, requirement)
+	}
+	return func(labels map[string]string) bool {
+		for _, requirement := range requirements {
+			if !requirement(labels) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// splitSelector splits a selector at the commas that aren't in
+// parentheses, ignoring empty requirements.
+func splitSelector(selector string) []string {
+	var ret []string
+	depth, start := 0, 0
+	for i, c := range selector + "," {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			if str := strings.TrimSpace(selector[start:i]); str != "" {
+				ret = append(ret, str)
+			}
+			start = i + 1
+		}
+	}
+	// An unclosed parenthesis leaves the rest to be rejected as
+	// a requirement.
+	if start < len(selector) {
+		ret = append(ret, strings.TrimSpace(selector[start:]))
+	}
+	return ret
+}
+
+// parseLabelRequirement parses one requirement of a label selector.
+func parseLabelRequirement(str string) (func(map[string]string) bool, error) {
+	if strings.HasPrefix(str, "!") {
+		key := strings.TrimSpace(str[1:])
+		if key == "" {
+			return nil, errors.Errorf("%q: missing key", str)
+		}
+		return func(labels map[string]string) bool {
+			_, ok := labels[key]
+			return !ok
+		}, nil
+	}
+	if i := strings.IndexAny(str, "=!"); i >= 0 {
+		key, op, value := strings.TrimSpace(str[:i]), "", ""
+		switch {
+		case strings.HasPrefix(str[i:], "=="):
+			op, value = "=", str[i+2:]
+		case strings.HasPrefix(str[i:], "!="):
+			op, value = "!=", str[i+2:]
+		case str[i] == '=':
+			op, value = "=", str[i+1:]
+		default:
+			return nil, errors.Errorf("%q: invalid operator", str)
+		}
+		value = strings.TrimSpace(value)
+		if key == "" {
+			return nil, errors.Errorf("%q: missing key", str)
+		}
+		return func(labels map[string]string) bool {
+			have, ok := labels[key]
+			return (op == "=") == (ok && have == value)
+		}, nil
+	}
+	fields := strings.Fields(str)
+	if len(fields) == 1 {
+		key := fields[0]
+		return func(labels map[string]string) bool {
+			_, ok := labels[key]
+			return ok
+		}, nil
+	}
+	key := fields[0]
+	rest := strings.TrimSpace(strings.TrimPrefix(str, key))
+	var in bool
+	switch {
+	case strings.HasPrefix(rest, "in"):
+		in, rest = true, strings.TrimSpace(rest[len("in"):])
+	case strings.HasPrefix(rest, "notin"):
+		in, rest = false, strings.TrimSpace(rest[len("notin"):])
+	default:
+		return nil, errors.Errorf("%q: invalid operator", str)
+	}
+	if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+		return nil, errors.Errorf("%q: expected a parenthesized list of values", str)
+	}
+	values := make(map[string]bool)
+	for _, value := range strings.Split(rest[1:len(rest)-1], ",") {
+		values[strings.TrimSpace(value)] = true
+	}
+	return func(labels map[string]string) bool {
+		have, ok := labels[key]
+		return in == (ok && values[have])
+	}, nil
+}
+
+// parseFieldSelector parses a field selector in the syntax of the
+// fieldSelector query parameter, supporting only the fields that every
+// type has: metadata.name and metadata.namespace.
+func parseFieldSelector(selector string) (func(k8s.Resource) bool, error) {
+	var requirements []func(k8s.Resource) bool
+	for _, str := range splitSelector(selector) {
+		i := strings.IndexAny(str, "=!")
+		if i < 0 {
+			return nil, errors.Errorf("field selector %q: %q: missing operator", selector, str)
+		}
+		field, value, equal := strings.TrimSpace(str[:i]), str[i+1:], true
+		switch {
+		case strings.HasPrefix(str[i:], "=="):
+			value = str[i+2:]
+		case strings.HasPrefix(str[i:], "!="):
+			value, equal = str[i+2:], false
+		case str[i] != '=':
+			return nil, errors.Errorf("field selector %q: %q: invalid operator", selector, str)
+		}
+		value = strings.TrimSpace(value)
+		var get func(*metav1.ObjectMeta) string
+		switch field {
+		case "metadata.name":
+			get = (*metav1.ObjectMeta).GetName
+		case "metadata.namespace":
+			get = (*metav1.ObjectMeta).GetNamespace
+		default:
+			return nil, errors.Errorf("field selector %q: field label not supported: %s", selector, field)
+		}
+		requirements = append(requirements, func(resource k8s.Resource) bool {
+			return (get(resource.GetMetadata()) == value) == equal
+		})
+	}
+	return func(resource k8s.Resource) bool {
+		for _, requirement := range requirements {
+			if !requirement(resource) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Filtered returns a view of the store that only has the resources that
+// match the label selector (in the syntax of the labelSelector query
+// parameter), of every type: for handing each tenant of a multi-tenant
+// server a view that it can't see the others' resources through.  The
+// view has the store's Sequence.  Keys and Count have to look at the
+// labels of every resource, so they are no cheaper than List.
+func Filtered(store Store, selector string) (Store, error) {
+	matches, err := parseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return &filteredStore{store: store, matches: matches}, nil
+}
+
+type filteredStore struct {
+	store   Store
+	matches func(map[string]string) bool
+}
+
+func (f *filteredStore) filter(resources []k8s.Resource) []k8s.Resource {
+	ret := make([]k8s.Resource, 0, len(resources))
+	for _, resource := range resources {
+		if f.matches(resource.GetMetadata().GetLabels()) {
+			ret = append(ret, resource)
+		}
+	}
+	return ret
+}
+
+// List implements Store.
+func (f *filteredStore) List(resourceType k8s.Resource) []k8s.Resource {
+	return f.filter(f.store.List(resourceType))
+}
+
+// ListSorted implements Store.
+func (f *filteredStore) ListSorted(resourceType k8s.Resource) []k8s.Resource {
+	return f.filter(f.store.ListSorted(resourceType))
+}
+
+// All implements Store.
+func (f *filteredStore) All(resourceType k8s.Resource) func(yield func(k8s.Resource) bool) {
+	return func(yield func(k8s.Resource) bool) {
+		f.store.All(resourceType)(func(resource k8s.Resource) bool {
+			return !f.matches(resource.GetMetadata().GetLabels()) || yield(resource)
+		})
+	}
+}
+
+// Keys implements Store.
+func (f *filteredStore) Keys(resourceType k8s.Resource) []ObjectKey {
+	resources := f.ListSorted(resourceType)
+	ret := make([]ObjectKey, len(resources))
+	for i, resource := range resources {
+		ret[i] = objectKeyOf(resource)
+	}
+	return ret
+}
+
+// Count implements Store.
+func (f *filteredStore) Count(resourceType k8s.Resource) int {
+	n := 0
+	f.All(resourceType)(func(k8s.Resource) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Sequence implements Store.
+func (f *filteredStore) Sequence() uint64 {
+	return f.store.Sequence()
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "front"}
+	for selector, want := range map[string]bool{
+		"":                       true,
+		"app":                    true,
+		"!app":                   false,
+		"!owner":                 true,
+		"app=web":                true,
+		"app==web,tier=front":    true,
+		"app=web,tier=back":      false,
+		"app!=db":                true,
+		"app in (db, web)":       true,
+		"app notin (db,web)":     false,
+		"tier notin (back), app": true,
+		"owner in (alice)":       false,
+		"owner notin (alice)":    true,
+	} {
+		matches, err := parseLabelSelector(selector)
+		if err != nil {
+			t.Errorf("%q: %v", selector, err)
+			continue
+		}
+		if got := matches(labels); got != want {
+			t.Errorf("%q: got %v, want %v", selector, got, want)
+		}
+	}
+	for _, selector := range []string{"=web", "!", "app in web", "app in (web", "app in (web,db"} {
+		if _, err := parseLabelSelector(selector); err == nil {
+			t.Errorf("%q: parsed", selector)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// ServerVersion describes the version of an apiserver, and which
+// optional behaviors it can be expected to support.
+//
+// The feature hints are based on the version in which each feature
+// became enabled by default; a cluster administrator may have turned
+// a feature off, or turned an alpha feature on early.
+type ServerVersion struct {
+	k8s.Version
+
+	// Major and Minor are the numeric forms of Version.Major and
+	// Version.Minor, ignoring any non-numeric suffix (such as the
+	// "+" that some providers append).
+	Major int
+	Minor int
+
+	// WatchBookmarks is whether watches may ask for BOOKMARK
+	// events (allowWatchBookmarks=true).  Kubernetes 1.16+.
+	WatchBookmarks bool
+
+	// EndpointSlices is whether the discovery.k8s.io
+	// EndpointSlice API is served, and should be preferred over
+	// core/v1 Endpoints.  Kubernetes 1.17+.
+	EndpointSlices bool
+
+	// EndpointSliceGroupVersion is the newest group version in
+	// which EndpointSlices are served: "discovery.k8s.io/v1beta1"
+	// for Kubernetes 1.17 through 1.20, and "discovery.k8s.io/v1"
+	// for 1.21+.  It is empty if EndpointSlices is false.
+	EndpointSliceGroupVersion string
+
+	// ServerSideApply is whether PATCH requests may use the
+	// application/apply-patch+yaml content type.  Kubernetes
+	// 1.16+.
+	ServerSideApply bool
+
+	// WatchList is whether watches may be streaming lists
+	// (sendInitialEvents=true).  Kubernetes 1.27+, but only if the
+	// WatchList feature gate is enabled, which it isn't by default
+	// until later versions; the apiserver rejects the request if
+	// it isn't.
+	WatchList bool
+}
+
+// AtLeast returns whether the server is version major.minor or later.
+func (v *ServerVersion) AtLeast(major, minor int) bool {
+	return v.Major > major || (v.Major == major && v.Minor >= minor)
+}
+
+// ServerInfo asks the apiserver for its version, and returns it along
+// with hints about which optional behaviors it supports.
+func ServerInfo(ctx context.Context, client *k8s.Client) (*ServerVersion, error) {
+	ret := new(ServerVersion)
+	if err := getJSON(ctx, client, "/version", &ret.Version); err != nil {
+		return nil, errors.Wrap(err, "get server version")
+	}
+	var err error
+	if ret.Major, err = parseVersionNumber(ret.Version.Major); err != nil {
+		return nil, errors.Wrapf(err, "server major version %q", ret.Version.Major)
+	}
+	if ret.Minor, err = parseVersionNumber(ret.Version.Minor); err != nil {
+		return nil, errors.Wrapf(err, "server minor version %q", ret.Version.Minor)
+	}
+	ret.WatchBookmarks = ret.AtLeast(1, 16)
+	ret.EndpointSlices = ret.AtLeast(1, 17)
+	switch {
+	case ret.AtLeast(1, 21):
+		ret.EndpointSliceGroupVersion = "discovery.k8s.io/v1"
+	case ret.EndpointSlices:
+		ret.EndpointSliceGroupVersion = "discovery.k8s.io/v1beta1"
+	}
+	ret.ServerSideApply = ret.AtLeast(1, 16)
+	ret.WatchList = ret.AtLeast(1, 27)
+	return ret, nil
+}
+
+// parseVersionNumber parses the leading digits of a version component
+// such as "14" or "14+".
+func parseVersionNumber(str string) (int, error) {
+	end := strings.IndexFunc(str, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		str = str[:end]
+	}
+	return strconv.Atoi(str)
+}
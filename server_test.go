@@ -0,0 +1,84 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestServerInfo(t *testing.T) {
+	tests := []struct {
+		minor          string
+		minorNumber    int
+		bookmarks      bool
+		endpointSlices string
+		serverSideApp  bool
+	}{
+		{"14+", 14, false, "", false},
+		{"16", 16, true, "", true},
+		{"17", 17, true, "discovery.k8s.io/v1beta1", true},
+		{"21", 21, true, "discovery.k8s.io/v1", true},
+	}
+	for _, test := range tests {
+		server := newFakeAPIServer(t)
+		server.setRelease("1", test.minor)
+		v, err := k8sutil.ServerInfo(context.Background(), server.client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "1." + test.minor
+		if v.Major != 1 || v.Minor != test.minorNumber {
+			t.Errorf("%s: got %d.%d", name, v.Major, v.Minor)
+		}
+		if v.WatchBookmarks != test.bookmarks {
+			t.Errorf("%s: WatchBookmarks: got %v", name, v.WatchBookmarks)
+		}
+		if v.EndpointSlices != (test.endpointSlices != "") || v.EndpointSliceGroupVersion != test.endpointSlices {
+			t.Errorf("%s: EndpointSlices: got %v %q", name, v.EndpointSlices, v.EndpointSliceGroupVersion)
+		}
+		if v.ServerSideApply != test.serverSideApp {
+			t.Errorf("%s: ServerSideApply: got %v", name, v.ServerSideApply)
+		}
+	}
+}
+
+func TestServerInfoBadVersion(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.setRelease("one", "16")
+	if _, err := k8sutil.ServerInfo(context.Background(), server.client()); err == nil {
+		t.Errorf("ServerInfo accepted major version \"one\"")
+	}
+}
+
+// TestBookmarks checks that watches only ask for bookmarks of servers
+// that support them, and that the WatchingStore exposes the version.
+func TestBookmarks(t *testing.T) {
+	for _, minor := range []string{"15", "16"} {
+		server := newFakeAPIServer(t)
+		server.setRelease("1", minor)
+		w := &k8sutil.WatchingStore{
+			Client:   server.client(),
+			Logger:   testLogger{t},
+			Callback: func(k8sutil.Store) {},
+		}
+		w.AddWatch("default", &corev1.ConfigMapList{})
+		if w.ServerVersion() != nil {
+			t.Errorf("1.%s: got a ServerVersion before Run", minor)
+		}
+		runStore(t, w)
+		watch := server.await("watch")
+		want := minor == "16"
+		if got := strings.Contains(watch.line, "allowWatchBookmarks=true"); got != want {
+			t.Errorf("1.%s: %s", minor, watch.line)
+		}
+		if v := w.ServerVersion(); v == nil || v.GitVersion != "v1."+minor+".0" {
+			t.Errorf("1.%s: got ServerVersion %v", minor, v)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	"github.com/pkg/errors"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// TestWatchSession replays the life of a single watch: its listing,
+// events (including ones older than what is stored, which are ignored),
+// a bookmark, a dropped connection, and an expiry that makes it list
+// again.
+func TestWatchSession(t *testing.T) {
+	ss := newSession(t)
+	store := ss.store()
+	store.AddWatch("default", &corev1.ConfigMapList{})
+	s := ss.stream("default")
+	ss.run(store)
+
+	ss.list(s, "1", configMap("default", "a", "1"), configMap("default", "b", "1"))
+	ss.expect(1)
+	ss.waitForWatch(s, 1)
+	ss.send(s, k8s.EventAdded, configMap("default", "c", "2"))
+	ss.expect(1)
+	ss.send(s, k8s.EventModified, configMap("default", "a", "3"))
+	ss.expect(1)
+	ss.send(s, k8s.EventModified, configMap("default", "a", "2"))
+	ss.send(s, k8s.EventDeleted, configMap("default", "b", "4"))
+	ss.expect(1)
+	s.Bookmark("5")
+	ss.logf("%s BOOKMARK 5", s)
+	s.Disconnect()
+	ss.logf("%s disconnect", s)
+	ss.waitForWatch(s, 2)
+	// Replayed by a watch that restarted from an older resourceVersion.
+	ss.send(s, k8s.EventAdded, configMap("default", "c", "2"))
+	ss.send(s, k8s.EventModified, configMap("default", "c", "6"))
+	ss.expect(1)
+	s.Expire()
+	ss.logf("%s expire", s)
+	ss.list(s, "8", configMap("default", "a", "3"), configMap("default", "c", "6"), configMap("default", "d", "7"))
+	ss.expect(1)
+	ss.waitForWatch(s, 3)
+	ss.done()
+}
+
+// TestRemoveWatchSession replays the removal of a watch while Run is
+// running: what it stored is purged, but not what another watch, of
+// another namespace, has stored.
+func TestRemoveWatchSession(t *testing.T) {
+	ss := newSession(t)
+	store := ss.store()
+	store.AddWatch("default", &corev1.ConfigMapList{})
+	store.AddWatch("other", &corev1.ConfigMapList{})
+	def, other := ss.stream("default"), ss.stream("other")
+	ss.run(store)
+
+	ss.list(def, "1", configMap("default", "a", "1"), configMap("default", "b", "1"))
+	ss.list(other, "1", configMap("other", "t", "1"))
+	ss.expect(1)
+	ss.waitForWatch(def, 1)
+	ss.waitForWatch(other, 1)
+	ss.logf("remove the watch of default: %d removed", store.RemoveWatch(&corev1.ConfigMap{}, "default"))
+	ss.expect(1)
+	ss.send(other, k8s.EventDeleted, configMap("other", "t", "2"))
+	ss.expect(1)
+	ss.logf("remove the watch of default again: %d removed", store.RemoveWatch(&corev1.ConfigMap{}, "default"))
+	ss.done()
+}
+
+// TestOverflowSession replays a watch that falls behind, with a callback
+// held up, and drops its events to list again (OverflowRelist), while
+// the watch of another namespace carries on.
+func TestOverflowSession(t *testing.T) {
+	ss := newSession(t)
+	g := newGate()
+	store := ss.store()
+	store.Callback = func(s k8sutil.Store) {
+		g.pass()
+		ss.rec.Callback(s)
+	}
+	store.EventBuffer = 1
+	store.Overflow = k8sutil.OverflowRelist
+	store.AddWatch("default", &corev1.ConfigMapList{})
+	store.AddWatch("other", &corev1.ConfigMapList{})
+	def, other := ss.stream("default"), ss.stream("other")
+	ss.run(store)
+
+	ss.list(def, "1", configMap("default", "a", "1"))
+	ss.list(other, "1", configMap("other", "t", "1"))
+	ss.expect(1)
+	ss.waitForWatch(def, 1)
+	ss.waitForWatch(other, 1)
+
+	// The callback for the first event holds up the next, which
+	// fills the buffer, so the third doesn't fit.
+	g.hold()
+	ss.send(def, k8s.EventModified, configMap("default", "a", "2"))
+	g.waitHeld(t)
+	ss.send(def, k8s.EventAdded, configMap("default", "b", "3"))
+	ss.send(def, k8s.EventAdded, configMap("default", "c", "4"))
+	ss.waitForList(def, 2)
+	g.release()
+	ss.logf("the callback returns")
+	ss.expect(2)
+	ss.list(def, "5", configMap("default", "b", "3"), configMap("default", "c", "4"))
+	ss.expect(1)
+	ss.waitForWatch(def, 2)
+	ss.send(other, k8s.EventModified, configMap("other", "t", "6"))
+	ss.expect(1)
+	ss.logf("overflows: %d", store.Overflows())
+	ss.done()
+}
+
+// A gate holds up a callback until the test releases it.
+type gate struct {
+	mu      sync.Mutex
+	held    bool
+	entered chan struct{}
+	opened  chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{entered: make(chan struct{}, 1), opened: make(chan struct{})}
+}
+
+// hold makes the next pass wait for release.
+func (g *gate) hold() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.held = true
+}
+
+func (g *gate) pass() {
+	g.mu.Lock()
+	held := g.held
+	g.held = false
+	g.mu.Unlock()
+	if held {
+		g.entered <- struct{}{}
+		<-g.opened
+	}
+}
+
+// waitHeld waits for a pass to be held up.
+func (g *gate) waitHeld(t *testing.T) {
+	t.Helper()
+	select {
+	case <-g.entered:
+	case <-time.After(k8sutiltest.DefaultTimeout):
+		t.Fatalf("timed out waiting for the callback")
+	}
+}
+
+// release lets the held pass through.
+func (g *gate) release() {
+	g.opened <- struct{}{}
+}
+
+// TestSelectorSession replays two watches of the same type and
+// namespace, told apart by their label selectors, in their streams,
+// their Status, and what they log.
+func TestSelectorSession(t *testing.T) {
+	ss := newSession(t)
+	logs := make(chan string, 100)
+	store := ss.store()
+	store.Logger = chanLogger{t, logs}
+	store.AddWatch("default", &corev1.ConfigMapList{}, selector("app=x"))
+	store.AddWatch("default", &corev1.ConfigMapList{}, selector("app=y"))
+	x, y := ss.selectorStream("default", "app=x"), ss.selectorStream("default", "app=y")
+	ss.run(store)
+
+	ss.list(x, "1", configMap("default", "x1", "1", "app", "x"))
+	ss.list(y, "1", configMap("default", "y1", "1", "app", "y"))
+	ss.expect(1)
+	ss.waitForWatch(x, 1)
+	ss.waitForWatch(y, 1)
+	for _, status := range store.Status() {
+		ss.logf("status %s", status.ID)
+	}
+	ss.send(y, k8s.EventModified, configMap("default", "y1", "2", "app", "y"))
+	ss.expect(1)
+	x.Fail(errors.New("connection reset"))
+	ss.logf("%s fail", x)
+	for line := range logs {
+		if strings.HasPrefix(line, "read ") {
+			ss.logf("  logged: %s", line)
+			break
+		}
+	}
+	ss.waitForWatch(x, 2)
+	ss.send(x, k8s.EventAdded, configMap("default", "x2", "3", "app", "x"))
+	ss.expect(1)
+	ss.done()
+}
+
+func selector(s string) k8sutil.WatchOption {
+	return k8sutil.ClientOptions(k8s.QueryParam("labelSelector", s))
+}
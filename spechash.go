@@ -0,0 +1,127 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+// SpecHashAnnotation is the annotation that SetSpecHash records a
+// resource's SpecHash in.
+const SpecHashAnnotation = "k8sutil.datawire.io/spec-hash"
+
+// SpecHash returns a hash of the resource's "spec", or, for types
+// without one (such as a ConfigMap), of everything but its apiVersion,
+// kind, metadata, and status.  The hash depends only on the content,
+// not on the Go type or field order, so it is the same for a typed
+// resource and an Unstructured with the same JSON.
+func SpecHash(resource k8s.Resource) (string, error) {
+	data, err := marshalKubeJSON(resource)
+	if err != nil {
+		return "", errors.Wrap(err, "spec hash")
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return "", errors.Wrap(err, "spec hash")
+	}
+	var spec interface{} = object
+	if s, ok := object["spec"]; ok {
+		spec = s
+	} else {
+		for _, field := range []string{"apiVersion", "kind", "metadata", "status"} {
+			delete(object, field)
+		}
+	}
+	// encoding/json sorts map keys, so this encoding is stable.
+	data, err = json.Marshal(spec)
+	if err != nil {
+		return "", errors.Wrap(err, "spec hash")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// GetSpecHash returns the hash that SetSpecHash recorded in the
+// resource's SpecHashAnnotation, or "" if there is none.
+func GetSpecHash(resource k8s.Resource) string {
+	return resource.GetMetadata().GetAnnotations()[SpecHashAnnotation]
+}
+
+// SetSpecHash records the resource's SpecHash in its
+// SpecHashAnnotation.  Call it on the desired state of a resource
+// before creating or updating it, so that NeedsUpdate can tell whether
+// it has changed since.
+func SetSpecHash(resource k8s.Resource) error {
+	hash, err := SpecHash(resource)
+	if err != nil {
+		return err
+	}
+	setAnnotation(resource, SpecHashAnnotation, hash)
+	return nil
+}
+
+// NeedsUpdate returns whether the actual resource must be updated to
+// match the desired one: whether the SpecHash of desired differs from
+// the hash that SetSpecHash recorded on actual.  It compares hashes
+// rather than the resources themselves, so that defaulting and other
+// changes made by the apiserver don't look like differences.
+func NeedsUpdate(desired, actual k8s.Resource) (bool, error) {
+	hash, err := SpecHash(desired)
+	if err != nil {
+		return false, err
+	}
+	return GetSpecHash(actual) != hash, nil
+}
+
+// setAnnotation sets an annotation on the resource, creating its
+// metadata if need be.
+func setAnnotation(resource k8s.Resource, key, value string) {
+	if u, ok := resource.(*Unstructured); ok {
+		setUnstructuredAnnotation(u, key, value)
+		return
+	}
+	metadata := resource.GetMetadata()
+	if metadata == nil {
+		metadata = new(metav1.ObjectMeta)
+		field := reflect.ValueOf(resource).Elem().FieldByName("Metadata")
+		field.Set(reflect.ValueOf(metadata))
+	}
+	if metadata.Annotations == nil {
+		metadata.Annotations = make(map[string]string)
+	}
+	metadata.Annotations[key] = value
+}
+
+// setUnstructuredAnnotation sets an annotation on an Unstructured, in
+// both its "metadata" and its decoded ObjectMeta.
+func setUnstructuredAnnotation(u *Unstructured, key, value string) {
+	if u.Object == nil {
+		u.Object = make(map[string]interface{})
+	}
+	metadata, ok := u.Object["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		u.Object["metadata"] = metadata
+	}
+	annotations, ok := metadata["annotations"].(map[string]interface{})
+	if !ok {
+		annotations = make(map[string]interface{})
+		metadata["annotations"] = annotations
+	}
+	annotations[key] = value
+
+	if u.metadata == nil {
+		u.metadata = new(metav1.ObjectMeta)
+	}
+	if u.metadata.Annotations == nil {
+		u.metadata.Annotations = make(map[string]string)
+	}
+	u.metadata.Annotations[key] = value
+}
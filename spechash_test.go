@@ -0,0 +1,89 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+func TestSpecHash(t *testing.T) {
+	deployment := func(replicas int32, labels map[string]string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String("a"), Labels: labels},
+			Spec:     &appsv1.DeploymentSpec{Replicas: k8s.Int32(replicas)},
+		}
+	}
+	hash := func(r k8s.Resource) string {
+		t.Helper()
+		h, err := k8sutil.SpecHash(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	if hash(deployment(1, nil)) != hash(deployment(1, map[string]string{"app": "a"})) {
+		t.Errorf("the hash depends on the metadata")
+	}
+	if hash(deployment(1, nil)) == hash(deployment(2, nil)) {
+		t.Errorf("the hash doesn't depend on the spec")
+	}
+	u := &k8sutil.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   map[string]interface{}{"name": "b"},
+		"spec":       map[string]interface{}{"replicas": 1},
+	}}
+	if hash(u) != hash(deployment(1, nil)) {
+		t.Errorf("an Unstructured hashes differently")
+	}
+	var withResources k8sutil.Unstructured
+	if err := json.Unmarshal([]byte(`{"spec": {"template": {"spec": {"containers": [{
+		"name": "app",
+		"ports": [{"containerPort": 8080}],
+		"resources": {"requests": {"cpu": "100m"}}
+	}]}}}}`), &withResources); err != nil {
+		t.Fatal(err)
+	}
+	if hash(&withResources) != hash(newDeployment("web", "100m", 8080)) {
+		t.Errorf("an Unstructured with resources hashes differently")
+	}
+	if hash(newConfigMap("default", "a", "k", "v")) == hash(newConfigMap("default", "a", "k", "w")) {
+		t.Errorf("the hash of a ConfigMap doesn't depend on its data")
+	}
+}
+
+func TestNeedsUpdate(t *testing.T) {
+	desired := newConfigMap("default", "a", "k", "v")
+	actual := newConfigMap("default", "a", "k", "v")
+	if needs, err := k8sutil.NeedsUpdate(desired, actual); err != nil || !needs {
+		t.Errorf("got %v, %v without a recorded hash", needs, err)
+	}
+	if err := k8sutil.SetSpecHash(actual); err != nil {
+		t.Fatal(err)
+	}
+	if k8sutil.GetSpecHash(actual) == "" {
+		t.Fatalf("didn't record the hash")
+	}
+	if needs, err := k8sutil.NeedsUpdate(desired, actual); err != nil || needs {
+		t.Errorf("got %v, %v for the same data", needs, err)
+	}
+	desired.Data["k"] = "w"
+	if needs, err := k8sutil.NeedsUpdate(desired, actual); err != nil || !needs {
+		t.Errorf("got %v, %v for changed data", needs, err)
+	}
+
+	u := &k8sutil.Unstructured{}
+	if err := k8sutil.SetSpecHash(u); err != nil {
+		t.Fatal(err)
+	}
+	if k8sutil.GetSpecHash(u) == "" {
+		t.Errorf("didn't record the hash of an Unstructured")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// ApplyPatchType is the content type of server-side apply patches.
+const ApplyPatchType = "application/apply-patch+yaml"
+
+// DefaultFieldManager is the field manager that Apply applies as if the
+// FieldManager of its ApplyOptions is empty.
+const DefaultFieldManager = "k8sutil"
+
+// ApplyOptions are the options of Apply.
+type ApplyOptions struct {
+	// FieldManager is the name that the apiserver records as the
+	// owner of the fields that are applied.  Each controller should
+	// have its own, so that it is told when it would take a field
+	// over from another.  If empty, DefaultFieldManager is used.
+	FieldManager string
+
+	// Force takes over the fields that are owned by other managers,
+	// instead of failing with an *ApplyConflictError.
+	Force bool
+
+	// DryRun applies with server-side dry run: the result is what
+	// the resource would be, but it isn't changed.
+	DryRun bool
+
+	// Discovery, if set, is used to find the resource type of
+	// Unstructured resources.
+	Discovery *Discovery
+
+	// ServerVersion, if set, is that of the apiserver, such as a
+	// WatchingStore's ServerVersion.  If it says that the
+	// apiserver doesn't support server-side apply, Apply falls back
+	// to merging the resource in to the one in the cluster with a
+	// merge patch, or creating it if there isn't one.  Without
+	// server-side apply, fields aren't owned: fields left out
+	// since the last apply aren't removed, and others' changes are
+	// overwritten rather than reported as conflicts.
+	ServerVersion *ServerVersion
+}
+
+// A FieldConflict is a field that an apply would have changed, but
+// that another field manager owns.
+type FieldConflict struct {
+	// Field is the path of the field, e.g. ".spec.replicas".
+	Field string
+
+	// Manager is the field manager that owns it, e.g. "kubectl" or
+	// "kube-controller-manager", or "" if the apiserver didn't say.
+	Manager string
+
+	// Message is the apiserver's description of the conflict,
+	// which also says which apiVersion the manager used, e.g.
+	// `conflict with "kubectl" using apps/v1`.
+	Message string
+}
+
+// An ApplyConflictError is the refusal of a server-side apply because
+// it would change fields that other field managers own.  Apply again
+// with Force to take them over, or leave them out of the applied
+// resource to leave them to their owners.  It wraps the "409 Conflict"
+// *k8s.APIError of the refusal.
+type ApplyConflictError struct {
+	Resource  ObjectKey
+	Conflicts []FieldConflict
+	Err       error
+}
+
+func (e *ApplyConflictError) Error() string {
+	fields := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		if c.Manager == "" {
+			fields = append(fields, c.Field)
+			continue
+		}
+		fields = append(fields, fmt.Sprintf("%s (owned by %q)", c.Field, c.Manager))
+	}
+	return fmt.Sprintf("apply %s: conflicts with other field managers: %s", e.Resource, strings.Join(fields, ", "))
+}
+
+func (e *ApplyConflictError) Unwrap() error {
+	return e.Err
+}
+
+// Apply applies the resource with server-side apply: the apiserver
+// merges the fields that are set in it with the resource in the
+// cluster (creating it if there isn't one), records the field manager
+// as their owner, and removes the fields that the manager applied
+// before but has now left out.  It returns the resource as it is after
+// the apply.  If the apply would change fields that other managers
+// own, and Force isn't set, it returns an *ApplyConflictError.
+//
+// The status, and the metadata that the apiserver manages (such as the
+// resourceVersion), aren't applied.  Server-side apply requires
+// Kubernetes 1.16 or later; see the ServerVersion of the ApplyOptions
+// for older versions.
+func Apply(ctx context.Context, client *k8s.Client, resource k8s.Resource, options ApplyOptions) (*Unstructured, error) {
+	key := objectKeyOf(resource)
+	apiResource, err := discoverAPIResource(ctx, options.Discovery, "Apply", resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "apply %s", key)
+	}
+	object, err := jsonObject(resource)
+	if err != nil {
+		return nil, errors.Wrapf(err, "apply %s: encode", key)
+	}
+	object = desiredState(object)
+	object["apiVersion"] = apiResource.GroupVersion()
+	object["kind"] = apiResource.Kind
+	if options.ServerVersion != nil && !options.ServerVersion.ServerSideApply {
+		return mergeApply(ctx, client, apiResource, key, object, options)
+	}
+
+	manager := options.FieldManager
+	if manager == "" {
+		manager = DefaultFieldManager
+	}
+	query := url.Values{"fieldManager": {manager}}
+	if options.Force {
+		query.Set("force", "true")
+	}
+	result := new(Unstructured)
+	err = doJSON(ctx, client, request{
+		verb:        http.MethodPatch,
+		path:        apiResource.Path(key.Namespace) + "/" + url.PathEscape(key.Name),
+		query:       query,
+		contentType: ApplyPatchType,
+		dryRun:      options.DryRun,
+	}, object, result)
+	if err != nil {
+		if conflicts := fieldConflictsOf(err); len(conflicts) > 0 {
+			return nil, &ApplyConflictError{Resource: key, Conflicts: conflicts, Err: err}
+		}
+		return nil, errors.Wrapf(classifyError(err, "patch", apiResource.GroupVersionResource(), key.Namespace), "apply %s", key)
+	}
+	return result, nil
+}
+
+// mergeApply is Apply for an apiserver without server-side apply: it
+// merges the object in to the resource with a merge patch, or, if there
+// is no resource, creates it.
+func mergeApply(ctx context.Context, client *k8s.Client, apiResource APIResource, key ObjectKey, object map[string]interface{}, options ApplyOptions) (*Unstructured, error) {
+	path := apiResource.Path(key.Namespace)
+	result := new(Unstructured)
+	err := doJSON(ctx, client, request{
+		verb:        http.MethodPatch,
+		path:        path + "/" + url.PathEscape(key.Name),
+		contentType: MergePatchType,
+		dryRun:      options.DryRun,
+	}, object, result)
+	if apiErrorCode(err) == http.StatusNotFound {
+		err = doJSON(ctx, client, request{
+			verb:   http.MethodPost,
+			path:   path,
+			dryRun: options.DryRun,
+		}, object, result)
+		if apiErrorCode(err) == http.StatusConflict {
+			// Created meanwhile; merge in to it after all.
+			return mergeApply(ctx, client, apiResource, key, object, options)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(classifyError(err, "patch", apiResource.GroupVersionResource(), key.Namespace), "apply %s", key)
+	}
+	return result, nil
+}
+
+// fieldConflictsOf returns the field manager conflicts that the "409
+// Conflict" *k8s.APIError that err is or wraps describes, if it is one.
+func fieldConflictsOf(err error) []FieldConflict {
+	var apiErr *k8s.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusConflict {
+		return nil
+	}
+	var conflicts []FieldConflict
+	for _, cause := range apiErr.Status.GetDetails().GetCauses() {
+		if cause.GetReason() != "FieldManagerConflict" {
+			continue
+		}
+		conflicts = append(conflicts, FieldConflict{
+			Field:   cause.GetField(),
+			Manager: conflictManager(cause.GetMessage()),
+			Message: cause.GetMessage(),
+		})
+	}
+	return conflicts
+}
+
+// conflictManager returns the field manager that a conflict's message,
+// such as `conflict with "kubectl" using apps/v1`, names, or "".
+func conflictManager(message string) string {
+	const prefix = `conflict with "`
+	if !strings.HasPrefix(message, prefix) {
+		return ""
+	}
+	rest := message[len(prefix):]
+	i := strings.Index(rest, `"`)
+	if i < 0 {
+		return ""
+	}
+	return rest[:i]
+}
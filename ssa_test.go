@@ -0,0 +1,157 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ericchiang/k8s"
+	appsv1 "github.com/ericchiang/k8s/apis/apps/v1"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/apis/resource"
+	"github.com/ericchiang/k8s/util/intstr"
+
+	"github.com/datawire/k8sutil"
+)
+
+// portedDeployment returns a Deployment with resources and ports, which
+// encoding/json doesn't encode as the apiserver does.
+func portedDeployment() *appsv1.Deployment {
+	stringType := int64(1) // of an IntOrString
+	return &appsv1.Deployment{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String("default"), Name: k8s.String("web")},
+		Spec: &appsv1.DeploymentSpec{
+			Replicas: k8s.Int32(2),
+			Strategy: &appsv1.DeploymentStrategy{RollingUpdate: &appsv1.RollingUpdateDeployment{
+				MaxSurge: &intstr.IntOrString{Type: &stringType, StrVal: k8s.String("25%")},
+			}},
+			Template: &corev1.PodTemplateSpec{Spec: &corev1.PodSpec{Containers: []*corev1.Container{{
+				Name:      k8s.String("web"),
+				Resources: &corev1.ResourceRequirements{Limits: map[string]*resource.Quantity{"cpu": {String_: k8s.String("100m")}}},
+				Ports:     []*corev1.ContainerPort{{ContainerPort: k8s.Int32(8080)}},
+			}}}},
+		},
+	}
+}
+
+func TestApply(t *testing.T) {
+	var request *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	client := &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+	result, err := k8sutil.Apply(context.Background(), client, portedDeployment(), k8sutil.ApplyOptions{FieldManager: "test", Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := request.Method+" "+request.URL.String(), "PATCH /apis/apps/v1/namespaces/default/deployments/web?fieldManager=test&force=true"; got != want {
+		t.Errorf("got request %s, want %s", got, want)
+	}
+	if ct := request.Header.Get("Content-Type"); ct != k8sutil.ApplyPatchType {
+		t.Errorf("got content type %q", ct)
+	}
+	var sent map[string]interface{}
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent["apiVersion"] != "apps/v1" || sent["kind"] != "Deployment" {
+		t.Errorf("applied %s", body)
+	}
+	want := map[string]interface{}{
+		"name":      "web",
+		"resources": map[string]interface{}{"limits": map[string]interface{}{"cpu": "100m"}},
+		"ports":     []interface{}{map[string]interface{}{"containerPort": 8080.0}},
+	}
+	spec := sent["spec"].(map[string]interface{})
+	if container := spec["template"].(map[string]interface{})["spec"].(map[string]interface{})["containers"].([]interface{})[0]; !reflect.DeepEqual(container, want) {
+		t.Errorf("applied the container %v, want %v", container, want)
+	}
+	if surge := spec["strategy"].(map[string]interface{})["rollingUpdate"].(map[string]interface{})["maxSurge"]; surge != "25%" {
+		t.Errorf("applied maxSurge %v", surge)
+	}
+	if result.GetMetadata().GetName() != "web" {
+		t.Errorf("got the result %v", result.Object)
+	}
+}
+
+func TestApplyConflict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusConflict, &metav1.Status{
+			Status: k8s.String("Failure"),
+			Code:   k8s.Int32(http.StatusConflict),
+			Reason: k8s.String("Conflict"),
+			Details: &metav1.StatusDetails{Causes: []*metav1.StatusCause{{
+				Reason:  k8s.String("FieldManagerConflict"),
+				Message: k8s.String(`conflict with "kubectl" using apps/v1`),
+				Field:   k8s.String(".spec.replicas"),
+			}}},
+		})
+	}))
+	defer server.Close()
+	client := &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+	_, err := k8sutil.Apply(context.Background(), client, portedDeployment(), k8sutil.ApplyOptions{})
+	conflict, ok := err.(*k8sutil.ApplyConflictError)
+	if !ok {
+		t.Fatalf("got %v, want an *ApplyConflictError", err)
+	}
+	want := []k8sutil.FieldConflict{{Field: ".spec.replicas", Manager: "kubectl", Message: `conflict with "kubectl" using apps/v1`}}
+	if !reflect.DeepEqual(conflict.Conflicts, want) {
+		t.Errorf("got conflicts %+v, want %+v", conflict.Conflicts, want)
+	}
+	if msg := conflict.Error(); !strings.Contains(msg, `.spec.replicas (owned by "kubectl")`) {
+		t.Errorf("got message %q", msg)
+	}
+}
+
+// TestApplyWithoutServerSideApply checks that Apply falls back to
+// creating, and then merging in to, the resource when the apiserver
+// doesn't support server-side apply.
+func TestApplyWithoutServerSideApply(t *testing.T) {
+	server := newFakeAPIServer(t)
+	options := k8sutil.ApplyOptions{
+		FieldManager:  "test",
+		ServerVersion: &k8sutil.ServerVersion{Major: 1, Minor: 15},
+	}
+	cm := newConfigMap("default", "a", "k", "v")
+	apply := func(data map[string]string) {
+		t.Helper()
+		cm.Data = data
+		if _, err := k8sutil.Apply(context.Background(), server.client(), cm, options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply(map[string]string{"k": "v"})
+	apply(map[string]string{"k": "new", "l": "v"})
+	const configMaps = "/api/v1/namespaces/default/configmaps"
+	want := []string{
+		"PATCH " + configMaps + "/a (" + k8sutil.MergePatchType + ")",
+		"POST " + configMaps,
+		"PATCH " + configMaps + "/a (" + k8sutil.MergePatchType + ")",
+	}
+	got := server.drain()
+	if len(got) != len(want) {
+		t.Fatalf("requests: got %q, want %q", got, want)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]+" ") {
+			t.Errorf("request %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+	data := server.object(cm)["data"]
+	if want := map[string]interface{}{"k": "new", "l": "v"}; !reflect.DeepEqual(data, want) {
+		t.Errorf("data: got %v, want %v", data, want)
+	}
+}
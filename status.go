@@ -0,0 +1,193 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// WatchStatus describes the state of one watch, for debug endpoints and
+// health checks.
+type WatchStatus struct {
+	ID WatchID
+
+	// Synced is whether the watch's listing, in the current round
+	// of lists and watches, has been delivered to the store.  While
+	// it hasn't, RelistingSince is when the watch started listing
+	// (or, if it had synced before, when it stopped being synced).
+	Synced         bool
+	RelistingSince time.Time
+
+	// ResourceVersion is the resourceVersion that the watch has
+	// caught up to: that of its last listing or event.
+	ResourceVersion string
+
+	// LastEvent is when the watch last received an event
+	// (including a bookmark), or the zero Time if it hasn't.
+	LastEvent time.Time
+
+	// LastError is the most recent error that the watch
+	// encountered listing or watching, and LastErrorTime is when.
+	// They are kept after the watch recovers.
+	LastError     error
+	LastErrorTime time.Time
+
+	// Bookmarks is whether the watch asks for BOOKMARK events,
+	// which the apiserver sends periodically even when nothing
+	// changes, so that a silent watch can be told from a stuck
+	// one.
+	Bookmarks bool
+
+	// EventDelay is how long after its creationTimestamp the last
+	// ADDED event was received: an estimate of the delay between a
+	// change in the cluster and the watch hearing of it, subject
+	// to clock skew.
+	EventDelay time.Duration
+
+	// Reconnects is the number of times that the watch has had to
+	// start watching again, after the first time.
+	Reconnects int
+
+	// Events is the number of events (including bookmarks) that the
+	// watch has received.
+	Events int64
+
+	// Paused is whether the watch is paused by Pause, and
+	// Unavailable whether it is an optional watch that can't list.
+	Paused      bool
+	Unavailable bool
+}
+
+// bookmarkInterval is about how often the apiserver sends a BOOKMARK
+// to a watch that asks for them.
+const bookmarkInterval = 1 * time.Minute
+
+// Lag estimates, as of now, how far behind the cluster the watch's
+// part of the store is likely to be: for a watch that is re-listing,
+// how long it has been since it was synced; otherwise, the longer of
+// the EventDelay, and (if the watch gets bookmarks) how long it has
+// been silent beyond the bookmark interval.  An alert on Lag fires
+// when the store is stale, rather than only when it is empty.
+func (s WatchStatus) Lag(now time.Time) time.Duration {
+	if !s.Synced {
+		return now.Sub(s.RelistingSince)
+	}
+	lag := s.EventDelay
+	if s.Bookmarks && !s.LastEvent.IsZero() {
+		if silent := now.Sub(s.LastEvent) - bookmarkInterval; silent > lag {
+			lag = silent
+		}
+	}
+	return lag
+}
+
+// watchStatus is the part of a WatchStatus that the watch's goroutine
+// keeps up to date.
+type watchStatus struct {
+	mu              sync.Mutex
+	synced          bool
+	relistingSince  time.Time
+	bookmarks       bool
+	eventDelay      time.Duration
+	resourceVersion string
+	lastEvent       time.Time
+	lastError       error
+	lastErrorTime   time.Time
+	watches         int // the number of watches started
+	events          int64
+}
+
+// newRound notes that the watch is listing again, and whether it asks
+// for bookmarks this time.
+func (s *watchStatus) newRound(now time.Time, bookmarks bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bookmarks = bookmarks
+	if s.synced || s.relistingSince.IsZero() {
+		s.relistingSince = now
+	}
+	s.synced = false
+}
+
+// listed notes that the watch's listing was delivered.
+func (s *watchStatus) listed(resourceVersion string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.synced = true
+	s.resourceVersion = resourceVersion
+}
+
+// watching notes that the watch started watching.
+func (s *watchStatus) watching() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watches++
+}
+
+// event notes that the watch received an event of the resource.
+func (s *watchStatus) event(now time.Time, eventType string, resource k8s.Resource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastEvent = now
+	s.events++
+	s.resourceVersion = resource.GetMetadata().GetResourceVersion()
+	if eventType == k8s.EventAdded {
+		if created := creationTime(resource); !created.IsZero() {
+			s.eventDelay = now.Sub(created)
+			if s.eventDelay < 0 {
+				s.eventDelay = 0
+			}
+		}
+	}
+}
+
+// failed notes that the watch encountered the error.
+func (s *watchStatus) failed(now time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+	s.lastErrorTime = now
+}
+
+// status returns the watch's WatchStatus.
+func (w *watch) status() WatchStatus {
+	s := &w.state
+	s.mu.Lock()
+	ret := WatchStatus{
+		ID:              w.id(),
+		Synced:          s.synced,
+		RelistingSince:  s.relistingSince,
+		Bookmarks:       s.bookmarks,
+		EventDelay:      s.eventDelay,
+		ResourceVersion: s.resourceVersion,
+		LastEvent:       s.lastEvent,
+		LastError:       s.lastError,
+		LastErrorTime:   s.lastErrorTime,
+		Events:          s.events,
+	}
+	if s.watches > 1 {
+		ret.Reconnects = s.watches - 1
+	}
+	s.mu.Unlock()
+
+	w.pauser.mu.Lock()
+	ret.Paused = w.pauser.paused
+	w.pauser.mu.Unlock()
+	ret.Unavailable = atomic.LoadInt32(&w.unavailable) != 0
+	return ret
+}
+
+// Status returns the status of each watch, in the order that they were
+// added.  It is safe to call while Run is running.
+func (w *WatchingStore) Status() []WatchStatus {
+	watches := w.currentWatches()
+	ret := make([]WatchStatus, len(watches))
+	for i, wa := range watches {
+		ret[i] = wa.status()
+	}
+	return ret
+}
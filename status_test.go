@@ -0,0 +1,143 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// waitForStatus waits for the status of the store's only watch to
+// satisfy cond, returning it.
+func waitForStatus(t *testing.T, w *k8sutil.WatchingStore, what string, cond func(k8sutil.WatchStatus) bool) k8sutil.WatchStatus {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		status := w.Status()
+		if len(status) != 1 {
+			t.Fatalf("got %d statuses, want 1", len(status))
+		}
+		if cond(status[0]) {
+			return status[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s: %+v", what, status[0])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	backend := k8sutiltest.NewScriptedBackend(t)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   k8sutiltest.Logger(t),
+		Callback: func(k8sutil.Store) {},
+		Clock:    clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	want := k8sutil.WatchID{Type: "v1 ConfigMap", Namespace: "default"}
+	if status := w.Status(); len(status) != 1 || status[0].ID != want || status[0].Synced {
+		t.Fatalf("before Run: got %+v", status)
+	}
+	s := backend.Stream("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+
+	s.List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1")})
+	waitForStatus(t, w, "the listing", func(status k8sutil.WatchStatus) bool {
+		return status.Synced && status.ResourceVersion == "1"
+	})
+	s.WaitForWatch(1)
+	clock.Advance(time.Minute)
+	s.Send(k8s.EventAdded, &corev1.ConfigMap{Metadata: k8sutiltest.ObjectMeta("default", "a", "2")})
+	status := waitForStatus(t, w, "the event", func(status k8sutil.WatchStatus) bool {
+		return status.ResourceVersion == "2"
+	})
+	if !status.LastEvent.Equal(epoch.Add(time.Minute)) {
+		t.Errorf("LastEvent: got %v, want %v", status.LastEvent, epoch.Add(time.Minute))
+	}
+	if status.LastError != nil || status.Reconnects != 0 {
+		t.Errorf("before reconnecting: got %+v", status)
+	}
+
+	s.Disconnect()
+	s.WaitForWatch(2)
+	status = waitForStatus(t, w, "the reconnect", func(status k8sutil.WatchStatus) bool {
+		return status.Reconnects == 1
+	})
+	if status.LastError != io.EOF || !status.LastErrorTime.Equal(epoch.Add(time.Minute)) {
+		t.Errorf("LastError: got %v at %v", status.LastError, status.LastErrorTime)
+	}
+	if !status.Synced || status.Paused || status.Unavailable {
+		t.Errorf("after reconnecting: got %+v", status)
+	}
+}
+
+func TestStatusLag(t *testing.T) {
+	now := epoch.Add(time.Hour)
+	for _, tc := range []struct {
+		name   string
+		status k8sutil.WatchStatus
+		want   time.Duration
+	}{
+		{"relisting", k8sutil.WatchStatus{RelistingSince: now.Add(-time.Minute)}, time.Minute},
+		{"event delay", k8sutil.WatchStatus{Synced: true, EventDelay: time.Second, LastEvent: now.Add(-time.Hour)}, time.Second},
+		{"silent", k8sutil.WatchStatus{Synced: true, Bookmarks: true, EventDelay: time.Second, LastEvent: now.Add(-3 * time.Minute)}, 2 * time.Minute},
+		{"bookmarked", k8sutil.WatchStatus{Synced: true, Bookmarks: true, EventDelay: time.Second, LastEvent: now.Add(-time.Minute)}, time.Second},
+	} {
+		if got := tc.status.Lag(now); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestStatusEventDelay checks that the delay of ADDED events, and how
+// long a watch has been re-listing, are measured by the Clock.
+func TestStatusEventDelay(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	backend := k8sutiltest.NewScriptedBackend(t)
+	w := &k8sutil.WatchingStore{
+		Backend:  backend,
+		Logger:   k8sutiltest.Logger(t),
+		Callback: func(k8sutil.Store) {},
+		Clock:    clock,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	s := backend.Stream("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+
+	s.List(&corev1.ConfigMapList{Metadata: k8sutiltest.ListMeta("1")})
+	s.WaitForWatch(1)
+	cm := &corev1.ConfigMap{Metadata: k8sutiltest.ObjectMeta("default", "a", "2")}
+	seconds := epoch.Add(-3 * time.Second).Unix()
+	cm.Metadata.CreationTimestamp = &metav1.Time{Seconds: &seconds}
+	s.Send(k8s.EventAdded, cm)
+	status := waitForStatus(t, w, "the event", func(status k8sutil.WatchStatus) bool {
+		return status.ResourceVersion == "2"
+	})
+	if status.EventDelay != 3*time.Second {
+		t.Errorf("EventDelay: got %v, want 3s", status.EventDelay)
+	}
+
+	clock.Advance(time.Minute)
+	s.Expire()
+	status = waitForStatus(t, w, "the relist", func(status k8sutil.WatchStatus) bool {
+		return !status.Synced
+	})
+	if !status.RelistingSince.Equal(epoch.Add(time.Minute)) {
+		t.Errorf("RelistingSince: got %v, want %v", status.RelistingSince, epoch.Add(time.Minute))
+	}
+	clock.Advance(time.Minute)
+	if lag := status.Lag(clock.Now()); lag != time.Minute {
+		t.Errorf("Lag while relisting: got %v, want 1m", lag)
+	}
+}
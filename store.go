@@ -0,0 +1,608 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"container/list"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+// A Store allows you to query the stored state of the cluster.
+type Store interface {
+	// List returns all stored resources with the same type as the
+	// given "sample" resource.  It is not valid to mutate any of
+	// the resource returned.
+	List(resourceType k8s.Resource) []k8s.Resource
+
+	// ListSorted is like List, but sorts the resources by namespace
+	// and then name, so that output generated from them is stable
+	// from one Callback to the next.
+	ListSorted(resourceType k8s.Resource) []k8s.Resource
+
+	// All is like List, but returns an iterator over the
+	// resources instead of a slice, so that large collections can
+	// be traversed without allocating; a LazyDecode store decodes
+	// each resource only when it is reached.  Its type is
+	// iter.Seq[k8s.Resource], for range-over-func in Go 1.23 and
+	// later:
+	//
+	//	for resource := range store.All(&corev1.Pod{}) {
+	//		...
+	//	}
+	All(resourceType k8s.Resource) func(yield func(k8s.Resource) bool)
+
+	// Keys returns the namespace and name of each of the stored
+	// resources with the same type as the sample, sorted like
+	// ListSorted, without decoding the resources.
+	Keys(resourceType k8s.Resource) []ObjectKey
+
+	// Count returns the number of stored resources with the same
+	// type as the sample.
+	Count(resourceType k8s.Resource) int
+
+	// Sequence identifies the snapshot: each Callback is passed a
+	// Store whose Sequence is one greater than the last, starting
+	// at 1.  This lets consumers correlate logs, skip stale
+	// snapshots in asynchronous pipelines, and detect missed
+	// notifications.
+	Sequence() uint64
+}
+
+// An ObjectKey identifies a resource within its type.  Namespace is
+// empty for a cluster-scoped resource.
+type ObjectKey struct {
+	Namespace string
+	Name      string
+}
+
+// String returns the key as "namespace/name", or just "name".
+func (k ObjectKey) String() string {
+	if k.Namespace == "" {
+		return k.Name
+	}
+	return k.Namespace + "/" + k.Name
+}
+
+// A typeKey identifies a type of resource in the store: its Go type,
+// plus (since every *Unstructured or *PartialObjectMetadata has the
+// same Go type) the apiVersion and kind that it represents.
+type typeKey struct {
+	goType     reflect.Type
+	apiVersion string
+	kind       string
+}
+
+func typeKeyOf(resource k8s.Resource) typeKey {
+	key := typeKey{goType: reflect.TypeOf(resource)}
+	switch r := resource.(type) {
+	case *Unstructured:
+		key.apiVersion = r.APIVersion()
+		key.kind = r.Kind()
+	case *PartialObjectMetadata:
+		key.apiVersion = r.APIVersion
+		key.kind = r.Kind
+	}
+	return key
+}
+
+// An entry is a single stored resource.
+type entry struct {
+	namespace       string
+	name            string
+	resourceVersion string
+
+	// Exactly one of resource and encoded is set; encoded is only
+	// used by a lazy store.
+	resource k8s.Resource
+	encoded  []byte
+
+	created   time.Time     // the resource's creationTimestamp
+	refreshed time.Time     // when the resource was last seen
+	elem      *list.Element // in the typeStore's order
+
+	firstSeen time.Time // when the UID was first stored
+	updated   time.Time // when this version was stored
+}
+
+// A typeStore holds all of the stored resources of one type, keyed by
+// UID.
+type typeStore struct {
+	sample  k8s.Resource
+	entries *pnode
+	count   int
+
+	limits limits
+	order  *list.List // of UIDs, most recently stored first
+}
+
+func newTypeStore(sample k8s.Resource, l limits) *typeStore {
+	return &typeStore{
+		sample: newResourceLike(sample),
+		limits: l,
+		order:  list.New(),
+	}
+}
+
+func (t *typeStore) get(uid string) *entry {
+	return t.entries.get(hashUID(uid), uid)
+}
+
+// set stores the entry, returning the one that it replaced, if any.
+func (t *typeStore) set(uid string, e *entry) *entry {
+	var old *entry
+	t.entries, old = t.entries.with(hashUID(uid), 0, uid, e)
+	if old == nil {
+		t.count++
+	}
+	return old
+}
+
+// remove removes the entry, returning it, if there was one.
+func (t *typeStore) remove(uid string) *entry {
+	var old *entry
+	t.entries, old = t.entries.without(hashUID(uid), 0, uid)
+	if old != nil {
+		t.count--
+	}
+	return old
+}
+
+// resourceStore is the data structure behind the WatchingStore.  It is
+// only used by the WatchingStore's Run goroutine; everything else sees
+// the snapshots that it publishes.  Since a snapshot shares nothing
+// that the Run goroutine goes on to modify, neither needs any locking.
+type resourceStore struct {
+	types map[typeKey]*typeStore
+	lazy  *decodeCache // nil unless objects are stored encoded
+	trim  *trimmer     // nil unless objects are trimmed
+	clock Clock
+
+	evicted  []k8s.Resource // since takeEvicted was last called
+	current  atomic.Value   // of *snapshot, the last one published
+	sequence uint64         // of the last snapshot
+	idPrefix string         // of the snapshots' correlation IDs
+}
+
+func newResourceStore() *resourceStore {
+	return &resourceStore{types: map[typeKey]*typeStore{}, clock: SystemClock, idPrefix: newCorrelationPrefix()}
+}
+
+// addType makes sure that the store has a place for resources of the
+// same type as the sample, subject to the limits, returning whether it
+// had to be added, or resources had to be evicted to meet the limits.
+func (s *resourceStore) addType(sample k8s.Resource, l limits) bool {
+	key := typeKeyOf(sample)
+	if types, ok := s.types[key]; ok {
+		types.limits = types.limits.merge(l)
+		return s.evictExcess(types)
+	}
+	s.types[key] = newTypeStore(sample, l)
+	return true
+}
+
+// resourceVersion returns the resourceVersion of the stored resource
+// of the given type and UID.
+func (s *resourceStore) resourceVersion(key typeKey, uid string) (string, bool) {
+	e := s.types[key].get(uid)
+	if e == nil {
+		return "", false
+	}
+	return e.resourceVersion, true
+}
+
+// newerVersion returns whether the resourceVersion is newer than the
+// old one.  Kubernetes says that resourceVersions are opaque, but the
+// apiserver's are etcd revisions, so they are compared as numbers when
+// they both are, and otherwise any other version is taken to be newer.
+func newerVersion(old, resourceVersion string) bool {
+	o, oerr := strconv.ParseUint(old, 10, 64)
+	n, nerr := strconv.ParseUint(resourceVersion, 10, 64)
+	if oerr != nil || nerr != nil {
+		return resourceVersion != old
+	}
+	return n > o
+}
+
+// put stores the resource, replacing any existing resource of the
+// same type and UID.  The type must have been added with addType.
+func (s *resourceStore) put(resource k8s.Resource) {
+	if s.trim != nil {
+		s.trim.trim(resource)
+	}
+	metadata := resource.GetMetadata()
+	now := s.clock.Now()
+	e := &entry{
+		namespace:       metadata.GetNamespace(),
+		name:            metadata.GetName(),
+		resourceVersion: metadata.GetResourceVersion(),
+		created:         creationTime(resource),
+		refreshed:       now,
+		firstSeen:       now,
+		updated:         now,
+	}
+	if s.lazy != nil {
+		if data, err := encodeResource(resource); err == nil {
+			e.encoded = data
+		}
+	}
+	if e.encoded == nil {
+		e.resource = resource
+	}
+	types := s.types[typeKeyOf(resource)]
+	uid := metadata.GetUid()
+	old := types.set(uid, e)
+	if old != nil {
+		e.firstSeen = old.firstSeen
+	}
+	types.touch(uid, e, old)
+	s.evictExcess(types)
+}
+
+// delete removes the stored resource of the given type and UID,
+// returning whether there was one.
+func (s *resourceStore) delete(key typeKey, uid string) bool {
+	types, ok := s.types[key]
+	if !ok {
+		return false
+	}
+	e := types.remove(uid)
+	if e == nil {
+		return false
+	}
+	types.order.Remove(e.elem)
+	return true
+}
+
+// retain removes every stored resource of the types in keep whose UID
+// isn't in keep, returning the types that it removed any from.
+func (s *resourceStore) retain(keep map[typeKey]map[string]struct{}) []typeKey {
+	var changed []typeKey
+	for key, uids := range keep {
+		if s.retainIn(key, k8s.AllNamespaces, uids) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// retainIn removes every stored resource of the type, in the namespace
+// (or in all namespaces), whose UID isn't in keep, returning whether
+// there were any.
+func (s *resourceStore) retainIn(key typeKey, namespace string, keep map[string]struct{}) bool {
+	types, ok := s.types[key]
+	if !ok {
+		return false
+	}
+	var uids []string
+	types.entries.each(func(uid string, e *entry) {
+		if namespace != k8s.AllNamespaces && e.namespace != namespace {
+			return
+		}
+		if _, ok := keep[uid]; !ok {
+			uids = append(uids, uid)
+		}
+	})
+	for _, uid := range uids {
+		s.delete(key, uid)
+	}
+	return len(uids) > 0
+}
+
+// snapshot publishes, and returns, an immutable snapshot of the
+// store.  This is O(1) in the number of stored resources, since the
+// snapshot shares the tries that hold them.
+func (s *resourceStore) snapshot() *snapshot {
+	s.sequence++
+	snap := &snapshot{
+		sequence: s.sequence,
+		id:       s.idPrefix + "-" + strconv.FormatUint(s.sequence, 10),
+		types:    make(map[typeKey]*typeSnapshot, len(s.types)),
+		lazy:     s.lazy,
+	}
+	for key, types := range s.types {
+		snap.types[key] = &typeSnapshot{
+			sample:  types.sample,
+			entries: types.entries,
+			count:   types.count,
+		}
+	}
+	s.current.Store(snap)
+	return snap
+}
+
+// published returns the last snapshot published, or nil.
+func (s *resourceStore) published() *snapshot {
+	snap, _ := s.current.Load().(*snapshot)
+	return snap
+}
+
+// A snapshot is the state of the store at one point in time.  It is
+// the Store that is passed to the Callback, and remains valid (and
+// unchanging) for as long as the Callback cares to keep it.
+type snapshot struct {
+	sequence uint64
+	id       string // the correlation ID
+	types    map[typeKey]*typeSnapshot
+	lazy     *decodeCache
+}
+
+type typeSnapshot struct {
+	sample  k8s.Resource
+	entries *pnode
+	count   int
+}
+
+// Sequence implements Store.
+func (s *snapshot) Sequence() uint64 {
+	return s.sequence
+}
+
+// List implements Store.
+func (s *snapshot) List(resourceType k8s.Resource) []k8s.Resource {
+	types, ok := s.types[typeKeyOf(resourceType)]
+	if !ok {
+		return []k8s.Resource{}
+	}
+	ret := make([]k8s.Resource, 0, types.count)
+	types.entries.each(func(_ string, e *entry) {
+		if resource := e.decode(types.sample, s.lazy); resource != nil {
+			ret = append(ret, resource)
+		}
+	})
+	return ret
+}
+
+// ListSorted implements Store.
+func (s *snapshot) ListSorted(resourceType k8s.Resource) []k8s.Resource {
+	types, ok := s.types[typeKeyOf(resourceType)]
+	if !ok {
+		return []k8s.Resource{}
+	}
+	entries := types.sorted()
+	ret := make([]k8s.Resource, 0, len(entries))
+	for _, e := range entries {
+		if resource := e.decode(types.sample, s.lazy); resource != nil {
+			ret = append(ret, resource)
+		}
+	}
+	return ret
+}
+
+// All implements Store.
+func (s *snapshot) All(resourceType k8s.Resource) func(yield func(k8s.Resource) bool) {
+	return func(yield func(k8s.Resource) bool) {
+		types, ok := s.types[typeKeyOf(resourceType)]
+		if !ok {
+			return
+		}
+		types.entries.until(func(_ string, e *entry) bool {
+			resource := e.decode(types.sample, s.lazy)
+			return resource == nil || yield(resource)
+		})
+	}
+}
+
+// Keys implements Store.
+func (s *snapshot) Keys(resourceType k8s.Resource) []ObjectKey {
+	types, ok := s.types[typeKeyOf(resourceType)]
+	if !ok {
+		return []ObjectKey{}
+	}
+	entries := types.sorted()
+	ret := make([]ObjectKey, len(entries))
+	for i, e := range entries {
+		ret[i] = ObjectKey{Namespace: e.namespace, Name: e.name}
+	}
+	return ret
+}
+
+// Count implements Store.
+func (s *snapshot) Count(resourceType k8s.Resource) int {
+	types, ok := s.types[typeKeyOf(resourceType)]
+	if !ok {
+		return 0
+	}
+	return types.count
+}
+
+// sorted returns the entries, sorted by namespace and then name.
+func (t *typeSnapshot) sorted() []*entry {
+	entries := make([]*entry, 0, t.count)
+	t.entries.each(func(_ string, e *entry) {
+		entries = append(entries, e)
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].namespace != entries[j].namespace {
+			return entries[i].namespace < entries[j].namespace
+		}
+		return entries[i].name < entries[j].name
+	})
+	return entries
+}
+
+// decode returns the resource stored in the entry, or nil if it can't
+// be decoded (which can only happen if something changed the type's
+// encoding out from under us).  The lazy cache is only used if the
+// entry is encoded.
+func (e *entry) decode(sample k8s.Resource, lazy *decodeCache) k8s.Resource {
+	if e.resource != nil {
+		return e.resource
+	}
+	return lazy.get(e, func() (k8s.Resource, error) {
+		resource := newResourceLike(sample)
+		return resource, decodeResource(e.encoded, resource)
+	})
+}
+
+// StoreStats describes the contents of a WatchingStore.
+type StoreStats struct {
+	Types []TypeStats
+
+	// Objects and Bytes are the totals across all Types.
+	Objects int
+	Bytes   int
+}
+
+// TypeStats describes the stored resources of one type.
+type TypeStats struct {
+	// Type names the type, e.g. "apps/v1 Deployment".
+	Type string
+
+	// Sample is an empty resource of the type, to pass to
+	// Store.List.
+	Sample k8s.Resource
+
+	// Objects is the number of stored resources.
+	Objects int
+
+	// Bytes estimates the memory used by the stored resources, as
+	// their serialized size.  It is exact for a store with
+	// LazyDecode, and an underestimate otherwise.
+	Bytes int
+}
+
+func (s *snapshot) stats() StoreStats {
+	var ret StoreStats
+	for _, types := range s.types {
+		stats := TypeStats{
+			Type:    resourceTypeName(types.sample),
+			Sample:  types.sample,
+			Objects: types.count,
+		}
+		types.entries.each(func(_ string, e *entry) {
+			stats.Bytes += e.size()
+		})
+		ret.Types = append(ret.Types, stats)
+		ret.Objects += stats.Objects
+		ret.Bytes += stats.Bytes
+	}
+	sort.Slice(ret.Types, func(i, j int) bool {
+		return ret.Types[i].Type < ret.Types[j].Type
+	})
+	return ret
+}
+
+// size returns the serialized size of the entry's resource.
+func (e *entry) size() int {
+	if e.encoded != nil {
+		return len(e.encoded)
+	}
+	if pb, ok := e.resource.(protoSizer); ok {
+		return pb.Size()
+	}
+	data, _ := json.Marshal(e.resource)
+	return len(data)
+}
+
+// resourceTypeName describes the type of the resource, for humans.
+func resourceTypeName(resource k8s.Resource) string {
+	switch r := resource.(type) {
+	case *Unstructured:
+		return r.APIVersion() + " " + r.Kind()
+	case *PartialObjectMetadata:
+		return r.APIVersion + " " + r.Kind + " metadata"
+	}
+	if gvk, err := GVKOf(resource); err == nil {
+		return gvk.String()
+	}
+	return strings.TrimPrefix(reflect.TypeOf(resource).String(), "*")
+}
+
+// protoSizer is implemented by the protobuf-generated types in
+// github.com/ericchiang/k8s/apis.
+type protoSizer interface {
+	Size() int
+}
+
+// protoCodec is implemented by the protobuf-generated types in
+// github.com/ericchiang/k8s/apis.
+type protoCodec interface {
+	Marshal() ([]byte, error)
+	Unmarshal([]byte) error
+}
+
+// encodeResource serializes the resource: as protobuf if it is a
+// protobuf message, and as JSON otherwise.
+func encodeResource(resource k8s.Resource) ([]byte, error) {
+	if pb, ok := resource.(protoCodec); ok {
+		return pb.Marshal()
+	}
+	return json.Marshal(resource)
+}
+
+// decodeResource is the inverse of encodeResource.
+func decodeResource(data []byte, resource k8s.Resource) error {
+	if pb, ok := resource.(protoCodec); ok {
+		return pb.Unmarshal(data)
+	}
+	return json.Unmarshal(data, resource)
+}
+
+// DefaultDecodeCacheSize is the number of decoded objects that a
+// WatchingStore with LazyDecode keeps, if DecodeCacheSize is zero.
+const DefaultDecodeCacheSize = 1000
+
+// decodeCache is a least-recently-used cache of decoded entries.  It
+// is safe to use from multiple goroutines, since the Store may be
+// queried from outside of the Callback.
+type decodeCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List // of *decodedEntry, most recently used first
+	entries map[*entry]*list.Element
+}
+
+type decodedEntry struct {
+	entry    *entry
+	resource k8s.Resource
+}
+
+func newDecodeCache(size int) *decodeCache {
+	if size <= 0 {
+		size = DefaultDecodeCacheSize
+	}
+	return &decodeCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[*entry]*list.Element{},
+	}
+}
+
+// get returns the decoded form of the entry, using decode to decode it
+// if it isn't cached.
+func (c *decodeCache) get(e *entry, decode func() (k8s.Resource, error)) k8s.Resource {
+	c.mu.Lock()
+	if elem, ok := c.entries[e]; ok {
+		c.order.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*decodedEntry).resource
+	}
+	c.mu.Unlock()
+
+	resource, err := decode()
+	if err != nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[e]; !ok {
+		c.entries[e] = c.order.PushFront(&decodedEntry{e, resource})
+		for c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*decodedEntry).entry)
+		}
+	}
+	return resource
+}
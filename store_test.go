@@ -0,0 +1,25 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import "testing"
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		old, resourceVersion string
+		want                 bool
+	}{
+		{"9", "10", true},
+		{"10", "9", false},
+		{"10", "10", false},
+		// Not etcd revisions: anything else is newer.
+		{"abc", "abd", true},
+		{"abd", "abc", true},
+		{"abc", "abc", false},
+		{"10", "x", true},
+	} {
+		if got := newerVersion(tc.old, tc.resourceVersion); got != tc.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tc.old, tc.resourceVersion, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// A ServiceAccountToken is a token of a service account, from the
+// TokenRequest API.
+type ServiceAccountToken struct {
+	Token      string
+	Expiration time.Time
+}
+
+// RequestToken requests a token of a service account, bound to the
+// audiences (or the apiserver's own, if there are none), with the
+// TokenRequest API.  The ttl, if non-zero, is the lifetime to ask for;
+// the apiserver doesn't issue tokens for less than 10 minutes, and may
+// issue them for a different lifetime than asked for, so check the
+// Expiration.
+func RequestToken(ctx context.Context, client *k8s.Client, namespace, serviceAccount string, audiences []string, ttl time.Duration) (ServiceAccountToken, error) {
+	spec := map[string]interface{}{}
+	if len(audiences) > 0 {
+		spec["audiences"] = audiences
+	}
+	if ttl > 0 {
+		spec["expirationSeconds"] = int64(ttl / time.Second)
+	}
+	tokenRequest := map[string]interface{}{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenRequest",
+		"spec":       spec,
+	}
+	var resp struct {
+		Status struct {
+			Token               string    `json:"token"`
+			ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+		} `json:"status"`
+	}
+	err := doJSON(ctx, client, request{
+		verb: http.MethodPost,
+		path: "/api/v1/namespaces/" + url.PathEscape(namespace) + "/serviceaccounts/" + url.PathEscape(serviceAccount) + "/token",
+	}, tokenRequest, &resp)
+	if err != nil {
+		return ServiceAccountToken{}, errors.Wrapf(err, "request token of service account %s/%s", namespace, serviceAccount)
+	}
+	return ServiceAccountToken{Token: resp.Status.Token, Expiration: resp.Status.ExpirationTimestamp}, nil
+}
+
+// A TokenSource supplies tokens of a service account, requesting a new
+// one with RequestToken once 80% of the lifetime of the last one has
+// passed, as the kubelet does for the tokens that it projects in to
+// pods.  It is safe to use from multiple goroutines.
+type TokenSource struct {
+	Client         *k8s.Client // must not be nil
+	Namespace      string
+	ServiceAccount string
+	Audiences      []string
+	TTL            time.Duration // as for RequestToken
+
+	// Clock, if set, is used instead of the system clock to decide
+	// when to refresh the token.
+	Clock Clock
+
+	mu        sync.Mutex
+	token     ServiceAccountToken
+	refreshAt time.Time
+}
+
+// Token returns the current token, refreshing it if it is due.  If a
+// refresh fails, Token returns the current token while it is still
+// valid, and the error only after that.
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := orSystemClock(s.Clock).Now()
+	if s.token.Token != "" && now.Before(s.refreshAt) {
+		return s.token.Token, nil
+	}
+	token, err := RequestToken(ctx, s.Client, s.Namespace, s.ServiceAccount, s.Audiences, s.TTL)
+	if err != nil {
+		if s.token.Token != "" && now.Before(s.token.Expiration) {
+			return s.token.Token, nil
+		}
+		return "", err
+	}
+	s.token = token
+	s.refreshAt = now.Add(token.Expiration.Sub(now) * 8 / 10)
+	return token.Token, nil
+}
+
+// Middleware returns a Middleware that authenticates each request with
+// a token from the TokenSource, as a bearer token, for calling services
+// that authenticate service accounts by their tokens (with a
+// TokenReview).  Use it with WrapClient, or on the http.RoundTripper of
+// any http.Client.
+func (s *TokenSource) Middleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			token, err := s.Token(req.Context())
+			if err != nil {
+				return nil, err
+			}
+			req = cloneRequest(req)
+			req.Header.Set("Authorization", "Bearer "+token)
+			return next.RoundTrip(req)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+	"github.com/datawire/k8sutil/k8sutiltest"
+)
+
+// A fakeTokens issues tokens of the service account default/app, for
+// an hour from the clock's now, and fails while failing is set.
+type fakeTokens struct {
+	clock *k8sutiltest.FakeClock
+
+	mu       sync.Mutex
+	issued   int
+	failing  bool
+	requests []map[string]interface{}
+}
+
+func (f *fakeTokens) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/api/v1/namespaces/default/serviceaccounts/app/token" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.failing {
+		writeJSON(w, http.StatusServiceUnavailable, &metav1.Status{Status: k8s.String("Failure"), Code: k8s.Int32(http.StatusServiceUnavailable)})
+		return
+	}
+	var request map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&request)
+	f.requests = append(f.requests, request)
+	f.issued++
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status": map[string]interface{}{
+			"token":               fmt.Sprintf("token%d", f.issued),
+			"expirationTimestamp": f.clock.Now().Add(time.Hour).Format(time.RFC3339),
+		},
+	})
+}
+
+func (f *fakeTokens) setFailing(failing bool) {
+	f.mu.Lock()
+	f.failing = failing
+	f.mu.Unlock()
+}
+
+func TestRequestToken(t *testing.T) {
+	f := &fakeTokens{clock: k8sutiltest.NewFakeClock(epoch)}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	client := &k8s.Client{Endpoint: server.URL, Client: server.Client()}
+	token, err := k8sutil.RequestToken(context.Background(), client, "default", "app", []string{"vault"}, 20*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (k8sutil.ServiceAccountToken{Token: "token1", Expiration: epoch.Add(time.Hour)}); !token.Expiration.Equal(want.Expiration) || token.Token != want.Token {
+		t.Errorf("got %+v, want %+v", token, want)
+	}
+	want := map[string]interface{}{
+		"apiVersion": "authentication.k8s.io/v1",
+		"kind":       "TokenRequest",
+		"spec":       map[string]interface{}{"audiences": []interface{}{"vault"}, "expirationSeconds": 1200.0},
+	}
+	if !reflect.DeepEqual(f.requests[0], want) {
+		t.Errorf("sent %v, want %v", f.requests[0], want)
+	}
+	if _, err := k8sutil.RequestToken(context.Background(), client, "default", "other", nil, 0); err == nil {
+		t.Error("got a token of a missing service account")
+	}
+}
+
+// TestTokenSource checks that a TokenSource refreshes its token once
+// 80% of its lifetime has passed, and keeps using it while it is valid
+// if a refresh fails.
+func TestTokenSource(t *testing.T) {
+	clock := k8sutiltest.NewFakeClock(epoch)
+	f := &fakeTokens{clock: clock}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	source := &k8sutil.TokenSource{
+		Client:         &k8s.Client{Endpoint: server.URL, Client: server.Client()},
+		Namespace:      "default",
+		ServiceAccount: "app",
+		Clock:          clock,
+	}
+	expect := func(want string) {
+		t.Helper()
+		token, err := source.Token(context.Background())
+		if err != nil || token != want {
+			t.Errorf("got %q, %v, want %q", token, err, want)
+		}
+	}
+	expect("token1")
+	clock.Advance(47 * time.Minute)
+	expect("token1")
+	clock.Advance(time.Minute)
+	expect("token2")
+
+	f.setFailing(true)
+	clock.Advance(50 * time.Minute)
+	expect("token2")
+	clock.Advance(10 * time.Minute)
+	if token, err := source.Token(context.Background()); err == nil {
+		t.Errorf("got expired %q", token)
+	}
+	f.setFailing(false)
+
+	// The Middleware authenticates requests with the token.
+	var authorization string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer target.Close()
+	httpClient := &http.Client{Transport: source.Middleware()(http.DefaultTransport)}
+	resp, err := httpClient.Get(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if authorization != "Bearer token3" {
+		t.Errorf("got Authorization %q", authorization)
+	}
+}
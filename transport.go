@@ -0,0 +1,207 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// A Middleware wraps the http.RoundTripper that a k8s.Client uses, in
+// order to observe or modify the requests that it makes (request
+// logging, auth injection, latency metrics, and the like).
+type Middleware func(http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is an adapter to allow the use of ordinary
+// functions as an http.RoundTripper; it is handy for writing a
+// Middleware.
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls f(req).
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// WrapClient returns a copy of the client that sends its requests
+// through the given middleware.  The first Middleware is the outermost;
+// it sees each request first and each response last.  The original
+// client is not modified.
+func WrapClient(client *k8s.Client, middleware ...Middleware) *k8s.Client {
+	if len(middleware) == 0 {
+		return client
+	}
+	httpClient := new(http.Client)
+	if client.Client != nil {
+		*httpClient = *client.Client
+	}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		transport = middleware[i](transport)
+	}
+	httpClient.Transport = transport
+
+	ret := *client
+	ret.Client = httpClient
+	return &ret
+}
+
+// userAgent returns a Middleware that sets the User-Agent header of
+// every request.
+func userAgent(ua string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = cloneRequest(req)
+			req.Header.Set("User-Agent", ua)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// cloneRequest returns a shallow copy of req with a deep copy of its
+// headers; an http.RoundTripper must not modify the request it was
+// given.
+func cloneRequest(req *http.Request) *http.Request {
+	ret := new(http.Request)
+	*ret = *req
+	ret.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		ret.Header[k] = append([]string(nil), v...)
+	}
+	return ret
+}
+
+// A Dialer opens network connections; *net.Dialer is a Dialer, as are
+// the dialers of most SSH and proxy libraries.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// WithDialer returns a copy of the client that opens its connections
+// with the given Dialer, for clusters that are only reachable through
+// a bastion or tunnel.  The original client is not modified.
+//
+// The client's transport must be an *http.Transport (as it is for
+// clients created by the k8s package), so WithDialer must be applied
+// before WrapClient.
+func WithDialer(client *k8s.Client, dialer Dialer) (*k8s.Client, error) {
+	return configureTransport(client, func(transport *http.Transport, _ *http2.Transport) {
+		transport.DialContext = dialer.DialContext
+	})
+}
+
+// WithProxy returns a copy of the client that makes its connections
+// through the proxy at proxyURL, overriding any HTTP_PROXY or
+// HTTPS_PROXY environment variables.  The scheme determines the type of
+// proxy: "http" or "https" for an HTTP CONNECT proxy, or "socks5" for a
+// SOCKS5 proxy.  The original client is not modified.
+//
+// The client's transport must be an *http.Transport (as it is for
+// clients created by the k8s package), so WithProxy must be applied
+// before WrapClient.
+func WithProxy(client *k8s.Client, proxyURL *url.URL) (*k8s.Client, error) {
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	return configureTransport(client, func(transport *http.Transport, _ *http2.Transport) {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	})
+}
+
+// Keepalive configures how quickly a connection that has silently died
+// (for example, because a NAT or load balancer between us and the
+// apiserver dropped it) is detected.  Without it, a watch on such a
+// connection hangs until the operating system gives up on it, which
+// can take many minutes.
+type Keepalive struct {
+	// PingInterval, if non-zero, causes an HTTP/2 connection to
+	// be sent a ping whenever no frames have been received on it
+	// for that long.
+	PingInterval time.Duration
+
+	// PingTimeout is how long to wait for a reply to a ping before
+	// closing the connection.  If zero, it defaults to 15 seconds.
+	PingTimeout time.Duration
+
+	// TCPKeepAlive, if non-zero, is the interval between TCP
+	// keep-alive probes on new connections.  This also applies to
+	// HTTP/1.1 connections, which don't support pings.
+	TCPKeepAlive time.Duration
+}
+
+// WithKeepalive returns a copy of the client that detects dead
+// connections as configured by keepalive.  The original client is not
+// modified.
+//
+// The client's transport must be an *http.Transport (as it is for
+// clients created by the k8s package), so WithKeepalive must be applied
+// before WrapClient.
+func WithKeepalive(client *k8s.Client, keepalive Keepalive) (*k8s.Client, error) {
+	return configureTransport(client, func(transport *http.Transport, h2 *http2.Transport) {
+		if keepalive.TCPKeepAlive != 0 {
+			dial := transport.DialContext
+			if dial == nil {
+				dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+			}
+			transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := dial(ctx, network, address)
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					_ = tcpConn.SetKeepAlive(true)
+					_ = tcpConn.SetKeepAlivePeriod(keepalive.TCPKeepAlive)
+				}
+				return conn, err
+			}
+		}
+		if h2 != nil {
+			h2.ReadIdleTimeout = keepalive.PingInterval
+			h2.PingTimeout = keepalive.PingTimeout
+		}
+	})
+}
+
+// configureTransport returns a copy of the client with a copy of its
+// *http.Transport that has been modified by fn.  If the transport
+// speaks HTTP/2, fn is also passed the HTTP/2 transport; otherwise it
+// is passed nil.
+func configureTransport(client *k8s.Client, fn func(*http.Transport, *http2.Transport)) (*k8s.Client, error) {
+	httpClient := new(http.Client)
+	if client.Client != nil {
+		*httpClient = *client.Client
+	}
+	var transport *http.Transport
+	switch rt := httpClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = rt.Clone()
+	default:
+		return nil, errors.Errorf("client transport is a %T, not an *http.Transport", rt)
+	}
+	var h2 *http2.Transport
+	if _, ok := transport.TLSNextProto["h2"]; ok || (transport.TLSNextProto == nil && transport.ForceAttemptHTTP2) {
+		// A cloned "h2" hook still belongs to the original
+		// transport's HTTP/2 connection pool; give the copy
+		// its own.
+		var err error
+		if h2, err = http2.ConfigureTransports(transport); err != nil {
+			return nil, errors.Wrap(err, "configure HTTP/2")
+		}
+	}
+	fn(transport, h2)
+	httpClient.Transport = transport
+
+	ret := *client
+	ret.Client = httpClient
+	return &ret, nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// tagger returns a Middleware that records its name in the order in
+// which the middleware sees each request and response.
+func tagger(name string, mu *sync.Mutex, order *[]string) k8sutil.Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return k8sutil.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			mu.Lock()
+			*order = append(*order, name+" request")
+			mu.Unlock()
+			resp, err := next.RoundTrip(req)
+			mu.Lock()
+			*order = append(*order, name+" response")
+			mu.Unlock()
+			return resp, err
+		})
+	}
+}
+
+func TestWrapClient(t *testing.T) {
+	server := newFakeAPIServer(t)
+	client := server.client()
+	transport := client.Client.Transport
+	var mu sync.Mutex
+	var order []string
+	wrapped := k8sutil.WrapClient(client, tagger("outer", &mu, &order), tagger("inner", &mu, &order))
+	if client.Client.Transport != transport {
+		t.Errorf("WrapClient modified the original client")
+	}
+	if err := wrapped.List(context.Background(), "default", &corev1.ConfigMapList{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"outer request", "inner request", "inner response", "outer response"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got %q, want %q", order, want)
+	}
+}
+
+// TestMiddleware checks that Run makes its requests through the
+// WatchingStore's Middleware.
+func TestMiddleware(t *testing.T) {
+	server := newFakeAPIServer(t)
+	var mu sync.Mutex
+	var order []string
+	w := &k8sutil.WatchingStore{
+		Client:     server.client(),
+		Logger:     testLogger{t},
+		Callback:   func(k8sutil.Store) {},
+		Middleware: []k8sutil.Middleware{tagger("middleware", &mu, &order)},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	server.await("list")
+	server.await("watch")
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) < 2 || order[0] != "middleware request" || order[1] != "middleware response" {
+		t.Errorf("the Middleware saw %q", order)
+	}
+}
+
+// countingDialer is a Dialer that counts the connections it opens.
+type countingDialer struct {
+	net.Dialer
+	dials int32
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+// TestDialer checks that Run opens its connections with the
+// WatchingStore's Dialer.
+func TestDialer(t *testing.T) {
+	server := newFakeAPIServer(t)
+	dialer := &countingDialer{}
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) {},
+		Dialer:   dialer,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	server.await("watch")
+	if atomic.LoadInt32(&dialer.dials) == 0 {
+		t.Errorf("the Dialer was not used")
+	}
+}
+
+// TestProxy checks that Run makes its requests through the
+// WatchingStore's Proxy.
+func TestProxy(t *testing.T) {
+	server := newFakeAPIServer(t)
+	var proxied int32
+	forward := &httputil.ReverseProxy{
+		Director:      func(*http.Request) {},
+		FlushInterval: -1,
+		ErrorLog:      log.New(io.Discard, "", 0),
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		forward.ServeHTTP(rw, req)
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(k8sutil.Store) {},
+		Proxy:    proxyURL,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	server.await("watch")
+	if atomic.LoadInt32(&proxied) == 0 {
+		t.Errorf("no requests went through the Proxy")
+	}
+}
+
+func TestWithProxyScheme(t *testing.T) {
+	client := newFakeAPIServer(t).client()
+	if _, err := k8sutil.WithProxy(client, &url.URL{Scheme: "ftp", Host: "proxy:21"}); err == nil {
+		t.Errorf("WithProxy accepted an ftp proxy")
+	}
+	if _, err := k8sutil.WithProxy(client, &url.URL{Scheme: "socks5", Host: "proxy:1080"}); err != nil {
+		t.Errorf("WithProxy: %v", err)
+	}
+}
+
+// TestWithKeepalive checks that a client with keep-alives still speaks
+// HTTP/2, and still dials with the client's own dialer.
+func TestWithKeepalive(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	dialer := &countingDialer{}
+	client, err := k8sutil.WithDialer(&k8s.Client{Endpoint: server.URL, Client: server.Client()}, dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = k8sutil.WithKeepalive(client, k8sutil.Keepalive{
+		PingInterval: time.Second,
+		TCPKeepAlive: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("got %s, want HTTP/2", resp.Proto)
+	}
+	if atomic.LoadInt32(&dialer.dials) == 0 {
+		t.Errorf("the Dialer was not used")
+	}
+}
+
+// TestWarningHandler checks that the WarningHandler is called once for
+// each distinct warning, however many responses carry it.
+func TestWarningHandler(t *testing.T) {
+	server := newFakeAPIServer(t)
+	warn := func(next http.RoundTripper) http.RoundTripper {
+		return k8sutil.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if resp != nil {
+				resp.Header.Add("Warning", `299 - "v1 ConfigMap is deprecated"`)
+			}
+			return resp, err
+		})
+	}
+	var mu sync.Mutex
+	var warnings []string
+	w := &k8sutil.WatchingStore{
+		Client:     server.client(),
+		Logger:     testLogger{t},
+		Callback:   func(k8sutil.Store) {},
+		Middleware: []k8sutil.Middleware{warn},
+		WarningHandler: func(text string) {
+			mu.Lock()
+			defer mu.Unlock()
+			warnings = append(warnings, text)
+		},
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	server.await("list")
+	server.await("watch")
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"v1 ConfigMap is deprecated"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("got %q, want %q", warnings, want)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"strings"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+// LastAppliedConfigAnnotation is the annotation that "kubectl apply"
+// uses to record the configuration that it last applied.  It holds a
+// full copy of the object, so it is often most of an object's size.
+const LastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// DefaultTrimAnnotations are the annotations that are stripped if a
+// Trim's Annotations are nil: those that are large, and that controllers
+// rarely need.  Append to it to strip more.
+var DefaultTrimAnnotations = []string{LastAppliedConfigAnnotation}
+
+// Trim describes what a WatchingStore may strip out of the resources
+// that it keeps, to shrink its memory footprint.  Resources are trimmed
+// when they are stored, so a trimmed-out field is simply missing when
+// the resource is listed.
+type Trim struct {
+	// ManagedFields drops metadata.managedFields.  The k8s package
+	// predates managedFields, so for its types this drops all of
+	// the metadata fields that it doesn't recognize.
+	ManagedFields bool
+
+	// MaxAnnotationSize, if non-zero, drops any annotation whose
+	// value is longer than that many bytes.
+	MaxAnnotationSize int
+
+	// Annotations are the keys of annotations to drop.  A key that
+	// ends in "/" drops every annotation with that prefix, e.g.
+	// "kubectl.kubernetes.io/".  If nil, DefaultTrimAnnotations
+	// are dropped; set it to an empty slice to keep them all.
+	Annotations []string
+
+	// InternStrings makes stored resources share a single copy of
+	// strings that repeat across resources: namespaces, label and
+	// annotation keys, label values, and owner references.  Only
+	// the maxInterned strings most recently seen are kept for
+	// sharing, so that label values that are unique to resources
+	// that have since gone don't accumulate.
+	InternStrings bool
+}
+
+// maxInterned is how many strings a trimmer's intern table holds before
+// it starts forgetting those that it hasn't seen since.
+const maxInterned = 1 << 15
+
+// trimmer applies a Trim, holding the table of interned strings.
+type trimmer struct {
+	Trim
+
+	// The interned strings are kept in two generations: strings
+	// are added to the current one, and those found in the
+	// previous one are moved to the current one; when the current
+	// one is full, it becomes the previous one, and what was left
+	// in the previous one is forgotten.
+	strings    map[string]string
+	oldStrings map[string]string
+
+	annotations map[string]bool // the Annotations that aren't prefixes
+	prefixes    []string        // those that are
+}
+
+func newTrimmer(trim Trim) *trimmer {
+	if trim.Annotations == nil {
+		trim.Annotations = DefaultTrimAnnotations
+	}
+	t := &trimmer{Trim: trim, strings: map[string]string{}, annotations: map[string]bool{}}
+	for _, key := range trim.Annotations {
+		if strings.HasSuffix(key, "/") {
+			t.prefixes = append(t.prefixes, key)
+		} else {
+			t.annotations[key] = true
+		}
+	}
+	return t
+}
+
+func (t *trimmer) intern(str string) string {
+	if interned, ok := t.strings[str]; ok {
+		return interned
+	}
+	interned, ok := t.oldStrings[str]
+	if !ok {
+		interned = str
+	}
+	if len(t.strings) >= maxInterned {
+		t.oldStrings, t.strings = t.strings, make(map[string]string, maxInterned)
+	}
+	t.strings[str] = interned
+	return interned
+}
+
+func (t *trimmer) internPtr(str *string) {
+	if str != nil {
+		*str = t.intern(*str)
+	}
+}
+
+// dropAnnotation returns whether the annotation should be trimmed.
+func (t *trimmer) dropAnnotation(key, value string) bool {
+	if t.annotations[key] {
+		return true
+	}
+	for _, prefix := range t.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return t.MaxAnnotationSize > 0 && len(value) > t.MaxAnnotationSize
+}
+
+// trim trims the resource in place.
+func (t *trimmer) trim(resource k8s.Resource) {
+	metadata := resource.GetMetadata()
+	if metadata == nil {
+		return
+	}
+	for key, value := range metadata.Annotations {
+		if t.dropAnnotation(key, value) {
+			delete(metadata.Annotations, key)
+		}
+	}
+	if t.ManagedFields {
+		metadata.XXX_unrecognized = nil
+	}
+	if t.InternStrings {
+		t.internMetadata(metadata)
+	}
+	if u, ok := resource.(*Unstructured); ok {
+		t.trimUnstructured(u)
+	}
+}
+
+func (t *trimmer) internMetadata(metadata *metav1.ObjectMeta) {
+	t.internPtr(metadata.Namespace)
+	if len(metadata.Labels) > 0 {
+		labels := make(map[string]string, len(metadata.Labels))
+		for key, value := range metadata.Labels {
+			labels[t.intern(key)] = t.intern(value)
+		}
+		metadata.Labels = labels
+	}
+	if len(metadata.Annotations) > 0 {
+		annotations := make(map[string]string, len(metadata.Annotations))
+		for key, value := range metadata.Annotations {
+			annotations[t.intern(key)] = value
+		}
+		metadata.Annotations = annotations
+	}
+	for _, ref := range metadata.OwnerReferences {
+		t.internPtr(ref.ApiVersion)
+		t.internPtr(ref.Kind)
+	}
+}
+
+// trimUnstructured trims an Unstructured's "metadata", which is kept
+// separately from its decoded ObjectMeta.
+func (t *trimmer) trimUnstructured(u *Unstructured) {
+	metadata, ok := u.Object["metadata"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if t.ManagedFields {
+		delete(metadata, "managedFields")
+	}
+	if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+		for key, value := range annotations {
+			str, _ := value.(string)
+			if t.dropAnnotation(key, str) {
+				delete(annotations, key)
+			}
+		}
+	}
+	if t.InternStrings {
+		if namespace, ok := metadata["namespace"].(string); ok {
+			metadata["namespace"] = t.intern(namespace)
+		}
+		if labels, ok := metadata["labels"].(map[string]interface{}); ok {
+			interned := make(map[string]interface{}, len(labels))
+			for key, value := range labels {
+				if str, ok := value.(string); ok {
+					value = t.intern(str)
+				}
+				interned[t.intern(key)] = value
+			}
+			metadata["labels"] = interned
+		}
+	}
+}
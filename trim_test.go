@@ -0,0 +1,137 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+// sameString returns whether a and b share their bytes.
+func sameString(a, b string) bool {
+	return (*reflect.StringHeader)(unsafe.Pointer(&a)).Data == (*reflect.StringHeader)(unsafe.Pointer(&b)).Data
+}
+
+// copyString returns a copy of str that doesn't share its bytes.
+func copyString(str string) string {
+	return string(append([]byte(nil), str...))
+}
+
+func TestTrim(t *testing.T) {
+	cm := &corev1.ConfigMap{Metadata: &metav1.ObjectMeta{
+		Name: k8s.String("a"),
+		Annotations: map[string]string{
+			LastAppliedConfigAnnotation: "{}",
+			"big":                       strings.Repeat("x", 100),
+			"small":                     "x",
+		},
+		XXX_unrecognized: []byte{1, 2, 3},
+	}}
+	newTrimmer(Trim{ManagedFields: true, MaxAnnotationSize: 10}).trim(cm)
+	if want := map[string]string{"small": "x"}; !reflect.DeepEqual(cm.Metadata.Annotations, want) {
+		t.Errorf("got annotations %v, want %v", cm.Metadata.Annotations, want)
+	}
+	if cm.Metadata.XXX_unrecognized != nil {
+		t.Errorf("kept unrecognized fields")
+	}
+}
+
+func TestTrimUnstructured(t *testing.T) {
+	u := &Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":          "a",
+			"managedFields": []interface{}{},
+			"annotations":   map[string]interface{}{LastAppliedConfigAnnotation: "{}", "small": "x"},
+		},
+	}}
+	newTrimmer(Trim{ManagedFields: true}).trim(u)
+	metadata := u.Object["metadata"].(map[string]interface{})
+	if _, ok := metadata["managedFields"]; ok {
+		t.Errorf("kept managedFields")
+	}
+	if want := map[string]interface{}{"small": "x"}; !reflect.DeepEqual(metadata["annotations"], want) {
+		t.Errorf("got annotations %v, want %v", metadata["annotations"], want)
+	}
+}
+
+func TestTrimAnnotations(t *testing.T) {
+	annotations := func() map[string]string {
+		return map[string]string{
+			LastAppliedConfigAnnotation:             "{}",
+			"kubectl.kubernetes.io/restartedAt":     "now",
+			"deployment.kubernetes.io/revision":     "3",
+			"getambassador.io/config":               "---",
+			"getambassador.io/config-with-a-suffix": "---",
+		}
+	}
+	for _, tc := range []struct {
+		annotations []string
+		want        []string
+	}{
+		{nil, []string{"deployment.kubernetes.io/revision", "getambassador.io/config", "getambassador.io/config-with-a-suffix", "kubectl.kubernetes.io/restartedAt"}},
+		{[]string{}, []string{"deployment.kubernetes.io/revision", "getambassador.io/config", "getambassador.io/config-with-a-suffix", LastAppliedConfigAnnotation, "kubectl.kubernetes.io/restartedAt"}},
+		{[]string{"kubectl.kubernetes.io/", "getambassador.io/config"}, []string{"deployment.kubernetes.io/revision", "getambassador.io/config-with-a-suffix"}},
+	} {
+		cm := &corev1.ConfigMap{Metadata: &metav1.ObjectMeta{Name: k8s.String("a"), Annotations: annotations()}}
+		newTrimmer(Trim{Annotations: tc.annotations}).trim(cm)
+		var got []string
+		for key := range cm.Metadata.Annotations {
+			got = append(got, key)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Annotations %q: kept %q, want %q", tc.annotations, got, tc.want)
+		}
+	}
+}
+
+func TestInternStrings(t *testing.T) {
+	trimmer := newTrimmer(Trim{InternStrings: true})
+	var resources []*corev1.ConfigMap
+	for i := 0; i < 2; i++ {
+		cm := &corev1.ConfigMap{Metadata: &metav1.ObjectMeta{
+			Namespace: k8s.String(copyString("default")),
+			Labels:    map[string]string{copyString("app"): copyString("web")},
+		}}
+		trimmer.trim(cm)
+		resources = append(resources, cm)
+	}
+	a, b := resources[0].Metadata, resources[1].Metadata
+	if !sameString(*a.Namespace, *b.Namespace) {
+		t.Errorf("namespaces not shared")
+	}
+	if !sameString(a.Labels["app"], b.Labels["app"]) {
+		t.Errorf("label values not shared")
+	}
+}
+
+// TestInternForgets checks that the intern table keeps the strings that
+// are still being seen, but forgets the others once enough new strings
+// have been seen.
+func TestInternForgets(t *testing.T) {
+	trimmer := newTrimmer(Trim{InternStrings: true})
+	kept := trimmer.intern(copyString("kept"))
+	forgotten := trimmer.intern(copyString("forgotten"))
+	for generation := 0; generation < 2; generation++ {
+		for i := 0; i < maxInterned; i++ {
+			trimmer.intern(strconv.Itoa(generation*maxInterned + i))
+		}
+		if !sameString(trimmer.intern(copyString("kept")), kept) {
+			t.Errorf("generation %d: forgot a string still in use", generation)
+		}
+	}
+	if sameString(trimmer.intern(copyString("forgotten")), forgotten) {
+		t.Errorf("kept a string not seen for two generations")
+	}
+	if n := len(trimmer.strings) + len(trimmer.oldStrings); n > 2*maxInterned {
+		t.Errorf("holding %d strings", n)
+	}
+}
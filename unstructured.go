@@ -0,0 +1,162 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/pkg/errors"
+)
+
+// Unstructured is a resource of any type, represented as its generic
+// JSON object.  It is what k8sutil uses for types that it has no Go
+// type for, such as the types watched by AddWatchEverything.
+//
+// Because every Unstructured has the same Go type, the Store tells
+// them apart by apiVersion and kind; use NewUnstructured to create a
+// sample to pass to Store.List:
+//
+//	store.List(k8sutil.NewUnstructured("apps/v1", "Deployment"))
+type Unstructured struct {
+	Object map[string]interface{}
+
+	metadata *metav1.ObjectMeta
+}
+
+// NewUnstructured returns an empty resource of the given apiVersion and
+// kind.
+func NewUnstructured(apiVersion, kind string) *Unstructured {
+	return &Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       kind,
+		},
+	}
+}
+
+// APIVersion returns the object's apiVersion, e.g. "apps/v1".
+func (u *Unstructured) APIVersion() string {
+	str, _ := u.Object["apiVersion"].(string)
+	return str
+}
+
+// Kind returns the object's kind, e.g. "Deployment".
+func (u *Unstructured) Kind() string {
+	str, _ := u.Object["kind"].(string)
+	return str
+}
+
+// GetMetadata implements k8s.Resource.  The ObjectMeta is decoded from
+// the object's "metadata" when the Unstructured is unmarshaled; it is
+// not valid to mutate it.
+func (u *Unstructured) GetMetadata() *metav1.ObjectMeta {
+	if u.metadata == nil {
+		return new(metav1.ObjectMeta)
+	}
+	return u.metadata
+}
+
+// MarshalJSON implements json.Marshaler.
+func (u *Unstructured) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.Object)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (u *Unstructured) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Metadata *metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	u.Object = object
+	u.metadata = raw.Metadata
+	return nil
+}
+
+// UnstructuredList is a list of resources of any type.  Resource
+// identifies the type; it is what a Backend uses to decide where to
+// list and watch those resources.
+type UnstructuredList struct {
+	Resource APIResource `json:"-"`
+
+	Metadata *metav1.ListMeta `json:"metadata"`
+	Items    []*Unstructured  `json:"items"`
+}
+
+// GetMetadata implements k8s.ResourceList.
+func (l *UnstructuredList) GetMetadata() *metav1.ListMeta {
+	if l.Metadata == nil {
+		return new(metav1.ListMeta)
+	}
+	return l.Metadata
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  Since the items in a list
+// don't have their own apiVersion and kind, they are filled in from
+// Resource.
+func (l *UnstructuredList) UnmarshalJSON(data []byte) error {
+	type list UnstructuredList // without the UnmarshalJSON method
+	raw := list{Resource: l.Resource}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for _, item := range raw.Items {
+		if item.Object == nil {
+			item.Object = map[string]interface{}{}
+		}
+		item.Object["apiVersion"] = raw.Resource.GroupVersion()
+		item.Object["kind"] = raw.Resource.Kind
+	}
+	*l = UnstructuredList(raw)
+	return nil
+}
+
+func newUnstructuredWatch(namespace string, resource APIResource) *watch {
+	return newWatch(namespace, &UnstructuredList{Resource: resource})
+}
+
+// jsonWatcher decodes a JSON watch stream.
+type jsonWatcher struct {
+	body    io.ReadCloser
+	decoder *json.Decoder
+}
+
+func newJSONWatcher(body io.ReadCloser) *jsonWatcher {
+	return &jsonWatcher{body: body, decoder: json.NewDecoder(body)}
+}
+
+func (w *jsonWatcher) Next(resource k8s.Resource) (string, error) {
+	var event struct {
+		Type   string          `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := w.decoder.Decode(&event); err != nil {
+		return "", errors.Wrap(err, "decode event")
+	}
+	switch event.Type {
+	case "":
+		return "", errors.New("watch event had no type field")
+	case k8s.EventError:
+		status := new(metav1.Status)
+		if err := json.Unmarshal(event.Object, status); err != nil {
+			return "", errors.Wrap(err, "decode error event")
+		}
+		return event.Type, &k8s.APIError{Status: status, Code: int(status.GetCode())}
+	}
+	if err := json.Unmarshal(event.Object, resource); err != nil {
+		return "", errors.Wrap(err, "decode resource")
+	}
+	return event.Type, nil
+}
+
+func (w *jsonWatcher) Close() error {
+	return w.body.Close()
+}
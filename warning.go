@@ -0,0 +1,124 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A WarningHandler is called with the text of each warning that the
+// apiserver attaches to a response, such as a notice that the request
+// used a deprecated API version.
+type WarningHandler func(text string)
+
+// WarningMiddleware returns a Middleware that passes the warnings in
+// the Warning headers of every response to handler.
+func WarningMiddleware(handler WarningHandler) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if resp != nil {
+				for _, header := range resp.Header[http.CanonicalHeaderKey("Warning")] {
+					for _, text := range parseWarningHeader(header) {
+						handler(text)
+					}
+				}
+			}
+			return resp, err
+		})
+	}
+}
+
+// dedupWarnings wraps handler so that it is only called once for each
+// distinct warning; a watch that reconnects every few minutes would
+// otherwise repeat the same warning forever.
+func dedupWarnings(handler WarningHandler) WarningHandler {
+	var mu sync.Mutex
+	seen := make(map[string]struct{})
+	return func(text string) {
+		mu.Lock()
+		_, dup := seen[text]
+		seen[text] = struct{}{}
+		mu.Unlock()
+		if !dup {
+			handler(text)
+		}
+	}
+}
+
+// parseWarningHeader returns the text of each "299" warning in the
+// value of a Warning header, which has the form
+//
+//	299 - "text", 299 - "more text"
+//
+// as described by RFC 7234 section 5.5.  The apiserver only sends
+// 299 ("miscellaneous persistent warning") warnings; others are
+// ignored.  Malformed values are ignored.
+func parseWarningHeader(header string) []string {
+	var ret []string
+	for {
+		header = strings.TrimLeft(header, " ,")
+		if header == "" {
+			return ret
+		}
+		// warn-code
+		sp := strings.IndexByte(header, ' ')
+		if sp < 0 {
+			return ret
+		}
+		code, err := strconv.Atoi(header[:sp])
+		if err != nil {
+			return ret
+		}
+		header = header[sp+1:]
+		// warn-agent
+		sp = strings.IndexByte(header, ' ')
+		if sp < 0 {
+			return ret
+		}
+		header = header[sp+1:]
+		// warn-text
+		text, rest, ok := parseQuotedString(header)
+		if !ok {
+			return ret
+		}
+		if code == 299 {
+			ret = append(ret, text)
+		}
+		// optional warn-date
+		header = strings.TrimLeft(rest, " ")
+		if strings.HasPrefix(header, `"`) {
+			if _, rest, ok = parseQuotedString(header); !ok {
+				return ret
+			}
+			header = rest
+		}
+	}
+}
+
+// parseQuotedString parses an RFC 7230 quoted-string from the start of
+// s, returning its unescaped contents and the remainder of s.
+func parseQuotedString(s string) (str, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", s, false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), s[i+1:], true
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", s, false
+			}
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", s, false
+}
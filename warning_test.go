@@ -0,0 +1,28 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseWarningHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{`299 - "deprecated"`, []string{"deprecated"}},
+		{`299 - "one", 299 - "two"`, []string{"one", "two"}},
+		{`299 kube-apiserver "quoted \"text\"" "Tue, 15 Nov 1994 08:12:31 GMT", 299 - "next"`, []string{`quoted "text"`, "next"}},
+		{`199 - "not persistent", 299 - "persistent"`, []string{"persistent"}},
+		{`299 - "unterminated`, nil},
+		{`299 - "ok", garbage`, []string{"ok"}},
+		{``, nil},
+	}
+	for _, test := range tests {
+		if got := parseWarningHeader(test.header); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.header, got, test.want)
+		}
+	}
+}
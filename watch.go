@@ -4,31 +4,17 @@ package k8sutil
 
 import (
 	"context"
-	"reflect"
+	"net/url"
+	"path"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ericchiang/k8s"
 	"github.com/pkg/errors"
 )
 
-// A Store allows you to query the stored state of the cluster.
-type Store interface {
-	// List returns all stored resources with the same type as the
-	// given "sample" resource.  It is not valid to mutate any of
-	// the resource returned.
-	List(resourceType k8s.Resource) []k8s.Resource
-}
-
-type mapStore map[reflect.Type]map[string]k8s.Resource
-
-func (store mapStore) List(resourceType k8s.Resource) []k8s.Resource {
-	rt := reflect.TypeOf(resourceType)
-	ret := make([]k8s.Resource, 0, len(store[rt]))
-	for _, resource := range store[rt] {
-		ret = append(ret, resource)
-	}
-	return ret
-}
-
 // WatchingStore watches a set of resources (specified with
 // .AddWatch() after creating the WatchingStore) and stores the
 // current state of the cluster.
@@ -39,18 +25,239 @@ func (store mapStore) List(resourceType k8s.Resource) []k8s.Resource {
 //
 // The Callback is called synchronously.  The Callback is not told
 // what changed between callbacks, because there may be multiple
-// changes that are coalesced.
+// changes that are coalesced.  The Store passed to the Callback is an
+// immutable snapshot; it is safe to keep it, and to use it from other
+// goroutines, after the Callback returns.
+//
+// In CPU and goroutine profiles, each watch's goroutines carry the
+// pprof labels "k8sutil.watch" (the resource type) and
+// "k8sutil.namespace" (and "k8sutil.label_selector" and
+// "k8sutil.field_selector", if it has them), and the Callback (or
+// OnChange function) runs with the labels "k8sutil.callback" and
+// "k8sutil.correlation_id" (see CorrelationID).
 type WatchingStore struct {
-	Client   *k8s.Client // must not be nil
+	slowCallbacks uint64 // accessed atomically; must be first for alignment
+
+	Client   *k8s.Client // must not be nil, unless Backend is set
 	Logger   Logger      // must not be nil
-	Callback func(Store) // must not be nil
+	Callback func(Store) // must not be nil, unless every watch uses OnChange, or Events is used
+
+	// Backend, if set, is used to list and watch resources
+	// instead of the Client.  The transport options below only
+	// apply to the Client; they have no effect on the Backend,
+	// other than the UserAgent, which is given to a
+	// UserAgentBackend.
+	//
+	// If the Client is nil, the server version is not detected,
+	// and AddWatchEverything may not be used.
+	Backend Backend
+
+	// Middleware, if set, wraps the Client's transport for all
+	// requests made by Run; see WrapClient.
+	Middleware []Middleware
+
+	// Dialer, if set, is used to open all connections made by
+	// Run; see WithDialer.
+	Dialer Dialer
+
+	// Proxy, if set, is the URL of an HTTP CONNECT or SOCKS5 proxy
+	// to make all connections through; see WithProxy.
+	Proxy *url.URL
+
+	// Keepalive, if set, configures how quickly Run's connections
+	// are detected to have died; see WithKeepalive.
+	Keepalive *Keepalive
+
+	// UserAgent, if set, is sent as the User-Agent of all requests
+	// made by Run (for example, "ambassador/0.50.0").  Requests
+	// made on behalf of a particular watch have a comment
+	// identifying the watch appended, so that the apiserver's audit
+	// logs and APF metrics can attribute load to specific watches.
+	// If the Backend is set, it only sends the UserAgent if it is a
+	// UserAgentBackend.
+	UserAgent string
+
+	// WarningHandler, if set, is called with each distinct warning
+	// that the apiserver attaches to a response to one of Run's
+	// requests, such as a notice that a watched type uses a
+	// deprecated API version.
+	WarningHandler WarningHandler
+
+	// StreamingList, if set, makes each watch perform its initial
+	// listing as a streaming list (a watch with
+	// sendInitialEvents=true) instead of a list call, which avoids
+	// the memory spike of decoding one very large list response.
+	// Watches fall back to a list call if the server is too old
+	// or rejects the request.
+	StreamingList bool
+
+	// LazyDecode, if set, keeps stored objects in their serialized
+	// (protobuf or JSON) form, and only decodes them when they are
+	// listed, keeping the DecodeCacheSize most recently decoded
+	// objects.  This trades CPU for a large reduction in
+	// steady-state memory use when storing tens of thousands of
+	// objects.
+	LazyDecode bool
+
+	// DecodeCacheSize is the number of decoded objects kept by
+	// LazyDecode.  If zero, DefaultDecodeCacheSize is used.
+	DecodeCacheSize int
+
+	// OnSync, if set, is called once the initial listing of every
+	// watch has completed, and again each time that they complete a
+	// full re-list, with the complete picture of the cluster.  When
+	// OnSync is set, the changes found by a listing are reported
+	// only to it, not to the Callback; the Callback only hears
+	// about incremental changes.
+	OnSync func(Store)
+
+	// OnStop, if set, is called once Run is stopping, before it
+	// returns, with the last Store passed to a callback (or nil, if
+	// there wasn't one), so that consumers can flush their state
+	// knowing that no further callbacks will arrive.  Any
+	// notification being held by the CoalesceWindow is delivered
+	// first.
+	OnStop func(Store)
+
+	// Preflight, if set, makes Run check up front, with
+	// SelfSubjectAccessReviews, that it is allowed to list and
+	// watch everything that it has been asked to, and return a
+	// *PreflightError listing the missing permissions if not.
+	Preflight bool
+
+	// SyncTimeout, if non-zero, is how long to wait for the
+	// listing of every watch to complete before logging a
+	// SyncTimeoutError naming the watches that haven't.
+	SyncTimeout time.Duration
+
+	// SyncPartial, if set, carries on after the SyncTimeout with
+	// the watches that did complete their listing; the Store is
+	// missing the resources of the others until they complete
+	// theirs.
+	SyncPartial bool
 
-	watches []watch
-	store   map[reflect.Type]map[string]k8s.Resource
+	// CoalesceWindow is how long changes are held before notifying
+	// of them, so that bursts of changes result in a single
+	// notification.  If zero, each change is notified of
+	// immediately.  The Coalesce and HighPriority WatchOptions
+	// override it for individual watches.
+	CoalesceWindow time.Duration
+
+	// SlowCallback, if non-zero, is how long the Callback (or an
+	// OnChange or OnSync function) may take before it is logged as
+	// slow, with how long it took and the Sequence of the Store
+	// that it was handling, and counted by SlowCallbacks.  Since
+	// callbacks are called synchronously, a slow one stalls the
+	// processing of events.
+	SlowCallback time.Duration
+
+	// EventBuffer is the number of watch events held for Run
+	// between the goroutines that read the watches and the one
+	// that updates the store and calls the callbacks, so that a
+	// burst of events, or a slow callback, doesn't stall reading
+	// the watches.  Overflow says what a watch does once it is
+	// full; the default, OverflowBlock, waits.
+	EventBuffer int
+	Overflow    OverflowPolicy
+
+	// Checkpointer, if set, keeps the resourceVersion that each
+	// watch has caught up to across restarts of the application.
+	Checkpointer Checkpointer
+
+	// Trim, if set, says what to strip out of stored resources to
+	// shrink the store's memory footprint.
+	Trim *Trim
+
+	// OnEvict, if set, is called with the resources that the
+	// MaxObjects, MaxAge, and TTL limits evict from the store, before
+	// the Callback that no longer has them.
+	OnEvict func(evicted []k8s.Resource)
+
+	// Clock, if set, is used instead of the system clock for
+	// everything time-based: retry backoff, the CoalesceWindow,
+	// MaxAge and TTL eviction, and the SyncTimeout.
+	Clock Clock
+
+	// RepeatedErrorInterval limits how often Run logs the same
+	// error, such as "connection refused" on every retry during an
+	// apiserver outage: once an error is logged, identical errors
+	// are suppressed for the interval, and the next one after it
+	// is logged with a count of those suppressed.  If zero,
+	// DefaultRepeatedErrorInterval is used; if negative, every
+	// error is logged.
+	RepeatedErrorInterval time.Duration
+
+	// FailAfter, if non-zero, makes Run give up and return a
+	// *RunError once a watch has failed that many times in a
+	// row without listing or watching successfully in between,
+	// instead of retrying forever, so that a misconfigured client
+	// exits and leaves it to its supervisor (systemd, or the
+	// kubelet) to restart it.  FailAfterDuration, if non-zero, is
+	// the same, but gives up once a watch has been failing for
+	// that long.  The failures of an optional watch that is
+	// unavailable don't count.
+	FailAfter         int
+	FailAfterDuration time.Duration
+
+	// MinRelistInterval, if non-zero, is the least time between the
+	// starts of a watch's listings, so that an apiserver that keeps
+	// failing, or expiring watches with "410 Gone", doesn't have
+	// every watch list everything again in a tight loop.  Each wait
+	// is lengthened by a random jitter of up to half the interval,
+	// so that watches that restart together don't list together.
+	// MaxConcurrentRelists, if non-zero, is how many watches may
+	// list at once; the rest wait their turn.  Both apply to the
+	// initial listings, too.
+	MinRelistInterval    time.Duration
+	MaxConcurrentRelists int
+
+	baseClient *k8s.Client  // w.Client, with the transport options
+	middleware []Middleware // for baseClient, including w.Middleware
+	client     *k8s.Client  // baseClient, with the middleware
+	logger     Logger       // the Logger, deduplicated
+	watches    []*watch
+	everything []everythingWatch
+	store      *resourceStore
+	router     *router
+	coalescer  coalescer
+	consistent bool // whether the current round has completed its listing
+
+	owned map[*watch]map[string]struct{} // the UIDs that each watch has stored; only used by run
+
+	mu            sync.Mutex // protects serverVersion, subscriptions, and setting store or watches
+	serverVersion *ServerVersion
+	subscriptions []*subscription // of Events
+	removeCh      chan removal    // to the Run goroutine, while it is running
+	doneCh        chan struct{}   // closed when Run returns
+
+	metrics storeMetrics
 }
 
-func (w *WatchingStore) notify() {
-	w.Callback(mapStore(w.store))
+// clock returns the Clock to use.
+func (w *WatchingStore) clock() Clock {
+	return orSystemClock(w.Clock)
+}
+
+// currentWatches returns the watches, for use outside of the Run
+// goroutine.
+func (w *WatchingStore) currentWatches() []*watch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.watches
+}
+
+// A WatchOption configures a single watch added with AddWatch.
+type WatchOption func(*watch)
+
+// ClientOptions adds the k8s.Options, such as label selectors
+// (k8s.QueryParam("labelSelector", ...)), to the watch's list and watch
+// requests, for parameters that there is no WatchOption for.  The
+// options are passed on to the Backend; their query parameters are
+// sent for types that the k8s.Client doesn't know about, too.
+func ClientOptions(options ...k8s.Option) WatchOption {
+	return func(w *watch) {
+		w.clientOptions = append(w.clientOptions, options...)
+	}
 }
 
 // AddWatch adds to the resources that the WatchingStore keeps track
@@ -64,16 +271,233 @@ func (w *WatchingStore) notify() {
 //
 // For example:
 //
-//     w.AddWatch(k8s.AllNamespaces, &corev1.PodList{})
+//	w.AddWatch(k8s.AllNamespaces, &corev1.PodList{})
 //
 // It is invalid to call .AddWatch() while .Run() is running.
-func (w *WatchingStore) AddWatch(namespace string, resourceList k8s.ResourceList) {
-	w.watches = append(w.watches, newWatch(namespace, resourceList))
+func (w *WatchingStore) AddWatch(namespace string, resourceList k8s.ResourceList, options ...WatchOption) {
+	wa := newWatch(namespace, resourceList)
+	for _, option := range options {
+		option(wa)
+	}
+	query := OptionQuery(wa.clientOptions...)
+	wa.labelSelector, wa.fieldSelector = query.Get("labelSelector"), query.Get("fieldSelector")
+	w.watches = append(w.watches, wa)
+}
+
+// AddOptionalWatch is like AddWatch, but for a best-effort watch: if
+// listing the resources fails because we aren't allowed to (403
+// Forbidden), or because the type isn't installed (404 Not Found), the
+// WatchingStore carries on as if the listing had found nothing, rather
+// than waiting for it forever.  The watch keeps retrying in the
+// background, and is reported by Unavailable until it succeeds.
+//
+// It is invalid to call .AddOptionalWatch() while .Run() is running.
+func (w *WatchingStore) AddOptionalWatch(namespace string, resourceList k8s.ResourceList, options ...WatchOption) {
+	optional := func(wa *watch) {
+		wa.optional = true
+	}
+	w.AddWatch(namespace, resourceList, append([]WatchOption{optional}, options...)...)
+}
+
+// Unavailable returns the optional watches (added with
+// AddOptionalWatch) that are currently failing to list, because of
+// missing permissions or a missing type.
+func (w *WatchingStore) Unavailable() []WatchID {
+	var ret []WatchID
+	for _, wa := range w.currentWatches() {
+		if atomic.LoadInt32(&wa.unavailable) != 0 {
+			ret = append(ret, wa.id())
+		}
+	}
+	return ret
+}
+
+// EverythingFilter selects the resource types that AddWatchEverything
+// watches.  Each pattern is of the form "resource.group" (for example
+// "deployments.apps"), or just "resource" for the core group (for
+// example "pods"), and may use the wildcards understood by path.Match
+// (for example "*.networking.k8s.io").
+type EverythingFilter struct {
+	// Include, if non-empty, limits the watched types to those
+	// matching at least one of these patterns.
+	Include []string
+
+	// Exclude excludes types matching any of these patterns, even
+	// if they match Include.
+	Exclude []string
+}
+
+// Matches returns whether the filter selects the resource type.
+func (f EverythingFilter) Matches(resource APIResource) bool {
+	name := resource.Name
+	if resource.Group != "" {
+		name += "." + resource.Group
+	}
+	matchAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(f.Include) == 0 || matchAny(f.Include)) && !matchAny(f.Exclude)
+}
+
+type everythingWatch struct {
+	namespace string
+	filter    EverythingFilter
+}
+
+// AddWatchEverything adds watches for every resource type that the
+// apiserver serves that can be listed and watched (and that is selected
+// by the filter), for tools that want a complete mirror of the cluster.
+// The resources are stored as *Unstructured; see NewUnstructured.
+//
+// The types are found using discovery when Run starts, and only the
+// preferred version of each API group is watched.  If namespace isn't
+// k8s.AllNamespaces, only namespaced types are watched.
+//
+// It is invalid to call .AddWatchEverything() while .Run() is running.
+func (w *WatchingStore) AddWatchEverything(namespace string, filter EverythingFilter) {
+	w.everything = append(w.everything, everythingWatch{namespace, filter})
+}
+
+// resolveEverything uses discovery to turn the AddWatchEverything
+// calls in to watches.  Other than when there is no Client, it only
+// returns an error if the Context is canceled before discovery
+// succeeds.
+func (w *WatchingStore) resolveEverything(ctx context.Context) error {
+	if len(w.everything) == 0 {
+		return nil
+	}
+	if w.client == nil {
+		return errors.New("AddWatchEverything requires a Client")
+	}
+	discovery := &Discovery{Client: w.client}
+	var resources []APIResource
+	for {
+		var err error
+		resources, err = discovery.Resources(ctx)
+		if err != nil {
+			w.logger.Errorf("discover resource types: %v", err)
+		}
+		if resources != nil {
+			break
+		}
+		sleep(ctx, w.clock(), time.Second)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	// Pause and the like might be looking at the watches.
+	watches := append([]*watch(nil), w.watches...)
+	for _, everything := range w.everything {
+		for _, resource := range resources {
+			if !resource.Preferred || !resource.Supports("list") || !resource.Supports("watch") {
+				continue
+			}
+			if everything.namespace != k8s.AllNamespaces && !resource.Namespaced {
+				continue
+			}
+			if !everything.filter.Matches(resource) {
+				continue
+			}
+			watches = append(watches, newUnstructuredWatch(everything.namespace, resource))
+		}
+	}
+	w.mu.Lock()
+	w.watches = watches
+	w.mu.Unlock()
+	w.everything = nil
+	return nil
+}
+
+// Throttled returns the number of times that the apiserver has told
+// the WatchingStore to back off with a "429 Too Many Requests"
+// response.  Each such response delays that watch's next request by
+// the amount of time that the apiserver asked for.
+func (w *WatchingStore) Throttled() uint64 {
+	var n uint64
+	for _, wa := range w.currentWatches() {
+		n += atomic.LoadUint64(&wa.throttled)
+	}
+	return n
+}
+
+// withUserAgent returns the middleware, preceded by one that sets the
+// User-Agent to the UserAgent, with the comment appended if there is
+// one.
+func (w *WatchingStore) withUserAgent(comment string, middleware []Middleware) []Middleware {
+	if w.UserAgent == "" {
+		return middleware
+	}
+	ua := w.UserAgent
+	if comment != "" {
+		ua += " (" + comment + ")"
+	}
+	return append([]Middleware{userAgent(ua)}, middleware...)
+}
+
+// SlowCallbacks returns the number of callbacks that have taken longer
+// than the SlowCallback threshold.
+func (w *WatchingStore) SlowCallbacks() uint64 {
+	return atomic.LoadUint64(&w.slowCallbacks)
+}
+
+// ServerVersion returns the version of the apiserver, as detected by
+// Run.  It returns nil if Run hasn't been called yet, or if it was
+// unable to detect the version.
+func (w *WatchingStore) ServerVersion() *ServerVersion {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.serverVersion
+}
+
+// Snapshot returns a snapshot of the store as of the most recent
+// change, or ErrNotSynced if the store hasn't synced yet.
+// It is safe to call while Run is running.
+func (w *WatchingStore) Snapshot() (Store, error) {
+	w.mu.Lock()
+	store := w.store
+	w.mu.Unlock()
+	if store == nil {
+		return nil, ErrNotSynced
+	}
+	snap := store.published()
+	if snap == nil {
+		return nil, ErrNotSynced
+	}
+	return snap, nil
+}
+
+// Stats returns the number of stored objects and an estimate of the
+// memory that they use, for each type of resource, as of the most
+// recent change.  It is safe to call while Run is running; it returns
+// empty StoreStats if the store hasn't synced yet.
+func (w *WatchingStore) Stats() StoreStats {
+	w.mu.Lock()
+	store := w.store
+	w.mu.Unlock()
+	if store == nil {
+		return StoreStats{}
+	}
+	snap := store.published()
+	if snap == nil {
+		return StoreStats{}
+	}
+	return snap.stats()
 }
 
 // Run performs the initial list calls to populate the store, and then
 // launches the following watch calls to keep it up to date.
 //
+// Run returns nil once the Context is done: that is a clean shutdown,
+// not a failure.  Otherwise it only returns an error that keeps it from
+// starting, such as a *PreflightError, or, if it gives up because of
+// FailAfter or FailAfterDuration, a *RunError describing every watch
+// that was failing.
+//
 // It is invalid to call .AddWatch() while .Run() is running.
 func (w *WatchingStore) Run(ctx context.Context) error {
 	// The store is keyed by the resource type.  Because it is
@@ -84,112 +508,471 @@ func (w *WatchingStore) Run(ctx context.Context) error {
 	// do that by killing all watches when 1 dies, and restarting
 	// everything.
 	//
-	for {
-		if err := ctx.Err(); err != nil {
+	defer w.closeSubscriptions()
+	if err := w.setupClient(); err != nil {
+		return err
+	}
+	w.logger = newDedupLogger(w.Logger, w.RepeatedErrorInterval, w.clock())
+	var serverVersion *ServerVersion
+	if w.client != nil {
+		var err error
+		if serverVersion, err = ServerInfo(ctx, w.client); err != nil {
+			// Carry on without any of the optional behaviors.
+			w.logger.Errorf("detect server version: %v", err)
+		} else {
+			w.mu.Lock()
+			w.serverVersion = serverVersion
+			w.mu.Unlock()
+		}
+	}
+	if err := w.resolveEverything(ctx); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	if w.Preflight && w.client != nil {
+		if err := w.preflight(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tripwire := &tripwire{cancel: cancel}
+	limiter := newListLimiter(w.MinRelistInterval, w.MaxConcurrentRelists)
+	for _, wa := range w.watches {
+		w.setupWatch(wa, serverVersion)
+		wa.breaker = w.newBreaker(tripwire)
+		wa.limiter = limiter
+	}
+	w.router = newRouter(w.Callback, w.CoalesceWindow, w.watches)
+	w.mu.Lock()
+	w.removeCh = make(chan removal)
+	w.doneCh = make(chan struct{})
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		close(w.doneCh)
+		w.removeCh = nil
+		w.mu.Unlock()
+	}()
+	for {
+		if ctx.Err() != nil {
+			w.stop()
+			if tripped := tripwire.tripped(); tripped != nil {
+				return w.runError(tripped)
+			}
+			return nil
+		}
 		w.run(ctx)
 	}
 }
 
+// stop delivers any notification still being held, as long as the store
+// hasn't been left part way through a re-list, and then calls the
+// OnStop callback.
+func (w *WatchingStore) stop() {
+	if w.consistent {
+		w.notify(w.coalescer.take(changeSet{}))
+	}
+	w.coalescer.stop()
+	if w.OnStop == nil {
+		return
+	}
+	var last Store
+	if w.store != nil {
+		if snap := w.store.published(); snap != nil {
+			last = snap
+		}
+	}
+	w.OnStop(last)
+}
+
+// applyListing stores the resources from the listing, and removes any
+// stored resources that the watch stored before, but that are missing
+// from the listing (unless another watch has stored them too),
+// returning the types that changed.  The UIDs of the listed resources
+// are added to uids, if it is non-nil; if it is non-nil, removal is left
+// for the caller.
+func (w *WatchingStore) applyListing(l listing, uids map[string]struct{}) []typeKey {
+	key := l.watch.storeKey()
+	changed := false
+	listed := uids
+	if listed == nil {
+		listed = map[string]struct{}{}
+	}
+	for _, newResource := range l.items {
+		uid := newResource.GetMetadata().GetUid()
+		listed[uid] = struct{}{}
+
+		oldVersion, existed := w.store.resourceVersion(key, uid)
+		if !existed || oldVersion != newResource.GetMetadata().GetResourceVersion() {
+			w.store.put(newResource)
+			changed = true
+		} else {
+			w.store.refresh(key, uid)
+		}
+	}
+	if uids == nil {
+		var stale []string
+		for uid := range w.owned[l.watch] {
+			if _, ok := listed[uid]; !ok {
+				stale = append(stale, uid)
+			}
+		}
+		for uid := range listed {
+			w.own(l.watch, uid)
+		}
+		if w.disown(l.watch, stale) {
+			changed = true
+		}
+	}
+	if changed {
+		return []typeKey{key}
+	}
+	return nil
+}
+
+// own records that the watch has stored the resource with the UID.
+// Watches of the same type, in overlapping namespaces or with different
+// selectors, may store the same resources; a resource is only removed
+// once none of them has it.
+func (w *WatchingStore) own(wa *watch, uid string) {
+	if w.owned == nil {
+		w.owned = map[*watch]map[string]struct{}{}
+	}
+	uids := w.owned[wa]
+	if uids == nil {
+		uids = map[string]struct{}{}
+		w.owned[wa] = uids
+	}
+	uids[uid] = struct{}{}
+}
+
+// disown forgets that the watch has stored the resources with the
+// UIDs, and removes those that no other watch of the type has stored,
+// returning whether there were any.
+func (w *WatchingStore) disown(wa *watch, uids []string) bool {
+	key := wa.storeKey()
+	removed := false
+	for _, uid := range uids {
+		delete(w.owned[wa], uid)
+		if !w.ownedByAny(key, uid) && w.store.delete(key, uid) {
+			removed = true
+		}
+	}
+	return removed
+}
+
+// ownedByAny returns whether any watch of the type has stored the
+// resource with the UID.
+func (w *WatchingStore) ownedByAny(key typeKey, uid string) bool {
+	for _, wa := range w.watches {
+		if wa.storeKey() != key {
+			continue
+		}
+		if _, ok := w.owned[wa][uid]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// setupClient configures the client used by Run from w.Client and the
+// transport options.
+func (w *WatchingStore) setupClient() error {
+	client := w.Client
+	if client == nil {
+		return nil
+	}
+	var err error
+	if w.Dialer != nil {
+		if client, err = WithDialer(client, w.Dialer); err != nil {
+			return errors.Wrap(err, "dialer")
+		}
+	}
+	if w.Proxy != nil {
+		if client, err = WithProxy(client, w.Proxy); err != nil {
+			return errors.Wrap(err, "proxy")
+		}
+	}
+	if w.Keepalive != nil {
+		if client, err = WithKeepalive(client, *w.Keepalive); err != nil {
+			return errors.Wrap(err, "keepalive")
+		}
+	}
+	middleware := append([]Middleware(nil), w.Middleware...)
+	if w.WarningHandler != nil {
+		middleware = append([]Middleware{WarningMiddleware(dedupWarnings(w.WarningHandler))}, middleware...)
+	}
+	// recordRetryAfter is innermost, to see responses as they came.
+	w.middleware = append(middleware, recordRetryAfter(w.clock()))
+	w.baseClient = client
+	w.client = WrapClient(client, w.withUserAgent("", w.middleware)...)
+	return nil
+}
+
+// setupWatch configures the watch's backend, and which optional
+// behaviors it uses.  The serverVersion may be nil.
+func (w *WatchingStore) setupWatch(wa *watch, serverVersion *ServerVersion) {
+	wa.backend = w.Backend
+	if w.Backend == nil {
+		wa.backend = clientBackend{WrapClient(w.baseClient, w.withUserAgent(wa.userAgentComment(), w.middleware)...)}
+	} else if backend, ok := w.Backend.(UserAgentBackend); ok && w.UserAgent != "" {
+		wa.backend = backend.WithUserAgent(w.UserAgent + " (" + wa.userAgentComment() + ")")
+	}
+	wa.clock = w.clock()
+	if resource, err := apiResourceForList(wa.list); err == nil {
+		wa.gvr = resource.GroupVersionResource()
+	}
+	wa.bookmarks = serverVersion != nil && serverVersion.WatchBookmarks
+	wa.streamingList = w.StreamingList && serverVersion != nil && serverVersion.WatchList
+	wa.overflow = w.Overflow
+	wa.checkpointer = w.Checkpointer
+}
+
 // run performs 1 "round" of list+watch calls.  Once the first watch
 // in this round dies, all others are canceled, so that they can all
 // be restarted.  See the comment in Run().
 func (w *WatchingStore) run(ctx context.Context) {
 	ctx, cancelCtx := context.WithCancel(ctx)
+	w.consistent = false
 
-	listCh := make(chan []k8s.Resource)
-	listCnt := 0
-
-	watchCh := make(chan watchEvent)
-
-	exitCh := make(chan struct{})
-	exitCnt := 0
+	listCh := make(chan listing)
+	eventBuffer := w.EventBuffer
+	if eventBuffer < 0 {
+		eventBuffer = 0
+	}
+	watchCh := make(chan watchEvent, eventBuffer)
+	exitCh := make(chan *watch)
 
+	// Each watch has its own Context, so that RemoveWatch can stop
+	// it without stopping the rest.
+	cancels := map[*watch]context.CancelFunc{}
 	for _, wa := range w.watches {
-		go func(wa watch) {
-			wa.run(ctx, w.Client, w.Logger, listCh, watchCh)
-			exitCh <- struct{}{}
+		wctx, cancel := context.WithCancel(ctx)
+		cancels[wa] = cancel
+		go func(wa *watch) {
+			pprof.Do(wctx, wa.pprofLabels(), func(wctx context.Context) {
+				wa.run(wctx, w.logger, listCh, watchCh)
+			})
+			exitCh <- wa
 		}(wa)
 	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	removed := map[*watch]bool{}
+	running := len(w.watches)
+	// exited handles the exit of a watch goroutine, returning
+	// whether they all have.
+	exited := func(wa *watch) bool {
+		if !removed[wa] {
+			cancelCtx()
+		}
+		running--
+		return running == 0
+	}
 
-	dirty := false
+	changes := changeSet{}
 	if w.store == nil {
-		w.store = map[reflect.Type]map[string]k8s.Resource{}
-		dirty = true
+		store := newResourceStore()
+		store.clock = w.clock()
+		if w.LazyDecode {
+			store.lazy = newDecodeCache(w.DecodeCacheSize)
+		}
+		if w.Trim != nil {
+			store.trim = newTrimmer(*w.Trim)
+		}
+		w.mu.Lock()
+		w.store = store
+		w.mu.Unlock()
 	}
-	newUids := map[reflect.Type]map[string]struct{}{}
+	var expireCh <-chan time.Time
 	for _, watch := range w.watches {
-		rt := reflect.TypeOf(watch.resource)
-		newUids[rt] = map[string]struct{}{}
-		if _, ok := w.store[rt]; !ok {
-			w.store[rt] = map[string]k8s.Resource{}
-			dirty = true
+		key := watch.storeKey()
+		if w.store.addType(watch.storeSample(), watch.limits) {
+			changes.add(key)
+		}
+		if watch.limits.timed() && expireCh == nil {
+			ticker := w.clock().NewTicker(evictionInterval)
+			defer ticker.Stop()
+			expireCh = ticker.C()
 		}
 	}
-	for listCnt < len(w.watches) {
+	var syncTimeout <-chan time.Time
+	if w.SyncTimeout > 0 {
+		timer := w.clock().NewTimer(w.SyncTimeout)
+		defer timer.Stop()
+		syncTimeout = timer.C()
+	}
+	unlisted := map[*watch]bool{}
+	for _, wa := range w.watches {
+		unlisted[wa] = true
+	}
+	listedUids := map[*watch]map[string]struct{}{}
+	relists := map[*watch]uint64{} // of each watch's latest listing
+	partial := false
+initial:
+	for len(unlisted) > 0 {
 		select {
-		case list := <-listCh:
-			for _, newResource := range list {
-				rt := reflect.TypeOf(newResource)
-				uid := newResource.GetMetadata().GetUid()
-				newUids[rt][uid] = struct{}{}
-
-				oldResource, existed := w.store[rt][uid]
-				if !existed || oldResource.GetMetadata().GetResourceVersion() != newResource.GetMetadata().GetResourceVersion() {
-					w.store[rt][uid] = newResource
-					dirty = true
+		case l := <-listCh:
+			if removed[l.watch] {
+				continue
+			}
+			// An optional watch may list again, once it
+			// becomes available.
+			uids := map[string]struct{}{}
+			relists[l.watch] = l.relists
+			changes.add(w.applyListing(l, uids)...)
+			listedUids[l.watch] = uids
+			delete(unlisted, l.watch)
+		case <-syncTimeout:
+			err := &SyncTimeoutError{}
+			for _, wa := range w.watches {
+				if unlisted[wa] {
+					err.Pending = append(err.Pending, wa.id())
 				}
 			}
-
-			listCnt++
-		case <-exitCh:
-			cancelCtx()
-			exitCnt++
-			if exitCnt == len(w.watches) {
+			w.logger.Errorf("%v", err)
+			if w.SyncPartial {
+				partial = true
+				break initial
+			}
+		case r := <-w.removeCh:
+			// The purge is taken care of by retaining only
+			// what the remaining watches listed.
+			for _, wa := range w.remove(r, cancels, removed) {
+				delete(unlisted, wa)
+				delete(listedUids, wa)
+				changes.add(wa.storeKey())
+			}
+		case wa := <-exitCh:
+			if exited(wa) {
 				return
 			}
 		}
 	}
-	for rt := range w.store {
-		for uid := range w.store[rt] {
-			if _, ok := newUids[rt][uid]; !ok {
-				delete(w.store[rt], uid)
-				dirty = true
+	newUids := map[typeKey]map[string]struct{}{}
+	for key := range w.store.types {
+		newUids[key] = map[string]struct{}{}
+	}
+	for wa, uids := range listedUids {
+		for uid := range uids {
+			newUids[wa.storeKey()][uid] = struct{}{}
+		}
+	}
+	if partial {
+		// Don't purge what we knew from before about types
+		// that haven't listed.
+		for wa := range unlisted {
+			delete(newUids, wa.storeKey())
+		}
+	}
+	changes.add(w.store.retain(newUids)...)
+	owned := listedUids
+	if partial {
+		for wa := range unlisted {
+			if uids, ok := w.owned[wa]; ok {
+				owned[wa] = uids
 			}
 		}
 	}
-	if dirty {
-		w.notify()
+	w.owned = owned
+	changes = w.coalescer.take(changes)
+	w.consistent = true
+	if w.OnSync != nil {
+		w.flushEvicted()
+		snap := w.store.snapshot()
+		w.call(callback{fn: w.OnSync, name: "OnSync"}, snap)
+		if len(changes) > 0 {
+			w.publish(changes, snap)
+		}
+	} else {
+		w.notify(changes)
 	}
 
+	done := ctx.Done()
 	for {
 		select {
+		case <-done:
+			// The watches exit on their own; this is only
+			// for when there aren't any left.
+			if running == 0 {
+				return
+			}
+			done = nil
 		case event := <-watchCh:
+			if removed[event.watch] || event.relists < relists[event.watch] {
+				// Removed, or superseded by a listing.
+				continue
+			}
 			newResource := event.resource
-			rt := reflect.TypeOf(newResource)
+			rt := typeKeyOf(newResource)
 			uid := newResource.GetMetadata().GetUid()
 
 			switch event.eventType {
 			case k8s.EventDeleted:
-				_, existed := w.store[rt][uid]
-				delete(w.store[rt], uid)
-				if existed {
-					w.notify()
+				if w.disown(event.watch, []string{uid}) {
+					w.changed(changeSet{rt: {}})
 				}
 			case k8s.EventAdded, k8s.EventModified:
-				oldResource, existed := w.store[rt][uid]
-				if !existed || oldResource.GetMetadata().ResourceVersion != newResource.GetMetadata().ResourceVersion {
-					w.store[rt][uid] = newResource
-					w.notify()
+				w.own(event.watch, uid)
+				oldVersion, existed := w.store.resourceVersion(rt, uid)
+				newVersion := newResource.GetMetadata().GetResourceVersion()
+				switch {
+				case !existed || newerVersion(oldVersion, newVersion):
+					w.store.put(newResource)
+					if !existed || !event.statusOnly {
+						w.changed(changeSet{rt: {}})
+					}
+				case newVersion == oldVersion:
+					w.store.refresh(rt, uid)
+				default:
+					// An older version, redelivered by a
+					// watch that reconnected at an older
+					// resourceVersion, or out of order;
+					// don't go back to it.
 				}
 			default:
 				panic(errors.Errorf("unexpected watch event type: %s", event.eventType))
 			}
-		case <-exitCh:
-			cancelCtx()
-			exitCnt++
-			if exitCnt == len(w.watches) {
+		case <-expireCh:
+			// Not the tick's time, which is stale if ticks were
+			// dropped.
+			if expired := w.store.expire(w.store.clock.Now()); len(expired) > 0 {
+				changes := changeSet{}
+				changes.add(expired...)
+				w.changed(changes)
+			}
+		case l := <-listCh:
+			if removed[l.watch] {
+				continue
+			}
+			// A watch that missed the SyncTimeout, an
+			// optional watch that has become available, or
+			// one that overflowed.
+			relists[l.watch] = l.relists
+			changes := changeSet{}
+			changes.add(w.applyListing(l, nil)...)
+			w.changed(changes)
+		case r := <-w.removeCh:
+			changes := changeSet{}
+			for _, wa := range w.remove(r, cancels, removed) {
+				if w.purge(wa) {
+					changes.add(wa.storeKey())
+				}
+			}
+			w.changed(changes)
+		case <-w.coalescer.C():
+			w.notify(w.coalescer.take(changeSet{}))
+		case wa := <-exitCh:
+			if exited(wa) {
 				return
 			}
 		}
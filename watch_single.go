@@ -3,11 +3,23 @@
 package k8sutil
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"reflect"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+	"github.com/ericchiang/k8s/runtime"
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 )
 
@@ -31,22 +43,207 @@ func getNewResourceInstance(x k8s.Resource) k8s.Resource {
 	return reflect.New(reflect.TypeOf(x).Elem()).Interface().(k8s.Resource)
 }
 
+// newResourceLike returns a new, empty resource of the same type as x
+// (including, for an *Unstructured, the same apiVersion and kind).
+func newResourceLike(x k8s.Resource) k8s.Resource {
+	switch x := x.(type) {
+	case *Unstructured:
+		return NewUnstructured(x.APIVersion(), x.Kind())
+	case *PartialObjectMetadata:
+		return NewPartialObjectMetadata(x.APIVersion, x.Kind)
+	}
+	return getNewResourceInstance(x)
+}
+
 func getNewResourceListInstance(x k8s.ResourceList) k8s.ResourceList {
 	return reflect.New(reflect.TypeOf(x).Elem()).Interface().(k8s.ResourceList)
 }
 
+// newResourceListLike returns a new, empty list of the same type as x
+// (including, for an *UnstructuredList or *PartialObjectMetadataList,
+// the same Resource).
+func newResourceListLike(x k8s.ResourceList) k8s.ResourceList {
+	switch x := x.(type) {
+	case *UnstructuredList:
+		return &UnstructuredList{Resource: x.Resource}
+	case *PartialObjectMetadataList:
+		return &PartialObjectMetadataList{Resource: x.Resource}
+	}
+	return getNewResourceListInstance(x)
+}
+
+// listItemSample returns a new, empty resource of the type of the
+// list's items.
+func listItemSample(list k8s.ResourceList) k8s.Resource {
+	switch list := list.(type) {
+	case *UnstructuredList:
+		return NewUnstructured(list.Resource.GroupVersion(), list.Resource.Kind)
+	case *PartialObjectMetadataList:
+		return NewPartialObjectMetadata(list.Resource.GroupVersion(), list.Resource.Kind)
+	}
+	itemsField, _ := reflect.TypeOf(list).Elem().FieldByName("Items")
+	return reflect.New(itemsField.Type.Elem().Elem()).Interface().(k8s.Resource)
+}
+
+// eventBookmark is the type of watch event that only advances the
+// resourceVersion; the k8s package doesn't know about it.
+const eventBookmark = "BOOKMARK"
+
+// A listing is the result of a watch's initial listing.
+type listing struct {
+	watch   *watch
+	items   []k8s.Resource
+	relists uint64 // of the watch, when it listed
+}
+
 type watchEvent struct {
-	eventType string
-	resource  k8s.Resource
+	watch      *watch
+	eventType  string
+	resource   k8s.Resource
+	statusOnly bool   // whether only the status changed, with IgnoreStatus
+	relists    uint64 // of the watch, before the event
 }
 
 type watch struct {
-	namespace    string
-	resource     k8s.Resource
-	resourceList k8s.ResourceList
+	throttled   uint64 // accessed atomically; must be first for alignment
+	overflows   uint64 // accessed atomically
+	unavailable int32  // accessed atomically
+
+	namespace string
+	list      k8s.ResourceList // a sample of the type being watched
+	resource  k8s.Resource     // a sample of the list's items
+	listType  ListType         // if registered, instead of reflection
+
+	backend       Backend
+	clock         Clock
+	bookmarks     bool // whether to ask for BOOKMARK events
+	streamingList bool // whether to try a streaming list first
+	gvr           GroupVersionResource
+	clientOptions []k8s.Option // more list and watch parameters
+	labelSelector string       // of the clientOptions, for the watch's id
+	fieldSelector string       // likewise
+
+	overflow OverflowPolicy
+	relists  uint64 // the times it has listed again on overflow; only used by run
+
+	// The Checkpointer, and its state; only used by run.
+	checkpointer     Checkpointer
+	checkpointLoaded bool
+	minVersion       string // that the first listing must be at least as new as
+	checkpointed     string // the last resourceVersion saved
+	checkpointedAt   time.Time
+
+	listStarted time.Time // when the last listing started; only used by run
+
+	optional bool // whether to tolerate being unable to list
+
+	normalized k8s.Resource              // if set, a sample of the type stored as
+	normalize  Normalizer                // converts resources to the normalized type
+	validate   func(k8s.Resource) error  // if set, rejects invalid resources
+	keep       []func(k8s.Resource) bool // the KeepIfs
+	pauser     pauser
+	state      watchStatus
+	breaker    *breaker // if set, gives up on the watch if it keeps failing
+	limiter    *listLimiter
+
+	fingerprints map[string]uint64 // by UID, with IgnoreStatus; only used by run
+
+	limits   limits         // on the stored resources of this type
+	callback func(Store)    // if set, instead of the WatchingStore's
+	coalesce *time.Duration // if set, instead of the WatchingStore's
+}
+
+// typeName describes the type being watched, for logging.
+func (w *watch) typeName() string {
+	return resourceTypeName(w.resource)
+}
+
+// id identifies the watch.
+func (w *watch) id() WatchID {
+	return WatchID{
+		Type:          w.typeName(),
+		Namespace:     w.namespace,
+		LabelSelector: w.labelSelector,
+		FieldSelector: w.fieldSelector,
+	}
+}
+
+// userAgentComment identifies the watch in the User-Agent of requests
+// made on its behalf.
+func (w *watch) userAgentComment() string {
+	namespace := w.namespace
+	if namespace == k8s.AllNamespaces {
+		namespace = "*"
+	}
+	return fmt.Sprintf("k8sutil watch=%s; namespace=%s", w.typeName(), namespace)
+}
+
+// pprofLabels labels the watch's goroutine (and any that it starts), so
+// that CPU and goroutine profiles attribute their cost to the watch.
+func (w *watch) pprofLabels() pprof.LabelSet {
+	namespace := w.namespace
+	if namespace == k8s.AllNamespaces {
+		namespace = "*"
+	}
+	labels := []string{"k8sutil.watch", w.typeName(), "k8sutil.namespace", namespace}
+	if w.labelSelector != "" {
+		labels = append(labels, "k8sutil.label_selector", w.labelSelector)
+	}
+	if w.fieldSelector != "" {
+		labels = append(labels, "k8sutil.field_selector", w.fieldSelector)
+	}
+	return pprof.Labels(labels...)
 }
 
-func newWatch(namespace string, resourceList k8s.ResourceList) watch {
+// A WatchID identifies a watch added to a WatchingStore, for
+// reporting.
+type WatchID struct {
+	Type      string // as in TypeStats
+	Namespace string // or k8s.AllNamespaces
+
+	// LabelSelector and FieldSelector are those of the watch's
+	// ClientOptions, if any, which tell apart watches of the same
+	// type in the same namespace.
+	LabelSelector string
+	FieldSelector string
+}
+
+func (id WatchID) String() string {
+	s := fmt.Sprintf("%s (namespace=%q", id.Type, id.Namespace)
+	if id.LabelSelector != "" {
+		s += fmt.Sprintf(", labelSelector=%q", id.LabelSelector)
+	}
+	if id.FieldSelector != "" {
+		s += fmt.Sprintf(", fieldSelector=%q", id.FieldSelector)
+	}
+	return s + ")"
+}
+
+// A SyncTimeoutError reports the watches that hadn't completed their
+// listing within the WatchingStore's SyncTimeout.
+type SyncTimeoutError struct {
+	Pending []WatchID
+}
+
+func (e *SyncTimeoutError) Error() string {
+	pending := make([]string, len(e.Pending))
+	for i, id := range e.Pending {
+		pending[i] = id.String()
+	}
+	return "sync timed out waiting for: " + strings.Join(pending, ", ")
+}
+
+func newWatch(namespace string, resourceList k8s.ResourceList) *watch {
+	if lt := lookupListType(resourceList); lt != nil {
+		list := lt.NewList()
+		return &watch{
+			namespace: namespace,
+			list:      list,
+			resource:  lt.NewItem(),
+			listType:  lt,
+		}
+	}
+
 	listType := reflect.TypeOf(resourceList)
 	if listType.Kind() != reflect.Ptr {
 		panic(errors.Errorf("k8s.ResourceList type %s isn't a pointer", listType))
@@ -70,56 +267,394 @@ func newWatch(namespace string, resourceList k8s.ResourceList) watch {
 		panic(errors.Errorf("k8s.ResourceList type %s member %s isn't a pointer", listType, itemType))
 	}
 
-	return watch{
-		namespace:    namespace,
-		resource:     reflect.New(itemType.Elem()).Interface().(k8s.Resource),
-		resourceList: reflect.New(listType.Elem()).Interface().(k8s.ResourceList),
+	list := newResourceListLike(resourceList)
+	return &watch{
+		namespace: namespace,
+		list:      list,
+		resource:  listItemSample(list),
 	}
 }
 
-func (w watch) run(ctx context.Context, client *k8s.Client, logger Logger,
-	listCh chan<- []k8s.Resource, watchCh chan<- watchEvent) {
+// defaultRetryAfter is how long to wait after a "429 Too Many
+// Requests" response that doesn't say how long to wait.
+const defaultRetryAfter = 1 * time.Second
+
+// retryAfter returns how long the apiserver asked us to wait before
+// retrying, if err is a *TooManyRequestsError.  The apiserver reports
+// the delay in the Retry-After header, and usually in the Status
+// details too; the k8s.APIError only gives us the latter, so
+// recordRetryAfter copies the former over it.
+func retryAfter(err error) (time.Duration, bool) {
+	var tooMany *TooManyRequestsError
+	if !errors.As(err, &tooMany) {
+		return 0, false
+	}
+	return tooMany.RetryAfter, true
+}
+
+// recordRetryAfter returns a Middleware that copies the delay of the
+// Retry-After header of each "429 Too Many Requests" response in to
+// the retryAfterSeconds of the Status in its body, which is all of the
+// response that the k8s.APIError made of it keeps.  An HTTP date is
+// relative to the clock's time.
+func recordRetryAfter(clock Clock) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+				return resp, err
+			}
+			seconds, ok := parseRetryAfter(resp.Header.Get("Retry-After"), clock.Now())
+			if !ok {
+				return resp, nil
+			}
+			if err := setRetryAfterSeconds(resp, seconds); err != nil {
+				return nil, err
+			}
+			return resp, nil
+		})
+	}
+}
+
+// parseRetryAfter returns the delay, in whole seconds, of a Retry-After
+// header: either a number of seconds, or an HTTP date, which is
+// relative to now.
+func parseRetryAfter(value string, now time.Time) (int32, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 32); err == nil {
+		return int32(seconds), seconds >= 0
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	d := date.Sub(now)
+	if d <= 0 {
+		return 0, true
+	}
+	return int32((d + time.Second - 1) / time.Second), true
+}
+
+// protobufMagic prefixes an object encoded in the protobuf form of the
+// Kubernetes API.
+var protobufMagic = []byte("k8s\x00")
+
+// setRetryAfterSeconds sets the retryAfterSeconds of the Status in the
+// body of the response, keeping it in whichever of protobuf or JSON it
+// is encoded in.  A body that isn't a Status is replaced by one.
+func setRetryAfterSeconds(resp *http.Response, seconds int32) error {
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return errors.Wrap(err, "read error status")
+	}
+	status := new(metav1.Status)
+	var unknown runtime.Unknown
+	isProtobuf := bytes.HasPrefix(data, protobufMagic) &&
+		unknown.Unmarshal(data[len(protobufMagic):]) == nil &&
+		proto.Unmarshal(unknown.Raw, status) == nil
+	if !isProtobuf && json.Unmarshal(data, status) != nil {
+		status = &metav1.Status{
+			Status:  k8s.String("Failure"),
+			Code:    k8s.Int32(int32(resp.StatusCode)),
+			Message: k8s.String(strings.TrimSpace(string(data))),
+		}
+	}
+	if status.Details == nil {
+		status.Details = new(metav1.StatusDetails)
+	}
+	status.Details.RetryAfterSeconds = &seconds
+	if isProtobuf {
+		if unknown.Raw, err = proto.Marshal(status); err == nil {
+			data, err = unknown.Marshal()
+			data = append(append([]byte(nil), protobufMagic...), data...)
+		}
+	} else {
+		data, err = json.Marshal(status)
+		resp.Header.Set("Content-Type", "application/json")
+	}
+	if err != nil {
+		return errors.Wrap(err, "encode error status")
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// backoff delays the next attempt if err asks us to.
+func (w *watch) backoff(ctx context.Context, err error) {
+	if d, ok := retryAfter(err); ok {
+		atomic.AddUint64(&w.throttled, 1)
+		sleep(ctx, w.clock, d)
+	}
+}
+
+// initialEventsEnd is the annotation on the BOOKMARK event that marks
+// the end of the initial events of a streaming list.
+const initialEventsEnd = "k8s.io/initial-events-end"
+
+// listOnce performs the initial listing.
+func (w *watch) listOnce(ctx context.Context) ([]k8s.Resource, string, error) {
+	list := w.newList()
+	options := ListOptions{ResourceVersion: w.minVersion, ClientOptions: w.clientOptions}
+	if err := w.backend.List(ctx, w.namespace, list, options); err != nil {
+		return nil, "", err
+	}
+	return w.items(list), list.GetMetadata().GetResourceVersion(), nil
+}
+
+// streamList performs the initial listing as a streaming list: a
+// watch that begins with an ADDED event for each existing resource,
+// followed by a bookmark.  The watch is returned to be carried on
+// with.
+func (w *watch) streamList(ctx context.Context) ([]k8s.Resource, string, Watcher, error) {
+	watcher, err := w.backend.Watch(ctx, w.namespace, w.list, ListOptions{
+		ResourceVersion:   w.minVersion,
+		SendInitialEvents: true,
+		AllowBookmarks:    true,
+		ClientOptions:     w.clientOptions,
+	})
+	if err != nil {
+		return nil, "", nil, err
+	}
+	var items []k8s.Resource
+	for {
+		resource := w.newResource()
+		eventType, err := watcher.Next(resource)
+		if err != nil {
+			_ = watcher.Close()
+			return nil, "", nil, err
+		}
+		switch eventType {
+		case k8s.EventAdded:
+			items = append(items, resource)
+		case eventBookmark:
+			if resource.GetMetadata().GetAnnotations()[initialEventsEnd] == "true" {
+				return items, resource.GetMetadata().GetResourceVersion(), watcher, nil
+			}
+		default:
+			_ = watcher.Close()
+			return nil, "", nil, errors.Errorf("unexpected %s event during initial events", eventType)
+		}
+	}
+}
+
+// optionalRetryInterval is how often an unavailable optional watch
+// retries its listing.
+const optionalRetryInterval = 30 * time.Second
+
+// isUnavailable returns whether err means that the watched type can't
+// be listed at all: because we aren't allowed to, or because it isn't
+// installed.
+func isUnavailable(err error) bool {
+	code := apiErrorCode(err)
+	return code == http.StatusForbidden || code == http.StatusNotFound
+}
+
+// isRejected returns whether err is the apiserver rejecting the
+// parameters of a request, rather than failing to carry it out.
+func isRejected(err error) bool {
+	code := apiErrorCode(err)
+	return code == http.StatusBadRequest || code == http.StatusUnprocessableEntity
+}
+
+// classify wraps err, from attempting the verb, in the typed error
+// that describes it.
+func (w *watch) classify(err error, verb string) error {
+	if err == nil {
+		return nil
+	}
+	return classifyError(err, verb, w.gvr, w.namespace)
+}
+
+func (w *watch) run(ctx context.Context, logger Logger,
+	listCh chan<- listing, watchCh chan<- watchEvent) {
+
+	var queue *eventQueue
+	if w.overflow == OverflowCoalesce {
+		queue = newEventQueue()
+		qctx, cancel := context.WithCancel(ctx)
+		forwarded := make(chan struct{})
+		go func() {
+			queue.forward(qctx, watchCh)
+			close(forwarded)
+		}()
+		defer func() {
+			cancel()
+			<-forwarded
+		}()
+	}
 
 	var resourceVersion string
+	var watcher Watcher
+	reported := false // whether an unavailable optional watch has sent an empty listing
+	w.state.newRound(w.clock.Now(), w.bookmarks)
+	w.loadCheckpoint(ctx, logger)
+relist: // with OverflowRelist, when Run falls behind
 	for {
 		if ctx.Err() != nil {
 			return
 		}
-		list := getNewResourceListInstance(w.resourceList)
-		if err := client.List(ctx, w.namespace, list); err != nil {
-			logger.Errorf("list %s (namespace=%q): %v", reflect.TypeOf(w.resource), w.namespace, err)
+		if !w.limiter.acquire(ctx, w) {
+			continue
+		}
+		var items []k8s.Resource
+		var err error
+		if w.streamingList {
+			items, resourceVersion, watcher, err = w.streamList(ctx)
+			w.limiter.release()
+			err = w.classify(err, "watch")
+			if isRejected(err) && w.minVersion == "" {
+				logger.Errorf("stream list %s: falling back to list: %v", w.id(), err)
+				w.streamingList = false
+				continue
+			}
+		} else {
+			items, resourceVersion, err = w.listOnce(ctx)
+			w.limiter.release()
+			err = w.classify(err, "list")
+		}
+		if err != nil && w.minVersion != "" && isStaleCheckpoint(err) {
+			logger.Errorf("list %s: ignoring checkpoint at resourceVersion %s: %v", w.id(), w.minVersion, err)
+			w.minVersion = ""
 			continue
 		}
-		resourceVersion = list.GetMetadata().GetResourceVersion()
-		listCh <- getResourceListItems(list)
+		if err != nil && ctx.Err() == nil {
+			w.state.failed(w.clock.Now(), err)
+			if !w.optional || !isUnavailable(err) {
+				w.breaker.failure(w.clock.Now(), w, err)
+			}
+		}
+		if err != nil && w.optional && isUnavailable(err) {
+			if !reported {
+				logger.Errorf("list %s: unavailable, will keep retrying: %v", w.id(), err)
+				atomic.StoreInt32(&w.unavailable, 1)
+				listCh <- listing{w, nil, w.relists}
+				reported = true
+			}
+			sleep(ctx, w.clock, optionalRetryInterval)
+			continue
+		}
+		if err != nil {
+			logger.Errorf("list %s: %v", w.id(), err)
+			w.backoff(ctx, err)
+			continue
+		}
+		atomic.StoreInt32(&w.unavailable, 0)
+		items = w.normalizeItems(logger, items)
+		w.listed(items)
+		listCh <- listing{w, items, w.relists}
+		w.state.listed(resourceVersion)
+		w.minVersion = ""
+		w.checkpoint(ctx, logger, resourceVersion, true)
+		w.breaker.success()
 		break
 	}
 	for {
 		if ctx.Err() != nil {
+			if watcher != nil {
+				_ = watcher.Close()
+			}
 			return
 		}
-		watcher, err := client.Watch(ctx, w.namespace, getNewResourceInstance(w.resource),
-			k8s.ResourceVersion(resourceVersion))
-		if err != nil {
-			logger.Errorf("create %s (namespace=%q) watch: %v", reflect.TypeOf(w.resource), w.namespace, err)
-			if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusGone {
-				return
+		if watcher == nil {
+			w.pauser.wait(ctx)
+			if ctx.Err() != nil {
+				continue
+			}
+			var err error
+			watcher, err = w.backend.Watch(ctx, w.namespace, w.list, ListOptions{
+				ResourceVersion: resourceVersion,
+				AllowBookmarks:  w.bookmarks,
+				ClientOptions:   w.clientOptions,
+			})
+			if err != nil {
+				err = w.classify(err, "watch")
+				if ctx.Err() == nil {
+					w.state.failed(w.clock.Now(), err)
+					w.breaker.failure(w.clock.Now(), w, err)
+				}
+				logger.Errorf("create %s watch: %v", w.id(), err)
+				watcher = nil
+				if errors.Is(err, ErrWatchExpired) {
+					return
+				}
+				w.backoff(ctx, err)
+				continue
 			}
-			continue
 		}
+		w.state.watching()
+		w.breaker.success()
+		w.pauser.setWatcher(watcher)
 		for {
-			resource := getNewResourceInstance(w.resource)
+			resource := w.newResource()
 			eventType, err := watcher.Next(resource)
+			if err != nil && w.pauser.tookWatcher() {
+				// Pause disconnected us.
+				w.pauser.setWatcher(nil)
+				watcher = nil
+				break
+			}
 			if err != nil {
-				logger.Errorf("read %s (namespace=%q) watch: %v", reflect.TypeOf(w.resource), w.namespace, err)
+				err = w.classify(err, "watch")
+				if ctx.Err() == nil {
+					w.state.failed(w.clock.Now(), err)
+					w.breaker.failure(w.clock.Now(), w, err)
+				}
+				logger.Errorf("read %s watch: %v", w.id(), err)
+				w.pauser.setWatcher(nil)
 				_ = watcher.Close()
-				if apiErr, ok := err.(*k8s.APIError); ok && apiErr.Code == http.StatusGone {
+				watcher = nil
+				if errors.Is(err, ErrWatchExpired) {
 					return
 				}
+				w.backoff(ctx, err)
 				break
 			}
 			resourceVersion = resource.GetMetadata().GetResourceVersion()
-			watchCh <- watchEvent{eventType, resource}
+			w.state.event(w.clock.Now(), eventType, resource)
+			w.checkpoint(ctx, logger, resourceVersion, eventType == eventBookmark)
+			if eventType == eventBookmark {
+				// A bookmark only carries a resourceVersion.
+				continue
+			}
+			normalized, err := w.normalizeResource(resource)
+			if err != nil {
+				w.logDropped(logger, resource, err)
+				continue
+			}
+			if !w.keeps(normalized) {
+				// Drop it, in case an earlier version was
+				// kept.
+				eventType = k8s.EventDeleted
+			}
+			statusOnly := w.statusOnly(eventType, normalized)
+			w.pauser.wait(ctx)
+			event := watchEvent{w, eventType, normalized, statusOnly, w.relists}
+			switch w.overflow {
+			case OverflowCoalesce:
+				if queue.put(event) {
+					atomic.AddUint64(&w.overflows, 1)
+				}
+			case OverflowRelist:
+				select {
+				case watchCh <- event:
+					continue
+				default:
+				}
+				atomic.AddUint64(&w.overflows, 1)
+				logger.Errorf("%s watch: event buffer full, dropping events to list again", w.id())
+				w.pauser.setWatcher(nil)
+				_ = watcher.Close()
+				watcher = nil
+				w.relists++
+				goto relist
+			default:
+				watchCh <- event
+			}
 		}
 	}
 }
@@ -0,0 +1,539 @@
+// Copyright 2019 Datawire. All rights reserved.
+
+package k8sutil_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+
+	"github.com/datawire/k8sutil"
+)
+
+// testLogger is a k8sutil.Logger that logs to the test.
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Errorf(format string, args ...interface{}) {
+	l.t.Logf(format, args...)
+}
+
+// newConfigMap returns a ConfigMap with the name and namespace, and data
+// of the pairs of keys and values.
+func newConfigMap(namespace, name string, data ...string) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		Metadata: &metav1.ObjectMeta{Namespace: k8s.String(namespace), Name: k8s.String(name)},
+	}
+	for i := 0; i+1 < len(data); i += 2 {
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[data[i]] = data[i+1]
+	}
+	return cm
+}
+
+// runStore runs the WatchingStore until the end of the test.
+func runStore(t *testing.T, w *k8sutil.WatchingStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = w.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// TestRetryAfter checks that a watch waits as long as a "429 Too Many
+// Requests" response's Retry-After header asks, in preference to its
+// Status details, before listing or watching again.
+func TestRetryAfter(t *testing.T) {
+	for _, verb := range []string{"list", "watch"} {
+		t.Run(verb, func(t *testing.T) {
+			server := newFakeAPIServer(t)
+			server.set(newConfigMap("default", "a"))
+			server.setFailure(verb, failure{
+				code:    http.StatusTooManyRequests,
+				header:  http.Header{"Retry-After": {"1"}},
+				details: &metav1.StatusDetails{RetryAfterSeconds: k8s.Int32(60)},
+			})
+			w := &k8sutil.WatchingStore{
+				Client:   server.client(),
+				Logger:   testLogger{t},
+				Callback: func(k8sutil.Store) {},
+			}
+			w.AddWatch("default", &corev1.ConfigMapList{})
+			runStore(t, w)
+
+			server.await(verb)
+			start := time.Now()
+			server.setFailure(verb, failure{})
+			server.await(verb)
+			if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+				t.Errorf("retried after %v, before the Retry-After of 1s", elapsed)
+			}
+			if n := w.Throttled(); n != 1 {
+				t.Errorf("Throttled: got %d, want 1", n)
+			}
+		})
+	}
+}
+
+// TestUserAgent checks that a watch's requests have the UserAgent,
+// with a comment identifying the watch.
+func TestUserAgent(t *testing.T) {
+	server := newFakeAPIServer(t)
+	w := &k8sutil.WatchingStore{
+		Client:    server.client(),
+		Logger:    testLogger{t},
+		Callback:  func(k8sutil.Store) {},
+		UserAgent: "test/1.0",
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{})
+	runStore(t, w)
+	want := "test/1.0 (k8sutil watch=v1 ConfigMap; namespace=*)"
+	for _, verb := range []string{"list", "watch"} {
+		if got := server.await(verb).header.Get("User-Agent"); got != want {
+			t.Errorf("%s: got User-Agent %q, want %q", verb, got, want)
+		}
+	}
+}
+
+// TestProtobuf checks that lists and watches of built-in types ask for
+// protobuf.
+func TestProtobuf(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a", "k", "v"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	for _, verb := range []string{"list", "watch"} {
+		if accept := server.await(verb).header.Get("Accept"); accept != "application/vnd.kubernetes.protobuf" {
+			t.Errorf("%s: got Accept %q", verb, accept)
+		}
+	}
+	resources := (<-stores).List(&corev1.ConfigMap{})
+	if len(resources) != 1 || resources[0].(*corev1.ConfigMap).Data["k"] != "v" {
+		t.Errorf("got %v", resources)
+	}
+}
+
+// TestStreamingList checks that a StreamingList watch begins with a
+// streaming list, and carries on with that watch, if the server allows
+// it, and otherwise falls back to a list.
+func TestStreamingList(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		minor     string
+		watchList bool
+		requests  []string // the first requests: "stream", "list", or "watch"
+	}{
+		{"streaming", "27", true, []string{"stream"}},
+		{"rejected", "27", false, []string{"stream", "list", "watch"}},
+		{"old server", "26", true, []string{"list", "watch"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeAPIServer(t)
+			server.setRelease("1", tc.minor)
+			server.setWatchList(tc.watchList)
+			server.set(newConfigMap("default", "a", "k", "v"))
+			stores := make(chan k8sutil.Store, 10)
+			w := &k8sutil.WatchingStore{
+				Client:        server.client(),
+				Logger:        testLogger{t},
+				Callback:      func(s k8sutil.Store) { stores <- s },
+				StreamingList: true,
+			}
+			w.AddWatch("default", &corev1.ConfigMapList{})
+			runStore(t, w)
+
+			for _, want := range tc.requests {
+				verb := want
+				if want == "stream" {
+					verb = "watch"
+				}
+				r := server.await(verb)
+				if streaming := strings.Contains(r.line, "sendInitialEvents=true"); streaming != (want == "stream") {
+					t.Errorf("want a %s: got %s", want, r.line)
+				}
+			}
+			resources := (<-stores).List(&corev1.ConfigMap{})
+			if len(resources) != 1 || resources[0].(*corev1.ConfigMap).Data["k"] != "v" {
+				t.Errorf("got %v", resources)
+			}
+
+			server.set(newConfigMap("default", "b"))
+			if resources := (<-stores).List(&corev1.ConfigMap{}); len(resources) != 2 {
+				t.Errorf("got %v", resources)
+			}
+			for _, line := range server.drain() {
+				t.Errorf("unexpected request: %s", line)
+			}
+		})
+	}
+}
+
+// TestLazyDecode checks that a LazyDecode store decodes what it stores,
+// including once the objects have been evicted from its decode cache.
+func TestLazyDecode(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a", "k", "a"))
+	server.set(newConfigMap("default", "b", "k", "b"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:          server.client(),
+		Logger:          testLogger{t},
+		Callback:        func(s k8sutil.Store) { stores <- s },
+		LazyDecode:      true,
+		DecodeCacheSize: 1,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	store := <-stores
+	for i := 0; i < 3; i++ {
+		got := map[string]string{}
+		for _, resource := range store.List(&corev1.ConfigMap{}) {
+			cm := resource.(*corev1.ConfigMap)
+			got[cm.GetMetadata().GetName()] = cm.Data["k"]
+		}
+		if len(got) != 2 || got["a"] != "a" || got["b"] != "b" {
+			t.Errorf("got %v", got)
+		}
+	}
+}
+
+// TestStats checks that Stats counts the stored resources of each type.
+func TestStats(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a", "k", "v"))
+	server.set(newConfigMap("default", "b"))
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("default")}})
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{})
+	if stats := w.Stats(); len(stats.Types) != 0 || stats.Objects != 0 {
+		t.Errorf("before Run: got %+v", stats)
+	}
+	runStore(t, w)
+	store := <-stores
+
+	stats := w.Stats()
+	if len(stats.Types) != 2 {
+		t.Fatalf("got %+v", stats)
+	}
+	bytes := 0
+	for i, want := range []struct {
+		name    string
+		objects int
+	}{{"v1 ConfigMap", 2}, {"v1 Namespace", 1}} {
+		got := stats.Types[i]
+		if got.Type != want.name || got.Objects != want.objects || got.Bytes <= 0 {
+			t.Errorf("got %+v, want %d %s", got, want.objects, want.name)
+		}
+		bytes += got.Bytes
+	}
+	if stats.Objects != 3 || stats.Bytes != bytes {
+		t.Errorf("got totals %d objects, %d bytes", stats.Objects, stats.Bytes)
+	}
+	if n := len(store.List(stats.Types[0].Sample)); n != 2 {
+		t.Errorf("listing the Sample: got %d", n)
+	}
+}
+
+// TestSnapshot checks that the Store passed to the Callback doesn't
+// change as the store is updated, even while it is being listed.
+func TestSnapshot(t *testing.T) {
+	server := newFakeAPIServer(t)
+	for i := 0; i < 50; i++ {
+		server.set(newConfigMap("default", fmt.Sprintf("cm-%d", i), "k", "v"))
+	}
+	stores := make(chan k8sutil.Store, 100)
+	w := &k8sutil.WatchingStore{
+		Client:     server.client(),
+		Logger:     testLogger{t},
+		Callback:   func(s k8sutil.Store) { stores <- s },
+		LazyDecode: true,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	first := <-stores
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 60; i++ {
+			server.set(newConfigMap("default", fmt.Sprintf("cm-%d", i)))
+		}
+	}()
+	store := first
+	for {
+		resources := first.List(&corev1.ConfigMap{})
+		if len(resources) != 50 {
+			t.Fatalf("first snapshot changed to %d resources", len(resources))
+		}
+		for _, resource := range resources {
+			if resource.(*corev1.ConfigMap).Data["k"] != "v" {
+				t.Fatalf("first snapshot changed: %v", resource)
+			}
+		}
+		if len(store.List(&corev1.ConfigMap{})) == 60 {
+			break
+		}
+		select {
+		case store = <-stores:
+		case <-time.After(timeout):
+			t.Fatalf("timed out")
+		}
+	}
+	<-done
+}
+
+// TestSequence checks that each Store passed to the Callback has the
+// next Sequence.
+func TestSequence(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	first := <-stores
+	if seq := first.Sequence(); seq != 1 {
+		t.Errorf("first Sequence: got %d, want 1", seq)
+	}
+	server.set(newConfigMap("default", "b"))
+	if seq := (<-stores).Sequence(); seq != 2 {
+		t.Errorf("second Sequence: got %d, want 2", seq)
+	}
+	if seq := first.Sequence(); seq != 1 {
+		t.Errorf("first Sequence changed to %d", seq)
+	}
+}
+
+// TestListSorted checks that ListSorted sorts by namespace, then name.
+func TestListSorted(t *testing.T) {
+	server := newFakeAPIServer(t)
+	for _, key := range [][2]string{{"b", "a"}, {"a", "c"}, {"a", "b"}, {"b", "b"}} {
+		server.set(newConfigMap(key[0], key[1]))
+	}
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{})
+	runStore(t, w)
+	var got []string
+	for _, resource := range (<-stores).ListSorted(&corev1.ConfigMap{}) {
+		got = append(got, resource.GetMetadata().GetNamespace()+"/"+resource.GetMetadata().GetName())
+	}
+	if want := []string{"a/b", "a/c", "b/a", "b/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestAll checks that All iterates over the stored resources, decoding
+// those of a LazyDecode store, and stops when told to.
+func TestAll(t *testing.T) {
+	server := newFakeAPIServer(t)
+	for _, name := range []string{"a", "b", "c"} {
+		server.set(newConfigMap("default", name, "k", name))
+	}
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:     server.client(),
+		Logger:     testLogger{t},
+		Callback:   func(s k8sutil.Store) { stores <- s },
+		LazyDecode: true,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	runStore(t, w)
+	store := <-stores
+	got := map[string]string{}
+	store.All(&corev1.ConfigMap{})(func(resource k8s.Resource) bool {
+		cm := resource.(*corev1.ConfigMap)
+		got[cm.GetMetadata().GetName()] = cm.Data["k"]
+		return true
+	})
+	if want := map[string]string{"a": "a", "b": "b", "c": "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	n := 0
+	store.All(&corev1.ConfigMap{})(func(k8s.Resource) bool {
+		n++
+		return n < 2
+	})
+	if n != 2 {
+		t.Errorf("yielded %d resources after being told to stop at 2", n)
+	}
+	store.All(&corev1.Namespace{})(func(k8s.Resource) bool {
+		t.Errorf("yielded an unwatched type")
+		return true
+	})
+}
+
+// TestKeys checks Keys and Count.
+func TestKeys(t *testing.T) {
+	server := newFakeAPIServer(t)
+	for _, key := range [][2]string{{"b", "a"}, {"a", "b"}} {
+		server.set(newConfigMap(key[0], key[1]))
+	}
+	server.set(&corev1.Namespace{Metadata: &metav1.ObjectMeta{Name: k8s.String("a")}})
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch(k8s.AllNamespaces, &corev1.ConfigMapList{})
+	w.AddWatch(k8s.AllNamespaces, &corev1.NamespaceList{})
+	runStore(t, w)
+	store := <-stores
+	want := []k8sutil.ObjectKey{{Namespace: "a", Name: "b"}, {Namespace: "b", Name: "a"}}
+	if got := store.Keys(&corev1.ConfigMap{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys: got %v, want %v", got, want)
+	}
+	if got := store.Keys(&corev1.Namespace{}); len(got) != 1 || got[0].String() != "a" {
+		t.Errorf("Keys of namespaces: got %v", got)
+	}
+	if n := store.Count(&corev1.ConfigMap{}); n != 2 {
+		t.Errorf("Count: got %d, want 2", n)
+	}
+	if n := store.Count(&corev1.Secret{}); n != 0 {
+		t.Errorf("Count of an unwatched type: got %d, want 0", n)
+	}
+	if s := want[0].String(); s != "a/b" {
+		t.Errorf("String: got %q", s)
+	}
+}
+
+// chanLogger is a k8sutil.Logger that sends what it logs to a channel,
+// as well as logging it to the test.
+type chanLogger struct {
+	t  *testing.T
+	ch chan string
+}
+
+func (l chanLogger) Errorf(format string, args ...interface{}) {
+	l.t.Logf(format, args...)
+	select {
+	case l.ch <- fmt.Sprintf(format, args...):
+	default:
+	}
+}
+
+// TestSyncTimeout checks that a watch that can't list is reported once
+// the SyncTimeout passes, and that SyncPartial carries on without it.
+// The fake apiserver doesn't serve Secrets, so their watch can't list.
+func TestSyncTimeout(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	logs := make(chan string, 100)
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:      server.client(),
+		Logger:      chanLogger{t, logs},
+		Callback:    func(s k8sutil.Store) { stores <- s },
+		SyncTimeout: 200 * time.Millisecond,
+		SyncPartial: true,
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddWatch("default", &corev1.SecretList{})
+	runStore(t, w)
+
+	want := `sync timed out waiting for: v1 Secret (namespace="default")`
+	for found := false; !found; {
+		select {
+		case line := <-logs:
+			found = line == want
+		case <-time.After(timeout):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	if n := (<-stores).Count(&corev1.ConfigMap{}); n != 1 {
+		t.Errorf("got %d ConfigMaps", n)
+	}
+}
+
+// TestOptionalWatch checks that an optional watch of a type that the
+// apiserver doesn't serve doesn't hold up the others, and is reported
+// as unavailable.
+func TestOptionalWatch(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	w.AddOptionalWatch("default", &corev1.SecretList{})
+	runStore(t, w)
+
+	select {
+	case s := <-stores:
+		if n := s.Count(&corev1.ConfigMap{}); n != 1 {
+			t.Errorf("got %d ConfigMaps", n)
+		}
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for the optional watch")
+	}
+	want := []k8sutil.WatchID{{Type: "v1 Secret", Namespace: "default"}}
+	if got := w.Unavailable(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got unavailable %v, want %v", got, want)
+	}
+}
+
+// TestSnapshotNotSynced checks that Snapshot is ErrNotSynced until the
+// first Callback, and the store that it was passed after.
+func TestSnapshotNotSynced(t *testing.T) {
+	server := newFakeAPIServer(t)
+	server.set(newConfigMap("default", "a"))
+	stores := make(chan k8sutil.Store, 10)
+	w := &k8sutil.WatchingStore{
+		Client:   server.client(),
+		Logger:   testLogger{t},
+		Callback: func(s k8sutil.Store) { stores <- s },
+	}
+	w.AddWatch("default", &corev1.ConfigMapList{})
+	if _, err := w.Snapshot(); err != k8sutil.ErrNotSynced {
+		t.Errorf("got %v before Run, want ErrNotSynced", err)
+	}
+	runStore(t, w)
+	want := <-stores
+	got, err := w.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Sequence() != want.Sequence() || got.Count(&corev1.ConfigMap{}) != 1 {
+		t.Errorf("got snapshot %d of %d ConfigMaps, want %d", got.Sequence(), got.Count(&corev1.ConfigMap{}), want.Sequence())
+	}
+}